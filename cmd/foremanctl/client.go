@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ApiErr is returned if the api server answered with an error status, Status is its code
+type ApiErr struct {
+	error
+	Status int
+}
+
+func WithApiErr(err error, status int) error {
+	return ApiErr{error: err, Status: status}
+}
+
+// apiClient calls endpoints of the saga api server, responses are returned as they are, so json output is exactly what the api serves
+type apiClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newApiClient(baseURL string, httpClient *http.Client) *apiClient {
+	return &apiClient{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+}
+
+// sagas returns a page of sagas matching the query, see status.StatusHandler.GetFilteredBy
+func (c *apiClient) sagas(ctx context.Context, query url.Values) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, "/sagas", query)
+}
+
+// saga returns the status of the saga
+func (c *apiClient) saga(ctx context.Context, sagaId string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, "/sagas/"+url.PathEscape(sagaId), nil)
+}
+
+// history returns events handled by the saga, see status.StatusHandler.GetHistory
+func (c *apiClient) history(ctx context.Context, sagaId string, query url.Values) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, "/sagas/"+url.PathEscape(sagaId)+"/history", query)
+}
+
+// control sends the recover or compensate command to the saga, see status.ControlHandler
+func (c *apiClient) control(ctx context.Context, sagaId, action string) ([]byte, error) {
+	return c.do(ctx, http.MethodPost, "/sagas/"+url.PathEscape(sagaId)+"/"+action, nil)
+}
+
+func (c *apiClient) do(ctx context.Context, method, path string, query url.Values) ([]byte, error) {
+	endpoint := c.baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating request %s %s", method, path)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s %s", method, path)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading response of %s %s", method, path)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, WithApiErr(errors.Errorf("%s %s answered %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body))), resp.StatusCode)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,104 @@
+// Command foremanctl operates sagas of a running service. Sagas are listed, inspected, recovered and compensated through the
+// api server of the saga component (component.WithSagaApiServer), dead lettered messages are redriven straight from an AMQP queue.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: foremanctl [flags] <command> [command flags] [args]
+
+Commands:
+  list                      list sagas, filtered by -status, -type, -parent, -entity, -q
+  show <saga id>            show the status of a saga
+  history <saga id>         show events handled by a saga, filtered by -event-type, -from, -to
+  recover <saga id>...      send RecoverSagaCommand to failed sagas
+  compensate <saga id>...   send CompensateSagaCommand to failed sagas
+  redrive                   send dead lettered messages of an AMQP queue back to queues they failed in
+
+Flags:
+  -api string        address of the saga api server, FOREMAN_API by default (default "http://localhost:8080")
+  -o string          output format: table or json (default "table")
+  -timeout duration  timeout of a request to the api server (default 30s)
+
+Run 'foremanctl <command> -h' for flags of a command.
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdout)
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "foremanctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("foremanctl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+	}
+
+	apiURL := flags.String("api", envOr("FOREMAN_API", "http://localhost:8080"), "")
+	format := flags.String("o", formatTable, "")
+	timeout := flags.Duration("timeout", 30*time.Second, "")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("command is missing")
+	}
+
+	if *format != formatTable && *format != formatJSON {
+		return errors.Errorf("unknown output format '%s', expected table or json", *format)
+	}
+
+	p := &printer{out: out, format: *format}
+	client := newApiClient(*apiURL, &http.Client{Timeout: *timeout})
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "list":
+		return listSagas(ctx, client, p, commandArgs)
+	case "show":
+		return showSaga(ctx, client, p, commandArgs)
+	case "history":
+		return showHistory(ctx, client, p, commandArgs)
+	case recoverCommand, compensateCommand:
+		return control(ctx, client, p, command, commandArgs)
+	case "redrive":
+		return redriveQueue(ctx, p, commandArgs)
+	case "help":
+		fmt.Fprint(out, usage)
+		return nil
+	default:
+		return errors.Errorf("unknown command '%s', run 'foremanctl help' for the list of commands", command)
+	}
+}
+
+func envOr(key, defaultVal string) string {
+	if val, exists := os.LookupEnv(key); exists {
+		return val
+	}
+
+	return defaultVal
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommands(t *testing.T) {
+	var requests []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sagas", func(resp http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.String())
+		_, _ = resp.Write([]byte(`{"total":3,"items":[
+			{"saga_uid":"1","status":"failed","payload":{"group":"orders","kind":"OrderSaga","orderId":"a"},"events":[{"uid":"e1"},{"uid":"e2"}]},
+			{"saga_uid":"2","status":"failed","payload":{"group":"orders","kind":"OrderSaga","orderId":"b"},"events":[]}
+		],"next_cursor":"Y3Vyc29yOjI"}`))
+	})
+	mux.HandleFunc("/sagas/", func(resp http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.String())
+
+		switch r.URL.Path {
+		case "/sagas/1":
+			_, _ = resp.Write([]byte(`{"saga_uid":"1","status":"failed","payload":{"group":"orders","kind":"OrderSaga"},"events":[{"uid":"e1"}],"entity_refs":[{"kind":"order","id":"a"}]}`))
+		case "/sagas/1/history":
+			_, _ = resp.Write([]byte(`{"saga_uid":"1","status":"failed","total":2,"events":[
+				{"uid":"e1","event_type":"orders.OrderPlaced","created_at":"2026-10-16T10:00:00Z","origin":"orders","trace_uid":"m1","status":"in_progress","previous_status":"created","status_changed":true},
+				{"uid":"e2","event_type":"orders.PaymentFailed","created_at":"2026-10-16T10:01:00Z","origin":"payments","trace_uid":"m2","status":"failed","previous_status":"in_progress","status_changed":true}
+			]}`))
+		case "/sagas/1/recover":
+			resp.WriteHeader(http.StatusAccepted)
+			_, _ = resp.Write([]byte(`{"saga_uid":"1","action":"recover"}`))
+		default:
+			resp.WriteHeader(http.StatusConflict)
+			_, _ = resp.Write([]byte(`saga '2' has status 'in_progress', it can't be recovered`))
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+
+	runCmd := func(args ...string) (string, error) {
+		requests = nil
+		out := &bytes.Buffer{}
+		err := run(ctx, append([]string{"-api", server.URL}, args...), out)
+
+		return out.String(), err
+	}
+
+	t.Run("list sagas as a table", func(t *testing.T) {
+		out, err := runCmd("list", "-status", "failed", "-type", "orders.OrderSaga", "-limit", "2")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"GET /sagas?limit=2&sagaType=orders.OrderSaga&status=failed"}, requests)
+		assert.Equal(t, "SAGA UID  TYPE              STATUS  EVENTS\n"+
+			"1         orders.OrderSaga  failed  2\n"+
+			"2         orders.OrderSaga  failed  0\n"+
+			"\n2 of 3 sagas\n"+
+			"next page: -cursor Y3Vyc29yOjI\n", out)
+	})
+
+	t.Run("list sagas as json", func(t *testing.T) {
+		out, err := runCmd("-o", "json", "list")
+		require.NoError(t, err)
+		assert.Contains(t, out, `"orderId": "a"`)
+	})
+
+	t.Run("show a saga", func(t *testing.T) {
+		out, err := runCmd("show", "1")
+		require.NoError(t, err)
+		assert.Contains(t, out, "type      orders.OrderSaga\n")
+		assert.Contains(t, out, "entities  order:a\n")
+	})
+
+	t.Run("show history of a saga", func(t *testing.T) {
+		out, err := runCmd("history", "-event-type", "PaymentFailed", "1")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"GET /sagas/1/history?eventType=PaymentFailed"}, requests)
+		assert.Contains(t, out, "2026-10-16T10:01:00Z  orders.PaymentFailed  in_progress -> failed   payments  m2\n")
+		assert.Contains(t, out, "saga 1 is failed, 2 of 2 events\n")
+	})
+
+	t.Run("recover sagas", func(t *testing.T) {
+		out, err := runCmd("recover", "1", "2")
+		assert.EqualError(t, err, "1 of 2 recover commands weren't sent")
+
+		assert.Equal(t, []string{"POST /sagas/1/recover", "POST /sagas/2/recover"}, requests)
+		assert.Contains(t, out, "1         recover  sent\n")
+		assert.Contains(t, out, "POST /sagas/2/recover answered 409: saga '2' has status 'in_progress', it can't be recovered\n")
+	})
+
+	t.Run("api error", func(t *testing.T) {
+		_, err := runCmd("show", "2")
+		require.Error(t, err)
+		assert.IsType(t, ApiErr{}, err)
+		assert.Equal(t, http.StatusConflict, err.(ApiErr).Status)
+	})
+
+	t.Run("invalid usage", func(t *testing.T) {
+		_, err := runCmd()
+		assert.EqualError(t, err, "command is missing")
+
+		_, err = runCmd("purge")
+		assert.EqualError(t, err, "unknown command 'purge', run 'foremanctl help' for the list of commands")
+
+		_, err = runCmd("-o", "yaml", "list")
+		assert.EqualError(t, err, "unknown output format 'yaml', expected table or json")
+
+		_, err = runCmd("history")
+		assert.EqualError(t, err, "history requires a saga id")
+
+		_, err = runCmd("compensate")
+		assert.EqualError(t, err, "compensate requires ids of sagas")
+		assert.Empty(t, requests)
+	})
+}
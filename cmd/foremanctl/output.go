@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printer writes results of commands as aligned tables or as indented json
+type printer struct {
+	out    io.Writer
+	format string
+}
+
+func (p *printer) json() bool {
+	return p.format == formatJSON
+}
+
+// raw writes a json response of the api server indented
+func (p *printer) raw(body []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return errors.Wrap(err, "indenting response of the api server")
+	}
+
+	indented.WriteByte('\n')
+	_, err := indented.WriteTo(p.out)
+
+	return err
+}
+
+// value writes v encoded into json
+func (p *printer) value(v interface{}) error {
+	encoder := json.NewEncoder(p.out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// table writes rows aligned by columns under the header
+func (p *printer) table(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// line writes a line below a table, e.g. a total
+func (p *printer) line(format string, args ...interface{}) {
+	fmt.Fprintf(p.out, format+"\n", args...)
+}
+
+func orDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+
+	return val
+}
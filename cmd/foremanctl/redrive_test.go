@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type acknowledger struct {
+	acked []uint64
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+type published struct {
+	key string
+	msg amqp.Publishing
+}
+
+type fakeChannel struct {
+	queued     []amqp.Delivery
+	published  []published
+	publishErr error
+}
+
+func (c *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if len(c.queued) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	delivery := c.queued[0]
+	c.queued = c.queued[1:]
+
+	return delivery, true, nil
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if c.publishErr != nil {
+		return c.publishErr
+	}
+
+	c.published = append(c.published, published{key: key, msg: msg})
+
+	return nil
+}
+
+func TestRedriver(t *testing.T) {
+	ctx := context.Background()
+
+	deadLettered := func(ack *acknowledger, tag uint64, uid, origin string) amqp.Delivery {
+		headers := amqp.Table{
+			"uid":                          uid,
+			message.AttemptsHeader:         int32(3),
+			subscriber.FailureReasonHeader: "payment service is down",
+			subscriber.FailedHandlerHeader: "handlers.SagaEventsHandler",
+			subscriber.FailedAtHeader:      int64(1760000000000),
+			message.RedrivenHeader:         int32(1),
+		}
+
+		if origin != "" {
+			headers[subscriber.FailureOriginHeader] = origin
+		}
+
+		return amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, Headers: headers, ContentType: "application/json", Body: []byte(`{"kind":"OrderPlaced"}`)}
+	}
+
+	t.Run("messages are published into queues they failed in", func(t *testing.T) {
+		ack := &acknowledger{}
+		ch := &fakeChannel{queued: []amqp.Delivery{deadLettered(ack, 1, "1", "orders"), deadLettered(ack, 2, "2", ""), deadLettered(ack, 3, "3", "payments")}}
+
+		results, err := redriver{channel: ch}.redrive(ctx, "dead_letters", 2)
+		require.NoError(t, err)
+
+		assert.Equal(t, []redriveResult{
+			{UID: "1", To: "orders", Reason: "payment service is down"},
+			{UID: "2", Reason: "payment service is down", Error: "queue the message failed in is unknown, set it with -to"},
+		}, results)
+		assert.Len(t, ch.queued, 1, "messages over the limit aren't taken")
+		assert.Equal(t, []uint64{1}, ack.acked)
+
+		require.Len(t, ch.published, 1)
+		assert.Equal(t, "orders", ch.published[0].key)
+		assert.Equal(t, []byte(`{"kind":"OrderPlaced"}`), ch.published[0].msg.Body)
+		assert.Equal(t, "application/json", ch.published[0].msg.ContentType)
+		assert.Equal(t, amqp.Table{"uid": "1", message.RedrivenHeader: int64(2)}, ch.published[0].msg.Headers)
+
+		assert.EqualError(t, redriveErr(results), "1 of 2 messages weren't redriven")
+	})
+
+	t.Run("target queue is overridden", func(t *testing.T) {
+		ack := &acknowledger{}
+		ch := &fakeChannel{queued: []amqp.Delivery{deadLettered(ack, 1, "1", "orders")}}
+
+		results, err := redriver{channel: ch, to: "orders_v2"}.redrive(ctx, "dead_letters", 10)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "orders_v2", ch.published[0].key)
+	})
+
+	t.Run("dry run doesn't publish or ack", func(t *testing.T) {
+		ack := &acknowledger{}
+		ch := &fakeChannel{queued: []amqp.Delivery{deadLettered(ack, 1, "1", "orders")}}
+
+		results, err := redriver{channel: ch, dryRun: true}.redrive(ctx, "dead_letters", 10)
+		require.NoError(t, err)
+		assert.Equal(t, []redriveResult{{UID: "1", To: "orders", Reason: "payment service is down"}}, results)
+		assert.Empty(t, ch.published)
+		assert.Empty(t, ack.acked)
+
+		out := &bytes.Buffer{}
+		require.NoError(t, printRedrive(&printer{out: out, format: formatTable}, results, true))
+		assert.Contains(t, out.String(), "1    orders  payment service is down  would be redriven\n")
+	})
+
+	t.Run("message which isn't published isn't acked", func(t *testing.T) {
+		ack := &acknowledger{}
+		ch := &fakeChannel{queued: []amqp.Delivery{deadLettered(ack, 1, "1", "orders")}, publishErr: errors.New("message was nacked by the broker")}
+
+		results, err := redriver{channel: ch}.redrive(ctx, "dead_letters", 10)
+		require.NoError(t, err)
+		assert.Equal(t, "publishing into queue 'orders': message was nacked by the broker", results[0].Error)
+		assert.Empty(t, ack.acked)
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/api/handlers/status"
+	"github.com/pkg/errors"
+)
+
+const (
+	recoverCommand    = "recover"
+	compensateCommand = "compensate"
+)
+
+// sagaView is a saga as it's served by the api server, the saga itself is decoded only up to its type
+type sagaView struct {
+	SagaUID    string            `json:"saga_uid"`
+	Status     string            `json:"status"`
+	Payload    scheme.TypeMeta   `json:"payload"`
+	Events     []json.RawMessage `json:"events"`
+	EntityRefs []saga.EntityRef  `json:"entity_refs"`
+}
+
+func (v sagaView) sagaType() string {
+	if v.Payload.Kind == "" {
+		return ""
+	}
+
+	return scheme.GroupKind{Group: scheme.Group(v.Payload.Group), Kind: v.Payload.Kind}.String()
+}
+
+type sagaListView struct {
+	Total      int        `json:"total"`
+	Items      []sagaView `json:"items"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+func listSagas(ctx context.Context, client *apiClient, p *printer, args []string) error {
+	flags := newCommandFlags("list")
+	sagaStatus := flags.String("status", "", "status of sagas, e.g. failed")
+	sagaType := flags.String("type", "", "type of sagas, group.kind")
+	parentId := flags.String("parent", "", "id of the parent saga")
+	entity := flags.String("entity", "", "entity referenced by sagas, kind:id")
+	search := flags.String("q", "", "text contained in data of sagas")
+	limit := flags.Int("limit", 50, "max number of sagas")
+	cursor := flags.String("cursor", "", "cursor of the next page printed by the previous call")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	setIfNotEmpty(query, "status", *sagaStatus)
+	setIfNotEmpty(query, "sagaType", *sagaType)
+	setIfNotEmpty(query, "parentId", *parentId)
+	setIfNotEmpty(query, "entity", *entity)
+	setIfNotEmpty(query, "q", *search)
+	setIfNotEmpty(query, "cursor", *cursor)
+	query.Set("limit", strconv.Itoa(*limit))
+
+	body, err := client.sagas(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if p.json() {
+		return p.raw(body)
+	}
+
+	var list sagaListView
+	if err := json.Unmarshal(body, &list); err != nil {
+		return errors.Wrap(err, "decoding sagas")
+	}
+
+	rows := make([][]string, len(list.Items))
+	for i, item := range list.Items {
+		rows[i] = []string{item.SagaUID, orDash(item.sagaType()), item.Status, strconv.Itoa(len(item.Events))}
+	}
+
+	if err := p.table([]string{"SAGA UID", "TYPE", "STATUS", "EVENTS"}, rows); err != nil {
+		return err
+	}
+
+	p.line("\n%d of %d sagas", len(list.Items), list.Total)
+
+	if list.NextCursor != "" {
+		p.line("next page: -cursor %s", list.NextCursor)
+	}
+
+	return nil
+}
+
+func showSaga(ctx context.Context, client *apiClient, p *printer, args []string) error {
+	flags := newCommandFlags("show")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sagaId, err := sagaIdArg(flags, "show")
+	if err != nil {
+		return err
+	}
+
+	body, err := client.saga(ctx, sagaId)
+	if err != nil {
+		return err
+	}
+
+	if p.json() {
+		return p.raw(body)
+	}
+
+	var view sagaView
+	if err := json.Unmarshal(body, &view); err != nil {
+		return errors.Wrapf(err, "decoding saga '%s'", sagaId)
+	}
+
+	refs := make([]string, len(view.EntityRefs))
+	for i, ref := range view.EntityRefs {
+		refs[i] = ref.String()
+	}
+
+	return p.table([]string{"FIELD", "VALUE"}, [][]string{
+		{"saga uid", view.SagaUID},
+		{"type", orDash(view.sagaType())},
+		{"status", view.Status},
+		{"events", strconv.Itoa(len(view.Events))},
+		{"entities", orDash(strings.Join(refs, ", "))},
+	})
+}
+
+func showHistory(ctx context.Context, client *apiClient, p *printer, args []string) error {
+	flags := newCommandFlags("history")
+	eventType := flags.String("event-type", "", "type of events, group.kind or kind")
+	from := flags.String("from", "", "events handled since the time, RFC3339")
+	to := flags.String("to", "", "events handled before the time, RFC3339")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sagaId, err := sagaIdArg(flags, "history")
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	setIfNotEmpty(query, "eventType", *eventType)
+	setIfNotEmpty(query, "from", *from)
+	setIfNotEmpty(query, "to", *to)
+
+	body, err := client.history(ctx, sagaId, query)
+	if err != nil {
+		return err
+	}
+
+	if p.json() {
+		return p.raw(body)
+	}
+
+	var history status.SagaHistory
+	if err := json.Unmarshal(body, &history); err != nil {
+		return errors.Wrapf(err, "decoding history of saga '%s'", sagaId)
+	}
+
+	rows := make([][]string, len(history.Events))
+	for i, ev := range history.Events {
+		sagaStatus := ev.Status
+		if ev.StatusChanged {
+			sagaStatus = ev.PreviousStatus + " -> " + ev.Status
+		}
+
+		rows[i] = []string{ev.CreatedAt.Format(time.RFC3339), ev.EventType, sagaStatus, orDash(ev.Origin), orDash(ev.TraceUID)}
+	}
+
+	if err := p.table([]string{"HANDLED AT", "EVENT", "STATUS", "ORIGIN", "TRACE UID"}, rows); err != nil {
+		return err
+	}
+
+	p.line("\nsaga %s is %s, %d of %d events", history.SagaUID, history.Status, len(history.Events), history.Total)
+
+	return nil
+}
+
+// controlResult is an outcome of a command sent to a saga
+type controlResult struct {
+	SagaUID string `json:"saga_uid"`
+	Action  string `json:"action"`
+	Error   string `json:"error,omitempty"`
+}
+
+// control sends the recover or compensate command to each saga, the api server checks whether the saga can take it.
+// Sagas are processed one by one, a failure doesn't stop the rest of them.
+func control(ctx context.Context, client *apiClient, p *printer, action string, args []string) error {
+	flags := newCommandFlags(action)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.Errorf("%s requires ids of sagas", action)
+	}
+
+	results := make([]controlResult, flags.NArg())
+	failed := 0
+
+	for i, sagaId := range flags.Args() {
+		results[i] = controlResult{SagaUID: sagaId, Action: action}
+
+		if _, err := client.control(ctx, sagaId, action); err != nil {
+			results[i].Error = err.Error()
+			failed++
+		}
+	}
+
+	if p.json() {
+		if err := p.value(results); err != nil {
+			return err
+		}
+	} else {
+		rows := make([][]string, len(results))
+		for i, res := range results {
+			rows[i] = []string{res.SagaUID, res.Action, "sent"}
+
+			if res.Error != "" {
+				rows[i][2] = res.Error
+			}
+		}
+
+		if err := p.table([]string{"SAGA UID", "ACTION", "RESULT"}, rows); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d %s commands weren't sent", failed, len(results), action)
+	}
+
+	return nil
+}
+
+func newCommandFlags(command string) *flag.FlagSet {
+	return flag.NewFlagSet("foremanctl "+command, flag.ContinueOnError)
+}
+
+func sagaIdArg(flags *flag.FlagSet, command string) (string, error) {
+	if flags.NArg() != 1 {
+		return "", errors.Errorf("%s requires a saga id", command)
+	}
+
+	return flags.Arg(0), nil
+}
+
+func setIfNotEmpty(query url.Values, key, val string) {
+	if val != "" {
+		query.Set(key, val)
+	}
+}
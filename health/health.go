@@ -0,0 +1,264 @@
+// Package health aggregates checks of dependencies of a service, e.g. connections of transports, the saga store and the mutex backend,
+// into liveness and readiness probes served at /healthz and /readyz.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// LivenessPath is the path the liveness probe is served at by Health.Register
+	LivenessPath = "/healthz"
+	// ReadinessPath is the path the readiness probe is served at by Health.Register
+	ReadinessPath = "/readyz"
+
+	// DefaultTimeout limits how long all checks of a probe may take, see WithTimeout
+	DefaultTimeout = time.Second * 5
+
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Probe is a set of checks asked by the orchestrator: a failing liveness probe restarts the process,
+// a failing readiness probe stops routing traffic to it until it's ready again
+type Probe string
+
+const (
+	Liveness  Probe = "liveness"
+	Readiness Probe = "readiness"
+)
+
+// Checker reports whether a dependency works, a nil error means it does.
+// Transports, saga stores and mutexes implement it when they can tell their connection state.
+type Checker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckerFunc turns a function into a Checker
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Report is the result of a probe, it's served as json
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Healthy tells whether all checks of the probe passed
+func (r Report) Healthy() bool {
+	return r.Status == StatusOK
+}
+
+// CheckResult is the result of a check, Error is the reason it fails
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type check struct {
+	name    string
+	checker Checker
+}
+
+// Health runs checks added to the probes. Checks of a probe run concurrently, each time the probe is asked.
+type Health struct {
+	mutex      sync.RWMutex
+	checks     map[Probe][]check
+	timeout    time.Duration
+	registerer prometheus.Registerer
+	status     *prometheus.GaugeVec
+}
+
+type Opt func(h *Health)
+
+// WithTimeout limits how long all checks of a probe may take, a check which doesn't return in time fails
+func WithTimeout(timeout time.Duration) Opt {
+	return func(h *Health) {
+		h.timeout = timeout
+	}
+}
+
+// WithMetrics registers foreman_health_check_status{probe, check} gauge in the registerer, it's 1 if the check passed
+// the last time the probe was asked and 0 if it failed
+func WithMetrics(registerer prometheus.Registerer) Opt {
+	return func(h *Health) {
+		h.registerer = registerer
+	}
+}
+
+func NewHealth(opts ...Opt) (*Health, error) {
+	h := &Health{checks: make(map[Probe][]check), timeout: DefaultTimeout}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.registerer != nil {
+		h.status = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "foreman",
+			Subsystem: "health",
+			Name:      "check_status",
+			Help:      "Whether a health check passed the last time its probe was asked.",
+		}, []string{"probe", "check"})
+
+		if err := h.registerer.Register(h.status); err != nil {
+			return nil, errors.Wrap(err, "registering health metrics")
+		}
+	}
+
+	return h, nil
+}
+
+// AddLivenessCheck adds the check to the liveness probe, a check with the same name is replaced
+func (h *Health) AddLivenessCheck(name string, checker Checker) {
+	h.add(Liveness, name, checker)
+}
+
+// AddReadinessCheck adds the check to the readiness probe, a check with the same name is replaced
+func (h *Health) AddReadinessCheck(name string, checker Checker) {
+	h.add(Readiness, name, checker)
+}
+
+// AddTransport checks the connection of the transport in both probes: the bus can neither receive nor send messages without it.
+// An error is returned if the transport can't tell its connection state, i.e. it doesn't implement Checker.
+func (h *Health) AddTransport(name string, t transport.Transport) error {
+	checker, ok := t.(Checker)
+	if !ok {
+		return errors.Errorf("transport %T doesn't implement health.Checker", t)
+	}
+
+	h.AddLivenessCheck(name, checker)
+	h.AddReadinessCheck(name, checker)
+
+	return nil
+}
+
+func (h *Health) add(probe Probe, name string, checker Checker) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, c := range h.checks[probe] {
+		if c.name == name {
+			h.checks[probe][i].checker = checker
+			return
+		}
+	}
+
+	h.checks[probe] = append(h.checks[probe], check{name: name, checker: checker})
+}
+
+// Check runs checks of the probe, a probe without checks is healthy
+func (h *Health) Check(ctx context.Context, probe Probe) Report {
+	h.mutex.RLock()
+	checks := h.checks[probe]
+	h.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	errs := make([]error, len(checks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+
+	for i, c := range checks {
+		go func(i int, c check) {
+			defer wg.Done()
+			errs[i] = runCheck(ctx, c.checker)
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+
+	for i, c := range checks {
+		result := CheckResult{Status: StatusOK}
+
+		if errs[i] != nil {
+			result = CheckResult{Status: StatusFailing, Error: errs[i].Error()}
+			report.Status = StatusFailing
+		}
+
+		report.Checks[c.name] = result
+
+		if h.status != nil {
+			h.status.WithLabelValues(string(probe), c.name).Set(boolToFloat(errs[i] == nil))
+		}
+	}
+
+	return report
+}
+
+// runCheck fails the check once ctx is done, even if the checker ignores ctx
+func runCheck(ctx context.Context, checker Checker) error {
+	result := make(chan error, 1)
+
+	go func() {
+		result <- checker.CheckHealth(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "check didn't return in time")
+	}
+}
+
+// Handler serves the report of the probe, it answers 200 if the probe is healthy and 503 otherwise
+func (h *Health) Handler(probe Probe) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, r *http.Request) {
+		report := h.Check(r.Context(), probe)
+
+		code := http.StatusOK
+		if !report.Healthy() {
+			code = http.StatusServiceUnavailable
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(code)
+		_ = json.NewEncoder(resp).Encode(report)
+	})
+}
+
+// Register serves the liveness probe at LivenessPath and the readiness probe at ReadinessPath
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.Handle(LivenessPath, h.Handler(Liveness))
+	mux.Handle(ReadinessPath, h.Handler(Readiness))
+}
+
+// Names returns sorted names of checks of the probe
+func (h *Health) Names(probe Probe) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	names := make([]string, 0, len(h.checks[probe]))
+	for _, c := range h.checks[probe] {
+		names = append(names, c.name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
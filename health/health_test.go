@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	transportMock "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type connectedTransport struct {
+	*transportMock.MockTransport
+	err error
+}
+
+func (t connectedTransport) CheckHealth(ctx context.Context) error {
+	return t.err
+}
+
+func TestHealth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	passing := CheckerFunc(func(ctx context.Context) error { return nil })
+	failing := CheckerFunc(func(ctx context.Context) error { return errors.New("connection refused") })
+
+	t.Run("probe without checks is healthy", func(t *testing.T) {
+		h, err := NewHealth()
+		require.NoError(t, err)
+
+		assert.Equal(t, Report{Status: StatusOK, Checks: map[string]CheckResult{}}, h.Check(ctx, Liveness))
+	})
+
+	t.Run("probes run their own checks", func(t *testing.T) {
+		h, err := NewHealth()
+		require.NoError(t, err)
+
+		h.AddLivenessCheck("process", passing)
+		h.AddReadinessCheck("store", failing)
+
+		assert.True(t, h.Check(ctx, Liveness).Healthy())
+		assert.Equal(t, Report{
+			Status: StatusFailing,
+			Checks: map[string]CheckResult{"store": {Status: StatusFailing, Error: "connection refused"}},
+		}, h.Check(ctx, Readiness))
+
+		h.AddReadinessCheck("store", passing)
+		assert.True(t, h.Check(ctx, Readiness).Healthy(), "check with the same name is replaced")
+		assert.Equal(t, []string{"store"}, h.Names(Readiness))
+	})
+
+	t.Run("check which doesn't return in time fails", func(t *testing.T) {
+		h, err := NewHealth(WithTimeout(time.Millisecond * 10))
+		require.NoError(t, err)
+
+		blocked := make(chan struct{})
+		defer close(blocked)
+
+		h.AddReadinessCheck("stuck", CheckerFunc(func(ctx context.Context) error {
+			<-blocked
+			return nil
+		}))
+		h.AddReadinessCheck("store", passing)
+
+		report := h.Check(ctx, Readiness)
+		assert.False(t, report.Healthy())
+		assert.Equal(t, CheckResult{Status: StatusFailing, Error: "check didn't return in time: context deadline exceeded"}, report.Checks["stuck"])
+		assert.Equal(t, CheckResult{Status: StatusOK}, report.Checks["store"])
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		h, err := NewHealth()
+		require.NoError(t, err)
+
+		assert.EqualError(t, h.AddTransport("amqp", transportMock.NewMockTransport(ctrl)), "transport *transport.MockTransport doesn't implement health.Checker")
+
+		require.NoError(t, h.AddTransport("amqp", connectedTransport{err: errors.New("connection is closed")}))
+		assert.False(t, h.Check(ctx, Liveness).Healthy())
+		assert.False(t, h.Check(ctx, Readiness).Healthy())
+	})
+
+	t.Run("handlers", func(t *testing.T) {
+		h, err := NewHealth()
+		require.NoError(t, err)
+
+		h.AddLivenessCheck("process", passing)
+		h.AddReadinessCheck("store", failing)
+
+		mux := http.NewServeMux()
+		h.Register(mux)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, LivenessPath, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"status":"ok","checks":{"process":{"status":"ok"}}}`, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+		report := Report{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		assert.Equal(t, "connection refused", report.Checks["store"].Error)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+
+		h, err := NewHealth(WithMetrics(registry))
+		require.NoError(t, err)
+
+		h.AddReadinessCheck("store", failing)
+		h.AddReadinessCheck("mutex", passing)
+		h.Check(ctx, Readiness)
+
+		assert.Equal(t, float64(0), testutil.ToFloat64(h.status.WithLabelValues("readiness", "store")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(h.status.WithLabelValues("readiness", "mutex")))
+
+		_, err = NewHealth(WithMetrics(registry))
+		assert.Error(t, err, "metrics are registered once")
+	})
+}
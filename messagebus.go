@@ -1,14 +1,23 @@
 package foreman
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/go-foreman/foreman/log"
 	"github.com/go-foreman/foreman/pubsub/dispatcher"
 	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/instrumentation"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/pubsub/sla"
 	"github.com/go-foreman/foreman/pubsub/subscriber"
 	"github.com/go-foreman/foreman/pubsub/transport"
 	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/mutex"
 	"github.com/pkg/errors"
 )
 
@@ -19,6 +28,21 @@ type Component interface {
 	Init(b *MessageBus) error
 }
 
+// Worker is a background process of a component, e.g. a relay or a scheduler. Workers are started by MessageBus.RunWorkers.
+// When workers run in several replicas or in both message handling and worker deployments, configure WithWorkerMutex,
+// so each worker runs in one replica at a time.
+type Worker interface {
+	// Name identifies the worker in logs
+	Name() string
+	// Run blocks until ctx is done or the worker fails
+	Run(ctx context.Context) error
+}
+
+// Shutdowner is implemented by components which must finish their work before the process exits, MessageBus.Shutdown shuts them down
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
 // SubscriberOption allows to provide a few options for configuring Subscriber
 type SubscriberOption func(subscriberOpts *subscriberOpts, c *subscriberContainer)
 
@@ -68,6 +92,20 @@ type container struct {
 	msgMarshaller             message.Marshaller
 	processor                 subscriber.Processor
 	components                []Component
+	slaTracker                *sla.Tracker
+	retryPolicy               *subscriber.RetryPolicy
+	msgRetryPolicies          []subscriber.ProcessorOpt
+	verifier                  *signing.Verifier
+	quarantine                endpoint.Endpoint
+	validateOnly              *subscriber.ValidateOnly
+	deduplicator              subscriber.Deduplicator
+	cipher                    message.Cipher
+	deduplicationOpts         []subscriber.DeduplicationOpt
+	instrumentation           *instrumentation.Instrumentation
+	handlerMiddlewares        []dispatcher.Middleware
+	endpointMiddlewares       []endpoint.Middleware
+	workerMutex               mutex.Mutex
+	workerRenewInterval       time.Duration
 }
 
 // WithComponents specifies a list of additional components you want to be registered in MessageBus
@@ -98,6 +136,97 @@ func WithMessageExecutionFactory(factory execution.MessageExecutionCtxFactory) C
 	}
 }
 
+// WithSLATracker enables SLA tracking of handled messages in the default processor
+func WithSLATracker(tracker *sla.Tracker) ConfigOption {
+	return func(c *container) {
+		c.slaTracker = tracker
+	}
+}
+
+// WithRetryPolicy limits attempts to process a message in the default processor and dead letters messages after the last one
+func WithRetryPolicy(policy *subscriber.RetryPolicy) ConfigOption {
+	return func(c *container) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithMessageRetryPolicy retries messages of the given types in the default processor by their own policy instead of
+// the one passed with WithRetryPolicy, see subscriber.WithMessageRetryPolicy
+func WithMessageRetryPolicy(policy *subscriber.RetryPolicy, objects ...message.Object) ConfigOption {
+	return func(c *container) {
+		c.msgRetryPolicies = append(c.msgRetryPolicies, subscriber.WithMessageRetryPolicy(policy, objects...))
+	}
+}
+
+// WithCipher makes the default processor decrypt payloads of received messages, see subscriber.WithCipher.
+// Endpoints encrypt payloads with endpoint.WithCipher.
+func WithCipher(cipher message.Cipher) ConfigOption {
+	return func(c *container) {
+		c.cipher = cipher
+	}
+}
+
+// WithSignatureVerification makes the default processor verify signatures of received messages,
+// messages failing verification are sent into quarantine endpoint instead of being handled, see subscriber.WithSignatureVerification
+func WithSignatureVerification(verifier *signing.Verifier, quarantine endpoint.Endpoint) ConfigOption {
+	return func(c *container) {
+		c.verifier = verifier
+		c.quarantine = quarantine
+	}
+}
+
+// WithValidateOnly makes the default processor only validate messages received from queues in validate-only mode,
+// executors aren't called and every such message is acked, see subscriber.WithValidateOnly. Serve validateOnly
+// on your api server to get the report and switch queues at runtime.
+func WithValidateOnly(validateOnly *subscriber.ValidateOnly) ConfigOption {
+	return func(c *container) {
+		c.validateOnly = validateOnly
+	}
+}
+
+// WithDeduplication makes the default processor skip messages which were already processed successfully,
+// see subscriber.WithDeduplication
+func WithDeduplication(deduplicator subscriber.Deduplicator, opts ...subscriber.DeduplicationOpt) ConfigOption {
+	return func(c *container) {
+		c.deduplicator = deduplicator
+		c.deduplicationOpts = opts
+	}
+}
+
+// WithInstrumentation traces and measures messages, see instrumentation.New. It wraps the default processor, executors matched
+// by the dispatcher and endpoints registered in the router, so register endpoints through MessageBus.Router().
+func WithInstrumentation(inst *instrumentation.Instrumentation) ConfigOption {
+	return func(c *container) {
+		c.instrumentation = inst
+	}
+}
+
+// WithHandlerMiddleware wraps every executor matched by the dispatcher with middlewares, the first one is the outermost.
+// Middlewares can also be added later with MessageBus.UseHandlerMiddleware.
+func WithHandlerMiddleware(middlewares ...dispatcher.Middleware) ConfigOption {
+	return func(c *container) {
+		c.handlerMiddlewares = append(c.handlerMiddlewares, middlewares...)
+	}
+}
+
+// WithEndpointMiddleware wraps endpoints registered in the router with middlewares, see endpoint.WrapRouter. Register endpoints
+// through MessageBus.Router().
+func WithEndpointMiddleware(middlewares ...endpoint.Middleware) ConfigOption {
+	return func(c *container) {
+		c.endpointMiddlewares = append(c.endpointMiddlewares, middlewares...)
+	}
+}
+
+// WithWorkerMutex runs each worker started by RunWorkers under an exclusive lock named after the worker, see mutex.RunExclusively.
+// Locks of m must implement mutex.RenewableLock, they are renewed every renewInterval. Replicas sharing m run every worker once,
+// the others wait and take over when the holder stops or loses its lease.
+func WithWorkerMutex(m mutex.Mutex, renewInterval time.Duration) ConfigOption {
+	return func(c *container) {
+		c.workerMutex = m
+		c.workerRenewInterval = renewInterval
+	}
+}
+
 // MessageBus is a main component, kind of a container which aggregates other components
 type MessageBus struct {
 	marshaller         message.Marshaller
@@ -105,11 +234,60 @@ type MessageBus struct {
 	router             endpoint.Router
 	scheme             scheme.KnownTypesRegistry
 	subscriber         subscriber.Subscriber
+	processor          subscriber.Processor
 	logger             log.Logger
+	workers            []Worker
+	workerMutex        mutex.Mutex
+	components         []Component
 }
 
 // NewMessageBus constructs MessageBus, allows to specify logger, choose subscriber or use default with transport and other options which configure implementations of other important parts
 func NewMessageBus(logger log.Logger, msgMarshaller message.Marshaller, scheme scheme.KnownTypesRegistry, subscriberOption SubscriberOption, configOpts ...ConfigOption) (*MessageBus, error) {
+	mBus, container := newMessageBus(logger, msgMarshaller, scheme, configOpts...)
+
+	subscriberCreationOpts := &subscriberOpts{}
+	subscriberOption(subscriberCreationOpts, &subscriberContainer{
+		msgMarshaller: msgMarshaller,
+		processor:     container.processor,
+	})
+
+	if subscriberCreationOpts.subscriber != nil {
+		mBus.subscriber = subscriberCreationOpts.subscriber
+	} else if subscriberCreationOpts.transport != nil {
+		mBus.subscriber = subscriber.NewSubscriber(subscriberCreationOpts.transport, container.processor, logger, subscriberCreationOpts.opts...)
+	} else {
+
+		panic(errors.New("subscriber is nil"))
+	}
+
+	if err := mBus.initComponents(container.components); err != nil {
+		return nil, err
+	}
+
+	return mBus, nil
+}
+
+// NewWorkerBus constructs MessageBus without a subscriber. It initializes the same components as NewMessageBus does, so they share
+// stores, endpoints and transport configuration, but no messages are consumed. Use it to run workers registered by components
+// in a separate deployment with RunWorkers.
+func NewWorkerBus(logger log.Logger, msgMarshaller message.Marshaller, scheme scheme.KnownTypesRegistry, configOpts ...ConfigOption) (*MessageBus, error) {
+	mBus, container := newMessageBus(logger, msgMarshaller, scheme, configOpts...)
+
+	if err := mBus.initComponents(container.components); err != nil {
+		return nil, err
+	}
+
+	return mBus, nil
+}
+
+// NewPushBus constructs MessageBus without a subscriber for environments where messages are pushed over http, e.g. by GCP Pub/Sub
+// push subscriptions. Serve push.NewHandler(mBus.Processor(), mBus.Logger()), messages are processed by the same processor,
+// dispatcher and components as with NewMessageBus.
+func NewPushBus(logger log.Logger, msgMarshaller message.Marshaller, scheme scheme.KnownTypesRegistry, configOpts ...ConfigOption) (*MessageBus, error) {
+	return NewWorkerBus(logger, msgMarshaller, scheme, configOpts...)
+}
+
+func newMessageBus(logger log.Logger, msgMarshaller message.Marshaller, scheme scheme.KnownTypesRegistry, configOpts ...ConfigOption) (*MessageBus, *container) {
 	mBus := &MessageBus{logger: logger, marshaller: msgMarshaller, scheme: scheme}
 
 	container := &container{
@@ -127,40 +305,219 @@ func NewMessageBus(logger log.Logger, msgMarshaller message.Marshaller, scheme s
 		container.router = endpoint.NewRouter()
 	}
 
+	if container.instrumentation != nil {
+		container.messagesDispatcher.Use(container.instrumentation.Middleware())
+		container.router = container.instrumentation.WrapRouter(container.router)
+	}
+
+	if len(container.handlerMiddlewares) > 0 {
+		container.messagesDispatcher.Use(container.handlerMiddlewares...)
+	}
+
+	if len(container.endpointMiddlewares) > 0 {
+		container.router = endpoint.WrapRouter(container.router, container.endpointMiddlewares...)
+	}
+
 	if container.messageExuctionCtxFactory == nil {
 		container.messageExuctionCtxFactory = execution.NewMessageExecutionCtxFactory(container.router, logger)
 	}
 
+	mBus.messagesDispatcher = container.messagesDispatcher
+	mBus.router = container.router
+
 	if container.processor == nil {
-		container.processor = subscriber.NewMessageProcessor(msgMarshaller, container.messageExuctionCtxFactory, container.messagesDispatcher, logger)
+		container.processor = newProcessor(container, logger)
+
+		if container.instrumentation != nil {
+			container.processor = container.instrumentation.WrapProcessor(container.processor)
+		}
 	}
 
-	mBus.messagesDispatcher = container.messagesDispatcher
-	mBus.router = container.router
-	mBus.scheme = scheme
+	mBus.processor = container.processor
 
-	subscriberCreationOpts := &subscriberOpts{}
-	subscriberOption(subscriberCreationOpts, &subscriberContainer{
-		msgMarshaller: msgMarshaller,
-		processor:     container.processor,
-	})
+	if container.workerMutex != nil {
+		mBus.UseWorkerMutex(container.workerMutex, container.workerRenewInterval)
+	}
 
-	if subscriberCreationOpts.subscriber != nil {
-		mBus.subscriber = subscriberCreationOpts.subscriber
-	} else if subscriberCreationOpts.transport != nil {
-		mBus.subscriber = subscriber.NewSubscriber(subscriberCreationOpts.transport, container.processor, logger, subscriberCreationOpts.opts...)
-	} else {
+	return mBus, container
+}
 
-		panic(errors.New("subscriber is nil"))
+// newProcessor creates the default processor configured by options of the container
+func newProcessor(container *container, logger log.Logger) subscriber.Processor {
+	var processorOpts []subscriber.ProcessorOpt
+
+	if container.slaTracker != nil {
+		processorOpts = append(processorOpts, subscriber.WithSLATracker(container.slaTracker))
+	}
+
+	if container.retryPolicy != nil {
+		processorOpts = append(processorOpts, subscriber.WithRetryPolicy(container.retryPolicy))
+	}
+
+	processorOpts = append(processorOpts, container.msgRetryPolicies...)
+
+	if container.cipher != nil {
+		processorOpts = append(processorOpts, subscriber.WithCipher(container.cipher))
 	}
 
-	for _, component := range container.components {
-		if err := component.Init(mBus); err != nil {
-			return nil, err
+	if container.verifier != nil {
+		processorOpts = append(processorOpts, subscriber.WithSignatureVerification(container.verifier, container.quarantine))
+	}
+
+	if container.validateOnly != nil {
+		processorOpts = append(processorOpts, subscriber.WithValidateOnly(container.validateOnly))
+	}
+
+	if container.deduplicator != nil {
+		processorOpts = append(processorOpts, subscriber.WithDeduplication(container.deduplicator, container.deduplicationOpts...))
+	}
+
+	return subscriber.NewMessageProcessor(container.msgMarshaller, container.messageExuctionCtxFactory, container.messagesDispatcher, logger, processorOpts...)
+}
+
+func (b *MessageBus) initComponents(components []Component) error {
+	scheme := b.scheme
+	b.components = components
+
+	if err := scheme.Validate(); err != nil {
+		return err
+	}
+
+	for _, component := range components {
+		// registrations made by the component are attributed to it, so conflicts name both owners
+		b.scheme = scheme.Scoped(fmt.Sprintf("%T", component))
+		err := component.Init(b)
+		b.scheme = scheme
+
+		if err != nil {
+			return err
+		}
+
+		if err := scheme.Validate(); err != nil {
+			return errors.Wrapf(err, "initializing component %T", component)
 		}
 	}
 
-	return mBus, nil
+	if untyped := dispatcher.UntypedContracts(b.messagesDispatcher); len(untyped) > 0 {
+		b.logger.Logf(log.WarnLevel, "contracts %s are subscribed without declaring whether they are commands or events, embed message.Command or message.Event into them and subscribe them by HandleCommand or ListenEvent", strings.Join(untyped, ", "))
+	}
+
+	return nil
+}
+
+// RegisterWorkers adds background workers of a component, they are started by RunWorkers
+func (b *MessageBus) RegisterWorkers(workers ...Worker) {
+	b.workers = append(b.workers, workers...)
+}
+
+// Workers returns all registered workers
+func (b *MessageBus) Workers() []Worker {
+	return b.workers
+}
+
+// UseWorkerMutex sets the mutex workers run under, see WithWorkerMutex. Components call it in Init to provide a default one,
+// e.g. the saga component uses its saga mutex unless WithWorkerMutex is configured.
+func (b *MessageBus) UseWorkerMutex(m mutex.Mutex, renewInterval time.Duration) {
+	b.workerMutex = mutex.NewLeasedMutex(m, renewInterval, b.logger)
+}
+
+// WorkerMutex returns the leased mutex workers run under, nil if none is configured
+func (b *MessageBus) WorkerMutex() mutex.Mutex {
+	return b.workerMutex
+}
+
+// RunWorkers runs all registered workers and blocks until ctx is done or one of them fails, then stops the rest and waits for them.
+// Call it next to Subscriber().Run to run workers in-process, or alone on a bus created with NewWorkerBus.
+// With a worker mutex each worker waits for its exclusive lock first, so it runs in one replica at a time.
+func (b *MessageBus) RunWorkers(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(b.workers))
+
+	if b.workerMutex == nil && len(b.workers) > 0 {
+		b.logger.Logf(log.WarnLevel, "no worker mutex is configured, workers run in every replica, see foreman.WithWorkerMutex")
+	}
+
+	for _, w := range b.workers {
+		go func(w Worker) {
+			b.logger.Logf(log.InfoLevel, "Started worker %s", w.Name())
+
+			err := b.runWorker(ctx, w)
+			if err != nil {
+				err = errors.Wrapf(err, "running worker %s", w.Name())
+				cancel()
+			}
+
+			b.logger.Logf(log.InfoLevel, "Stopped worker %s", w.Name())
+
+			errs <- err
+		}(w)
+	}
+
+	var firstErr error
+
+	for range b.workers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (b *MessageBus) runWorker(ctx context.Context, w Worker) error {
+	if b.workerMutex == nil {
+		return w.Run(ctx)
+	}
+
+	return mutex.RunExclusively(ctx, b.workerMutex, w.Name(), b.logger, w.Run)
+}
+
+// Shutdown stops the subscriber: no more packages are fetched, packages in progress are awaited until ctx is done and acked,
+// the rest are nacked for redelivery and the transport is disconnected, see subscriber.ShutdownErr. Then components implementing
+// Shutdowner are shut down in reverse order, e.g. the saga component releases locks of handlers which didn't return in time.
+// Nothing is sent afterwards, so endpoints registered through Router() are closed last in order they were registered, see endpoint.Close.
+// Hook it to signal handling instead of cancelling ctx of Subscriber().Run. The first error is returned, the rest are logged.
+func (b *MessageBus) Shutdown(ctx context.Context) error {
+	var firstErr error
+
+	if b.subscriber != nil {
+		firstErr = b.subscriber.Shutdown(ctx)
+	}
+
+	for i := len(b.components) - 1; i >= 0; i-- {
+		shutdowner, ok := b.components[i].(Shutdowner)
+		if !ok {
+			continue
+		}
+
+		if err := shutdowner.Shutdown(ctx); err != nil {
+			err = errors.Wrapf(err, "shutting down component %T", b.components[i])
+
+			if firstErr == nil {
+				firstErr = err
+				continue
+			}
+
+			b.logger.Logf(log.ErrorLevel, "%s", err)
+		}
+	}
+
+	for _, e := range endpoint.Endpoints(b.router) {
+		if err := endpoint.Close(e); err != nil {
+			err = errors.Wrapf(err, "closing endpoint %s", e.Name())
+
+			if firstErr == nil {
+				firstErr = err
+				continue
+			}
+
+			b.logger.Logf(log.ErrorLevel, "%s", err)
+		}
+	}
+
+	return firstErr
 }
 
 // Dispatcher returns an instance of dispatcher.Dispatcher
@@ -168,6 +525,12 @@ func (b *MessageBus) Dispatcher() dispatcher.Dispatcher {
 	return b.messagesDispatcher
 }
 
+// UseHandlerMiddleware wraps every executor matched by the dispatcher with middlewares, including executors subscribed before,
+// e.g. dispatcher.RecoveryMiddleware or dispatcher.LoggingMiddleware
+func (b *MessageBus) UseHandlerMiddleware(middlewares ...dispatcher.Middleware) {
+	b.messagesDispatcher.Use(middlewares...)
+}
+
 // Router returns an instance of endpoint.Router
 func (b *MessageBus) Router() endpoint.Router {
 	return b.router
@@ -178,11 +541,17 @@ func (b *MessageBus) SchemeRegistry() scheme.KnownTypesRegistry {
 	return b.scheme
 }
 
-// Subscriber returns an instance of subscriber.Subscriber which controls the main flow of messages
+// Subscriber returns an instance of subscriber.Subscriber which controls the main flow of messages, nil for a bus created by NewWorkerBus
 func (b *MessageBus) Subscriber() subscriber.Subscriber {
 	return b.subscriber
 }
 
+// Processor returns the subscriber.Processor which decodes and dispatches received messages, pass it to push.NewHandler
+// to receive messages pushed over http the same way
+func (b *MessageBus) Processor() subscriber.Processor {
+	return b.processor
+}
+
 // Logger returns an instance of logger
 func (b *MessageBus) Logger() log.Logger {
 	return b.logger
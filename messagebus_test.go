@@ -1,19 +1,29 @@
 package foreman
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
 
+	pubsubDispatcher "github.com/go-foreman/foreman/pubsub/dispatcher"
+	pubsubEndpoint "github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/instrumentation"
 	"github.com/go-foreman/foreman/pubsub/message"
+	messageExecution "github.com/go-foreman/foreman/pubsub/message/execution"
 	"github.com/go-foreman/foreman/pubsub/subscriber"
 
 	"github.com/pkg/errors"
 
 	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/mutex"
 	"github.com/go-foreman/foreman/testing/log"
 	messageMock "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
 	subscriberMock "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	mutexMock "github.com/go-foreman/foreman/testing/mocks/saga/mutex"
 	"github.com/stretchr/testify/require"
 
 	"github.com/go-foreman/foreman/testing/mocks/pubsub/dispatcher"
@@ -51,6 +61,23 @@ func TestMessageBusConfigOptions(t *testing.T) {
 	assert.Same(t, c.messageExuctionCtxFactory, msgExecFactoryMock)
 }
 
+type registeringComponent struct {
+	obj scheme.Object
+}
+
+func (r registeringComponent) Init(b *MessageBus) error {
+	b.SchemeRegistry().AddKnownTypeWithName(scheme.GroupKind{Group: "test", Kind: "Contract"}, r.obj)
+	return nil
+}
+
+type contractA struct {
+	message.ObjectMeta
+}
+
+type contractB struct {
+	message.ObjectMeta
+}
+
 type aComponent struct {
 	err error
 }
@@ -59,6 +86,40 @@ func (a aComponent) Init(b *MessageBus) error {
 	return a.err
 }
 
+type untypedContract struct {
+	message.ObjectMeta
+}
+
+type typedContract struct {
+	message.ObjectMeta
+	message.Command
+}
+
+// subscribingComponent subscribes contracts in Init as components do
+type subscribingComponent struct{}
+
+func noopExecutor(execCtx messageExecution.MessageExecutionCtx) error {
+	return nil
+}
+
+func (c subscribingComponent) Init(b *MessageBus) error {
+	b.Dispatcher().HandleCommand(&typedContract{}, noopExecutor)
+	b.Dispatcher().SubscribeForEvent(&untypedContract{}, noopExecutor)
+	return nil
+}
+
+func TestMessageBusUntypedContracts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+
+	_, err := NewWorkerBus(testLogger, messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), WithComponents(subscribingComponent{}))
+	require.NoError(t, err)
+
+	testLogger.AssertContainsSubstr(t, "contracts foreman.untypedContract are subscribed without declaring whether they are commands or events")
+}
+
 func TestMessageBusConstructor(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -142,9 +203,462 @@ func TestMessageBusConstructor(t *testing.T) {
 		assert.IsType(t, defaultSubscriber, mBus.Subscriber())
 	})
 
+	t.Run("components register conflicting types", func(t *testing.T) {
+		registry := scheme.NewKnownTypesRegistry()
+		mBus, err := NewMessageBus(
+			testLogger,
+			msgMarshallerMock,
+			registry,
+			WithSubscriber(subscriberInstanceMock),
+			WithComponents(registeringComponent{obj: &contractA{}}, registeringComponent{obj: &contractA{}}, &registeringComponent{obj: &contractB{}}),
+		)
+		require.Error(t, err)
+		assert.Nil(t, mBus)
+		assert.IsType(t, scheme.ConflictErr{}, errors.Cause(err))
+		assert.Contains(t, err.Error(), "initializing component *foreman.registeringComponent")
+		assert.Contains(t, err.Error(), "github.com/go-foreman/foreman.contractA by foreman.registeringComponent at ")
+		assert.Contains(t, err.Error(), "github.com/go-foreman/foreman.contractB by *foreman.registeringComponent at ")
+	})
+
 	t.Run("nil subscriber", func(t *testing.T) {
 		assert.PanicsWithError(t, "subscriber is nil", func() {
 			_, _ = NewMessageBus(testLogger, msgMarshallerMock, schemeRegistry, WithSubscriber(nil))
 		})
 	})
 }
+
+type aWorker struct {
+	name string
+	err  error
+}
+
+func (w aWorker) Name() string {
+	return w.name
+}
+
+func (w aWorker) Run(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+type workersComponent struct {
+	workers []Worker
+}
+
+func (c workersComponent) Init(b *MessageBus) error {
+	b.RegisterWorkers(c.workers...)
+	return nil
+}
+
+func TestWorkerBus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	msgMarshallerMock := messageMock.NewMockMarshaller(ctrl)
+
+	t.Run("workers run until ctx is done", func(t *testing.T) {
+		workers := []Worker{aWorker{name: "relay"}, aWorker{name: "scheduler"}}
+		mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: workers}))
+		require.NoError(t, err)
+
+		assert.Nil(t, mBus.Subscriber())
+		assert.NotNil(t, mBus.Dispatcher())
+		assert.NotNil(t, mBus.Router())
+		assert.Equal(t, workers, mBus.Workers())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.NoError(t, mBus.RunWorkers(ctx))
+		testLogger.AssertContainsSubstr(t, "no worker mutex is configured, workers run in every replica")
+	})
+
+	t.Run("failed worker stops the rest", func(t *testing.T) {
+		workers := []Worker{aWorker{name: "relay"}, aWorker{name: "scheduler", err: errors.New("store is down")}}
+		mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: workers}))
+		require.NoError(t, err)
+
+		assert.EqualError(t, mBus.RunWorkers(context.Background()), "running worker scheduler: store is down")
+	})
+
+	t.Run("component error", func(t *testing.T) {
+		mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(&aComponent{err: errors.New("component error")}))
+		assert.Nil(t, mBus)
+		assert.EqualError(t, err, "component error")
+	})
+}
+
+// memoryMutex is a mutex.Mutex shared by buses of a test as if they were replicas using the same database
+type memoryMutex struct {
+	mu    sync.Mutex
+	held  map[string]chan struct{}
+	names []string
+}
+
+func newMemoryMutex() *memoryMutex {
+	return &memoryMutex{held: make(map[string]chan struct{})}
+}
+
+func (m *memoryMutex) Lock(ctx context.Context, name string) (mutex.Lock, error) {
+	for {
+		m.mu.Lock()
+		released, exists := m.held[name]
+		if !exists {
+			m.held[name] = make(chan struct{})
+			m.names = append(m.names, name)
+			m.mu.Unlock()
+
+			return &memoryLock{m: m, name: name}, nil
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (m *memoryMutex) acquired() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.names...)
+}
+
+type memoryLock struct {
+	m    *memoryMutex
+	name string
+}
+
+func (l *memoryLock) Renew(ctx context.Context) error {
+	return nil
+}
+
+func (l *memoryLock) Release(ctx context.Context) error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	close(l.m.held[l.name])
+	delete(l.m.held, l.name)
+
+	return nil
+}
+
+// countingWorker records how many copies of it run at the same time
+type countingWorker struct {
+	mu      *sync.Mutex
+	running *int
+	maxRuns *int
+	started *int
+}
+
+func (w countingWorker) Name() string {
+	return "relay"
+}
+
+func (w countingWorker) Run(ctx context.Context) error {
+	w.mu.Lock()
+	*w.running++
+	*w.started++
+	if *w.running > *w.maxRuns {
+		*w.maxRuns = *w.running
+	}
+	w.mu.Unlock()
+
+	<-ctx.Done()
+
+	w.mu.Lock()
+	*w.running--
+	w.mu.Unlock()
+
+	return nil
+}
+
+func TestWorkerMutex(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	msgMarshallerMock := messageMock.NewMockMarshaller(ctrl)
+
+	t.Run("worker runs in one of buses sharing the mutex", func(t *testing.T) {
+		sharedMutex := newMemoryMutex()
+
+		var (
+			mu                        sync.Mutex
+			running, maxRuns, started int
+		)
+
+		worker := countingWorker{mu: &mu, running: &running, maxRuns: &maxRuns, started: &started}
+
+		buses := make([]*MessageBus, 2)
+		for i := range buses {
+			mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: []Worker{worker}}), WithWorkerMutex(sharedMutex, time.Millisecond*10))
+			require.NoError(t, err)
+			require.NotNil(t, mBus.WorkerMutex())
+
+			buses[i] = mBus
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		var wg sync.WaitGroup
+
+		for _, mBus := range buses {
+			wg.Add(1)
+			go func(mBus *MessageBus) {
+				defer wg.Done()
+				assert.NoError(t, mBus.RunWorkers(ctx))
+			}(mBus)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, 1, maxRuns)
+		assert.Equal(t, 1, started, "the other bus waits while the lock is held")
+		assert.Equal(t, []string{"relay"}, sharedMutex.acquired())
+	})
+
+	t.Run("worker is run again by the other bus once the holder stops", func(t *testing.T) {
+		sharedMutex := newMemoryMutex()
+
+		var (
+			mu                        sync.Mutex
+			running, maxRuns, started int
+		)
+
+		worker := countingWorker{mu: &mu, running: &running, maxRuns: &maxRuns, started: &started}
+
+		first, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: []Worker{worker}}), WithWorkerMutex(sharedMutex, time.Millisecond*10))
+		require.NoError(t, err)
+		second, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: []Worker{worker}}), WithWorkerMutex(sharedMutex, time.Millisecond*10))
+		require.NoError(t, err)
+
+		firstCtx, stopFirst := context.WithCancel(context.Background())
+		firstDone := make(chan error)
+		go func() {
+			firstDone <- first.RunWorkers(firstCtx)
+		}()
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return started == 1
+		}, time.Second, time.Millisecond)
+
+		secondCtx, stopSecond := context.WithCancel(context.Background())
+		secondDone := make(chan error)
+		go func() {
+			secondDone <- second.RunWorkers(secondCtx)
+		}()
+
+		stopFirst()
+		require.NoError(t, <-firstDone)
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return started == 2
+		}, time.Second, time.Millisecond)
+
+		stopSecond()
+		require.NoError(t, <-secondDone)
+		assert.Equal(t, 1, maxRuns)
+	})
+
+	t.Run("lock which isn't renewable fails the worker", func(t *testing.T) {
+		sagaMutex := mutexMock.NewMockMutex(ctrl)
+		lock := mutexMock.NewMockLock(ctrl)
+
+		sagaMutex.EXPECT().Lock(gomock.Any(), "relay").Return(lock, nil)
+		lock.EXPECT().Release(gomock.Any()).Return(nil)
+
+		mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(workersComponent{workers: []Worker{aWorker{name: "relay"}}}), WithWorkerMutex(sagaMutex, time.Second))
+		require.NoError(t, err)
+
+		err = mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker relay: acquiring exclusive lock relay: lock *mutex.MockLock of saga relay doesn't implement RenewableLock")
+	})
+}
+
+func TestPushBus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mBus, err := NewPushBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry())
+	require.NoError(t, err)
+
+	assert.Nil(t, mBus.Subscriber())
+	assert.NotNil(t, mBus.Processor())
+	assert.NotNil(t, mBus.Dispatcher())
+}
+
+func TestMessageBusInstrumentation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inst, err := instrumentation.New()
+	require.NoError(t, err)
+
+	mBus, err := NewPushBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), WithInstrumentation(inst))
+	require.NoError(t, err)
+
+	endpointInstance := endpoint.NewMockEndpoint(ctrl)
+	mBus.Router().RegisterEndpoint(endpointInstance, &message.ObjectMeta{})
+
+	routed := mBus.Router().Route(&message.ObjectMeta{})
+	require.Len(t, routed, 1)
+	assert.NotEqual(t, endpointInstance, routed[0], "endpoints registered in the router are wrapped")
+	assert.NotEqual(t, "*subscriber.processor", fmt.Sprintf("%T", mBus.Processor()), "the processor is wrapped")
+}
+
+func TestMessageBusMiddleware(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var calls []string
+
+	handlerMiddleware := func(name string) pubsubDispatcher.Middleware {
+		return func(next messageExecution.Executor) messageExecution.Executor {
+			return func(execCtx messageExecution.MessageExecutionCtx) error {
+				calls = append(calls, name)
+				return next(execCtx)
+			}
+		}
+	}
+
+	endpointMiddleware := func(next pubsubEndpoint.Sender) pubsubEndpoint.Sender {
+		return func(ctx context.Context, msg *message.OutcomingMessage, options ...pubsubEndpoint.DeliveryOption) error {
+			calls = append(calls, "endpoint")
+			return next(ctx, msg, options...)
+		}
+	}
+
+	mBus, err := NewPushBus(
+		log.NewNilLogger(),
+		messageMock.NewMockMarshaller(ctrl),
+		scheme.NewKnownTypesRegistry(),
+		WithHandlerMiddleware(handlerMiddleware("first")),
+		WithEndpointMiddleware(endpointMiddleware),
+	)
+	require.NoError(t, err)
+	mBus.UseHandlerMiddleware(handlerMiddleware("second"))
+
+	endpointInstance := endpoint.NewMockEndpoint(ctrl)
+	mBus.Router().RegisterEndpoint(endpointInstance, &contractB{})
+
+	mBus.Dispatcher().SubscribeForCmd(&contractA{}, func(execCtx messageExecution.MessageExecutionCtx) error {
+		calls = append(calls, "executor")
+		return execCtx.Send(message.NewOutcomingMessage(&contractB{}))
+	})
+
+	executors := mBus.Dispatcher().Match(&contractA{})
+	require.Len(t, executors, 1)
+
+	endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).Return(nil)
+
+	execCtx := messageExecution.NewMessageExecutionCtxFactory(mBus.Router(), log.NewNilLogger()).CreateCtx(context.Background(), message.NewReceivedMessage("123", &contractA{}, message.Headers{}, time.Now(), "queue"))
+	require.NoError(t, executors[0](execCtx))
+	assert.Equal(t, []string{"first", "second", "executor", "endpoint"}, calls)
+}
+
+type shutdownComponent struct {
+	name  string
+	err   error
+	order *[]string
+}
+
+func (c shutdownComponent) Init(b *MessageBus) error {
+	return nil
+}
+
+func (c shutdownComponent) Shutdown(ctx context.Context) error {
+	*c.order = append(*c.order, c.name)
+	return c.err
+}
+
+type closingEndpoint struct {
+	pubsubEndpoint.Endpoint
+	name  string
+	err   error
+	order *[]string
+}
+
+func (e closingEndpoint) Name() string {
+	return e.name
+}
+
+func (e closingEndpoint) Close() error {
+	*e.order = append(*e.order, e.name)
+	return e.err
+}
+
+func TestMessageBus_Shutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	msgMarshallerMock := messageMock.NewMockMarshaller(ctrl)
+
+	t.Run("subscriber is shut down before components in reverse order", func(t *testing.T) {
+		var order []string
+
+		subscriberMock := subscriberMock.NewMockSubscriber(ctrl)
+		subscriberMock.
+			EXPECT().
+			Shutdown(gomock.Any()).
+			DoAndReturn(func(ctx context.Context) error {
+				order = append(order, "subscriber")
+				return subscriber.WithShutdownErr(errors.New("1 packages were nacked"), 1)
+			})
+
+		mBus, err := NewMessageBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithSubscriber(subscriberMock), WithComponents(
+			shutdownComponent{name: "first", order: &order},
+			aComponent{},
+			shutdownComponent{name: "second", err: errors.New("store is down"), order: &order},
+		))
+		require.NoError(t, err)
+
+		err = mBus.Shutdown(context.Background())
+		require.Error(t, err)
+		assert.Equal(t, 1, err.(subscriber.ShutdownErr).ForceNacked)
+		assert.Equal(t, []string{"subscriber", "second", "first"}, order)
+		assert.Contains(t, testLogger.Messages(), "shutting down component foreman.shutdownComponent: store is down")
+	})
+
+	t.Run("endpoints are closed last in order they were registered", func(t *testing.T) {
+		var order []string
+
+		subscriberMock := subscriberMock.NewMockSubscriber(ctrl)
+		subscriberMock.EXPECT().Shutdown(gomock.Any()).Return(nil)
+
+		mBus, err := NewMessageBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithSubscriber(subscriberMock), WithComponents(
+			shutdownComponent{name: "component", order: &order},
+		), WithEndpointMiddleware(pubsubEndpoint.RecoveryMiddleware(testLogger)))
+		require.NoError(t, err)
+
+		mBus.Router().RegisterEndpoint(&closingEndpoint{name: "first", err: errors.New("connection is closed"), order: &order}, &message.ObjectMeta{})
+		mBus.Router().RegisterEndpoint(&closingEndpoint{name: "second", order: &order}, &message.ObjectMeta{})
+
+		assert.EqualError(t, mBus.Shutdown(context.Background()), "closing endpoint first: connection is closed")
+		assert.Equal(t, []string{"component", "first", "second"}, order)
+	})
+
+	t.Run("worker bus shuts down components", func(t *testing.T) {
+		var order []string
+
+		mBus, err := NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), WithComponents(shutdownComponent{name: "first", err: errors.New("store is down"), order: &order}))
+		require.NoError(t, err)
+
+		assert.EqualError(t, mBus.Shutdown(context.Background()), "shutting down component foreman.shutdownComponent: store is down")
+		assert.Equal(t, []string{"first"}, order)
+	})
+}
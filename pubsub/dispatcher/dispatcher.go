@@ -3,6 +3,8 @@ package dispatcher
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
@@ -14,33 +16,55 @@ import (
 type Dispatcher interface {
 	// Match matches object type and returns list of registered executors for this type
 	Match(obj message.Object) []execution.Executor
-	// SubscribeForCmd subscribes given executor for a command
+	// HandleCommand subscribes given executor for a command, only contracts embedding message.Command are accepted
+	HandleCommand(cmd message.CommandContract, executor execution.Executor) Dispatcher
+	// ListenEvent subscribes given executor for an event, only contracts embedding message.Event are accepted
+	ListenEvent(ev message.EventContract, executor execution.Executor) Dispatcher
+	// SubscribeForCmd subscribes given executor for a command. It accepts contracts declaring neither message.Command nor message.Event
+	// for compatibility, prefer HandleCommand.
 	SubscribeForCmd(obj message.Object, executor execution.Executor) Dispatcher
-	// SubscribeForEvent subscribes given executor for an event
+	// SubscribeForEvent subscribes given executor for an event. It accepts contracts declaring neither message.Command nor message.Event
+	// for compatibility, prefer ListenEvent.
 	SubscribeForEvent(obj message.Object, executor execution.Executor) Dispatcher
 	// SubscribeForAllEvents subscribes executor type for all types
 	SubscribeForAllEvents(executor execution.Executor) Dispatcher
+	// SubscribeForGroup subscribes given executor for all events of the group, e.g. every event of "payments" group.
+	// Events are matched by their GroupKind, so types registered in the scheme later are matched as well.
+	SubscribeForGroup(group scheme.Group, executor execution.Executor) Dispatcher
+	// Unsubscribe removes the executor from all subscriptions for commands, events, groups and all events.
+	// Like subscribing, it's safe while messages are processed, a message being processed keeps executors it was matched with.
+	Unsubscribe(executor execution.Executor) Dispatcher
+	// Use adds middlewares wrapped around every matched executor, the first added one is the outermost
+	Use(middlewares ...Middleware) Dispatcher
 }
 
 func NewDispatcher() Dispatcher {
 	return &dispatcher{
-		handlers:  make(map[reflect.Type][]execution.Executor),
-		listeners: make(map[reflect.Type][]execution.Executor),
+		handlers:       make(map[reflect.Type][]execution.Executor),
+		listeners:      make(map[reflect.Type][]execution.Executor),
+		groupListeners: make(map[scheme.Group][]execution.Executor),
 	}
 }
 
+// dispatcher may be subscribed at any time, e.g. by plugins loaded after the bus is started, so subscriptions are guarded by mutex
 type dispatcher struct {
+	mutex           sync.RWMutex
 	handlers        map[reflect.Type][]execution.Executor
 	listeners       map[reflect.Type][]execution.Executor
+	groupListeners  map[scheme.Group][]execution.Executor
 	allEvsListeners []execution.Executor
+	middlewares     []Middleware
 }
 
-func (d dispatcher) Match(obj message.Object) []execution.Executor {
+func (d *dispatcher) Match(obj message.Object) []execution.Executor {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
 	structType := scheme.GetStructType(obj)
 	handlers, exists := d.handlers[structType]
 
 	if exists && len(handlers) > 0 {
-		return handlers
+		return d.wrap(handlers)
 	}
 
 	listenersMap := make(map[uintptr]execution.Executor)
@@ -57,6 +81,12 @@ func (d dispatcher) Match(obj message.Object) []execution.Executor {
 		}
 	}
 
+	if group := obj.GroupKind().Group; !group.Empty() && !message.IsCommand(obj) {
+		for _, ev := range d.groupListeners[group] {
+			listenersMap[reflect.ValueOf(ev).Pointer()] = ev
+		}
+	}
+
 	allEvListeners := make([]execution.Executor, len(listenersMap))
 
 	counter := 0
@@ -65,12 +95,56 @@ func (d dispatcher) Match(obj message.Object) []execution.Executor {
 		counter++
 	}
 
-	return allEvListeners
+	return d.wrap(allEvListeners)
+}
+
+func (d *dispatcher) Use(middlewares ...Middleware) Dispatcher {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.middlewares = append(d.middlewares, middlewares...)
+	return d
+}
+
+// wrap applies middlewares on matching, so they work for executors subscribed before and after Use was called
+func (d *dispatcher) wrap(executors []execution.Executor) []execution.Executor {
+	if len(d.middlewares) == 0 {
+		return executors
+	}
+
+	wrapped := make([]execution.Executor, len(executors))
+
+	for i, executor := range executors {
+		name := ExecutorName(executor)
+
+		for j := len(d.middlewares) - 1; j >= 0; j-- {
+			executor = d.middlewares[j](executor)
+		}
+
+		wrapped[i] = named(name, executor)
+	}
+
+	return wrapped
+}
+
+func (d *dispatcher) HandleCommand(cmd message.CommandContract, executor execution.Executor) Dispatcher {
+	return d.SubscribeForCmd(cmd, executor)
+}
+
+func (d *dispatcher) ListenEvent(ev message.EventContract, executor execution.Executor) Dispatcher {
+	return d.SubscribeForEvent(ev, executor)
 }
 
 func (d *dispatcher) SubscribeForCmd(obj message.Object, executor execution.Executor) Dispatcher {
 	structType := scheme.GetStructType(obj)
 
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if message.IsEvent(obj) {
+		panic(fmt.Sprintf("obj %s is declared as an event, it can't be subscribed for a cmd handler", structType.String()))
+	}
+
 	if _, subscribedForAnEvent := d.listeners[structType]; subscribedForAnEvent {
 		panic(fmt.Sprintf("obj %s already subscribed for an event listener", structType.String()))
 	}
@@ -93,6 +167,13 @@ func (d *dispatcher) SubscribeForCmd(obj message.Object, executor execution.Exec
 func (d *dispatcher) SubscribeForEvent(obj message.Object, executor execution.Executor) Dispatcher {
 	structType := scheme.GetStructType(obj)
 
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if message.IsCommand(obj) {
+		panic(fmt.Sprintf("obj %s is declared as a command, it can't be subscribed for an event listener", structType.String()))
+	}
+
 	if _, subscribedForACmd := d.handlers[structType]; subscribedForACmd {
 		panic(fmt.Sprintf("obj %s already subscribed for a cmd handler", structType.String()))
 	}
@@ -113,6 +194,9 @@ func (d *dispatcher) SubscribeForEvent(obj message.Object, executor execution.Ex
 }
 
 func (d *dispatcher) SubscribeForAllEvents(executor execution.Executor) Dispatcher {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	executorPtr := reflect.ValueOf(executor).Pointer()
 	for _, listener := range d.allEvsListeners {
 		listenerPtr := reflect.ValueOf(listener).Pointer()
@@ -126,3 +210,96 @@ func (d *dispatcher) SubscribeForAllEvents(executor execution.Executor) Dispatch
 	d.allEvsListeners = append(d.allEvsListeners, executor)
 	return d
 }
+
+func (d *dispatcher) SubscribeForGroup(group scheme.Group, executor execution.Executor) Dispatcher {
+	if group.Empty() {
+		panic("group must not be empty, use SubscribeForAllEvents to listen for all events")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	executorPtr := reflect.ValueOf(executor).Pointer()
+
+	for _, listener := range d.groupListeners[group] {
+		//check if this listener was already registered
+		if executorPtr == reflect.ValueOf(listener).Pointer() {
+			return d
+		}
+	}
+
+	d.groupListeners[group] = append(d.groupListeners[group], executor)
+	return d
+}
+
+func (d *dispatcher) Unsubscribe(executor execution.Executor) Dispatcher {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	executorPtr := reflect.ValueOf(executor).Pointer()
+
+	// a type left without executors is forgotten, so it can be subscribed again for a cmd as well as for an event
+	for structType, handlers := range d.handlers {
+		if d.handlers[structType] = without(handlers, executorPtr); len(d.handlers[structType]) == 0 {
+			delete(d.handlers, structType)
+		}
+	}
+
+	for structType, listeners := range d.listeners {
+		if d.listeners[structType] = without(listeners, executorPtr); len(d.listeners[structType]) == 0 {
+			delete(d.listeners, structType)
+		}
+	}
+
+	for group, listeners := range d.groupListeners {
+		if d.groupListeners[group] = without(listeners, executorPtr); len(d.groupListeners[group]) == 0 {
+			delete(d.groupListeners, group)
+		}
+	}
+
+	d.allEvsListeners = without(d.allEvsListeners, executorPtr)
+
+	return d
+}
+
+// without returns a copy of executors without the one at executorPtr, executors being matched right now keep the original slice
+func without(executors []execution.Executor, executorPtr uintptr) []execution.Executor {
+	left := make([]execution.Executor, 0, len(executors))
+
+	for _, executor := range executors {
+		if reflect.ValueOf(executor).Pointer() != executorPtr {
+			left = append(left, executor)
+		}
+	}
+
+	return left
+}
+
+// UntypedContracts returns names of subscribed contracts which declare neither message.Command nor message.Event, sorted.
+// It knows only subscriptions of the dispatcher created by NewDispatcher, nil is returned for other implementations.
+func UntypedContracts(d Dispatcher) []string {
+	subscribed, ok := d.(*dispatcher)
+	if !ok {
+		return nil
+	}
+
+	subscribed.mutex.RLock()
+	defer subscribed.mutex.RUnlock()
+
+	var untyped []string
+
+	for _, types := range []map[reflect.Type][]execution.Executor{subscribed.handlers, subscribed.listeners} {
+		for structType := range types {
+			obj, ok := reflect.New(structType).Interface().(message.Object)
+			if ok && (message.IsCommand(obj) || message.IsEvent(obj)) {
+				continue
+			}
+
+			untyped = append(untyped, structType.String())
+		}
+	}
+
+	sort.Strings(untyped)
+
+	return untyped
+}
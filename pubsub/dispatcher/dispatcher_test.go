@@ -2,6 +2,7 @@ package dispatcher
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/go-foreman/foreman/pubsub/message"
@@ -27,6 +28,16 @@ type confirmationSentEvent struct {
 	message.ObjectMeta
 }
 
+type closeAccountCmd struct {
+	message.ObjectMeta
+	message.Command
+}
+
+type accountClosedEvent struct {
+	message.ObjectMeta
+	message.Event
+}
+
 type service struct {
 }
 
@@ -158,6 +169,144 @@ func TestDispatcher_SubscribeForAllEvents(t *testing.T) {
 	})
 }
 
+func TestDispatcher_Typed(t *testing.T) {
+	t.Run("commands and events are subscribed by typed methods", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.HandleCommand(&closeAccountCmd{}, handler.handle)
+		dispatcher.ListenEvent(&accountClosedEvent{}, handler.anotherHandler)
+
+		handlers := dispatcher.Match(&closeAccountCmd{})
+		require.Len(t, handlers, 1)
+		assertThisValueExists(t, handler.handle, handlers)
+
+		listeners := dispatcher.Match(&accountClosedEvent{})
+		require.Len(t, listeners, 1)
+		assertThisValueExists(t, handler.anotherHandler, listeners)
+	})
+
+	t.Run("event subscribed for a cmd handler", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		assert.PanicsWithValue(t, "obj dispatcher.accountClosedEvent is declared as an event, it can't be subscribed for a cmd handler", func() {
+			dispatcher.SubscribeForCmd(&accountClosedEvent{}, handler.handle)
+		})
+	})
+
+	t.Run("cmd subscribed for an event listener", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		assert.PanicsWithValue(t, "obj dispatcher.closeAccountCmd is declared as a command, it can't be subscribed for an event listener", func() {
+			dispatcher.SubscribeForEvent(&closeAccountCmd{}, handler.handle)
+		})
+	})
+
+	t.Run("untyped contracts are listed", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.HandleCommand(&closeAccountCmd{}, handler.handle)
+		dispatcher.ListenEvent(&accountClosedEvent{}, handler.handle)
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.handle)
+		dispatcher.SubscribeForCmd(&registerAccountCmd{}, handler.handle)
+		dispatcher.SubscribeForAllEvents(handler.anotherHandler)
+
+		assert.Equal(t, []string{"dispatcher.accountRegisteredEvent", "dispatcher.registerAccountCmd"}, UntypedContracts(dispatcher))
+	})
+}
+
+func TestDispatcher_SubscribeForGroup(t *testing.T) {
+	withGroup := func(obj message.Object, group scheme.Group) message.Object {
+		obj.SetGroupKind(&scheme.GroupKind{Group: group, Kind: reflect.TypeOf(obj).Elem().Name()})
+		return obj
+	}
+
+	t.Run("events of the group are matched", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForGroup("accounts", handler.handle)
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.anotherHandler)
+
+		listeners := dispatcher.Match(withGroup(&accountRegisteredEvent{}, "accounts"))
+		require.Len(t, listeners, 2)
+		assertThisValueExists(t, handler.handle, listeners)
+		assertThisValueExists(t, handler.anotherHandler, listeners)
+
+		listeners = dispatcher.Match(withGroup(&accountClosedEvent{}, "accounts"))
+		require.Len(t, listeners, 1, "event not subscribed by its type is matched too")
+		assertThisValueExists(t, handler.handle, listeners)
+
+		assert.Empty(t, dispatcher.Match(withGroup(&accountClosedEvent{}, "payments")))
+		assert.Empty(t, dispatcher.Match(&accountClosedEvent{}), "event without group isn't matched")
+	})
+
+	t.Run("commands of the group aren't matched", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForGroup("accounts", handler.handle)
+
+		assert.Empty(t, dispatcher.Match(withGroup(&closeAccountCmd{}, "accounts")))
+	})
+
+	t.Run("empty group", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		assert.PanicsWithValue(t, "group must not be empty, use SubscribeForAllEvents to listen for all events", func() {
+			dispatcher.SubscribeForGroup("", handler.handle)
+		})
+	})
+}
+
+func TestDispatcher_Unsubscribe(t *testing.T) {
+	t.Run("executor is removed from all subscriptions", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForCmd(&registerAccountCmd{}, handler.handle)
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.handle)
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.anotherHandler)
+		dispatcher.SubscribeForGroup("accounts", handler.handle)
+		dispatcher.SubscribeForAllEvents(handler.handle)
+
+		dispatcher.Unsubscribe(handler.handle)
+
+		assert.Empty(t, dispatcher.Match(&registerAccountCmd{}))
+
+		ev := &accountClosedEvent{}
+		ev.SetGroupKind(&scheme.GroupKind{Group: "accounts", Kind: "accountClosedEvent"})
+		assert.Empty(t, dispatcher.Match(ev))
+
+		listeners := dispatcher.Match(&accountRegisteredEvent{})
+		require.Len(t, listeners, 1)
+		assertThisValueExists(t, handler.anotherHandler, listeners)
+	})
+
+	t.Run("type without executors can be subscribed for an event", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForCmd(&registerAccountCmd{}, handler.handle)
+		dispatcher.Unsubscribe(handler.handle)
+
+		assert.NotPanics(t, func() {
+			dispatcher.SubscribeForEvent(&registerAccountCmd{}, handler.handle)
+		})
+	})
+
+	t.Run("subscriptions change while messages are matched", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.anotherHandler)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, handler.handle)
+				dispatcher.Unsubscribe(handler.handle)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assertThisValueExists(t, handler.anotherHandler, dispatcher.Match(&accountRegisteredEvent{}))
+			}
+		}()
+
+		wg.Wait()
+	})
+}
+
 type notStructType string
 
 func (n notStructType) GroupKind() scheme.GroupKind {
@@ -0,0 +1,68 @@
+package dispatcher
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+)
+
+// ExecutorErr is returned by an executor wrapped with middlewares, it keeps a name of the executor since wrapped one is anonymous
+type ExecutorErr struct {
+	error
+	Executor string
+}
+
+// WithExecutorErr wraps err with ExecutorErr
+func WithExecutorErr(executor string, err error) error {
+	return ExecutorErr{error: err, Executor: executor}
+}
+
+// Cause returns the error of the executor
+func (e ExecutorErr) Cause() error {
+	return e.error
+}
+
+// ExecutorName returns a name of a function or a method the executor was created from, i.e. "pkg.Handler.Handle"
+func ExecutorName(executor execution.Executor) string {
+	if executor == nil {
+		return ""
+	}
+
+	f := runtime.FuncForPC(reflect.ValueOf(executor).Pointer())
+	if f == nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(f.Name(), "-fm")
+}
+
+// FailedExecutor returns a name of the executor which returned err. Executors matched by a dispatcher with middlewares are anonymous,
+// their name is taken from ExecutorErr in the chain of err.
+func FailedExecutor(executor execution.Executor, err error) string {
+	for err != nil {
+		if executorErr, ok := err.(ExecutorErr); ok {
+			return executorErr.Executor
+		}
+
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+
+		err = causer.Cause()
+	}
+
+	return ExecutorName(executor)
+}
+
+func named(name string, executor execution.Executor) execution.Executor {
+	return func(execCtx execution.MessageExecutionCtx) error {
+		if err := executor(execCtx); err != nil {
+			return WithExecutorErr(name, err)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package dispatcher
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// Middleware wraps an executor with cross-cutting logic. It may call next with an enriched context (see execution.WithContext)
+// or return an error without calling next at all.
+type Middleware func(next execution.Executor) execution.Executor
+
+// RecoveryMiddleware converts a panic of an executor into an error, so the message goes the usual way of failed messages
+// instead of killing the consumer
+func RecoveryMiddleware() Middleware {
+	return func(next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					msg := execCtx.Message()
+					execCtx.Logger().Logf(log.ErrorLevel, "panic while executing message %s %s: %v\n%s", msg.UID(), msg.Payload().GroupKind(), r, debug.Stack())
+					err = errors.Errorf("panic while executing message %s %s: %v", msg.UID(), msg.Payload().GroupKind(), r)
+				}
+			}()
+
+			return next(execCtx)
+		}
+	}
+}
+
+// LoggingMiddleware logs execution time of every executor at debug level and failures at error level
+func LoggingMiddleware() Middleware {
+	return func(next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) error {
+			msg := execCtx.Message()
+			started := time.Now()
+
+			err := next(execCtx)
+
+			if err != nil {
+				execCtx.Logger().Logf(log.ErrorLevel, "failed to execute message %s %s in %s. %s", msg.UID(), msg.Payload().GroupKind(), time.Since(started), err)
+				return err
+			}
+
+			execCtx.Logger().Logf(log.DebugLevel, "executed message %s %s in %s", msg.UID(), msg.Payload().GroupKind(), time.Since(started))
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+)
+
+type ctxKey string
+
+func TestDispatcher_Use(t *testing.T) {
+	testLogger := log.NewNilLogger()
+	cmd := &registerAccountCmd{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "test", Kind: "registerAccountCmd"}}}
+	execCtx := execution.NewMessageExecutionCtxFactory(nil, testLogger).CreateCtx(context.Background(), message.NewReceivedMessage("123", cmd, message.Headers{}, time.Now(), "queue"))
+
+	var calls []string
+
+	tracing := func(name string) Middleware {
+		return func(next execution.Executor) execution.Executor {
+			return func(execCtx execution.MessageExecutionCtx) error {
+				calls = append(calls, name)
+				return next(execution.WithContext(execCtx, context.WithValue(execCtx.Context(), ctxKey(name), true)))
+			}
+		}
+	}
+
+	t.Run("middlewares are applied in order of adding to handlers subscribed before and after", func(t *testing.T) {
+		calls = nil
+		dispatcher := NewDispatcher()
+		dispatcher.Use(tracing("first"))
+		dispatcher.SubscribeForCmd(cmd, func(execCtx execution.MessageExecutionCtx) error {
+			calls = append(calls, "handler")
+			assert.Equal(t, true, execCtx.Context().Value(ctxKey("first")))
+			assert.Equal(t, true, execCtx.Context().Value(ctxKey("second")))
+			assert.Same(t, cmd, execCtx.Message().Payload())
+			return nil
+		})
+		dispatcher.Use(tracing("second"))
+
+		executors := dispatcher.Match(cmd)
+		require.Len(t, executors, 1)
+		require.NoError(t, executors[0](execCtx))
+		assert.Equal(t, []string{"first", "second", "handler"}, calls)
+	})
+
+	t.Run("middleware short-circuits execution", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.Use(func(next execution.Executor) execution.Executor {
+			return func(execCtx execution.MessageExecutionCtx) error {
+				return errors.New("unauthorized")
+			}
+		})
+		dispatcher.SubscribeForEvent(&accountRegisteredEvent{}, func(execCtx execution.MessageExecutionCtx) error {
+			t.Fatal("must not be called")
+			return nil
+		})
+
+		executors := dispatcher.Match(&accountRegisteredEvent{})
+		require.Len(t, executors, 1)
+		assert.EqualError(t, executors[0](execCtx), "unauthorized")
+	})
+
+	t.Run("recovery converts panic into error", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		dispatcher := NewDispatcher()
+		dispatcher.Use(RecoveryMiddleware())
+		dispatcher.SubscribeForCmd(cmd, func(execCtx execution.MessageExecutionCtx) error {
+			panic("nil map")
+		})
+
+		err := dispatcher.Match(cmd)[0](execCtx)
+		assert.EqualError(t, err, "panic while executing message 123 test.registerAccountCmd: nil map")
+		testLogger.AssertContainsSubstr(t, "panic while executing message 123 test.registerAccountCmd: nil map")
+	})
+
+	t.Run("logging of failed execution", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		dispatcher := NewDispatcher()
+		dispatcher.Use(LoggingMiddleware())
+		dispatcher.SubscribeForCmd(cmd, func(execCtx execution.MessageExecutionCtx) error {
+			return errors.New("handler error")
+		})
+
+		assert.EqualError(t, dispatcher.Match(cmd)[0](execCtx), "handler error")
+		testLogger.AssertContainsSubstr(t, "failed to execute message 123 test.registerAccountCmd in ")
+	})
+}
+
+func TestFailedExecutor(t *testing.T) {
+	testLogger := log.NewNilLogger()
+	cmd := &registerAccountCmd{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "test", Kind: "registerAccountCmd"}}}
+	execCtx := execution.NewMessageExecutionCtxFactory(nil, testLogger).CreateCtx(context.Background(), message.NewReceivedMessage("123", cmd, message.Headers{}, time.Now(), "queue"))
+	handler := &accountHandler{}
+
+	t.Run("executor without middlewares", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.SubscribeForCmd(cmd, handler.Handle)
+
+		executors := dispatcher.Match(cmd)
+		require.Len(t, executors, 1)
+
+		err := executors[0](execCtx)
+		assert.EqualError(t, err, "account already exists")
+		assert.Equal(t, "github.com/go-foreman/foreman/pubsub/dispatcher.(*accountHandler).Handle", FailedExecutor(executors[0], err))
+	})
+
+	t.Run("executor wrapped with middlewares", func(t *testing.T) {
+		dispatcher := NewDispatcher()
+		dispatcher.Use(LoggingMiddleware())
+		dispatcher.SubscribeForCmd(cmd, handler.Handle)
+
+		executors := dispatcher.Match(cmd)
+		require.Len(t, executors, 1)
+
+		err := executors[0](execCtx)
+		assert.EqualError(t, err, "account already exists")
+		assert.Equal(t, "github.com/go-foreman/foreman/pubsub/dispatcher.(*accountHandler).Handle", FailedExecutor(executors[0], errors.Wrap(err, "executing")))
+	})
+}
+
+type accountHandler struct{}
+
+func (h *accountHandler) Handle(execCtx execution.MessageExecutionCtx) error {
+	return errors.New("account already exists")
+}
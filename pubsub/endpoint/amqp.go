@@ -5,53 +5,237 @@ import (
 	"time"
 
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/signing"
 	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
 	"github.com/pkg/errors"
 )
 
 // AmqpEndpoint uses amqp transport to send out a message.
 type AmqpEndpoint struct {
-	amqpTransport transport.Transport
-	destination   transport.DeliveryDestination
-	msgMarshaller message.Marshaller
-	name          string
+	amqpTransport   transport.Transport
+	destination     transport.DeliveryDestination
+	msgMarshaller   message.Marshaller
+	name            string
+	delayedExchange bool
+	idempotency     *idempotency
+	signer          *signing.Signer
+	delayQueues     *delayQueues
+	ownsTransport   bool
+	cipher          message.Cipher
+}
+
+// AmqpEndpointOpt configures AmqpEndpoint
+type AmqpEndpointOpt func(e *AmqpEndpoint)
+
+// WithDelayedExchange tells the endpoint that destination topic is declared with amqp.WithDelayedMessageType.
+// Delayed messages are held by the broker. Without it or WithDelayQueues delayed messages are refused with UnsupportedDeliveryOptionErr.
+func WithDelayedExchange() AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.delayedExchange = true
+	}
+}
+
+// WithDelayQueues delays messages without rabbitmq_delayed_message_exchange plugin. A delayed message is published into a queue
+// whose messages expire after the delay (rounded up to a second) and are dead lettered into the destination, there is a queue
+// for each delay. WithDelayedExchange takes precedence if both are passed.
+func WithDelayQueues() AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.delayQueues = newDelayQueues()
+	}
+}
+
+// WithSharedSeenKeys enables WithIdempotencyKey option with SharedScope, sent keys are remembered in the passed SeenKeys
+func WithSharedSeenKeys(seenKeys SeenKeys) AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.idempotency.shared = seenKeys
+	}
+}
+
+// WithLocalSeenKeys replaces the process local LRU of DefaultLocalSeenKeysCapacity keys used for WithIdempotencyKey option with ProcessScope
+func WithLocalSeenKeys(seenKeys SeenKeys) AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.idempotency.local = seenKeys
+	}
+}
+
+// WithIdempotencyTTL sets how long idempotency keys of sent messages are remembered, DefaultIdempotencyTTL by default
+func WithIdempotencyTTL(ttl time.Duration) AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.idempotency.ttl = ttl
+	}
+}
+
+// WithSigner signs each sent message with the signer, receivers verify it with signing.Verifier
+func WithSigner(signer *signing.Signer) AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.signer = signer
+	}
+}
+
+// WithCipher encrypts payloads of sent messages after they are marshalled, receivers decrypt them with the same cipher.
+// A signature of WithSigner covers the encrypted payload.
+func WithCipher(cipher message.Cipher) AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.cipher = cipher
+	}
+}
+
+// WithOwnTransport makes Close of the endpoint disconnect its transport. Pass it if the transport is used only by this endpoint,
+// e.g. a separate connection for publishing, so MessageBus.Shutdown disconnects it after the subscriber has stopped.
+func WithOwnTransport() AmqpEndpointOpt {
+	return func(e *AmqpEndpoint) {
+		e.ownsTransport = true
+	}
 }
 
 // NewAmqpEndpoint creates new instance of AmqpEndpoint
-func NewAmqpEndpoint(name string, amqpTransport transport.Transport, destination transport.DeliveryDestination, msgMarshaller message.Marshaller) Endpoint {
-	return &AmqpEndpoint{name: name, amqpTransport: amqpTransport, destination: destination, msgMarshaller: msgMarshaller}
+func NewAmqpEndpoint(name string, amqpTransport transport.Transport, destination transport.DeliveryDestination, msgMarshaller message.Marshaller, opts ...AmqpEndpointOpt) Endpoint {
+	e := &AmqpEndpoint{name: name, amqpTransport: amqpTransport, destination: destination, msgMarshaller: msgMarshaller, idempotency: newIdempotency()}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
 }
 
 func (a AmqpEndpoint) Name() string {
 	return a.name
 }
 
+// Close disconnects the transport if the endpoint owns it, see WithOwnTransport
+func (a AmqpEndpoint) Close() error {
+	if !a.ownsTransport {
+		return nil
+	}
+
+	return errors.Wrapf(a.amqpTransport.Disconnect(context.Background()), "disconnecting transport of endpoint %s", a.name)
+}
+
+// SupportsDelay is true with WithDelayedExchange or WithDelayQueues
+func (a AmqpEndpoint) SupportsDelay() bool {
+	return a.delayedExchange || a.delayQueues != nil
+}
+
 func (a AmqpEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, opts ...DeliveryOption) error {
-	deliveryOpts := &deliveryOptions{}
+	return a.SendBatch(ctx, []*message.OutcomingMessage{msg}, opts...)
+}
 
+// SendBatch marshals all messages before sending any of them, so a message which can't be marshalled fails the whole batch.
+// More than one message is published by transport.Transport.SendBatch in a single confirm cycle, a single message is sent as before.
+// An idempotency key passed by WithIdempotencyKey covers the whole batch, it's forgotten if any of messages wasn't sent.
+func (a AmqpEndpoint) SendBatch(ctx context.Context, msgs []*message.OutcomingMessage, opts ...DeliveryOption) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	deliveryOpts := &deliveryOptions{}
 	for _, opt := range opts {
 		opt(deliveryOpts)
 	}
 
-	dataToSend, err := a.msgMarshaller.Marshal(msg.Payload())
+	delay := deliveryOpts.effectiveDelay()
+
+	if delay > 0 && !a.delayedExchange && a.delayQueues == nil {
+		return WithUnsupportedDeliveryOptionErr(errors.Errorf("message %s is delayed by %s, but endpoint %s has neither a delayed exchange nor delay queues", msgs[0].UID(), delay, a.name))
+	}
+
+	toSend := make([]transport.OutboundPkg, len(msgs))
+
+	for i, msg := range msgs {
+		pkg, err := a.outboundPkg(msg, delay)
+		if err != nil {
+			return err
+		}
+
+		toSend[i] = pkg
+	}
+
+	if a.delayedExchange && delay > amqp.MaxDelay {
+		return WithUnsupportedDeliveryOptionErr(errors.Errorf("delay %s of message %s exceeds maximum %s supported by the broker", delay, msgs[0].UID(), amqp.MaxDelay))
+	}
+
+	return a.idempotency.send(ctx, deliveryOpts, func() error {
+		if delay > 0 && !a.delayedExchange {
+			return a.publishIntoDelayQueue(ctx, msgs, toSend, delay)
+		}
+
+		return a.publish(ctx, msgs, toSend, delay)
+	})
+}
+
+// publishIntoDelayQueue publishes packages into the queue which holds them for the delay, see WithDelayQueues
+func (a AmqpEndpoint) publishIntoDelayQueue(ctx context.Context, msgs []*message.OutcomingMessage, toSend []transport.OutboundPkg, delay time.Duration) error {
+	destination, err := a.delayQueues.destination(ctx, a.amqpTransport, a.destination, delay)
+	if err != nil {
+		return err
+	}
+
+	delayed := make([]transport.OutboundPkg, len(toSend))
+	for i, pkg := range toSend {
+		delayed[i] = transport.NewOutboundPkg(pkg.Payload(), pkg.ContentType(), destination, pkg.Headers())
+	}
+
+	return a.publish(ctx, msgs, delayed, 0)
+}
 
+func (a AmqpEndpoint) outboundPkg(msg *message.OutcomingMessage, delay time.Duration) (transport.OutboundPkg, error) {
+	dataToSend, err := a.msgMarshaller.Marshal(msg.Payload())
 	if err != nil {
-		return errors.Wrapf(err, "error serializing message %s to json ", msg.UID())
+		return nil, errors.Wrapf(err, "error serializing message %s", msg.UID())
+	}
+
+	// headers of outcoming messages are often shared between deliveries (and the received message), changes must not leak into them
+	headers := make(message.Headers, len(msg.Headers())+6)
+	for k, v := range msg.Headers() {
+		headers[k] = v
+	}
+
+	contentType := message.ContentTypeOf(a.msgMarshaller)
+	headers.SetContentType(contentType)
+
+	// the message becomes available for consumers only after the delay
+	headers.SetPublishedAt(time.Now().Add(delay))
+
+	if delay > 0 {
+		headers[DeliveryDelayHeader] = delay.Milliseconds()
+	}
+
+	if a.cipher != nil {
+		if dataToSend, err = a.cipher.Encrypt(dataToSend, headers); err != nil {
+			return nil, errors.Wrapf(err, "error encrypting message %s", msg.UID())
+		}
+	}
+
+	if a.signer != nil {
+		a.signer.Sign(dataToSend, headers)
+	}
+
+	return transport.NewOutboundPkg(dataToSend, contentType, a.destination, headers), nil
+}
+
+func (a AmqpEndpoint) publish(ctx context.Context, msgs []*message.OutcomingMessage, toSend []transport.OutboundPkg, delay time.Duration) error {
+	var sendOpts []transport.SendOpt
+
+	if delay > 0 {
+		sendOpts = append(sendOpts, amqp.WithDelay(delay))
 	}
 
-	toSend := transport.NewOutboundPkg(dataToSend, "application/json", a.destination, msg.Headers())
+	if len(toSend) == 1 {
+		return a.amqpTransport.Send(ctx, toSend[0], sendOpts...)
+	}
 
-	if deliveryOpts.delay != nil {
-		timer := time.NewTimer(*deliveryOpts.delay)
-		defer timer.Stop()
+	err := a.amqpTransport.SendBatch(ctx, toSend, sendOpts...)
 
-		select {
-		case <-ctx.Done():
-			return errors.Errorf("failed to send message %s. Was waiting for the delay and parent ctx closed.", msg.UID())
-		case <-timer.C:
-			break
+	if batchErr, ok := err.(transport.BatchErr); ok {
+		failed := make(map[string]error, len(batchErr.Failed))
+		for i, pkgErr := range batchErr.Failed {
+			failed[msgs[i].UID()] = pkgErr
 		}
+
+		return WithBatchSendErr(errors.Errorf("%d of %d messages weren't sent", len(failed), len(msgs)), failed)
 	}
 
-	return a.amqpTransport.Send(ctx, toSend)
+	return err
 }
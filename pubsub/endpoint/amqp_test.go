@@ -2,16 +2,21 @@ package endpoint
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/signing"
 	"github.com/pkg/errors"
 
 	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
 	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	mockTransport "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
 	"github.com/golang/mock/gomock"
@@ -51,7 +56,7 @@ func TestAmqpEndpoint(t *testing.T) {
 			outcomingMsg := message.NewOutcomingMessage(payload)
 			err := amqpEndpoint.Send(context.Background(), outcomingMsg)
 			assert.Error(t, err)
-			assert.EqualError(t, err, fmt.Sprintf("error serializing message %s to json : some error", outcomingMsg.UID()))
+			assert.EqualError(t, err, fmt.Sprintf("error serializing message %s: some error", outcomingMsg.UID()))
 		})
 
 		t.Run("sent", func(t *testing.T) {
@@ -59,7 +64,7 @@ func TestAmqpEndpoint(t *testing.T) {
 			payload := &testObj{}
 
 			outcomingMsg := message.NewOutcomingMessage(payload, message.WithHeaders(message.Headers{"test": 1}))
-			outboundPkg := transport.NewOutboundPkg([]byte("data"), "application/json", destination, outcomingMsg.Headers())
+			outboundPkg := transport.NewOutboundPkg([]byte("data"), "application/json", destination, message.Headers{"test": 1, "uid": outcomingMsg.UID(), message.ContentTypeHeader: "application/json"})
 
 			t.Run("with error", func(t *testing.T) {
 				marshallerTest.
@@ -69,7 +74,7 @@ func TestAmqpEndpoint(t *testing.T) {
 
 				transportTest.
 					EXPECT().
-					Send(ctx, outboundPkg).
+					Send(ctx, publishedPkg(outboundPkg)).
 					Return(errors.New("transport error"))
 
 				err := amqpEndpoint.Send(ctx, outcomingMsg)
@@ -85,44 +90,312 @@ func TestAmqpEndpoint(t *testing.T) {
 
 				transportTest.
 					EXPECT().
-					Send(ctx, outboundPkg).
+					Send(ctx, publishedPkg(outboundPkg)).
 					Return(nil)
 				assert.NoError(t, amqpEndpoint.Send(ctx, outcomingMsg))
 			})
 
-			t.Run("ctx canceled while waiting for the delay", func(t *testing.T) {
-				ctx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
-				defer cancel()
+			t.Run("delay without broker support is refused", func(t *testing.T) {
+				err := amqpEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Millisecond*200))
+				require.Error(t, err)
+				assert.IsType(t, &UnsupportedDeliveryOptionErr{}, err)
+				assert.EqualError(t, err, fmt.Sprintf("message %s is delayed by 200ms, but endpoint amqp has neither a delayed exchange nor delay queues", outcomingMsg.UID()))
+
+				assert.Error(t, amqpEndpoint.Send(ctx, outcomingMsg, WithDeliverAt(time.Now().Add(time.Hour))))
+			})
+
+			t.Run("delayed exchange schedules delivery on the broker", func(t *testing.T) {
+				delayedEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithDelayedExchange())
 
 				marshallerTest.
 					EXPECT().
 					Marshal(payload).
 					Return([]byte("data"), nil)
 
-				err := amqpEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Millisecond*300))
-				assert.Error(t, err)
-				assert.EqualError(t, err, fmt.Sprintf("failed to send message %s. Was waiting for the delay and parent ctx closed.", outcomingMsg.UID()))
+				delayedPkg := transport.NewOutboundPkg([]byte("data"), "application/json", destination, message.Headers{"test": 1, "uid": outcomingMsg.UID(), DeliveryDelayHeader: int64(30000), message.ContentTypeHeader: "application/json"})
+
+				transportTest.
+					EXPECT().
+					Send(ctx, publishedPkg(delayedPkg), gomock.Any()).
+					Return(nil)
+
+				err := delayedEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Second*30))
+				assert.NoError(t, err)
+				assert.NotContains(t, outcomingMsg.Headers(), DeliveryDelayHeader, "headers of the original message must stay untouched")
+				assert.NotContains(t, outcomingMsg.Headers(), message.PublishedAtHeader, "headers of the original message must stay untouched")
 			})
 
-			t.Run("with delay opt", func(t *testing.T) {
-				ctx, cancel := context.WithTimeout(ctx, time.Millisecond*300)
-				defer cancel()
+			t.Run("saga and trace headers survive the delay", func(t *testing.T) {
+				delayedEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithDelayedExchange())
+				sagaMsg := message.NewOutcomingMessage(payload, message.WithHeaders(message.Headers{"sagaUID": "123", "traceId": "trace"}))
 
 				marshallerTest.
 					EXPECT().
 					Marshal(payload).
 					Return([]byte("data"), nil)
 
+				delayedPkg := transport.NewOutboundPkg([]byte("data"), "application/json", destination, message.Headers{"sagaUID": "123", "traceId": "trace", "uid": sagaMsg.UID(), DeliveryDelayHeader: int64(900000), message.ContentTypeHeader: "application/json"})
+
 				transportTest.
 					EXPECT().
-					Send(ctx, outboundPkg).
+					Send(ctx, publishedPkg(delayedPkg), gomock.Any()).
 					Return(nil)
 
-				err := amqpEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Millisecond*200))
+				assert.NoError(t, delayedEndpoint.Send(ctx, sagaMsg, WithDelay(time.Minute*15)))
+			})
+
+			t.Run("delay queues hold messages without the plugin", func(t *testing.T) {
+				delayQueueEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithDelayQueues())
+				delayQueue := transport.DeliveryDestination{RoutingKey: "messagebus_topic.events.delay.30000"}
+
+				marshallerTest.
+					EXPECT().
+					Marshal(payload).
+					Return([]byte("data"), nil).
+					Times(2)
+
+				transportTest.
+					EXPECT().
+					CreateQueue(ctx, amqp.Queue("messagebus_topic.events.delay.30000", true, false, false, false,
+						amqp.WithDeadLetterExchange("messagebus_topic", "events"),
+						amqp.WithMessageTTL(time.Second*30),
+						amqp.WithExpires(time.Minute*2),
+					)).
+					Return(nil)
+
+				transportTest.
+					EXPECT().
+					Send(ctx, gomock.Any()).
+					DoAndReturn(func(ctx context.Context, pkg transport.OutboundPkg, opts ...transport.SendOpt) error {
+						assert.Equal(t, delayQueue, pkg.Destination())
+						assert.Empty(t, opts, "the message isn't delayed by the plugin")
+						return nil
+					}).
+					Times(2)
+
+				require.NoError(t, delayQueueEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Second*30)))
+				require.NoError(t, delayQueueEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Millisecond*29500)), "delay is rounded up to a second, the queue is declared once")
+			})
+
+			t.Run("delay queue can't be declared", func(t *testing.T) {
+				delayQueueEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithDelayQueues())
+
+				marshallerTest.
+					EXPECT().
+					Marshal(payload).
+					Return([]byte("data"), nil)
+
+				transportTest.EXPECT().CreateQueue(ctx, gomock.Any()).Return(errors.New("access refused"))
+
+				err := delayQueueEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Second))
+				assert.EqualError(t, err, "declaring delay queue messagebus_topic.events.delay.1000: access refused")
+			})
+
+			t.Run("delay exceeds maximum supported by the broker", func(t *testing.T) {
+				delayedEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithDelayedExchange())
+
+				marshallerTest.
+					EXPECT().
+					Marshal(payload).
+					Return([]byte("data"), nil)
+
+				err := delayedEndpoint.Send(ctx, outcomingMsg, WithDelay(time.Hour*24*60))
+				require.Error(t, err)
+				assert.IsType(t, &UnsupportedDeliveryOptionErr{}, err)
+				assert.Contains(t, err.Error(), "exceeds maximum 1193h2m47.295s supported by the broker")
+			})
+
+			t.Run("deliver at time in the past", func(t *testing.T) {
+				marshallerTest.
+					EXPECT().
+					Marshal(payload).
+					Return([]byte("data"), nil)
+
+				transportTest.
+					EXPECT().
+					Send(ctx, publishedPkg(outboundPkg)).
+					Return(nil)
+
+				err := amqpEndpoint.Send(ctx, outcomingMsg, WithDeliverAt(time.Now().Add(-time.Minute)))
 				assert.NoError(t, err)
 			})
+		})
+	})
+
+	t.Run("send batch", func(t *testing.T) {
+		ctx := context.Background()
+		first, second := &testObj{}, &testObj{}
+		firstMsg, secondMsg := message.NewOutcomingMessage(first), message.NewOutcomingMessage(second)
+		batch := []*message.OutcomingMessage{firstMsg, secondMsg}
+
+		expectedPkg := func(msg *message.OutcomingMessage) gomock.Matcher {
+			return publishedPkg(transport.NewOutboundPkg([]byte("data"), "application/json", destination, message.Headers{"uid": msg.UID(), message.ContentTypeHeader: "application/json"}))
+		}
+
+		t.Run("published at once", func(t *testing.T) {
+			marshallerTest.EXPECT().Marshal(first).Return([]byte("data"), nil)
+			marshallerTest.EXPECT().Marshal(second).Return([]byte("data"), nil)
+
+			transportTest.
+				EXPECT().
+				SendBatch(ctx, gomock.Any()).
+				DoAndReturn(func(ctx context.Context, pkgs []transport.OutboundPkg, options ...transport.SendOpt) error {
+					require.Len(t, pkgs, 2)
+					assert.True(t, expectedPkg(firstMsg).Matches(pkgs[0]))
+					assert.True(t, expectedPkg(secondMsg).Matches(pkgs[1]))
+					return nil
+				})
+
+			assert.NoError(t, amqpEndpoint.SendBatch(ctx, batch))
+		})
+
+		t.Run("failed messages are identified by uids", func(t *testing.T) {
+			nacked := errors.New("nacked")
+			marshallerTest.EXPECT().Marshal(first).Return([]byte("data"), nil)
+			marshallerTest.EXPECT().Marshal(second).Return([]byte("data"), nil)
+
+			transportTest.
+				EXPECT().
+				SendBatch(ctx, gomock.Any()).
+				Return(transport.WithBatchErr(errors.New("1 of 2 pkgs weren't sent"), map[int]error{1: nacked}))
+
+			err := amqpEndpoint.SendBatch(ctx, batch)
+			require.Error(t, err)
+			require.IsType(t, BatchSendErr{}, err)
+			assert.EqualError(t, err, "1 of 2 messages weren't sent")
+			assert.Equal(t, map[string]error{secondMsg.UID(): nacked}, err.(BatchSendErr).Failed)
+		})
+
+		t.Run("nothing is sent if a message can't be marshalled", func(t *testing.T) {
+			marshallerTest.EXPECT().Marshal(first).Return([]byte("data"), nil)
+			marshallerTest.EXPECT().Marshal(second).Return(nil, errors.New("some error"))
 
+			err := amqpEndpoint.SendBatch(ctx, batch)
+			assert.EqualError(t, err, fmt.Sprintf("error serializing message %s: some error", secondMsg.UID()))
 		})
+
+		t.Run("empty batch", func(t *testing.T) {
+			assert.NoError(t, amqpEndpoint.SendBatch(ctx, nil))
+		})
+	})
+
+	t.Run("close", func(t *testing.T) {
+		assert.NoError(t, Close(amqpEndpoint), "shared transport isn't disconnected")
+
+		transportTest.EXPECT().Disconnect(gomock.Any()).Return(errors.New("channel is closed"))
+		ownEndpoint := NewAmqpEndpoint("publisher", transportTest, destination, marshallerTest, WithOwnTransport())
+		assert.EqualError(t, Close(ownEndpoint), "disconnecting transport of endpoint publisher: channel is closed")
+	})
+
+	t.Run("encrypted message", func(t *testing.T) {
+		ctx := context.Background()
+		cipher, err := message.NewAESCipher("key-1", map[string][]byte{"key-1": make([]byte, 32)})
+		require.NoError(t, err)
+
+		encryptingEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithCipher(cipher))
+		payload := &testObj{}
+		msg := message.NewOutcomingMessage(payload)
+
+		marshallerTest.EXPECT().Marshal(payload).Return([]byte("data"), nil)
+		transportTest.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, pkg transport.OutboundPkg, options ...transport.SendOpt) error {
+				assert.NotEqual(t, []byte("data"), pkg.Payload())
+				assert.Equal(t, "key-1", pkg.Headers()[message.EncryptionKeyIDHeader])
+
+				decrypted, err := cipher.Decrypt(pkg.Payload(), pkg.Headers())
+				require.NoError(t, err)
+				assert.Equal(t, []byte("data"), decrypted)
+				return nil
+			})
+
+		require.NoError(t, encryptingEndpoint.Send(ctx, msg))
+		assert.NotContains(t, msg.Headers(), message.EncryptionKeyIDHeader, "headers of the message aren't changed")
 	})
 
+	t.Run("signed message", func(t *testing.T) {
+		ctx := context.Background()
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		signingEndpoint := NewAmqpEndpoint("amqp", transportTest, destination, marshallerTest, WithSigner(signing.NewSigner("key-1", privateKey)))
+		payload := &testObj{}
+		msg := message.NewOutcomingMessage(payload)
+
+		marshallerTest.EXPECT().Marshal(payload).Return([]byte("data"), nil)
+		transportTest.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, pkg transport.OutboundPkg, options ...transport.SendOpt) error {
+				assert.Equal(t, "key-1", pkg.Headers()[signing.KeyIDHeader])
+				verifier := signing.NewVerifier(map[string]ed25519.PublicKey{"key-1": publicKey})
+				assert.NoError(t, verifier.Verify(payload.GroupKind(), pkg.Payload(), pkg.Headers()))
+				return nil
+			})
+
+		require.NoError(t, signingEndpoint.Send(ctx, msg))
+		assert.NotContains(t, msg.Headers(), signing.SignatureHeader, "headers of the message aren't changed")
+	})
+
+}
+
+func TestDeliveryDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), DeliveryDelay())
+	assert.Equal(t, time.Second, DeliveryDelay(WithDelay(time.Second)))
+	assert.Equal(t, time.Duration(0), DeliveryDelay(WithDeliverAt(time.Now().Add(-time.Hour))))
+
+	delay := DeliveryDelay(WithDelay(time.Second), WithDeliverAt(time.Now().Add(time.Hour)))
+	assert.True(t, delay > time.Minute*59, "the last passed option wins")
+
+	assert.Equal(t, time.Second, DeliveryDelay(WithDeliverAt(time.Now().Add(time.Hour)), WithDelay(time.Second)))
+}
+
+func TestSupportsDelay(t *testing.T) {
+	destination := transport.DeliveryDestination{DestinationTopic: "messagebus_topic", RoutingKey: "events"}
+
+	plain := NewAmqpEndpoint("amqp", nil, destination, nil)
+	delayedExchange := NewAmqpEndpoint("amqp", nil, destination, nil, WithDelayedExchange())
+	delayQueues := NewAmqpEndpoint("amqp", nil, destination, nil, WithDelayQueues())
+
+	assert.False(t, SupportsDelay(plain))
+	assert.True(t, SupportsDelay(delayedExchange))
+	assert.True(t, SupportsDelay(delayQueues))
+
+	assert.True(t, SupportsDelay(WithMiddleware(delayedExchange)), "wrapping endpoints ask the wrapped one")
+	assert.False(t, SupportsDelay(NewOutboxEndpoint(plain, nil)))
+	assert.True(t, SupportsDelay(WithStoreDelay(plain, &stubDelayStore{})), "the store holds delayed messages")
+}
+
+// publishedPkg matches an outbound package ignoring the value of publishing timestamp, which must be set though
+func publishedPkg(expected transport.OutboundPkg) gomock.Matcher {
+	return publishedPkgMatcher{expected: expected}
+}
+
+type publishedPkgMatcher struct {
+	expected transport.OutboundPkg
+}
+
+func (m publishedPkgMatcher) Matches(x interface{}) bool {
+	actual, ok := x.(transport.OutboundPkg)
+	if !ok {
+		return false
+	}
+
+	if _, published := message.Headers(actual.Headers()).PublishedAt(); !published {
+		return false
+	}
+
+	headers := make(map[string]interface{})
+	for k, v := range actual.Headers() {
+		if k != message.PublishedAtHeader {
+			headers[k] = v
+		}
+	}
+
+	return reflect.DeepEqual(transport.NewOutboundPkg(actual.Payload(), actual.ContentType(), actual.Destination(), headers), m.expected)
+}
+
+func (m publishedPkgMatcher) String() string {
+	return fmt.Sprintf("is published %v", m.expected)
 }
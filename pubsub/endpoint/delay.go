@@ -0,0 +1,114 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
+	"github.com/pkg/errors"
+)
+
+// delayQueues declares amqp queues which hold messages for a delay and dead letter them into the destination afterwards.
+// A queue is declared per delay rounded up to a second, the broker deletes it once it isn't declared again for a while.
+type delayQueues struct {
+	mutex    sync.Mutex
+	declared map[time.Duration]time.Time
+}
+
+func newDelayQueues() *delayQueues {
+	return &delayQueues{declared: make(map[time.Duration]time.Time)}
+}
+
+// destination returns where a message delayed by delay is published, the queue is declared again before it could expire
+func (q *delayQueues) destination(ctx context.Context, amqpTransport transport.Transport, destination transport.DeliveryDestination, delay time.Duration) (transport.DeliveryDestination, error) {
+	queueDelay := delay.Truncate(time.Second)
+	if queueDelay < delay {
+		queueDelay += time.Second
+	}
+
+	name := fmt.Sprintf("%s.%s.delay.%d", destination.DestinationTopic, destination.RoutingKey, queueDelay.Milliseconds())
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// a message published after the last declaration leaves the queue before it expires
+	if declaredAt, declared := q.declared[queueDelay]; !declared || time.Since(declaredAt) >= queueDelay {
+		queue := amqp.Queue(name, true, false, false, false,
+			amqp.WithDeadLetterExchange(destination.DestinationTopic, destination.RoutingKey),
+			amqp.WithMessageTTL(queueDelay),
+			amqp.WithExpires(2*queueDelay+time.Minute),
+		)
+
+		if err := amqpTransport.CreateQueue(ctx, queue); err != nil {
+			return transport.DeliveryDestination{}, errors.Wrapf(err, "declaring delay queue %s", name)
+		}
+
+		q.declared[queueDelay] = time.Now()
+	}
+
+	// the default exchange routes a message into the queue named by its routing key
+	return transport.DeliveryDestination{RoutingKey: name}, nil
+}
+
+// DelayStore keeps messages whose delivery is postponed until they are due, saga.SQLDelayStore is one
+type DelayStore interface {
+	// Delay stores the message to be sent through the endpoint at deliverAt. Idempotency key of options is kept with it
+	// and passed when the message is sent.
+	Delay(ctx context.Context, endpoint string, msg *message.OutcomingMessage, deliverAt time.Time, options ...DeliveryOption) error
+}
+
+// WithStoreDelay delays messages of an endpoint whose transport doesn't support delays: a message sent with WithDelay or
+// WithDeliverAt is kept in the store and a worker (e.g. saga.DelayDispatcher) sends it through the endpoint when it's due.
+// Other messages are sent right away.
+func WithStoreDelay(e Endpoint, store DelayStore) Endpoint {
+	return &storeDelayEndpoint{Endpoint: e, store: store}
+}
+
+type storeDelayEndpoint struct {
+	Endpoint
+	store DelayStore
+}
+
+// SupportsDelay is always true, delayed messages are kept in the store
+func (e *storeDelayEndpoint) SupportsDelay() bool {
+	return true
+}
+
+func (e *storeDelayEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+	delay := DeliveryDelay(options...)
+	if delay <= 0 {
+		return e.Endpoint.Send(ctx, msg, options...)
+	}
+
+	if err := e.store.Delay(ctx, e.Name(), msg, time.Now().Add(delay), options...); err != nil {
+		return errors.Wrapf(err, "delaying message %s of endpoint %s", msg.UID(), e.Name())
+	}
+
+	return nil
+}
+
+func (e *storeDelayEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error {
+	delay := DeliveryDelay(options...)
+	if delay <= 0 {
+		return e.Endpoint.SendBatch(ctx, messages, options...)
+	}
+
+	deliverAt := time.Now().Add(delay)
+	failed := make(map[string]error)
+
+	for _, msg := range messages {
+		if err := e.store.Delay(ctx, e.Name(), msg, deliverAt, options...); err != nil {
+			failed[msg.UID()] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return WithBatchSendErr(errors.Errorf("%d of %d messages of endpoint %s aren't delayed", len(failed), len(messages), e.Name()), failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package endpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type delayedMsg struct {
+	endpoint       string
+	uid            string
+	deliverAt      time.Time
+	idempotencyKey string
+}
+
+type stubDelayStore struct {
+	delayed []delayedMsg
+	fail    map[string]error
+}
+
+func (s *stubDelayStore) Delay(ctx context.Context, endpoint string, msg *message.OutcomingMessage, deliverAt time.Time, options ...DeliveryOption) error {
+	if err := s.fail[msg.UID()]; err != nil {
+		return err
+	}
+
+	key, _ := DeliveryIdempotencyKey(options...)
+	s.delayed = append(s.delayed, delayedMsg{endpoint: endpoint, uid: msg.UID(), deliverAt: deliverAt, idempotencyKey: key})
+
+	return nil
+}
+
+func TestWithStoreDelay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("message without delay is sent right away", func(t *testing.T) {
+		target, store := &recordingEndpoint{}, &stubDelayStore{}
+		msg := message.NewOutcomingMessage(&testObj{})
+
+		require.NoError(t, WithStoreDelay(target, store).Send(ctx, msg))
+		assert.Equal(t, []string{msg.UID()}, target.sent)
+		assert.Empty(t, store.delayed)
+	})
+
+	t.Run("delayed message is stored", func(t *testing.T) {
+		target, store := &recordingEndpoint{}, &stubDelayStore{}
+		msg := message.NewOutcomingMessage(&testObj{})
+		deliverAt := time.Now().Add(time.Hour)
+
+		require.NoError(t, WithStoreDelay(target, store).Send(ctx, msg, WithDeliverAt(deliverAt)))
+		assert.Empty(t, target.sent)
+		require.Len(t, store.delayed, 1)
+		assert.Equal(t, "recording", store.delayed[0].endpoint)
+		assert.Equal(t, msg.UID(), store.delayed[0].uid)
+		assert.WithinDuration(t, deliverAt, store.delayed[0].deliverAt, time.Second)
+	})
+
+	t.Run("idempotency key is stored with delayed messages", func(t *testing.T) {
+		store := &stubDelayStore{}
+		delayed := WithStoreDelay(&recordingEndpoint{}, store)
+		first, second := message.NewOutcomingMessage(&testObj{}), message.NewOutcomingMessage(&testObj{})
+
+		require.NoError(t, delayed.Send(ctx, first, WithDelay(time.Minute), WithIdempotencyKey("order-1", SharedScope)))
+		require.NoError(t, delayed.SendBatch(ctx, []*message.OutcomingMessage{second}, WithDelay(time.Minute), WithIdempotencyKey("order-2", ProcessScope)))
+
+		require.Len(t, store.delayed, 2)
+		assert.Equal(t, "order-1", store.delayed[0].idempotencyKey)
+		assert.Equal(t, "order-2", store.delayed[1].idempotencyKey)
+	})
+
+	t.Run("store fails", func(t *testing.T) {
+		msg := message.NewOutcomingMessage(&testObj{})
+		store := &stubDelayStore{fail: map[string]error{msg.UID(): errors.New("connection lost")}}
+
+		err := WithStoreDelay(&recordingEndpoint{}, store).Send(ctx, msg, WithDelay(time.Minute))
+		assert.EqualError(t, err, "delaying message "+msg.UID()+" of endpoint recording: connection lost")
+	})
+
+	t.Run("batch is stored with the same delivery time", func(t *testing.T) {
+		first, second, third := message.NewOutcomingMessage(&testObj{}), message.NewOutcomingMessage(&testObj{}), message.NewOutcomingMessage(&testObj{})
+		store := &stubDelayStore{fail: map[string]error{second.UID(): errors.New("connection lost")}}
+
+		err := WithStoreDelay(&recordingEndpoint{}, store).SendBatch(ctx, []*message.OutcomingMessage{first, second, third}, WithDelay(time.Minute))
+		require.Error(t, err)
+		assert.EqualError(t, err, "1 of 3 messages of endpoint recording aren't delayed")
+
+		batchErr, isBatchErr := err.(BatchSendErr)
+		require.True(t, isBatchErr)
+		assert.EqualError(t, batchErr.Failed[second.UID()], "connection lost")
+
+		require.Len(t, store.delayed, 2)
+		assert.Equal(t, first.UID(), store.delayed[0].uid)
+		assert.Equal(t, third.UID(), store.delayed[1].uid)
+		assert.Equal(t, store.delayed[0].deliverAt, store.delayed[1].deliverAt)
+	})
+}
@@ -2,6 +2,7 @@ package endpoint
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/go-foreman/foreman/pubsub/message"
@@ -9,23 +10,127 @@ import (
 
 //go:generate mockgen --build_flags=--mod=mod -destination ../../testing/mocks/pubsub/endpoint/endpoint.go -package endpoint . Endpoint
 
+// DeliveryDelayHeader contains an effective delay in milliseconds of a message that was sent with WithDelay or WithDeliverAt option
+const DeliveryDelayHeader = "deliveryDelay"
+
 // Endpoint knows where to deliver a message
 type Endpoint interface {
 	// Name is a unique name of the endpoint
 	Name() string
 	// Send sends a message with specified implementation
 	Send(ctx context.Context, message *message.OutcomingMessage, options ...DeliveryOption) error
+	// SendBatch sends messages at once, options are applied to each of them. If some of messages aren't sent
+	// BatchSendErr with their uids is returned, the rest of them were sent.
+	SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error
+}
+
+// Lister is implemented by routers which know endpoints registered in them, MessageBus.Shutdown closes them
+type Lister interface {
+	// Endpoints returns registered endpoints in order they were registered
+	Endpoints() []Endpoint
+}
+
+// Endpoints returns endpoints registered in the router if it implements Lister
+func Endpoints(router Router) []Endpoint {
+	lister, ok := router.(Lister)
+	if !ok {
+		return nil
+	}
+
+	return lister.Endpoints()
+}
+
+// Close closes the endpoint if it holds resources, i.e. implements io.Closer. Endpoints wrapping another one close it.
+func Close(e Endpoint) error {
+	closer, ok := e.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return closer.Close()
+}
+
+// DelaySupporter is implemented by endpoints which hold messages sent with WithDelay or WithDeliverAt outside the sending process
+type DelaySupporter interface {
+	SupportsDelay() bool
+}
+
+// SupportsDelay tells if delayed messages sent through the endpoint are held by the broker or a store. Endpoints wrapping another one ask it.
+func SupportsDelay(e Endpoint) bool {
+	supporter, ok := e.(DelaySupporter)
+
+	return ok && supporter.SupportsDelay()
+}
+
+// BatchSendErr is returned by Endpoint.SendBatch if some of messages weren't sent. Failed contains errors by uids of messages.
+type BatchSendErr struct {
+	error
+	Failed map[string]error
+}
+
+func WithBatchSendErr(err error, failed map[string]error) error {
+	return BatchSendErr{error: err, Failed: failed}
 }
 
 type deliveryOptions struct {
-	delay *time.Duration
+	delay            *time.Duration
+	deliverAt        *time.Time
+	idempotencyKey   string
+	idempotencyScope IdempotencyScope
 }
 
 // WithDelay option waits specified duration before delivering a message
 func WithDelay(delay time.Duration) DeliveryOption {
 	return func(o *deliveryOptions) {
 		o.delay = &delay
+		o.deliverAt = nil
+	}
+}
+
+// WithDeliverAt option postpones delivery of a message until specified time. If the time is in the past the message is delivered immediately
+func WithDeliverAt(deliverAt time.Time) DeliveryOption {
+	return func(o *deliveryOptions) {
+		o.deliverAt = &deliverAt
+		o.delay = nil
 	}
 }
 
 type DeliveryOption func(o *deliveryOptions)
+
+// DeliveryDelay returns effective delay specified by WithDelay or WithDeliverAt options. The last one wins if both are passed.
+// Zero means a message should be delivered immediately. Useful for own Endpoint implementations.
+func DeliveryDelay(options ...DeliveryOption) time.Duration {
+	opts := &deliveryOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	return opts.effectiveDelay()
+}
+
+func (o deliveryOptions) effectiveDelay() time.Duration {
+	var delay time.Duration
+
+	if o.delay != nil {
+		delay = *o.delay
+	}
+
+	if o.deliverAt != nil {
+		delay = time.Until(*o.deliverAt)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+
+	return delay
+}
+
+// UnsupportedDeliveryOptionErr is returned by an Endpoint which can't honor passed DeliveryOption
+type UnsupportedDeliveryOptionErr struct {
+	error
+}
+
+func WithUnsupportedDeliveryOptionErr(err error) error {
+	return &UnsupportedDeliveryOptionErr{err}
+}
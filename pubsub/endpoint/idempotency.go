@@ -0,0 +1,174 @@
+package endpoint
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:generate mockgen --build_flags=--mod=mod -destination ../../testing/mocks/pubsub/endpoint/seenkeys.go -package endpoint . SeenKeys
+
+const (
+	// DefaultIdempotencyTTL is how long a sent idempotency key is remembered unless WithIdempotencyTTL is specified
+	DefaultIdempotencyTTL = time.Hour
+	// DefaultLocalSeenKeysCapacity is the number of keys remembered by the process local LRU of an endpoint
+	DefaultLocalSeenKeysCapacity = 10000
+)
+
+// IdempotencyScope selects where keys passed with WithIdempotencyKey are remembered
+type IdempotencyScope int
+
+const (
+	// ProcessScope remembers keys in memory of the process, it's cheap but replicas don't see keys of each other
+	ProcessScope IdempotencyScope = iota
+	// SharedScope remembers keys in SeenKeys shared by all replicas, e.g. saga.NewSQLSeenKeys. Each send costs a roundtrip to the store.
+	SharedScope
+)
+
+func (s IdempotencyScope) String() string {
+	switch s {
+	case ProcessScope:
+		return "process"
+	case SharedScope:
+		return "shared"
+	default:
+		return "unknown"
+	}
+}
+
+// SeenKeys remembers idempotency keys of sent messages
+type SeenKeys interface {
+	// MarkSent remembers the key for ttl. It returns true if the key is remembered already, i.e. a message with the key was sent.
+	MarkSent(ctx context.Context, key string, ttl time.Duration) (alreadySent bool, err error)
+	// Forget removes the key, so a message with the key can be sent again. Used when sending fails after MarkSent.
+	Forget(ctx context.Context, key string) error
+}
+
+// WithIdempotencyKey option sends a message only once for the key within the idempotency TTL of the endpoint.
+// A repeated send with the same key returns nil without sending. Scope selects whether replicas of a service share sent keys.
+func WithIdempotencyKey(key string, scope IdempotencyScope) DeliveryOption {
+	return func(o *deliveryOptions) {
+		o.idempotencyKey = key
+		o.idempotencyScope = scope
+	}
+}
+
+// DeliveryIdempotencyKey returns the key and its scope passed with WithIdempotencyKey option, the key is empty if the option isn't passed.
+// Useful for own Endpoint implementations.
+func DeliveryIdempotencyKey(options ...DeliveryOption) (string, IdempotencyScope) {
+	opts := &deliveryOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	return opts.idempotencyKey, opts.idempotencyScope
+}
+
+// idempotency deduplicates sends of an endpoint by keys passed with WithIdempotencyKey
+type idempotency struct {
+	local  SeenKeys
+	shared SeenKeys
+	ttl    time.Duration
+}
+
+func newIdempotency() *idempotency {
+	return &idempotency{local: NewLocalSeenKeys(DefaultLocalSeenKeysCapacity), ttl: DefaultIdempotencyTTL}
+}
+
+// send calls sendFunc unless a message with the same idempotency key was sent already. The key is forgotten if sendFunc fails, so the send can be retried.
+func (i *idempotency) send(ctx context.Context, opts *deliveryOptions, sendFunc func() error) error {
+	if opts.idempotencyKey == "" {
+		return sendFunc()
+	}
+
+	keys := i.local
+
+	if opts.idempotencyScope == SharedScope {
+		keys = i.shared
+	}
+
+	if keys == nil {
+		return WithUnsupportedDeliveryOptionErr(errors.Errorf("idempotency key with %s scope is passed, but no SeenKeys are configured for the scope", opts.idempotencyScope))
+	}
+
+	alreadySent, err := keys.MarkSent(ctx, opts.idempotencyKey, i.ttl)
+	if err != nil {
+		return errors.Wrapf(err, "marking idempotency key %s as sent", opts.idempotencyKey)
+	}
+
+	if alreadySent {
+		return nil
+	}
+
+	if err := sendFunc(); err != nil {
+		if forgetErr := keys.Forget(ctx, opts.idempotencyKey); forgetErr != nil {
+			return errors.Wrapf(err, "forgetting idempotency key %s failed: %s", opts.idempotencyKey, forgetErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+type localSeenKeys struct {
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List
+	keys     map[string]*list.Element
+}
+
+type seenKey struct {
+	key       string
+	expiresAt time.Time
+}
+
+// NewLocalSeenKeys creates an LRU of keys in memory of the process. The least recently seen keys are evicted once capacity is reached, even if they aren't expired.
+func NewLocalSeenKeys(capacity int) SeenKeys {
+	return &localSeenKeys{capacity: capacity, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (l *localSeenKeys) MarkSent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	if el, exists := l.keys[key]; exists {
+		seen := el.Value.(*seenKey)
+		l.order.MoveToFront(el)
+
+		if seen.expiresAt.After(now) {
+			return true, nil
+		}
+
+		seen.expiresAt = now.Add(ttl)
+
+		return false, nil
+	}
+
+	l.keys[key] = l.order.PushFront(&seenKey{key: key, expiresAt: now.Add(ttl)})
+
+	for l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.keys, oldest.Value.(*seenKey).key)
+	}
+
+	return false, nil
+}
+
+func (l *localSeenKeys) Forget(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if el, exists := l.keys[key]; exists {
+		l.order.Remove(el)
+		delete(l.keys, key)
+	}
+
+	return nil
+}
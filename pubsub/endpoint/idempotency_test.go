@@ -0,0 +1,204 @@
+package endpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	mockTransport "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalSeenKeys(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("key is seen until it expires", func(t *testing.T) {
+		seenKeys := NewLocalSeenKeys(10)
+
+		alreadySent, err := seenKeys.MarkSent(ctx, "a", time.Millisecond*50)
+		require.NoError(t, err)
+		assert.False(t, alreadySent)
+
+		alreadySent, err = seenKeys.MarkSent(ctx, "a", time.Millisecond*50)
+		require.NoError(t, err)
+		assert.True(t, alreadySent)
+
+		time.Sleep(time.Millisecond * 60)
+
+		alreadySent, err = seenKeys.MarkSent(ctx, "a", time.Minute)
+		require.NoError(t, err)
+		assert.False(t, alreadySent, "expired key is marked again")
+
+		alreadySent, err = seenKeys.MarkSent(ctx, "a", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, alreadySent)
+	})
+
+	t.Run("least recently seen keys are evicted", func(t *testing.T) {
+		seenKeys := NewLocalSeenKeys(2)
+
+		for _, key := range []string{"a", "b", "a", "c"} {
+			_, err := seenKeys.MarkSent(ctx, key, time.Minute)
+			require.NoError(t, err)
+		}
+
+		alreadySent, _ := seenKeys.MarkSent(ctx, "a", time.Minute)
+		assert.True(t, alreadySent)
+
+		alreadySent, _ = seenKeys.MarkSent(ctx, "b", time.Minute)
+		assert.False(t, alreadySent, "b was evicted when c was added")
+	})
+
+	t.Run("forget key", func(t *testing.T) {
+		seenKeys := NewLocalSeenKeys(10)
+
+		_, err := seenKeys.MarkSent(ctx, "a", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, seenKeys.Forget(ctx, "a"))
+		require.NoError(t, seenKeys.Forget(ctx, "unknown"))
+
+		alreadySent, _ := seenKeys.MarkSent(ctx, "a", time.Minute)
+		assert.False(t, alreadySent)
+	})
+}
+
+func TestAmqpEndpointIdempotency(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+	transportMock := mockTransport.NewMockTransport(ctrl)
+	destination := transport.DeliveryDestination{DestinationTopic: "messagebus_topic", RoutingKey: "events"}
+	payload := &testObj{}
+
+	marshallerMock.EXPECT().Marshal(payload).Return([]byte("data"), nil).AnyTimes()
+
+	t.Run("message with the same key is sent once", func(t *testing.T) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock)
+
+		transportMock.EXPECT().Send(ctx, gomock.Any()).Return(nil).Times(2)
+
+		require.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)))
+		require.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)))
+		require.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-2", ProcessScope)))
+	})
+
+	t.Run("key is forgotten if sending fails", func(t *testing.T) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock)
+
+		transportMock.EXPECT().Send(ctx, gomock.Any()).Return(errors.New("transport error"))
+		assert.EqualError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)), "transport error")
+
+		transportMock.EXPECT().Send(ctx, gomock.Any()).Return(nil)
+		assert.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)))
+	})
+
+	t.Run("shared scope uses shared seen keys", func(t *testing.T) {
+		shared := NewLocalSeenKeys(10)
+		replicaA := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock, WithSharedSeenKeys(shared))
+		replicaB := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock, WithSharedSeenKeys(shared))
+
+		transportMock.EXPECT().Send(ctx, gomock.Any()).Return(nil).Times(3)
+
+		require.NoError(t, replicaA.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", SharedScope)))
+		require.NoError(t, replicaB.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", SharedScope)))
+
+		// process scope of each replica doesn't know about keys of the other one
+		require.NoError(t, replicaA.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-2", ProcessScope)))
+		require.NoError(t, replicaB.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-2", ProcessScope)))
+	})
+
+	t.Run("shared scope without shared seen keys", func(t *testing.T) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock)
+
+		err := amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", SharedScope))
+		require.Error(t, err)
+		assert.IsType(t, &UnsupportedDeliveryOptionErr{}, err)
+		assert.EqualError(t, err, "idempotency key with shared scope is passed, but no SeenKeys are configured for the scope")
+	})
+
+	t.Run("seen keys error", func(t *testing.T) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock, WithSharedSeenKeys(failingSeenKeys{}))
+
+		err := amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", SharedScope))
+		assert.EqualError(t, err, "marking idempotency key order-1 as sent: connection lost")
+	})
+
+	t.Run("ttl of keys", func(t *testing.T) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", transportMock, destination, marshallerMock, WithIdempotencyTTL(time.Millisecond*20))
+
+		transportMock.EXPECT().Send(ctx, gomock.Any()).Return(nil).Times(2)
+
+		require.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)))
+		time.Sleep(time.Millisecond * 30)
+		require.NoError(t, amqpEndpoint.Send(ctx, message.NewOutcomingMessage(payload), WithIdempotencyKey("order-1", ProcessScope)))
+	})
+}
+
+type failingSeenKeys struct{}
+
+func (f failingSeenKeys) MarkSent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return false, errors.New("connection lost")
+}
+
+func (f failingSeenKeys) Forget(ctx context.Context, key string) error {
+	return errors.New("connection lost")
+}
+
+// BenchmarkAmqpEndpointIdempotency measures the cost of WithIdempotencyKey on top of a send. Latency of SharedScope
+// is dominated by a roundtrip to the store, see BenchmarkSQLSeenKeys in testing/integration/saga.
+func BenchmarkAmqpEndpointIdempotency(b *testing.B) {
+	ctx := context.Background()
+	destination := transport.DeliveryDestination{DestinationTopic: "messagebus_topic", RoutingKey: "events"}
+	knownTypes := scheme.NewKnownTypesRegistry()
+	knownTypes.AddKnownTypes("test", &testObj{})
+	marshaller := message.NewJsonMarshaller(knownTypes)
+	msg := message.NewOutcomingMessage(&testObj{})
+
+	b.Run("without key", func(b *testing.B) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", nopTransport{}, destination, marshaller)
+
+		for i := 0; i < b.N; i++ {
+			if err := amqpEndpoint.Send(ctx, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("process scope", func(b *testing.B) {
+		amqpEndpoint := NewAmqpEndpoint("amqp", nopTransport{}, destination, marshaller)
+		keys := benchmarkKeys(b.N)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if err := amqpEndpoint.Send(ctx, msg, WithIdempotencyKey(keys[i], ProcessScope)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = message.NewOutcomingMessage(nil).UID()
+	}
+
+	return keys
+}
+
+type nopTransport struct {
+	transport.Transport
+}
+
+func (n nopTransport) Send(ctx context.Context, outboundPkg transport.OutboundPkg, options ...transport.SendOpt) error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package endpoint
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+// Sender sends a message, Endpoint.Send is one
+type Sender func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error
+
+// Middleware wraps sending of a message with cross-cutting logic. It may call next with an enriched context, changed message
+// or options, or return an error without calling next at all.
+type Middleware func(next Sender) Sender
+
+// WithMiddleware wraps Send and SendBatch of the endpoint with middlewares, the first one is the outermost. Messages of a batch
+// pass through middlewares one by one and are sent with Send of the endpoint. Wrap the target of OutboxEndpoint, not the outbox
+// endpoint itself, or use WrapRouter which does it.
+func WithMiddleware(e Endpoint, middlewares ...Middleware) Endpoint {
+	if len(middlewares) == 0 {
+		return e
+	}
+
+	send := e.Send
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		send = middlewares[i](send)
+	}
+
+	return &middlewareEndpoint{Endpoint: e, send: send}
+}
+
+type middlewareEndpoint struct {
+	Endpoint
+	send Sender
+}
+
+func (e *middlewareEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+	return e.send(ctx, msg, options...)
+}
+
+// Close closes the wrapped endpoint
+func (e *middlewareEndpoint) Close() error {
+	return Close(e.Endpoint)
+}
+
+func (e *middlewareEndpoint) SupportsDelay() bool {
+	return SupportsDelay(e.Endpoint)
+}
+
+func (e *middlewareEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error {
+	failed := make(map[string]error)
+
+	for _, msg := range messages {
+		if err := e.send(ctx, msg, options...); err != nil {
+			failed[msg.UID()] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return WithBatchSendErr(errors.Errorf("%d of %d messages aren't sent through endpoint %s", len(failed), len(messages), e.Name()), failed)
+	}
+
+	return nil
+}
+
+// WrapRouter wraps endpoints with middlewares when they are registered in the router. The target of OutboxEndpoint is wrapped
+// instead of the outbox endpoint, so relayed messages pass through middlewares when they are actually sent.
+func WrapRouter(router Router, middlewares ...Middleware) Router {
+	return &middlewareRouter{Router: router, middlewares: middlewares}
+}
+
+type middlewareRouter struct {
+	Router
+	middlewares []Middleware
+}
+
+func (r *middlewareRouter) Endpoints() []Endpoint {
+	return Endpoints(r.Router)
+}
+
+func (r *middlewareRouter) RegisterEndpoint(e Endpoint, objects ...message.Object) {
+	if outboxEndpoint, isOutboxEndpoint := e.(*OutboxEndpoint); isOutboxEndpoint {
+		e = NewOutboxEndpoint(WithMiddleware(outboxEndpoint.target, r.middlewares...), outboxEndpoint.outbox)
+	} else {
+		e = WithMiddleware(e, r.middlewares...)
+	}
+
+	r.Router.RegisterEndpoint(e, objects...)
+}
+
+// RecoveryMiddleware converts a panic while sending a message into an error
+func RecoveryMiddleware(logger log.Logger) Middleware {
+	return func(next Sender) Sender {
+		return func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Logf(log.ErrorLevel, "panic while sending message %s %s: %v\n%s", msg.UID(), msg.Payload().GroupKind(), r, debug.Stack())
+					err = errors.Errorf("panic while sending message %s %s: %v", msg.UID(), msg.Payload().GroupKind(), r)
+				}
+			}()
+
+			return next(ctx, msg, options...)
+		}
+	}
+}
+
+// LoggingMiddleware logs sending time of every message at debug level and failures at error level
+func LoggingMiddleware(logger log.Logger) Middleware {
+	return func(next Sender) Sender {
+		return func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+			started := time.Now()
+
+			if err := next(ctx, msg, options...); err != nil {
+				logger.Logf(log.ErrorLevel, "failed to send message %s %s in %s. %s", msg.UID(), msg.Payload().GroupKind(), time.Since(started), err)
+				return err
+			}
+
+			logger.Logf(log.DebugLevel, "sent message %s %s in %s", msg.UID(), msg.Payload().GroupKind(), time.Since(started))
+
+			return nil
+		}
+	}
+}
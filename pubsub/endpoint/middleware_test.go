@@ -0,0 +1,144 @@
+package endpoint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingEndpoint struct {
+	sent []string
+	fail map[string]error
+}
+
+func (e *recordingEndpoint) Name() string {
+	return "recording"
+}
+
+func (e *recordingEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+	if err := e.fail[msg.UID()]; err != nil {
+		return err
+	}
+
+	e.sent = append(e.sent, msg.UID())
+
+	return nil
+}
+
+func (e *recordingEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error {
+	panic("batch must be sent through middlewares")
+}
+
+func TestWithMiddleware(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+
+	tagging := func(name string) Middleware {
+		return func(next Sender) Sender {
+			return func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+				calls = append(calls, name)
+				msg.Headers()[name] = true
+				return next(ctx, msg, options...)
+			}
+		}
+	}
+
+	t.Run("middlewares are applied in order", func(t *testing.T) {
+		calls = nil
+		target := &recordingEndpoint{}
+		e := WithMiddleware(target, tagging("first"), tagging("second"))
+		msg := message.NewOutcomingMessage(&testObj{})
+
+		require.NoError(t, e.Send(ctx, msg))
+		assert.Equal(t, "recording", e.Name())
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.Equal(t, []string{msg.UID()}, target.sent)
+		assert.Equal(t, true, msg.Headers()["second"])
+	})
+
+	t.Run("without middlewares the endpoint is returned as is", func(t *testing.T) {
+		target := &recordingEndpoint{}
+		assert.Same(t, target, WithMiddleware(target))
+	})
+
+	t.Run("batch is sent message by message", func(t *testing.T) {
+		calls = nil
+		first, second := message.NewOutcomingMessage(&testObj{}), message.NewOutcomingMessage(&testObj{})
+		target := &recordingEndpoint{fail: map[string]error{second.UID(): errors.New("nacked")}}
+		e := WithMiddleware(target, tagging("first"))
+
+		err := e.SendBatch(ctx, []*message.OutcomingMessage{first, second})
+		require.Error(t, err)
+		assert.EqualError(t, err, "1 of 2 messages aren't sent through endpoint recording")
+
+		batchErr, ok := err.(BatchSendErr)
+		require.True(t, ok)
+		assert.EqualError(t, batchErr.Failed[second.UID()], "nacked")
+		assert.Equal(t, []string{first.UID()}, target.sent)
+		assert.Equal(t, []string{"first", "first"}, calls)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		e := WithMiddleware(&recordingEndpoint{}, RecoveryMiddleware(log.NewNilLogger()), func(next Sender) Sender {
+			return func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+				panic("marshaller is nil")
+			}
+		}, LoggingMiddleware(log.NewNilLogger()))
+		msg := message.NewOutcomingMessage(&testObj{})
+
+		assert.EqualError(t, e.Send(ctx, msg), "panic while sending message "+msg.UID()+" : marshaller is nil")
+	})
+}
+
+func TestWrapRouter(t *testing.T) {
+	var calls int
+	counting := func(next Sender) Sender {
+		return func(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+			calls++
+			return next(ctx, msg, options...)
+		}
+	}
+
+	target := &recordingEndpoint{}
+	outboxEndpoint := NewOutboxEndpoint(&recordingEndpoint{}, &outboxWriterStub{})
+
+	router := WrapRouter(NewRouter(), counting)
+	router.RegisterEndpoint(target, &testObj{})
+	router.RegisterEndpoint(outboxEndpoint, &testObj{})
+
+	routed := router.Route(&testObj{})
+	require.Len(t, routed, 2)
+
+	require.NoError(t, routed[0].Send(context.Background(), message.NewOutcomingMessage(&testObj{})))
+	assert.Equal(t, 1, calls)
+	assert.Len(t, target.sent, 1)
+
+	relayed, ok := routed[1].(*OutboxEndpoint)
+	require.True(t, ok, "outbox endpoint is kept for the relay")
+	require.NoError(t, relayed.Target().Send(context.Background(), message.NewOutcomingMessage(&testObj{})))
+	assert.Equal(t, 2, calls, "the target of outbox endpoint is wrapped")
+
+	registered := Endpoints(router)
+	require.Len(t, registered, 2)
+	assert.Same(t, routed[0], registered[0])
+
+	closing := &closingEndpoint{}
+	router.RegisterEndpoint(NewOutboxEndpoint(closing, &outboxWriterStub{}), &anotherObj{})
+	require.NoError(t, Close(Endpoints(router)[2]))
+	assert.True(t, closing.closed, "wrapped endpoints are closed")
+}
+
+type closingEndpoint struct {
+	recordingEndpoint
+	closed bool
+}
+
+func (e *closingEndpoint) Close() error {
+	e.closed = true
+	return nil
+}
@@ -0,0 +1,99 @@
+package endpoint
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+// OutboxEndpointHeader contains the name of the OutboxEndpoint which wrote a message into the outbox, the relay sends the message
+// only through the target of that endpoint. It's removed before the message is sent.
+const OutboxEndpointHeader = "outboxEndpoint"
+
+// OutboxWriter writes messages into an outbox within a transaction, saga.SQLOutbox is one. Messages with the same key are relayed
+// in the order they were written.
+type OutboxWriter interface {
+	Add(ctx context.Context, tx *sql.Tx, key string, msg *message.OutcomingMessage, options ...DeliveryOption) error
+}
+
+type txKey struct{}
+
+// WithTx returns ctx carrying the transaction OutboxEndpoint writes messages in
+func WithTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// TxFromContext returns the transaction set by WithTx, nil if there is none
+func TxFromContext(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(txKey{}).(*sql.Tx)
+	return tx
+}
+
+// OutboxEndpoint writes messages into the outbox in the transaction passed with WithTx instead of sending them through the target,
+// so a handler commits its own changes and messages together. saga.OutboxRelay sends them through the target afterwards.
+// Register it in the router instead of the target. Messages of one OutboxEndpoint are relayed in the order they were written.
+type OutboxEndpoint struct {
+	target Endpoint
+	outbox OutboxWriter
+}
+
+func NewOutboxEndpoint(target Endpoint, outbox OutboxWriter) *OutboxEndpoint {
+	return &OutboxEndpoint{target: target, outbox: outbox}
+}
+
+// Name is the name of the target
+func (e *OutboxEndpoint) Name() string {
+	return e.target.Name()
+}
+
+// Target is the endpoint the relay sends messages through
+func (e *OutboxEndpoint) Target() Endpoint {
+	return e.target
+}
+
+// Close closes the target
+func (e *OutboxEndpoint) Close() error {
+	return Close(e.target)
+}
+
+// SupportsDelay asks the target, the relay passes delays of messages to it
+func (e *OutboxEndpoint) SupportsDelay() bool {
+	return SupportsDelay(e.target)
+}
+
+// Send writes the message into the outbox, ctx must carry a transaction set by WithTx
+func (e *OutboxEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+	tx := TxFromContext(ctx)
+	if tx == nil {
+		return errors.Errorf("outbox endpoint %s requires a transaction in ctx, pass it with endpoint.WithTx", e.Name())
+	}
+
+	msg.Headers()[OutboxEndpointHeader] = e.Name()
+	defer delete(msg.Headers(), OutboxEndpointHeader)
+
+	if err := e.outbox.Add(ctx, tx, e.Name(), msg, options...); err != nil {
+		return errors.Wrapf(err, "writing message %s into outbox of endpoint %s", msg.UID(), e.Name())
+	}
+
+	return nil
+}
+
+// SendBatch writes messages into the outbox one by one, a failed write usually aborts the transaction, so the rest of messages
+// are reported as failed too
+func (e *OutboxEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error {
+	failed := make(map[string]error)
+
+	for i, msg := range messages {
+		if err := e.Send(ctx, msg, options...); err != nil {
+			for _, notWritten := range messages[i:] {
+				failed[notWritten.UID()] = err
+			}
+
+			return WithBatchSendErr(errors.Errorf("%d of %d messages weren't written into outbox", len(failed), len(messages)), failed)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package endpoint
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type outboxWriterStub struct {
+	keys    []string
+	headers []message.Headers
+	err     error
+}
+
+func (o *outboxWriterStub) Add(ctx context.Context, tx *sql.Tx, key string, msg *message.OutcomingMessage, options ...DeliveryOption) error {
+	if o.err != nil {
+		return o.err
+	}
+
+	headers := make(message.Headers, len(msg.Headers()))
+	for k, v := range msg.Headers() {
+		headers[k] = v
+	}
+
+	o.keys = append(o.keys, key)
+	o.headers = append(o.headers, headers)
+
+	return nil
+}
+
+func TestOutboxEndpoint(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	target := NewAmqpEndpoint("orders", nopTransport{}, transport.DeliveryDestination{}, nil)
+	ctx := WithTx(context.Background(), tx)
+
+	t.Run("message is written into the outbox", func(t *testing.T) {
+		outbox := &outboxWriterStub{}
+		outboxEndpoint := NewOutboxEndpoint(target, outbox)
+		msg := message.NewOutcomingMessage(&testObj{})
+
+		assert.Equal(t, "orders", outboxEndpoint.Name())
+		assert.Equal(t, target, outboxEndpoint.Target())
+
+		require.NoError(t, outboxEndpoint.Send(ctx, msg))
+		assert.Equal(t, []string{"orders"}, outbox.keys)
+		assert.Equal(t, "orders", outbox.headers[0][OutboxEndpointHeader])
+		assert.NotContains(t, msg.Headers(), OutboxEndpointHeader, "the header is kept only in the outbox")
+	})
+
+	t.Run("transaction is required", func(t *testing.T) {
+		outboxEndpoint := NewOutboxEndpoint(target, &outboxWriterStub{})
+		assert.Nil(t, TxFromContext(context.Background()))
+
+		err := outboxEndpoint.Send(context.Background(), message.NewOutcomingMessage(&testObj{}))
+		assert.EqualError(t, err, "outbox endpoint orders requires a transaction in ctx, pass it with endpoint.WithTx")
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		outbox := &outboxWriterStub{}
+		outboxEndpoint := NewOutboxEndpoint(target, outbox)
+		messages := []*message.OutcomingMessage{message.NewOutcomingMessage(&testObj{}), message.NewOutcomingMessage(&testObj{})}
+
+		require.NoError(t, outboxEndpoint.SendBatch(ctx, messages))
+		assert.Len(t, outbox.keys, 2)
+
+		outbox.err = errors.New("tx is aborted")
+		err := outboxEndpoint.SendBatch(ctx, messages)
+		require.Error(t, err)
+
+		batchErr, ok := err.(BatchSendErr)
+		require.True(t, ok)
+		assert.Len(t, batchErr.Failed, 2)
+		assert.EqualError(t, batchErr.Failed[messages[1].UID()], "writing message "+messages[0].UID()+" into outbox of endpoint orders: tx is aborted")
+	})
+}
@@ -25,10 +25,13 @@ func NewRouter() Router {
 }
 
 type router struct {
-	routes map[reflect.Type][]Endpoint
+	routes    map[reflect.Type][]Endpoint
+	endpoints []Endpoint
 }
 
 func (r *router) RegisterEndpoint(endpoint Endpoint, objects ...message.Object) {
+	r.endpoints = appendEndpoint(r.endpoints, endpoint)
+
 	for _, obj := range objects {
 		structType := scheme.GetStructType(obj)
 		r.routes[structType] = append(r.routes[structType], endpoint)
@@ -43,3 +46,23 @@ func (r router) Route(obj message.Object) []Endpoint {
 
 	return []Endpoint{}
 }
+
+// Endpoints returns registered endpoints in order they were registered, an endpoint registered by pointer for several types is listed once
+func (r router) Endpoints() []Endpoint {
+	return r.endpoints
+}
+
+// appendEndpoint appends the endpoint unless the same pointer is already in the list
+func appendEndpoint(endpoints []Endpoint, e Endpoint) []Endpoint {
+	if reflect.TypeOf(e).Kind() != reflect.Ptr {
+		return append(endpoints, e)
+	}
+
+	for _, registered := range endpoints {
+		if reflect.TypeOf(registered) == reflect.TypeOf(e) && registered == e {
+			return endpoints
+		}
+	}
+
+	return append(endpoints, e)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRouter(t *testing.T) {
@@ -21,6 +22,14 @@ func TestRouter(t *testing.T) {
 	endpoints = router.Route(&anotherObj{})
 	assert.Empty(t, endpoints)
 
+	anotherEndpoint := &recordingEndpoint{}
+	router.RegisterEndpoint(anotherEndpoint, &anotherObj{})
+	router.RegisterEndpoint(testEndpoint, &anotherObj{})
+
+	registered := Endpoints(router)
+	require.Len(t, registered, 2, "an endpoint is listed once")
+	assert.Same(t, testEndpoint, registered[0])
+	assert.Same(t, anotherEndpoint, registered[1])
 }
 
 type testObj struct {
@@ -44,3 +53,8 @@ func (t testEndpoint) Send(ctx context.Context, message *message.OutcomingMessag
 	//TODO implement me
 	panic("implement me")
 }
+
+func (t testEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...DeliveryOption) error {
+	//TODO implement me
+	panic("implement me")
+}
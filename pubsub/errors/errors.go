@@ -1,17 +1,55 @@
+// Package errors marks errors returned by executors, so the retry policy of a subscriber knows whether handling
+// a message again may succeed.
 package errors
 
-//
-//type Status int
-//
-//const (
-//	NoRetry Status = iota
-//)
-//
-//type StatusErr struct {
-//	Status Status
-//	error
-//}
-//
-//func WithStatusErr(status Status, err error) error {
-//	return StatusErr{status, err}
-//}
+import (
+	pkgErrors "github.com/pkg/errors"
+)
+
+// RetryableErr marks an error after which handling the message again may succeed, e.g. a timeout of a downstream service
+type RetryableErr struct {
+	error
+}
+
+// WithRetryableErr marks err as retryable
+func WithRetryableErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &RetryableErr{err}
+}
+
+func (e RetryableErr) Unwrap() error {
+	return e.error
+}
+
+// TerminalErr marks an error after which the message fails again no matter how many times it's handled, e.g. invalid payload
+type TerminalErr struct {
+	error
+}
+
+// WithTerminalErr marks err as terminal
+func WithTerminalErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &TerminalErr{err}
+}
+
+func (e TerminalErr) Unwrap() error {
+	return e.error
+}
+
+// IsRetryable tells whether err or any error it wraps is marked with WithRetryableErr
+func IsRetryable(err error) bool {
+	var retryableErr *RetryableErr
+	return pkgErrors.As(err, &retryableErr)
+}
+
+// IsTerminal tells whether err or any error it wraps is marked with WithTerminalErr
+func IsTerminal(err error) bool {
+	var terminalErr *TerminalErr
+	return pkgErrors.As(err, &terminalErr)
+}
@@ -0,0 +1,24 @@
+package errors
+
+import (
+	"testing"
+
+	pkgErrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryableErrors(t *testing.T) {
+	retryable := pkgErrors.Wrap(WithRetryableErr(pkgErrors.New("timeout")), "charging payment")
+	assert.True(t, IsRetryable(retryable))
+	assert.False(t, IsTerminal(retryable))
+	assert.EqualError(t, retryable, "charging payment: timeout")
+
+	terminal := pkgErrors.Wrap(WithTerminalErr(pkgErrors.New("invalid amount")), "charging payment")
+	assert.True(t, IsTerminal(terminal))
+	assert.False(t, IsRetryable(terminal))
+
+	assert.False(t, IsRetryable(pkgErrors.New("unknown")))
+	assert.False(t, IsTerminal(nil))
+	assert.Nil(t, WithRetryableErr(nil))
+	assert.Nil(t, WithTerminalErr(nil))
+}
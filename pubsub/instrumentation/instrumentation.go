@@ -0,0 +1,141 @@
+package instrumentation
+
+import (
+	"github.com/go-foreman/foreman/pubsub/dispatcher"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Opt configures Instrumentation
+type Opt func(i *Instrumentation) error
+
+// WithTracing configures OpenTelemetry spans, the global tracer provider and W3C trace context are used by default
+func WithTracing(opts ...tracing.Opt) Opt {
+	return func(i *Instrumentation) error {
+		i.tracingOpts = opts
+		return nil
+	}
+}
+
+// WithoutTracing disables spans, only metrics are recorded
+func WithoutTracing() Opt {
+	return func(i *Instrumentation) error {
+		i.tracingDisabled = true
+		return nil
+	}
+}
+
+// WithMetrics registers prometheus collectors of messages in the registerer, see Metrics
+func WithMetrics(registerer prometheus.Registerer) Opt {
+	return func(i *Instrumentation) error {
+		metrics, err := NewMetrics(registerer)
+		if err != nil {
+			return err
+		}
+
+		i.metrics = metrics
+
+		return nil
+	}
+}
+
+// Instrumentation traces and measures messages received and sent by a MessageBus. Pass it into foreman.WithInstrumentation,
+// it wraps the processor, every executor matched by the dispatcher and endpoints registered in the router.
+type Instrumentation struct {
+	tracingOpts     []tracing.Opt
+	tracingDisabled bool
+	metrics         *Metrics
+}
+
+// New creates Instrumentation with spans and without metrics unless WithMetrics is passed
+func New(opts ...Opt) (*Instrumentation, error) {
+	i := &Instrumentation{}
+
+	for _, opt := range opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+// Metrics returns collectors registered by WithMetrics, nil if metrics are disabled
+func (i *Instrumentation) Metrics() *Metrics {
+	return i.metrics
+}
+
+// WrapProcessor starts a span for each package received from a transport and counts consumed packages
+func (i *Instrumentation) WrapProcessor(processor subscriber.Processor) subscriber.Processor {
+	if i.metrics != nil {
+		processor = i.metrics.wrapProcessor(processor)
+	}
+
+	if !i.tracingDisabled {
+		processor = tracing.WrapProcessor(processor, i.tracingOpts...)
+	}
+
+	return processor
+}
+
+// Middleware starts a span for each executor, measures its duration and counts retried messages
+func (i *Instrumentation) Middleware() dispatcher.Middleware {
+	var middlewares []dispatcher.Middleware
+
+	if !i.tracingDisabled {
+		middlewares = append(middlewares, tracing.Middleware(i.tracingOpts...))
+	}
+
+	if i.metrics != nil {
+		middlewares = append(middlewares, i.metrics.middleware())
+	}
+
+	return func(next execution.Executor) execution.Executor {
+		for j := len(middlewares) - 1; j >= 0; j-- {
+			next = middlewares[j](next)
+		}
+
+		return next
+	}
+}
+
+// WrapEndpoint starts a producer span for each sent message and counts produced messages. Wrap the target of
+// endpoint.OutboxEndpoint, not the outbox endpoint itself.
+func (i *Instrumentation) WrapEndpoint(e endpoint.Endpoint) endpoint.Endpoint {
+	if i.metrics != nil {
+		e = i.metrics.wrapEndpoint(e)
+	}
+
+	if !i.tracingDisabled {
+		e = tracing.WrapEndpoint(e, i.tracingOpts...)
+	}
+
+	return e
+}
+
+// WrapRouter wraps endpoints with WrapEndpoint when they are registered. Outbox endpoints are registered as they are,
+// the relay needs them to find their targets, so wrap their targets instead.
+func (i *Instrumentation) WrapRouter(router endpoint.Router) endpoint.Router {
+	return &instrumentedRouter{Router: router, instrumentation: i}
+}
+
+type instrumentedRouter struct {
+	endpoint.Router
+	instrumentation *Instrumentation
+}
+
+func (r *instrumentedRouter) Endpoints() []endpoint.Endpoint {
+	return endpoint.Endpoints(r.Router)
+}
+
+func (r *instrumentedRouter) RegisterEndpoint(e endpoint.Endpoint, objects ...message.Object) {
+	if _, isOutboxEndpoint := e.(*endpoint.OutboxEndpoint); !isOutboxEndpoint {
+		e = r.instrumentation.WrapEndpoint(e)
+	}
+
+	r.Router.RegisterEndpoint(e, objects...)
+}
@@ -0,0 +1,137 @@
+package instrumentation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/tracing"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	subscriberMock "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	transportMock "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type orderPlaced struct {
+	message.ObjectMeta
+}
+
+func newOrderPlaced() *orderPlaced {
+	return &orderPlaced{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "orders", Kind: "orderPlaced"}}}
+}
+
+func TestInstrumentation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	inst, err := New(WithTracing(tracing.WithTracerProvider(tracerProvider)), WithMetrics(prometheus.NewRegistry()))
+	require.NoError(t, err)
+	metrics := inst.Metrics()
+
+	t.Run("executors", func(t *testing.T) {
+		headers := message.Headers{}
+		headers.SetAttempts(1)
+		received := message.NewReceivedMessage("msg-1", newOrderPlaced(), headers, time.Now(), "orders-queue")
+		execCtx := execution.NewMessageExecutionCtxFactory(endpoint.NewRouter(), log.NewNilLogger()).CreateCtx(context.Background(), received)
+
+		executor := inst.Middleware()(func(execCtx execution.MessageExecutionCtx) error {
+			return errors.New("payment failed")
+		})
+
+		assert.EqualError(t, executor(execCtx), "payment failed")
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.retries.WithLabelValues("orders.orderPlaced")))
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.duration))
+		require.Len(t, recorder.Ended(), 1)
+		assert.Equal(t, "orders.orderPlaced", recorder.Ended()[0].Name())
+	})
+
+	t.Run("processor", func(t *testing.T) {
+		processorMock := subscriberMock.NewMockProcessor(ctrl)
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().Headers().Return(map[string]interface{}{}).AnyTimes()
+		inPkg.EXPECT().UID().Return("msg-1").AnyTimes()
+		inPkg.EXPECT().Origin().Return("orders-queue").AnyTimes()
+
+		processor := inst.WrapProcessor(processorMock)
+
+		processorMock.EXPECT().Process(gomock.Any(), inPkg).Return(nil)
+		require.NoError(t, processor.Process(context.Background(), inPkg))
+		processorMock.EXPECT().Process(gomock.Any(), inPkg).Return(errors.New("no executors"))
+		require.Error(t, processor.Process(context.Background(), inPkg))
+
+		expected := `
+# HELP foreman_messages_consumed_total Number of packages received from a transport.
+# TYPE foreman_messages_consumed_total counter
+foreman_messages_consumed_total{origin="orders-queue",outcome="error"} 1
+foreman_messages_consumed_total{origin="orders-queue",outcome="success"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.consumed, strings.NewReader(expected)))
+	})
+
+	t.Run("endpoints registered in the router", func(t *testing.T) {
+		endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+		endpointInstance.EXPECT().Name().Return("orders").AnyTimes()
+		outboxEndpoint := endpoint.NewOutboxEndpoint(endpointInstance, nil)
+
+		router := inst.WrapRouter(endpoint.NewRouter())
+		router.RegisterEndpoint(endpointInstance, &orderPlaced{})
+		router.RegisterEndpoint(outboxEndpoint, &orderPlaced{})
+
+		routed := router.Route(&orderPlaced{})
+		require.Len(t, routed, 2)
+		assert.NotEqual(t, endpointInstance, routed[0], "endpoint is wrapped")
+		assert.Equal(t, outboxEndpoint, routed[1], "outbox endpoint is kept for the relay")
+
+		first, second := message.NewOutcomingMessage(newOrderPlaced()), message.NewOutcomingMessage(newOrderPlaced())
+		batchErr := endpoint.WithBatchSendErr(errors.New("1 message isn't sent"), map[string]error{second.UID(): errors.New("nacked")})
+
+		endpointInstance.EXPECT().Send(gomock.Any(), first).Return(nil)
+		endpointInstance.EXPECT().SendBatch(gomock.Any(), []*message.OutcomingMessage{first, second}).Return(batchErr)
+
+		require.NoError(t, routed[0].Send(context.Background(), first))
+		assert.Equal(t, batchErr, routed[0].SendBatch(context.Background(), []*message.OutcomingMessage{first, second}))
+
+		expected := `
+# HELP foreman_messages_produced_total Number of messages sent through endpoints.
+# TYPE foreman_messages_produced_total counter
+foreman_messages_produced_total{endpoint="orders",outcome="error",type="orders.orderPlaced"} 1
+foreman_messages_produced_total{endpoint="orders",outcome="success",type="orders.orderPlaced"} 2
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.produced, strings.NewReader(expected)))
+	})
+
+	t.Run("tracing only", func(t *testing.T) {
+		inst, err := New()
+		require.NoError(t, err)
+		assert.Nil(t, inst.Metrics())
+
+		endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+		assert.NotEqual(t, endpointInstance, inst.WrapEndpoint(endpointInstance))
+	})
+
+	t.Run("metrics are registered twice", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		_, err := New(WithMetrics(registry))
+		require.NoError(t, err)
+
+		_, err = New(WithMetrics(registry), WithoutTracing())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registering message metrics")
+	})
+}
@@ -0,0 +1,161 @@
+package instrumentation
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/dispatcher"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "foreman"
+	metricsSubsystem = "messages"
+
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Metrics collects prometheus metrics of messages:
+//
+//	foreman_messages_consumed_total{origin, outcome} - packages received from a transport and processed
+//	foreman_messages_produced_total{type, endpoint, outcome} - messages sent through endpoints
+//	foreman_messages_handling_duration_seconds{type, outcome} - duration of an executor handling a message
+//	foreman_messages_retries_total{type} - messages handled again after failed attempts of the retry policy
+//
+// type is group and kind of a message, origin is a queue the package was received from.
+type Metrics struct {
+	consumed *prometheus.CounterVec
+	produced *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	retries  *prometheus.CounterVec
+}
+
+// NewMetrics creates collectors and registers them in the registerer
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "consumed_total",
+			Help:      "Number of packages received from a transport.",
+		}, []string{"origin", "outcome"}),
+		produced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "produced_total",
+			Help:      "Number of messages sent through endpoints.",
+		}, []string{"type", "endpoint", "outcome"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "handling_duration_seconds",
+			Help:      "Duration of handling a message by an executor.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"type", "outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "retries_total",
+			Help:      "Number of messages handled again after failed attempts.",
+		}, []string{"type"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.consumed, m.produced, m.duration, m.retries} {
+		if err := registerer.Register(c); err != nil {
+			return nil, errors.Wrap(err, "registering message metrics")
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) middleware() dispatcher.Middleware {
+	return func(next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) error {
+			msg := execCtx.Message()
+			msgType := msg.Payload().GroupKind().String()
+
+			if msg.Headers().Attempts() > 0 {
+				m.retries.WithLabelValues(msgType).Inc()
+			}
+
+			started := time.Now()
+			err := next(execCtx)
+			m.duration.WithLabelValues(msgType, outcomeOf(err)).Observe(time.Since(started).Seconds())
+
+			return err
+		}
+	}
+}
+
+func (m *Metrics) wrapProcessor(next subscriber.Processor) subscriber.Processor {
+	return &measuredProcessor{next: next, metrics: m}
+}
+
+type measuredProcessor struct {
+	next    subscriber.Processor
+	metrics *Metrics
+}
+
+func (p measuredProcessor) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
+	err := p.next.Process(ctx, inPkg)
+	p.metrics.consumed.WithLabelValues(inPkg.Origin(), outcomeOf(err)).Inc()
+
+	return err
+}
+
+func (m *Metrics) wrapEndpoint(next endpoint.Endpoint) endpoint.Endpoint {
+	return &measuredEndpoint{Endpoint: next, metrics: m}
+}
+
+type measuredEndpoint struct {
+	endpoint.Endpoint
+	metrics *Metrics
+}
+
+func (e measuredEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	err := e.Endpoint.Send(ctx, msg, options...)
+	e.metrics.produced.WithLabelValues(msg.Payload().GroupKind().String(), e.Name(), outcomeOf(err)).Inc()
+
+	return err
+}
+
+// Close closes the wrapped endpoint
+func (e measuredEndpoint) Close() error {
+	return endpoint.Close(e.Endpoint)
+}
+
+func (e measuredEndpoint) SupportsDelay() bool {
+	return endpoint.SupportsDelay(e.Endpoint)
+}
+
+func (e measuredEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	err := e.Endpoint.SendBatch(ctx, messages, options...)
+	batchErr, isBatchErr := err.(endpoint.BatchSendErr)
+
+	for _, msg := range messages {
+		msgErr := err
+		if isBatchErr {
+			msgErr = batchErr.Failed[msg.UID()]
+		}
+
+		e.metrics.produced.WithLabelValues(msg.Payload().GroupKind().String(), e.Name(), outcomeOf(msgErr)).Inc()
+	}
+
+	return err
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+
+	return OutcomeSuccess
+}
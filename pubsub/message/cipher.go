@@ -0,0 +1,222 @@
+package message
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncryptionKeyIDHeader contains id of the key a payload is encrypted with, a message without it isn't encrypted
+	EncryptionKeyIDHeader = "encryptionKeyId"
+	// PayloadHMACHeader contains base64 encoded HMAC-SHA256 of the encrypted payload and the key id
+	PayloadHMACHeader = "payloadHmac"
+
+	encryptionKeyInfo = "foreman-encryption-v1"
+	signingKeyInfo    = "foreman-signing-v1"
+)
+
+// Cipher encrypts a marshalled payload before it's published and decrypts it once it's received, before it's unmarshalled.
+// Everything needed to decrypt the payload, e.g. id of the key, is carried in headers.
+type Cipher interface {
+	// Encrypt returns the encrypted payload and puts its metadata into headers
+	Encrypt(payload []byte, headers Headers) ([]byte, error)
+	// Decrypt returns the decrypted payload, CipherErr is returned if it can't be decrypted or was tampered with
+	Decrypt(payload []byte, headers Headers) ([]byte, error)
+}
+
+// CipherErr is returned if a payload isn't encrypted while it must be, is encrypted with an unknown key or doesn't match its HMAC
+type CipherErr struct {
+	error
+}
+
+func WithCipherErr(err error) error {
+	return CipherErr{err}
+}
+
+// AESCipher encrypts payloads with AES-256-GCM and signs them with HMAC-SHA256. Keys for encryption and signing are derived
+// from a key of the keyring. Several keys may be known at once, so a new key is added to all receivers before senders switch
+// to it with UseKey, and the old one is removed once nothing encrypted with it is left in the broker.
+type AESCipher struct {
+	mutex    sync.RWMutex
+	keyID    string
+	keys     map[string]aesKey
+	optional bool
+}
+
+type aesKey struct {
+	aead    cipher.AEAD
+	signing []byte
+}
+
+// AESCipherOpt configures AESCipher
+type AESCipherOpt func(c *AESCipher)
+
+// WithOptionalEncryption accepts received payloads which aren't encrypted, e.g. while senders are switched to encryption one by one
+func WithOptionalEncryption() AESCipherOpt {
+	return func(c *AESCipher) {
+		c.optional = true
+	}
+}
+
+// NewAESCipher creates AESCipher encrypting payloads with the key keyID and decrypting them with any of the keys.
+// Keys are mapped by their ids, each of them must be 16, 24 or 32 bytes long.
+func NewAESCipher(keyID string, keys map[string][]byte, opts ...AESCipherOpt) (*AESCipher, error) {
+	c := &AESCipher{keys: make(map[string]aesKey, len(keys))}
+
+	for id, key := range keys {
+		if err := c.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.UseKey(keyID); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// AddKey starts decrypting payloads encrypted with the key
+func (c *AESCipher) AddKey(keyID string, key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return errors.Errorf("key '%s' is %d bytes long, it must be 16, 24 or 32 bytes long", keyID, len(key))
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, encryptionKeyInfo))
+	if err != nil {
+		return errors.Wrapf(err, "creating cipher of key '%s'", keyID)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(err, "creating cipher of key '%s'", keyID)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.keys[keyID] = aesKey{aead: aead, signing: deriveKey(key, signingKeyInfo)}
+
+	return nil
+}
+
+// RemoveKey stops decrypting payloads encrypted with the key, the key used for encryption can't be removed
+func (c *AESCipher) RemoveKey(keyID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if keyID == c.keyID {
+		return errors.Errorf("key '%s' is used for encryption, switch to another key before removing it", keyID)
+	}
+
+	delete(c.keys, keyID)
+
+	return nil
+}
+
+// UseKey switches encryption to the key, it must be added before
+func (c *AESCipher) UseKey(keyID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, known := c.keys[keyID]; !known {
+		return errors.Errorf("key '%s' isn't added", keyID)
+	}
+
+	c.keyID = keyID
+
+	return nil
+}
+
+func (c *AESCipher) Encrypt(payload []byte, headers Headers) ([]byte, error) {
+	c.mutex.RLock()
+	keyID, key := c.keyID, c.keys[c.keyID]
+	c.mutex.RUnlock()
+
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(payload)+key.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+
+	encrypted := key.aead.Seal(nonce, nonce, payload, []byte(keyID))
+
+	headers[EncryptionKeyIDHeader] = keyID
+	headers[PayloadHMACHeader] = base64.StdEncoding.EncodeToString(payloadHMAC(key.signing, keyID, encrypted))
+
+	return encrypted, nil
+}
+
+func (c *AESCipher) Decrypt(payload []byte, headers Headers) ([]byte, error) {
+	keyID, encrypted := headers[EncryptionKeyIDHeader].(string)
+
+	if !encrypted {
+		if c.optional {
+			return payload, nil
+		}
+
+		return nil, WithCipherErr(errors.New("payload isn't encrypted"))
+	}
+
+	c.mutex.RLock()
+	key, known := c.keys[keyID]
+	c.mutex.RUnlock()
+
+	if !known {
+		return nil, WithCipherErr(errors.Errorf("payload is encrypted with unknown key '%s'", keyID))
+	}
+
+	encodedHMAC, _ := headers[PayloadHMACHeader].(string)
+
+	sum, err := base64.StdEncoding.DecodeString(encodedHMAC)
+	if err != nil {
+		return nil, WithCipherErr(errors.Wrap(err, "decoding payload hmac"))
+	}
+
+	if !hmac.Equal(sum, payloadHMAC(key.signing, keyID, payload)) {
+		return nil, WithCipherErr(errors.Errorf("hmac of payload encrypted with key '%s' doesn't match", keyID))
+	}
+
+	if len(payload) < key.aead.NonceSize() {
+		return nil, WithCipherErr(errors.Errorf("payload encrypted with key '%s' is too short", keyID))
+	}
+
+	nonce, sealed := payload[:key.aead.NonceSize()], payload[key.aead.NonceSize():]
+
+	decrypted, err := key.aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, WithCipherErr(errors.Wrapf(err, "decrypting payload with key '%s'", keyID))
+	}
+
+	return decrypted, nil
+}
+
+// deriveKey derives a 32 bytes key for the purpose from the key of the keyring, so encryption and signing use different keys
+func deriveKey(key []byte, info string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(info))
+
+	return mac.Sum(nil)
+}
+
+func payloadHMAC(key []byte, keyID string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyID))
+	mac.Write([]byte{'\n'})
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
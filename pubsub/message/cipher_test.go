@@ -0,0 +1,91 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESCipher(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+
+	cipher, err := NewAESCipher("old", map[string][]byte{"old": oldKey})
+	require.NoError(t, err)
+
+	t.Run("payload is encrypted and decrypted", func(t *testing.T) {
+		headers := Headers{}
+		encrypted, err := cipher.Encrypt([]byte("card 4242"), headers)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encrypted), "4242")
+		assert.Equal(t, "old", headers[EncryptionKeyIDHeader])
+		assert.NotEmpty(t, headers[PayloadHMACHeader])
+
+		again, err := cipher.Encrypt([]byte("card 4242"), Headers{})
+		require.NoError(t, err)
+		assert.NotEqual(t, encrypted, again, "every payload gets own nonce")
+
+		decrypted, err := cipher.Decrypt(encrypted, headers)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("card 4242"), decrypted)
+	})
+
+	t.Run("keys are rotated", func(t *testing.T) {
+		rotated, err := NewAESCipher("old", map[string][]byte{"old": oldKey})
+		require.NoError(t, err)
+
+		oldHeaders := Headers{}
+		encryptedWithOld, err := rotated.Encrypt([]byte("data"), oldHeaders)
+		require.NoError(t, err)
+
+		require.NoError(t, rotated.AddKey("new", newKey))
+		require.NoError(t, rotated.UseKey("new"))
+		assert.EqualError(t, rotated.RemoveKey("new"), "key 'new' is used for encryption, switch to another key before removing it")
+
+		newHeaders := Headers{}
+		_, err = rotated.Encrypt([]byte("data"), newHeaders)
+		require.NoError(t, err)
+		assert.Equal(t, "new", newHeaders[EncryptionKeyIDHeader])
+
+		decrypted, err := rotated.Decrypt(encryptedWithOld, oldHeaders)
+		require.NoError(t, err, "payloads encrypted with the old key are still decrypted")
+		assert.Equal(t, []byte("data"), decrypted)
+
+		require.NoError(t, rotated.RemoveKey("old"))
+		_, err = rotated.Decrypt(encryptedWithOld, oldHeaders)
+		assert.EqualError(t, err, "payload is encrypted with unknown key 'old'")
+		assert.IsType(t, CipherErr{}, err)
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		headers := Headers{}
+		encrypted, err := cipher.Encrypt([]byte("data"), headers)
+		require.NoError(t, err)
+
+		encrypted[len(encrypted)-1] ^= 1
+		_, err = cipher.Decrypt(encrypted, headers)
+		assert.EqualError(t, err, "hmac of payload encrypted with key 'old' doesn't match")
+		assert.IsType(t, CipherErr{}, err)
+	})
+
+	t.Run("payload isn't encrypted", func(t *testing.T) {
+		_, err := cipher.Decrypt([]byte("data"), Headers{})
+		assert.EqualError(t, err, "payload isn't encrypted")
+
+		optional, err := NewAESCipher("old", map[string][]byte{"old": oldKey}, WithOptionalEncryption())
+		require.NoError(t, err)
+
+		decrypted, err := optional.Decrypt([]byte("data"), Headers{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("data"), decrypted)
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		_, err := NewAESCipher("short", map[string][]byte{"short": []byte("123")})
+		assert.EqualError(t, err, "key 'short' is 3 bytes long, it must be 16, 24 or 32 bytes long")
+
+		_, err = NewAESCipher("missing", map[string][]byte{"old": oldKey})
+		assert.EqualError(t, err, "key 'missing' isn't added")
+	})
+}
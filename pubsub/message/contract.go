@@ -0,0 +1,37 @@
+package message
+
+// Command marks a contract as a command when it's embedded into the contract's struct.
+// Commands are subscribed by dispatcher.Dispatcher.HandleCommand, which doesn't accept anything else.
+type Command struct{}
+
+func (Command) command() {}
+
+// Event marks a contract as an event when it's embedded into the contract's struct.
+// Events are subscribed by dispatcher.Dispatcher.ListenEvent, which doesn't accept anything else.
+type Event struct{}
+
+func (Event) event() {}
+
+// CommandContract is implemented only by contracts embedding Command
+type CommandContract interface {
+	Object
+	command()
+}
+
+// EventContract is implemented only by contracts embedding Event
+type EventContract interface {
+	Object
+	event()
+}
+
+// IsCommand tells whether the contract embeds Command
+func IsCommand(obj Object) bool {
+	_, ok := obj.(CommandContract)
+	return ok
+}
+
+// IsEvent tells whether the contract embeds Event
+func IsEvent(obj Object) bool {
+	_, ok := obj.(EventContract)
+	return ok
+}
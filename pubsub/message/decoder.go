@@ -20,8 +20,42 @@ type Marshaller interface {
 	Marshal(obj Object) ([]byte, error)
 }
 
-func NewJsonMarshaller(knownTypes scheme.KnownTypesRegistry) Marshaller {
-	return &jsonDecoder{knownTypes: knownTypes}
+// JsonContentType is the content type of bytes produced by json marshaller
+const JsonContentType = "application/json"
+
+// ContentTyper is implemented by marshallers which tell the content type of bytes they produce
+type ContentTyper interface {
+	ContentType() string
+}
+
+// ContentTypeOf returns the content type of bytes produced by the marshaller, a marshaller which doesn't implement ContentTyper is considered to produce json
+func ContentTypeOf(m Marshaller) string {
+	if typer, ok := m.(ContentTyper); ok {
+		return typer.ContentType()
+	}
+
+	return JsonContentType
+}
+
+func NewJsonMarshaller(knownTypes scheme.KnownTypesRegistry, opts ...JsonMarshallerOpt) Marshaller {
+	j := &jsonDecoder{knownTypes: knownTypes}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+// JsonMarshallerOpt configures json marshaller
+type JsonMarshallerOpt func(j *jsonDecoder)
+
+// WithUpcasters writes the schema version of a kind into marshalled payloads and upcasts received payloads of older versions
+// into the current one before they are decoded, see Upcasters. Only the top level payload is versioned, not objects nested into it.
+func WithUpcasters(upcasters *Upcasters) JsonMarshallerOpt {
+	return func(j *jsonDecoder) {
+		j.upcasters = upcasters
+	}
 }
 
 type DecoderErr struct {
@@ -34,6 +68,11 @@ func WithDecoderErr(err error) error {
 
 type jsonDecoder struct {
 	knownTypes scheme.KnownTypesRegistry
+	upcasters  *Upcasters
+}
+
+func (j jsonDecoder) ContentType() string {
+	return JsonContentType
 }
 
 func (j jsonDecoder) Unmarshal(b []byte) (Object, error) {
@@ -43,6 +82,12 @@ func (j jsonDecoder) Unmarshal(b []byte) (Object, error) {
 		return nil, WithDecoderErr(err)
 	}
 
+	if j.upcasters != nil {
+		if err := j.upcasters.upcast(unstructured); err != nil {
+			return nil, WithDecoderErr(err)
+		}
+	}
+
 	obj, err := j.decode(unstructured)
 
 	if err != nil {
@@ -163,6 +208,10 @@ func (j jsonDecoder) Marshal(obj Object) ([]byte, error) {
 		return nil, WithDecoderErr(errors.Wrapf(err, "encoding obj %v, GK: %s", obj, encodingTo.GroupKind().String()))
 	}
 
+	if j.upcasters != nil {
+		encodedBytes = j.upcasters.stamp(obj.GroupKind(), encodedBytes)
+	}
+
 	return encodedBytes, nil
 }
 
@@ -0,0 +1,177 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        (unknown)
+// source: pubsub/message/envelope.proto
+
+package message
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ProtoEnvelope is written by protobuf marshaller, it keeps the type of a payload so it can be decoded into the registered type
+type ProtoEnvelope struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Group string `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Kind  string `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	// payload is the proto message encoded with protobuf
+	Payload []byte `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
+	// fields keeps json of exported fields of a struct which embeds the proto message, e.g. timeouts of a saga
+	Fields []byte `protobuf:"bytes,4,opt,name=fields,proto3" json:"fields,omitempty"`
+}
+
+func (x *ProtoEnvelope) Reset() {
+	*x = ProtoEnvelope{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pubsub_message_envelope_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProtoEnvelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoEnvelope) ProtoMessage() {}
+
+func (x *ProtoEnvelope) ProtoReflect() protoreflect.Message {
+	mi := &file_pubsub_message_envelope_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoEnvelope.ProtoReflect.Descriptor instead.
+func (*ProtoEnvelope) Descriptor() ([]byte, []int) {
+	return file_pubsub_message_envelope_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ProtoEnvelope) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *ProtoEnvelope) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *ProtoEnvelope) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ProtoEnvelope) GetFields() []byte {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+var File_pubsub_message_envelope_proto protoreflect.FileDescriptor
+
+var file_pubsub_message_envelope_proto_rawDesc = []byte{
+	0x0a, 0x1d, 0x70, 0x75, 0x62, 0x73, 0x75, 0x62, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x2f, 0x65, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x0f, 0x66, 0x6f, 0x72, 0x65, 0x6d, 0x61, 0x6e, 0x2e, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x22, 0x6b, 0x0a, 0x0d, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70,
+	0x65, 0x12, 0x14, 0x0a, 0x05, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x05, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x12, 0x12, 0x0a, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x70,
+	0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x66, 0x69, 0x65, 0x6c, 0x64, 0x73, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x66, 0x69, 0x65, 0x6c, 0x64, 0x73, 0x42, 0x2e, 0x5a,
+	0x2c, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x2d, 0x66,
+	0x6f, 0x72, 0x65, 0x6d, 0x61, 0x6e, 0x2f, 0x66, 0x6f, 0x72, 0x65, 0x6d, 0x61, 0x6e, 0x2f, 0x70,
+	0x75, 0x62, 0x73, 0x75, 0x62, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_pubsub_message_envelope_proto_rawDescOnce sync.Once
+	file_pubsub_message_envelope_proto_rawDescData = file_pubsub_message_envelope_proto_rawDesc
+)
+
+func file_pubsub_message_envelope_proto_rawDescGZIP() []byte {
+	file_pubsub_message_envelope_proto_rawDescOnce.Do(func() {
+		file_pubsub_message_envelope_proto_rawDescData = protoimpl.X.CompressGZIP(file_pubsub_message_envelope_proto_rawDescData)
+	})
+	return file_pubsub_message_envelope_proto_rawDescData
+}
+
+var file_pubsub_message_envelope_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_pubsub_message_envelope_proto_goTypes = []interface{}{
+	(*ProtoEnvelope)(nil), // 0: foreman.message.ProtoEnvelope
+}
+var file_pubsub_message_envelope_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_pubsub_message_envelope_proto_init() }
+func file_pubsub_message_envelope_proto_init() {
+	if File_pubsub_message_envelope_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_pubsub_message_envelope_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProtoEnvelope); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_pubsub_message_envelope_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_pubsub_message_envelope_proto_goTypes,
+		DependencyIndexes: file_pubsub_message_envelope_proto_depIdxs,
+		MessageInfos:      file_pubsub_message_envelope_proto_msgTypes,
+	}.Build()
+	File_pubsub_message_envelope_proto = out.File
+	file_pubsub_message_envelope_proto_rawDesc = nil
+	file_pubsub_message_envelope_proto_goTypes = nil
+	file_pubsub_message_envelope_proto_depIdxs = nil
+}
@@ -21,6 +21,9 @@ type MessageExecutionCtx interface {
 	Valid() bool
 	// Send sends an out coming message to registered endpoints
 	Send(message *message.OutcomingMessage, options ...endpoint.DeliveryOption) error
+	// SendBatch sends out coming messages at once, messages routed to the same endpoint are sent by a single Endpoint.SendBatch.
+	// Options are applied to each of them.
+	SendBatch(messages []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error
 	// Return sends received message to registered endpoints and updates number of returns in headers
 	Return(options ...endpoint.DeliveryOption) error
 	// Logger returns logger instance with traceId and message uid included as fields
@@ -61,6 +64,37 @@ func (m messageExecutionCtx) Send(msg *message.OutcomingMessage, options ...endp
 	return nil
 }
 
+func (m messageExecutionCtx) SendBatch(msgs []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	var endpoints []endpoint.Endpoint
+	batches := make(map[string][]*message.OutcomingMessage)
+
+	for _, msg := range msgs {
+		routed := m.router.Route(msg.Payload())
+
+		if len(routed) == 0 {
+			m.logger.Logf(log.WarnLevel, "no endpoints defined for message %s", msg.UID())
+			continue
+		}
+
+		for _, endp := range routed {
+			if _, exists := batches[endp.Name()]; !exists {
+				endpoints = append(endpoints, endp)
+			}
+
+			batches[endp.Name()] = append(batches[endp.Name()], msg)
+		}
+	}
+
+	for _, endp := range endpoints {
+		if err := endp.SendBatch(m.ctx, batches[endp.Name()], options...); err != nil {
+			m.logger.Logf(log.ErrorLevel, "error sending batch of messages. %s", err)
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
 func (m messageExecutionCtx) Return(options ...endpoint.DeliveryOption) error {
 	outComingMsg := message.FromReceivedMsg(m.message)
 	outComingMsg.Headers().RegisterReturn()
@@ -80,6 +114,48 @@ func (m messageExecutionCtx) Logger() log.Logger {
 	return m.logger
 }
 
+// WithContext returns a copy of execCtx that carries ctx, e.g. a middleware enriches context passed to the next executor
+func WithContext(execCtx MessageExecutionCtx, ctx context.Context) MessageExecutionCtx {
+	if m, ok := execCtx.(*messageExecutionCtx); ok {
+		enriched := *m
+		enriched.ctx = ctx
+		return &enriched
+	}
+
+	return &contextOverride{MessageExecutionCtx: execCtx, ctx: ctx}
+}
+
+// contextOverride replaces Context of own MessageExecutionCtx implementations
+type contextOverride struct {
+	MessageExecutionCtx
+	ctx context.Context
+}
+
+func (c contextOverride) Context() context.Context {
+	return c.ctx
+}
+
+// WithLogger returns a copy of execCtx with the logger, e.g. enriched with more fields
+func WithLogger(execCtx MessageExecutionCtx, logger log.Logger) MessageExecutionCtx {
+	if m, ok := execCtx.(*messageExecutionCtx); ok {
+		enriched := *m
+		enriched.logger = logger
+		return &enriched
+	}
+
+	return &loggerOverride{MessageExecutionCtx: execCtx, logger: logger}
+}
+
+// loggerOverride replaces Logger of own MessageExecutionCtx implementations
+type loggerOverride struct {
+	MessageExecutionCtx
+	logger log.Logger
+}
+
+func (l loggerOverride) Logger() log.Logger {
+	return l.logger
+}
+
 type MessageExecutionCtxFactory interface {
 	CreateCtx(ctx context.Context, message *message.ReceivedMessage) MessageExecutionCtx
 }
@@ -122,6 +122,63 @@ func TestMessageExecutionCtx_Send(t *testing.T) {
 	})
 }
 
+func TestMessageExecutionCtx_SendBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := testingLog.NewNilLogger()
+	testRouter := endpointMock.NewMockRouter(ctrl)
+	firstEndpoint := endpointMock.NewMockEndpoint(ctrl)
+	secondEndpoint := endpointMock.NewMockEndpoint(ctrl)
+	firstEndpoint.EXPECT().Name().Return("first").AnyTimes()
+	secondEndpoint.EXPECT().Name().Return("second").AnyTimes()
+
+	factory := NewMessageExecutionCtxFactory(testRouter, testLogger)
+	ctx := context.Background()
+	receivedMessage := message.NewReceivedMessage("123", &someTestType{}, message.Headers{}, time.Now(), "bus")
+
+	t.Run("messages are batched per endpoint", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		first := message.NewOutcomingMessage(&someTestType{Data: "first"})
+		second := message.NewOutcomingMessage(&someTestType{Data: "second"})
+		unrouted := message.NewOutcomingMessage(&someTestType{Data: "unrouted"})
+		sendingOpt := endpoint.WithDelay(time.Second)
+
+		testRouter.EXPECT().Route(first.Payload()).Return([]endpoint.Endpoint{firstEndpoint, secondEndpoint})
+		testRouter.EXPECT().Route(second.Payload()).Return([]endpoint.Endpoint{firstEndpoint})
+		testRouter.EXPECT().Route(unrouted.Payload()).Return(nil)
+
+		gomock.InOrder(
+			firstEndpoint.EXPECT().SendBatch(ctx, []*message.OutcomingMessage{first, second}, gomock.AssignableToTypeOf(sendingOpt)).Return(nil),
+			secondEndpoint.EXPECT().SendBatch(ctx, []*message.OutcomingMessage{first}, gomock.AssignableToTypeOf(sendingOpt)).Return(nil),
+		)
+
+		execCtx := factory.CreateCtx(ctx, receivedMessage)
+		require.NoError(t, execCtx.SendBatch([]*message.OutcomingMessage{first, second, unrouted}, sendingOpt))
+
+		require.Len(t, testLogger.Entries(), 1)
+		assert.Equal(t, log.WarnLevel, testLogger.Entries()[0].Level)
+		assert.Contains(t, testLogger.LastMessage(), "no endpoints defined for message "+unrouted.UID())
+	})
+
+	t.Run("error sending a batch", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		first := message.NewOutcomingMessage(&someTestType{Data: "first"})
+		batchErr := endpoint.WithBatchSendErr(errors.New("1 of 1 messages weren't sent"), map[string]error{first.UID(): errors.New("nacked")})
+
+		testRouter.EXPECT().Route(first.Payload()).Return([]endpoint.Endpoint{firstEndpoint})
+		firstEndpoint.EXPECT().SendBatch(ctx, []*message.OutcomingMessage{first}).Return(batchErr)
+
+		execCtx := factory.CreateCtx(ctx, receivedMessage)
+		err := execCtx.SendBatch([]*message.OutcomingMessage{first})
+		require.Error(t, err)
+		assert.IsType(t, endpoint.BatchSendErr{}, errors.Cause(err))
+		assert.Contains(t, testLogger.LastMessage(), "error sending batch of messages")
+	})
+}
+
 func TestMessageExecutionCtx_Return(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -227,3 +284,53 @@ func TestMessageExecutionCtx(t *testing.T) {
 	assert.Same(t, execCtx.Message(), receivedMessage)
 
 }
+
+type ctxKey string
+
+func TestWithContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testRouter := endpointMock.NewMockRouter(ctrl)
+	receivedMessage := message.NewReceivedMessage("123", &someTestType{}, message.Headers{}, time.Now(), "bus")
+	enrichedCtx := context.WithValue(context.Background(), ctxKey("key"), "val")
+
+	t.Run("default implementation sends with the new context", func(t *testing.T) {
+		execCtx := NewMessageExecutionCtxFactory(testRouter, testingLog.NewNilLogger()).CreateCtx(context.Background(), receivedMessage)
+		enriched := WithContext(execCtx, enrichedCtx)
+
+		assert.Equal(t, "val", enriched.Context().Value(ctxKey("key")))
+		assert.Nil(t, execCtx.Context().Value(ctxKey("key")))
+		assert.Same(t, receivedMessage, enriched.Message())
+
+		outcomingMsg := message.NewOutcomingMessage(&someTestType{})
+		anEndpoint := endpointMock.NewMockEndpoint(ctrl)
+		testRouter.EXPECT().Route(outcomingMsg.Payload()).Return([]endpoint.Endpoint{anEndpoint})
+		anEndpoint.EXPECT().Send(enrichedCtx, outcomingMsg).Return(nil)
+
+		require.NoError(t, enriched.Send(outcomingMsg))
+	})
+
+	t.Run("own implementation", func(t *testing.T) {
+		execCtx := &messageExecutionCtx{ctx: context.Background(), message: receivedMessage}
+		enriched := WithContext(struct{ MessageExecutionCtx }{execCtx}, enrichedCtx)
+
+		assert.Equal(t, "val", enriched.Context().Value(ctxKey("key")))
+		assert.Same(t, receivedMessage, enriched.Message())
+	})
+}
+
+func TestWithLogger(t *testing.T) {
+	receivedMessage := message.NewReceivedMessage("123", &someTestType{}, message.Headers{}, time.Now(), "bus")
+	logger := testingLog.NewNilLogger()
+
+	execCtx := NewMessageExecutionCtxFactory(endpoint.NewRouter(), testingLog.NewNilLogger()).CreateCtx(context.Background(), receivedMessage)
+	enriched := WithLogger(execCtx, logger)
+	assert.Same(t, logger, enriched.Logger())
+	assert.NotSame(t, logger, execCtx.Logger())
+	assert.Same(t, receivedMessage, enriched.Message())
+
+	own := WithLogger(struct{ MessageExecutionCtx }{execCtx}, logger)
+	assert.Same(t, logger, own.Logger())
+	assert.Same(t, receivedMessage, own.Message())
+}
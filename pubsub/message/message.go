@@ -7,8 +7,116 @@ import (
 	"github.com/google/uuid"
 )
 
+// PublishedAtHeader contains unix time in milliseconds when a message was published by an endpoint
+const PublishedAtHeader = "publishedAt"
+
+// AttemptsHeader contains a number of failed attempts to process a message, it is maintained by subscriber.RetryPolicy
+const AttemptsHeader = "attempts"
+
+// HandlingAttemptsHeader contains a number of failed attempts of saga event handlers to handle a message, it is maintained by handlers.WithRetryPolicy
+const HandlingAttemptsHeader = "handlingAttempts"
+
+// RedrivenHeader contains a number of times a dead lettered message was sent back for processing, it is maintained by subscriber.Redriver
+const RedrivenHeader = "redriven"
+
+// ContentTypeHeader contains the content type of the payload, it's set by an endpoint from its marshaller so a receiver can select the right decoder
+const ContentTypeHeader = "contentType"
+
+// TraceIDHeader contains a correlation id of a flow of messages, it's added to fields of the logger of an execution context
+const TraceIDHeader = "traceId"
+
 type Headers map[string]interface{}
 
+// PublishedAt returns time when the message was published, false if header is missing or has unknown format
+func (m Headers) PublishedAt() (time.Time, bool) {
+	v, exists := m[PublishedAtHeader]
+	if !exists {
+		return time.Time{}, false
+	}
+
+	switch publishedAt := v.(type) {
+	case int64:
+		return fromUnixMilli(publishedAt), true
+	case int:
+		return fromUnixMilli(int64(publishedAt)), true
+	case float64:
+		return fromUnixMilli(int64(publishedAt)), true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, publishedAt)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// SetPublishedAt sets publishing time of the message
+func (m Headers) SetPublishedAt(t time.Time) {
+	m[PublishedAtHeader] = t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Attempts returns a number of failed attempts to process the message, 0 if header is missing or has unknown format
+func (m Headers) Attempts() int {
+	return m.intHeader(AttemptsHeader)
+}
+
+// SetAttempts sets a number of failed attempts to process the message
+func (m Headers) SetAttempts(attempts int) {
+	m[AttemptsHeader] = int64(attempts)
+}
+
+// HandlingAttempts returns a number of failed attempts of a saga to handle the message, 0 if header is missing or has unknown format
+func (m Headers) HandlingAttempts() int {
+	return m.intHeader(HandlingAttemptsHeader)
+}
+
+// SetHandlingAttempts sets a number of failed attempts of a saga to handle the message
+func (m Headers) SetHandlingAttempts(attempts int) {
+	m[HandlingAttemptsHeader] = int64(attempts)
+}
+
+// Redriven returns a number of times the message was sent back for processing from a dead letter queue
+func (m Headers) Redriven() int {
+	return m.intHeader(RedrivenHeader)
+}
+
+// SetRedriven sets a number of times the message was sent back for processing from a dead letter queue
+func (m Headers) SetRedriven(redriven int) {
+	m[RedrivenHeader] = int64(redriven)
+}
+
+func (m Headers) intHeader(key string) int {
+	switch v := m[key].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// ContentType returns the content type of the payload, empty if header is missing
+func (m Headers) ContentType() string {
+	contentType, _ := m[ContentTypeHeader].(string)
+	return contentType
+}
+
+// SetContentType sets the content type of the payload
+func (m Headers) SetContentType(contentType string) {
+	m[ContentTypeHeader] = contentType
+}
+
 func (m Headers) ReturnsCount() int {
 	v, exists := m["returnsCount"]
 	if !exists {
@@ -71,7 +179,7 @@ func (m ReceivedMessage) TraceID() string {
 		return ""
 	}
 
-	traceIdVal, ok := m.headers["traceId"]
+	traceIdVal, ok := m.headers[TraceIDHeader]
 
 	if !ok {
 		return ""
@@ -90,6 +198,11 @@ func (m ReceivedMessage) Headers() Headers {
 	return m.headers
 }
 
+// ContentType returns the content type the payload was received in
+func (m ReceivedMessage) ContentType() string {
+	return m.headers.ContentType()
+}
+
 func (m ReceivedMessage) Payload() Object {
 	return m.payload
 }
@@ -116,6 +229,11 @@ func (m OutcomingMessage) UID() string {
 	return m.uid
 }
 
+// ContentType returns the content type of the payload, it's known once the message is sent by an endpoint
+func (m OutcomingMessage) ContentType() string {
+	return m.headers.ContentType()
+}
+
 func (m OutcomingMessage) Payload() Object {
 	return m.obj
 }
@@ -132,7 +250,11 @@ func NewOutcomingMessage(payload Object, passedOptions ...MsgOption) *OutcomingM
 		}
 	}
 
-	msg := &OutcomingMessage{uid: uuid.New().String(), obj: payload}
+	msg := &OutcomingMessage{uid: opts.uid, obj: payload}
+
+	if msg.uid == "" {
+		msg.uid = uuid.New().String()
+	}
 
 	if opts.headers != nil {
 		msg.headers = opts.headers
@@ -145,7 +267,7 @@ func NewOutcomingMessage(payload Object, passedOptions ...MsgOption) *OutcomingM
 	msg.headers["uid"] = msg.UID()
 
 	if opts.traceID != "" {
-		msg.headers["traceId"] = opts.traceID
+		msg.headers[TraceIDHeader] = opts.traceID
 	}
 
 	return msg
@@ -169,6 +291,7 @@ type MsgOption func(attr *opts)
 type opts struct {
 	headers Headers
 	traceID string
+	uid     string
 }
 
 func WithHeaders(headers Headers) MsgOption {
@@ -177,6 +300,13 @@ func WithHeaders(headers Headers) MsgOption {
 	}
 }
 
+// WithUID keeps the uid of a message which is sent again, e.g. after it was persisted instead of sending
+func WithUID(uid string) MsgOption {
+	return func(attr *opts) {
+		attr.uid = uid
+	}
+}
+
 func WithTraceID(traceID string) MsgOption {
 	return func(attr *opts) {
 		attr.traceID = traceID
@@ -51,3 +51,49 @@ func TestNewReceivedMessage(t *testing.T) {
 		assert.Equal(t, m.TraceID(), "")
 	})
 }
+
+func TestHeadersPublishedAt(t *testing.T) {
+	t.Run("not set", func(t *testing.T) {
+		_, ok := Headers{}.PublishedAt()
+		assert.False(t, ok)
+	})
+
+	t.Run("set and read", func(t *testing.T) {
+		now := time.Now()
+		headers := Headers{}
+		headers.SetPublishedAt(now)
+		publishedAt, ok := headers.PublishedAt()
+		assert.True(t, ok)
+		assert.Equal(t, now.Truncate(time.Millisecond).UnixNano(), publishedAt.UnixNano())
+	})
+
+	t.Run("decoded from json as float", func(t *testing.T) {
+		publishedAt, ok := Headers{PublishedAtHeader: float64(1000)}.PublishedAt()
+		assert.True(t, ok)
+		assert.Equal(t, time.Second.Nanoseconds(), publishedAt.UnixNano())
+	})
+
+	t.Run("wrong format", func(t *testing.T) {
+		_, ok := Headers{PublishedAtHeader: "yesterday"}.PublishedAt()
+		assert.False(t, ok)
+	})
+}
+
+func TestHeadersAttempts(t *testing.T) {
+	headers := Headers{}
+	assert.Equal(t, 0, headers.Attempts())
+
+	headers.SetAttempts(2)
+	assert.Equal(t, 2, headers.Attempts())
+
+	assert.Equal(t, 3, Headers{AttemptsHeader: int32(3)}.Attempts())
+	assert.Equal(t, 4, Headers{AttemptsHeader: float64(4)}.Attempts())
+	assert.Equal(t, 0, Headers{AttemptsHeader: "five"}.Attempts())
+
+	headers.SetHandlingAttempts(1)
+	assert.Equal(t, 1, headers.HandlingAttempts())
+	assert.Equal(t, 2, headers.Attempts(), "attempts of saga handlers are counted apart")
+
+	headers.SetRedriven(1)
+	assert.Equal(t, 1, headers.Redriven())
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ContentTypeUnmarshaller is implemented by marshallers which select a decoder by the content type of received bytes,
+// the subscriber passes the value of ContentTypeHeader
+type ContentTypeUnmarshaller interface {
+	UnmarshalContentType(b []byte, contentType string) (Object, error)
+}
+
+// NewNegotiatingMarshaller creates a Marshaller which encodes with the encoder and decodes with the marshaller of received
+// content type, so producers of different formats share a topic, e.g. during migration from json to protobuf:
+//
+//	message.NewNegotiatingMarshaller(message.NewProtobufMarshaller(registry), message.NewJsonMarshaller(registry))
+//
+// Content type of a marshaller is taken with ContentTypeOf. Bytes without content type (e.g. sent by producers which
+// don't set ContentTypeHeader or read from a saga store) are decoded by the encoder and then by decoders in the order they are passed.
+func NewNegotiatingMarshaller(encoder Marshaller, decoders ...Marshaller) Marshaller {
+	m := &negotiatingMarshaller{encoder: encoder, byContentType: make(map[string]Marshaller, len(decoders)+1)}
+	m.ordered = append(m.ordered, encoder)
+	m.byContentType[ContentTypeOf(encoder)] = encoder
+
+	for _, decoder := range decoders {
+		contentType := ContentTypeOf(decoder)
+
+		if _, exists := m.byContentType[contentType]; exists {
+			continue
+		}
+
+		m.byContentType[contentType] = decoder
+		m.ordered = append(m.ordered, decoder)
+	}
+
+	return m
+}
+
+type negotiatingMarshaller struct {
+	encoder       Marshaller
+	byContentType map[string]Marshaller
+	ordered       []Marshaller
+}
+
+func (m negotiatingMarshaller) ContentType() string {
+	return ContentTypeOf(m.encoder)
+}
+
+// Marshal encodes obj with the encoder
+func (m negotiatingMarshaller) Marshal(obj Object) ([]byte, error) {
+	return m.encoder.Marshal(obj)
+}
+
+// Unmarshal decodes bytes of unknown content type with the first marshaller which succeeds, the error of the encoder is returned if none does
+func (m negotiatingMarshaller) Unmarshal(b []byte) (Object, error) {
+	var firstErr error
+
+	for _, decoder := range m.ordered {
+		obj, err := decoder.Unmarshal(b)
+		if err == nil {
+			return obj, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// UnmarshalContentType decodes bytes with the marshaller of the content type, empty content type is handled by Unmarshal
+func (m negotiatingMarshaller) UnmarshalContentType(b []byte, contentType string) (Object, error) {
+	if contentType == "" {
+		return m.Unmarshal(b)
+	}
+
+	decoder, exists := m.byContentType[contentType]
+	if !exists {
+		return nil, WithDecoderErr(errors.Errorf("no marshaller for content type '%s'", contentType))
+	}
+
+	return decoder.Unmarshal(b)
+}
+
+// UnmarshalWithContentType decodes bytes with UnmarshalContentType if the marshaller implements ContentTypeUnmarshaller,
+// otherwise the content type is ignored
+func UnmarshalWithContentType(m Marshaller, b []byte, contentType string) (Object, error) {
+	if negotiator, ok := m.(ContentTypeUnmarshaller); ok {
+		return negotiator.UnmarshalContentType(b, contentType)
+	}
+
+	return m.Unmarshal(b)
+}
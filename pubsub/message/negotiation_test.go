@@ -0,0 +1,71 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/protobuf/examplepb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNegotiatingMarshaller(t *testing.T) {
+	knownRegistry := scheme.NewKnownTypesRegistry()
+	knownRegistry.AddKnownTypes(group, &OrderPaid{})
+
+	jsonMarshaller := NewJsonMarshaller(knownRegistry)
+	protobufMarshaller := NewProtobufMarshaller(knownRegistry)
+	marshaller := NewNegotiatingMarshaller(protobufMarshaller, jsonMarshaller, NewJsonMarshaller(knownRegistry))
+
+	instance := &OrderPaid{OrderPaid: examplepb.OrderPaid{OrderId: "123"}}
+	jsonData, err := jsonMarshaller.Marshal(instance)
+	require.NoError(t, err)
+	protoData, err := protobufMarshaller.Marshal(instance)
+	require.NoError(t, err)
+
+	assertDecoded := func(t *testing.T, obj Object, err error) {
+		require.NoError(t, err)
+		require.IsType(t, &OrderPaid{}, obj)
+		assert.True(t, proto.Equal(&instance.OrderPaid, &obj.(*OrderPaid).OrderPaid))
+	}
+
+	t.Run("encodes with the encoder", func(t *testing.T) {
+		assert.Equal(t, ProtobufContentType, ContentTypeOf(marshaller))
+
+		data, err := marshaller.Marshal(instance)
+		require.NoError(t, err)
+		assert.Equal(t, protoData, data)
+	})
+
+	t.Run("decodes by content type", func(t *testing.T) {
+		obj, err := UnmarshalWithContentType(marshaller, jsonData, JsonContentType)
+		assertDecoded(t, obj, err)
+
+		obj, err = UnmarshalWithContentType(marshaller, protoData, ProtobufContentType)
+		assertDecoded(t, obj, err)
+
+		_, err = UnmarshalWithContentType(marshaller, protoData, JsonContentType)
+		assert.Error(t, err)
+	})
+
+	t.Run("decodes bytes without content type", func(t *testing.T) {
+		obj, err := UnmarshalWithContentType(marshaller, jsonData, "")
+		assertDecoded(t, obj, err)
+
+		obj, err = marshaller.Unmarshal(protoData)
+		assertDecoded(t, obj, err)
+	})
+
+	t.Run("unknown content type", func(t *testing.T) {
+		_, err := UnmarshalWithContentType(marshaller, jsonData, "application/avro")
+		require.Error(t, err)
+		assert.IsType(t, DecoderErr{}, err)
+		assert.EqualError(t, err, "no marshaller for content type 'application/avro'")
+	})
+
+	t.Run("marshaller without negotiation ignores content type", func(t *testing.T) {
+		obj, err := UnmarshalWithContentType(jsonMarshaller, jsonData, ProtobufContentType)
+		assertDecoded(t, obj, err)
+	})
+}
@@ -0,0 +1,242 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=../.. --go_opt=paths=source_relative -I ../.. pubsub/message/envelope.proto
+
+// ProtobufContentType is the content type of bytes produced by protobuf marshaller
+const ProtobufContentType = "application/x-protobuf"
+
+var (
+	protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	objectMetaType   = reflect.TypeOf(ObjectMeta{})
+	commandType      = reflect.TypeOf(Command{})
+	eventType        = reflect.TypeOf(Event{})
+)
+
+// NewProtobufMarshaller creates a Marshaller which encodes objects with protobuf. Types are registered in the scheme the same way
+// as for json marshaller, an object must be a proto.Message: either a generated message with GroupKind methods
+// or a struct which embeds a generated message, e.g.
+//
+//	type OrderCreated struct {
+//		message.ObjectMeta
+//		pb.OrderCreated
+//	}
+//
+// The embedded message is encoded with protobuf, other exported fields of the struct (e.g. saga.BaseSaga with its timeouts) are kept as json.
+// A message embedded by value keeps the type decodable by json marshaller too, json marshaller doesn't support embedded pointers.
+// Group and kind of the object are written into ProtoEnvelope together with encoded bytes.
+// Marshaling of an object which isn't a proto.Message fails, unless its type is listed in WithJsonEncodedTypes.
+func NewProtobufMarshaller(knownTypes scheme.KnownTypesRegistry, opts ...ProtobufMarshallerOpt) Marshaller {
+	m := &protobufMarshaller{knownTypes: knownTypes, jsonMarshaller: NewJsonMarshaller(knownTypes), jsonTypes: make(map[reflect.Type]bool)}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// ProtobufMarshallerOpt configures protobuf marshaller
+type ProtobufMarshallerOpt func(m *protobufMarshaller)
+
+// WithJsonEncodedTypes lets protobuf marshaller encode types which aren't proto messages with json inside ProtoEnvelope,
+// e.g. saga system contracts returned by contracts.SagaContracts()
+func WithJsonEncodedTypes(types ...Object) ProtobufMarshallerOpt {
+	return func(m *protobufMarshaller) {
+		for _, t := range types {
+			m.jsonTypes[scheme.GetStructType(t)] = true
+		}
+	}
+}
+
+type protobufMarshaller struct {
+	knownTypes     scheme.KnownTypesRegistry
+	jsonMarshaller Marshaller
+	jsonTypes      map[reflect.Type]bool
+}
+
+func (p protobufMarshaller) ContentType() string {
+	return ProtobufContentType
+}
+
+// Marshal encodes obj into ProtoEnvelope. Like json marshaller it sets GK if obj has empty GK
+func (p protobufMarshaller) Marshal(obj Object) ([]byte, error) {
+	protoMsg, ok := obj.(proto.Message)
+	if !ok && !p.jsonTypes[scheme.GetStructType(obj)] {
+		return nil, WithDecoderErr(errors.Errorf("%T doesn't implement proto.Message, it can't be encoded by protobuf marshaller. List it in WithJsonEncodedTypes to encode it with json", obj))
+	}
+
+	gk := obj.GroupKind()
+
+	if gk.Empty() {
+		registeredGK, err := p.knownTypes.ObjectKind(obj)
+		if err != nil {
+			return nil, WithDecoderErr(errors.Wrapf(err, "encoding %T", obj))
+		}
+
+		obj.SetGroupKind(registeredGK)
+		gk = *registeredGK
+	}
+
+	if !ok {
+		return p.marshalJson(obj, gk)
+	}
+
+	embedded := protoMsg.ProtoReflect()
+	if !embedded.IsValid() {
+		return nil, WithDecoderErr(errors.Errorf("proto message of %s is nil", gk))
+	}
+
+	payload, err := proto.Marshal(embedded.Interface())
+	if err != nil {
+		return nil, WithDecoderErr(errors.Wrapf(err, "encoding %s", gk))
+	}
+
+	envelope := &ProtoEnvelope{Group: gk.Group.String(), Kind: gk.Kind, Payload: payload}
+
+	// obj isn't the generated message itself, it embeds one
+	if embedded.Interface() != protoMsg {
+		if envelope.Fields, err = marshalFields(obj); err != nil {
+			return nil, WithDecoderErr(errors.Wrapf(err, "encoding fields of %s", gk))
+		}
+	}
+
+	encodedBytes, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, WithDecoderErr(errors.Wrapf(err, "encoding envelope of %s", gk))
+	}
+
+	return encodedBytes, nil
+}
+
+// Unmarshal decodes ProtoEnvelope into a new object of the type registered in scheme under its group and kind
+func (p protobufMarshaller) Unmarshal(b []byte) (Object, error) {
+	envelope := &ProtoEnvelope{}
+
+	if err := proto.Unmarshal(b, envelope); err != nil {
+		return nil, WithDecoderErr(errors.Wrap(err, "decoding proto envelope"))
+	}
+
+	gk := scheme.GroupKind{Group: scheme.Group(envelope.Group), Kind: envelope.Kind}
+
+	if gk.Empty() {
+		return nil, WithDecoderErr(errors.New("GroupKind is empty in proto envelope"))
+	}
+
+	obj, err := p.knownTypes.NewObject(gk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating new obj for %s", gk)
+	}
+
+	protoMsg, ok := obj.(proto.Message)
+	if !ok {
+		if p.jsonTypes[scheme.GetStructType(obj)] {
+			return p.jsonMarshaller.Unmarshal(envelope.Payload)
+		}
+
+		return nil, WithDecoderErr(errors.Errorf("%T registered as %s doesn't implement proto.Message", obj, gk))
+	}
+
+	if !protoMsg.ProtoReflect().IsValid() {
+		allocEmbeddedMessage(obj)
+	}
+
+	if err := proto.Unmarshal(envelope.Payload, protoMsg.ProtoReflect().Interface()); err != nil {
+		return nil, WithDecoderErr(errors.Wrapf(err, "decoding %s", gk))
+	}
+
+	if len(envelope.Fields) > 0 {
+		if err := unmarshalFields(obj, envelope.Fields); err != nil {
+			return nil, WithDecoderErr(errors.Wrapf(err, "decoding fields of %s", gk))
+		}
+	}
+
+	obj.SetGroupKind(&gk)
+
+	return obj, nil
+}
+
+// marshalJson puts json of an object listed in WithJsonEncodedTypes into the envelope, nested objects are encoded by json marshaller as well
+func (p protobufMarshaller) marshalJson(obj Object, gk scheme.GroupKind) ([]byte, error) {
+	payload, err := p.jsonMarshaller.Marshal(obj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	encodedBytes, err := proto.Marshal(&ProtoEnvelope{Group: gk.Group.String(), Kind: gk.Kind, Payload: payload})
+	if err != nil {
+		return nil, WithDecoderErr(errors.Wrapf(err, "encoding envelope of %s", gk))
+	}
+
+	return encodedBytes, nil
+}
+
+// marshalFields encodes exported fields of a struct except the embedded proto message, ObjectMeta and Command or Event markers, keyed by field names
+func marshalFields(obj Object) ([]byte, error) {
+	structVal := reflect.ValueOf(obj).Elem()
+	fields := make(map[string]interface{})
+
+	for i := 0; i < structVal.NumField(); i++ {
+		if field := structVal.Type().Field(i); isPlainField(field) {
+			fields[field.Name] = structVal.Field(i).Interface()
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(fields)
+}
+
+func unmarshalFields(obj Object, data []byte) error {
+	fields := make(map[string]json.RawMessage)
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return errors.WithStack(err)
+	}
+
+	structVal := reflect.ValueOf(obj).Elem()
+
+	for name, value := range fields {
+		field, exists := structVal.Type().FieldByName(name)
+		if !exists || !isPlainField(field) {
+			continue
+		}
+
+		if err := json.Unmarshal(value, structVal.FieldByIndex(field.Index).Addr().Interface()); err != nil {
+			return errors.Wrapf(err, "decoding field %s", name)
+		}
+	}
+
+	return nil
+}
+
+func isPlainField(field reflect.StructField) bool {
+	if field.PkgPath != "" || field.Type == objectMetaType || field.Type == commandType || field.Type == eventType {
+		return false
+	}
+
+	return !(field.Anonymous && (field.Type.Implements(protoMessageType) || reflect.PtrTo(field.Type).Implements(protoMessageType)))
+}
+
+// allocEmbeddedMessage sets nil pointers to embedded proto messages of a new object, so it can be decoded into
+func allocEmbeddedMessage(obj Object) {
+	structVal := reflect.ValueOf(obj).Elem()
+
+	for i := 0; i < structVal.NumField(); i++ {
+		field := structVal.Type().Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Ptr && field.Type.Implements(protoMessageType) && structVal.Field(i).IsNil() {
+			structVal.Field(i).Set(reflect.New(field.Type.Elem()))
+		}
+	}
+}
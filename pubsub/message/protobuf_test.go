@@ -0,0 +1,152 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/protobuf/examplepb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type OrderCreated struct {
+	ObjectMeta
+	*examplepb.OrderCreated
+}
+
+type OrderPaid struct {
+	ObjectMeta
+	examplepb.OrderPaid
+}
+
+type PayOrder struct {
+	ObjectMeta
+	Command
+	examplepb.OrderPaid
+}
+
+type OrderProcess struct {
+	ObjectMeta
+	*examplepb.OrderState
+	Timeouts map[string]string `json:"timeouts,omitempty"`
+	Attempts int
+	internal string
+}
+
+func TestProtobufMarshaller(t *testing.T) {
+	knownRegistry := scheme.NewKnownTypesRegistry()
+	knownRegistry.AddKnownTypes(group, &OrderCreated{}, &OrderPaid{}, &OrderProcess{}, &SomeTestType{})
+	marshaller := NewProtobufMarshaller(knownRegistry)
+
+	t.Run("encode and decode embedded proto message", func(t *testing.T) {
+		instance := &OrderCreated{OrderCreated: &examplepb.OrderCreated{OrderId: "123", Amount: 100}}
+
+		data, err := marshaller.Marshal(instance)
+		require.NoError(t, err)
+		assert.Equal(t, scheme.GroupKind{Group: group, Kind: "OrderCreated"}, instance.GroupKind())
+
+		decoded, err := marshaller.Unmarshal(data)
+		require.NoError(t, err)
+		require.IsType(t, &OrderCreated{}, decoded)
+
+		order := decoded.(*OrderCreated)
+		assert.Equal(t, instance.GroupKind(), order.GroupKind())
+		assert.True(t, proto.Equal(instance.OrderCreated, order.OrderCreated))
+	})
+
+	t.Run("fields besides proto message are kept", func(t *testing.T) {
+		instance := &OrderProcess{
+			OrderState: &examplepb.OrderState{OrderId: "123", Status: "paid", Items: []string{"a", "b"}},
+			Timeouts:   map[string]string{"payment": "uid"},
+			Attempts:   2,
+			internal:   "not encoded",
+		}
+
+		data, err := marshaller.Marshal(instance)
+		require.NoError(t, err)
+
+		decoded, err := marshaller.Unmarshal(data)
+		require.NoError(t, err)
+
+		process := decoded.(*OrderProcess)
+		assert.True(t, proto.Equal(instance.OrderState, process.OrderState))
+		assert.Equal(t, instance.Timeouts, process.Timeouts)
+		assert.Equal(t, 2, process.Attempts)
+		assert.Empty(t, process.internal)
+		assert.Equal(t, scheme.GroupKind{Group: group, Kind: "OrderProcess"}, process.GroupKind())
+	})
+
+	t.Run("object is not a proto message", func(t *testing.T) {
+		_, err := marshaller.Marshal(&SomeTestType{Value: 1})
+		require.Error(t, err)
+		assert.IsType(t, DecoderErr{}, err)
+		assert.EqualError(t, err, "*message.SomeTestType doesn't implement proto.Message, it can't be encoded by protobuf marshaller. List it in WithJsonEncodedTypes to encode it with json")
+	})
+
+	t.Run("json encoded types", func(t *testing.T) {
+		jsonEncoding := NewProtobufMarshaller(knownRegistry, WithJsonEncodedTypes(&SomeTestType{}))
+
+		data, err := jsonEncoding.Marshal(&SomeTestType{Value: 1, Child: ChildType{Value: 2}})
+		require.NoError(t, err)
+
+		decoded, err := jsonEncoding.Unmarshal(data)
+		require.NoError(t, err)
+		assert.Equal(t, &SomeTestType{ObjectMeta: ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SomeTestType", Group: group.String()}}, Value: 1, Child: ChildType{Value: 2}}, decoded)
+
+		_, err = marshaller.Unmarshal(data)
+		assert.EqualError(t, err, "*message.SomeTestType registered as test.SomeTestType doesn't implement proto.Message")
+	})
+
+	t.Run("embedded proto message is nil", func(t *testing.T) {
+		_, err := marshaller.Marshal(&OrderCreated{})
+		assert.EqualError(t, err, "proto message of test.OrderCreated is nil")
+	})
+
+	t.Run("type is not registered", func(t *testing.T) {
+		_, err := NewProtobufMarshaller(scheme.NewKnownTypesRegistry()).Marshal(&OrderCreated{OrderCreated: &examplepb.OrderCreated{}})
+		assert.Error(t, err)
+
+		data, err := marshaller.Marshal(&OrderCreated{OrderCreated: &examplepb.OrderCreated{OrderId: "1"}})
+		require.NoError(t, err)
+
+		_, err = NewProtobufMarshaller(scheme.NewKnownTypesRegistry()).Unmarshal(data)
+		assert.EqualError(t, err, "creating new obj for test.OrderCreated: type test.OrderCreated is not registered in KnownTypes")
+	})
+
+	t.Run("decode invalid data", func(t *testing.T) {
+		_, err := marshaller.Unmarshal([]byte("{}"))
+		require.Error(t, err)
+		assert.IsType(t, DecoderErr{}, err)
+
+		data, err := proto.Marshal(&ProtoEnvelope{Payload: []byte("data")})
+		require.NoError(t, err)
+
+		_, err = marshaller.Unmarshal(data)
+		assert.EqualError(t, err, "GroupKind is empty in proto envelope")
+	})
+
+	t.Run("proto message embedded by value", func(t *testing.T) {
+		for _, m := range []Marshaller{marshaller, NewJsonMarshaller(knownRegistry)} {
+			data, err := m.Marshal(&OrderPaid{OrderPaid: examplepb.OrderPaid{OrderId: "123"}})
+			require.NoError(t, err)
+
+			decoded, err := m.Unmarshal(data)
+			require.NoError(t, err)
+			require.IsType(t, &OrderPaid{}, decoded)
+			assert.Equal(t, "123", decoded.(*OrderPaid).GetOrderId())
+			assert.Equal(t, scheme.GroupKind{Group: group, Kind: "OrderPaid"}, decoded.GroupKind())
+		}
+	})
+
+	t.Run("command marker isn't encoded", func(t *testing.T) {
+		fields, err := marshalFields(&PayOrder{OrderPaid: examplepb.OrderPaid{OrderId: "123"}})
+		require.NoError(t, err)
+		assert.Nil(t, fields)
+	})
+
+	t.Run("content type", func(t *testing.T) {
+		assert.Equal(t, ProtobufContentType, ContentTypeOf(marshaller))
+		assert.Equal(t, JsonContentType, ContentTypeOf(NewJsonMarshaller(knownRegistry)))
+	})
+}
@@ -61,6 +61,22 @@ func (u *Unstructured) SetGroupKind(gk *scheme.GroupKind) {
 	u.Object["kind"] = gk.Kind
 }
 
+// SchemaVersion returns the schema version the object was marshalled with, see Upcasters. An object without a version is of version 1,
+// zero is returned if the version isn't a number.
+func (u *Unstructured) SchemaVersion() int {
+	versionVal, ok := u.Object[SchemaVersionKey]
+	if !ok {
+		return 1
+	}
+
+	version, ok := versionVal.(float64)
+	if !ok || version != float64(int(version)) {
+		return 0
+	}
+
+	return int(version)
+}
+
 func (u *Unstructured) GetUID() string {
 	uidVal, ok := u.Object["uid"]
 	if ok {
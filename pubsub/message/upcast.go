@@ -0,0 +1,131 @@
+package message
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+// SchemaVersionKey is the json key json marshaller writes the schema version of a payload into, see Upcasters
+const SchemaVersionKey = "schemaVersion"
+
+// Upcaster transforms data of a payload marshalled with a schema version into the next version, e.g. renames or fills fields.
+// Nested objects in data are *Unstructured.
+type Upcaster func(data map[string]interface{}) (map[string]interface{}, error)
+
+// Upcasters keeps upcasters of payload kinds, so a payload marshalled with an old schema is decoded into the current struct.
+// Versions of a kind start at 1, the current version is the number of its upcasters + 1. Json marshaller created with
+// WithUpcasters writes the current version of a kind into the payload and upcasts received payloads of older versions
+// one version after another before they are decoded. A payload without a version is considered to be of version 1.
+type Upcasters struct {
+	mutex  sync.RWMutex
+	chains map[scheme.GroupKind][]Upcaster
+}
+
+func NewUpcasters() *Upcasters {
+	return &Upcasters{chains: make(map[scheme.GroupKind][]Upcaster)}
+}
+
+// Register adds the upcaster of the kind from version `from` into the next one. Upcasters of a kind are registered in order of versions:
+// 1 into 2, then 2 into 3 and so on.
+func (u *Upcasters) Register(gk scheme.GroupKind, from int, upcaster Upcaster) error {
+	if upcaster == nil {
+		return errors.Errorf("upcaster of %s from version %d is nil", gk, from)
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if next := len(u.chains[gk]) + 1; from != next {
+		return errors.Errorf("upcaster of %s must be registered from version %d, got %d", gk, next, from)
+	}
+
+	u.chains[gk] = append(u.chains[gk], upcaster)
+
+	return nil
+}
+
+// Version returns the current schema version of the kind
+func (u *Upcasters) Version(gk scheme.GroupKind) int {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return len(u.chains[gk]) + 1
+}
+
+// Upcast transforms data of the kind marshalled with the version into the current version
+func (u *Upcasters) Upcast(gk scheme.GroupKind, version int, data map[string]interface{}) (map[string]interface{}, error) {
+	u.mutex.RLock()
+	chain := u.chains[gk]
+	u.mutex.RUnlock()
+
+	if version < 1 {
+		return nil, errors.Errorf("schema version %d of %s is invalid, versions start at 1", version, gk)
+	}
+
+	if current := len(chain) + 1; version > current {
+		return nil, errors.Errorf("payload of %s has schema version %d, newer than the current version %d", gk, version, current)
+	}
+
+	for v := version; v <= len(chain); v++ {
+		upcasted, err := chain[v-1](data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upcasting %s from version %d to %d", gk, v, v+1)
+		}
+
+		data = upcasted
+	}
+
+	return data, nil
+}
+
+// upcast transforms the received payload into the current version, the version is removed from its data
+func (u *Upcasters) upcast(unstructured *Unstructured) error {
+	gk := unstructured.GroupKind()
+	version := unstructured.SchemaVersion()
+	delete(unstructured.Object, SchemaVersionKey)
+
+	if version == u.Version(gk) {
+		return nil
+	}
+
+	data, err := u.Upcast(gk, version, unstructured.Object)
+	if err != nil {
+		return err
+	}
+
+	//the kind is kept even if an upcaster builds new data, nested objects it added are wrapped into Unstructured
+	unstructured.Object = data
+	unstructured.SetGroupKind(&gk)
+	unstructured.walkUnstructured()
+
+	return nil
+}
+
+// stamp writes the current version of the kind into encoded json of the payload, the first version isn't written
+func (u *Upcasters) stamp(gk scheme.GroupKind, encoded []byte) []byte {
+	version := u.Version(gk)
+	if version == 1 {
+		return encoded
+	}
+
+	trimmed := bytes.TrimSpace(encoded)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return encoded
+	}
+
+	rest := bytes.TrimSpace(trimmed[1:])
+
+	stamped := make([]byte, 0, len(encoded)+len(SchemaVersionKey)+8)
+	stamped = append(stamped, `{"`+SchemaVersionKey+`":`...)
+	stamped = strconv.AppendInt(stamped, int64(version), 10)
+
+	if len(rest) > 0 && rest[0] != '}' {
+		stamped = append(stamped, ',')
+	}
+
+	return append(stamped, rest...)
+}
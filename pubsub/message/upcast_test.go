@@ -0,0 +1,99 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// OrderPlaced v1 had 'amount' in cents, v2 renamed it into 'amountCents', v3 added 'currency'
+type OrderPlaced struct {
+	ObjectMeta
+	AmountCents int    `json:"amountCents"`
+	Currency    string `json:"currency"`
+}
+
+func TestUpcasters(t *testing.T) {
+	orderPlacedGK := scheme.GroupKind{Group: group, Kind: "OrderPlaced"}
+
+	knownTypes := scheme.NewKnownTypesRegistry()
+	knownTypes.AddKnownTypes(group, &OrderPlaced{}, &SomeTestType{})
+
+	upcasters := NewUpcasters()
+	require.NoError(t, upcasters.Register(orderPlacedGK, 1, func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["amountCents"] = data["amount"]
+		delete(data, "amount")
+		return data, nil
+	}))
+	require.NoError(t, upcasters.Register(orderPlacedGK, 2, func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["currency"] = "EUR"
+		return data, nil
+	}))
+
+	marshaller := NewJsonMarshaller(knownTypes, WithUpcasters(upcasters))
+
+	t.Run("registration", func(t *testing.T) {
+		assert.Equal(t, 3, upcasters.Version(orderPlacedGK))
+		assert.Equal(t, 1, upcasters.Version(scheme.GroupKind{Group: group, Kind: "SomeTestType"}))
+		assert.EqualError(t, upcasters.Register(orderPlacedGK, 1, func(data map[string]interface{}) (map[string]interface{}, error) {
+			return data, nil
+		}), "upcaster of test.OrderPlaced must be registered from version 3, got 1")
+		assert.EqualError(t, upcasters.Register(orderPlacedGK, 3, nil), "upcaster of test.OrderPlaced from version 3 is nil")
+	})
+
+	t.Run("current version is written into marshalled payload", func(t *testing.T) {
+		encoded, err := marshaller.Marshal(&OrderPlaced{AmountCents: 100, Currency: "USD"})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"schemaVersion":3,"group":"test","kind":"OrderPlaced","amountCents":100,"currency":"USD"}`, string(encoded))
+
+		decoded, err := marshaller.Unmarshal(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, 100, decoded.(*OrderPlaced).AmountCents)
+		assert.Equal(t, "USD", decoded.(*OrderPlaced).Currency)
+	})
+
+	t.Run("first version isn't written", func(t *testing.T) {
+		encoded, err := marshaller.Marshal(&SomeTestType{Value: 1})
+		require.NoError(t, err)
+		assert.NotContains(t, string(encoded), SchemaVersionKey)
+	})
+
+	t.Run("payload without version is upcasted from the first version", func(t *testing.T) {
+		decoded, err := marshaller.Unmarshal([]byte(`{"group":"test","kind":"OrderPlaced","amount":250}`))
+		require.NoError(t, err)
+		assert.Equal(t, &OrderPlaced{ObjectMeta: ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "test", Kind: "OrderPlaced"}}, AmountCents: 250, Currency: "EUR"}, decoded)
+	})
+
+	t.Run("payload is upcasted from its version", func(t *testing.T) {
+		decoded, err := marshaller.Unmarshal([]byte(`{"schemaVersion":2,"group":"test","kind":"OrderPlaced","amountCents":250}`))
+		require.NoError(t, err)
+		assert.Equal(t, 250, decoded.(*OrderPlaced).AmountCents)
+		assert.Equal(t, "EUR", decoded.(*OrderPlaced).Currency)
+	})
+
+	t.Run("invalid versions", func(t *testing.T) {
+		_, err := marshaller.Unmarshal([]byte(`{"schemaVersion":4,"group":"test","kind":"OrderPlaced"}`))
+		assert.IsType(t, DecoderErr{}, err)
+		assert.EqualError(t, err, "payload of test.OrderPlaced has schema version 4, newer than the current version 3")
+
+		_, err = marshaller.Unmarshal([]byte(`{"schemaVersion":"2","group":"test","kind":"OrderPlaced"}`))
+		assert.EqualError(t, err, "schema version 0 of test.OrderPlaced is invalid, versions start at 1")
+	})
+
+	t.Run("upcaster fails", func(t *testing.T) {
+		failing := NewUpcasters()
+		require.NoError(t, failing.Register(orderPlacedGK, 1, func(data map[string]interface{}) (map[string]interface{}, error) {
+			return nil, errors.New("amount is missing")
+		}))
+
+		_, err := NewJsonMarshaller(knownTypes, WithUpcasters(failing)).Unmarshal([]byte(`{"group":"test","kind":"OrderPlaced"}`))
+		assert.EqualError(t, err, "upcasting test.OrderPlaced from version 1 to 2: amount is missing")
+	})
+
+	t.Run("empty payload is stamped", func(t *testing.T) {
+		assert.Equal(t, `{"schemaVersion":3}`, string(upcasters.stamp(orderPlacedGK, []byte(`{ }`))))
+	})
+}
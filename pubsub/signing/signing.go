@@ -0,0 +1,256 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureHeader contains base64 encoded ed25519 signature of the canonical form of a message
+	SignatureHeader = "signature"
+	// KeyIDHeader contains id of the key the message was signed with
+	KeyIDHeader = "signatureKeyId"
+	// SignedHeadersHeader contains comma separated names of headers covered by the signature
+	SignedHeadersHeader = "signedHeaders"
+
+	uidHeader        = "uid"
+	canonicalVersion = "foreman-signature-v1"
+)
+
+// DefaultSignedHeaders are covered by a signature unless WithSignedHeaders adds others
+var DefaultSignedHeaders = []string{uidHeader, message.ContentTypeHeader, message.PublishedAtHeader}
+
+// SignatureErr is returned if a message isn't signed while it must be, or its signature can't be verified
+type SignatureErr struct {
+	error
+}
+
+func WithSignatureErr(err error) error {
+	return SignatureErr{err}
+}
+
+// Signer signs messages sent by an endpoint with a private key
+type Signer struct {
+	keyID   string
+	key     ed25519.PrivateKey
+	headers []string
+}
+
+// SignerOpt configures Signer
+type SignerOpt func(s *Signer)
+
+// WithSignedHeaders adds headers to DefaultSignedHeaders covered by the signature, e.g. sagaUID
+func WithSignedHeaders(keys ...string) SignerOpt {
+	return func(s *Signer) {
+		s.headers = append(s.headers, keys...)
+	}
+}
+
+// NewSigner creates a Signer, keyID tells receivers which of their public keys verifies the signature
+func NewSigner(keyID string, key ed25519.PrivateKey, opts ...SignerOpt) *Signer {
+	s := &Signer{keyID: keyID, key: key, headers: append([]string{}, DefaultSignedHeaders...)}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.headers = uniqueSorted(s.headers)
+
+	return s
+}
+
+// Sign signs the body together with signed headers and puts the signature, the key id and names of signed headers into headers
+func (s Signer) Sign(body []byte, headers message.Headers) {
+	headers[SignedHeadersHeader] = strings.Join(s.headers, ",")
+	headers[KeyIDHeader] = s.keyID
+	headers[SignatureHeader] = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, canonical(body, headers, s.headers)))
+}
+
+// Verifier checks signatures of received messages against a set of public keys. Several keys may be active at once,
+// so a new key is added before senders switch to it and the old one is removed once nothing is signed with it.
+type Verifier struct {
+	mutex      sync.RWMutex
+	keys       map[string]ed25519.PublicKey
+	required   map[scheme.GroupKind]struct{}
+	requireAll bool
+}
+
+// VerifierOpt configures Verifier
+type VerifierOpt func(v *Verifier)
+
+// WithRequiredFor requires signatures only for messages of the types, by default every message must be signed.
+// Signatures of other messages are verified if they are present.
+func WithRequiredFor(gks ...scheme.GroupKind) VerifierOpt {
+	return func(v *Verifier) {
+		v.requireAll = false
+		v.require(gks)
+	}
+}
+
+// WithOptionalSignatures requires signatures only for types added by Require, e.g. by a component for its contracts.
+// Signatures of other messages are verified if they are present.
+func WithOptionalSignatures() VerifierOpt {
+	return func(v *Verifier) {
+		v.requireAll = false
+	}
+}
+
+// NewVerifier creates a Verifier accepting signatures made by any of the keys, keys are mapped by their ids
+func NewVerifier(keys map[string]ed25519.PublicKey, opts ...VerifierOpt) *Verifier {
+	v := &Verifier{keys: make(map[string]ed25519.PublicKey, len(keys)), required: make(map[scheme.GroupKind]struct{}), requireAll: true}
+
+	for id, key := range keys {
+		v.keys[id] = key
+	}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	return v
+}
+
+// Require adds types of messages which must be signed, it changes nothing if all messages must be signed
+func (v *Verifier) Require(gks ...scheme.GroupKind) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.require(gks)
+}
+
+func (v *Verifier) require(gks []scheme.GroupKind) {
+	for _, gk := range gks {
+		v.required[gk] = struct{}{}
+	}
+}
+
+// AddKey starts accepting signatures made by the key
+func (v *Verifier) AddKey(keyID string, key ed25519.PublicKey) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.keys[keyID] = key
+}
+
+// RemoveKey stops accepting signatures made by the key
+func (v *Verifier) RemoveKey(keyID string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.keys, keyID)
+}
+
+// Verify returns SignatureErr if a message of the type must be signed and isn't, or if its signature doesn't match the body and signed headers
+func (v *Verifier) Verify(gk scheme.GroupKind, body []byte, headers message.Headers) error {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	signature, signed := headers[SignatureHeader].(string)
+
+	if !signed {
+		if _, required := v.required[gk]; v.requireAll || required {
+			return WithSignatureErr(errors.Errorf("message of type %s isn't signed", gk))
+		}
+
+		return nil
+	}
+
+	keyID, _ := headers[KeyIDHeader].(string)
+
+	key, known := v.keys[keyID]
+	if !known {
+		return WithSignatureErr(errors.Errorf("message is signed with unknown key '%s'", keyID))
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return WithSignatureErr(errors.Wrap(err, "decoding signature"))
+	}
+
+	signedHeadersList, _ := headers[SignedHeadersHeader].(string)
+
+	var signedHeaders []string
+	if signedHeadersList != "" {
+		signedHeaders = strings.Split(signedHeadersList, ",")
+	}
+
+	if !ed25519.Verify(key, canonical(body, headers, signedHeaders), decoded) {
+		return WithSignatureErr(errors.Errorf("signature made with key '%s' doesn't match the message", keyID))
+	}
+
+	return nil
+}
+
+// canonical joins signed headers and the body, so neither of them can be changed without breaking the signature
+func canonical(body []byte, headers message.Headers, signedHeaders []string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(canonicalVersion)
+	buf.WriteByte('\n')
+	buf.WriteString(strings.Join(signedHeaders, ","))
+	buf.WriteByte('\n')
+
+	for _, key := range signedHeaders {
+		buf.WriteString(key)
+		buf.WriteByte(':')
+		buf.WriteString(headerValue(headers[key]))
+		buf.WriteByte('\n')
+	}
+
+	buf.WriteByte('\n')
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+// headerValue formats numbers the same way whether a transport delivers them as integers or floats
+func headerValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	case int32:
+		return strconv.FormatInt(int64(val), 10)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		if val == math.Trunc(val) {
+			return strconv.FormatInt(int64(val), 10)
+		}
+
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func uniqueSorted(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	res := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		if _, exists := seen[key]; exists {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		res = append(res, key)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
@@ -0,0 +1,81 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigning(t *testing.T) {
+	oldPublic, oldPrivate, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	newPublic, newPrivate, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	startSaga := scheme.GroupKind{Group: "systemSaga", Kind: "StartSagaCommand"}
+	orderPlaced := scheme.GroupKind{Group: "orders", Kind: "OrderPlaced"}
+	body := []byte(`{"saga_uid":"123"}`)
+
+	signed := func(signer *Signer) message.Headers {
+		headers := message.Headers{"uid": "msg-1", "sagaUID": "123", message.PublishedAtHeader: int64(1650000000000)}
+		signer.Sign(body, headers)
+		return headers
+	}
+
+	verifier := NewVerifier(map[string]ed25519.PublicKey{"old": oldPublic, "new": newPublic})
+
+	t.Run("keys being rotated are accepted", func(t *testing.T) {
+		assert.NoError(t, verifier.Verify(startSaga, body, signed(NewSigner("old", oldPrivate))))
+		assert.NoError(t, verifier.Verify(startSaga, body, signed(NewSigner("new", newPrivate))))
+	})
+
+	t.Run("numeric headers delivered as floats", func(t *testing.T) {
+		headers := signed(NewSigner("new", newPrivate))
+		headers[message.PublishedAtHeader] = float64(1650000000000)
+
+		assert.NoError(t, verifier.Verify(startSaga, body, headers))
+	})
+
+	t.Run("tampered body or signed header", func(t *testing.T) {
+		err := verifier.Verify(startSaga, []byte(`{"saga_uid":"456"}`), signed(NewSigner("new", newPrivate)))
+		assert.IsType(t, SignatureErr{}, err)
+		assert.EqualError(t, err, "signature made with key 'new' doesn't match the message")
+
+		headers := signed(NewSigner("new", newPrivate, WithSignedHeaders("sagaUID")))
+		assert.Equal(t, "contentType,publishedAt,sagaUID,uid", headers[SignedHeadersHeader])
+		headers["sagaUID"] = "456"
+		assert.Error(t, verifier.Verify(startSaga, body, headers))
+
+		headers = signed(NewSigner("new", newPrivate, WithSignedHeaders("sagaUID")))
+		headers[SignedHeadersHeader] = "uid"
+		assert.Error(t, verifier.Verify(startSaga, body, headers), "list of signed headers is signed too")
+	})
+
+	t.Run("removed key", func(t *testing.T) {
+		verifier := NewVerifier(map[string]ed25519.PublicKey{"old": oldPublic})
+		verifier.AddKey("new", newPublic)
+		verifier.RemoveKey("old")
+
+		assert.EqualError(t, verifier.Verify(startSaga, body, signed(NewSigner("old", oldPrivate))), "message is signed with unknown key 'old'")
+		assert.NoError(t, verifier.Verify(startSaga, body, signed(NewSigner("new", newPrivate))))
+	})
+
+	t.Run("required signatures", func(t *testing.T) {
+		assert.EqualError(t, verifier.Verify(orderPlaced, body, message.Headers{}), "message of type orders.OrderPlaced isn't signed")
+
+		optional := NewVerifier(map[string]ed25519.PublicKey{"new": newPublic}, WithOptionalSignatures())
+		optional.Require(startSaga)
+
+		assert.NoError(t, optional.Verify(orderPlaced, body, message.Headers{}))
+		assert.EqualError(t, optional.Verify(startSaga, body, message.Headers{}), "message of type systemSaga.StartSagaCommand isn't signed")
+		assert.Error(t, optional.Verify(orderPlaced, body, signed(NewSigner("old", oldPrivate))), "present signatures are verified")
+
+		requiredFor := NewVerifier(map[string]ed25519.PublicKey{"new": newPublic}, WithRequiredFor(orderPlaced))
+		assert.NoError(t, requiredFor.Verify(startSaga, body, message.Headers{}))
+		assert.Error(t, requiredFor.Verify(orderPlaced, body, message.Headers{}))
+	})
+}
@@ -0,0 +1,193 @@
+package sla
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Breach describes a message that was handled later than its SLA allows
+type Breach struct {
+	GroupKind   scheme.GroupKind
+	MessageUID  string
+	SLA         time.Duration
+	Latency     time.Duration
+	PublishedAt time.Time
+	HandledAt   time.Time
+}
+
+// Stats contains counters collected for a GroupKind
+type Stats struct {
+	// Handled is a number of observed messages that had a publishing timestamp
+	Handled uint64
+	// Breaches is a number of messages handled later than SLA allows
+	Breaches uint64
+	// ClockSkews is a number of messages which were handled before they were published according to producer's clock.
+	// Latency of such messages is clamped to zero.
+	ClockSkews uint64
+	// MaxLatency is the highest observed latency
+	MaxLatency time.Duration
+}
+
+// Tracker measures time from publishing of a message (message.PublishedAtHeader set by an endpoint) to completion of its handlers
+// and reports a Breach if it exceeds the SLA registered for message's GroupKind.
+type Tracker struct {
+	mutex    *sync.RWMutex
+	slas     map[scheme.GroupKind]time.Duration
+	stats    map[scheme.GroupKind]*Stats
+	onBreach []func(Breach)
+
+	breaches   *prometheus.CounterVec
+	clockSkews prometheus.Counter
+}
+
+// NewTracker creates an empty Tracker, register SLAs with Register
+func NewTracker() *Tracker {
+	return &Tracker{
+		mutex: &sync.RWMutex{},
+		slas:  make(map[scheme.GroupKind]time.Duration),
+		stats: make(map[scheme.GroupKind]*Stats),
+	}
+}
+
+// Register sets an SLA for messages of GroupKind. Registering the same GroupKind again overrides the previous value.
+func (t *Tracker) Register(gk scheme.GroupKind, sla time.Duration) *Tracker {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.slas[gk] = sla
+
+	return t
+}
+
+// RegisterMetrics registers prometheus counters in the registerer, Stats stay available as well:
+//
+//	foreman_sla_breaches_total{group_kind} - messages handled later than their SLA allows
+//	foreman_sla_clock_skews_total - messages handled before they were published according to producer's clock
+func (t *Tracker) RegisterMetrics(registerer prometheus.Registerer) error {
+	breaches := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foreman",
+		Subsystem: "sla",
+		Name:      "breaches_total",
+		Help:      "Number of messages handled later than their SLA allows.",
+	}, []string{"group_kind"})
+	clockSkews := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "foreman",
+		Subsystem: "sla",
+		Name:      "clock_skews_total",
+		Help:      "Number of messages handled before they were published according to producer's clock.",
+	})
+
+	for _, c := range []prometheus.Collector{breaches, clockSkews} {
+		if err := registerer.Register(c); err != nil {
+			return errors.Wrap(err, "registering sla metrics")
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.breaches = breaches
+	t.clockSkews = clockSkews
+
+	return nil
+}
+
+// OnBreach registers a callback called synchronously on each breach, it shouldn't block for long
+func (t *Tracker) OnBreach(callback func(Breach)) *Tracker {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.onBreach = append(t.onBreach, callback)
+
+	return t
+}
+
+// Observe records handling of a message. Messages without registered SLA or publishing timestamp are ignored.
+func (t *Tracker) Observe(msg *message.ReceivedMessage, handledAt time.Time) {
+	gk := msg.Payload().GroupKind()
+
+	t.mutex.RLock()
+	sla, registered := t.slas[gk]
+	t.mutex.RUnlock()
+
+	if !registered {
+		return
+	}
+
+	publishedAt, ok := msg.Headers().PublishedAt()
+	if !ok {
+		return
+	}
+
+	latency := handledAt.Sub(publishedAt)
+
+	t.mutex.Lock()
+
+	stats, exists := t.stats[gk]
+	if !exists {
+		stats = &Stats{}
+		t.stats[gk] = stats
+	}
+
+	stats.Handled++
+
+	if latency < 0 {
+		stats.ClockSkews++
+		latency = 0
+
+		if t.clockSkews != nil {
+			t.clockSkews.Inc()
+		}
+	}
+
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+
+	breached := latency > sla
+	if breached {
+		stats.Breaches++
+
+		if t.breaches != nil {
+			t.breaches.WithLabelValues(gk.String()).Inc()
+		}
+	}
+
+	callbacks := t.onBreach
+
+	t.mutex.Unlock()
+
+	if !breached {
+		return
+	}
+
+	breach := Breach{
+		GroupKind:   gk,
+		MessageUID:  msg.UID(),
+		SLA:         sla,
+		Latency:     latency,
+		PublishedAt: publishedAt,
+		HandledAt:   handledAt,
+	}
+
+	for _, callback := range callbacks {
+		callback(breach)
+	}
+}
+
+// Stats returns a snapshot of counters for a GroupKind
+func (t *Tracker) Stats(gk scheme.GroupKind) Stats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if stats, exists := t.stats[gk]; exists {
+		return *stats
+	}
+
+	return Stats{}
+}
@@ -0,0 +1,100 @@
+package sla
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type processPayment struct {
+	message.ObjectMeta
+}
+
+func TestTracker(t *testing.T) {
+	gk := scheme.GroupKind{Group: "payments", Kind: "ProcessPayment"}
+	payload := &processPayment{}
+	payload.SetGroupKind(&gk)
+
+	receivedMsg := func(publishedAt time.Time) *message.ReceivedMessage {
+		headers := message.Headers{}
+		headers.SetPublishedAt(publishedAt)
+		return message.NewReceivedMessage("uid", payload, headers, time.Now(), "bus")
+	}
+
+	t.Run("breach is reported", func(t *testing.T) {
+		var breaches []Breach
+		tracker := NewTracker().
+			Register(gk, time.Second*30).
+			OnBreach(func(b Breach) {
+				breaches = append(breaches, b)
+			})
+
+		now := time.Now()
+		tracker.Observe(receivedMsg(now.Add(-time.Second*10)), now)
+		tracker.Observe(receivedMsg(now.Add(-time.Minute)), now)
+
+		require.Len(t, breaches, 1)
+		assert.Equal(t, gk, breaches[0].GroupKind)
+		assert.Equal(t, "uid", breaches[0].MessageUID)
+		assert.Equal(t, time.Second*30, breaches[0].SLA)
+		assert.Equal(t, time.Minute, breaches[0].Latency.Round(time.Second))
+
+		stats := tracker.Stats(gk)
+		assert.Equal(t, uint64(2), stats.Handled)
+		assert.Equal(t, uint64(1), stats.Breaches)
+		assert.Equal(t, time.Minute, stats.MaxLatency.Round(time.Second))
+	})
+
+	t.Run("negative latency is clamped", func(t *testing.T) {
+		tracker := NewTracker().Register(gk, time.Second).OnBreach(func(b Breach) {
+			t.Fatal("no breach expected")
+		})
+
+		now := time.Now()
+		tracker.Observe(receivedMsg(now.Add(time.Minute)), now)
+
+		stats := tracker.Stats(gk)
+		assert.Equal(t, uint64(1), stats.ClockSkews)
+		assert.Equal(t, time.Duration(0), stats.MaxLatency)
+	})
+
+	t.Run("breaches and clock skews are counted in metrics", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		tracker := NewTracker().Register(gk, time.Second*30)
+		require.NoError(t, tracker.RegisterMetrics(registry))
+
+		now := time.Now()
+		tracker.Observe(receivedMsg(now.Add(-time.Second*10)), now)
+		tracker.Observe(receivedMsg(now.Add(-time.Minute)), now)
+		tracker.Observe(receivedMsg(now.Add(time.Minute)), now)
+
+		expected := `
+# HELP foreman_sla_breaches_total Number of messages handled later than their SLA allows.
+# TYPE foreman_sla_breaches_total counter
+foreman_sla_breaches_total{group_kind="payments.ProcessPayment"} 1
+# HELP foreman_sla_clock_skews_total Number of messages handled before they were published according to producer's clock.
+# TYPE foreman_sla_clock_skews_total counter
+foreman_sla_clock_skews_total 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "foreman_sla_breaches_total", "foreman_sla_clock_skews_total"))
+
+		assert.EqualError(t, NewTracker().RegisterMetrics(registry), "registering sla metrics: duplicate metrics collector registration attempted")
+	})
+
+	t.Run("not registered or not timestamped messages are ignored", func(t *testing.T) {
+		tracker := NewTracker()
+		tracker.Observe(receivedMsg(time.Now().Add(-time.Hour)), time.Now())
+		assert.Equal(t, Stats{}, tracker.Stats(gk))
+
+		tracker.Register(gk, time.Second)
+		tracker.Observe(message.NewReceivedMessage("uid", payload, message.Headers{}, time.Now(), "bus"), time.Now())
+		assert.Equal(t, Stats{}, tracker.Stats(gk))
+	})
+}
@@ -0,0 +1,94 @@
+package subscriber
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+// DefaultDeduplicationTTL is how long a processed message is remembered by Deduplicator unless WithDeduplicationTTL is passed
+const DefaultDeduplicationTTL = time.Hour * 24
+
+//go:generate mockgen --build_flags=--mod=mod -destination ../../testing/mocks/pubsub/subscriber/deduplicator.go -package subscriber . Deduplicator
+
+// Deduplicator remembers keys of successfully processed messages, saga.SQLDeduplicator and RedisDeduplicator are shared by replicas
+type Deduplicator interface {
+	// Processed tells whether a message with the key was processed and its key didn't expire yet
+	Processed(ctx context.Context, key string) (bool, error)
+	// MarkProcessed remembers the key for ttl
+	MarkProcessed(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// DeduplicationOpt configures deduplication of the default processor
+type DeduplicationOpt func(d *deduplication)
+
+// WithIdempotencyKeyHeader makes messages deduplicated by the value of the header, messages without it are deduplicated by uid
+func WithIdempotencyKeyHeader(header string) DeduplicationOpt {
+	return func(d *deduplication) {
+		d.keyHeader = header
+	}
+}
+
+// WithDeduplicationTTL overrides DefaultDeduplicationTTL, redeliveries coming later than ttl are processed again
+func WithDeduplicationTTL(ttl time.Duration) DeduplicationOpt {
+	return func(d *deduplication) {
+		d.ttl = ttl
+	}
+}
+
+type deduplication struct {
+	deduplicator Deduplicator
+	keyHeader    string
+	ttl          time.Duration
+}
+
+// key of a message is scoped by the queue it's received from, so a message delivered into several queues is processed in each of them
+func (d deduplication) key(receivedMsg *message.ReceivedMessage) string {
+	key := receivedMsg.UID()
+
+	if d.keyHeader != "" {
+		if headerKey, ok := receivedMsg.Headers()[d.keyHeader].(string); ok && headerKey != "" {
+			key = headerKey
+		}
+	}
+
+	return receivedMsg.Origin() + ":" + key
+}
+
+// RedisClient is a subset of a redis client used by RedisDeduplicator, adapt the client your stack already uses (go-redis, redigo, ...)
+type RedisClient interface {
+	// Exists tells whether the key exists
+	Exists(ctx context.Context, key string) (bool, error)
+	// Set sets the key with expiration
+	Set(ctx context.Context, key, value string, expiration time.Duration) error
+}
+
+// RedisDeduplicator is Deduplicator keeping processed keys in redis, they expire by redis itself
+type RedisDeduplicator struct {
+	client RedisClient
+	prefix string
+}
+
+// NewRedisDeduplicator creates RedisDeduplicator, keys are prefixed with prefix
+func NewRedisDeduplicator(client RedisClient, prefix string) *RedisDeduplicator {
+	return &RedisDeduplicator{client: client, prefix: prefix}
+}
+
+func (r *RedisDeduplicator) Processed(ctx context.Context, key string) (bool, error) {
+	exists, err := r.client.Exists(ctx, r.prefix+key)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking processed key %s", key)
+	}
+
+	return exists, nil
+}
+
+func (r *RedisDeduplicator) MarkProcessed(ctx context.Context, key string, ttl time.Duration) error {
+	if err := r.client.Set(ctx, r.prefix+key, time.Now().UTC().Format(time.RFC3339), ttl); err != nil {
+		return errors.Wrapf(err, "setting processed key %s", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRedisClient struct {
+	keys map[string]time.Duration
+	err  error
+}
+
+func (c *fakeRedisClient) Exists(ctx context.Context, key string) (bool, error) {
+	_, exists := c.keys[key]
+	return exists, c.err
+}
+
+func (c *fakeRedisClient) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	c.keys[key] = expiration
+
+	return nil
+}
+
+func TestRedisDeduplicator(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeRedisClient{keys: make(map[string]time.Duration)}
+	deduplicator := NewRedisDeduplicator(client, "processed:")
+
+	processed, err := deduplicator.Processed(ctx, "queue:123")
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	require.NoError(t, deduplicator.MarkProcessed(ctx, "queue:123", time.Hour))
+	assert.Equal(t, map[string]time.Duration{"processed:queue:123": time.Hour}, client.keys)
+
+	processed, err = deduplicator.Processed(ctx, "queue:123")
+	require.NoError(t, err)
+	assert.True(t, processed)
+
+	client.err = errors.New("connection lost")
+	_, err = deduplicator.Processed(ctx, "queue:123")
+	assert.EqualError(t, err, "checking processed key queue:123: connection lost")
+	assert.EqualError(t, deduplicator.MarkProcessed(ctx, "queue:123", time.Hour), "setting processed key queue:123: connection lost")
+}
@@ -0,0 +1,76 @@
+package subscriber
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+)
+
+// DefaultPrefetch is the number of packages a worker holds besides the one in progress when packages are ordered, see WithPrefetch
+const DefaultPrefetch = 1
+
+// KeyFunc returns an ordering key of a package, an empty key means the package can be processed in any order, see WithOrderingKey
+type KeyFunc func(pkg transport.IncomingPkg) string
+
+// HeaderKey orders packages by a string header, e.g. HeaderKey("sagaUID") processes messages of a saga one by one.
+// See saga.OrderingKey when the saga uid header is configured.
+func HeaderKey(header string) KeyFunc {
+	return func(pkg transport.IncomingPkg) string {
+		key, _ := pkg.Headers()[header].(string)
+		return key
+	}
+}
+
+// partitions is a pool of workers, each of them processes packages of its own queue one by one
+type partitions struct {
+	queues []chan *inFlightPkg
+	key    KeyFunc
+	// next is a counter for packages without a key, they are spread among partitions in turn
+	next uint32
+}
+
+func newPartitions(count, prefetch uint, key KeyFunc) *partitions {
+	if count == 0 {
+		count = 1
+	}
+
+	p := &partitions{queues: make([]chan *inFlightPkg, count), key: key}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan *inFlightPkg, prefetch)
+	}
+
+	return p
+}
+
+func (p *partitions) start(process func(pkg *inFlightPkg)) {
+	for _, q := range p.queues {
+		go func(q chan *inFlightPkg) {
+			for pkg := range q {
+				process(pkg)
+			}
+		}(q)
+	}
+}
+
+// queue returns the queue of the partition the package belongs to
+func (p *partitions) queue(pkg transport.IncomingPkg) chan<- *inFlightPkg {
+	key := p.key(pkg)
+
+	if key == "" {
+		return p.queues[atomic.AddUint32(&p.next, 1)%uint32(len(p.queues))]
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+
+	return p.queues[hash.Sum32()%uint32(len(p.queues))]
+}
+
+// close stops workers once they have processed packages already in their queues
+func (p *partitions) close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+}
@@ -0,0 +1,118 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
+	"github.com/go-foreman/foreman/testing/log"
+	transportMock "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type processorFunc func(ctx context.Context, inPkg transport.IncomingPkg) error
+
+func (f processorFunc) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
+	return f(ctx, inPkg)
+}
+
+func TestPartitions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	incomingPkg := func(headers map[string]interface{}) transport.IncomingPkg {
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().Headers().Return(headers).AnyTimes()
+		return inPkg
+	}
+
+	workers := newPartitions(8, 1, HeaderKey("sagaUID"))
+	require.Len(t, workers.queues, 8)
+
+	first := incomingPkg(map[string]interface{}{"sagaUID": "saga-1"})
+	assert.Equal(t, workers.queue(first), workers.queue(incomingPkg(map[string]interface{}{"sagaUID": "saga-1"})), "packages of a saga go into the same partition")
+
+	withoutKey := incomingPkg(map[string]interface{}{})
+	assert.NotEqual(t, workers.queue(withoutKey), workers.queue(withoutKey), "packages without a key go to workers in turn")
+
+	assert.Len(t, newPartitions(0, 1, HeaderKey("sagaUID")).queues, 1)
+}
+
+func TestSubscriberOrdering(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testTransport := transportMock.NewMockTransport(ctrl)
+	queues := []transport.Queue{amqp.Queue("ordered", false, false, false, false)}
+
+	pkgsCount := 60
+	pkgsChan := make(chan transport.IncomingPkg, pkgsCount)
+	testTransport.EXPECT().Consume(gomock.Any(), queues).Return(pkgsChan, nil)
+
+	sent := make(map[string][]string)
+
+	for i := 0; i < pkgsCount; i++ {
+		sagaUID := fmt.Sprintf("saga-%d", i%3)
+		uid := fmt.Sprintf("%d", i)
+		sent[sagaUID] = append(sent[sagaUID], uid)
+
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().UID().Return(uid).AnyTimes()
+		inPkg.EXPECT().Headers().Return(map[string]interface{}{"sagaUID": sagaUID}).AnyTimes()
+		inPkg.EXPECT().Ack().Return(nil)
+		pkgsChan <- inPkg
+	}
+
+	var (
+		mutex     sync.Mutex
+		processed = make(map[string][]string)
+		active    = make(map[string]int)
+		overlaps  int
+		done      sync.WaitGroup
+	)
+
+	done.Add(pkgsCount)
+
+	processor := processorFunc(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+		defer done.Done()
+		sagaUID := inPkg.Headers()["sagaUID"].(string)
+
+		mutex.Lock()
+		active[sagaUID]++
+		if active[sagaUID] > 1 {
+			overlaps++
+		}
+		processed[sagaUID] = append(processed[sagaUID], inPkg.UID())
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mutex.Lock()
+		active[sagaUID]--
+		mutex.Unlock()
+
+		return nil
+	})
+
+	subscriber := NewSubscriber(testTransport, processor, log.NewNilLogger(), WithWorkersCount(4), WithPrefetch(2), WithOrderingKey(HeaderKey("sagaUID")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- subscriber.Run(ctx, queues...)
+	}()
+
+	done.Wait()
+	cancel()
+	require.NoError(t, <-runErr)
+
+	assert.Equal(t, 0, overlaps, "packages of a saga aren't processed concurrently")
+	assert.Equal(t, sent, processed, "packages of a saga are processed in order they are received")
+}
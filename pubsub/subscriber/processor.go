@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/pubsub/sla"
 	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/runtime/scheme"
 
 	"github.com/go-foreman/foreman/log"
 	msgDispatcher "github.com/go-foreman/foreman/pubsub/dispatcher"
@@ -30,15 +34,128 @@ type processor struct {
 	decoder           message.Marshaller
 	dispatcher        msgDispatcher.Dispatcher
 	msgExecCtxFactory execution.MessageExecutionCtxFactory
+	slaTracker        *sla.Tracker
+	retryPolicy       *RetryPolicy
+	msgRetryPolicies  messageRetryPolicies
+	sharedPayload     bool
+	verifier          *signing.Verifier
+	quarantine        endpoint.Endpoint
+	validateOnly      *ValidateOnly
+	deduplication     *deduplication
+	cipher            message.Cipher
+}
+
+// ProcessorOpt configures default Processor
+type ProcessorOpt func(p *processor)
+
+// WithSLATracker makes processor report handled messages to the tracker
+func WithSLATracker(tracker *sla.Tracker) ProcessorOpt {
+	return func(p *processor) {
+		p.slaTracker = tracker
+	}
+}
+
+// WithRetryPolicy makes processor retry messages which executors failed to handle and dead letter them after the last attempt.
+// Without the policy a failed message isn't acked and is redelivered by the broker infinitely.
+func WithRetryPolicy(policy *RetryPolicy) ProcessorOpt {
+	return func(p *processor) {
+		p.retryPolicy = policy
+	}
+}
+
+// WithMessageRetryPolicy retries messages of the given types by the policy instead of the one passed with WithRetryPolicy,
+// e.g. to give a payment more attempts than a notification. Other messages are still retried by WithRetryPolicy, if it's set.
+func WithMessageRetryPolicy(policy *RetryPolicy, objects ...message.Object) ProcessorOpt {
+	return func(p *processor) {
+		if p.msgRetryPolicies == nil {
+			p.msgRetryPolicies = make(messageRetryPolicies)
+		}
+
+		for _, obj := range objects {
+			p.msgRetryPolicies[scheme.GetStructType(obj)] = policy
+		}
+	}
+}
+
+// WithSharedPayload makes processor pass the same decoded payload and headers to all executors matched for a message.
+// It saves unmarshalling per executor, use it only if none of executors modifies a received message.
+func WithSharedPayload() ProcessorOpt {
+	return func(p *processor) {
+		p.sharedPayload = true
+	}
+}
+
+// WithSignatureVerification verifies signatures of received messages before they are dispatched, see signing.Verifier.
+// A message which fails verification isn't handled, it's acked and sent into quarantine endpoint with the failure in headers.
+func WithSignatureVerification(verifier *signing.Verifier, quarantine endpoint.Endpoint) ProcessorOpt {
+	return func(p *processor) {
+		p.verifier = verifier
+		p.quarantine = quarantine
+	}
+}
+
+// WithValidateOnly makes processor only validate messages received from queues in validate-only mode: they are decoded,
+// verified and matched with executors, but executors aren't called. Every such message is acked, even an invalid one,
+// and counted in the report of ValidateOnly. SLA of validated messages is still observed.
+func WithValidateOnly(validateOnly *ValidateOnly) ProcessorOpt {
+	return func(p *processor) {
+		p.validateOnly = validateOnly
+	}
+}
+
+// WithCipher makes processor decrypt payloads of received messages before they are unmarshalled, see message.Cipher.
+// A message which can't be decrypted isn't acked, as one which can't be unmarshalled.
+func WithCipher(cipher message.Cipher) ProcessorOpt {
+	return func(p *processor) {
+		p.cipher = cipher
+	}
+}
+
+// WithDeduplication makes processor skip messages which were already processed successfully, e.g. redelivered by the broker
+// after the ack was lost. A message is remembered in the deduplicator only after all executors handled it, so messages
+// which failed or were retried by the retry policy are processed again. Concurrent deliveries of the same message may
+// still be processed twice.
+func WithDeduplication(deduplicator Deduplicator, opts ...DeduplicationOpt) ProcessorOpt {
+	return func(p *processor) {
+		p.deduplication = &deduplication{deduplicator: deduplicator, ttl: DefaultDeduplicationTTL}
+
+		for _, opt := range opts {
+			opt(p.deduplication)
+		}
+	}
 }
 
 // NewMessageProcessor returns default implementation of Processor
-func NewMessageProcessor(decoder message.Marshaller, msgExecCtxFactory execution.MessageExecutionCtxFactory, msgDispatcher msgDispatcher.Dispatcher, logger log.Logger) Processor {
-	return &processor{decoder: decoder, msgExecCtxFactory: msgExecCtxFactory, dispatcher: msgDispatcher, logger: logger}
+func NewMessageProcessor(decoder message.Marshaller, msgExecCtxFactory execution.MessageExecutionCtxFactory, msgDispatcher msgDispatcher.Dispatcher, logger log.Logger, opts ...ProcessorOpt) Processor {
+	p := &processor{decoder: decoder, msgExecCtxFactory: msgExecCtxFactory, dispatcher: msgDispatcher, logger: logger}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
 }
 
 func (p *processor) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
-	payload, err := p.decoder.Unmarshal(inPkg.Payload())
+	if p.validateOnly != nil && p.validateOnly.Enabled(inPkg.Origin()) {
+		p.validate(inPkg)
+		return nil
+	}
+
+	// a signature covers the payload as it was published, i.e. encrypted
+	signedPkg := inPkg
+
+	if p.cipher != nil {
+		decrypted, err := decryptPkg(p.cipher, inPkg)
+		if err != nil {
+			p.logger.Logf(log.ErrorLevel, "Failed to decrypt IncomingPkg %s. %s", inPkg.UID(), err)
+			return err
+		}
+
+		inPkg = decrypted
+	}
+
+	payload, err := unmarshalPkg(p.decoder, inPkg)
 	if err != nil {
 		p.logger.Logf(log.ErrorLevel, "Failed to decode IncomingPkg into Message. %s", err)
 		return errors.Wrap(err, "unmarshalling pkg payload")
@@ -50,6 +167,28 @@ func (p *processor) Process(ctx context.Context, inPkg transport.IncomingPkg) er
 
 	receivedMsg := message.NewReceivedMessage(inPkg.UID(), payload, inPkg.Headers(), time.Now(), inPkg.Origin())
 
+	if p.verifier != nil {
+		if err := p.verifier.Verify(payload.GroupKind(), signedPkg.Payload(), receivedMsg.Headers()); err != nil {
+			return p.quarantineMsg(ctx, receivedMsg, err)
+		}
+	}
+
+	var dedupKey string
+
+	if p.deduplication != nil {
+		dedupKey = p.deduplication.key(receivedMsg)
+
+		processed, err := p.deduplication.deduplicator.Processed(ctx, dedupKey)
+		if err != nil {
+			return errors.Wrapf(err, "checking whether message %s is processed", receivedMsg.UID())
+		}
+
+		if processed {
+			p.logger.Logf(log.DebugLevel, "Message %s %s from %s is already processed, skipping it", receivedMsg.UID(), payload.GroupKind(), receivedMsg.Origin())
+			return nil
+		}
+	}
+
 	executors := p.dispatcher.Match(payload)
 
 	if len(executors) == 0 {
@@ -62,17 +201,176 @@ func (p *processor) Process(ctx context.Context, inPkg transport.IncomingPkg) er
 		ctx = context.WithValue(ctx, ContextTraceIDKey, traceID)
 	}
 
-	execCtx := p.msgExecCtxFactory.CreateCtx(ctx, receivedMsg)
+	for i, exec := range executors {
+		execMsg := receivedMsg
+
+		// executors must not see changes made to the message by previous ones. Each of them gets own copy of headers,
+		// the first one gets already decoded payload, others get freshly unmarshalled one.
+		if !p.sharedPayload && len(executors) > 1 {
+			execPayload := payload
+
+			if i > 0 {
+				if execPayload, err = unmarshalPkg(p.decoder, inPkg); err != nil {
+					return errors.Wrapf(err, "unmarshalling pkg payload for executor %d of message %s", i, receivedMsg.UID())
+				}
+			}
+
+			execMsg = message.NewReceivedMessage(receivedMsg.UID(), execPayload, copyHeaders(receivedMsg.Headers()), receivedMsg.ReceivedAt(), receivedMsg.Origin())
+		}
+
+		execCtx := p.msgExecCtxFactory.CreateCtx(ctx, execMsg)
 
-	for _, exec := range executors {
 		if err := exec(execCtx); err != nil {
-			return errors.Wrapf(err, "error executing message %s %s", receivedMsg.UID(), payload.GroupKind())
+			handler := msgDispatcher.FailedExecutor(exec, err)
+			err = errors.Wrapf(err, "error executing message %s %s", receivedMsg.UID(), payload.GroupKind())
+
+			retryPolicy := p.msgRetryPolicies.policy(payload)
+			if retryPolicy == nil {
+				retryPolicy = p.retryPolicy
+			}
+
+			if retryPolicy == nil {
+				return err
+			}
+
+			if retryErr := retryPolicy.handleFailure(ctx, receivedMsg, handler, err, p.logger); retryErr != nil {
+				return errors.Wrapf(err, "retry policy failed: %s", retryErr)
+			}
+
+			return nil
+		}
+	}
+
+	if p.deduplication != nil {
+		if err := p.deduplication.deduplicator.MarkProcessed(ctx, dedupKey, p.deduplication.ttl); err != nil {
+			p.logger.Logf(log.ErrorLevel, "Failed to mark message %s as processed, its redelivery will be processed again. %s", receivedMsg.UID(), err)
 		}
 	}
 
+	if p.slaTracker != nil {
+		p.slaTracker.Observe(receivedMsg, time.Now())
+	}
+
 	return nil
 }
 
+// validate runs a message through the same steps as Process up to dispatching and records the result instead of handling it.
+// A message failing signature verification isn't quarantined, only counted.
+func (p *processor) validate(inPkg transport.IncomingPkg) {
+	signedPkg := inPkg
+
+	if p.cipher != nil {
+		decrypted, err := decryptPkg(p.cipher, inPkg)
+		if err != nil {
+			p.logger.Logf(log.WarnLevel, "validate-only: failed to decrypt message %s from %s. %s", inPkg.UID(), inPkg.Origin(), err)
+			p.validateOnly.recordFailed(scheme.GroupKind{})
+			return
+		}
+
+		inPkg = decrypted
+	}
+
+	payload, err := unmarshalPkg(p.decoder, inPkg)
+	if err != nil {
+		p.logger.Logf(log.WarnLevel, "validate-only: failed to decode message %s from %s. %s", inPkg.UID(), inPkg.Origin(), err)
+		p.validateOnly.recordFailed(scheme.GroupKind{})
+		return
+	}
+
+	if inPkg.UID() == "" {
+		p.logger.Logf(log.WarnLevel, "validate-only: message %s from %s has no uid header", payload.GroupKind(), inPkg.Origin())
+		p.validateOnly.recordFailed(payload.GroupKind())
+		return
+	}
+
+	receivedMsg := message.NewReceivedMessage(inPkg.UID(), payload, inPkg.Headers(), time.Now(), inPkg.Origin())
+
+	if p.verifier != nil {
+		if err := p.verifier.Verify(payload.GroupKind(), signedPkg.Payload(), receivedMsg.Headers()); err != nil {
+			p.logger.Logf(log.WarnLevel, "validate-only: message %s %s from %s failed signature verification. %s", receivedMsg.UID(), payload.GroupKind(), inPkg.Origin(), err)
+			p.validateOnly.recordFailed(payload.GroupKind())
+			return
+		}
+	}
+
+	executors := p.dispatcher.Match(payload)
+
+	if len(executors) == 0 {
+		p.logger.Logf(log.WarnLevel, "validate-only: no executors defined for message uid %s %s", receivedMsg.UID(), payload.GroupKind())
+		p.validateOnly.recordFailed(payload.GroupKind())
+		return
+	}
+
+	p.validateOnly.recordValidated(payload.GroupKind(), len(executors))
+
+	if p.slaTracker != nil {
+		p.slaTracker.Observe(receivedMsg, time.Now())
+	}
+}
+
+// quarantineMsg sends a message which failed signature verification into quarantine endpoint and logs an audit record of it
+func (p *processor) quarantineMsg(ctx context.Context, receivedMsg *message.ReceivedMessage, verificationErr error) error {
+	keyID, _ := receivedMsg.Headers()[signing.KeyIDHeader].(string)
+
+	p.logger.Logf(
+		log.ErrorLevel,
+		"audit: message %s %s from %s failed signature verification (key '%s'), quarantining it. %s",
+		receivedMsg.UID(),
+		receivedMsg.Payload().GroupKind(),
+		receivedMsg.Origin(),
+		keyID,
+		verificationErr,
+	)
+
+	outcomingMsg := message.FromReceivedMsg(receivedMsg)
+	outcomingMsg.Headers()[FailureReasonHeader] = verificationErr.Error()
+	outcomingMsg.Headers()[FailureOriginHeader] = receivedMsg.Origin()
+	outcomingMsg.Headers()[FailedAtHeader] = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := p.quarantine.Send(ctx, outcomingMsg); err != nil {
+		return errors.Wrapf(err, "sending message %s to quarantine endpoint %s", receivedMsg.UID(), p.quarantine.Name())
+	}
+
+	return nil
+}
+
+// unmarshalPkg decodes the payload of a package, a marshaller negotiating content type gets the value of message.ContentTypeHeader
+func unmarshalPkg(decoder message.Marshaller, inPkg transport.IncomingPkg) (message.Object, error) {
+	if _, negotiates := decoder.(message.ContentTypeUnmarshaller); !negotiates {
+		return decoder.Unmarshal(inPkg.Payload())
+	}
+
+	return message.UnmarshalWithContentType(decoder, inPkg.Payload(), message.Headers(inPkg.Headers()).ContentType())
+}
+
+// decryptedPkg is a received package with decrypted payload
+type decryptedPkg struct {
+	transport.IncomingPkg
+	payload []byte
+}
+
+func (p decryptedPkg) Payload() []byte {
+	return p.payload
+}
+
+func decryptPkg(cipher message.Cipher, inPkg transport.IncomingPkg) (transport.IncomingPkg, error) {
+	payload, err := cipher.Decrypt(inPkg.Payload(), inPkg.Headers())
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting payload of pkg %s", inPkg.UID())
+	}
+
+	return decryptedPkg{IncomingPkg: inPkg, payload: payload}, nil
+}
+
+func copyHeaders(headers message.Headers) message.Headers {
+	res := make(message.Headers, len(headers))
+	for k, v := range headers {
+		res[k] = v
+	}
+
+	return res
+}
+
 type NoExecutorsDefinedErr struct {
 	error
 }
@@ -2,8 +2,10 @@ package subscriber
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -12,14 +14,19 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/pubsub/sla"
 	mockTransport "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
 
 	"github.com/go-foreman/foreman/testing/log"
 	mockDispatcher "github.com/go-foreman/foreman/testing/mocks/pubsub/dispatcher"
+	mockEndpoint "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
 
 	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	mockSubscriber "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
 	"github.com/golang/mock/gomock"
 )
 
@@ -28,6 +35,15 @@ type someTest struct {
 	Data string `json:"data"`
 }
 
+type contentTypedMarshaller struct {
+	message.Marshaller
+	contentType string
+}
+
+func (m contentTypedMarshaller) ContentType() string {
+	return m.contentType
+}
+
 func TestProcessor(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -73,6 +89,55 @@ func TestProcessor(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("processed pkg is reported to sla tracker", func(t *testing.T) {
+		tracker := sla.NewTracker().Register(data.GroupKind(), time.Second)
+		trackingProcessor := NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithSLATracker(tracker))
+
+		headers := message.Headers{"traceId": "123", "uid": "1234"}
+		headers.SetPublishedAt(time.Now().Add(-time.Minute))
+
+		incomingPkg := mockTransport.NewMockIncomingPkg(ctrl)
+		incomingPkg.EXPECT().Payload().Return(payload)
+		incomingPkg.EXPECT().UID().Return("123").Times(2)
+		incomingPkg.EXPECT().Origin().Return("mb_topic")
+		incomingPkg.EXPECT().Headers().Return(headers)
+
+		marshaller.
+			EXPECT().
+			Unmarshal(payload).
+			Return(data, nil)
+
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{niceExecutor})
+
+		require.NoError(t, trackingProcessor.Process(ctx, incomingPkg))
+		assert.Equal(t, uint64(1), tracker.Stats(data.GroupKind()).Breaches)
+	})
+
+	t.Run("payload is decoded by its content type", func(t *testing.T) {
+		protobufMarshaller := mockMessage.NewMockMarshaller(ctrl)
+		negotiatingProcessor := NewMessageProcessor(
+			message.NewNegotiatingMarshaller(contentTypedMarshaller{Marshaller: protobufMarshaller, contentType: message.ProtobufContentType}, marshaller),
+			execCtxFactory,
+			dispatcher,
+			testLogger,
+		)
+
+		incomingPkg := mockTransport.NewMockIncomingPkg(ctrl)
+		incomingPkg.EXPECT().Payload().Return(payload)
+		incomingPkg.EXPECT().UID().Return("123").Times(2)
+		incomingPkg.EXPECT().Origin().Return("mb_topic")
+		incomingPkg.EXPECT().Headers().Return(message.Headers{"uid": "123", "traceId": "123", message.ContentTypeHeader: message.JsonContentType}).Times(2)
+
+		marshaller.
+			EXPECT().
+			Unmarshal(payload).
+			Return(data, nil)
+
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{niceExecutor})
+
+		require.NoError(t, negotiatingProcessor.Process(ctx, incomingPkg))
+	})
+
 	t.Run("error unmarshalling payload", func(t *testing.T) {
 		incomingPkg := mockTransport.NewMockIncomingPkg(ctrl)
 		incomingPkg.EXPECT().Payload().Return(payload)
@@ -140,6 +205,315 @@ func TestProcessor(t *testing.T) {
 	})
 }
 
+func TestProcessorValidateOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+
+	validateOnly := NewValidateOnly("standby")
+	pkgProcessor := NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithValidateOnly(validateOnly))
+
+	data := &someTest{
+		Data: "111",
+		ObjectMeta: message.ObjectMeta{
+			TypeMeta: scheme.TypeMeta{
+				Kind:  "someTest",
+				Group: "testGroup",
+			},
+		},
+	}
+	payload, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	newPkg := func(origin string) *mockTransport.MockIncomingPkg {
+		incomingPkg := mockTransport.NewMockIncomingPkg(ctrl)
+		incomingPkg.EXPECT().Payload().Return(payload).AnyTimes()
+		incomingPkg.EXPECT().UID().Return("123").AnyTimes()
+		incomingPkg.EXPECT().Origin().Return(origin).AnyTimes()
+		incomingPkg.EXPECT().Headers().Return(message.Headers{"uid": "123"}).AnyTimes()
+
+		return incomingPkg
+	}
+
+	executed := 0
+	countingExecutor := func(execCtx execution.MessageExecutionCtx) error {
+		executed++
+		return nil
+	}
+
+	t.Run("executors aren't called for a queue in validate-only mode", func(t *testing.T) {
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{countingExecutor, countingExecutor})
+
+		require.NoError(t, pkgProcessor.Process(context.Background(), newPkg("standby")))
+		assert.Equal(t, 0, executed)
+		assert.Equal(t, ValidationStats{Validated: 1, Executors: 2}, validateOnly.Stats(data.GroupKind()))
+	})
+
+	t.Run("invalid messages are acked and counted", func(t *testing.T) {
+		marshaller.EXPECT().Unmarshal(payload).Return(nil, errors.New("unknown type"))
+		require.NoError(t, pkgProcessor.Process(context.Background(), newPkg("standby")))
+
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return(nil)
+		require.NoError(t, pkgProcessor.Process(context.Background(), newPkg("standby")))
+
+		report := validateOnly.Report()
+		assert.Equal(t, uint64(1), report.Undecoded)
+		assert.Equal(t, ValidationStats{Validated: 1, Executors: 2, Failed: 1}, report.Types["testGroup.someTest"])
+	})
+
+	t.Run("other queues are handled", func(t *testing.T) {
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{countingExecutor})
+
+		require.NoError(t, pkgProcessor.Process(context.Background(), newPkg("active")))
+		assert.Equal(t, 1, executed)
+	})
+
+	t.Run("queue switched out of validate-only mode is handled", func(t *testing.T) {
+		validateOnly.Disable("standby")
+		defer validateOnly.Enable("standby")
+
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{countingExecutor})
+
+		require.NoError(t, pkgProcessor.Process(context.Background(), newPkg("standby")))
+		assert.Equal(t, 2, executed)
+		assert.Equal(t, uint64(1), validateOnly.Stats(data.GroupKind()).Validated)
+	})
+}
+
+func TestProcessorSignatureVerification(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	quarantine := mockEndpoint.NewMockEndpoint(ctrl)
+	quarantine.EXPECT().Name().Return("quarantine").AnyTimes()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	data := &someTest{Data: "111", ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "someTest", Group: "testGroup"}}}
+	verifier := signing.NewVerifier(map[string]ed25519.PublicKey{"key-1": publicKey}, signing.WithRequiredFor(data.GroupKind()))
+	pkgProcessor := NewMessageProcessor(marshaller, execution.NewMessageExecutionCtxFactory(nil, testLogger), dispatcher, testLogger, WithSignatureVerification(verifier, quarantine))
+	ctx := context.Background()
+
+	incomingPkg := func(body []byte, headers message.Headers) *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return(body).AnyTimes()
+		pkg.EXPECT().UID().Return("123").AnyTimes()
+		pkg.EXPECT().Origin().Return("mb_topic").AnyTimes()
+		pkg.EXPECT().Headers().Return(headers).AnyTimes()
+		marshaller.EXPECT().Unmarshal(body).Return(data, nil)
+
+		return pkg
+	}
+
+	t.Run("signed message is dispatched", func(t *testing.T) {
+		headers := message.Headers{"uid": "123", "traceId": "123"}
+		signing.NewSigner("key-1", privateKey).Sign([]byte("body"), headers)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{niceExecutor})
+
+		assert.NoError(t, pkgProcessor.Process(ctx, incomingPkg([]byte("body"), headers)))
+	})
+
+	t.Run("tampered message is quarantined", func(t *testing.T) {
+		headers := message.Headers{"uid": "123"}
+		signing.NewSigner("key-1", privateKey).Sign([]byte("body"), headers)
+
+		quarantine.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, "123", msg.UID())
+				assert.Equal(t, "signature made with key 'key-1' doesn't match the message", msg.Headers()[FailureReasonHeader])
+				assert.Equal(t, "mb_topic", msg.Headers()[FailureOriginHeader])
+				return nil
+			})
+
+		assert.NoError(t, pkgProcessor.Process(ctx, incomingPkg([]byte("forged body"), headers)))
+	})
+
+	t.Run("unsigned message fails if quarantine is unavailable", func(t *testing.T) {
+		quarantine.EXPECT().Send(ctx, gomock.Any()).Return(errors.New("broker is down"))
+
+		err := pkgProcessor.Process(ctx, incomingPkg([]byte("body"), message.Headers{"uid": "123"}))
+		assert.EqualError(t, err, "sending message 123 to quarantine endpoint quarantine: broker is down")
+	})
+}
+
+func TestProcessorCipher(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	cipher, err := message.NewAESCipher("key-1", map[string][]byte{"key-1": make([]byte, 32)})
+	require.NoError(t, err)
+
+	data := &someTest{Data: "111", ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "someTest", Group: "testGroup"}}}
+	verifier := signing.NewVerifier(map[string]ed25519.PublicKey{"key-1": publicKey})
+	pkgProcessor := NewMessageProcessor(marshaller, execution.NewMessageExecutionCtxFactory(nil, testLogger), dispatcher, testLogger, WithCipher(cipher), WithSignatureVerification(verifier, nil))
+	ctx := context.Background()
+
+	incomingPkg := func(body []byte, headers message.Headers) *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return(body).AnyTimes()
+		pkg.EXPECT().UID().Return("123").AnyTimes()
+		pkg.EXPECT().Origin().Return("mb_topic").AnyTimes()
+		pkg.EXPECT().Headers().Return(headers).AnyTimes()
+
+		return pkg
+	}
+
+	t.Run("encrypted and signed message is decrypted before it's unmarshalled", func(t *testing.T) {
+		headers := message.Headers{"uid": "123", "traceId": "123"}
+		encrypted, err := cipher.Encrypt([]byte("body"), headers)
+		require.NoError(t, err)
+		signing.NewSigner("key-1", privateKey).Sign(encrypted, headers)
+
+		marshaller.EXPECT().Unmarshal([]byte("body")).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{niceExecutor})
+
+		assert.NoError(t, pkgProcessor.Process(ctx, incomingPkg(encrypted, headers)))
+	})
+
+	t.Run("message which can't be decrypted isn't handled", func(t *testing.T) {
+		err := pkgProcessor.Process(ctx, incomingPkg([]byte("body"), message.Headers{"uid": "123"}))
+		assert.EqualError(t, err, "decrypting payload of pkg 123: payload isn't encrypted")
+		assert.IsType(t, message.CipherErr{}, errors.Cause(err))
+	})
+}
+
+func TestProcessorDeduplication(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	deduplicator := mockSubscriber.NewMockDeduplicator(ctrl)
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+	pkgProcessor := NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithDeduplication(deduplicator, WithIdempotencyKeyHeader("idempotencyKey"), WithDeduplicationTTL(time.Hour)))
+
+	data := &someTest{Data: "111", ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "someTest", Group: "testGroup"}}}
+	ctx := context.Background()
+
+	incomingPkg := func(headers message.Headers) *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return([]byte("body")).AnyTimes()
+		pkg.EXPECT().UID().Return("123").AnyTimes()
+		pkg.EXPECT().Origin().Return("mb_topic").AnyTimes()
+		pkg.EXPECT().Headers().Return(headers).AnyTimes()
+		marshaller.EXPECT().Unmarshal([]byte("body")).Return(data, nil)
+
+		return pkg
+	}
+
+	t.Run("processed message is remembered", func(t *testing.T) {
+		deduplicator.EXPECT().Processed(ctx, "mb_topic:123").Return(false, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{niceExecutor})
+		deduplicator.EXPECT().MarkProcessed(gomock.Any(), "mb_topic:123", time.Hour).Return(nil)
+
+		assert.NoError(t, pkgProcessor.Process(ctx, incomingPkg(message.Headers{"uid": "123", "traceId": "123"})))
+	})
+
+	t.Run("redelivered message is skipped", func(t *testing.T) {
+		deduplicator.EXPECT().Processed(ctx, "mb_topic:order-1").Return(true, nil)
+
+		assert.NoError(t, pkgProcessor.Process(ctx, incomingPkg(message.Headers{"uid": "123", "idempotencyKey": "order-1"})))
+	})
+
+	t.Run("failed message isn't remembered", func(t *testing.T) {
+		deduplicator.EXPECT().Processed(ctx, "mb_topic:123").Return(false, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{executorWithError})
+
+		assert.Error(t, pkgProcessor.Process(ctx, incomingPkg(message.Headers{"uid": "123"})))
+	})
+
+	t.Run("deduplicator is unavailable", func(t *testing.T) {
+		deduplicator.EXPECT().Processed(ctx, "mb_topic:123").Return(false, errors.New("connection lost"))
+
+		err := pkgProcessor.Process(ctx, incomingPkg(message.Headers{"uid": "123"}))
+		assert.EqualError(t, err, "checking whether message 123 is processed: connection lost")
+	})
+}
+
+func TestProcessorIsolatesExecutors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	knownTypes := scheme.NewKnownTypesRegistry()
+	knownTypes.AddKnownTypes(scheme.Group("testGroup"), &someTest{})
+	marshaller := message.NewJsonMarshaller(knownTypes)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+
+	payload, err := marshaller.Marshal(&someTest{Data: "original"})
+	require.NoError(t, err)
+
+	mutatingExecutor := func(execCtx execution.MessageExecutionCtx) error {
+		execCtx.Message().Payload().(*someTest).Data = "mutated"
+		execCtx.Message().Headers()["sagaUID"] = "mutated"
+		return nil
+	}
+
+	incomingPkg := func() *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return(payload).AnyTimes()
+		pkg.EXPECT().UID().Return("123").Times(2)
+		pkg.EXPECT().Origin().Return("mb_topic")
+		pkg.EXPECT().Headers().Return(message.Headers{"uid": "123"})
+		return pkg
+	}
+
+	t.Run("second executor doesn't see changes of the first one", func(t *testing.T) {
+		var seen []string
+
+		dispatcher.EXPECT().Match(gomock.Any()).Return([]execution.Executor{
+			mutatingExecutor,
+			func(execCtx execution.MessageExecutionCtx) error {
+				seen = append(seen, execCtx.Message().Payload().(*someTest).Data)
+				_, exists := execCtx.Message().Headers()["sagaUID"]
+				assert.False(t, exists)
+				return nil
+			},
+		})
+
+		require.NoError(t, NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger).Process(context.Background(), incomingPkg()))
+		assert.Equal(t, []string{"original"}, seen)
+	})
+
+	t.Run("shared payload", func(t *testing.T) {
+		var seen []string
+
+		dispatcher.EXPECT().Match(gomock.Any()).Return([]execution.Executor{
+			mutatingExecutor,
+			func(execCtx execution.MessageExecutionCtx) error {
+				seen = append(seen, execCtx.Message().Payload().(*someTest).Data)
+				return nil
+			},
+		})
+
+		require.NoError(t, NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithSharedPayload()).Process(context.Background(), incomingPkg()))
+		assert.Equal(t, []string{"mutated"}, seen)
+	})
+}
+
 // check ctx here instead of mocking MsgExecutionCtxFactory
 func niceExecutor(execCtx execution.MessageExecutionCtx) error {
 	traceIdVal := execCtx.Context().Value(ContextTraceIDKey)
@@ -0,0 +1,121 @@
+package subscriber
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+// RedriveTarget returns an endpoint a dead lettered message is sent back to
+type RedriveTarget func(msg *message.ReceivedMessage) (endpoint.Endpoint, error)
+
+// RedriveTo sends all dead lettered messages into the endpoint
+func RedriveTo(e endpoint.Endpoint) RedriveTarget {
+	return func(msg *message.ReceivedMessage) (endpoint.Endpoint, error) {
+		return e, nil
+	}
+}
+
+// RedriveToOrigins sends a dead lettered message into the endpoint of a queue it failed in, endpoints are keyed by the value
+// of FailureOriginHeader. A message from an unknown origin isn't redriven.
+func RedriveToOrigins(endpoints map[string]endpoint.Endpoint) RedriveTarget {
+	return func(msg *message.ReceivedMessage) (endpoint.Endpoint, error) {
+		origin, _ := msg.Headers()[FailureOriginHeader].(string)
+
+		e, exists := endpoints[origin]
+		if !exists {
+			return nil, errors.Errorf("no endpoint to redrive message %s failed in '%s'", msg.UID(), origin)
+		}
+
+		return e, nil
+	}
+}
+
+// Redriver sends dead lettered messages back for processing: failure headers are removed, attempts are reset and message.RedrivenHeader
+// is incremented. It's a Processor, run it with a subscriber consuming the dead letter queue once the cause of failures is fixed,
+// messages are acked after they are sent. Redrive can also be called directly for a message read from the queue some other way.
+type Redriver struct {
+	decoder message.Marshaller
+	target  RedriveTarget
+	logger  log.Logger
+	cipher  message.Cipher
+}
+
+// RedriverOpt configures Redriver
+type RedriverOpt func(r *Redriver)
+
+// WithRedriveCipher decrypts payloads of dead lettered messages, endpoints of the target encrypt them again
+func WithRedriveCipher(cipher message.Cipher) RedriverOpt {
+	return func(r *Redriver) {
+		r.cipher = cipher
+	}
+}
+
+// NewRedriver creates Redriver
+func NewRedriver(decoder message.Marshaller, target RedriveTarget, logger log.Logger, opts ...RedriverOpt) *Redriver {
+	r := &Redriver{decoder: decoder, target: target, logger: logger}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Process decodes a package received from a dead letter queue and redrives it
+func (r *Redriver) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
+	if r.cipher != nil {
+		decrypted, err := decryptPkg(r.cipher, inPkg)
+		if err != nil {
+			return errors.Wrap(err, "decrypting dead lettered message")
+		}
+
+		inPkg = decrypted
+	}
+
+	payload, err := unmarshalPkg(r.decoder, inPkg)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshalling dead lettered message %s", inPkg.UID())
+	}
+
+	return r.Redrive(ctx, message.NewReceivedMessage(inPkg.UID(), payload, inPkg.Headers(), time.Now(), inPkg.Origin()))
+}
+
+// Redrive sends the dead lettered message to its target
+func (r *Redriver) Redrive(ctx context.Context, deadLettered *message.ReceivedMessage) error {
+	target, err := r.target(deadLettered)
+	if err != nil {
+		return errors.Wrap(err, "resolving redrive target")
+	}
+
+	outcomingMsg := message.FromReceivedMsg(deadLettered)
+	reason := ResetFailure(outcomingMsg.Headers())
+
+	if err := target.Send(ctx, outcomingMsg); err != nil {
+		return errors.Wrapf(err, "redriving message %s to endpoint %s", deadLettered.UID(), target.Name())
+	}
+
+	r.logger.Logf(log.InfoLevel, "redrove dead lettered message %s %s to endpoint %s, it failed with: %v", deadLettered.UID(), deadLettered.Payload().GroupKind(), target.Name(), reason)
+
+	return nil
+}
+
+// ResetFailure prepares headers of a dead lettered message to be sent back for processing: failure headers and attempts are removed
+// and message.RedrivenHeader is incremented. The failure reason is returned. Tools moving raw packages out of a dead letter queue use it as Redriver does.
+func ResetFailure(headers message.Headers) interface{} {
+	reason := headers[FailureReasonHeader]
+
+	for _, header := range []string{FailureReasonHeader, FailureOriginHeader, FailedAtHeader, FailureStackHeader, FailedHandlerHeader} {
+		delete(headers, header)
+	}
+
+	delete(headers, message.AttemptsHeader)
+	headers.SetRedriven(headers.Redriven() + 1)
+
+	return reason
+}
@@ -0,0 +1,102 @@
+package subscriber
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	mockEndpoint "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	mockTransport "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedriver(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	ordersEndpoint := mockEndpoint.NewMockEndpoint(ctrl)
+	ordersEndpoint.EXPECT().Name().Return("orders").AnyTimes()
+
+	redriver := NewRedriver(marshaller, RedriveToOrigins(map[string]endpoint.Endpoint{"orders_queue": ordersEndpoint}), log.NewNilLogger())
+
+	data := &someTest{Data: "111", ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "someTest", Group: "testGroup"}}}
+
+	deadLetteredPkg := func(headers message.Headers) *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return([]byte("payload"))
+		pkg.EXPECT().UID().Return("123").AnyTimes()
+		pkg.EXPECT().Origin().Return("dead_letter_queue")
+		pkg.EXPECT().Headers().Return(headers)
+		marshaller.EXPECT().Unmarshal([]byte("payload")).Return(data, nil)
+
+		return pkg
+	}
+
+	t.Run("message is sent back to its origin without failure headers", func(t *testing.T) {
+		headers := message.Headers{
+			"uid":                  "123",
+			"traceId":              "xxx",
+			message.AttemptsHeader: int64(3),
+			FailureReasonHeader:    "always return an error",
+			FailureOriginHeader:    "orders_queue",
+			FailedAtHeader:         int64(1000),
+			FailureStackHeader:     "always return an error\nmain.handle",
+			FailedHandlerHeader:    "main.handle",
+		}
+
+		ordersEndpoint.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, "123", msg.UID())
+				assert.Same(t, data, msg.Payload())
+				assert.Equal(t, message.Headers{"uid": "123", "traceId": "xxx", message.RedrivenHeader: int64(1)}, msg.Headers())
+				return nil
+			})
+
+		require.NoError(t, redriver.Process(ctx, deadLetteredPkg(headers)))
+		assert.Equal(t, "orders_queue", headers[FailureOriginHeader], "headers of the received message must stay untouched")
+	})
+
+	t.Run("redriven counter is incremented", func(t *testing.T) {
+		ordersEndpoint.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, 3, msg.Headers().Redriven())
+				return nil
+			})
+
+		require.NoError(t, redriver.Process(ctx, deadLetteredPkg(message.Headers{FailureOriginHeader: "orders_queue", message.RedrivenHeader: int64(2)})))
+	})
+
+	t.Run("message from unknown origin", func(t *testing.T) {
+		err := redriver.Process(ctx, deadLetteredPkg(message.Headers{FailureOriginHeader: "payments_queue"}))
+		assert.EqualError(t, err, "resolving redrive target: no endpoint to redrive message 123 failed in 'payments_queue'")
+	})
+
+	t.Run("error sending message", func(t *testing.T) {
+		ordersEndpoint.EXPECT().Send(ctx, gomock.Any()).Return(errors.New("broker is down"))
+
+		err := redriver.Process(ctx, deadLetteredPkg(message.Headers{FailureOriginHeader: "orders_queue"}))
+		assert.EqualError(t, err, "redriving message 123 to endpoint orders: broker is down")
+	})
+
+	t.Run("undecodable message", func(t *testing.T) {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return([]byte("garbage"))
+		pkg.EXPECT().UID().Return("123")
+		marshaller.EXPECT().Unmarshal([]byte("garbage")).Return(nil, errors.New("invalid character"))
+
+		assert.EqualError(t, redriver.Process(ctx, pkg), "unmarshalling dead lettered message 123: invalid character")
+	})
+}
@@ -0,0 +1,200 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	pubsubErrors "github.com/go-foreman/foreman/pubsub/errors"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FailureReasonHeader contains an error of the last failed attempt of a dead lettered message
+	FailureReasonHeader = "failureReason"
+	// FailureOriginHeader contains an origin (queue) the dead lettered message was received from
+	FailureOriginHeader = "failureOrigin"
+	// FailedAtHeader contains unix time in milliseconds of the last failed attempt of a dead lettered message
+	FailedAtHeader = "failedAt"
+	// FailureStackHeader contains the error of the last failed attempt with a stack trace, if the error has one
+	FailureStackHeader = "failureStack"
+	// FailedHandlerHeader contains a name of the executor which failed to handle a dead lettered message
+	FailedHandlerHeader = "failedHandler"
+
+	// maxFailureStackSize limits the stack header, brokers restrict a size of headers
+	maxFailureStackSize = 8 << 10
+)
+
+// RetryPolicy limits a number of attempts to process a message. A failed message is republished into retry endpoint
+// with incremented message.AttemptsHeader, after the last attempt it's published into dead letter endpoint with
+// failure details in headers. In both cases the received message is acked. Attempts aren't waited for in the consumer,
+// the delay of the next attempt is a delivery delay of the retry endpoint.
+type RetryPolicy struct {
+	maxAttempts        int
+	retryEndpoint      endpoint.Endpoint
+	deadLetterEndpoint endpoint.Endpoint
+	initialBackoff     time.Duration
+	maxBackoff         time.Duration
+	jitter             float64
+	retryable          func(err error) bool
+}
+
+// RetryOpt configures RetryPolicy
+type RetryOpt func(p *RetryPolicy)
+
+// WithBackoff delays every next attempt exponentially starting from initial delay up to max.
+// Retry endpoint must support endpoint.WithDelay option.
+func WithBackoff(initial, max time.Duration) RetryOpt {
+	return func(p *RetryPolicy) {
+		p.initialBackoff = initial
+		p.maxBackoff = max
+	}
+}
+
+// WithJitter shortens the delay of every attempt by a random part of it up to fraction (0..1), so messages failed
+// at the same time, e.g. by an outage of a dependency, aren't retried all at once.
+func WithJitter(fraction float64) RetryOpt {
+	return func(p *RetryPolicy) {
+		if fraction < 0 {
+			fraction = 0
+		}
+
+		if fraction > 1 {
+			fraction = 1
+		}
+
+		p.jitter = fraction
+	}
+}
+
+// WithRetryable sets a predicate which tells whether an executor error is worth another attempt, a message failed
+// with other errors is dead lettered right away. By default all errors are retried except ones marked with
+// errors.WithTerminalErr, pass errors.IsRetryable to retry only errors marked with errors.WithRetryableErr.
+func WithRetryable(predicate func(err error) bool) RetryOpt {
+	return func(p *RetryPolicy) {
+		p.retryable = predicate
+	}
+}
+
+// NewRetryPolicy creates RetryPolicy. Retry endpoint usually delivers a message back into the queue it was consumed from,
+// dead letter endpoint may deliver into a dedicated queue or just log a message.
+func NewRetryPolicy(maxAttempts int, retryEndpoint, deadLetterEndpoint endpoint.Endpoint, opts ...RetryOpt) *RetryPolicy {
+	p := &RetryPolicy{
+		maxAttempts:        maxAttempts,
+		retryEndpoint:      retryEndpoint,
+		deadLetterEndpoint: deadLetterEndpoint,
+		retryable: func(err error) bool {
+			return !pubsubErrors.IsTerminal(err)
+		},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// Backoff returns a delay before the attempt, attempts are counted from 1
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.initialBackoff <= 0 || attempt <= 1 {
+		return 0
+	}
+
+	backoff := p.initialBackoff
+	for i := 2; i < attempt && (p.maxBackoff <= 0 || backoff < p.maxBackoff); i++ {
+		backoff *= 2
+	}
+
+	if p.maxBackoff > 0 && backoff > p.maxBackoff {
+		return p.maxBackoff
+	}
+
+	return backoff
+}
+
+// delay returns Backoff of the attempt shortened by jitter
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.Backoff(attempt)
+
+	if p.jitter <= 0 || backoff <= 0 {
+		return backoff
+	}
+
+	return backoff - time.Duration(rand.Float64()*p.jitter*float64(backoff))
+}
+
+// handleFailure either schedules next attempt or dead letters the message. Returned error means the message wasn't sent anywhere.
+func (p RetryPolicy) handleFailure(ctx context.Context, receivedMsg *message.ReceivedMessage, handler string, processingErr error, logger log.Logger) error {
+	outcomingMsg := message.FromReceivedMsg(receivedMsg)
+	attempts := receivedMsg.Headers().Attempts() + 1
+	outcomingMsg.Headers().SetAttempts(attempts)
+
+	retryable := p.retryable(processingErr)
+
+	if retryable && attempts < p.maxAttempts {
+		backoff := p.delay(attempts + 1)
+
+		var opts []endpoint.DeliveryOption
+		if backoff > 0 {
+			opts = append(opts, endpoint.WithDelay(backoff))
+		}
+
+		if err := p.retryEndpoint.Send(ctx, outcomingMsg, opts...); err != nil {
+			return errors.Wrapf(err, "sending message %s to retry endpoint %s", receivedMsg.UID(), p.retryEndpoint.Name())
+		}
+
+		logger.Logf(log.WarnLevel, "attempt %d of %d to process message %s failed, retrying in %s. %s", attempts, p.maxAttempts, receivedMsg.UID(), backoff, processingErr)
+
+		return nil
+	}
+
+	outcomingMsg.Headers()[FailureReasonHeader] = processingErr.Error()
+	outcomingMsg.Headers()[FailureOriginHeader] = receivedMsg.Origin()
+	outcomingMsg.Headers()[FailedAtHeader] = time.Now().UnixNano() / int64(time.Millisecond)
+	outcomingMsg.Headers()[FailureStackHeader] = failureStack(processingErr)
+
+	if handler != "" {
+		outcomingMsg.Headers()[FailedHandlerHeader] = handler
+	}
+
+	if err := p.deadLetterEndpoint.Send(ctx, outcomingMsg); err != nil {
+		return errors.Wrapf(err, "sending message %s to dead letter endpoint %s", receivedMsg.UID(), p.deadLetterEndpoint.Name())
+	}
+
+	if !retryable {
+		logger.Logf(log.ErrorLevel, "message %s failed with an error which isn't retried, sent it to dead letter endpoint %s. %s", receivedMsg.UID(), p.deadLetterEndpoint.Name(), processingErr)
+		return nil
+	}
+
+	logger.Logf(log.ErrorLevel, "message %s failed %d times, sent it to dead letter endpoint %s. %s", receivedMsg.UID(), attempts, p.deadLetterEndpoint.Name(), processingErr)
+
+	return nil
+}
+
+// messageRetryPolicies are retry policies of particular message types, they take precedence over the processor's one
+type messageRetryPolicies map[reflect.Type]*RetryPolicy
+
+func (m messageRetryPolicies) policy(payload message.Object) *RetryPolicy {
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m[scheme.GetStructType(payload)]
+}
+
+func failureStack(err error) string {
+	stack := fmt.Sprintf("%+v", err)
+
+	if len(stack) > maxFailureStackSize {
+		return stack[:maxFailureStackSize]
+	}
+
+	return stack
+}
@@ -0,0 +1,233 @@
+package subscriber
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	pubsubErrors "github.com/go-foreman/foreman/pubsub/errors"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	mockDispatcher "github.com/go-foreman/foreman/testing/mocks/pubsub/dispatcher"
+	mockEndpoint "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	mockTransport "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	t.Run("without backoff", func(t *testing.T) {
+		policy := NewRetryPolicy(3, nil, nil)
+		assert.Equal(t, time.Duration(0), policy.Backoff(2))
+	})
+
+	t.Run("exponential backoff", func(t *testing.T) {
+		policy := NewRetryPolicy(10, nil, nil, WithBackoff(time.Second, 10*time.Second))
+		assert.Equal(t, time.Duration(0), policy.Backoff(1))
+		assert.Equal(t, time.Second, policy.Backoff(2))
+		assert.Equal(t, 2*time.Second, policy.Backoff(3))
+		assert.Equal(t, 8*time.Second, policy.Backoff(5))
+		assert.Equal(t, 10*time.Second, policy.Backoff(6))
+		assert.Equal(t, 10*time.Second, policy.Backoff(100))
+	})
+
+	t.Run("jitter shortens the delay", func(t *testing.T) {
+		policy := NewRetryPolicy(10, nil, nil, WithBackoff(time.Second, 10*time.Second), WithJitter(0.5))
+		assert.Equal(t, 2*time.Second, policy.Backoff(3), "backoff itself stays exponential")
+
+		for i := 0; i < 100; i++ {
+			delay := policy.delay(3)
+			assert.True(t, delay > time.Second && delay <= 2*time.Second, "delay %s is out of bounds", delay)
+		}
+
+		assert.Equal(t, time.Duration(0), policy.delay(1))
+	})
+}
+
+func TestProcessorRetryPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	retryEndpoint := mockEndpoint.NewMockEndpoint(ctrl)
+	deadLetterEndpoint := mockEndpoint.NewMockEndpoint(ctrl)
+	retryEndpoint.EXPECT().Name().Return("retry").AnyTimes()
+	deadLetterEndpoint.EXPECT().Name().Return("dead_letter").AnyTimes()
+
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+	policy := NewRetryPolicy(3, retryEndpoint, deadLetterEndpoint, WithBackoff(time.Second, time.Minute))
+	pkgProcessor := NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithRetryPolicy(policy))
+
+	data := &someTest{
+		Data: "111",
+		ObjectMeta: message.ObjectMeta{
+			TypeMeta: scheme.TypeMeta{
+				Kind:  "someTest",
+				Group: "testGroup",
+			},
+		},
+	}
+	payload, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	incomingPkg := func(headers message.Headers) *mockTransport.MockIncomingPkg {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return(payload)
+		pkg.EXPECT().UID().Return("123").Times(2)
+		pkg.EXPECT().Origin().Return("mb_queue")
+		pkg.EXPECT().Headers().Return(headers)
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{executorWithError})
+
+		return pkg
+	}
+
+	t.Run("first failure is retried with a delay", func(t *testing.T) {
+		headers := message.Headers{"uid": "123", "traceId": "xxx"}
+
+		retryEndpoint.
+			EXPECT().
+			Send(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, "123", msg.UID())
+				assert.Same(t, data, msg.Payload())
+				assert.Equal(t, 1, msg.Headers().Attempts())
+				assert.Equal(t, "xxx", msg.Headers()["traceId"])
+				assert.Equal(t, time.Second, endpoint.DeliveryDelay(opts...))
+				return nil
+			})
+
+		require.NoError(t, pkgProcessor.Process(ctx, incomingPkg(headers)))
+		assert.Equal(t, 0, headers.Attempts(), "headers of the received message must stay untouched")
+	})
+
+	t.Run("message is dead lettered after the last attempt", func(t *testing.T) {
+		headers := message.Headers{"uid": "123", "traceId": "xxx", message.AttemptsHeader: int64(2)}
+
+		deadLetterEndpoint.
+			EXPECT().
+			Send(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, "123", msg.UID())
+				assert.Equal(t, 3, msg.Headers().Attempts())
+				assert.Equal(t, "xxx", msg.Headers()["traceId"])
+				assert.Equal(t, "error executing message 123 testGroup.someTest: always return an error", msg.Headers()[FailureReasonHeader])
+				assert.Equal(t, "mb_queue", msg.Headers()[FailureOriginHeader])
+				assert.NotEmpty(t, msg.Headers()[FailedAtHeader])
+				assert.Contains(t, msg.Headers()[FailureStackHeader], "always return an error")
+				assert.Equal(t, "github.com/go-foreman/foreman/pubsub/subscriber.executorWithError", msg.Headers()[FailedHandlerHeader])
+				return nil
+			})
+
+		require.NoError(t, pkgProcessor.Process(ctx, incomingPkg(headers)))
+	})
+
+	t.Run("error sending into dead letter endpoint", func(t *testing.T) {
+		headers := message.Headers{"uid": "123", message.AttemptsHeader: int64(5)}
+
+		deadLetterEndpoint.
+			EXPECT().
+			Send(gomock.Any(), gomock.Any()).
+			Return(errors.New("connection closed"))
+
+		err := pkgProcessor.Process(ctx, incomingPkg(headers))
+		assert.EqualError(t, err, "retry policy failed: sending message 123 to dead letter endpoint dead_letter: connection closed: error executing message 123 testGroup.someTest: always return an error")
+	})
+}
+
+func TestProcessorRetryableErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshaller := mockMessage.NewMockMarshaller(ctrl)
+	dispatcher := mockDispatcher.NewMockDispatcher(ctrl)
+	retryEndpoint := mockEndpoint.NewMockEndpoint(ctrl)
+	deadLetterEndpoint := mockEndpoint.NewMockEndpoint(ctrl)
+	retryEndpoint.EXPECT().Name().Return("retry").AnyTimes()
+	deadLetterEndpoint.EXPECT().Name().Return("dead_letter").AnyTimes()
+
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+
+	data := &someTest{
+		Data: "111",
+		ObjectMeta: message.ObjectMeta{
+			TypeMeta: scheme.TypeMeta{
+				Kind:  "someTest",
+				Group: "testGroup",
+			},
+		},
+	}
+	payload, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	process := func(pkgProcessor Processor, executorErr error) error {
+		pkg := mockTransport.NewMockIncomingPkg(ctrl)
+		pkg.EXPECT().Payload().Return(payload)
+		pkg.EXPECT().UID().Return("123").Times(2)
+		pkg.EXPECT().Origin().Return("mb_queue")
+		pkg.EXPECT().Headers().Return(message.Headers{"uid": "123"})
+		marshaller.EXPECT().Unmarshal(payload).Return(data, nil)
+		dispatcher.EXPECT().Match(data).Return([]execution.Executor{func(execCtx execution.MessageExecutionCtx) error {
+			return executorErr
+		}})
+
+		return pkgProcessor.Process(ctx, pkg)
+	}
+
+	expectDeadLettered := func() {
+		deadLetterEndpoint.
+			EXPECT().
+			Send(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, 1, msg.Headers().Attempts())
+				return nil
+			})
+	}
+
+	t.Run("terminal error is dead lettered right away", func(t *testing.T) {
+		policy := NewRetryPolicy(3, retryEndpoint, deadLetterEndpoint)
+		expectDeadLettered()
+
+		require.NoError(t, process(NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithRetryPolicy(policy)), pubsubErrors.WithTerminalErr(errors.New("invalid amount"))))
+	})
+
+	t.Run("only retryable errors are retried", func(t *testing.T) {
+		policy := NewRetryPolicy(3, retryEndpoint, deadLetterEndpoint, WithRetryable(pubsubErrors.IsRetryable))
+		pkgProcessor := NewMessageProcessor(marshaller, execCtxFactory, dispatcher, testLogger, WithRetryPolicy(policy))
+
+		retryEndpoint.EXPECT().Send(gomock.Any(), gomock.Any()).Return(nil)
+		require.NoError(t, process(pkgProcessor, pubsubErrors.WithRetryableErr(errors.New("timeout"))))
+
+		expectDeadLettered()
+		require.NoError(t, process(pkgProcessor, errors.New("unknown error")))
+	})
+
+	t.Run("policy of a message type", func(t *testing.T) {
+		messagePolicy := NewRetryPolicy(1, retryEndpoint, deadLetterEndpoint)
+		pkgProcessor := NewMessageProcessor(
+			marshaller,
+			execCtxFactory,
+			dispatcher,
+			testLogger,
+			WithRetryPolicy(NewRetryPolicy(3, retryEndpoint, deadLetterEndpoint)),
+			WithMessageRetryPolicy(messagePolicy, &someTest{}),
+		)
+
+		expectDeadLettered()
+		require.NoError(t, process(pkgProcessor, errors.New("always return an error")))
+	})
+}
@@ -3,6 +3,7 @@ package subscriber
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"context"
@@ -20,6 +21,19 @@ import (
 type Subscriber interface {
 	// Run listens queues for packages and processes them. Gracefully shuts down either on os.Signal or ctx.Done()
 	Run(ctx context.Context, queues ...transport.Queue) error
+	// Shutdown stops fetching packages and waits until packages in progress are processed and acked or ctx is done.
+	// Packages still in progress then are nacked for redelivery and ShutdownErr is returned. The transport is disconnected last.
+	Shutdown(ctx context.Context) error
+}
+
+// ShutdownErr is returned by Shutdown if some packages weren't processed in time, ForceNacked of them were nacked for redelivery
+type ShutdownErr struct {
+	error
+	ForceNacked int
+}
+
+func WithShutdownErr(err error, forceNacked int) error {
+	return ShutdownErr{error: err, ForceNacked: forceNacked}
 }
 
 // Config allows to configure subscriber workflow
@@ -42,8 +56,11 @@ var DefaultConfig = Config{
 }
 
 type subscriberOpts struct {
-	config      *Config
-	consumeOpts []transport.ConsumeOpt
+	config       *Config
+	consumeOpts  []transport.ConsumeOpt
+	workersCount uint
+	prefetch     uint
+	orderingKey  KeyFunc
 }
 
 type Opt func(o *subscriberOpts)
@@ -60,9 +77,33 @@ func WithConsumeOpts(opts ...transport.ConsumeOpt) Opt {
 	}
 }
 
+// WithWorkersCount overrides Config.WorkersCount, the number of packages processed concurrently
+func WithWorkersCount(count uint) Opt {
+	return func(o *subscriberOpts) {
+		o.workersCount = count
+	}
+}
+
+// WithPrefetch sets how many packages a worker holds besides the one in progress when packages are ordered by WithOrderingKey,
+// DefaultPrefetch is used otherwise. Let the transport deliver enough packages, e.g. amqp.WithQosPrefetchCount(workers * (prefetch + 1)).
+func WithPrefetch(count uint) Opt {
+	return func(o *subscriberOpts) {
+		o.prefetch = count
+	}
+}
+
+// WithOrderingKey processes packages with the same key one by one in the order they are received, packages with different keys
+// are processed concurrently. Packages are partitioned among workers by a hash of the key, packages without a key go to workers in turn.
+// A package which failed is redelivered by the transport later, so it loses its place.
+func WithOrderingKey(key KeyFunc) Opt {
+	return func(o *subscriberOpts) {
+		o.orderingKey = key
+	}
+}
+
 // NewSubscriber creates default subscriber implementation
 func NewSubscriber(transport transport.Transport, processor Processor, logger log.Logger, opts ...Opt) Subscriber {
-	sOpts := &subscriberOpts{}
+	sOpts := &subscriberOpts{prefetch: DefaultPrefetch}
 
 	for _, o := range opts {
 		o(sOpts)
@@ -72,12 +113,20 @@ func NewSubscriber(transport transport.Transport, processor Processor, logger lo
 		sOpts.config = &DefaultConfig
 	}
 
+	if sOpts.workersCount == 0 {
+		sOpts.workersCount = sOpts.config.WorkersCount
+	}
+
 	return &subscriber{
 		transport:        transport,
 		logger:           logger,
 		processor:        processor,
-		workerDispatcher: newDispatcher(sOpts.config.WorkersCount, logger),
+		workerDispatcher: newDispatcher(sOpts.workersCount, logger),
 		opts:             sOpts,
+		stop:             make(chan struct{}),
+		idle:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		inFlight:         make(map[*inFlightPkg]struct{}),
 	}
 }
 
@@ -87,32 +136,78 @@ type subscriber struct {
 	processor        Processor
 	workerDispatcher *dispatcher
 	opts             *subscriberOpts
+
+	mutex    sync.Mutex
+	stopping bool
+	running  bool
+	// stop is closed when fetching of packages must stop
+	stop chan struct{}
+	// idle is closed when fetching has stopped and no package is in progress
+	idle chan struct{}
+	// stopped is closed when Run has returned
+	stopped  chan struct{}
+	inFlight map[*inFlightPkg]struct{}
+
+	drainOnce sync.Once
+	drainErr  error
 }
 
-func (s *subscriber) Run(ctx context.Context, queues ...transport.Queue) error {
+func (s *subscriber) Run(ctx context.Context, queues ...transport.Queue) (err error) {
 	s.logger.Logf(log.InfoLevel, "Started subscriber. Listening to queues: %v", queues)
 
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.running = true
+	s.mutex.Unlock()
+
+	defer close(s.stopped)
+
 	ctx, cancelSignal := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancelSignal()
 
 	config := s.opts.config
 
-	consumerCtx, cancelConsumerCtx := context.WithCancel(ctx)
+	// consuming isn't stopped together with ctx, packages in progress are acked over the same channel after ctx is done
+	consumerCtx, cancelConsumerCtx := context.WithCancel(detachedCtx{ctx})
+	defer cancelConsumerCtx()
 
 	consumedPkgs, err := s.transport.Consume(consumerCtx, queues, s.opts.consumeOpts...)
 
 	if err != nil {
-		cancelConsumerCtx()
 		return errors.WithStack(err)
 	}
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.GracefulShutdownTimeout)
-	defer shutdownCancel()
+	fetchingCtx, stopFetching := context.WithCancel(ctx)
 
-	defer s.gracefulShutdown(shutdownCtx)
-	defer cancelConsumerCtx()
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.GracefulShutdownTimeout)
+		defer shutdownCancel()
+
+		if drainErr := s.drain(shutdownCtx); drainErr != nil && err == nil {
+			err = drainErr
+		}
+	}()
+	defer stopFetching()
+
+	go func() {
+		select {
+		case <-s.stop:
+			stopFetching()
+		case <-fetchingCtx.Done():
+		}
+	}()
+
+	// handlers keep running after ctx is done until they finish or shutdown gives up waiting for them
+	processingCtx := detachedCtx{ctx}
+
+	if s.opts.orderingKey != nil {
+		return s.runPartitioned(fetchingCtx, processingCtx, consumedPkgs)
+	}
 
-	s.workerDispatcher.start(consumerCtx)
+	s.workerDispatcher.start(fetchingCtx)
 
 	scheduleTicker := time.NewTicker(config.WorkerWaitingAssignmentTimeout)
 
@@ -120,7 +215,7 @@ func (s *subscriber) Run(ctx context.Context, queues ...transport.Queue) error {
 
 	for {
 		select {
-		case <-consumerCtx.Done():
+		case <-fetchingCtx.Done():
 			s.logger.Log(log.InfoLevel, "Subscriber's context was canceled")
 			return nil
 		case worker, open := <-s.workerDispatcher.queue():
@@ -134,19 +229,208 @@ func (s *subscriber) Run(ctx context.Context, queues ...transport.Queue) error {
 				s.logger.Logf(log.DebugLevel, "worker was waiting %s for a job to start. returning him to the pool", config.WorkerWaitingAssignmentTimeout.String())
 				s.workerDispatcher.queue() <- worker
 				break
+			case <-fetchingCtx.Done():
+				s.workerDispatcher.queue() <- worker
+				s.logger.Log(log.InfoLevel, "Subscriber's context was canceled")
+				return nil
 			case incomingPkg, open := <-consumedPkgs:
 				if !open {
 					s.logger.Log(log.InfoLevel, "consumed package is closed")
 					return nil
 				}
-				worker <- newTaskProcessPkg(ctx, incomingPkg, s, s.logger)
+
+				inFlight := s.track(processingCtx, incomingPkg)
+
+				if inFlight == nil {
+					s.workerDispatcher.queue() <- worker
+					s.nackForRedelivery(incomingPkg)
+					return nil
+				}
+
+				worker <- newTaskProcessPkg(inFlight, s, s.logger)
+			}
+		}
+	}
+}
+
+// runPartitioned passes packages to workers by their ordering keys, a worker processes packages of its partition one by one
+func (s *subscriber) runPartitioned(fetchingCtx, processingCtx context.Context, consumedPkgs <-chan transport.IncomingPkg) error {
+	workers := newPartitions(s.opts.workersCount, s.opts.prefetch, s.opts.orderingKey)
+	workers.start(s.processPackage)
+	defer workers.close()
+
+	for {
+		select {
+		case <-fetchingCtx.Done():
+			s.logger.Log(log.InfoLevel, "Subscriber's context was canceled")
+			return nil
+		case incomingPkg, open := <-consumedPkgs:
+			if !open {
+				s.logger.Log(log.InfoLevel, "consumed package is closed")
+				return nil
+			}
+
+			inFlight := s.track(processingCtx, incomingPkg)
+
+			if inFlight == nil {
+				s.nackForRedelivery(incomingPkg)
+				return nil
+			}
+
+			// a partition is full while its worker is busy, other partitions wait until it takes the package
+			select {
+			case workers.queue(incomingPkg) <- inFlight:
+			case <-fetchingCtx.Done():
+				inFlight.forceNack(s.logger)
+				s.untrack(inFlight)
+				s.logger.Log(log.InfoLevel, "Subscriber's context was canceled")
+				return nil
 			}
 		}
 	}
 }
 
-func (s *subscriber) processPackage(ctx context.Context, inPkg transport.IncomingPkg) {
-	processorCtx, processorCancel := context.WithTimeout(ctx, s.opts.config.PackageProcessingMaxTime)
+// Shutdown stops fetching packages, waits for packages in progress until ctx is done, nacks the rest and disconnects the transport.
+// Calls after the first one return ShutdownErr of the first call if there was one.
+func (s *subscriber) Shutdown(ctx context.Context) error {
+	err := s.drain(ctx)
+
+	s.mutex.Lock()
+	running := s.running
+	s.mutex.Unlock()
+
+	// consuming stops once Run returns, the transport is disconnected after that
+	if running {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+		}
+	}
+
+	if dErr := s.transport.Disconnect(ctx); dErr != nil && err == nil {
+		err = errors.Wrap(dErr, "disconnecting transport")
+	}
+
+	return err
+}
+
+// drain stops fetching of packages and waits until packages in progress are settled or ctx is done.
+// Packages which aren't settled by then are nacked for redelivery and their contexts are cancelled.
+func (s *subscriber) drain(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		s.drainErr = s.waitInFlight(ctx)
+	})
+
+	return s.drainErr
+}
+
+func (s *subscriber) waitInFlight(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	close(s.stop)
+
+	inProgress := len(s.inFlight)
+	if inProgress == 0 {
+		close(s.idle)
+	}
+	s.mutex.Unlock()
+
+	if inProgress > 0 {
+		s.logger.Logf(log.InfoLevel, "Graceful shutdown. Waiting subscriber for finishing %d tasks in progress", inProgress)
+	}
+
+	waitingTicker := time.NewTicker(time.Second)
+	defer waitingTicker.Stop()
+
+	for waiting := true; waiting; {
+		select {
+		case <-s.idle:
+			s.logger.Log(log.InfoLevel, "All tasks are finished.")
+			return nil
+		case <-waitingTicker.C:
+			s.logger.Logf(log.InfoLevel, "Waiting for processor to finish all remaining tasks in a queue. Tasks in progress: %d", s.inFlightCount())
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
+
+	s.mutex.Lock()
+	pkgs := make([]*inFlightPkg, 0, len(s.inFlight))
+	for pkg := range s.inFlight {
+		pkgs = append(pkgs, pkg)
+	}
+	s.mutex.Unlock()
+
+	forceNacked := 0
+
+	for _, pkg := range pkgs {
+		if pkg.forceNack(s.logger) {
+			forceNacked++
+		}
+	}
+
+	if forceNacked == 0 {
+		return nil
+	}
+
+	s.logger.Logf(log.WarnLevel, "Stopped gracefulShutdown because of canceled parent ctx. %d packages in progress were nacked for redelivery", forceNacked)
+
+	return WithShutdownErr(errors.Errorf("%d packages were still in progress on shutdown and were nacked for redelivery", forceNacked), forceNacked)
+}
+
+// track registers a package in progress, nil is returned if the subscriber is shutting down
+func (s *subscriber) track(ctx context.Context, pkg transport.IncomingPkg) *inFlightPkg {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	inFlight := &inFlightPkg{pkg: pkg, ctx: ctx, cancel: cancel}
+	s.inFlight[inFlight] = struct{}{}
+
+	return inFlight
+}
+
+func (s *subscriber) untrack(pkg *inFlightPkg) {
+	pkg.cancel()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inFlight, pkg)
+
+	if s.stopping && len(s.inFlight) == 0 {
+		select {
+		case <-s.idle:
+		default:
+			close(s.idle)
+		}
+	}
+}
+
+func (s *subscriber) inFlightCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.inFlight)
+}
+
+// nackForRedelivery returns a package which was fetched while the subscriber was stopping
+func (s *subscriber) nackForRedelivery(pkg transport.IncomingPkg) {
+	if err := pkg.Nack(transport.WithRequeue()); err != nil {
+		s.logger.Logf(log.ErrorLevel, "error nacking package %s. %s", pkg.UID(), err)
+	}
+}
+
+func (s *subscriber) processPackage(inFlight *inFlightPkg) {
+	defer s.untrack(inFlight)
+
+	inPkg := inFlight.pkg
+
+	processorCtx, processorCancel := context.WithTimeout(inFlight.ctx, s.opts.config.PackageProcessingMaxTime)
 	defer processorCancel()
 
 	s.logger.Logf(log.DebugLevel, "started processing package id %s", inPkg.UID())
@@ -157,7 +441,7 @@ func (s *subscriber) processPackage(ctx context.Context, inPkg transport.Incomin
 		return
 	}
 
-	if err := inPkg.Ack(); err != nil {
+	if err := inFlight.ack(); err != nil {
 		s.logger.Logf(log.ErrorLevel, "error acking package %s. %s", inPkg.UID(), err)
 		return
 	}
@@ -165,37 +449,74 @@ func (s *subscriber) processPackage(ctx context.Context, inPkg transport.Incomin
 	s.logger.Logf(log.DebugLevel, "acked package id %s", inPkg.UID())
 }
 
-func (s *subscriber) gracefulShutdown(ctx context.Context) {
-	if s.workerDispatcher.busyWorkers() > 0 {
-		s.logger.Logf(log.InfoLevel, "Graceful shutdown. Waiting subscriber for finishing %d tasks in progress", s.workerDispatcher.busyWorkers())
+// inFlightPkg is a package in progress. It's settled once: either acked after processing or nacked by shutdown.
+type inFlightPkg struct {
+	pkg    transport.IncomingPkg
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex  sync.Mutex
+	acked  bool
+	nacked bool
+}
+
+func (p *inFlightPkg) ack() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.nacked {
+		return errors.New("package was nacked by shutdown while it was processed")
 	}
 
-	waitingTicker := time.NewTicker(time.Second)
-	defer waitingTicker.Stop()
+	if err := p.pkg.Ack(); err != nil {
+		return err
+	}
 
-	for s.workerDispatcher.busyWorkers() > 0 {
-		select {
-		case <-ctx.Done():
-			s.logger.Log(log.WarnLevel, "Stopped gracefulShutdown because of canceled parent ctx")
-			return
-		case <-waitingTicker.C:
-			s.logger.Logf(log.InfoLevel, "Waiting for processor to finish all remaining tasks in a queue. Tasks in progress: %d", s.workerDispatcher.busyWorkers())
-		}
+	p.acked = true
+
+	return nil
+}
+
+// forceNack nacks the package for redelivery and cancels its processing, false is returned if it's already acked
+func (p *inFlightPkg) forceNack(logger log.Logger) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cancel()
+
+	if p.acked || p.nacked {
+		return false
+	}
+
+	p.nacked = true
+
+	if err := p.pkg.Nack(transport.WithRequeue()); err != nil {
+		logger.Logf(log.ErrorLevel, "error nacking package %s on shutdown. %s", p.pkg.UID(), err)
 	}
 
-	s.logger.Log(log.InfoLevel, "All tasks are finished.")
+	return true
+}
+
+// detachedCtx keeps values of the parent, but isn't cancelled with it
+type detachedCtx struct {
+	parent context.Context
+}
+
+func (detachedCtx) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedCtx) Done() <-chan struct{}       { return nil }
+func (detachedCtx) Err() error                  { return nil }
+func (c detachedCtx) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
 }
 
 type processPkg struct {
-	ctx        context.Context
-	pkg        transport.IncomingPkg
+	pkg        *inFlightPkg
 	subscriber *subscriber
 	logger     log.Logger
 }
 
-func newTaskProcessPkg(ctx context.Context, pkg transport.IncomingPkg, subscriber *subscriber, logger log.Logger) *processPkg {
+func newTaskProcessPkg(pkg *inFlightPkg, subscriber *subscriber, logger log.Logger) *processPkg {
 	return &processPkg{
-		ctx:        ctx,
 		pkg:        pkg,
 		subscriber: subscriber,
 		logger:     logger,
@@ -203,5 +524,5 @@ func newTaskProcessPkg(ctx context.Context, pkg transport.IncomingPkg, subscribe
 }
 
 func (p *processPkg) do() {
-	p.subscriber.processPackage(p.ctx, p.pkg)
+	p.subscriber.processPackage(p.pkg)
 }
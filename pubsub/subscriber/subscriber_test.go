@@ -158,16 +158,22 @@ func TestSubscriber(t *testing.T) {
 
 		inPkg := transportMock.NewMockIncomingPkg(ctrl)
 		inPkg.EXPECT().UID().Return("111").Times(2)
-		inPkg.EXPECT().Ack().Return(nil)
+		inPkg.EXPECT().Nack(gomock.Any()).Return(nil)
 
 		startedProcessingNotifier := make(chan struct{})
+		processorReturned := make(chan struct{})
 
 		testProcessor.
 			EXPECT().
 			Process(gomock.Any(), inPkg).
 			Do(func(ctx context.Context, inPkg transport.IncomingPkg) {
+				defer close(processorReturned)
 				startedProcessingNotifier <- struct{}{}
-				time.Sleep(time.Second * 4)
+
+				select {
+				case <-time.After(time.Second * 4):
+				case <-ctx.Done():
+				}
 			}).
 			Return(nil)
 
@@ -180,14 +186,17 @@ func TestSubscriber(t *testing.T) {
 			cancel()
 		}()
 
-		if err := subscriber.Run(ctx, queues...); err != nil {
-			assert.NoError(t, err)
-		}
+		err := subscriber.Run(ctx, queues...)
+		assert.Error(t, err)
+		assert.IsType(t, ShutdownErr{}, err)
+		assert.Equal(t, 1, err.(ShutdownErr).ForceNacked)
 
-		//exiting here without this sleep will stop all goroutines and processed package will abort it's execution.
-		time.Sleep(time.Second * 2)
+		// processing is cancelled once the package is nacked, acking it afterwards fails
+		<-processorReturned
+		time.Sleep(time.Millisecond * 100)
 
-		assert.Contains(t, testLogger.Messages(), "Stopped gracefulShutdown because of canceled parent ctx")
+		assert.Contains(t, testLogger.Messages(), "Stopped gracefulShutdown because of canceled parent ctx. 1 packages in progress were nacked for redelivery")
+		assert.Contains(t, testLogger.Messages(), "error acking package 111. package was nacked by shutdown while it was processed")
 	})
 
 	t.Run("waiting for all tasks to finish in gracefulShutdown", func(t *testing.T) {
@@ -402,6 +411,147 @@ func TestSubscriber(t *testing.T) {
 	})
 }
 
+func TestSubscriber_Shutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testTransport := transportMock.NewMockTransport(ctrl)
+	testProcessor := subscriberMock.NewMockProcessor(ctrl)
+	testLogger := log.NewNilLogger()
+
+	config := &Config{
+		WorkersCount:                   2,
+		WorkerWaitingAssignmentTimeout: time.Second,
+		PackageProcessingMaxTime:       time.Second * 10,
+		GracefulShutdownTimeout:        time.Second * 10,
+	}
+
+	t.Run("slow handler is acked before the transport is disconnected", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		queues := []transport.Queue{amqp.Queue("slow", false, false, false, false)}
+		pkgsChan := make(chan transport.IncomingPkg, 1)
+
+		var consumeCtx context.Context
+
+		testTransport.
+			EXPECT().
+			Consume(gomock.Any(), queues).
+			DoAndReturn(func(ctx context.Context, queues []transport.Queue, options ...transport.ConsumeOpt) (<-chan transport.IncomingPkg, error) {
+				consumeCtx = ctx
+				return pkgsChan, nil
+			})
+
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().UID().Return("111").AnyTimes()
+
+		started := make(chan struct{})
+		processed, consumingWhenAcked := false, false
+
+		gomock.InOrder(
+			testProcessor.
+				EXPECT().
+				Process(gomock.Any(), inPkg).
+				DoAndReturn(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+					close(started)
+					time.Sleep(time.Second)
+
+					// ctx isn't cancelled by the shutdown while the handler runs in time
+					processed = ctx.Err() == nil
+					return nil
+				}),
+			inPkg.EXPECT().Ack().DoAndReturn(func(options ...transport.AcknowledgmentOption) error {
+				// the channel of the package is still open
+				consumingWhenAcked = consumeCtx.Err() == nil
+				return nil
+			}),
+			testTransport.EXPECT().Disconnect(gomock.Any()).Return(nil),
+		)
+
+		pkgsChan <- inPkg
+
+		subscriber := NewSubscriber(testTransport, testProcessor, testLogger, WithConfig(config))
+
+		runErr := make(chan error)
+		go func() {
+			runErr <- subscriber.Run(context.Background(), queues...)
+		}()
+
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		assert.NoError(t, subscriber.Shutdown(ctx))
+		assert.NoError(t, <-runErr)
+		assert.True(t, processed)
+		assert.True(t, consumingWhenAcked)
+		assert.Error(t, consumeCtx.Err())
+		assert.Contains(t, testLogger.Messages(), "All tasks are finished.")
+	})
+
+	t.Run("handlers not finished in time are force nacked", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		queues := []transport.Queue{amqp.Queue("stuck", false, false, false, false)}
+		pkgsChan := make(chan transport.IncomingPkg, 1)
+
+		testTransport.EXPECT().Consume(gomock.Any(), queues).Return(pkgsChan, nil)
+
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().UID().Return("222").AnyTimes()
+
+		started := make(chan struct{})
+		returned := make(chan struct{})
+
+		gomock.InOrder(
+			testProcessor.
+				EXPECT().
+				Process(gomock.Any(), inPkg).
+				DoAndReturn(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+					defer close(returned)
+					close(started)
+					<-ctx.Done()
+
+					return ctx.Err()
+				}),
+			inPkg.EXPECT().Nack(gomock.Any()).Return(nil),
+		)
+		inPkg.EXPECT().Origin().Return("stuck")
+		testTransport.EXPECT().Disconnect(gomock.Any()).Return(nil)
+
+		pkgsChan <- inPkg
+
+		subscriber := NewSubscriber(testTransport, testProcessor, testLogger, WithConfig(config))
+
+		runErr := make(chan error)
+		go func() {
+			runErr <- subscriber.Run(context.Background(), queues...)
+		}()
+
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+
+		err := subscriber.Shutdown(ctx)
+		assert.EqualError(t, err, "1 packages were still in progress on shutdown and were nacked for redelivery")
+		assert.Equal(t, 1, err.(ShutdownErr).ForceNacked)
+		assert.Equal(t, err, <-runErr, "Run returns the result of the shutdown")
+
+		<-returned
+	})
+
+	t.Run("shutdown before run", func(t *testing.T) {
+		testTransport.EXPECT().Disconnect(gomock.Any()).Return(nil)
+
+		subscriber := NewSubscriber(testTransport, testProcessor, testLogger, WithConfig(config))
+
+		assert.NoError(t, subscriber.Shutdown(context.Background()))
+		assert.NoError(t, subscriber.Run(context.Background()))
+	})
+}
+
 func producePackages(ctrl *gomock.Controller, processorMock *subscriberMock.MockProcessor, count int, done chan struct{}) chan transport.IncomingPkg {
 	respChan := make(chan transport.IncomingPkg)
 
@@ -0,0 +1,182 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+// ValidateOnly is a set of queues whose messages are decoded, verified and matched with executors, but not handled.
+// Such messages are acked and counted as would-be dispatched, e.g. by a standby region which must prove the pipeline works
+// before failover. Queues are switched in and out at runtime, the mode is read once per message, so a message is either handled
+// or only validated, never both.
+type ValidateOnly struct {
+	mutex  sync.RWMutex
+	queues map[string]struct{}
+	report map[scheme.GroupKind]*ValidationStats
+}
+
+// ValidationStats contains counters collected for a GroupKind in validate-only mode
+type ValidationStats struct {
+	// Validated is a number of messages which would be dispatched
+	Validated uint64 `json:"validated"`
+	// Executors is a number of executors which would be called for validated messages in total
+	Executors uint64 `json:"executors"`
+	// Failed is a number of messages which failed signature verification or have no executors
+	Failed uint64 `json:"failed"`
+}
+
+// ValidationReport is a snapshot of ValidateOnly, counters are keyed by group.kind of messages
+type ValidationReport struct {
+	Queues []string                   `json:"queues"`
+	Types  map[string]ValidationStats `json:"types"`
+	// Undecoded is a number of messages which failed to be unmarshalled, their type is unknown
+	Undecoded uint64 `json:"undecoded"`
+}
+
+// NewValidateOnly creates ValidateOnly with queues initially in validate-only mode
+func NewValidateOnly(queues ...string) *ValidateOnly {
+	v := &ValidateOnly{queues: make(map[string]struct{}, len(queues)), report: make(map[scheme.GroupKind]*ValidationStats)}
+
+	for _, queue := range queues {
+		v.queues[queue] = struct{}{}
+	}
+
+	return v
+}
+
+// Enable switches the queue into validate-only mode, messages received after it returns aren't handled
+func (v *ValidateOnly) Enable(queue string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.queues[queue] = struct{}{}
+}
+
+// Disable switches the queue out of validate-only mode, messages received after it returns are handled
+func (v *ValidateOnly) Disable(queue string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.queues, queue)
+}
+
+// Enabled tells whether messages received from the queue are only validated
+func (v *ValidateOnly) Enabled(queue string) bool {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	_, enabled := v.queues[queue]
+
+	return enabled
+}
+
+// Queues returns sorted names of queues in validate-only mode
+func (v *ValidateOnly) Queues() []string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	queues := make([]string, 0, len(v.queues))
+	for queue := range v.queues {
+		queues = append(queues, queue)
+	}
+
+	sort.Strings(queues)
+
+	return queues
+}
+
+// Stats returns a snapshot of counters for a GroupKind
+func (v *ValidateOnly) Stats(gk scheme.GroupKind) ValidationStats {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	if stats, exists := v.report[gk]; exists {
+		return *stats
+	}
+
+	return ValidationStats{}
+}
+
+// Report returns a snapshot of queues and counters of all types
+func (v *ValidateOnly) Report() ValidationReport {
+	queues := v.Queues()
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	report := ValidationReport{Queues: queues, Types: make(map[string]ValidationStats, len(v.report))}
+
+	for gk, stats := range v.report {
+		if gk.Empty() {
+			report.Undecoded = stats.Failed
+			continue
+		}
+
+		report.Types[gk.String()] = *stats
+	}
+
+	return report
+}
+
+// ServeHTTP serves the report on GET. PUT and DELETE with ?queue= switch the queue into and out of validate-only mode.
+func (v *ValidateOnly) ServeHTTP(resp http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodDelete:
+		queue := r.URL.Query().Get("queue")
+		if queue == "" {
+			http.Error(resp, "Query parameter 'queue' is required", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			v.Enable(queue)
+		} else {
+			v.Disable(queue)
+		}
+	default:
+		resp.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respBody, err := json.Marshal(v.Report())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write(respBody)
+}
+
+func (v *ValidateOnly) recordValidated(gk scheme.GroupKind, executors int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	stats := v.stats(gk)
+	stats.Validated++
+	stats.Executors += uint64(executors)
+}
+
+// recordFailed counts a message which wouldn't be handled, an empty GroupKind counts a message which wasn't decoded
+func (v *ValidateOnly) recordFailed(gk scheme.GroupKind) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.stats(gk).Failed++
+}
+
+func (v *ValidateOnly) stats(gk scheme.GroupKind) *ValidationStats {
+	stats, exists := v.report[gk]
+	if !exists {
+		stats = &ValidationStats{}
+		v.report[gk] = stats
+	}
+
+	return stats
+}
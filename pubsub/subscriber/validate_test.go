@@ -0,0 +1,63 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOnly(t *testing.T) {
+	gk := scheme.GroupKind{Group: "testGroup", Kind: "someTest"}
+
+	t.Run("queues are switched at runtime", func(t *testing.T) {
+		v := NewValidateOnly("b")
+		v.Enable("a")
+		assert.True(t, v.Enabled("a"))
+		assert.Equal(t, []string{"a", "b"}, v.Queues())
+
+		v.Disable("b")
+		assert.False(t, v.Enabled("b"))
+		assert.Equal(t, []string{"a"}, v.Queues())
+	})
+
+	t.Run("report is served and queues are switched over http", func(t *testing.T) {
+		v := NewValidateOnly("standby")
+		v.recordValidated(gk, 3)
+		v.recordFailed(scheme.GroupKind{})
+
+		resp := httptest.NewRecorder()
+		v.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/validation", nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{"queues":["standby"],"types":{"testGroup.someTest":{"validated":1,"executors":3,"failed":0}},"undecoded":1}`, resp.Body.String())
+
+		resp = httptest.NewRecorder()
+		v.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/validation?queue=standby", nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.False(t, v.Enabled("standby"))
+
+		resp = httptest.NewRecorder()
+		v.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/validation?queue=other", nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		report := ValidationReport{}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &report))
+		assert.Equal(t, []string{"other"}, report.Queues)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		v := NewValidateOnly()
+
+		resp := httptest.NewRecorder()
+		v.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/validation", nil))
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+		resp = httptest.NewRecorder()
+		v.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/validation?queue=a", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	})
+}
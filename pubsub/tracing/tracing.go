@@ -0,0 +1,284 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-foreman/foreman/pubsub/dispatcher"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceParentHeader contains W3C trace context of the span which sent a message
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader contains W3C vendor specific trace state
+	TraceStateHeader = "tracestate"
+
+	instrumentationName = "github.com/go-foreman/foreman"
+)
+
+// Span attributes set by foreman
+const (
+	MessageUIDKey    = attribute.Key("messaging.message_id")
+	MessageTypeKey   = attribute.Key("messaging.message_type")
+	DestinationKey   = attribute.Key("messaging.destination")
+	MessageOriginKey = attribute.Key("messaging.origin")
+	SagaUIDKey       = attribute.Key("saga.id")
+	SagaTypeKey      = attribute.Key("saga.type")
+)
+
+type opts struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+// Opt configures tracing of endpoints and executors
+type Opt func(o *opts)
+
+// WithTracerProvider sets a provider of tracers, the global one registered with otel.SetTracerProvider is used by default
+func WithTracerProvider(tracerProvider trace.TracerProvider) Opt {
+	return func(o *opts) {
+		o.tracerProvider = tracerProvider
+	}
+}
+
+// WithPropagator sets a propagator of span context in headers, W3C trace context by default
+func WithPropagator(propagator propagation.TextMapPropagator) Opt {
+	return func(o *opts) {
+		o.propagator = propagator
+	}
+}
+
+func newOpts(passedOpts []Opt) *opts {
+	o := &opts{propagator: propagation.TraceContext{}}
+
+	for _, opt := range passedOpts {
+		opt(o)
+	}
+
+	if o.tracerProvider == nil {
+		o.tracerProvider = otel.GetTracerProvider()
+	}
+
+	return o
+}
+
+// HeadersCarrier adapts message headers to propagation.TextMapCarrier
+type HeadersCarrier message.Headers
+
+func (c HeadersCarrier) Get(key string) string {
+	val, _ := c[key].(string)
+	return val
+}
+
+func (c HeadersCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c HeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// WrapEndpoint starts a producer span for each sent message and injects its context into headers of the message.
+// If ctx passed to Send carries no span, headers are left as is: a message sent by a handler keeps the context
+// it copied from the received message.
+func WrapEndpoint(next endpoint.Endpoint, passedOpts ...Opt) endpoint.Endpoint {
+	o := newOpts(passedOpts)
+	return &tracedEndpoint{Endpoint: next, tracer: o.tracerProvider.Tracer(instrumentationName), propagator: o.propagator}
+}
+
+type tracedEndpoint struct {
+	endpoint.Endpoint
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (e tracedEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return e.Endpoint.Send(ctx, msg, options...)
+	}
+
+	ctx, span := e.start(ctx, msg)
+	defer span.End()
+
+	err := e.Endpoint.Send(ctx, msg, options...)
+	recordErr(span, err)
+
+	return err
+}
+
+// Close closes the wrapped endpoint
+func (e tracedEndpoint) Close() error {
+	return endpoint.Close(e.Endpoint)
+}
+
+func (e tracedEndpoint) SupportsDelay() bool {
+	return endpoint.SupportsDelay(e.Endpoint)
+}
+
+func (e tracedEndpoint) SendBatch(ctx context.Context, messages []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return e.Endpoint.SendBatch(ctx, messages, options...)
+	}
+
+	spans := make(map[string]trace.Span, len(messages))
+
+	for _, msg := range messages {
+		_, spans[msg.UID()] = e.start(ctx, msg)
+	}
+
+	err := e.Endpoint.SendBatch(ctx, messages, options...)
+	batchErr, isBatchErr := err.(endpoint.BatchSendErr)
+
+	for uid, span := range spans {
+		if isBatchErr {
+			recordErr(span, batchErr.Failed[uid])
+		} else {
+			recordErr(span, err)
+		}
+
+		span.End()
+	}
+
+	return err
+}
+
+func (e tracedEndpoint) start(ctx context.Context, msg *message.OutcomingMessage) (context.Context, trace.Span) {
+	msgType := msg.Payload().GroupKind().String()
+
+	ctx, span := e.tracer.Start(
+		ctx,
+		fmt.Sprintf("%s send", msgType),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(MessageUIDKey.String(msg.UID()), MessageTypeKey.String(msgType), DestinationKey.String(e.Name())),
+	)
+
+	e.propagator.Inject(ctx, HeadersCarrier(msg.Headers()))
+
+	return ctx, span
+}
+
+// Middleware starts a consumer span named after group and kind of a received message. The span is a child of the producer span
+// extracted from headers, or of the span execCtx.Context() already carries, e.g. started by WrapProcessor. Executors get it
+// in execCtx.Context(), so messages they send are traced as its children.
+func Middleware(passedOpts ...Opt) dispatcher.Middleware {
+	o := newOpts(passedOpts)
+	tracer := o.tracerProvider.Tracer(instrumentationName)
+
+	return func(next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) error {
+			msg := execCtx.Message()
+			msgType := msg.Payload().GroupKind().String()
+
+			ctx := execCtx.Context()
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				ctx = o.propagator.Extract(ctx, HeadersCarrier(msg.Headers()))
+			}
+
+			ctx, span := tracer.Start(
+				ctx,
+				msgType,
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(MessageUIDKey.String(msg.UID()), MessageTypeKey.String(msgType), MessageOriginKey.String(msg.Origin())),
+			)
+			defer span.End()
+
+			err := next(execution.WithContext(execCtx, ctx))
+			recordErr(span, err)
+
+			return err
+		}
+	}
+}
+
+// WrapProcessor starts a consumer span for each package received from a transport, before it's decoded. The span is a child
+// of the producer span extracted from headers, spans of Middleware become its children. Failures of decoding, verification
+// or dispatching are recorded in it.
+func WrapProcessor(next subscriber.Processor, passedOpts ...Opt) subscriber.Processor {
+	o := newOpts(passedOpts)
+	return &tracedProcessor{next: next, tracer: o.tracerProvider.Tracer(instrumentationName), propagator: o.propagator}
+}
+
+type tracedProcessor struct {
+	next       subscriber.Processor
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (p tracedProcessor) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
+	ctx = p.propagator.Extract(ctx, HeadersCarrier(inPkg.Headers()))
+	ctx, span := p.tracer.Start(
+		ctx,
+		fmt.Sprintf("%s receive", inPkg.Origin()),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(MessageUIDKey.String(inPkg.UID()), MessageOriginKey.String(inPkg.Origin())),
+	)
+	defer span.End()
+
+	err := p.next.Process(ctx, inPkg)
+	recordErr(span, err)
+
+	return err
+}
+
+// TraceCarrier extracts span context of messages received by sagas and injects it into messages they dispatch, see saga.TraceCarrier
+type TraceCarrier struct {
+	propagator propagation.TextMapPropagator
+}
+
+// NewTraceCarrier creates a TraceCarrier, only WithPropagator option is used by it
+func NewTraceCarrier(passedOpts ...Opt) *TraceCarrier {
+	return &TraceCarrier{propagator: newOpts(passedOpts).propagator}
+}
+
+// Extract keeps a span started by Middleware, messages are sent as its children then. Otherwise the context of the span
+// which sent the message is extracted from headers.
+func (c TraceCarrier) Extract(ctx context.Context, headers message.Headers) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	return c.propagator.Extract(ctx, HeadersCarrier(headers))
+}
+
+// Inject writes span context of ctx into headers, they are left as is if ctx carries no span
+func (c TraceCarrier) Inject(ctx context.Context, headers message.Headers) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	c.propagator.Inject(ctx, HeadersCarrier(headers))
+}
+
+// TagSaga adds id and type of a saga to the span in ctx, it does nothing if the span isn't recorded
+func TagSaga(ctx context.Context, sagaUID, sagaType string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	span.SetAttributes(SagaUIDKey.String(sagaUID), SagaTypeKey.String(sagaType))
+}
+
+func recordErr(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
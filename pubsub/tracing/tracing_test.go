@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	subscriberMock "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	transportMock "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type orderPlaced struct {
+	message.ObjectMeta
+}
+
+func newOrderPlaced() *orderPlaced {
+	return &orderPlaced{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "orders", Kind: "orderPlaced"}}}
+}
+
+func TestTracing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+	endpointInstance.EXPECT().Name().Return("orders").AnyTimes()
+	traced := WrapEndpoint(endpointInstance, WithTracerProvider(tracerProvider))
+
+	ctx, parent := tracerProvider.Tracer("test").Start(context.Background(), "http request")
+	msg := message.NewOutcomingMessage(newOrderPlaced())
+
+	endpointInstance.EXPECT().Send(gomock.Any(), msg).Return(nil)
+	require.NoError(t, traced.Send(ctx, msg))
+	parent.End()
+
+	require.Len(t, recorder.Ended(), 2)
+	producer := recorder.Ended()[0]
+	assert.Equal(t, "orders.orderPlaced send", producer.Name())
+	assert.Equal(t, trace.SpanKindProducer, producer.SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), producer.Parent().SpanID())
+	assert.Contains(t, producer.Attributes(), DestinationKey.String("orders"))
+	assert.Contains(t, msg.Headers(), TraceParentHeader)
+	assert.Contains(t, msg.Headers(), "uid", "headers of a message are kept")
+
+	t.Run("consumer span is a child of the producer span", func(t *testing.T) {
+		received := message.NewReceivedMessage(msg.UID(), msg.Payload(), msg.Headers(), time.Now(), "orders-queue")
+		execCtx := execution.NewMessageExecutionCtxFactory(endpoint.NewRouter(), log.NewNilLogger()).CreateCtx(context.Background(), received)
+
+		executor := Middleware(WithTracerProvider(tracerProvider))(func(execCtx execution.MessageExecutionCtx) error {
+			TagSaga(execCtx.Context(), "saga-1", "orders.orderSaga")
+			return errors.New("payment failed")
+		})
+
+		assert.EqualError(t, executor(execCtx), "payment failed")
+
+		require.Len(t, recorder.Ended(), 3)
+		consumer := recorder.Ended()[2]
+		assert.Equal(t, "orders.orderPlaced", consumer.Name())
+		assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+		assert.Equal(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+		assert.Equal(t, producer.SpanContext().SpanID(), consumer.Parent().SpanID())
+		assert.True(t, consumer.Parent().IsRemote())
+		assert.Contains(t, consumer.Attributes(), SagaUIDKey.String("saga-1"))
+		assert.Contains(t, consumer.Attributes(), SagaTypeKey.String("orders.orderSaga"))
+		assert.Contains(t, consumer.Attributes(), MessageOriginKey.String("orders-queue"))
+		assert.Equal(t, codes.Error, consumer.Status().Code)
+	})
+
+	t.Run("headers are kept without a span in context", func(t *testing.T) {
+		msg := message.NewOutcomingMessage(newOrderPlaced(), message.WithHeaders(message.Headers{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}))
+		endpointInstance.EXPECT().Send(gomock.Any(), msg).Return(nil)
+
+		require.NoError(t, traced.Send(context.Background(), msg))
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", msg.Headers()[TraceParentHeader])
+		assert.Len(t, recorder.Ended(), 3)
+	})
+
+	t.Run("failed messages of a batch", func(t *testing.T) {
+		ctx, parent := tracerProvider.Tracer("test").Start(context.Background(), "http request")
+		defer parent.End()
+
+		first, second := message.NewOutcomingMessage(newOrderPlaced()), message.NewOutcomingMessage(newOrderPlaced())
+		batchErr := endpoint.WithBatchSendErr(errors.New("1 message isn't sent"), map[string]error{second.UID(): errors.New("nacked")})
+		endpointInstance.EXPECT().SendBatch(gomock.Any(), []*message.OutcomingMessage{first, second}).Return(batchErr)
+
+		assert.Equal(t, batchErr, traced.SendBatch(ctx, []*message.OutcomingMessage{first, second}))
+		assert.NotEqual(t, first.Headers()[TraceParentHeader], second.Headers()[TraceParentHeader], "each message has own span")
+
+		statuses := make(map[string]codes.Code)
+		for _, span := range recorder.Ended()[3:] {
+			for _, attr := range span.Attributes() {
+				if attr.Key == MessageUIDKey {
+					statuses[attr.Value.AsString()] = span.Status().Code
+				}
+			}
+		}
+
+		assert.Equal(t, map[string]codes.Code{first.UID(): codes.Unset, second.UID(): codes.Error}, statuses)
+	})
+}
+
+func TestWrapProcessor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	processorMock := subscriberMock.NewMockProcessor(ctrl)
+	inPkg := transportMock.NewMockIncomingPkg(ctrl)
+
+	headers := message.Headers{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	inPkg.EXPECT().Headers().Return(map[string]interface{}(headers)).AnyTimes()
+	inPkg.EXPECT().UID().Return("msg-1").AnyTimes()
+	inPkg.EXPECT().Origin().Return("orders-queue").AnyTimes()
+
+	executor := Middleware(WithTracerProvider(tracerProvider))(func(execCtx execution.MessageExecutionCtx) error {
+		return nil
+	})
+
+	processorMock.EXPECT().Process(gomock.Any(), inPkg).DoAndReturn(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+		received := message.NewReceivedMessage("msg-1", newOrderPlaced(), headers, time.Now(), "orders-queue")
+		require.NoError(t, executor(execution.NewMessageExecutionCtxFactory(endpoint.NewRouter(), log.NewNilLogger()).CreateCtx(ctx, received)))
+
+		return errors.New("no executors")
+	})
+
+	processor := WrapProcessor(processorMock, WithTracerProvider(tracerProvider))
+	assert.EqualError(t, processor.Process(context.Background(), inPkg), "no executors")
+
+	require.Len(t, recorder.Ended(), 2)
+	consumer, receive := recorder.Ended()[0], recorder.Ended()[1]
+
+	assert.Equal(t, "orders-queue receive", receive.Name())
+	assert.Equal(t, trace.SpanKindConsumer, receive.SpanKind())
+	assert.Equal(t, "00f067aa0ba902b7", receive.Parent().SpanID().String())
+	assert.True(t, receive.Parent().IsRemote())
+	assert.Contains(t, receive.Attributes(), MessageUIDKey.String("msg-1"))
+	assert.Equal(t, codes.Error, receive.Status().Code)
+
+	assert.Equal(t, "orders.orderPlaced", consumer.Name())
+	assert.Equal(t, receive.SpanContext().SpanID(), consumer.Parent().SpanID(), "span of the middleware is a child of the receive span")
+}
+
+func TestHeadersCarrier(t *testing.T) {
+	carrier := HeadersCarrier(message.Headers{"uid": "123", "attempts": int64(2)})
+	carrier.Set(TraceStateHeader, "vendor=value")
+
+	assert.Equal(t, "vendor=value", carrier.Get(TraceStateHeader))
+	assert.Equal(t, "", carrier.Get("attempts"), "only string headers are read")
+	assert.ElementsMatch(t, []string{"uid", "attempts", TraceStateHeader}, carrier.Keys())
+}
+
+func TestTraceCarrier(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	carrier := NewTraceCarrier()
+	received := message.Headers{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+
+	t.Run("context of the sender is extracted", func(t *testing.T) {
+		ctx := carrier.Extract(context.Background(), received)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(ctx).TraceID().String())
+
+		headers := message.Headers{}
+		carrier.Inject(ctx, headers)
+		assert.Equal(t, received[TraceParentHeader], headers[TraceParentHeader])
+	})
+
+	t.Run("span started by middleware is kept", func(t *testing.T) {
+		ctx, span := tracerProvider.Tracer("test").Start(context.Background(), "consumer")
+		defer span.End()
+
+		assert.Equal(t, ctx, carrier.Extract(ctx, received))
+
+		headers := message.Headers{}
+		carrier.Inject(ctx, headers)
+		assert.Contains(t, headers[TraceParentHeader], span.SpanContext().SpanID().String())
+	})
+
+	t.Run("headers are kept without a span", func(t *testing.T) {
+		headers := message.Headers{TraceParentHeader: "kept"}
+		carrier.Inject(context.Background(), headers)
+		assert.Equal(t, "kept", headers[TraceParentHeader])
+	})
+}
@@ -35,6 +35,7 @@ type amqpTransport struct {
 }
 
 // CreateTopic creates an exchange in amqp. Allows options are: durable, autoDelete, internal, noWait.
+// A topic created with WithDelayedMessageType patch is declared as x-delayed-message exchange.
 func (t *amqpTransport) CreateTopic(ctx context.Context, topic transport.Topic) error {
 	if err := t.checkConnection(); err != nil {
 		return errors.WithStack(err)
@@ -46,14 +47,25 @@ func (t *amqpTransport) CreateTopic(ctx context.Context, topic transport.Topic)
 		return errors.Errorf("supplied topic is not an instance of amqp.Topic")
 	}
 
+	kind := "topic"
+
+	var args amqp.Table
+
+	if amqpTopic.delayed {
+		kind = "x-delayed-message"
+		args = amqp.Table{
+			"x-delayed-type": "topic",
+		}
+	}
+
 	if err := t.publishingChannel.ExchangeDeclare(
 		amqpTopic.Name(),
-		"topic",
+		kind,
 		amqpTopic.durable,
 		amqpTopic.autoDelete,
 		amqpTopic.internal,
 		amqpTopic.noWait,
-		nil,
+		args,
 	); err != nil {
 		return errors.WithStack(err)
 	}
@@ -84,26 +96,13 @@ func (t *amqpTransport) CreateQueue(ctx context.Context, q transport.Queue, qbs
 		queueBinds = append(queueBinds, queueBind)
 	}
 
-	var table amqp.Table
-
-	switch queue.queueType {
-	case QueueTypeQuorum:
-		table = amqp.Table{
-			"x-queue-type": "quorum",
-		}
-	case QueueTypeClassic:
-		table = amqp.Table{
-			"x-queue-type": "classic",
-		}
-	}
-
 	if _, err := t.publishingChannel.QueueDeclare(
 		queue.Name(),
 		queue.durable,
 		queue.autoDelete,
 		queue.exclusive,
 		queue.noWait,
-		table,
+		queue.arguments(),
 	); err != nil {
 		return errors.WithStack(err)
 	}
@@ -128,29 +127,129 @@ func (t *amqpTransport) Send(ctx context.Context, outboundPkg transport.Outbound
 		return errors.WithStack(err)
 	}
 
+	sendOptions, err := newSendOptions(options)
+	if err != nil {
+		return err
+	}
+
+	if err := t.publish(t.publishingChannel, outboundPkg, sendOptions); err != nil {
+		return errors.Wrap(err, "sending out pkg")
+	}
+
+	return nil
+}
+
+// SendBatch publishes packages on a separate channel in confirm mode, so confirms of the batch aren't mixed with other publishings.
+// Publishing stops on the first failure, that package and the rest of the batch are reported as failed.
+func (t *amqpTransport) SendBatch(ctx context.Context, outboundPkgs []transport.OutboundPkg, options ...transport.SendOpt) error {
+	if len(outboundPkgs) == 0 {
+		return nil
+	}
+
+	if t.connection == nil {
+		return errors.Errorf("connection is nil")
+	}
+
+	sendOptions, err := newSendOptions(options)
+	if err != nil {
+		return err
+	}
+
+	ch, err := t.connection.Channel()
+	if err != nil {
+		return errors.Wrap(err, "creating batch channel")
+	}
+
+	defer func() {
+		if err := ch.Close(); err != nil {
+			t.logger.Logf(log.ErrorLevel, "error closing batch channel. %s", err)
+		}
+	}()
+
+	if err := ch.Confirm(false); err != nil {
+		return errors.Wrap(err, "enabling publisher confirms")
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, len(outboundPkgs)))
+	failed := make(map[int]error)
+	published := 0
+
+	for i, pkg := range outboundPkgs {
+		if err := t.publish(ch, pkg, sendOptions); err != nil {
+			markFailed(failed, i, len(outboundPkgs), errors.Wrap(err, "sending out pkg"))
+			break
+		}
+
+		published++
+	}
+
+	// delivery tags are assigned from 1 in the order of publishing
+waiting:
+	for confirmed := 0; confirmed < published; confirmed++ {
+		select {
+		case confirm, open := <-confirms:
+			if !open {
+				markFailed(failed, confirmed, published, errors.New("channel closed before the broker confirmed pkg"))
+				break waiting
+			}
+
+			if !confirm.Ack {
+				failed[int(confirm.DeliveryTag)-1] = errors.New("pkg is nacked by the broker")
+			}
+		case <-ctx.Done():
+			markFailed(failed, confirmed, published, errors.Wrap(ctx.Err(), "waiting for the broker to confirm pkg"))
+			break waiting
+		}
+	}
+
+	if len(failed) > 0 {
+		return transport.WithBatchErr(errors.Errorf("%d of %d pkgs weren't sent", len(failed), len(outboundPkgs)), failed)
+	}
+
+	return nil
+}
+
+// markFailed marks packages with indexes in [from, to) as failed
+func markFailed(failed map[int]error, from, to int, err error) {
+	for i := from; i < to; i++ {
+		failed[i] = err
+	}
+}
+
+func newSendOptions(options []transport.SendOpt) (*sendOptions, error) {
 	sendOptions := &sendOptions{}
 
 	for _, opt := range options {
 		if err := opt(sendOptions); err != nil {
-			return errors.WithStack(err)
+			return nil, errors.WithStack(err)
 		}
 	}
 
-	if err := t.publishingChannel.Publish(
+	return sendOptions, nil
+}
+
+func (t *amqpTransport) publish(ch AmqpChannel, outboundPkg transport.OutboundPkg, sendOptions *sendOptions) error {
+	headers := outboundPkg.Headers()
+
+	if sendOptions.Delay > 0 {
+		headers = make(amqp.Table, len(outboundPkg.Headers())+1)
+		for k, v := range outboundPkg.Headers() {
+			headers[k] = v
+		}
+		headers[delayHeader] = sendOptions.Delay.Milliseconds()
+	}
+
+	return ch.Publish(
 		outboundPkg.Destination().DestinationTopic,
 		outboundPkg.Destination().RoutingKey,
 		sendOptions.Mandatory,
 		sendOptions.Immediate,
 		amqp.Publishing{
-			Headers:     outboundPkg.Headers(),
+			Headers:     headers,
 			ContentType: outboundPkg.ContentType(),
 			Body:        outboundPkg.Payload(),
 		},
-	); err != nil {
-		return errors.Wrap(err, "sending out pkg")
-	}
-
-	return nil
+	)
 }
 
 func (t *amqpTransport) Consume(ctx context.Context, queues []transport.Queue, options ...transport.ConsumeOpt) (<-chan transport.IncomingPkg, error) {
@@ -287,6 +386,19 @@ func (t *amqpTransport) Disconnect(ctx context.Context) error {
 	return nil
 }
 
+// CheckHealth fails while the connection is closed, e.g. until it's reconnected, see health.Checker
+func (t *amqpTransport) CheckHealth(ctx context.Context) error {
+	if t.connection == nil {
+		return errors.Errorf("connection is nil")
+	}
+
+	if t.connection.IsClosed() {
+		return errors.Errorf("connection is closed")
+	}
+
+	return nil
+}
+
 func (t *amqpTransport) checkConnection() error {
 	if t.connection == nil {
 		return errors.Errorf("connection is nil")
@@ -12,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/go-foreman/foreman/testing/log"
 	"github.com/golang/mock/gomock"
@@ -45,6 +46,19 @@ func TestAmqpTransport(t *testing.T) {
 		assert.EqualError(t, err, "connection is nil")
 	})
 
+	t.Run("health of connection", func(t *testing.T) {
+		transport := amqpTransport{logger: testLogger}
+		assert.EqualError(t, transport.CheckHealth(context.Background()), "connection is nil")
+
+		transport.connection = connMock
+
+		connMock.EXPECT().IsClosed().Return(true)
+		assert.EqualError(t, transport.CheckHealth(context.Background()), "connection is closed")
+
+		connMock.EXPECT().IsClosed().Return(false)
+		assert.NoError(t, transport.CheckHealth(context.Background()))
+	})
+
 	t.Run("error creating publishing channel", func(t *testing.T) {
 		transport := amqpTransport{
 			connection: connMock,
@@ -80,6 +94,15 @@ func TestAmqpTransport(t *testing.T) {
 		err := transport.CreateTopic(context.Background(), Topic("someName", true, true, true, true))
 		assert.NoError(t, err)
 
+		t.Run("create delayed topic", func(t *testing.T) {
+			channMock.
+				EXPECT().
+				ExchangeDeclare("delayed", "x-delayed-message", true, false, false, false, amqp.Table{"x-delayed-type": "topic"}).
+				Return(nil)
+			err := transport.CreateTopic(context.Background(), Topic("delayed", true, false, false, false, WithDelayedMessageType()))
+			assert.NoError(t, err)
+		})
+
 		t.Run("create topic with an error", func(t *testing.T) {
 			channMock.
 				EXPECT().
@@ -262,6 +285,36 @@ func TestAmqpTransport(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("create queue dead lettering expired messages", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		transport := amqpTransport{
+			connection:        connMock,
+			publishingChannel: channMock,
+			logger:            testLogger,
+		}
+
+		channMock.
+			EXPECT().
+			QueueDeclare("queueName", true, false, false, false, amqp.Table{
+				"x-dead-letter-exchange":    "dest1",
+				"x-dead-letter-routing-key": "binding1",
+				"x-message-ttl":             int64(30000),
+				"x-expires":                 int64(120000),
+			}).
+			Return(amqp.Queue{}, nil)
+
+		err := transport.CreateQueue(
+			context.Background(),
+			Queue("queueName", true, false, false, false,
+				WithDeadLetterExchange("dest1", "binding1"),
+				WithMessageTTL(time.Second*30),
+				WithExpires(time.Minute*2),
+			),
+		)
+		assert.NoError(t, err)
+	})
+
 	t.Run("send", func(t *testing.T) {
 		defer testLogger.Clear()
 
@@ -334,11 +387,119 @@ func TestAmqpTransport(t *testing.T) {
 			assert.NoError(t, err)
 		})
 
+		t.Run("with delay", func(t *testing.T) {
+			channMock.
+				EXPECT().
+				Publish("someTopic", "someKey", false, false, amqp.Publishing{
+					Headers:     amqp.Table{"key": "val", "x-delay": int64(1500)},
+					ContentType: outboundPkg.ContentType(),
+					Body:        outboundPkg.Payload(),
+				}).
+				Return(nil)
+
+			err := transport.Send(context.Background(), outboundPkg, WithDelay(time.Millisecond*1500))
+			assert.NoError(t, err)
+			assert.NotContains(t, outboundPkg.Headers(), "x-delay")
+		})
+
+		t.Run("delay exceeds maximum", func(t *testing.T) {
+			err := transport.Send(context.Background(), outboundPkg, WithDelay(MaxDelay+time.Millisecond))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "exceeds maximum 1193h2m47.295s supported by the broker")
+		})
+
 		t.Run("with wrong options", func(t *testing.T) {
 
 		})
 	})
 
+	t.Run("send batch", func(t *testing.T) {
+		destination := transportMain.DeliveryDestination{DestinationTopic: "someTopic", RoutingKey: "someKey"}
+		pkgs := []transportMain.OutboundPkg{
+			transportMain.NewOutboundPkg([]byte("first"), "application/json", destination, map[string]interface{}{}),
+			transportMain.NewOutboundPkg([]byte("second"), "application/json", destination, map[string]interface{}{}),
+			transportMain.NewOutboundPkg([]byte("third"), "application/json", destination, map[string]interface{}{}),
+		}
+
+		transport := amqpTransport{
+			connection:        connMock,
+			publishingChannel: channMock,
+			logger:            testLogger,
+		}
+
+		// expectBatch expects the batch on a separate channel in confirm mode and confirms published pkgs by acks
+		expectBatch := func(acks ...bool) *MockAmqpChannel {
+			batchChannel := NewMockAmqpChannel(ctrl)
+			connMock.EXPECT().Channel().Return(batchChannel, nil)
+			batchChannel.EXPECT().Confirm(false).Return(nil)
+			batchChannel.EXPECT().Close().Return(nil)
+			batchChannel.
+				EXPECT().
+				NotifyPublish(gomock.Any()).
+				DoAndReturn(func(confirms chan amqp.Confirmation) chan amqp.Confirmation {
+					for i, ack := range acks {
+						confirms <- amqp.Confirmation{DeliveryTag: uint64(i + 1), Ack: ack}
+					}
+					return confirms
+				})
+
+			return batchChannel
+		}
+
+		t.Run("all pkgs are confirmed", func(t *testing.T) {
+			batchChannel := expectBatch(true, true, true)
+			batchChannel.EXPECT().Publish("someTopic", "someKey", false, false, gomock.Any()).Return(nil).Times(3)
+
+			assert.NoError(t, transport.SendBatch(context.Background(), pkgs))
+		})
+
+		t.Run("nacked pkg", func(t *testing.T) {
+			batchChannel := expectBatch(true, false, true)
+			batchChannel.EXPECT().Publish("someTopic", "someKey", false, false, gomock.Any()).Return(nil).Times(3)
+
+			err := transport.SendBatch(context.Background(), pkgs)
+			require.Error(t, err)
+			require.IsType(t, transportMain.BatchErr{}, err)
+			assert.EqualError(t, err, "1 of 3 pkgs weren't sent")
+			assert.Equal(t, []int{1}, err.(transportMain.BatchErr).FailedIndexes())
+			assert.EqualError(t, err.(transportMain.BatchErr).Failed[1], "pkg is nacked by the broker")
+		})
+
+		t.Run("publishing stops on the first failure", func(t *testing.T) {
+			batchChannel := expectBatch(true)
+			batchChannel.EXPECT().Publish("someTopic", "someKey", false, false, amqp.Publishing{Headers: amqp.Table{}, ContentType: "application/json", Body: []byte("first")}).Return(nil)
+			batchChannel.EXPECT().Publish("someTopic", "someKey", false, false, amqp.Publishing{Headers: amqp.Table{}, ContentType: "application/json", Body: []byte("second")}).Return(errors.New("publish error"))
+
+			err := transport.SendBatch(context.Background(), pkgs)
+			require.IsType(t, transportMain.BatchErr{}, err)
+			assert.Equal(t, []int{1, 2}, err.(transportMain.BatchErr).FailedIndexes())
+			assert.EqualError(t, err.(transportMain.BatchErr).Failed[2], "sending out pkg: publish error")
+		})
+
+		t.Run("ctx is done while waiting for confirms", func(t *testing.T) {
+			batchChannel := expectBatch(true)
+			batchChannel.EXPECT().Publish("someTopic", "someKey", false, false, gomock.Any()).Return(nil).Times(3)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+			defer cancel()
+
+			err := transport.SendBatch(ctx, pkgs)
+			require.IsType(t, transportMain.BatchErr{}, err)
+			assert.Equal(t, []int{1, 2}, err.(transportMain.BatchErr).FailedIndexes())
+			assert.EqualError(t, err.(transportMain.BatchErr).Failed[1], "waiting for the broker to confirm pkg: context deadline exceeded")
+		})
+
+		t.Run("error creating batch channel", func(t *testing.T) {
+			connMock.EXPECT().Channel().Return(nil, errors.New("chan err"))
+
+			assert.EqualError(t, transport.SendBatch(context.Background(), pkgs), "creating batch channel: chan err")
+		})
+
+		t.Run("empty batch", func(t *testing.T) {
+			assert.NoError(t, transport.SendBatch(context.Background(), nil))
+		})
+	})
+
 	t.Run("disconnect", func(t *testing.T) {
 		t.Run("no connection or pub channel", func(t *testing.T) {
 			transport := amqpTransport{
@@ -18,6 +18,8 @@ type AmqpChannel interface {
 	Close() error
 	Qos(prefetchCount, prefetchSize int, global bool) error
 	Cancel(consumer string, noWait bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
 }
 
 type AmqpConnection interface {
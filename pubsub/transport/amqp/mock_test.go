@@ -63,6 +63,20 @@ func (mr *MockAmqpChannelMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAmqpChannel)(nil).Close))
 }
 
+// Confirm mocks base method.
+func (m *MockAmqpChannel) Confirm(arg0 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Confirm", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Confirm indicates an expected call of Confirm.
+func (mr *MockAmqpChannelMockRecorder) Confirm(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Confirm", reflect.TypeOf((*MockAmqpChannel)(nil).Confirm), arg0)
+}
+
 // Consume mocks base method.
 func (m *MockAmqpChannel) Consume(arg0, arg1 string, arg2, arg3, arg4, arg5 bool, arg6 amqp091_go.Table) (<-chan amqp091_go.Delivery, error) {
 	m.ctrl.T.Helper()
@@ -106,6 +120,20 @@ func (mr *MockAmqpChannelMockRecorder) NotifyClose(arg0 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyClose", reflect.TypeOf((*MockAmqpChannel)(nil).NotifyClose), arg0)
 }
 
+// NotifyPublish mocks base method.
+func (m *MockAmqpChannel) NotifyPublish(arg0 chan amqp091_go.Confirmation) chan amqp091_go.Confirmation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyPublish", arg0)
+	ret0, _ := ret[0].(chan amqp091_go.Confirmation)
+	return ret0
+}
+
+// NotifyPublish indicates an expected call of NotifyPublish.
+func (mr *MockAmqpChannelMockRecorder) NotifyPublish(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPublish", reflect.TypeOf((*MockAmqpChannel)(nil).NotifyPublish), arg0)
+}
+
 // Publish mocks base method.
 func (m *MockAmqpChannel) Publish(arg0, arg1 string, arg2, arg3 bool, arg4 amqp091_go.Publishing) error {
 	m.ctrl.T.Helper()
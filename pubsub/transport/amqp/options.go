@@ -1,6 +1,9 @@
 package amqp
 
 import (
+	"math"
+	"time"
+
 	"github.com/go-foreman/foreman/pubsub/transport"
 	"github.com/pkg/errors"
 )
@@ -86,9 +89,16 @@ func WithNoWait() transport.ConsumeOpt {
 	}
 }
 
+// delayHeader is read by rabbitmq_delayed_message_exchange plugin
+const delayHeader = "x-delay"
+
+// MaxDelay is the longest delay rabbitmq_delayed_message_exchange plugin accepts, x-delay is an unsigned 32 bit number of milliseconds
+const MaxDelay = time.Duration(math.MaxUint32) * time.Millisecond
+
 type sendOptions struct {
 	Mandatory bool
 	Immediate bool
+	Delay     time.Duration
 }
 
 func WithMandatory() transport.SendOpt {
@@ -118,3 +128,22 @@ func WithImmediate() transport.SendOpt {
 		return nil
 	}
 }
+
+// WithDelay sets x-delay header on the published package. It takes effect only if destination topic is declared with WithDelayedMessageType.
+func WithDelay(delay time.Duration) transport.SendOpt {
+	return func(options interface{}) error {
+		opts, err := convertSendOptsType(options)
+
+		if err != nil {
+			return errors.Wrap(err, "calling WithDelay opt")
+		}
+
+		if delay > MaxDelay {
+			return errors.Errorf("delay %s exceeds maximum %s supported by the broker", delay, MaxDelay)
+		}
+
+		opts.Delay = delay
+
+		return nil
+	}
+}
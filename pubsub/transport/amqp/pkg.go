@@ -97,9 +97,7 @@ func (i inAmqpPkg) ReceivedAt() time.Time {
 }
 
 func WithRequeue() transport.AcknowledgmentOption {
-	return func(options map[string]interface{}) {
-		options["requeue"] = true
-	}
+	return transport.WithRequeue()
 }
 
 func WithMultiple() transport.AcknowledgmentOption {
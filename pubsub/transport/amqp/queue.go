@@ -1,6 +1,11 @@
 package amqp
 
-import "github.com/go-foreman/foreman/pubsub/transport"
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
 
 type QueueType string
 
@@ -17,6 +22,28 @@ func WithQueueType(v QueueType) QueueOptionsPatch {
 	}
 }
 
+// WithDeadLetterExchange makes the broker republish rejected and expired messages of the queue into the exchange with the routing key
+func WithDeadLetterExchange(exchange, routingKey string) QueueOptionsPatch {
+	return func(options *amqpQueue) {
+		options.deadLetterExchange = &exchange
+		options.deadLetterRoutingKey = routingKey
+	}
+}
+
+// WithMessageTTL expires messages which stayed in the queue longer than ttl, together with WithDeadLetterExchange it delays delivery
+func WithMessageTTL(ttl time.Duration) QueueOptionsPatch {
+	return func(options *amqpQueue) {
+		options.messageTTL = ttl
+	}
+}
+
+// WithExpires deletes the queue after it wasn't used for the duration
+func WithExpires(expires time.Duration) QueueOptionsPatch {
+	return func(options *amqpQueue) {
+		options.expires = expires
+	}
+}
+
 func Queue(name string, durable, autoDelete, exclusive, noWait bool, patches ...QueueOptionsPatch) transport.Queue {
 	q := amqpQueue{
 		queueName:  name,
@@ -40,6 +67,42 @@ type amqpQueue struct {
 	autoDelete bool
 	exclusive  bool
 	noWait     bool
+
+	deadLetterExchange   *string
+	deadLetterRoutingKey string
+	messageTTL           time.Duration
+	expires              time.Duration
+}
+
+// arguments returns optional arguments of the queue declaration, nil if there are none
+func (q amqpQueue) arguments() amqp.Table {
+	table := amqp.Table{}
+
+	switch q.queueType {
+	case QueueTypeQuorum:
+		table["x-queue-type"] = "quorum"
+	case QueueTypeClassic:
+		table["x-queue-type"] = "classic"
+	}
+
+	if q.deadLetterExchange != nil {
+		table["x-dead-letter-exchange"] = *q.deadLetterExchange
+		table["x-dead-letter-routing-key"] = q.deadLetterRoutingKey
+	}
+
+	if q.messageTTL > 0 {
+		table["x-message-ttl"] = q.messageTTL.Milliseconds()
+	}
+
+	if q.expires > 0 {
+		table["x-expires"] = q.expires.Milliseconds()
+	}
+
+	if len(table) == 0 {
+		return nil
+	}
+
+	return table
 }
 
 func (q amqpQueue) Name() string {
@@ -2,8 +2,24 @@ package amqp
 
 import "github.com/go-foreman/foreman/pubsub/transport"
 
-func Topic(name string, durable, autoDelete, internal, noWait bool) transport.Topic {
-	return amqpTopic{topicName: name, durable: durable, autoDelete: autoDelete, internal: internal, noWait: noWait}
+type TopicOptionsPatch func(options *amqpTopic)
+
+// WithDelayedMessageType declares the exchange as x-delayed-message (rabbitmq_delayed_message_exchange plugin) with topic routing.
+// Packages sent with WithDelay option will be held by the broker for the specified duration.
+func WithDelayedMessageType() TopicOptionsPatch {
+	return func(options *amqpTopic) {
+		options.delayed = true
+	}
+}
+
+func Topic(name string, durable, autoDelete, internal, noWait bool, patches ...TopicOptionsPatch) transport.Topic {
+	t := amqpTopic{topicName: name, durable: durable, autoDelete: autoDelete, internal: internal, noWait: noWait}
+
+	for _, patch := range patches {
+		patch(&t)
+	}
+
+	return t
 }
 
 type amqpTopic struct {
@@ -12,6 +28,7 @@ type amqpTopic struct {
 	autoDelete bool
 	internal   bool
 	noWait     bool
+	delayed    bool
 }
 
 func (a amqpTopic) Name() string {
@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"context"
+	"time"
+)
+
+//go:generate mockgen --build_flags=--mod=mod -destination mock_test.go -package kafka . Client,ConsumerGroup
+
+// Record is a kafka record produced or consumed by the transport
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string][]byte
+	Timestamp time.Time
+}
+
+// TopicSpec describes a topic created by CreateTopic
+type TopicSpec struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int16
+	Configs           map[string]string
+}
+
+// Client is an adapter of a kafka client library, e.g. sarama or franz-go. The transport depends on it only,
+// so foreman doesn't bring a kafka client into your dependencies and you keep the one your stack already uses.
+type Client interface {
+	// CreateTopic creates a topic, it must not fail if the topic already exists
+	CreateTopic(ctx context.Context, spec TopicSpec) error
+	// Produce writes records and waits until the cluster acknowledges them. The result contains an error of every record at its index,
+	// nil if the record is written. A nil result means all records are written.
+	Produce(ctx context.Context, records []*Record) []error
+	// ConsumerGroup creates a member of the consumer group
+	ConsumerGroup(groupID string) (ConsumerGroup, error)
+	// Close closes producers and connections to the cluster
+	Close() error
+}
+
+// ConsumerGroup is a member of a consumer group
+type ConsumerGroup interface {
+	// Consume joins the group and consumes topics for a generation of the group. Every partition assigned to the member is passed
+	// to handle in its own goroutine, handle returns when the partition is revoked. Consume returns when the generation ends,
+	// e.g. on rebalance, the transport calls it again until its context is done.
+	Consume(ctx context.Context, topics []string, handle func(claim Claim)) error
+	// Close leaves the group
+	Close() error
+}
+
+// Claim is a partition assigned to a member of a consumer group
+type Claim interface {
+	Topic() string
+	Partition() int32
+	// Records returns records of the partition in order, the channel is closed when the partition is revoked
+	Records() <-chan *Record
+	// Commit marks the record as consumed, the group resumes the partition after it
+	Commit(record *Record)
+}
@@ -0,0 +1,390 @@
+// Package kafka implements transport.Transport on kafka. Topics are kafka topics, queues are topics consumed by consumer groups.
+// Records are keyed by saga uid, so messages of a saga land in the same partition, and records of a partition are delivered
+// one by one: the next one is delivered after the previous is acknowledged.
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+func NewTransport(client Client, logger log.Logger, opts ...Opt) transport.Transport {
+	t := &kafkaTransport{
+		client:             client,
+		logger:             logger,
+		partitionKeyHeader: DefaultPartitionKeyHeader,
+		rejoinDelay:        DefaultRejoinDelay,
+		ackTimeout:         DefaultAckTimeout,
+		groups:             map[ConsumerGroup]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type kafkaTransport struct {
+	client             Client
+	logger             log.Logger
+	partitionKeyHeader string
+	rejoinDelay        time.Duration
+	ackTimeout         time.Duration
+	mutex              sync.Mutex
+	groups             map[ConsumerGroup]struct{}
+}
+
+// CreateTopic creates a topic described by kafka.Topic
+func (t *kafkaTransport) CreateTopic(ctx context.Context, topic transport.Topic) error {
+	kTopic, topicConv := topic.(kafkaTopic)
+
+	if !topicConv {
+		return errors.Errorf("supplied topic is not an instance of kafka.Topic")
+	}
+
+	if err := t.client.CreateTopic(ctx, TopicSpec{
+		Name:              kTopic.Name(),
+		Partitions:        kTopic.partitions,
+		ReplicationFactor: kTopic.replicationFactor,
+		Configs:           kTopic.configs,
+	}); err != nil {
+		return errors.Wrapf(err, "creating topic %s", kTopic.Name())
+	}
+
+	return nil
+}
+
+// CreateQueue only checks the queue: kafka creates a consumer group when its first member joins and has no bindings,
+// a group consumes the topic of the queue directly.
+func (t *kafkaTransport) CreateQueue(ctx context.Context, q transport.Queue, qbs ...transport.QueueBind) error {
+	if _, queueConv := q.(kafkaQueue); !queueConv {
+		return errors.Errorf("supplied Queue is not an instance of kafka.Queue")
+	}
+
+	if len(qbs) > 0 {
+		return errors.Errorf("kafka has no queue bindings, queue %s consumes its topic directly", q.Name())
+	}
+
+	return nil
+}
+
+func (t *kafkaTransport) Send(ctx context.Context, outboundPkg transport.OutboundPkg, options ...transport.SendOpt) error {
+	if err := t.SendBatch(ctx, []transport.OutboundPkg{outboundPkg}, options...); err != nil {
+		if batchErr, ok := err.(transport.BatchErr); ok {
+			return errors.Wrap(batchErr.Failed[0], "sending out pkg")
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// SendBatch produces records of all packages at once, packages the cluster didn't acknowledge are reported in transport.BatchErr
+func (t *kafkaTransport) SendBatch(ctx context.Context, outboundPkgs []transport.OutboundPkg, options ...transport.SendOpt) error {
+	if len(outboundPkgs) == 0 {
+		return nil
+	}
+
+	sendOptions := &sendOptions{}
+
+	for _, opt := range options {
+		if err := opt(sendOptions); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	records := make([]*Record, len(outboundPkgs))
+
+	for i, pkg := range outboundPkgs {
+		record, err := t.record(pkg, sendOptions)
+		if err != nil {
+			return errors.Wrapf(err, "creating record of pkg %d", i)
+		}
+
+		records[i] = record
+	}
+
+	failed := make(map[int]error)
+
+	for i, err := range t.client.Produce(ctx, records) {
+		if err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return transport.WithBatchErr(errors.Errorf("%d of %d pkgs weren't sent", len(failed), len(outboundPkgs)), failed)
+	}
+
+	return nil
+}
+
+func (t *kafkaTransport) record(pkg transport.OutboundPkg, sendOptions *sendOptions) (*Record, error) {
+	headers := message.Headers(pkg.Headers())
+
+	if pkg.ContentType() != "" && headers.ContentType() == "" {
+		headers = make(message.Headers, len(pkg.Headers())+1)
+		for k, v := range pkg.Headers() {
+			headers[k] = v
+		}
+		headers.SetContentType(pkg.ContentType())
+	}
+
+	encodedHeaders, err := encodeHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{Topic: pkg.Destination().DestinationTopic, Value: pkg.Payload(), Headers: encodedHeaders}
+
+	if publishedAt, ok := headers.PublishedAt(); ok {
+		record.Timestamp = publishedAt
+	}
+
+	if key := t.partitionKey(pkg, sendOptions); key != "" {
+		record.Key = []byte(key)
+	}
+
+	return record, nil
+}
+
+// partitionKey returns the key set by WithPartitionKey, the value of the partition key header or the routing key,
+// a record without a key is written to any partition
+func (t *kafkaTransport) partitionKey(pkg transport.OutboundPkg, sendOptions *sendOptions) string {
+	if sendOptions.PartitionKey != "" {
+		return sendOptions.PartitionKey
+	}
+
+	if key, _ := pkg.Headers()[t.partitionKeyHeader].(string); key != "" {
+		return key
+	}
+
+	return pkg.Destination().RoutingKey
+}
+
+// Consume joins consumer groups of queues. Records of every assigned partition are delivered in order, partitions are delivered in parallel.
+// A package nacked or rejected with transport.WithRequeue is delivered again before the rest of its partition, otherwise its record is committed.
+// A package which isn't acknowledged within the ack timeout is committed too, see WithAckTimeout.
+func (t *kafkaTransport) Consume(ctx context.Context, queues []transport.Queue, options ...transport.ConsumeOpt) (<-chan transport.IncomingPkg, error) {
+	consumeOptions := &consumeOptions{}
+
+	for _, opt := range options {
+		if err := opt(consumeOptions); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	var groupIDs []string
+	topicsByGroup := make(map[string][]string)
+
+	for _, q := range queues {
+		queue, queueConv := q.(kafkaQueue)
+		if !queueConv {
+			return nil, errors.Errorf("queue %s is not an instance of kafka.Queue", q.Name())
+		}
+
+		if _, exists := topicsByGroup[queue.groupID]; !exists {
+			groupIDs = append(groupIDs, queue.groupID)
+		}
+
+		topicsByGroup[queue.groupID] = append(topicsByGroup[queue.groupID], queue.topic)
+	}
+
+	groups := make([]ConsumerGroup, 0, len(groupIDs))
+
+	for _, groupID := range groupIDs {
+		group, err := t.client.ConsumerGroup(groupID)
+		if err != nil {
+			for _, g := range groups {
+				if err := g.Close(); err != nil {
+					t.logger.Logf(log.ErrorLevel, "error leaving consumer group. %s", err)
+				}
+			}
+
+			return nil, errors.Wrapf(err, "creating member of consumer group %s", groupID)
+		}
+
+		groups = append(groups, group)
+	}
+
+	income := make(chan transport.IncomingPkg)
+	consumersWait := &sync.WaitGroup{}
+
+	for i, group := range groups {
+		t.mutex.Lock()
+		t.groups[group] = struct{}{}
+		t.mutex.Unlock()
+
+		consumersWait.Add(1)
+
+		go func(groupID string, group ConsumerGroup) {
+			defer consumersWait.Done()
+			defer t.closeGroup(group)
+
+			t.consumeGroup(ctx, groupID, group, topicsByGroup[groupID], income, consumeOptions)
+		}(groupIDs[i], group)
+	}
+
+	go func() {
+		consumersWait.Wait()
+		close(income)
+	}()
+
+	return income, nil
+}
+
+// consumeGroup joins the group for every generation until ctx is done
+func (t *kafkaTransport) consumeGroup(ctx context.Context, groupID string, group ConsumerGroup, topics []string, income chan<- transport.IncomingPkg, consumeOptions *consumeOptions) {
+	for {
+		err := group.Consume(ctx, topics, func(claim Claim) {
+			t.consumeClaim(ctx, claim, income, consumeOptions)
+		})
+
+		if ctx.Err() != nil {
+			t.logger.Logf(log.WarnLevel, "canceled context. Stopped consuming group %s", groupID)
+			return
+		}
+
+		if !t.member(group) {
+			t.logger.Logf(log.WarnLevel, "disconnected. Stopped consuming group %s", groupID)
+			return
+		}
+
+		delay := time.Duration(0)
+
+		if err != nil {
+			t.logger.Logf(log.ErrorLevel, "error consuming group %s, joining again in %s. %s", groupID, t.rejoinDelay, err)
+			delay = t.rejoinDelay
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// consumeClaim delivers records of the partition one by one until the partition is revoked or ctx is done
+func (t *kafkaTransport) consumeClaim(ctx context.Context, claim Claim, income chan<- transport.IncomingPkg, consumeOptions *consumeOptions) {
+	for {
+		select {
+		case record, open := <-claim.Records():
+			if !open {
+				t.logger.Logf(log.InfoLevel, "partition %s/%d is revoked", claim.Topic(), claim.Partition())
+				return
+			}
+
+			if !t.deliver(ctx, record, income, consumeOptions) {
+				return
+			}
+
+			claim.Commit(record)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver delivers the record until it's acknowledged without requeue, false is returned if ctx is done before that
+func (t *kafkaTransport) deliver(ctx context.Context, record *Record, income chan<- transport.IncomingPkg, consumeOptions *consumeOptions) bool {
+	for {
+		pkg := newInPkg(record)
+
+		select {
+		case income <- pkg:
+		case <-ctx.Done():
+			return false
+		}
+
+		ack, acknowledged := t.awaitAck(ctx, pkg)
+		if !acknowledged {
+			return false
+		}
+
+		if !ack.requeue {
+			return true
+		}
+
+		select {
+		case <-time.After(consumeOptions.RedeliveryDelay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// awaitAck waits for the acknowledgment of the package. A package which isn't acknowledged within the ack timeout is acknowledged
+// by the transport, false is returned if ctx is done before that
+func (t *kafkaTransport) awaitAck(ctx context.Context, pkg *inKafkaPkg) (acknowledgment, bool) {
+	timer := time.NewTimer(t.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case ack := <-pkg.acks:
+		return ack, true
+	case <-timer.C:
+		if pkg.expire() {
+			t.logger.Logf(log.WarnLevel, "package %s of record %s/%d/%d wasn't acknowledged in %s, committing it", pkg.UID(), pkg.record.Topic, pkg.record.Partition, pkg.record.Offset, t.ackTimeout)
+			return acknowledgment{}, true
+		}
+
+		// acknowledged right when the timeout expired
+		return <-pkg.acks, true
+	case <-ctx.Done():
+		return acknowledgment{}, false
+	}
+}
+
+// member tells whether the group wasn't left by Disconnect
+func (t *kafkaTransport) member(group ConsumerGroup) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, exists := t.groups[group]
+
+	return exists
+}
+
+func (t *kafkaTransport) closeGroup(group ConsumerGroup) {
+	t.mutex.Lock()
+	_, exists := t.groups[group]
+	delete(t.groups, group)
+	t.mutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	if err := group.Close(); err != nil {
+		t.logger.Logf(log.ErrorLevel, "error leaving consumer group. %s", err)
+	}
+}
+
+// Disconnect leaves consumer groups and closes the client
+func (t *kafkaTransport) Disconnect(ctx context.Context) error {
+	t.mutex.Lock()
+	groups := t.groups
+	t.groups = map[ConsumerGroup]struct{}{}
+	t.mutex.Unlock()
+
+	for group := range groups {
+		if err := group.Close(); err != nil {
+			return errors.Wrap(err, "leaving one of consumer groups")
+		}
+	}
+
+	if err := t.client.Close(); err != nil {
+		return errors.Wrap(err, "closing client")
+	}
+
+	return nil
+}
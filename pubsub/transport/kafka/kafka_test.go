@@ -0,0 +1,397 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/testing/log"
+	subscriberMock "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type claimStub struct {
+	topic     string
+	partition int32
+	records   chan *Record
+	committed chan *Record
+}
+
+func newClaimStub(topic string, partition int32, records ...*Record) *claimStub {
+	c := &claimStub{topic: topic, partition: partition, records: make(chan *Record, len(records)), committed: make(chan *Record, len(records))}
+	for _, r := range records {
+		c.records <- r
+	}
+
+	return c
+}
+
+func (c *claimStub) Topic() string {
+	return c.topic
+}
+
+func (c *claimStub) Partition() int32 {
+	return c.partition
+}
+
+func (c *claimStub) Records() <-chan *Record {
+	return c.records
+}
+
+func (c *claimStub) Commit(record *Record) {
+	c.committed <- record
+}
+
+func TestKafkaTransport_CreateTopic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	clientMock := NewMockClient(ctrl)
+	kafkaTransport := NewTransport(clientMock, log.NewNilLogger())
+
+	t.Run("topic is created", func(t *testing.T) {
+		clientMock.EXPECT().CreateTopic(gomock.Any(), TopicSpec{Name: "orders", Partitions: 12, ReplicationFactor: 3, Configs: map[string]string{"retention.ms": "3600000"}}).Return(nil)
+		assert.NoError(t, kafkaTransport.CreateTopic(context.Background(), Topic("orders", 12, 3, WithTopicConfig("retention.ms", "3600000"))))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		clientMock.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(errors.New("not authorized"))
+		assert.EqualError(t, kafkaTransport.CreateTopic(context.Background(), Topic("orders", 12, 3)), "creating topic orders: not authorized")
+	})
+
+	t.Run("not a kafka topic", func(t *testing.T) {
+		assert.EqualError(t, kafkaTransport.CreateTopic(context.Background(), aTopic{}), "supplied topic is not an instance of kafka.Topic")
+	})
+}
+
+func TestKafkaTransport_CreateQueue(t *testing.T) {
+	kafkaTransport := NewTransport(nil, log.NewNilLogger())
+
+	assert.NoError(t, kafkaTransport.CreateQueue(context.Background(), Queue("orders", "billing")))
+	assert.EqualError(t, kafkaTransport.CreateQueue(context.Background(), aTopic{}), "supplied Queue is not an instance of kafka.Queue")
+	assert.EqualError(
+		t,
+		kafkaTransport.CreateQueue(context.Background(), Queue("orders", "billing"), transport.QueueBind(nil)),
+		"kafka has no queue bindings, queue orders consumes its topic directly",
+	)
+}
+
+func TestKafkaTransport_Send(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	clientMock := NewMockClient(ctrl)
+	kafkaTransport := NewTransport(clientMock, log.NewNilLogger())
+	destination := transport.DeliveryDestination{DestinationTopic: "orders", RoutingKey: "order.created"}
+
+	t.Run("record is keyed by saga uid", func(t *testing.T) {
+		pkg := transport.NewOutboundPkg([]byte("payload"), "application/json", destination, map[string]interface{}{"uid": "1", "sagaUID": "saga-1", "publishedAt": int64(1614592800000)})
+
+		clientMock.EXPECT().Produce(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records []*Record) []error {
+			require.Len(t, records, 1)
+			assert.Equal(t, "orders", records[0].Topic)
+			assert.Equal(t, []byte("saga-1"), records[0].Key)
+			assert.Equal(t, []byte("payload"), records[0].Value)
+			assert.Equal(t, int64(1614592800000), records[0].Timestamp.UnixNano()/int64(time.Millisecond))
+			assert.Equal(t, map[string][]byte{
+				"uid":         []byte(`"1"`),
+				"sagaUID":     []byte(`"saga-1"`),
+				"publishedAt": []byte(`1614592800000`),
+				"contentType": []byte(`"application/json"`),
+			}, records[0].Headers)
+			return nil
+		})
+
+		assert.NoError(t, kafkaTransport.Send(context.Background(), pkg))
+		assert.NotContains(t, pkg.Headers(), "contentType", "headers of the pkg aren't changed")
+	})
+
+	t.Run("partition key", func(t *testing.T) {
+		var keys []string
+
+		clientMock.EXPECT().Produce(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records []*Record) []error {
+			keys = append(keys, string(records[0].Key))
+			return nil
+		}).Times(3)
+
+		pkg := transport.NewOutboundPkg(nil, "", destination, map[string]interface{}{"sagaUID": "saga-1", "tenant": "tenant-1"})
+
+		require.NoError(t, kafkaTransport.Send(context.Background(), pkg, WithPartitionKey("explicit")))
+		require.NoError(t, NewTransport(clientMock, log.NewNilLogger(), WithPartitionKeyHeader("tenant")).Send(context.Background(), pkg))
+		require.NoError(t, kafkaTransport.Send(context.Background(), transport.NewOutboundPkg(nil, "", destination, nil)))
+
+		assert.Equal(t, []string{"explicit", "tenant-1", "order.created"}, keys)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		clientMock.EXPECT().Produce(gomock.Any(), gomock.Any()).Return([]error{errors.New("leader not available")})
+
+		err := kafkaTransport.Send(context.Background(), transport.NewOutboundPkg(nil, "", destination, nil))
+		assert.EqualError(t, err, "sending out pkg: leader not available")
+	})
+
+	t.Run("batch error", func(t *testing.T) {
+		clientMock.EXPECT().Produce(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, records []*Record) []error {
+			assert.Len(t, records, 3)
+			return []error{nil, errors.New("leader not available"), nil}
+		})
+
+		pkgs := []transport.OutboundPkg{
+			transport.NewOutboundPkg(nil, "", destination, nil),
+			transport.NewOutboundPkg(nil, "", destination, nil),
+			transport.NewOutboundPkg(nil, "", destination, nil),
+		}
+
+		err := kafkaTransport.SendBatch(context.Background(), pkgs)
+		require.Error(t, err)
+
+		batchErr, ok := err.(transport.BatchErr)
+		require.True(t, ok)
+		assert.Equal(t, []int{1}, batchErr.FailedIndexes())
+		assert.EqualError(t, batchErr, "1 of 3 pkgs weren't sent")
+	})
+
+	t.Run("wrong option", func(t *testing.T) {
+		err := kafkaTransport.Send(context.Background(), transport.NewOutboundPkg(nil, "", destination, nil), func(options interface{}) error {
+			_, err := convertConsumeOptsType(options)
+			return err
+		})
+		assert.EqualError(t, err, "this option must be called on kafka.consumeOptions type")
+	})
+}
+
+func TestKafkaTransport_Consume(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	record := func(offset int64, uid string) *Record {
+		return &Record{Topic: "orders", Offset: offset, Value: []byte(uid), Headers: map[string][]byte{"uid": []byte(`"` + uid + `"`)}}
+	}
+
+	receive := func(t *testing.T, income <-chan transport.IncomingPkg) transport.IncomingPkg {
+		select {
+		case pkg := <-income:
+			return pkg
+		case <-time.After(time.Second):
+			t.Fatal("no package is delivered")
+			return nil
+		}
+	}
+
+	t.Run("records of a partition are delivered in order", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		kafkaTransport := NewTransport(clientMock, log.NewNilLogger())
+
+		claim := newClaimStub("orders", 0, record(1, "first"), record(2, "second"))
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		groupMock.EXPECT().Consume(gomock.Any(), []string{"orders", "payments"}, gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+			handle(claim)
+			return nil
+		})
+		groupMock.EXPECT().Close().Return(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		income, err := kafkaTransport.Consume(ctx, []transport.Queue{Queue("orders", "billing"), Queue("payments", "billing")}, WithRedeliveryDelay(time.Millisecond))
+		require.NoError(t, err)
+
+		first := receive(t, income)
+		assert.Equal(t, "first", first.UID())
+		assert.Equal(t, "orders", first.Origin())
+
+		select {
+		case <-income:
+			t.Fatal("second record is delivered before the first is acknowledged")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		require.NoError(t, first.Nack(transport.WithRequeue()))
+		assert.EqualError(t, first.Ack(), "record orders/0/1 is already acknowledged")
+
+		redelivered := receive(t, income)
+		assert.Equal(t, "first", redelivered.UID())
+		require.NoError(t, redelivered.Ack())
+		assert.Equal(t, int64(1), (<-claim.committed).Offset)
+
+		second := receive(t, income)
+		assert.Equal(t, "second", second.UID())
+		require.NoError(t, second.Reject())
+		assert.Equal(t, int64(2), (<-claim.committed).Offset)
+
+		cancel()
+
+		_, open := <-income
+		assert.False(t, open)
+	})
+
+	t.Run("package whose processing failed doesn't block its partition", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		processorMock := subscriberMock.NewMockProcessor(ctrl)
+		testLogger := log.NewNilLogger()
+		kafkaTransport := NewTransport(clientMock, testLogger, WithAckTimeout(time.Millisecond*50))
+
+		claim := newClaimStub("orders", 0, record(1, "poison"), record(2, "next"))
+		left := make(chan struct{})
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		groupMock.EXPECT().Consume(gomock.Any(), []string{"orders"}, gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+			handle(claim)
+			return ctx.Err()
+		})
+		groupMock.EXPECT().Close().DoAndReturn(func() error {
+			close(left)
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// the subscriber neither acks nor nacks a package the processor failed
+		gomock.InOrder(
+			processorMock.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, pkg transport.IncomingPkg) error {
+				assert.Equal(t, "poison", pkg.UID())
+				return errors.New("no executors defined for message")
+			}),
+			processorMock.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, pkg transport.IncomingPkg) error {
+				assert.Equal(t, "next", pkg.UID())
+				cancel()
+				return nil
+			}),
+		)
+
+		sub := subscriber.NewSubscriber(kafkaTransport, processorMock, testLogger, subscriber.WithConfig(&subscriber.Config{
+			WorkersCount:                   1,
+			WorkerWaitingAssignmentTimeout: time.Second,
+			PackageProcessingMaxTime:       time.Second,
+			GracefulShutdownTimeout:        time.Second,
+		}))
+		require.NoError(t, sub.Run(ctx, Queue("orders", "billing")))
+		<-left
+
+		assert.Equal(t, int64(1), (<-claim.committed).Offset)
+		assert.Equal(t, int64(2), (<-claim.committed).Offset)
+		testLogger.AssertContainsSubstr(t, "package poison of record orders/0/1 wasn't acknowledged in 50ms, committing it")
+	})
+
+	t.Run("package acknowledged after the timeout gets an error", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		kafkaTransport := NewTransport(clientMock, log.NewNilLogger(), WithAckTimeout(time.Millisecond))
+
+		claim := newClaimStub("orders", 0, record(1, "slow"))
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		groupMock.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+			handle(claim)
+			return ctx.Err()
+		})
+		groupMock.EXPECT().Close().Return(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		income, err := kafkaTransport.Consume(ctx, []transport.Queue{Queue("orders", "billing")})
+		require.NoError(t, err)
+
+		pkg := receive(t, income)
+		assert.Equal(t, int64(1), (<-claim.committed).Offset)
+		assert.EqualError(t, pkg.Ack(), "record orders/0/1 is already acknowledged")
+
+		cancel()
+
+		_, open := <-income
+		assert.False(t, open)
+	})
+
+	t.Run("group is joined again after failure", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		testLogger := log.NewNilLogger()
+		kafkaTransport := NewTransport(clientMock, testLogger, WithRejoinDelay(time.Millisecond))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		rejoined := make(chan struct{})
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		gomock.InOrder(
+			groupMock.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("coordinator not available")),
+			groupMock.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+				claim := newClaimStub("orders", 0, record(1, "first"))
+				close(claim.records)
+				handle(claim)
+				return nil
+			}),
+			groupMock.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+				close(rejoined)
+				<-ctx.Done()
+				return ctx.Err()
+			}),
+		)
+		groupMock.EXPECT().Close().Return(nil)
+
+		income, err := kafkaTransport.Consume(ctx, []transport.Queue{Queue("orders", "billing")})
+		require.NoError(t, err)
+
+		pkg := receive(t, income)
+		assert.Equal(t, "first", pkg.UID())
+		require.NoError(t, pkg.Ack())
+
+		<-rejoined
+		cancel()
+
+		_, open := <-income
+		assert.False(t, open)
+
+		testLogger.AssertContainsSubstr(t, "error consuming group billing, joining again in 1ms. coordinator not available")
+	})
+
+	t.Run("failed to create group member", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		kafkaTransport := NewTransport(clientMock, log.NewNilLogger())
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		clientMock.EXPECT().ConsumerGroup("shipping").Return(nil, errors.New("not authorized"))
+		groupMock.EXPECT().Close().Return(nil)
+
+		_, err := kafkaTransport.Consume(context.Background(), []transport.Queue{Queue("orders", "billing"), Queue("orders", "shipping")})
+		assert.EqualError(t, err, "creating member of consumer group shipping: not authorized")
+	})
+
+	t.Run("disconnect leaves groups", func(t *testing.T) {
+		clientMock := NewMockClient(ctrl)
+		groupMock := NewMockConsumerGroup(ctrl)
+		kafkaTransport := NewTransport(clientMock, log.NewNilLogger())
+
+		left := make(chan struct{})
+
+		clientMock.EXPECT().ConsumerGroup("billing").Return(groupMock, nil)
+		groupMock.EXPECT().Consume(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, topics []string, handle func(claim Claim)) error {
+			<-left
+			return nil
+		})
+		groupMock.EXPECT().Close().DoAndReturn(func() error {
+			close(left)
+			return nil
+		})
+		clientMock.EXPECT().Close().Return(nil)
+
+		income, err := kafkaTransport.Consume(context.Background(), []transport.Queue{Queue("orders", "billing")})
+		require.NoError(t, err)
+
+		require.NoError(t, kafkaTransport.Disconnect(context.Background()))
+
+		_, open := <-income
+		assert.False(t, open)
+	})
+}
+
+type aTopic struct{}
+
+func (a aTopic) Name() string {
+	return "a"
+}
@@ -0,0 +1,143 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/go-foreman/foreman/pubsub/transport/kafka (interfaces: Client,ConsumerGroup)
+
+// Package kafka is a generated GoMock package.
+package kafka
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockClient is a mock of Client interface.
+type MockClient struct {
+	ctrl     *gomock.Controller
+	recorder *MockClientMockRecorder
+}
+
+// MockClientMockRecorder is the mock recorder for MockClient.
+type MockClientMockRecorder struct {
+	mock *MockClient
+}
+
+// NewMockClient creates a new mock instance.
+func NewMockClient(ctrl *gomock.Controller) *MockClient {
+	mock := &MockClient{ctrl: ctrl}
+	mock.recorder = &MockClientMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockClient) EXPECT() *MockClientMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockClient) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockClientMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockClient)(nil).Close))
+}
+
+// ConsumerGroup mocks base method.
+func (m *MockClient) ConsumerGroup(arg0 string) (ConsumerGroup, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumerGroup", arg0)
+	ret0, _ := ret[0].(ConsumerGroup)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumerGroup indicates an expected call of ConsumerGroup.
+func (mr *MockClientMockRecorder) ConsumerGroup(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumerGroup", reflect.TypeOf((*MockClient)(nil).ConsumerGroup), arg0)
+}
+
+// CreateTopic mocks base method.
+func (m *MockClient) CreateTopic(arg0 context.Context, arg1 TopicSpec) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateTopic", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateTopic indicates an expected call of CreateTopic.
+func (mr *MockClientMockRecorder) CreateTopic(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTopic", reflect.TypeOf((*MockClient)(nil).CreateTopic), arg0, arg1)
+}
+
+// Produce mocks base method.
+func (m *MockClient) Produce(arg0 context.Context, arg1 []*Record) []error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Produce", arg0, arg1)
+	ret0, _ := ret[0].([]error)
+	return ret0
+}
+
+// Produce indicates an expected call of Produce.
+func (mr *MockClientMockRecorder) Produce(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Produce", reflect.TypeOf((*MockClient)(nil).Produce), arg0, arg1)
+}
+
+// MockConsumerGroup is a mock of ConsumerGroup interface.
+type MockConsumerGroup struct {
+	ctrl     *gomock.Controller
+	recorder *MockConsumerGroupMockRecorder
+}
+
+// MockConsumerGroupMockRecorder is the mock recorder for MockConsumerGroup.
+type MockConsumerGroupMockRecorder struct {
+	mock *MockConsumerGroup
+}
+
+// NewMockConsumerGroup creates a new mock instance.
+func NewMockConsumerGroup(ctrl *gomock.Controller) *MockConsumerGroup {
+	mock := &MockConsumerGroup{ctrl: ctrl}
+	mock.recorder = &MockConsumerGroupMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockConsumerGroup) EXPECT() *MockConsumerGroupMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockConsumerGroup) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockConsumerGroupMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockConsumerGroup)(nil).Close))
+}
+
+// Consume mocks base method.
+func (m *MockConsumerGroup) Consume(arg0 context.Context, arg1 []string, arg2 func(Claim)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Consume", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Consume indicates an expected call of Consume.
+func (mr *MockConsumerGroupMockRecorder) Consume(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Consume", reflect.TypeOf((*MockConsumerGroup)(nil).Consume), arg0, arg1, arg2)
+}
@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+// DefaultPartitionKeyHeader is the header saga uid is kept in by default, records of a saga are written to the same partition
+const DefaultPartitionKeyHeader = "sagaUID"
+
+// DefaultRejoinDelay is the time the transport waits before joining a consumer group again after it failed
+const DefaultRejoinDelay = time.Second
+
+// DefaultAckTimeout is how long a delivered package may stay unacknowledged, a second more than subscriber.DefaultConfig.PackageProcessingMaxTime
+const DefaultAckTimeout = time.Second * 61
+
+type Opt func(t *kafkaTransport)
+
+// WithPartitionKeyHeader sets the header whose value is the key of a record. Pass the header of saga.WithSagaUIDHeader if it's changed.
+func WithPartitionKeyHeader(header string) Opt {
+	return func(t *kafkaTransport) {
+		t.partitionKeyHeader = header
+	}
+}
+
+// WithRejoinDelay sets the time the transport waits before joining a consumer group again after it failed, DefaultRejoinDelay by default
+func WithRejoinDelay(delay time.Duration) Opt {
+	return func(t *kafkaTransport) {
+		t.rejoinDelay = delay
+	}
+}
+
+// WithAckTimeout commits the record of a package which isn't acknowledged in time, DefaultAckTimeout by default. The subscriber
+// doesn't acknowledge a package whose processing failed, such record would block its partition until the next rebalance otherwise.
+// Set it a bit over subscriber.Config.PackageProcessingMaxTime, a package acknowledged later gets an error.
+func WithAckTimeout(timeout time.Duration) Opt {
+	return func(t *kafkaTransport) {
+		t.ackTimeout = timeout
+	}
+}
+
+type consumeOptions struct {
+	RedeliveryDelay time.Duration
+}
+
+func convertConsumeOptsType(options interface{}) (*consumeOptions, error) {
+	opts, ok := options.(*consumeOptions)
+
+	if !ok {
+		return nil, errors.Errorf("this option must be called on kafka.consumeOptions type")
+	}
+
+	return opts, nil
+}
+
+func convertSendOptsType(options interface{}) (*sendOptions, error) {
+	opts, ok := options.(*sendOptions)
+
+	if !ok {
+		return nil, errors.Errorf("this option must be called on kafka.sendOptions type")
+	}
+
+	return opts, nil
+}
+
+// WithRedeliveryDelay delays delivering a package again after it's nacked with requeue. Other records of its partition wait too,
+// the order of a partition is kept.
+func WithRedeliveryDelay(delay time.Duration) transport.ConsumeOpt {
+	return func(options interface{}) error {
+		opts, err := convertConsumeOptsType(options)
+
+		if err != nil {
+			return errors.Wrap(err, "calling WithRedeliveryDelay opt")
+		}
+
+		opts.RedeliveryDelay = delay
+
+		return nil
+	}
+}
+
+type sendOptions struct {
+	PartitionKey string
+}
+
+// WithPartitionKey sets the key of sent records instead of the one taken from the partition key header
+func WithPartitionKey(key string) transport.SendOpt {
+	return func(options interface{}) error {
+		opts, err := convertSendOptsType(options)
+
+		if err != nil {
+			return errors.Wrap(err, "calling WithPartitionKey opt")
+		}
+
+		opts.PartitionKey = key
+
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+// encodeHeaders encodes values of headers as json, so their types survive kafka headers which are bytes
+func encodeHeaders(headers map[string]interface{}) (map[string][]byte, error) {
+	encoded := make(map[string][]byte, len(headers))
+
+	for k, v := range headers {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encoding header %s", k)
+		}
+
+		encoded[k] = value
+	}
+
+	return encoded, nil
+}
+
+// decodeHeaders decodes headers encoded by encodeHeaders. Whole numbers are decoded as int64,
+// a value which isn't json, e.g. written by another producer, is kept as a string.
+func decodeHeaders(encoded map[string][]byte) map[string]interface{} {
+	headers := make(map[string]interface{}, len(encoded))
+
+	for k, value := range encoded {
+		var v interface{}
+
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&v); err != nil || decoder.More() {
+			headers[k] = string(value)
+			continue
+		}
+
+		if number, isNumber := v.(json.Number); isNumber {
+			if n, err := number.Int64(); err == nil {
+				v = n
+			} else if f, err := number.Float64(); err == nil {
+				v = f
+			}
+		}
+
+		headers[k] = v
+	}
+
+	return headers
+}
+
+type acknowledgment struct {
+	requeue bool
+}
+
+// inKafkaPkg is a record delivered to the subscriber. The claim doesn't deliver the next record of the partition
+// until the package is acknowledged.
+type inKafkaPkg struct {
+	record       *Record
+	headers      map[string]interface{}
+	receivedAt   time.Time
+	acknowledged int32
+	acks         chan acknowledgment
+}
+
+func newInPkg(record *Record) *inKafkaPkg {
+	return &inKafkaPkg{
+		record:     record,
+		headers:    decodeHeaders(record.Headers),
+		receivedAt: time.Now(),
+		acks:       make(chan acknowledgment, 1),
+	}
+}
+
+func (i *inKafkaPkg) UID() string {
+	uid, _ := i.headers["uid"].(string)
+	return uid
+}
+
+func (i *inKafkaPkg) Origin() string {
+	return i.record.Topic
+}
+
+func (i *inKafkaPkg) Payload() []byte {
+	return i.record.Value
+}
+
+func (i *inKafkaPkg) Headers() map[string]interface{} {
+	return i.headers
+}
+
+// Ack commits the record
+func (i *inKafkaPkg) Ack(options ...transport.AcknowledgmentOption) error {
+	return i.acknowledge(acknowledgment{})
+}
+
+// Nack commits the record, with WithRequeue the record is delivered again instead
+func (i *inKafkaPkg) Nack(options ...transport.AcknowledgmentOption) error {
+	return i.acknowledge(acknowledgment{requeue: requeued(options)})
+}
+
+// Reject commits the record, with WithRequeue the record is delivered again instead
+func (i *inKafkaPkg) Reject(options ...transport.AcknowledgmentOption) error {
+	return i.acknowledge(acknowledgment{requeue: requeued(options)})
+}
+
+func (i *inKafkaPkg) acknowledge(ack acknowledgment) error {
+	if !atomic.CompareAndSwapInt32(&i.acknowledged, 0, 1) {
+		return errors.Errorf("record %s/%d/%d is already acknowledged", i.record.Topic, i.record.Partition, i.record.Offset)
+	}
+
+	i.acks <- ack
+
+	return nil
+}
+
+// expire acknowledges the package on behalf of the transport, false is returned if it's already acknowledged
+func (i *inKafkaPkg) expire() bool {
+	return atomic.CompareAndSwapInt32(&i.acknowledged, 0, 1)
+}
+
+func (i *inKafkaPkg) PublishedAt() time.Time {
+	return i.record.Timestamp
+}
+
+func (i *inKafkaPkg) ReceivedAt() time.Time {
+	return i.receivedAt
+}
+
+func requeued(options []transport.AcknowledgmentOption) bool {
+	optsMap := map[string]interface{}{}
+	for _, opt := range options {
+		opt(optsMap)
+	}
+
+	requeue, _ := optsMap["requeue"].(bool)
+
+	return requeue
+}
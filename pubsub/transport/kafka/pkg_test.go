@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	headers := message.Headers{"uid": "1", "attempts": int64(2), "ratio": 0.5, "valid": true}
+	headers.SetPublishedAt(time.Now())
+
+	encoded, err := encodeHeaders(headers)
+	require.NoError(t, err)
+
+	decoded := message.Headers(decodeHeaders(encoded))
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, 2, decoded.Attempts())
+
+	t.Run("headers of other producers are strings", func(t *testing.T) {
+		assert.Equal(t, map[string]interface{}{"source": "legacy service", "id": "42 43"}, decodeHeaders(map[string][]byte{
+			"source": []byte("legacy service"),
+			"id":     []byte("42 43"),
+		}))
+	})
+
+	t.Run("unsupported value", func(t *testing.T) {
+		_, err := encodeHeaders(map[string]interface{}{"callback": func() {}})
+		assert.EqualError(t, err, "encoding header callback: json: unsupported type: func()")
+	})
+}
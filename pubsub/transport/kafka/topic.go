@@ -0,0 +1,59 @@
+package kafka
+
+import "github.com/go-foreman/foreman/pubsub/transport"
+
+type TopicOptionsPatch func(options *kafkaTopic)
+
+// WithTopicConfig sets a config entry of the topic, e.g. retention.ms
+func WithTopicConfig(name, value string) TopicOptionsPatch {
+	return func(options *kafkaTopic) {
+		if options.configs == nil {
+			options.configs = make(map[string]string)
+		}
+
+		options.configs[name] = value
+	}
+}
+
+// Topic describes a topic with a number of partitions and a replication factor. Records of a partition are delivered in order,
+// so the number of partitions limits how many packages of the topic are processed in parallel.
+func Topic(name string, partitions int32, replicationFactor int16, patches ...TopicOptionsPatch) transport.Topic {
+	t := kafkaTopic{topicName: name, partitions: partitions, replicationFactor: replicationFactor}
+
+	for _, patch := range patches {
+		patch(&t)
+	}
+
+	return t
+}
+
+type kafkaTopic struct {
+	topicName         string
+	partitions        int32
+	replicationFactor int16
+	configs           map[string]string
+}
+
+func (k kafkaTopic) Name() string {
+	return k.topicName
+}
+
+// Queue describes a topic consumed by a consumer group. Members of the group share partitions of the topic,
+// every group receives all records of the topic.
+func Queue(topic, groupID string) transport.Queue {
+	return kafkaQueue{topic: topic, groupID: groupID}
+}
+
+type kafkaQueue struct {
+	topic   string
+	groupID string
+}
+
+func (k kafkaQueue) Name() string {
+	return k.topic
+}
+
+// GroupID returns the id of the consumer group
+func (k kafkaQueue) GroupID() string {
+	return k.groupID
+}
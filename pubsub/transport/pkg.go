@@ -58,3 +58,10 @@ type DeliveryDestination struct {
 }
 
 type AcknowledgmentOption func(options map[string]interface{})
+
+// WithRequeue asks the transport to deliver a nacked or rejected package again
+func WithRequeue() AcknowledgmentOption {
+	return func(options map[string]interface{}) {
+		options["requeue"] = true
+	}
+}
@@ -0,0 +1,285 @@
+// Package push receives messages pushed over http, e.g. by GCP Pub/Sub push subscriptions, instead of consuming them from a broker.
+// Handler passes each request through the same Processor as the subscriber, so decoding, dispatching, middlewares and sagas
+// work identically whatever transport a message came by.
+package push
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/tracing"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxBodySize limits the size of a request body unless WithMaxBodySize says otherwise
+const DefaultMaxBodySize = 10 << 20
+
+// numericHeaders are headers foreman writes as numbers, http headers and Pub/Sub attributes carry them as strings
+var numericHeaders = []string{message.PublishedAtHeader, message.AttemptsHeader, message.HandlingAttemptsHeader}
+
+// Message is a message extracted from a push request
+type Message struct {
+	UID     string
+	Payload []byte
+	Headers message.Headers
+}
+
+// RequestDecoder extracts a message from a push request
+type RequestDecoder func(r *http.Request) (*Message, error)
+
+// HeaderMapping maps names of http headers to names of message headers, http names are canonicalized
+type HeaderMapping map[string]string
+
+// DefaultHeaderMapping maps X-Message-* http headers to headers set by foreman endpoints and handlers
+var DefaultHeaderMapping = HeaderMapping{
+	"X-Message-Uid":               "uid",
+	"X-Message-Trace-Id":          message.TraceIDHeader,
+	"X-Message-Content-Type":      message.ContentTypeHeader,
+	"X-Message-Published-At":      message.PublishedAtHeader,
+	"X-Message-Attempts":          message.AttemptsHeader,
+	"X-Message-Handling-Attempts": message.HandlingAttemptsHeader,
+	"X-Message-Saga-Uid":          "sagaUID",
+	"X-Message-Signature":         signing.SignatureHeader,
+	"X-Message-Signature-Key-Id":  signing.KeyIDHeader,
+	"X-Message-Signed-Headers":    signing.SignedHeadersHeader,
+	"X-Message-Traceparent":       tracing.TraceParentHeader,
+	"X-Message-Tracestate":        tracing.TraceStateHeader,
+}
+
+// RawRequest reads the raw payload from the body of a request and message headers from http headers listed in mapping,
+// other http headers are ignored. The message uid is taken from the uid header.
+func RawRequest(mapping HeaderMapping) RequestDecoder {
+	canonical := make(HeaderMapping, len(mapping))
+	for httpHeader, msgHeader := range mapping {
+		canonical[http.CanonicalHeaderKey(httpHeader)] = msgHeader
+	}
+
+	return func(r *http.Request) (*Message, error) {
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading body")
+		}
+
+		headers := make(message.Headers)
+
+		for httpHeader, msgHeader := range canonical {
+			if value := r.Header.Get(httpHeader); value != "" {
+				headers[msgHeader] = value
+			}
+		}
+
+		convertNumericHeaders(headers)
+		uid, _ := headers["uid"].(string)
+
+		return &Message{UID: uid, Payload: payload, Headers: headers}, nil
+	}
+}
+
+// pubSubPush is a body of a request made by GCP Pub/Sub push subscription
+type pubSubPush struct {
+	Message struct {
+		Attributes  map[string]string `json:"attributes"`
+		Data        string            `json:"data"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PubSubRequest decodes a push request of GCP Pub/Sub: the payload is base64 data of the message and headers are its attributes.
+// Pub/Sub message id is used as uid if attributes have no uid, publish time is used if they have no publishedAt.
+func PubSubRequest() RequestDecoder {
+	return func(r *http.Request) (*Message, error) {
+		push := &pubSubPush{}
+		if err := json.NewDecoder(r.Body).Decode(push); err != nil {
+			return nil, errors.Wrap(err, "decoding pub/sub push request")
+		}
+
+		payload, err := base64.StdEncoding.DecodeString(push.Message.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding data of pub/sub message")
+		}
+
+		headers := make(message.Headers, len(push.Message.Attributes)+2)
+		for k, v := range push.Message.Attributes {
+			headers[k] = v
+		}
+
+		convertNumericHeaders(headers)
+
+		uid, _ := headers["uid"].(string)
+		if uid == "" {
+			uid = push.Message.MessageID
+			headers["uid"] = uid
+		}
+
+		if _, ok := headers.PublishedAt(); !ok && !push.Message.PublishTime.IsZero() {
+			headers.SetPublishedAt(push.Message.PublishTime)
+		}
+
+		return &Message{UID: uid, Payload: payload, Headers: headers}, nil
+	}
+}
+
+func convertNumericHeaders(headers message.Headers) {
+	for _, key := range numericHeaders {
+		value, ok := headers[key].(string)
+		if !ok {
+			continue
+		}
+
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			headers[key] = n
+		}
+	}
+}
+
+type opts struct {
+	decoder     RequestDecoder
+	middlewares []func(http.Handler) http.Handler
+	origin      string
+	maxBodySize int64
+}
+
+// Opt configures Handler
+type Opt func(o *opts)
+
+// WithDecoder sets how messages are extracted from requests, RawRequest(DefaultHeaderMapping) by default
+func WithDecoder(decoder RequestDecoder) Opt {
+	return func(o *opts) {
+		o.decoder = decoder
+	}
+}
+
+// WithMiddlewares wraps the handler with http middlewares, e.g. the one authenticating requests to your api server.
+// The first one is the outermost.
+func WithMiddlewares(middlewares ...func(http.Handler) http.Handler) Opt {
+	return func(o *opts) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithOrigin sets the origin of received messages, the path of a request is used by default
+func WithOrigin(origin string) Opt {
+	return func(o *opts) {
+		o.origin = origin
+	}
+}
+
+// WithMaxBodySize limits the size of a request body, DefaultMaxBodySize by default
+func WithMaxBodySize(size int64) Opt {
+	return func(o *opts) {
+		o.maxBodySize = size
+	}
+}
+
+// NewHandler creates an http.Handler which accepts POST requests with messages and passes them to the processor.
+// A processed message is acknowledged with 204, a message which failed to be processed is answered with 500, so the pusher
+// delivers it again. A request which carries no message is answered with 400.
+func NewHandler(processor subscriber.Processor, logger log.Logger, passedOpts ...Opt) http.Handler {
+	o := &opts{decoder: RawRequest(DefaultHeaderMapping), maxBodySize: DefaultMaxBodySize}
+
+	for _, opt := range passedOpts {
+		opt(o)
+	}
+
+	var handler http.Handler = &pushHandler{processor: processor, logger: logger, opts: o}
+
+	for i := len(o.middlewares) - 1; i >= 0; i-- {
+		handler = o.middlewares[i](handler)
+	}
+
+	return handler
+}
+
+type pushHandler struct {
+	processor subscriber.Processor
+	logger    log.Logger
+	opts      *opts
+}
+
+func (h *pushHandler) ServeHTTP(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receivedAt := time.Now()
+	r.Body = http.MaxBytesReader(resp, r.Body, h.opts.maxBodySize)
+
+	msg, err := h.opts.decoder(r)
+	if err != nil {
+		h.logger.Logf(log.ErrorLevel, "Failed to decode pushed message. %s", err)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	origin := h.opts.origin
+	if origin == "" {
+		origin = r.URL.Path
+	}
+
+	inPkg := &incomingPkg{msg: msg, origin: origin, receivedAt: receivedAt}
+
+	if err := h.processor.Process(r.Context(), inPkg); err != nil {
+		h.logger.Logf(log.ErrorLevel, "Failed to process pushed message %s. %s", msg.UID, err)
+		http.Error(resp, "message is not processed", http.StatusInternalServerError)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// incomingPkg is a pushed message, it's acknowledged by the status of the response, so Ack, Nack and Reject do nothing
+type incomingPkg struct {
+	msg        *Message
+	origin     string
+	receivedAt time.Time
+}
+
+func (i incomingPkg) UID() string {
+	return i.msg.UID
+}
+
+func (i incomingPkg) Origin() string {
+	return i.origin
+}
+
+func (i incomingPkg) Payload() []byte {
+	return i.msg.Payload
+}
+
+func (i incomingPkg) Headers() map[string]interface{} {
+	return i.msg.Headers
+}
+
+func (i incomingPkg) Ack(options ...transport.AcknowledgmentOption) error {
+	return nil
+}
+
+func (i incomingPkg) Nack(options ...transport.AcknowledgmentOption) error {
+	return nil
+}
+
+func (i incomingPkg) Reject(options ...transport.AcknowledgmentOption) error {
+	return nil
+}
+
+func (i incomingPkg) PublishedAt() time.Time {
+	publishedAt, _ := i.msg.Headers.PublishedAt()
+	return publishedAt
+}
+
+func (i incomingPkg) ReceivedAt() time.Time {
+	return i.receivedAt
+}
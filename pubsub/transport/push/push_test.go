@@ -0,0 +1,153 @@
+package push
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/testing/log"
+	subscriberMock "github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	processorMock := subscriberMock.NewMockProcessor(ctrl)
+
+	t.Run("raw request is processed", func(t *testing.T) {
+		handler := NewHandler(processorMock, testLogger)
+
+		req := httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader(`{"kind":"CreateOrder"}`))
+		req.Header.Set("X-Message-Uid", "uid-1")
+		req.Header.Set("X-Message-Trace-Id", "trace-1")
+		req.Header.Set("X-Message-Attempts", "2")
+		req.Header.Set("Authorization", "Bearer secret")
+
+		processorMock.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+			assert.Equal(t, "uid-1", inPkg.UID())
+			assert.Equal(t, "/push/orders", inPkg.Origin())
+			assert.Equal(t, []byte(`{"kind":"CreateOrder"}`), inPkg.Payload())
+			assert.Equal(t, map[string]interface{}{"uid": "uid-1", message.TraceIDHeader: "trace-1", message.AttemptsHeader: int64(2)}, inPkg.Headers())
+			assert.False(t, inPkg.ReceivedAt().IsZero())
+			return nil
+		})
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+	})
+
+	t.Run("failed message is answered with an error to be pushed again", func(t *testing.T) {
+		handler := NewHandler(processorMock, testLogger, WithOrigin("orders"))
+
+		processorMock.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+			assert.Equal(t, "orders", inPkg.Origin())
+			return errors.New("dispatcher failed")
+		})
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader("{}")))
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		testLogger.AssertContainsSubstr(t, "dispatcher failed")
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		NewHandler(processorMock, testLogger).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/push/orders", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	})
+
+	t.Run("body is too large", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		handler := NewHandler(processorMock, testLogger, WithMaxBodySize(2))
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader("{}{}")))
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("middlewares wrap the handler", func(t *testing.T) {
+		var order []string
+		middleware := func(name string) func(http.Handler) http.Handler {
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(resp http.ResponseWriter, r *http.Request) {
+					order = append(order, name)
+					if r.Header.Get("Authorization") != "Bearer secret" {
+						http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+						return
+					}
+					next.ServeHTTP(resp, r)
+				})
+			}
+		}
+
+		handler := NewHandler(processorMock, testLogger, WithMiddlewares(middleware("first"), middleware("second")))
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader("{}")))
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Equal(t, []string{"first"}, order)
+
+		order = nil
+		processorMock.EXPECT().Process(gomock.Any(), gomock.Any()).Return(nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+		assert.Equal(t, []string{"first", "second"}, order)
+	})
+}
+
+func TestPubSubRequest(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString([]byte(`{"kind":"CreateOrder"}`))
+	publishTime := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	push := func(attributes string) *http.Request {
+		body := fmt.Sprintf(`{"message":{"attributes":%s,"data":"%s","messageId":"pubsub-1","publishTime":"%s"},"subscription":"projects/p/subscriptions/orders"}`, attributes, data, publishTime.Format(time.RFC3339))
+		return httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader(body))
+	}
+
+	t.Run("attributes are headers", func(t *testing.T) {
+		msg, err := PubSubRequest()(push(`{"uid":"uid-1","traceId":"trace-1","publishedAt":"1614592800000000000"}`))
+		require.NoError(t, err)
+
+		assert.Equal(t, "uid-1", msg.UID)
+		assert.Equal(t, []byte(`{"kind":"CreateOrder"}`), msg.Payload)
+		assert.Equal(t, "trace-1", msg.Headers[message.TraceIDHeader])
+		assert.Equal(t, int64(1614592800000000000), msg.Headers[message.PublishedAtHeader])
+	})
+
+	t.Run("pub/sub message id and publish time are used if attributes have none", func(t *testing.T) {
+		msg, err := PubSubRequest()(push(`{}`))
+		require.NoError(t, err)
+
+		assert.Equal(t, "pubsub-1", msg.UID)
+		assert.Equal(t, "pubsub-1", msg.Headers["uid"])
+
+		publishedAt, exists := msg.Headers.PublishedAt()
+		require.True(t, exists)
+		assert.True(t, publishTime.Equal(publishedAt))
+	})
+
+	t.Run("invalid envelope", func(t *testing.T) {
+		_, err := PubSubRequest()(httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader("not json")))
+		assert.Error(t, err)
+
+		_, err = PubSubRequest()(httptest.NewRequest(http.MethodPost, "/push/orders", strings.NewReader(`{"message":{"data":"%%%"}}`)))
+		assert.EqualError(t, err, "decoding data of pub/sub message: illegal base64 data at input byte 0")
+	})
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"sort"
 )
 
 //go:generate mockgen --build_flags=--mod=mod -destination ../../testing/mocks/pubsub/transport/transport.go -package transport . Transport
@@ -15,6 +16,9 @@ type Transport interface {
 	Consume(ctx context.Context, queues []Queue, options ...ConsumeOpt) (<-chan IncomingPkg, error)
 	// Send sends an outbound package to a defined destination topic in OutboundPkg
 	Send(ctx context.Context, outboundPkg OutboundPkg, options ...SendOpt) error
+	// SendBatch sends outbound packages at once and waits until the broker confirms them.
+	// If some of them aren't confirmed BatchErr with their indexes is returned.
+	SendBatch(ctx context.Context, outboundPkgs []OutboundPkg, options ...SendOpt) error
 	// Disconnect disconnects from publishing and consuming channels
 	Disconnect(context.Context) error
 }
@@ -34,3 +38,26 @@ type QueueBind interface {
 
 type ConsumeOpt func(options interface{}) error
 type SendOpt func(options interface{}) error
+
+// BatchErr is returned by Transport.SendBatch if some of packages weren't sent. Failed contains errors by indexes of packages,
+// packages with other indexes were sent.
+type BatchErr struct {
+	error
+	Failed map[int]error
+}
+
+func WithBatchErr(err error, failed map[int]error) error {
+	return BatchErr{error: err, Failed: failed}
+}
+
+// FailedIndexes returns sorted indexes of packages which weren't sent
+func (e BatchErr) FailedIndexes() []int {
+	indexes := make([]int, 0, len(e.Failed))
+	for i := range e.Failed {
+		indexes = append(indexes, i)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes
+}
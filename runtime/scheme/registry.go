@@ -3,6 +3,10 @@ package scheme
 import (
 	"fmt"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -19,47 +23,95 @@ type KnownTypesRegistry interface {
 	NewObject(gk GroupKind) (Object, error)
 	// ObjectKind returns GroupKind of an already registered type
 	ObjectKind(object Object) (*GroupKind, error)
+	// Scoped returns a view of the registry which attributes all registrations made through it to the owner
+	Scoped(owner string) KnownTypesRegistry
+	// Validate returns ConflictErr if the same GroupKind was registered with different types
+	Validate() error
+	// DumpOwnership returns all registered GroupKinds together with their types and registration sites
+	DumpOwnership() []Ownership
+}
+
+// Ownership describes who registered a type behind GroupKind
+type Ownership struct {
+	GroupKind GroupKind `json:"groupKind"`
+	Type      string    `json:"type"`
+	Owner     string    `json:"owner,omitempty"`
+	Site      string    `json:"site"`
+}
+
+// String returns the registration site in a readable form
+func (o Ownership) String() string {
+	if o.Owner == "" {
+		return fmt.Sprintf("%s at %s", o.Type, o.Site)
+	}
+
+	return fmt.Sprintf("%s by %s at %s", o.Type, o.Owner, o.Site)
+}
+
+// Conflict is a registration of a GroupKind with a type different from the one registered first
+type Conflict struct {
+	GroupKind GroupKind
+	Existing  Ownership
+	Rejected  Ownership
+}
+
+// ConflictErr is returned by Validate when registry contains conflicting registrations
+type ConflictErr struct {
+	error
+	Conflicts []Conflict
 }
 
 // NewKnownTypesRegistry returns new empty registry of types
 func NewKnownTypesRegistry() KnownTypesRegistry {
-	return &knownTypesRegistry{gvkToType: map[GroupKind]reflect.Type{}, typeToGVK: map[reflect.Type]GroupKind{}}
+	return &knownTypesRegistry{
+		gvkToType: map[GroupKind]reflect.Type{},
+		typeToGVK: map[reflect.Type]GroupKind{},
+		owners:    map[GroupKind]Ownership{},
+	}
 }
 
+// knownTypesRegistry may be extended while messages are decoded, e.g. by plugins loaded after the bus is started, so it's guarded by mutex
 type knownTypesRegistry struct {
+	mutex sync.RWMutex
 	// versionMap allows one to figure out the go type of an object with
 	// the given version and name.
 	gvkToType map[GroupKind]reflect.Type
 	// typeToGroupVersion allows one to find metadata for a given go object.
 	// The reflect.Type we index by should *not* be a pointer.
 	typeToGVK map[reflect.Type]GroupKind
+	// owners keeps the first registration site of each GroupKind
+	owners    map[GroupKind]Ownership
+	conflicts []Conflict
 }
 
 // AddKnownTypes registers list of types of objects to a Group. Kind of each type will be set as struct name using reflection
 func (r *knownTypesRegistry) AddKnownTypes(g Group, types ...Object) {
-	for _, obj := range types {
-		structType := GetStructType(obj)
-		r.addKnownTypeWithName(GroupKind{
-			Group: g,
-			Kind:  structType.Name(),
-		}, obj, structType)
-	}
+	r.addKnownTypes(g, "", callerSite(), types...)
 }
 
 // AddKnownTypeWithName registers a type an object to a Group and custom defined Kind
 func (r *knownTypesRegistry) AddKnownTypeWithName(gk GroupKind, obj Object) {
 	structType := GetStructType(obj)
-	r.addKnownTypeWithName(gk, obj, structType)
+	r.addKnownTypeWithName(gk, obj, structType, "", callerSite())
 }
 
 // NewObject instantiates new object instance of a type registered behind GroupKind
 func (r *knownTypesRegistry) NewObject(gk GroupKind) (Object, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
 	t, exists := r.gvkToType[gk]
 
 	if !exists {
 		return nil, errors.Errorf("type %s is not registered in KnownTypes", gk.String())
 	}
 
+	for _, c := range r.conflicts {
+		if c.GroupKind == gk {
+			return nil, errors.Errorf("type %s has conflicting registrations: %s and %s", gk.String(), c.Existing, c.Rejected)
+		}
+	}
+
 	obj := reflect.New(t).Interface().(Object)
 	obj.SetGroupKind(&gk)
 
@@ -69,6 +121,10 @@ func (r *knownTypesRegistry) NewObject(gk GroupKind) (Object, error) {
 // ObjectKind returns GroupKind of an already registered type
 func (r *knownTypesRegistry) ObjectKind(obj Object) (*GroupKind, error) {
 	structType := GetStructType(obj)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
 	gk, ok := r.typeToGVK[structType]
 	if !ok {
 		return nil, errors.Errorf("no kind is registered in schema for the type %s", structType.Name())
@@ -81,20 +137,120 @@ func (r *knownTypesRegistry) ObjectKind(obj Object) (*GroupKind, error) {
 	return &gk, nil
 }
 
-func (r *knownTypesRegistry) addKnownTypeWithName(gk GroupKind, obj Object, structType reflect.Type) {
+// Scoped returns a view of the registry which attributes all registrations made through it to the owner
+func (r *knownTypesRegistry) Scoped(owner string) KnownTypesRegistry {
+	return &scopedRegistry{knownTypesRegistry: r, owner: owner}
+}
+
+// Validate returns ConflictErr if the same GroupKind was registered with different types
+func (r *knownTypesRegistry) Validate() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.conflicts) == 0 {
+		return nil
+	}
+
+	descriptions := make([]string, len(r.conflicts))
+	for i, c := range r.conflicts {
+		descriptions[i] = fmt.Sprintf("%s: registered as %s, then as %s", c.GroupKind, c.Existing, c.Rejected)
+	}
+
+	conflicts := make([]Conflict, len(r.conflicts))
+	copy(conflicts, r.conflicts)
+
+	return ConflictErr{
+		error:     errors.Errorf("conflicting registrations of types in scheme: %s", strings.Join(descriptions, "; ")),
+		Conflicts: conflicts,
+	}
+}
+
+// DumpOwnership returns all registered GroupKinds together with their types and registration sites
+func (r *knownTypesRegistry) DumpOwnership() []Ownership {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res := make([]Ownership, 0, len(r.owners))
+	for _, o := range r.owners {
+		res = append(res, o)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].GroupKind.String() < res[j].GroupKind.String()
+	})
+
+	return res
+}
+
+func (r *knownTypesRegistry) addKnownTypes(g Group, owner, site string, types ...Object) {
+	for _, obj := range types {
+		structType := GetStructType(obj)
+		r.addKnownTypeWithName(GroupKind{
+			Group: g,
+			Kind:  structType.Name(),
+		}, obj, structType, owner, site)
+	}
+}
+
+func (r *knownTypesRegistry) addKnownTypeWithName(gk GroupKind, obj Object, structType reflect.Type, owner, site string) {
 	if len(gk.Group) == 0 {
 		panic(fmt.Sprintf("group is required on all types: %s %v", gk, structType))
 	}
 
-	if oldT, found := r.gvkToType[gk]; found && oldT != structType {
-		panic(fmt.Sprintf("Double registration of different types for %v: old=%v.%v, new=%v.%v", gk, oldT.PkgPath(), oldT.Name(), structType.PkgPath(), structType.Name()))
+	ownership := Ownership{
+		GroupKind: gk,
+		Type:      fmt.Sprintf("%s.%s", structType.PkgPath(), structType.Name()),
+		Owner:     owner,
+		Site:      site,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if oldT, found := r.gvkToType[gk]; found {
+		// identical re-registration only sets the group kind of the object, a different type is kept aside and reported by Validate
+		if oldT == structType {
+			obj.SetGroupKind(&gk)
+		} else {
+			r.conflicts = append(r.conflicts, Conflict{GroupKind: gk, Existing: r.owners[gk], Rejected: ownership})
+		}
+
+		return
 	}
 
 	r.gvkToType[gk] = structType
 	r.typeToGVK[structType] = gk
+	r.owners[gk] = ownership
 	obj.SetGroupKind(&gk)
 }
 
+// scopedRegistry shares the state with the parent registry, only registrations are attributed to the owner
+type scopedRegistry struct {
+	*knownTypesRegistry
+	owner string
+}
+
+// AddKnownTypes registers list of types of objects to a Group. Kind of each type will be set as struct name using reflection
+func (s *scopedRegistry) AddKnownTypes(g Group, types ...Object) {
+	s.addKnownTypes(g, s.owner, callerSite(), types...)
+}
+
+// AddKnownTypeWithName registers a type an object to a Group and custom defined Kind
+func (s *scopedRegistry) AddKnownTypeWithName(gk GroupKind, obj Object) {
+	structType := GetStructType(obj)
+	s.addKnownTypeWithName(gk, obj, structType, s.owner, callerSite())
+}
+
+// callerSite returns file:line of the code which called a registration method
+func callerSite() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
 // GetStructType returns reflect.Type of the passed object
 func GetStructType(obj Object) reflect.Type {
 	structType := reflect.TypeOf(obj)
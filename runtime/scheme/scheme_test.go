@@ -1,6 +1,7 @@
 package scheme
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,13 +71,27 @@ func TestKnownTypesRegistry_AddKnownTypeWithName(t *testing.T) {
 	})
 
 	t.Run("double registration", func(t *testing.T) {
-		expected := "Double registration of different types for test.CustomKind: old=github.com/go-foreman/foreman/runtime/scheme.SomeTestType, new=github.com/go-foreman/foreman/runtime/scheme.SomeAnotherTestType"
-		require.PanicsWithValue(t, expected, func() {
-			knownRegistry.AddKnownTypeWithName(GroupKind{
-				Group: group,
-				Kind:  "CustomKind",
-			}, &SomeAnotherTestType{})
-		})
+		require.NoError(t, knownRegistry.Validate())
+
+		knownRegistry.AddKnownTypeWithName(GroupKind{
+			Group: group,
+			Kind:  "CustomKind",
+		}, &SomeAnotherTestType{})
+
+		err := knownRegistry.Validate()
+		require.Error(t, err)
+		assert.IsType(t, ConflictErr{}, err)
+		assert.Contains(t, err.Error(), "test.CustomKind: registered as github.com/go-foreman/foreman/runtime/scheme.SomeTestType at ")
+		assert.Contains(t, err.Error(), "then as github.com/go-foreman/foreman/runtime/scheme.SomeAnotherTestType at ")
+		assert.Contains(t, err.Error(), "scheme_test.go:")
+
+		conflicts := err.(ConflictErr).Conflicts
+		require.Len(t, conflicts, 1)
+		assert.NotEqual(t, conflicts[0].Existing.Site, conflicts[0].Rejected.Site)
+
+		_, err = knownRegistry.NewObject(GroupKind{Group: group, Kind: "CustomKind"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "type test.CustomKind has conflicting registrations")
 	})
 
 	t.Run("object is not struct type", func(t *testing.T) {
@@ -143,6 +158,64 @@ func TestKnownTypesRegistry_AddKnownTypes(t *testing.T) {
 	})
 }
 
+func TestKnownTypesRegistry_Ownership(t *testing.T) {
+	t.Run("identical re-registration is a no-op", func(t *testing.T) {
+		knownRegistry := NewKnownTypesRegistry()
+		knownRegistry.AddKnownTypes(group, &SomeTestType{})
+		reRegistered := &SomeTestType{}
+		knownRegistry.AddKnownTypes(group, reRegistered)
+
+		assert.NoError(t, knownRegistry.Validate())
+		assert.Len(t, knownRegistry.DumpOwnership(), 1)
+		assert.Equal(t, GroupKind{Group: group, Kind: "SomeTestType"}, reRegistered.GroupKind())
+	})
+
+	t.Run("scoped registry attributes registrations to the owner", func(t *testing.T) {
+		knownRegistry := NewKnownTypesRegistry()
+		knownRegistry.Scoped("componentA").AddKnownTypes(group, &SomeTestType{})
+		knownRegistry.Scoped("componentB").AddKnownTypeWithName(GroupKind{Group: group, Kind: "SomeTestType"}, &SomeAnotherTestType{})
+		knownRegistry.AddKnownTypes(group, &SomeAnotherTestType{})
+
+		ownership := knownRegistry.DumpOwnership()
+		require.Len(t, ownership, 2)
+		assert.Equal(t, GroupKind{Group: group, Kind: "SomeAnotherTestType"}, ownership[0].GroupKind)
+		assert.Empty(t, ownership[0].Owner)
+		assert.Equal(t, GroupKind{Group: group, Kind: "SomeTestType"}, ownership[1].GroupKind)
+		assert.Equal(t, "componentA", ownership[1].Owner)
+		assert.Equal(t, "github.com/go-foreman/foreman/runtime/scheme.SomeTestType", ownership[1].Type)
+		assert.Contains(t, ownership[1].Site, "scheme_test.go:")
+
+		err := knownRegistry.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "SomeTestType by componentA at ")
+		assert.Contains(t, err.Error(), "SomeAnotherTestType by componentB at ")
+	})
+}
+
+func TestKnownTypesRegistry_Concurrency(t *testing.T) {
+	knownRegistry := NewKnownTypesRegistry()
+	knownRegistry.AddKnownTypes(group, &SomeTestType{})
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			knownRegistry.AddKnownTypeWithName(GroupKind{Group: group, Kind: fmt.Sprintf("Plugin%d", i)}, &SomeAnotherTestType{})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, err := knownRegistry.NewObject(GroupKind{Group: group, Kind: "SomeTestType"})
+		require.NoError(t, err)
+	}
+
+	<-done
+
+	_, err := knownRegistry.NewObject(GroupKind{Group: group, Kind: "Plugin99"})
+	assert.NoError(t, err, "types registered while others are decoded are known")
+}
+
 type notStructType string
 
 func (n notStructType) GroupKind() GroupKind {
@@ -0,0 +1,169 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+)
+
+const (
+	recoverAction    = "recover"
+	compensateAction = "compensate"
+)
+
+// ControlService triggers recovering and compensation of failed sagas by sending system commands to saga endpoints
+type ControlService interface {
+	// Recover sends contracts.RecoverSagaCommand if the saga can be recovered
+	Recover(ctx context.Context, sagaId string) error
+	// Compensate sends contracts.CompensateSagaCommand if the saga can be compensated
+	Compensate(ctx context.Context, sagaId string) error
+}
+
+// NewControlService creates ControlService, commands are routed by router to endpoints registered for saga contracts
+func NewControlService(store saga.Store, router endpoint.Router) ControlService {
+	return &controlService{sagaStore: store, router: router}
+}
+
+type controlService struct {
+	sagaStore saga.Store
+	router    endpoint.Router
+}
+
+func (s controlService) Recover(ctx context.Context, sagaId string) error {
+	sagaInstance, err := s.loadSaga(ctx, sagaId)
+	if err != nil {
+		return err
+	}
+
+	status := sagaInstance.Status()
+
+	// the same conditions are checked by handlers.SagaControlHandler, otherwise the command is ignored
+	if !status.Failed() || status.Completed() || status.Recovering() || status.Compensating() {
+		return NewResponseError(http.StatusConflict, errors.Errorf("saga '%s' has status '%s', it can't be recovered", sagaId, status))
+	}
+
+	return s.send(ctx, sagaId, &contracts.RecoverSagaCommand{SagaUID: sagaId})
+}
+
+func (s controlService) Compensate(ctx context.Context, sagaId string) error {
+	sagaInstance, err := s.loadSaga(ctx, sagaId)
+	if err != nil {
+		return err
+	}
+
+	status := sagaInstance.Status()
+
+	// a child compensated by its parent is not checked here, the command is sent by the parent
+	if !status.Failed() && !status.ChildCompensationFailed() {
+		return NewResponseError(http.StatusConflict, errors.Errorf("saga '%s' has status '%s', it can't be compensated", sagaId, status))
+	}
+
+	return s.send(ctx, sagaId, &contracts.CompensateSagaCommand{SagaUID: sagaId})
+}
+
+func (s controlService) loadSaga(ctx context.Context, sagaId string) (saga.Instance, error) {
+	sagaInstance, err := s.sagaStore.GetById(ctx, sagaId)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading saga '%s'", sagaId)
+	}
+
+	if sagaInstance == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	return sagaInstance, nil
+}
+
+func (s controlService) send(ctx context.Context, sagaId string, cmd message.Object) error {
+	endpoints := s.router.Route(cmd)
+
+	if len(endpoints) == 0 {
+		return errors.Errorf("no endpoints registered for %T, register saga endpoints in the component", cmd)
+	}
+
+	outcomingMsg := message.NewOutcomingMessage(cmd)
+
+	for _, endp := range endpoints {
+		if err := endp.Send(ctx, outcomingMsg); err != nil {
+			return errors.Wrapf(err, "sending %T of saga '%s' to endpoint %s", cmd, sagaId, endp.Name())
+		}
+	}
+
+	return nil
+}
+
+// ControlHandler serves POST /sagas/{id}/recover and POST /sagas/{id}/compensate
+type ControlHandler struct {
+	service ControlService
+	logger  log.Logger
+}
+
+func NewControlHandler(logger log.Logger, service ControlService) *ControlHandler {
+	return &ControlHandler{service: service, logger: logger}
+}
+
+// IsControlRequest tells whether the request path is one of control endpoints, so it can be served on the same route as status
+func IsControlRequest(r *http.Request) bool {
+	_, action := parseControlPath(r.URL.Path)
+	return action != ""
+}
+
+func (h *ControlHandler) Handle(resp http.ResponseWriter, r *http.Request) {
+	sagaId, action := parseControlPath(r.URL.Path)
+
+	if action == "" {
+		NewResponseWriterFromErrMsg("Unknown saga action, expected one of: recover, compensate", http.StatusNotFound).write(resp, h.logger)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		NewResponseWriterFromErrMsg("Only POST method is allowed", http.StatusMethodNotAllowed).write(resp, h.logger)
+		return
+	}
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	var err error
+
+	if action == recoverAction {
+		err = h.service.Recover(r.Context(), sagaId)
+	} else {
+		err = h.service.Compensate(r.Context(), sagaId)
+	}
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(map[string]string{"saga_uid": sagaId, "action": action}, http.StatusAccepted).write(resp, h.logger)
+}
+
+// parseControlPath splits /sagas/{id}/{action}, action is empty if the path isn't a control one
+func parseControlPath(path string) (sagaId string, action string) {
+	path = strings.TrimPrefix(path, "/sagas/")
+
+	idx := strings.LastIndex(path, "/")
+	if idx < 0 {
+		return "", ""
+	}
+
+	switch path[idx+1:] {
+	case recoverAction, compensateAction:
+		return path[:idx], path[idx+1:]
+	default:
+		return "", ""
+	}
+}
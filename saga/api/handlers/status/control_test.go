@@ -0,0 +1,172 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlService(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	sagaId := "123"
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	endpointInstanceMock := endpointMock.NewMockEndpoint(ctrl)
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(endpointInstanceMock, &contracts.RecoverSagaCommand{}, &contracts.CompensateSagaCommand{})
+
+	controlService := NewControlService(storeMock, router)
+
+	failedInstance := func() saga.Instance {
+		sagaInstance := saga.NewSagaInstance(sagaId, "", sagaMock.NewMockSaga(ctrl))
+		sagaInstance.Fail(&dataContract{})
+		return sagaInstance
+	}
+
+	t.Run("recover", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(failedInstance(), nil)
+		endpointInstanceMock.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &contracts.RecoverSagaCommand{SagaUID: sagaId}, msg.Payload())
+				return nil
+			})
+
+		assert.NoError(t, controlService.Recover(ctx, sagaId))
+	})
+
+	t.Run("compensate", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(failedInstance(), nil)
+		endpointInstanceMock.
+			EXPECT().
+			Send(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, opts ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &contracts.CompensateSagaCommand{SagaUID: sagaId}, msg.Payload())
+				return nil
+			})
+
+		assert.NoError(t, controlService.Compensate(ctx, sagaId))
+	})
+
+	t.Run("saga not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(nil, nil)
+
+		err := controlService.Recover(ctx, sagaId)
+		require.Error(t, err)
+		assert.EqualError(t, err, "saga '123' not found")
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+
+	t.Run("saga is not failed", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(saga.NewSagaInstance(sagaId, "", sagaMock.NewMockSaga(ctrl)), nil).Times(2)
+
+		err := controlService.Recover(ctx, sagaId)
+		require.Error(t, err)
+		assert.EqualError(t, err, "saga '123' has status 'created', it can't be recovered")
+		assert.Equal(t, http.StatusConflict, err.(ResponseError).Status())
+
+		err = controlService.Compensate(ctx, sagaId)
+		require.Error(t, err)
+		assert.EqualError(t, err, "saga '123' has status 'created', it can't be compensated")
+		assert.Equal(t, http.StatusConflict, err.(ResponseError).Status())
+	})
+
+	t.Run("error loading saga", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(nil, errors.New("connection lost"))
+
+		err := controlService.Compensate(ctx, sagaId)
+		assert.EqualError(t, err, "error loading saga '123': connection lost")
+	})
+
+	t.Run("error sending command", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(failedInstance(), nil)
+		endpointInstanceMock.EXPECT().Send(ctx, gomock.Any()).Return(errors.New("broker is down"))
+		endpointInstanceMock.EXPECT().Name().Return("saga_queue")
+
+		err := controlService.Recover(ctx, sagaId)
+		assert.EqualError(t, err, "sending *contracts.RecoverSagaCommand of saga '123' to endpoint saga_queue: broker is down")
+	})
+
+	t.Run("no endpoints", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(failedInstance(), nil)
+
+		err := NewControlService(storeMock, endpoint.NewRouter()).Recover(ctx, sagaId)
+		assert.EqualError(t, err, "no endpoints registered for *contracts.RecoverSagaCommand, register saga endpoints in the component")
+	})
+}
+
+func TestControlHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	controlServiceMock := NewMockControlService(ctrl)
+	handler := NewControlHandler(log.NewNilLogger(), controlServiceMock)
+
+	t.Run("recover", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/sagas/123/recover", nil)
+		controlServiceMock.EXPECT().Recover(req.Context(), "123").Return(nil)
+
+		rr := httptest.NewRecorder()
+		handler.Handle(rr, req)
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.JSONEq(t, `{"saga_uid":"123","action":"recover"}`, rr.Body.String())
+	})
+
+	t.Run("compensate conflict", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/sagas/123/compensate", nil)
+		controlServiceMock.
+			EXPECT().
+			Compensate(req.Context(), "123").
+			Return(NewResponseError(http.StatusConflict, errors.New("saga '123' has status 'completed', it can't be compensated")))
+
+		rr := httptest.NewRecorder()
+		handler.Handle(rr, req)
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Equal(t, "saga '123' has status 'completed', it can't be compensated", rr.Body.String())
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/sagas/123/recover", nil)
+
+		rr := httptest.NewRecorder()
+		handler.Handle(rr, req)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+		assert.Equal(t, http.MethodPost, rr.Header().Get("Allow"))
+	})
+
+	t.Run("empty saga id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/sagas//recover", nil)
+
+		rr := httptest.NewRecorder()
+		handler.Handle(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("is control request", func(t *testing.T) {
+		assert.True(t, IsControlRequest(httptest.NewRequest(http.MethodPost, "/sagas/123/recover", nil)))
+		assert.True(t, IsControlRequest(httptest.NewRequest(http.MethodPost, "/sagas/123/compensate", nil)))
+		assert.False(t, IsControlRequest(httptest.NewRequest(http.MethodGet, "/sagas/123", nil)))
+		assert.False(t, IsControlRequest(httptest.NewRequest(http.MethodGet, "/sagas/recover", nil)))
+	})
+}
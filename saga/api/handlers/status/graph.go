@@ -0,0 +1,166 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+const (
+	graphPathSuffix       = "/graph"
+	definitionsPathPrefix = "/sagas/definitions/"
+
+	GraphFormatJSON    = "json"
+	GraphFormatDOT     = "dot"
+	GraphFormatMermaid = "mermaid"
+)
+
+// GraphService describes event handler graphs of registered sagas and of saga instances
+type GraphService interface {
+	// GetDefinitionGraph returns the graph of the registered saga, sagaType is its group.kind
+	GetDefinitionGraph(ctx context.Context, sagaType string) (*saga.Graph, error)
+	// GetGraph returns the graph of the saga of the instance with its current position
+	GetGraph(ctx context.Context, sagaId string) (*saga.Graph, error)
+}
+
+func NewGraphService(store saga.Store, schema scheme.KnownTypesRegistry, versions *saga.VersionRegistry) GraphService {
+	return &graphService{sagaStore: store, schema: schema, versions: versions}
+}
+
+type graphService struct {
+	sagaStore saga.Store
+	schema    scheme.KnownTypesRegistry
+	versions  *saga.VersionRegistry
+}
+
+func (s graphService) GetDefinitionGraph(ctx context.Context, sagaType string) (*saga.Graph, error) {
+	gk, err := scheme.FromString(sagaType)
+	if err != nil {
+		return nil, NewResponseError(http.StatusBadRequest, errors.Wrapf(err, "parsing saga type '%s'", sagaType))
+	}
+
+	if _, _, exists := s.versions.Version(gk); !exists {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' isn't registered", sagaType))
+	}
+
+	obj, err := s.schema.NewObject(gk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating saga '%s'", sagaType)
+	}
+
+	sagaObj, ok := obj.(saga.Saga)
+	if !ok {
+		return nil, errors.Errorf("'%s' isn't a saga", sagaType)
+	}
+
+	sagaObj.SetSchema(s.schema)
+	sagaObj.Init()
+
+	return saga.DescribeSaga(sagaObj), nil
+}
+
+func (s graphService) GetGraph(ctx context.Context, sagaId string) (*saga.Graph, error) {
+	sagaInstance, err := s.sagaStore.GetById(ctx, sagaId)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading saga '%s'", sagaId)
+	}
+
+	if sagaInstance == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	sagaInstance.Saga().SetSchema(s.schema)
+	sagaInstance.Saga().Init()
+
+	return saga.DescribeInstance(sagaInstance), nil
+}
+
+// GraphHandler serves graphs of sagas as json, graphviz DOT or mermaid, the format is chosen by the format query parameter
+type GraphHandler struct {
+	service GraphService
+	logger  log.Logger
+}
+
+func NewGraphHandler(logger log.Logger, service GraphService) *GraphHandler {
+	return &GraphHandler{service: service, logger: logger}
+}
+
+// IsGraphRequest tells whether the request path is /sagas/{id}/graph, so it can be served on the same route as status
+func IsGraphRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, graphPathSuffix)
+}
+
+// GetGraph serves the graph of a saga instance with its current position at /sagas/{id}/graph
+func (h *GraphHandler) GetGraph(resp http.ResponseWriter, r *http.Request) {
+	sagaId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sagas/"), graphPathSuffix)
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	h.serve(resp, r, func(ctx context.Context) (*saga.Graph, error) {
+		return h.service.GetGraph(ctx, sagaId)
+	})
+}
+
+// GetDefinitionGraph serves the graph of a registered saga at /sagas/definitions/{group.kind}/graph
+func (h *GraphHandler) GetDefinitionGraph(resp http.ResponseWriter, r *http.Request) {
+	if !IsGraphRequest(r) {
+		http.NotFound(resp, r)
+		return
+	}
+
+	sagaType := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, definitionsPathPrefix), graphPathSuffix)
+
+	if sagaType == "" {
+		NewResponseWriterFromErrMsg("Saga type is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	h.serve(resp, r, func(ctx context.Context) (*saga.Graph, error) {
+		return h.service.GetDefinitionGraph(ctx, sagaType)
+	})
+}
+
+func (h *GraphHandler) serve(resp http.ResponseWriter, r *http.Request, describe func(ctx context.Context) (*saga.Graph, error)) {
+	format := r.URL.Query().Get("format")
+
+	switch format {
+	case "", GraphFormatJSON, GraphFormatDOT, GraphFormatMermaid:
+	default:
+		NewResponseWriterFromErrMsg("Query parameter 'format' must be one of json, dot, mermaid", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	graph, err := describe(r.Context())
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	switch format {
+	case GraphFormatDOT:
+		writeText(resp, "text/vnd.graphviz", graph.DOT(), h.logger)
+	case GraphFormatMermaid:
+		writeText(resp, "text/plain; charset=utf-8", graph.Mermaid(), h.logger)
+	default:
+		NewResponseWriter(graph, http.StatusOK).write(resp, h.logger)
+	}
+}
+
+func writeText(resp http.ResponseWriter, contentType, body string, logger log.Logger) {
+	resp.Header().Set("Content-Type", contentType)
+	resp.WriteHeader(http.StatusOK)
+
+	if _, err := resp.Write([]byte(body)); err != nil {
+		logger.Log(log.ErrorLevel, err)
+	}
+}
@@ -0,0 +1,174 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type orderSaga struct {
+	saga.BaseSaga
+}
+
+func (s *orderSaga) Init() {
+	s.AddEventHandler(&orderPaid{}, s.handle)
+}
+
+func (s *orderSaga) Start(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (s *orderSaga) Compensate(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (s *orderSaga) Recover(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (s *orderSaga) handle(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+type orderPaid struct {
+	message.ObjectMeta
+}
+
+func TestGraphService(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schema := scheme.NewKnownTypesRegistry()
+	schema.AddKnownTypes("orders", &orderSaga{}, &orderPaid{})
+
+	versions := saga.NewVersionRegistry()
+	require.NoError(t, versions.Register(nil, scheme.GroupKind{Group: "orders", Kind: "orderSaga"}))
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	graphService := NewGraphService(storeMock, schema, versions)
+	ctx := context.Background()
+
+	t.Run("graph of a definition", func(t *testing.T) {
+		graph, err := graphService.GetDefinitionGraph(ctx, "orders.orderSaga")
+		require.NoError(t, err)
+		assert.Equal(t, "orders.orderSaga", graph.Saga)
+		assert.Contains(t, graph.Edges, saga.GraphEdge{From: "in_progress", To: "in_progress", Kind: saga.GraphEdgeEvent, Label: "orders.orderPaid"})
+	})
+
+	t.Run("definition isn't registered", func(t *testing.T) {
+		_, err := graphService.GetDefinitionGraph(ctx, "orders.orderPaid")
+		require.Error(t, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+
+		_, err = graphService.GetDefinitionGraph(ctx, "orderSaga")
+		require.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.(ResponseError).Status())
+	})
+
+	t.Run("graph of an instance", func(t *testing.T) {
+		sagaObj := &orderSaga{}
+		sagaObj.SetGroupKind(&scheme.GroupKind{Group: "orders", Kind: "orderSaga"})
+		storeMock.EXPECT().GetById(ctx, "1").Return(saga.NewSagaInstance("1", "", sagaObj), nil)
+
+		graph, err := graphService.GetGraph(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "created", graph.Current)
+		assert.Contains(t, graph.Nodes, saga.GraphNode{ID: "created", Kind: saga.GraphNodeStatus, Visited: true})
+	})
+
+	t.Run("instance not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(nil, nil)
+
+		_, err := graphService.GetGraph(ctx, "1")
+		require.Error(t, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+}
+
+func TestGraphHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	graphServiceMock := NewMockGraphService(ctrl)
+	handler := NewGraphHandler(log.NewNilLogger(), graphServiceMock)
+
+	graph := &saga.Graph{
+		Saga:    "orders.orderSaga",
+		Nodes:   []saga.GraphNode{{ID: "created", Kind: saga.GraphNodeStatus}, {ID: "in_progress", Kind: saga.GraphNodeStatus}},
+		Edges:   []saga.GraphEdge{{From: "created", To: "in_progress", Kind: saga.GraphEdgeCommand, Label: "StartSagaCommand"}},
+		Current: "in_progress",
+	}
+
+	t.Run("graph of an instance as json", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/graph", nil)
+		assert.True(t, IsGraphRequest(req))
+
+		graphServiceMock.EXPECT().GetGraph(req.Context(), "123").Return(graph, nil)
+
+		rr := httptest.NewRecorder()
+		handler.GetGraph(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{
+			"saga":"orders.orderSaga",
+			"nodes":[{"id":"created","kind":"status"},{"id":"in_progress","kind":"status"}],
+			"edges":[{"from":"created","to":"in_progress","kind":"command","label":"StartSagaCommand"}],
+			"current":"in_progress"
+		}`, rr.Body.String())
+	})
+
+	t.Run("graph of a definition as dot and mermaid", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/definitions/orders.orderSaga/graph?format=dot", nil)
+		graphServiceMock.EXPECT().GetDefinitionGraph(req.Context(), "orders.orderSaga").Return(graph, nil)
+
+		rr := httptest.NewRecorder()
+		handler.GetDefinitionGraph(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "text/vnd.graphviz", rr.Header().Get("Content-Type"))
+		assert.Equal(t, graph.DOT(), rr.Body.String())
+
+		req = httptest.NewRequest("GET", "http://localhost:8000/sagas/definitions/orders.orderSaga/graph?format=mermaid", nil)
+		graphServiceMock.EXPECT().GetDefinitionGraph(req.Context(), "orders.orderSaga").Return(graph, nil)
+
+		rr = httptest.NewRecorder()
+		handler.GetDefinitionGraph(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, graph.Mermaid(), rr.Body.String())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.GetGraph(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas//graph", nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		rr = httptest.NewRecorder()
+		handler.GetGraph(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas/123/graph?format=png", nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		rr = httptest.NewRecorder()
+		handler.GetDefinitionGraph(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas/definitions/orders.orderSaga", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("service returns not found", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/graph", nil)
+		graphServiceMock.EXPECT().GetGraph(req.Context(), "123").Return(nil, NewResponseError(http.StatusNotFound, errors.New("saga '123' not found")))
+
+		rr := httptest.NewRecorder()
+		handler.GetGraph(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
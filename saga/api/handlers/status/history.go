@@ -0,0 +1,155 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+const historyPathSuffix = "/history"
+
+// HistoryFilters selects events of a saga history, zero values are ignored
+type HistoryFilters struct {
+	// EventType is group.kind or only kind of event payloads
+	EventType string
+	// From and To limit the time range events were handled in
+	From time.Time
+	To   time.Time
+}
+
+// SagaHistory is a timeline of events handled by a saga, ordered by time they were handled at
+type SagaHistory struct {
+	SagaUID string `json:"saga_uid"`
+	Status  string `json:"status"`
+	// Total is a number of events in the history before filtering
+	Total  int            `json:"total"`
+	Events []HistoryEntry `json:"events"`
+}
+
+// HistoryEntry is an event handled by a saga with the status it resulted in
+type HistoryEntry struct {
+	UID            string      `json:"uid"`
+	EventType      string      `json:"event_type"`
+	CreatedAt      time.Time   `json:"created_at"`
+	Payload        interface{} `json:"payload"`
+	Origin         string      `json:"origin"`
+	TraceUID       string      `json:"trace_uid"`
+	Status         string      `json:"status"`
+	PreviousStatus string      `json:"previous_status"`
+	StatusChanged  bool        `json:"status_changed"`
+}
+
+func (s statusService) GetHistory(ctx context.Context, sagaId string, filters *HistoryFilters) (*SagaHistory, error) {
+	sagaInstance, err := s.sagaStore.GetById(ctx, sagaId)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading saga '%s'", sagaId)
+	}
+
+	if sagaInstance == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	events := make([]saga.HistoryEvent, len(sagaInstance.HistoryEvents()))
+	copy(events, sagaInstance.HistoryEvents())
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.Before(events[j].CreatedAt)
+	})
+
+	history := &SagaHistory{SagaUID: sagaId, Status: sagaInstance.Status().String(), Total: len(events), Events: []HistoryEntry{}}
+	previousStatus := ""
+
+	for _, ev := range events {
+		entry := HistoryEntry{
+			UID:            ev.UID,
+			CreatedAt:      ev.CreatedAt,
+			Payload:        ev.Payload,
+			Origin:         ev.OriginSource,
+			TraceUID:       ev.TraceUID,
+			Status:         ev.SagaStatus,
+			PreviousStatus: previousStatus,
+			StatusChanged:  ev.SagaStatus != previousStatus,
+		}
+		previousStatus = ev.SagaStatus
+
+		if ev.Payload != nil {
+			entry.EventType = ev.Payload.GroupKind().String()
+		}
+
+		if filters.matches(entry) {
+			history.Events = append(history.Events, entry)
+		}
+	}
+
+	return history, nil
+}
+
+func (f *HistoryFilters) matches(entry HistoryEntry) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.EventType != "" && entry.EventType != f.EventType && !strings.HasSuffix(entry.EventType, "."+f.EventType) {
+		return false
+	}
+
+	if !f.From.IsZero() && entry.CreatedAt.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !entry.CreatedAt.Before(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// IsHistoryRequest tells whether the request path is /sagas/{id}/history, so it can be served on the same route as status
+func IsHistoryRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, historyPathSuffix)
+}
+
+// GetHistory serves the timeline of events handled by a saga at /sagas/{id}/history. Events are filtered by eventType
+// (group.kind or kind) and a time range from, to (RFC3339).
+func (h *StatusHandler) GetHistory(resp http.ResponseWriter, r *http.Request) {
+	sagaId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sagas/"), historyPathSuffix)
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	query := r.URL.Query()
+	filters := &HistoryFilters{EventType: query.Get("eventType")}
+
+	var err error
+
+	if filters.From, err = h.getTime(query, "from"); err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	if filters.To, err = h.getTime(query, "to"); err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	if !filters.From.IsZero() && !filters.To.IsZero() && !filters.From.Before(filters.To) {
+		NewResponseWriterFromErrMsg("Query parameter 'from' must be before 'to'", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	history, err := h.service.GetHistory(r.Context(), sagaId, filters)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(history, http.StatusOK).write(resp, h.logger)
+}
@@ -0,0 +1,152 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusServiceHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+	ctx := context.Background()
+
+	started := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	event := func(kind string) message.Object {
+		return &message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "orders", Kind: kind}}
+	}
+
+	instance := sagaMock.NewMockInstance(ctrl)
+	instance.EXPECT().Status().Return(saga.NewSagaInstance("1", "", nil).Status()).AnyTimes()
+	instance.EXPECT().HistoryEvents().Return([]saga.HistoryEvent{
+		{UID: "3", CreatedAt: started.Add(2 * time.Minute), Payload: event("OrderShipped"), SagaStatus: "completed"},
+		{UID: "1", CreatedAt: started, Payload: event("StartSagaCommand"), SagaStatus: "in_progress", TraceUID: "msg-1"},
+		{UID: "2", CreatedAt: started.Add(time.Minute), Payload: event("OrderPaid"), SagaStatus: "in_progress", OriginSource: "payments"},
+	}).AnyTimes()
+
+	t.Run("events are ordered with status changes", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(instance, nil)
+
+		history, err := statusService.GetHistory(ctx, "1", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "1", history.SagaUID)
+		assert.Equal(t, "created", history.Status)
+		assert.Equal(t, 3, history.Total)
+		require.Len(t, history.Events, 3)
+
+		assert.Equal(t, HistoryEntry{
+			UID:           "1",
+			EventType:     "orders.StartSagaCommand",
+			CreatedAt:     started,
+			Payload:       event("StartSagaCommand"),
+			TraceUID:      "msg-1",
+			Status:        "in_progress",
+			StatusChanged: true,
+		}, history.Events[0])
+		assert.Equal(t, "payments", history.Events[1].Origin)
+		assert.Equal(t, "in_progress", history.Events[1].PreviousStatus)
+		assert.False(t, history.Events[1].StatusChanged)
+		assert.Equal(t, "orders.OrderShipped", history.Events[2].EventType)
+		assert.True(t, history.Events[2].StatusChanged)
+	})
+
+	t.Run("filtered by event type and time range", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(instance, nil).Times(3)
+
+		history, err := statusService.GetHistory(ctx, "1", &HistoryFilters{EventType: "OrderPaid"})
+		require.NoError(t, err)
+		require.Len(t, history.Events, 1)
+		assert.Equal(t, "2", history.Events[0].UID)
+		assert.Equal(t, 3, history.Total)
+
+		history, err = statusService.GetHistory(ctx, "1", &HistoryFilters{EventType: "orders.OrderShipped"})
+		require.NoError(t, err)
+		require.Len(t, history.Events, 1)
+		assert.Equal(t, "3", history.Events[0].UID)
+
+		history, err = statusService.GetHistory(ctx, "1", &HistoryFilters{From: started.Add(time.Minute), To: started.Add(2 * time.Minute)})
+		require.NoError(t, err)
+		require.Len(t, history.Events, 1)
+		assert.Equal(t, "2", history.Events[0].UID)
+		assert.Equal(t, "in_progress", history.Events[0].PreviousStatus, "previous status is taken from the whole history")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(nil, nil)
+
+		_, err := statusService.GetHistory(ctx, "1", nil)
+		require.IsType(t, ResponseError{}, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+
+	t.Run("error loading saga", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(nil, errors.New("connection lost"))
+
+		_, err := statusService.GetHistory(ctx, "1", nil)
+		assert.EqualError(t, err, "error loading saga '1': connection lost")
+	})
+}
+
+func TestHandlerHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	statusServiceMock := NewMockStatusService(ctrl)
+	handler := NewStatusHandler(log.NewNilLogger(), statusServiceMock)
+
+	t.Run("filters are passed to the service", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/history?eventType=OrderPaid&from=2022-01-01T10:00:00Z&to=2022-01-01T11:00:00Z", nil)
+		assert.True(t, IsHistoryRequest(req))
+
+		statusServiceMock.
+			EXPECT().
+			GetHistory(req.Context(), "123", &HistoryFilters{
+				EventType: "OrderPaid",
+				From:      time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC),
+				To:        time.Date(2022, 1, 1, 11, 0, 0, 0, time.UTC),
+			}).
+			Return(&SagaHistory{SagaUID: "123", Status: "in_progress", Total: 0, Events: []HistoryEntry{}}, nil)
+
+		rr := httptest.NewRecorder()
+		handler.GetHistory(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"saga_uid":"123","status":"in_progress","total":0,"events":[]}`, rr.Body.String())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, url := range []string{
+			"http://localhost:8000/sagas//history",
+			"http://localhost:8000/sagas/123/history?from=yesterday",
+			"http://localhost:8000/sagas/123/history?from=2022-01-01T11:00:00Z&to=2022-01-01T10:00:00Z",
+		} {
+			rr := httptest.NewRecorder()
+			handler.GetHistory(rr, httptest.NewRequest("GET", url, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+		}
+	})
+
+	t.Run("service returns not found", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/history", nil)
+		statusServiceMock.EXPECT().GetHistory(req.Context(), "123", &HistoryFilters{}).Return(nil, NewResponseError(http.StatusNotFound, errors.New("saga '123' not found")))
+
+		rr := httptest.NewRecorder()
+		handler.GetHistory(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
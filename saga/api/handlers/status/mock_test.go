@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/go-foreman/foreman/saga/api/handlers/status (interfaces: StatusService)
+// Source: github.com/go-foreman/foreman/saga/api/handlers/status (interfaces: StatusService,ControlService,OperationService,GraphService)
 
 // Package status is a generated GoMock package.
 package status
@@ -8,6 +8,7 @@ import (
 	context "context"
 	reflect "reflect"
 
+	saga "github.com/go-foreman/foreman/saga"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -34,6 +35,35 @@ func (m *MockStatusService) EXPECT() *MockStatusServiceMockRecorder {
 	return m.recorder
 }
 
+// Delete mocks base method.
+func (m *MockStatusService) Delete(arg0 context.Context, arg1 string, arg2 bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockStatusServiceMockRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockStatusService)(nil).Delete), arg0, arg1, arg2)
+}
+
+// GetChildren mocks base method.
+func (m *MockStatusService) GetChildren(arg0 context.Context, arg1 string) (*SagaChildren, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetChildren", arg0, arg1)
+	ret0, _ := ret[0].(*SagaChildren)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetChildren indicates an expected call of GetChildren.
+func (mr *MockStatusServiceMockRecorder) GetChildren(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChildren", reflect.TypeOf((*MockStatusService)(nil).GetChildren), arg0, arg1)
+}
+
 // GetFilteredBy mocks base method.
 func (m *MockStatusService) GetFilteredBy(arg0 context.Context, arg1 *Filters, arg2 *Pagination) (*SagaBatch, error) {
 	m.ctrl.T.Helper()
@@ -49,6 +79,21 @@ func (mr *MockStatusServiceMockRecorder) GetFilteredBy(arg0, arg1, arg2 interfac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFilteredBy", reflect.TypeOf((*MockStatusService)(nil).GetFilteredBy), arg0, arg1, arg2)
 }
 
+// GetHistory mocks base method.
+func (m *MockStatusService) GetHistory(arg0 context.Context, arg1 string, arg2 *HistoryFilters) (*SagaHistory, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetHistory", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*SagaHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetHistory indicates an expected call of GetHistory.
+func (mr *MockStatusServiceMockRecorder) GetHistory(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHistory", reflect.TypeOf((*MockStatusService)(nil).GetHistory), arg0, arg1, arg2)
+}
+
 // GetStatus mocks base method.
 func (m *MockStatusService) GetStatus(arg0 context.Context, arg1 string) (*SagaStatus, error) {
 	m.ctrl.T.Helper()
@@ -63,3 +108,190 @@ func (mr *MockStatusServiceMockRecorder) GetStatus(arg0, arg1 interface{}) *gomo
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStatus", reflect.TypeOf((*MockStatusService)(nil).GetStatus), arg0, arg1)
 }
+
+// GetTree mocks base method.
+func (m *MockStatusService) GetTree(arg0 context.Context, arg1 string) (*SagaTreeNode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTree", arg0, arg1)
+	ret0, _ := ret[0].(*SagaTreeNode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTree indicates an expected call of GetTree.
+func (mr *MockStatusServiceMockRecorder) GetTree(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTree", reflect.TypeOf((*MockStatusService)(nil).GetTree), arg0, arg1)
+}
+
+// Purge mocks base method.
+func (m *MockStatusService) Purge(arg0 context.Context, arg1 *PurgeFilters, arg2 bool) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Purge", arg0, arg1, arg2)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Purge indicates an expected call of Purge.
+func (mr *MockStatusServiceMockRecorder) Purge(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*MockStatusService)(nil).Purge), arg0, arg1, arg2)
+}
+
+// MockControlService is a mock of ControlService interface.
+type MockControlService struct {
+	ctrl     *gomock.Controller
+	recorder *MockControlServiceMockRecorder
+}
+
+// MockControlServiceMockRecorder is the mock recorder for MockControlService.
+type MockControlServiceMockRecorder struct {
+	mock *MockControlService
+}
+
+// NewMockControlService creates a new mock instance.
+func NewMockControlService(ctrl *gomock.Controller) *MockControlService {
+	mock := &MockControlService{ctrl: ctrl}
+	mock.recorder = &MockControlServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockControlService) EXPECT() *MockControlServiceMockRecorder {
+	return m.recorder
+}
+
+// Compensate mocks base method.
+func (m *MockControlService) Compensate(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compensate", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Compensate indicates an expected call of Compensate.
+func (mr *MockControlServiceMockRecorder) Compensate(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compensate", reflect.TypeOf((*MockControlService)(nil).Compensate), arg0, arg1)
+}
+
+// Recover mocks base method.
+func (m *MockControlService) Recover(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Recover", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Recover indicates an expected call of Recover.
+func (mr *MockControlServiceMockRecorder) Recover(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*MockControlService)(nil).Recover), arg0, arg1)
+}
+
+// MockOperationService is a mock of OperationService interface.
+type MockOperationService struct {
+	ctrl     *gomock.Controller
+	recorder *MockOperationServiceMockRecorder
+}
+
+// MockOperationServiceMockRecorder is the mock recorder for MockOperationService.
+type MockOperationServiceMockRecorder struct {
+	mock *MockOperationService
+}
+
+// NewMockOperationService creates a new mock instance.
+func NewMockOperationService(ctrl *gomock.Controller) *MockOperationService {
+	mock := &MockOperationService{ctrl: ctrl}
+	mock.recorder = &MockOperationServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOperationService) EXPECT() *MockOperationServiceMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockOperationService) Get(arg0 context.Context, arg1 string) (*OperationStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", arg0, arg1)
+	ret0, _ := ret[0].(*OperationStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockOperationServiceMockRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockOperationService)(nil).Get), arg0, arg1)
+}
+
+// Start mocks base method.
+func (m *MockOperationService) Start(arg0 context.Context, arg1 string, arg2 saga.OperationFilter) (*OperationStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Start", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*OperationStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Start indicates an expected call of Start.
+func (mr *MockOperationServiceMockRecorder) Start(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockOperationService)(nil).Start), arg0, arg1, arg2)
+}
+
+// MockGraphService is a mock of GraphService interface.
+type MockGraphService struct {
+	ctrl     *gomock.Controller
+	recorder *MockGraphServiceMockRecorder
+}
+
+// MockGraphServiceMockRecorder is the mock recorder for MockGraphService.
+type MockGraphServiceMockRecorder struct {
+	mock *MockGraphService
+}
+
+// NewMockGraphService creates a new mock instance.
+func NewMockGraphService(ctrl *gomock.Controller) *MockGraphService {
+	mock := &MockGraphService{ctrl: ctrl}
+	mock.recorder = &MockGraphServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockGraphService) EXPECT() *MockGraphServiceMockRecorder {
+	return m.recorder
+}
+
+// GetDefinitionGraph mocks base method.
+func (m *MockGraphService) GetDefinitionGraph(arg0 context.Context, arg1 string) (*saga.Graph, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDefinitionGraph", arg0, arg1)
+	ret0, _ := ret[0].(*saga.Graph)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDefinitionGraph indicates an expected call of GetDefinitionGraph.
+func (mr *MockGraphServiceMockRecorder) GetDefinitionGraph(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDefinitionGraph", reflect.TypeOf((*MockGraphService)(nil).GetDefinitionGraph), arg0, arg1)
+}
+
+// GetGraph mocks base method.
+func (m *MockGraphService) GetGraph(arg0 context.Context, arg1 string) (*saga.Graph, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetGraph", arg0, arg1)
+	ret0, _ := ret[0].(*saga.Graph)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetGraph indicates an expected call of GetGraph.
+func (mr *MockGraphServiceMockRecorder) GetGraph(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetGraph", reflect.TypeOf((*MockGraphService)(nil).GetGraph), arg0, arg1)
+}
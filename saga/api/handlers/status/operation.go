@@ -0,0 +1,266 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const failedStatus = "failed"
+
+// OperationStatus is an operation with its progress, the progress is live while OperationRunner processes the operation
+type OperationStatus struct {
+	*saga.Operation
+	Progress saga.OperationProgress `json:"progress"`
+}
+
+func newOperationStatus(operation *saga.Operation) *OperationStatus {
+	return &OperationStatus{Operation: operation, Progress: operation.Progress()}
+}
+
+// OperationService starts bulk actions over sagas matching a filter and reports their progress
+type OperationService interface {
+	// Start queues sagas matching the filter, status is "failed" if empty, and returns the operation before the action is applied to them
+	Start(ctx context.Context, action string, filter saga.OperationFilter) (*OperationStatus, error)
+	// Get returns the operation with results of the action applied so far
+	Get(ctx context.Context, operationId string) (*OperationStatus, error)
+}
+
+// NewOperationService creates OperationService, runner is woken up once an operation is started. If runner is nil,
+// operations are picked up on its next tick by a runner of another replica.
+func NewOperationService(sagaStore saga.Store, operations saga.OperationStore, runner *OperationRunner) OperationService {
+	return &operationService{sagaStore: sagaStore, operations: operations, runner: runner}
+}
+
+type operationService struct {
+	sagaStore  saga.Store
+	operations saga.OperationStore
+	runner     *OperationRunner
+}
+
+func (s operationService) Start(ctx context.Context, action string, filter saga.OperationFilter) (*OperationStatus, error) {
+	if action != recoverAction && action != compensateAction {
+		return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("unknown action '%s', expected one of: recover, compensate", action))
+	}
+
+	if filter.Status == "" {
+		filter.Status = failedStatus
+	}
+
+	operation := &saga.Operation{
+		ID:        uuid.New().String(),
+		Action:    action,
+		Filter:    filter,
+		StartedAt: time.Now().UTC(),
+	}
+
+	opts := []saga.FilterOption{saga.WithStatus(filter.Status), saga.WithSorting(saga.SortByStartedAt, saga.SortAsc)}
+
+	if filter.SagaName != "" {
+		opts = append(opts, saga.WithSagaName(filter.SagaName))
+	}
+
+	for offset := 0; ; offset += MaxPageSize {
+		batch, err := s.sagaStore.GetByFilter(ctx, append(opts, saga.WithOffsetAndLimit(offset, MaxPageSize))...)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading sagas of the operation")
+		}
+
+		for _, instance := range batch.Items {
+			operation.Items = append(operation.Items, saga.OperationItem{SagaUID: instance.UID(), Result: saga.OperationPending})
+		}
+
+		if len(batch.Items) < MaxPageSize {
+			break
+		}
+	}
+
+	if err := s.operations.CreateOperation(ctx, operation); err != nil {
+		return nil, errors.Wrap(err, "error saving operation")
+	}
+
+	s.runner.Notify()
+
+	return newOperationStatus(operation), nil
+}
+
+func (s operationService) Get(ctx context.Context, operationId string) (*OperationStatus, error) {
+	operation, err := s.operations.GetOperation(ctx, operationId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading operation '%s'", operationId)
+	}
+
+	if operation == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("operation '%s' not found", operationId))
+	}
+
+	return newOperationStatus(operation), nil
+}
+
+// OperationsHandler serves POST /operations?action=recover&status=failed&sagaType=... and GET /operations/{id}
+type OperationsHandler struct {
+	service OperationService
+	logger  log.Logger
+}
+
+func NewOperationsHandler(logger log.Logger, service OperationService) *OperationsHandler {
+	return &OperationsHandler{service: service, logger: logger}
+}
+
+// Start responds with 202 and the operation, its progress is polled at GET /operations/{id}
+func (h *OperationsHandler) Start(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		NewResponseWriterFromErrMsg("Only POST method is allowed", http.StatusMethodNotAllowed).write(resp, h.logger)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := saga.OperationFilter{Status: query.Get("status"), SagaName: query.Get("sagaType")}
+
+	if filter.Status != "" && !isKnownStatus(filter.Status) {
+		NewResponseWriterFromErrMsg(fmt.Sprintf("Query parameter 'status' is expected to be one of: %s", strings.Join(knownStatuses, ", ")), http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	operation, err := h.service.Start(r.Context(), query.Get("action"), filter)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(operation, http.StatusAccepted).write(resp, h.logger)
+}
+
+func (h *OperationsHandler) Get(resp http.ResponseWriter, r *http.Request) {
+	operationId := strings.TrimPrefix(r.URL.Path, "/operations/")
+
+	if operationId == "" {
+		NewResponseWriterFromErrMsg("Operation id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	operation, err := h.service.Get(r.Context(), operationId)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(operation, http.StatusOK).write(resp, h.logger)
+}
+
+// OperationRunner is a worker applying actions of operations to their pending sagas. Results are saved after each saga,
+// so after a restart unfinished operations are resumed from sagas that are still pending. Runners of several replicas would
+// send commands of the same saga twice, so it must run under a worker mutex of MessageBus, see foreman.WithWorkerMutex.
+type OperationRunner struct {
+	operations saga.OperationStore
+	control    ControlService
+	interval   time.Duration
+	wake       chan struct{}
+	logger     log.Logger
+}
+
+func NewOperationRunner(operations saga.OperationStore, control ControlService, interval time.Duration, logger log.Logger) *OperationRunner {
+	return &OperationRunner{
+		operations: operations,
+		control:    control,
+		interval:   interval,
+		wake:       make(chan struct{}, 1),
+		logger:     logger,
+	}
+}
+
+func (r *OperationRunner) Name() string {
+	return "saga-bulk-operations"
+}
+
+// Notify wakes the runner up without waiting for the next tick
+func (r *OperationRunner) Notify() {
+	if r == nil {
+		return
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *OperationRunner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.runUnfinished(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Logf(log.ErrorLevel, "error running saga operations: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+func (r *OperationRunner) runUnfinished(ctx context.Context) error {
+	operations, err := r.operations.GetUnfinishedOperations(ctx)
+	if err != nil {
+		return errors.Wrap(err, "loading unfinished operations")
+	}
+
+	for _, operation := range operations {
+		if err := r.run(ctx, operation); err != nil {
+			return errors.Wrapf(err, "running operation %s", operation.ID)
+		}
+	}
+
+	return nil
+}
+
+func (r *OperationRunner) run(ctx context.Context, operation *saga.Operation) error {
+	for _, item := range operation.Items {
+		if item.Result != saga.OperationPending {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var err error
+
+		if operation.Action == compensateAction {
+			err = r.control.Compensate(ctx, item.SagaUID)
+		} else {
+			err = r.control.Recover(ctx, item.SagaUID)
+		}
+
+		item.Result = saga.OperationSent
+
+		if err != nil {
+			// the saga stays pending if sending is interrupted, it's retried after the restart
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			item.Result, item.Error = saga.OperationFailed, err.Error()
+		}
+
+		if err := r.operations.SetItemResult(ctx, operation.ID, item); err != nil {
+			return err
+		}
+	}
+
+	return r.operations.FinishOperation(ctx, operation.ID, time.Now().UTC())
+}
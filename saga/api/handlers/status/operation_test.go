@@ -0,0 +1,189 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationService(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	storeMock := sagaMock.NewMockStore(ctrl)
+	operationsMock := sagaMock.NewMockOperationStore(ctrl)
+	runner := NewOperationRunner(operationsMock, NewMockControlService(ctrl), time.Hour, log.NewNilLogger())
+	service := NewOperationService(storeMock, operationsMock, runner)
+
+	t.Run("start queues matching sagas", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Do(func(ctx context.Context, filters ...saga.FilterOption) {
+				// status, sorting and pagination
+				assert.Len(t, filters, 3)
+			}).
+			Return(&saga.InstancesBatch{Total: 2, Items: []saga.Instance{
+				saga.NewSagaInstance("1", "", sagaMock.NewMockSaga(ctrl)),
+				saga.NewSagaInstance("2", "", sagaMock.NewMockSaga(ctrl)),
+			}}, nil)
+
+		operationsMock.
+			EXPECT().
+			CreateOperation(ctx, gomock.Any()).
+			Do(func(ctx context.Context, operation *saga.Operation) {
+				assert.NotEmpty(t, operation.ID)
+				assert.Equal(t, "recover", operation.Action)
+				assert.Equal(t, saga.OperationFilter{Status: "failed"}, operation.Filter)
+				assert.Equal(t, []string{"1", "2"}, operation.SagaUIDs())
+			}).
+			Return(nil)
+
+		operation, err := service.Start(ctx, recoverAction, saga.OperationFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, saga.OperationProgress{Total: 2, Pending: 2}, operation.Progress)
+		assert.Len(t, runner.wake, 1, "runner is woken up")
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		_, err := service.Start(ctx, "delete", saga.OperationFilter{})
+		assert.EqualError(t, err, "unknown action 'delete', expected one of: recover, compensate")
+		assert.Equal(t, http.StatusBadRequest, err.(ResponseError).Status())
+	})
+
+	t.Run("operation not found", func(t *testing.T) {
+		operationsMock.EXPECT().GetOperation(ctx, "op-1").Return(nil, nil)
+
+		_, err := service.Get(ctx, "op-1")
+		assert.EqualError(t, err, "operation 'op-1' not found")
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+}
+
+func TestOperationRunner(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	operationsMock := sagaMock.NewMockOperationStore(ctrl)
+	controlMock := NewMockControlService(ctrl)
+	runner := NewOperationRunner(operationsMock, controlMock, time.Hour, log.NewNilLogger())
+	assert.Equal(t, "saga-bulk-operations", runner.Name())
+
+	// the operation was interrupted by a restart after the first saga
+	operation := &saga.Operation{ID: "op-1", Action: compensateAction, Items: []saga.OperationItem{
+		{SagaUID: "1", Result: saga.OperationSent},
+		{SagaUID: "2", Result: saga.OperationPending},
+		{SagaUID: "3", Result: saga.OperationPending},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gomock.InOrder(
+		operationsMock.EXPECT().GetUnfinishedOperations(gomock.Any()).Return([]*saga.Operation{operation}, nil),
+		controlMock.EXPECT().Compensate(gomock.Any(), "2").Return(nil),
+		operationsMock.EXPECT().SetItemResult(gomock.Any(), "op-1", saga.OperationItem{SagaUID: "2", Result: saga.OperationSent}).Return(nil),
+		controlMock.EXPECT().Compensate(gomock.Any(), "3").Return(NewResponseError(http.StatusConflict, errors.New("saga '3' has status 'compensating', it can't be compensated"))),
+		operationsMock.EXPECT().SetItemResult(gomock.Any(), "op-1", saga.OperationItem{SagaUID: "3", Result: saga.OperationFailed, Error: "saga '3' has status 'compensating', it can't be compensated"}).Return(nil),
+		operationsMock.EXPECT().FinishOperation(gomock.Any(), "op-1", gomock.Any()).Return(nil),
+		operationsMock.EXPECT().GetUnfinishedOperations(gomock.Any()).DoAndReturn(func(ctx context.Context) ([]*saga.Operation, error) {
+			cancel()
+			return nil, errors.New("connection lost")
+		}),
+	)
+
+	runner.Notify()
+	assert.NoError(t, runner.Run(ctx))
+}
+
+func TestOperationsHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	serviceMock := NewMockOperationService(ctrl)
+	handler := NewOperationsHandler(log.NewNilLogger(), serviceMock)
+
+	t.Run("start returns the operation at once", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/operations?action=recover&sagaType=order", nil)
+		require.NoError(t, err)
+
+		operation := newOperationStatus(&saga.Operation{ID: "op-1", Action: recoverAction, Items: []saga.OperationItem{{SagaUID: "1", Result: saga.OperationPending}}})
+		serviceMock.EXPECT().Start(req.Context(), recoverAction, saga.OperationFilter{SagaName: "order"}).Return(operation, nil)
+
+		rr := httptest.NewRecorder()
+		handler.Start(rr, req)
+
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.JSONEq(t, `{"id":"op-1","action":"recover","filter":{},"started_at":"0001-01-01T00:00:00Z","items":[{"saga_uid":"1","result":"pending"}],"progress":{"total":1,"pending":1,"sent":0,"failed":0}}`, rr.Body.String())
+	})
+
+	t.Run("start accepts only POST", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8000/operations?action=recover", nil)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		handler.Start(rr, req)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+		assert.Equal(t, http.MethodPost, rr.Header().Get("Allow"))
+	})
+
+	t.Run("get operation", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8000/operations/op-1", nil)
+		require.NoError(t, err)
+
+		operation := newOperationStatus(&saga.Operation{ID: "op-1", Action: compensateAction, Items: []saga.OperationItem{{SagaUID: "1", Result: saga.OperationSent}}})
+		serviceMock.EXPECT().Get(req.Context(), "op-1").Return(operation, nil)
+
+		rr := httptest.NewRecorder()
+		handler.Get(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var resp OperationStatus
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Equal(t, saga.OperationProgress{Total: 1, Sent: 1}, resp.Progress)
+	})
+}
+
+func TestStatusServiceExcludeOperation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	storeMock := sagaMock.NewMockStore(ctrl)
+	operationsMock := sagaMock.NewMockOperationStore(ctrl)
+
+	t.Run("sagas of the operation are excluded", func(t *testing.T) {
+		operationsMock.EXPECT().GetOperation(ctx, "op-1").Return(&saga.Operation{ID: "op-1", Items: []saga.OperationItem{{SagaUID: "1"}}}, nil)
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Do(func(ctx context.Context, filters ...saga.FilterOption) {
+				// status, excluded ids and pagination
+				assert.Len(t, filters, 3)
+			}).
+			Return(&saga.InstancesBatch{}, nil)
+
+		_, err := NewStatusService(storeMock, WithOperationStore(operationsMock)).GetFilteredBy(ctx, &Filters{Status: "failed", ExcludeOperation: "op-1"}, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("operations aren't enabled", func(t *testing.T) {
+		_, err := NewStatusService(storeMock).GetFilteredBy(ctx, &Filters{ExcludeOperation: "op-1"}, nil)
+		assert.EqualError(t, err, "bulk operations aren't enabled, sagas can't be filtered by an operation")
+		assert.Equal(t, http.StatusBadRequest, err.(ResponseError).Status())
+	})
+}
@@ -0,0 +1,162 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+const completedStatus = "completed"
+
+// PurgeFilters select sagas deleted by StatusService.Purge
+type PurgeFilters struct {
+	// Status is "completed" if empty
+	Status   string
+	SagaName string
+	// UpdatedBefore is required, sagas updated at or after it are kept
+	UpdatedBefore time.Time
+}
+
+type DeletedSagas struct {
+	Deleted int `json:"deleted"`
+}
+
+func (s statusService) Delete(ctx context.Context, sagaId string, force bool) error {
+	sagaInstance, err := s.sagaStore.GetById(ctx, sagaId)
+
+	if err != nil {
+		return errors.Wrapf(err, "error loading saga '%s'", sagaId)
+	}
+
+	if sagaInstance == nil {
+		return NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	if !sagaInstance.Status().Completed() && !force {
+		return NewResponseError(http.StatusConflict, errors.Errorf("saga '%s' has status '%s', pass force=true to delete it", sagaId, sagaInstance.Status()))
+	}
+
+	if err := s.sagaStore.Delete(ctx, sagaId); err != nil {
+		return errors.Wrapf(err, "error deleting saga '%s'", sagaId)
+	}
+
+	return nil
+}
+
+func (s statusService) Purge(ctx context.Context, filters *PurgeFilters, force bool) (int, error) {
+	status := filters.Status
+	if status == "" {
+		status = completedStatus
+	}
+
+	if status != completedStatus && !force {
+		return 0, NewResponseError(http.StatusConflict, errors.Errorf("purging sagas with status '%s', pass force=true to delete not completed sagas", status))
+	}
+
+	if filters.UpdatedBefore.IsZero() {
+		return 0, NewResponseError(http.StatusBadRequest, errors.New("updated before time is required to purge sagas"))
+	}
+
+	opts := []saga.FilterOption{saga.WithStatus(status), saga.WithUpdatedBefore(filters.UpdatedBefore)}
+
+	if filters.SagaName != "" {
+		opts = append(opts, saga.WithSagaName(filters.SagaName))
+	}
+
+	deleted, err := s.sagaStore.DeleteByFilter(ctx, opts...)
+	if err != nil {
+		return deleted, errors.Wrap(err, "error purging sagas")
+	}
+
+	return deleted, nil
+}
+
+// Delete serves DELETE /sagas/{id}, a not completed saga is deleted only with force=true
+func (h *StatusHandler) Delete(resp http.ResponseWriter, r *http.Request) {
+	sagaId := strings.TrimPrefix(r.URL.Path, "/sagas/")
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	force, err := h.getBool(r.URL.Query(), "force")
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	if err := h.service.Delete(r.Context(), sagaId, force); err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(DeletedSagas{Deleted: 1}, http.StatusOK).write(resp, h.logger)
+}
+
+// Purge serves DELETE /sagas?status=completed&sagaType=...&olderThan=720h, olderThan is either a duration or RFC3339 time
+func (h *StatusHandler) Purge(resp http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filters := PurgeFilters{
+		Status:   query.Get("status"),
+		SagaName: query.Get("sagaType"),
+	}
+
+	if filters.Status != "" && !isKnownStatus(filters.Status) {
+		NewResponseWriterFromErrMsg(fmt.Sprintf("Query parameter 'status' is expected to be one of: %s", strings.Join(knownStatuses, ", ")), http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	olderThan := query.Get("olderThan")
+
+	if olderThan == "" {
+		NewResponseWriterFromErrMsg("Query parameter 'olderThan' is required", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	if age, err := time.ParseDuration(olderThan); err == nil {
+		filters.UpdatedBefore = time.Now().Add(-age)
+	} else if filters.UpdatedBefore, err = time.Parse(time.RFC3339, olderThan); err != nil {
+		NewResponseWriterFromErrMsg("Query parameter 'olderThan' is expected to be a duration or a time in RFC3339 format", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	force, err := h.getBool(query, "force")
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	deleted, err := h.service.Purge(r.Context(), &filters, force)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(DeletedSagas{Deleted: deleted}, http.StatusOK).write(resp, h.logger)
+}
+
+func (h *StatusHandler) getBool(values url.Values, paramName string) (bool, error) {
+	paramValue := values.Get(paramName)
+	if paramValue == "" {
+		return false, nil
+	}
+
+	res, err := strconv.ParseBool(paramValue)
+	if err != nil {
+		return false, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter '%s' is expected to be a boolean", paramName))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,199 @@
+package status
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusServiceDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	sagaId := "123"
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+
+	t.Run("delete completed saga", func(t *testing.T) {
+		sagaInstance := saga.NewSagaInstance(sagaId, "", sagaMock.NewMockSaga(ctrl))
+		sagaInstance.Complete()
+
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(sagaInstance, nil)
+		storeMock.EXPECT().Delete(ctx, sagaId).Return(nil)
+
+		assert.NoError(t, statusService.Delete(ctx, sagaId, false))
+	})
+
+	t.Run("failed saga requires force", func(t *testing.T) {
+		sagaInstance := saga.NewSagaInstance(sagaId, "", sagaMock.NewMockSaga(ctrl))
+		sagaInstance.Fail(&dataContract{})
+
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(sagaInstance, nil).Times(2)
+
+		err := statusService.Delete(ctx, sagaId, false)
+		require.Error(t, err)
+		assert.EqualError(t, err, "saga '123' has status 'failed', pass force=true to delete it")
+		assert.Equal(t, http.StatusConflict, err.(ResponseError).Status())
+
+		storeMock.EXPECT().Delete(ctx, sagaId).Return(nil)
+		assert.NoError(t, statusService.Delete(ctx, sagaId, true))
+	})
+
+	t.Run("saga not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(nil, nil)
+
+		err := statusService.Delete(ctx, sagaId, true)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+
+	t.Run("error deleting", func(t *testing.T) {
+		sagaInstance := saga.NewSagaInstance(sagaId, "", sagaMock.NewMockSaga(ctrl))
+		sagaInstance.Complete()
+
+		storeMock.EXPECT().GetById(ctx, sagaId).Return(sagaInstance, nil)
+		storeMock.EXPECT().Delete(ctx, sagaId).Return(errors.New("connection lost"))
+
+		assert.EqualError(t, statusService.Delete(ctx, sagaId, false), "error deleting saga '123': connection lost")
+	})
+}
+
+func TestStatusServicePurge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	updatedBefore := time.Now().Add(-time.Hour)
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+
+	t.Run("completed sagas by default", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			DeleteByFilter(ctx, gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(5, nil)
+
+		deleted, err := statusService.Purge(ctx, &PurgeFilters{SagaName: "example.Saga", UpdatedBefore: updatedBefore}, false)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, deleted)
+	})
+
+	t.Run("not completed sagas require force", func(t *testing.T) {
+		_, err := statusService.Purge(ctx, &PurgeFilters{Status: "in_progress", UpdatedBefore: updatedBefore}, false)
+		require.Error(t, err)
+		assert.EqualError(t, err, "purging sagas with status 'in_progress', pass force=true to delete not completed sagas")
+		assert.Equal(t, http.StatusConflict, err.(ResponseError).Status())
+
+		storeMock.
+			EXPECT().
+			DeleteByFilter(ctx, gomock.Any(), gomock.Any()).
+			Return(1, nil)
+
+		deleted, err := statusService.Purge(ctx, &PurgeFilters{Status: "in_progress", UpdatedBefore: updatedBefore}, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+	})
+
+	t.Run("updated before is required", func(t *testing.T) {
+		_, err := statusService.Purge(ctx, &PurgeFilters{}, false)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.(ResponseError).Status())
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			DeleteByFilter(ctx, gomock.Any(), gomock.Any()).
+			Return(0, errors.New("connection lost"))
+
+		_, err := statusService.Purge(ctx, &PurgeFilters{UpdatedBefore: updatedBefore}, false)
+		assert.EqualError(t, err, "error purging sagas: connection lost")
+	})
+}
+
+func TestPurgeHandlers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	statusServiceMock := NewMockStatusService(ctrl)
+	handler := NewStatusHandler(log.NewNilLogger(), statusServiceMock)
+
+	t.Run("delete saga", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/sagas/123?force=true", nil)
+		statusServiceMock.EXPECT().Delete(req.Context(), "123", true).Return(nil)
+
+		rr := httptest.NewRecorder()
+		handler.Delete(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"deleted":1}`, rr.Body.String())
+	})
+
+	t.Run("delete saga with invalid force", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.Delete(rr, httptest.NewRequest(http.MethodDelete, "/sagas/123?force=yes", nil))
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Equal(t, "Query parameter 'force' is expected to be a boolean", rr.Body.String())
+	})
+
+	t.Run("purge older than duration", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/sagas?status=completed&sagaType=example.Saga&olderThan=24h", nil)
+		statusServiceMock.
+			EXPECT().
+			Purge(req.Context(), gomock.Any(), false).
+			DoAndReturn(func(ctx context.Context, filters *PurgeFilters, force bool) (int, error) {
+				assert.Equal(t, "completed", filters.Status)
+				assert.Equal(t, "example.Saga", filters.SagaName)
+				assert.WithinDuration(t, time.Now().Add(-time.Hour*24), filters.UpdatedBefore, time.Minute)
+				return 3, nil
+			})
+
+		rr := httptest.NewRecorder()
+		handler.Purge(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"deleted":3}`, rr.Body.String())
+	})
+
+	t.Run("purge older than time", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/sagas?olderThan=2022-01-01T00:00:00Z&force=1", nil)
+		statusServiceMock.
+			EXPECT().
+			Purge(req.Context(), &PurgeFilters{UpdatedBefore: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}, true).
+			Return(0, nil)
+
+		rr := httptest.NewRecorder()
+		handler.Purge(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("purge with invalid params", func(t *testing.T) {
+		for query, expectedErr := range map[string]string{
+			"":                                "Query parameter 'olderThan' is required",
+			"?olderThan=yesterday":            "Query parameter 'olderThan' is expected to be a duration or a time in RFC3339 format",
+			"?olderThan=24h&status=archived":  "Query parameter 'status' is expected to be one of: created, in_progress, failed, compensating, recovering, completed, compensating_children, child_compensation_failed",
+			"?olderThan=24h&force=absolutely": "Query parameter 'force' is expected to be a boolean",
+		} {
+			rr := httptest.NewRecorder()
+			handler.Purge(rr, httptest.NewRequest(http.MethodDelete, "/sagas"+query, nil))
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+			assert.Equal(t, expectedErr, rr.Body.String(), query)
+		}
+	})
+}
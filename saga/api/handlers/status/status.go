@@ -2,57 +2,200 @@ package status
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/filter"
 	"github.com/pkg/errors"
 )
 
+// MaxPageSize limits the number of sagas returned at once, it's also a page size when no limit is specified
+const MaxPageSize = 1000
+
+// MinSearchLength is the shortest text sagas can be searched by, shorter texts match almost every saga
+const MinSearchLength = 3
+
+const cursorPrefix = "offset:"
+
 type SagaBatch struct {
-	Total int          `json:"total"`
-	Items []SagaStatus `json:"items"`
+	Total      int          `json:"total"`
+	Items      []SagaStatus `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"`
 }
 
 type SagaStatus struct {
-	SagaUID string      `json:"saga_uid"`
-	Status  string      `json:"status"`
-	Payload interface{} `json:"payload"`
-	Events  []SagaEvent `json:"events"`
+	SagaUID    string           `json:"saga_uid"`
+	Status     string           `json:"status"`
+	Payload    interface{}      `json:"payload"`
+	Events     []SagaEvent      `json:"events"`
+	EntityRefs []saga.EntityRef `json:"entity_refs,omitempty"`
 }
 
 type SagaEvent struct {
 	saga.HistoryEvent
 }
 
-//go:generate mockgen --build_flags=--mod=mod -destination ./mock_test.go -package status . StatusService
+// SagaTreeNode is a saga with its descendants nested under it
+type SagaTreeNode struct {
+	SagaUID   string         `json:"saga_uid"`
+	SagaType  string         `json:"saga_type"`
+	Status    string         `json:"status"`
+	StartedAt *time.Time     `json:"started_at,omitempty"`
+	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+	Children  []SagaTreeNode `json:"children"`
+}
+
+// SagaChildren are sagas started by the saga, see saga.SagaContext.StartChildSaga
+type SagaChildren struct {
+	SagaUID  string      `json:"saga_uid"`
+	Children []SagaChild `json:"children"`
+}
+
+// SagaChild is a direct child of a saga, its own children are listed at /sagas/{id}/children of the child
+type SagaChild struct {
+	SagaUID   string     `json:"saga_uid"`
+	SagaType  string     `json:"saga_type"`
+	Status    string     `json:"status"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+const (
+	treePathSuffix     = "/tree"
+	childrenPathSuffix = "/children"
+)
+
+//go:generate mockgen --build_flags=--mod=mod -destination ./mock_test.go -package status . StatusService,ControlService,OperationService,GraphService
 
 type Pagination struct {
 	Offset int
 	Limit  int
+	// Sort and Order are optional, sagas are sorted by saga.SortByStartedAt in saga.SortDesc order by default
+	Sort  saga.SortField
+	Order saga.SortOrder
 }
 
 type Filters struct {
 	SagaID   string
 	SagaName string
 	Status   string
+	ParentID string
+	// StartedFrom and StartedTo limit the time range sagas were started in, zero values are ignored
+	StartedFrom time.Time
+	StartedTo   time.Time
+	// UpdatedFrom and UpdatedBefore limit the time range sagas were last updated in, zero values are ignored
+	UpdatedFrom   time.Time
+	UpdatedBefore time.Time
+	// EntityRef finds sagas of any type and status that referenced the entity
+	EntityRef *saga.EntityRef
+	// Search finds sagas whose data contains the text, see filter.DataContains
+	Search string
+	// Where is combined with other filters by And, it selects sagas by any predicates of the filter package
+	Where filter.Expr
+	// ExcludeOperation hides sagas queued in the bulk operation
+	ExcludeOperation string
+}
+
+// Filter combines the filters except ExcludeOperation into a filter of the saga store, nil is returned if all of them are empty
+func (f Filters) Filter() filter.Expr {
+	var exprs []filter.Expr
+
+	if f.SagaID != "" {
+		exprs = append(exprs, filter.SagaID(f.SagaID))
+	}
+
+	if f.Status != "" {
+		exprs = append(exprs, filter.StatusIn(f.Status))
+	}
+
+	if f.SagaName != "" {
+		exprs = append(exprs, filter.Name(f.SagaName))
+	}
+
+	if f.ParentID != "" {
+		exprs = append(exprs, filter.ParentID(f.ParentID))
+	}
+
+	if !f.StartedFrom.IsZero() {
+		exprs = append(exprs, filter.StartedFrom(f.StartedFrom))
+	}
+
+	if !f.StartedTo.IsZero() {
+		exprs = append(exprs, filter.StartedBefore(f.StartedTo))
+	}
+
+	if !f.UpdatedFrom.IsZero() {
+		exprs = append(exprs, filter.UpdatedFrom(f.UpdatedFrom))
+	}
+
+	if !f.UpdatedBefore.IsZero() {
+		exprs = append(exprs, filter.UpdatedBefore(f.UpdatedBefore))
+	}
+
+	if f.EntityRef != nil {
+		exprs = append(exprs, filter.EntityRef(f.EntityRef.Kind, f.EntityRef.ID))
+	}
+
+	if f.Search != "" {
+		exprs = append(exprs, filter.DataContains(f.Search))
+	}
+
+	if f.Where != nil {
+		exprs = append(exprs, f.Where)
+	}
+
+	if len(exprs) == 0 {
+		return nil
+	}
+
+	return filter.And(exprs...)
 }
 
 type StatusService interface {
 	GetStatus(ctx context.Context, sagaId string) (*SagaStatus, error)
 	GetFilteredBy(ctx context.Context, filters *Filters, pagination *Pagination) (*SagaBatch, error)
+	// GetTree returns the saga with its descendants, see saga.GetTree
+	GetTree(ctx context.Context, sagaId string) (*SagaTreeNode, error)
+	// GetChildren returns sagas started by the saga sorted by the time they were started
+	GetChildren(ctx context.Context, sagaId string) (*SagaChildren, error)
+	// GetHistory returns events handled by the saga in order they were handled, filtered by filters if they aren't nil
+	GetHistory(ctx context.Context, sagaId string, filters *HistoryFilters) (*SagaHistory, error)
+	// Delete deletes a completed saga, not completed one is deleted only with force
+	Delete(ctx context.Context, sagaId string, force bool) error
+	// Purge deletes sagas matching filters and returns their number, not completed sagas are deleted only with force
+	Purge(ctx context.Context, filters *PurgeFilters, force bool) (int, error)
+}
+
+type StatusServiceOpt func(s *statusService)
+
+// WithOperationStore enables Filters.ExcludeOperation
+func WithOperationStore(operations saga.OperationStore) StatusServiceOpt {
+	return func(s *statusService) {
+		s.operations = operations
+	}
 }
 
-func NewStatusService(store saga.Store) StatusService {
-	return &statusService{sagaStore: store}
+func NewStatusService(store saga.Store, opts ...StatusServiceOpt) StatusService {
+	s := &statusService{sagaStore: store}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 type statusService struct {
-	sagaStore saga.Store
+	sagaStore  saga.Store
+	operations saga.OperationStore
 }
 
 func (s statusService) GetStatus(ctx context.Context, sagaId string) (*SagaStatus, error) {
@@ -72,33 +215,127 @@ func (s statusService) GetStatus(ctx context.Context, sagaId string) (*SagaStatu
 		events[i] = SagaEvent{ev}
 	}
 
-	return &SagaStatus{SagaUID: sagaId, Status: sagaInstance.Status().String(), Payload: sagaInstance.Saga(), Events: events}, nil
+	return &SagaStatus{SagaUID: sagaId, Status: sagaInstance.Status().String(), Payload: sagaInstance.Saga(), Events: events, EntityRefs: sagaInstance.EntityRefs()}, nil
+}
+
+func (s statusService) GetTree(ctx context.Context, sagaId string) (*SagaTreeNode, error) {
+	tree, err := saga.GetTree(ctx, s.sagaStore, sagaId)
+
+	if err != nil {
+		if _, corrupt := errors.Cause(err).(saga.CorruptTreeErr); corrupt {
+			return nil, NewResponseError(http.StatusConflict, err)
+		}
+
+		return nil, errors.Wrapf(err, "error loading tree of saga '%s'", sagaId)
+	}
+
+	if tree == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	node := treeNode(tree)
+
+	return &node, nil
+}
+
+func treeNode(tree *saga.Tree) SagaTreeNode {
+	instance := tree.Instance
+
+	node := SagaTreeNode{
+		SagaUID:   instance.UID(),
+		Status:    instance.Status().String(),
+		StartedAt: instance.StartedAt(),
+		UpdatedAt: instance.UpdatedAt(),
+		Children:  make([]SagaTreeNode, len(tree.Children)),
+	}
+
+	if instance.Saga() != nil {
+		node.SagaType = instance.Saga().GroupKind().String()
+	}
+
+	for i, child := range tree.Children {
+		node.Children[i] = treeNode(child)
+	}
+
+	return node
+}
+
+func (s statusService) GetChildren(ctx context.Context, sagaId string) (*SagaChildren, error) {
+	parent, err := s.sagaStore.GetById(ctx, sagaId)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading saga '%s'", sagaId)
+	}
+
+	if parent == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("saga '%s' not found", sagaId))
+	}
+
+	batch, err := s.sagaStore.GetByFilter(ctx, saga.WithFilter(filter.ParentID(sagaId)), saga.WithSorting(saga.SortByStartedAt, saga.SortAsc))
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading children of saga '%s'", sagaId)
+	}
+
+	children := make([]SagaChild, len(batch.Items))
+
+	for i, instance := range batch.Items {
+		children[i] = SagaChild{
+			SagaUID:   instance.UID(),
+			Status:    instance.Status().String(),
+			StartedAt: instance.StartedAt(),
+			UpdatedAt: instance.UpdatedAt(),
+		}
+
+		if instance.Saga() != nil {
+			children[i].SagaType = instance.Saga().GroupKind().String()
+		}
+	}
+
+	return &SagaChildren{SagaUID: sagaId, Children: children}, nil
 }
 
 func (s statusService) GetFilteredBy(ctx context.Context, filters *Filters, pagination *Pagination) (*SagaBatch, error) {
 
 	var opts []saga.FilterOption
 
-	if filters != nil && filters.SagaID != "" {
-		opts = append(opts, saga.WithSagaId(filters.SagaID))
+	if filters != nil {
+		if where := filters.Filter(); where != nil {
+			opts = append(opts, saga.WithFilter(where))
+		}
 	}
 
-	if filters != nil && filters.Status != "" {
-		opts = append(opts, saga.WithStatus(filters.Status))
-	}
+	if filters != nil && filters.ExcludeOperation != "" {
+		excludeOpt, err := s.excludeOperation(ctx, filters.ExcludeOperation)
+		if err != nil {
+			return nil, err
+		}
 
-	if filters != nil && filters.SagaName != "" {
-		opts = append(opts, saga.WithSagaName(filters.SagaName))
+		opts = append(opts, excludeOpt)
 	}
 
 	if len(opts) == 0 && pagination == nil {
 		return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("Either filters or pagination must be specified"))
 	}
 
+	offset, limit := 0, MaxPageSize
+
 	if pagination != nil {
-		opts = append(opts, saga.WithOffsetAndLimit(pagination.Offset, pagination.Limit))
+		if pagination.Offset > 0 {
+			offset = pagination.Offset
+		}
+
+		if pagination.Limit > 0 && pagination.Limit < MaxPageSize {
+			limit = pagination.Limit
+		}
+
+		if pagination.Sort != "" || pagination.Order != "" {
+			opts = append(opts, saga.WithSorting(pagination.Sort, pagination.Order))
+		}
 	}
 
+	opts = append(opts, saga.WithOffsetAndLimit(offset, limit))
+
 	batch, err := s.sagaStore.GetByFilter(ctx, opts...)
 
 	if err != nil {
@@ -115,17 +352,41 @@ func (s statusService) GetFilteredBy(ctx context.Context, filters *Filters, pagi
 		}
 
 		statuses[i] = SagaStatus{
-			SagaUID: instance.UID(),
-			Status:  instance.Status().String(),
-			Payload: instance.Saga(),
-			Events:  events,
+			SagaUID:    instance.UID(),
+			Status:     instance.Status().String(),
+			Payload:    instance.Saga(),
+			Events:     events,
+			EntityRefs: instance.EntityRefs(),
 		}
 	}
 
-	return &SagaBatch{
+	res := &SagaBatch{
 		Total: batch.Total,
 		Items: statuses,
-	}, nil
+	}
+
+	if next := offset + len(statuses); len(statuses) > 0 && next < batch.Total {
+		res.NextCursor = encodeCursor(next)
+	}
+
+	return res, nil
+}
+
+func (s statusService) excludeOperation(ctx context.Context, operationId string) (saga.FilterOption, error) {
+	if s.operations == nil {
+		return nil, NewResponseError(http.StatusBadRequest, errors.New("bulk operations aren't enabled, sagas can't be filtered by an operation"))
+	}
+
+	operation, err := s.operations.GetOperation(ctx, operationId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading operation '%s'", operationId)
+	}
+
+	if operation == nil {
+		return nil, NewResponseError(http.StatusNotFound, errors.Errorf("operation '%s' not found", operationId))
+	}
+
+	return saga.WithExcludedIds(operation.SagaUIDs()...), nil
 }
 
 type StatusHandler struct {
@@ -156,17 +417,65 @@ func (h *StatusHandler) GetStatus(resp http.ResponseWriter, r *http.Request) {
 	NewResponseWriter(statusResp, http.StatusOK).write(resp, h.logger)
 }
 
+// IsTreeRequest tells whether the request path is /sagas/{id}/tree, so it can be served on the same route as status
+func IsTreeRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, treePathSuffix)
+}
+
+// GetTree serves the saga with its descendants at /sagas/{id}/tree
+func (h *StatusHandler) GetTree(resp http.ResponseWriter, r *http.Request) {
+	sagaId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sagas/"), treePathSuffix)
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	tree, err := h.service.GetTree(r.Context(), sagaId)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(tree, http.StatusOK).write(resp, h.logger)
+}
+
+// IsChildrenRequest tells whether the request path is /sagas/{id}/children, so it can be served on the same route as status
+func IsChildrenRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, childrenPathSuffix)
+}
+
+// GetChildren serves sagas started by the saga at /sagas/{id}/children
+func (h *StatusHandler) GetChildren(resp http.ResponseWriter, r *http.Request) {
+	sagaId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sagas/"), childrenPathSuffix)
+
+	if sagaId == "" {
+		NewResponseWriterFromErrMsg("Saga id is empty", http.StatusBadRequest).write(resp, h.logger)
+		return
+	}
+
+	children, err := h.service.GetChildren(r.Context(), sagaId)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(children, http.StatusOK).write(resp, h.logger)
+}
+
 func (h *StatusHandler) GetFilteredBy(resp http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
-	var (
-		filters    Filters
-		pagination *Pagination
-	)
+	var pagination *Pagination
+
+	filters, err := h.parseFilters(query)
 
-	filters.SagaID = query.Get("sagaId")
-	filters.Status = query.Get("status")
-	filters.SagaName = query.Get("sagaType")
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
 
 	offset, err := h.getInt(query, "offset")
 
@@ -182,24 +491,40 @@ func (h *StatusHandler) GetFilteredBy(resp http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if offset != nil && limit == nil {
-		NewResponseWriterFromErrMsg("Query param 'limit' must be specified along with 'offset'", http.StatusBadRequest).write(resp, h.logger)
-		return
+	if cursor := query.Get("cursor"); cursor != "" {
+		if offset != nil {
+			NewResponseWriterFromErrMsg("Query params 'cursor' and 'offset' can't be specified together", http.StatusBadRequest).write(resp, h.logger)
+			return
+		}
+
+		offset, err = decodeCursor(cursor)
+
+		if err != nil {
+			NewResponseWriterFromError(err).write(resp, h.logger)
+			return
+		}
 	}
 
-	if limit != nil && offset == nil {
-		NewResponseWriterFromErrMsg("Query param 'offset' must be specified along with 'limit'", http.StatusBadRequest).write(resp, h.logger)
+	sortField, sortOrder, err := h.getSorting(query)
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
 		return
 	}
 
-	if limit != nil || offset != nil {
-		pagination = &Pagination{
-			Offset: *offset,
-			Limit:  *limit,
+	if limit != nil || offset != nil || sortField != "" || sortOrder != "" {
+		pagination = &Pagination{Sort: sortField, Order: sortOrder}
+
+		if offset != nil {
+			pagination.Offset = *offset
+		}
+
+		if limit != nil {
+			pagination.Limit = *limit
 		}
 	}
 
-	statusesResp, err := h.service.GetFilteredBy(r.Context(), &filters, pagination)
+	statusesResp, err := h.service.GetFilteredBy(r.Context(), filters, pagination)
 
 	if err != nil {
 		NewResponseWriterFromError(err).write(resp, h.logger)
@@ -209,6 +534,69 @@ func (h *StatusHandler) GetFilteredBy(resp http.ResponseWriter, r *http.Request)
 	NewResponseWriter(statusesResp, http.StatusOK).write(resp, h.logger)
 }
 
+// GrowthStatsHandler reports sizes of sagas collected by saga.GrowthMonitor
+type GrowthStatsHandler struct {
+	monitor *saga.GrowthMonitor
+	logger  log.Logger
+}
+
+func NewGrowthStatsHandler(logger log.Logger, monitor *saga.GrowthMonitor) *GrowthStatsHandler {
+	return &GrowthStatsHandler{monitor: monitor, logger: logger}
+}
+
+func (h *GrowthStatsHandler) GetStats(resp http.ResponseWriter, r *http.Request) {
+	NewResponseWriter(h.monitor.Stats(), http.StatusOK).write(resp, h.logger)
+}
+
+// OutboxStatsHandler reports messages of saga.Outbox which aren't sent yet
+type OutboxStatsHandler struct {
+	outbox saga.Outbox
+	logger log.Logger
+}
+
+func NewOutboxStatsHandler(logger log.Logger, outbox saga.Outbox) *OutboxStatsHandler {
+	return &OutboxStatsHandler{outbox: outbox, logger: logger}
+}
+
+func (h *OutboxStatsHandler) GetStats(resp http.ResponseWriter, r *http.Request) {
+	stats, err := h.outbox.Stats(r.Context())
+
+	if err != nil {
+		NewResponseWriterFromError(err).write(resp, h.logger)
+		return
+	}
+
+	NewResponseWriter(stats, http.StatusOK).write(resp, h.logger)
+}
+
+// DefinitionsHandler lists registered sagas with their versions
+type DefinitionsHandler struct {
+	versions *saga.VersionRegistry
+	logger   log.Logger
+}
+
+func NewDefinitionsHandler(logger log.Logger, versions *saga.VersionRegistry) *DefinitionsHandler {
+	return &DefinitionsHandler{versions: versions, logger: logger}
+}
+
+func (h *DefinitionsHandler) GetDefinitions(resp http.ResponseWriter, r *http.Request) {
+	NewResponseWriter(h.versions.Definitions(), http.StatusOK).write(resp, h.logger)
+}
+
+// SchemeHandler lists types registered in the scheme together with components and call sites which registered them
+type SchemeHandler struct {
+	registry scheme.KnownTypesRegistry
+	logger   log.Logger
+}
+
+func NewSchemeHandler(logger log.Logger, registry scheme.KnownTypesRegistry) *SchemeHandler {
+	return &SchemeHandler{registry: registry, logger: logger}
+}
+
+func (h *SchemeHandler) GetOwnership(resp http.ResponseWriter, r *http.Request) {
+	NewResponseWriter(h.registry.DumpOwnership(), http.StatusOK).write(resp, h.logger)
+}
+
 func (h *StatusHandler) getInt(values url.Values, paramName string) (*int, error) {
 	paramValue := values.Get(paramName)
 	if paramValue != "" {
@@ -217,12 +605,154 @@ func (h *StatusHandler) getInt(values url.Values, paramName string) (*int, error
 			return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter '%s' is expected to be an integer", paramName))
 		}
 
+		if intValue < 0 {
+			return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter '%s' must not be negative", paramName))
+		}
+
 		return &intValue, nil
 	}
 
 	return nil, nil
 }
 
+// parseFilters is the only place query params selecting sagas are parsed: sagaId, status, sagaType, parentId, entity (kind:id),
+// startedFrom, startedTo, updatedFrom, updatedBefore (RFC3339), q (free-text search) and excludeOperation. Filters.Filter turns them into a store filter.
+func (h *StatusHandler) parseFilters(query url.Values) (*Filters, error) {
+	filters := &Filters{
+		SagaID:           query.Get("sagaId"),
+		Status:           query.Get("status"),
+		SagaName:         query.Get("sagaType"),
+		ParentID:         query.Get("parentId"),
+		ExcludeOperation: query.Get("excludeOperation"),
+		Search:           strings.TrimSpace(query.Get("q")),
+	}
+
+	if filters.Search != "" && len([]rune(filters.Search)) < MinSearchLength {
+		return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'q' must be at least %d characters long", MinSearchLength))
+	}
+
+	if filters.Status != "" && !isKnownStatus(filters.Status) {
+		return nil, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'status' is expected to be one of: %s", strings.Join(knownStatuses, ", ")))
+	}
+
+	if entity := query.Get("entity"); entity != "" {
+		ref, parseErr := saga.ParseEntityRef(entity)
+
+		if parseErr != nil {
+			return nil, NewResponseError(http.StatusBadRequest, errors.New("Query parameter 'entity' is expected to be in format kind:id"))
+		}
+
+		filters.EntityRef = &ref
+	}
+
+	var err error
+
+	if filters.StartedFrom, err = h.getTime(query, "startedFrom"); err != nil {
+		return nil, err
+	}
+
+	if filters.StartedTo, err = h.getTime(query, "startedTo"); err != nil {
+		return nil, err
+	}
+
+	if filters.UpdatedFrom, err = h.getTime(query, "updatedFrom"); err != nil {
+		return nil, err
+	}
+
+	if filters.UpdatedBefore, err = h.getTime(query, "updatedBefore"); err != nil {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+func (h *StatusHandler) getTime(values url.Values, paramName string) (time.Time, error) {
+	paramValue := values.Get(paramName)
+	if paramValue == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, paramValue)
+	if err != nil {
+		return time.Time{}, NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter '%s' is expected to be a time in RFC3339 format", paramName))
+	}
+
+	return t, nil
+}
+
+func (h *StatusHandler) getSorting(values url.Values) (saga.SortField, saga.SortOrder, error) {
+	var (
+		field saga.SortField
+		order saga.SortOrder
+	)
+
+	switch values.Get("sort") {
+	case "":
+	case "startedAt":
+		field = saga.SortByStartedAt
+	case "updatedAt":
+		field = saga.SortByUpdatedAt
+	default:
+		return "", "", NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'sort' is expected to be one of: startedAt, updatedAt"))
+	}
+
+	// sortBy takes names of columns, it's used only if sort isn't specified
+	switch sortBy := saga.SortField(values.Get("sortBy")); sortBy {
+	case "":
+	case saga.SortByStartedAt, saga.SortByUpdatedAt:
+		if field == "" {
+			field = sortBy
+		}
+	default:
+		return "", "", NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'sortBy' is expected to be one of: %s, %s", saga.SortByStartedAt, saga.SortByUpdatedAt))
+	}
+
+	switch values.Get("order") {
+	case "":
+	case "asc":
+		order = saga.SortAsc
+	case "desc":
+		order = saga.SortDesc
+	default:
+		return "", "", NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'order' is expected to be one of: asc, desc"))
+	}
+
+	return field, order, nil
+}
+
+var knownStatuses = []string{"created", "in_progress", "failed", "compensating", "recovering", "completed", "compensating_children", "child_compensation_failed"}
+
+func isKnownStatus(status string) bool {
+	for _, s := range knownStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encodeCursor hides the paging implementation from API clients, they should pass the cursor back as is
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (*int, error) {
+	invalidErr := NewResponseError(http.StatusBadRequest, errors.Errorf("Query parameter 'cursor' is invalid"))
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), cursorPrefix) {
+		return nil, invalidErr
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(decoded), cursorPrefix))
+	if err != nil || offset < 0 {
+		return nil, invalidErr
+	}
+
+	return &offset, nil
+}
+
 type responseWriter struct {
 	body   interface{}
 	status int
@@ -6,15 +6,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-foreman/foreman/testing/log"
 	"github.com/stretchr/testify/require"
 
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
 
 	"github.com/pkg/errors"
 
 	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/filter"
 
 	sagaMock "github.com/go-foreman/foreman/testing/mocks/saga"
 	"github.com/golang/mock/gomock"
@@ -102,7 +105,8 @@ func TestStatusService(t *testing.T) {
 				EXPECT().
 				GetByFilter(ctx, gomock.Any()).
 				Do(func(ctx context.Context, filters ...saga.FilterOption) {
-					assert.Len(t, filters, 3)
+					// the combined filter and the page size cap
+					assert.Len(t, filters, 2)
 				}).
 				Return(instancesBatch, nil)
 
@@ -128,7 +132,8 @@ func TestStatusService(t *testing.T) {
 				EXPECT().
 				GetByFilter(ctx, gomock.Any()).
 				Do(func(ctx context.Context, filters ...saga.FilterOption) {
-					assert.Len(t, filters, 3)
+					// the combined filter and the page size cap
+					assert.Len(t, filters, 2)
 				}).
 				Return(nil, errors.New("some error"))
 
@@ -193,6 +198,207 @@ func TestStatusService(t *testing.T) {
 	})
 }
 
+func TestStatusServicePaging(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+	ctx := context.Background()
+
+	batchOf := func(total int, ids ...string) *saga.InstancesBatch {
+		batch := &saga.InstancesBatch{Total: total}
+		for _, id := range ids {
+			batch.Items = append(batch.Items, saga.NewSagaInstance(id, "", sagaMock.NewMockSaga(ctrl)))
+		}
+		return batch
+	}
+
+	t.Run("next cursor points to the next page", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Do(func(ctx context.Context, filters ...saga.FilterOption) {
+				// pagination and sorting
+				assert.Len(t, filters, 2)
+			}).
+			Return(batchOf(5, "1", "2"), nil)
+
+		resp, err := statusService.GetFilteredBy(ctx, &Filters{}, &Pagination{Offset: 2, Limit: 2, Sort: saga.SortByUpdatedAt, Order: saga.SortAsc})
+		require.NoError(t, err)
+		assert.Equal(t, 5, resp.Total)
+		assert.Len(t, resp.Items, 2)
+
+		offset, err := decodeCursor(resp.NextCursor)
+		require.NoError(t, err)
+		assert.Equal(t, 4, *offset)
+	})
+
+	t.Run("no next cursor on the last page", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Return(batchOf(5, "5"), nil)
+
+		resp, err := statusService.GetFilteredBy(ctx, &Filters{}, &Pagination{Offset: 4, Limit: 2})
+		require.NoError(t, err)
+		assert.Empty(t, resp.NextCursor)
+	})
+
+	t.Run("parent and time range filters", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Do(func(ctx context.Context, filters ...saga.FilterOption) {
+				// the combined filter and pagination
+				assert.Len(t, filters, 2)
+			}).
+			Return(batchOf(0), nil)
+
+		_, err := statusService.GetFilteredBy(ctx, &Filters{ParentID: "777", StartedTo: time.Now()}, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("too big limit is capped", func(t *testing.T) {
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any()).
+			Return(batchOf(MaxPageSize*2, "1"), nil)
+
+		resp, err := statusService.GetFilteredBy(ctx, &Filters{}, &Pagination{Limit: MaxPageSize * 10})
+		require.NoError(t, err)
+
+		offset, err := decodeCursor(resp.NextCursor)
+		require.NoError(t, err)
+		assert.Equal(t, 1, *offset)
+	})
+}
+
+func TestStatusServiceTree(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+	ctx := context.Background()
+
+	sagaExample := sagaMock.NewMockSaga(ctrl)
+	sagaExample.EXPECT().GroupKind().Return(scheme.GroupKind{Group: "orders", Kind: "OrderSaga"}).AnyTimes()
+
+	t.Run("saga with children", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(saga.NewSagaInstance("1", "", sagaExample), nil)
+		gomock.InOrder(
+			storeMock.EXPECT().GetByFilter(ctx, gomock.Any(), gomock.Any()).Return(&saga.InstancesBatch{Total: 1, Items: []saga.Instance{saga.NewSagaInstance("2", "1", sagaExample)}}, nil),
+			storeMock.EXPECT().GetByFilter(ctx, gomock.Any(), gomock.Any()).Return(&saga.InstancesBatch{}, nil),
+		)
+
+		tree, err := statusService.GetTree(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, &SagaTreeNode{
+			SagaUID:  "1",
+			SagaType: "orders.OrderSaga",
+			Status:   "created",
+			Children: []SagaTreeNode{{SagaUID: "2", SagaType: "orders.OrderSaga", Status: "created", Children: []SagaTreeNode{}}},
+		}, tree)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(nil, nil)
+
+		_, err := statusService.GetTree(ctx, "1")
+		require.IsType(t, ResponseError{}, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+
+	t.Run("cycle is a conflict", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(saga.NewSagaInstance("1", "1", sagaExample), nil)
+		storeMock.EXPECT().GetByFilter(ctx, gomock.Any(), gomock.Any()).Return(&saga.InstancesBatch{Total: 1, Items: []saga.Instance{saga.NewSagaInstance("1", "1", sagaExample)}}, nil)
+
+		_, err := statusService.GetTree(ctx, "1")
+		require.IsType(t, ResponseError{}, err)
+		assert.Equal(t, http.StatusConflict, err.(ResponseError).Status())
+		assert.EqualError(t, err, "saga '1' is its own ancestor, parents of sagas in the tree of '1' form a cycle")
+	})
+}
+
+func TestStatusServiceChildren(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	storeMock := sagaMock.NewMockStore(ctrl)
+	statusService := NewStatusService(storeMock)
+	ctx := context.Background()
+
+	sagaExample := sagaMock.NewMockSaga(ctrl)
+	sagaExample.EXPECT().GroupKind().Return(scheme.GroupKind{Group: "orders", Kind: "OrderSaga"}).AnyTimes()
+
+	t.Run("saga with children", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(saga.NewSagaInstance("1", "", sagaExample), nil)
+		storeMock.
+			EXPECT().
+			GetByFilter(ctx, gomock.Any(), gomock.Any()).
+			Return(&saga.InstancesBatch{Total: 2, Items: []saga.Instance{saga.NewSagaInstance("2", "1", sagaExample), saga.NewSagaInstance("3", "1", sagaExample)}}, nil)
+
+		children, err := statusService.GetChildren(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, &SagaChildren{
+			SagaUID: "1",
+			Children: []SagaChild{
+				{SagaUID: "2", SagaType: "orders.OrderSaga", Status: "created"},
+				{SagaUID: "3", SagaType: "orders.OrderSaga", Status: "created"},
+			},
+		}, children)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		storeMock.EXPECT().GetById(ctx, "1").Return(nil, nil)
+
+		_, err := statusService.GetChildren(ctx, "1")
+		require.IsType(t, ResponseError{}, err)
+		assert.Equal(t, http.StatusNotFound, err.(ResponseError).Status())
+	})
+}
+
+func TestCursor(t *testing.T) {
+	offset, err := decodeCursor(encodeCursor(42))
+	require.NoError(t, err)
+	assert.Equal(t, 42, *offset)
+
+	for _, invalid := range []string{"!!!", "NDI", encodeCursor(-1)} {
+		_, err := decodeCursor(invalid)
+		assert.EqualError(t, err, "Query parameter 'cursor' is invalid")
+	}
+}
+
+func TestFilters_Filter(t *testing.T) {
+	assert.Nil(t, Filters{ExcludeOperation: "op"}.Filter())
+
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	before := from.Add(time.Hour)
+
+	f := Filters{
+		SagaID:        "123",
+		Status:        "failed",
+		ParentID:      "777",
+		UpdatedFrom:   from,
+		UpdatedBefore: before,
+		EntityRef:     &saga.EntityRef{Kind: "order", ID: "12345"},
+		Search:        "john@example.com",
+		Where:         filter.Not(filter.Name("orders.OrderSaga")),
+	}
+
+	assert.Equal(t, filter.And(
+		filter.SagaID("123"),
+		filter.StatusIn("failed"),
+		filter.ParentID("777"),
+		filter.UpdatedFrom(from),
+		filter.UpdatedBefore(before),
+		filter.EntityRef("order", "12345"),
+		filter.DataContains("john@example.com"),
+		filter.Not(filter.Name("orders.OrderSaga")),
+	), f.Filter())
+}
+
 type dataContract struct {
 	message.ObjectMeta
 }
@@ -206,6 +412,49 @@ func TestHandler(t *testing.T) {
 
 	handler := NewStatusHandler(testLogger, statusServiceMock)
 
+	t.Run("Tree", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/tree", nil)
+		assert.True(t, IsTreeRequest(req))
+
+		tree := &SagaTreeNode{SagaUID: "123", Status: "in_progress", Children: []SagaTreeNode{{SagaUID: "456", Status: "completed", Children: []SagaTreeNode{}}}}
+
+		statusServiceMock.
+			EXPECT().
+			GetTree(req.Context(), "123").
+			Return(tree, nil)
+
+		rr := httptest.NewRecorder()
+		handler.GetTree(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"saga_uid":"123","saga_type":"","status":"in_progress","children":[{"saga_uid":"456","saga_type":"","status":"completed","children":[]}]}`, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		handler.GetTree(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas//tree", nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("Children", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8000/sagas/123/children", nil)
+		assert.True(t, IsChildrenRequest(req))
+		assert.False(t, IsTreeRequest(req))
+
+		statusServiceMock.
+			EXPECT().
+			GetChildren(req.Context(), "123").
+			Return(&SagaChildren{SagaUID: "123", Children: []SagaChild{{SagaUID: "456", Status: "completed"}}}, nil)
+
+		rr := httptest.NewRecorder()
+		handler.GetChildren(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"saga_uid":"123","children":[{"saga_uid":"456","saga_type":"","status":"completed"}]}`, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		handler.GetChildren(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas//children", nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
 	t.Run("Status", func(t *testing.T) {
 		t.Run("sagaid is empty", func(t *testing.T) {
 
@@ -309,6 +558,48 @@ func TestHandler(t *testing.T) {
 			assert.Equal(t, rr.Header().Get("Content-Type"), "application/json")
 		})
 
+		t.Run("get filtered by entity ref", func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:8000/sagas?entity=order:12345", nil)
+
+			statusServiceMock.
+				EXPECT().
+				GetFilteredBy(req.Context(), &Filters{EntityRef: &saga.EntityRef{Kind: "order", ID: "12345"}}, nil).
+				Return(&SagaBatch{}, nil)
+
+			rr := httptest.NewRecorder()
+			handler.GetFilteredBy(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			rr = httptest.NewRecorder()
+			handler.GetFilteredBy(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas?entity=order", nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Equal(t, "Query parameter 'entity' is expected to be in format kind:id", rr.Body.String())
+		})
+
+		t.Run("filter by update time", func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:8000/sagas?updatedFrom=2021-03-01T00:00:00Z&updatedBefore=2021-03-02T00:00:00Z", nil)
+			require.NoError(t, err)
+
+			statusServiceMock.
+				EXPECT().
+				GetFilteredBy(req.Context(), &Filters{
+					UpdatedFrom:   time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+					UpdatedBefore: time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+				}, nil).
+				Return(&SagaBatch{}, nil)
+
+			rr := httptest.NewRecorder()
+			handler.GetFilteredBy(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+		})
+
+		t.Run("invalid update time", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.GetFilteredBy(rr, httptest.NewRequest("GET", "http://localhost:8000/sagas?updatedBefore=yesterday", nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+
 		t.Run("get filtered returns a response error", func(t *testing.T) {
 			req, err := http.NewRequest("GET", "http://localhost:8000/sagas?&status=created&sagaType=someType", nil)
 			require.NoError(t, err)
@@ -349,6 +640,76 @@ func TestHandler(t *testing.T) {
 			assert.Contains(t, rr.Body.String(), "some error")
 		})
 
+		t.Run("pass cursor and sorting through", func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:8000/sagas?status=failed&limit=5&sort=updatedAt&order=asc&cursor="+encodeCursor(15), nil)
+			require.NoError(t, err)
+
+			statuses := &SagaBatch{Total: 30, Items: []SagaStatus{{SagaUID: "123", Status: "failed"}}, NextCursor: encodeCursor(20)}
+
+			statusServiceMock.
+				EXPECT().
+				GetFilteredBy(req.Context(), &Filters{Status: "failed"}, &Pagination{
+					Offset: 15,
+					Limit:  5,
+					Sort:   saga.SortByUpdatedAt,
+					Order:  saga.SortAsc,
+				}).
+				Return(statuses, nil)
+
+			rr := httptest.NewRecorder()
+			handler.GetFilteredBy(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Contains(t, rr.Body.String(), `"next_cursor":"`+encodeCursor(20)+`"`)
+		})
+
+		t.Run("parent, time range and sortBy", func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:8000/sagas?parentId=777&startedFrom=2022-01-01T00:00:00Z&startedTo=2022-01-02T00:00:00Z&sortBy=started_at&order=desc&limit=50", nil)
+			require.NoError(t, err)
+
+			statusServiceMock.
+				EXPECT().
+				GetFilteredBy(req.Context(), &Filters{
+					ParentID:    "777",
+					StartedFrom: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+					StartedTo:   time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+				}, &Pagination{
+					Limit: 50,
+					Sort:  saga.SortByStartedAt,
+					Order: saga.SortDesc,
+				}).
+				Return(&SagaBatch{}, nil)
+
+			rr := httptest.NewRecorder()
+			handler.GetFilteredBy(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+		})
+
+		t.Run("invalid paging params", func(t *testing.T) {
+			for query, errMsg := range map[string]string{
+				"sort=name":                          "Query parameter 'sort' is expected to be one of: startedAt, updatedAt",
+				"order=up":                           "Query parameter 'order' is expected to be one of: asc, desc",
+				"cursor=xxx":                         "Query parameter 'cursor' is invalid",
+				"offset=1&cursor=" + encodeCursor(1): "Query params 'cursor' and 'offset' can't be specified together",
+				"limit=abc":                          "Query parameter 'limit' is expected to be an integer",
+				"offset=-1":                          "Query parameter 'offset' must not be negative",
+				"sortBy=name":                        "Query parameter 'sortBy' is expected to be one of: started_at, updated_at",
+				"status=lost":                        "Query parameter 'status' is expected to be one of: created, in_progress, failed, compensating, recovering, completed, compensating_children, child_compensation_failed",
+				"startedFrom=yesterday":              "Query parameter 'startedFrom' is expected to be a time in RFC3339 format",
+				"q=ab":                               "Query parameter 'q' must be at least 3 characters long",
+			} {
+				req, err := http.NewRequest("GET", "http://localhost:8000/sagas?"+query, nil)
+				require.NoError(t, err)
+
+				rr := httptest.NewRecorder()
+				handler.GetFilteredBy(rr, req)
+
+				assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+				assert.Equal(t, errMsg, rr.Body.String(), query)
+			}
+		})
+
 		t.Run("pass limit and offset through from API to Store", func(t *testing.T) {
 			req, err := http.NewRequest("GET", "http://localhost:8000/sagas?&status=created&sagaType=someType&offset=10&limit=10", nil)
 			require.NoError(t, err)
@@ -2,37 +2,110 @@ package component
 
 import (
 	"net/http"
+	"time"
 
 	foreman "github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/health"
 	"github.com/go-foreman/foreman/log"
 	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/saga"
 	"github.com/go-foreman/foreman/saga/api/handlers/status"
 	"github.com/go-foreman/foreman/saga/contracts"
 	"github.com/go-foreman/foreman/saga/handlers"
 	"github.com/go-foreman/foreman/saga/mutex"
+	"github.com/go-foreman/foreman/saga/retention"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// workerRenewInterval is how often locks of workers are renewed when the saga mutex is used as the worker mutex
+const workerRenewInterval = time.Second * 10
+
+// sagaLockRenewInterval is how often locks of sagas are renewed while they are handled, a third of TTL of expiring locks
+// (e.g. redis ones) and workerRenewInterval for locks which are held as long as their connection is alive
+func sagaLockRenewInterval(m mutex.Mutex) time.Duration {
+	if expiring, ok := m.(interface{ LockTTL() time.Duration }); ok && expiring.LockTTL() > 0 {
+		return expiring.LockTTL() / 3
+	}
+
+	return workerRenewInterval
+}
+
 type Component struct {
 	sagas            []saga.Saga
+	sagaVersions     []sagaVersions
 	contracts        []message.Object
+	expectedEvents   []message.Object
 	sagaStoreFactory StoreFactory
 	sagaMutex        mutex.Mutex
 	endpoints        []endpoint.Endpoint
 	configOpts       []configOption
+	shutdown         *shutdown
 }
 
 type opts struct {
-	uidService   saga.SagaUIDService
-	apiServerMux *http.ServeMux
+	uidService    saga.SagaUIDService
+	apiServerMux  *http.ServeMux
+	apiServer     *http.Server
+	readOnlyApi   bool
+	retention     *retentionOpts
+	history       *historyRetentionOpts
+	growthLimits  []saga.GrowthMonitorOpt
+	monitorGrowth bool
+	metrics       prometheus.Registerer
+	// optimisticRetries is nil unless WithOptimisticLocking is used
+	optimisticRetries *int
+	operations        *operationsOpts
+	outbox            *outboxOpts
+	schedule          *scheduleOpts
+	retry             *retryOpts
+	updateRetry       *updateRetryOpts
+	correlation       map[scheme.GroupKind]saga.CorrelationRule
+	verifier          *signing.Verifier
+	traceCarrier      saga.TraceCarrier
+	health            *health.Health
+}
+
+type retryOpts struct {
+	maxAttempts int
+	backoff     handlers.BackoffFunc
+}
+
+type updateRetryOpts struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+type outboxOpts struct {
+	relayInterval time.Duration
+	batchSize     int
+}
+
+type scheduleOpts struct {
+	interval  time.Duration
+	batchSize int
+}
+
+type operationsOpts struct {
+	store    saga.OperationStore
+	interval time.Duration
 }
 
 type configOption func(o *opts)
 
+type sagaVersions struct {
+	selector saga.VersionSelector
+	versions []saga.Saga
+}
+
+// NewSagaComponent creates the component keeping sagas in the store created by sagaStoreFactory. The mutex locks a saga while
+// a message of it is handled, it may be nil with WithOptimisticLocking.
 func NewSagaComponent(sagaStoreFactory StoreFactory, sagaMutex mutex.Mutex, opts ...configOption) *Component {
-	return &Component{sagaStoreFactory: sagaStoreFactory, sagaMutex: sagaMutex, configOpts: opts}
+	return &Component{sagaStoreFactory: sagaStoreFactory, sagaMutex: sagaMutex, configOpts: opts, shutdown: newShutdown()}
 }
 
 func (c Component) Init(mBus *foreman.MessageBus) error {
@@ -45,26 +118,183 @@ func (c Component) Init(mBus *foreman.MessageBus) error {
 		opts.uidService = saga.NewSagaUIDService()
 	}
 
+	if c.sagaMutex == nil && opts.optimisticRetries == nil {
+		return errors.New("saga mutex is nil, it may be omitted only with WithOptimisticLocking")
+	}
+
+	if opts.optimisticRetries != nil && opts.outbox == nil {
+		return errors.New("optimistic locking requires WithOutbox, deliveries of a saga must be saved in the transaction of its update")
+	}
+
 	store, err := c.sagaStoreFactory(mBus.Marshaller())
 
 	if err != nil {
 		return err
 	}
 
+	// workers of the component must run once among all replicas, they compete for locks of the saga mutex
+	// unless foreman.WithWorkerMutex is configured
+	if mBus.WorkerMutex() == nil {
+		if c.sagaMutex != nil {
+			mBus.UseWorkerMutex(c.sagaMutex, workerRenewInterval)
+		} else if opts.outbox != nil || opts.schedule != nil || opts.operations != nil || opts.retention != nil || opts.history != nil {
+			mBus.Logger().Logf(log.WarnLevel, "saga component has no mutex and foreman.WithWorkerMutex isn't configured, its workers run in every replica")
+		}
+	}
+
+	var (
+		growthMonitor     *saga.GrowthMonitor
+		metrics           *saga.Metrics
+		eventsHandlerOpts []handlers.EventsHandlerOpt
+	)
+
+	if opts.monitorGrowth {
+		growthMonitor = saga.NewGrowthMonitor(mBus.Marshaller(), opts.growthLimits...)
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithGrowthMonitor(growthMonitor))
+	}
+
+	if opts.metrics != nil {
+		if metrics, err = saga.NewMetrics(opts.metrics); err != nil {
+			return err
+		}
+	}
+
+	versions, err := c.versionRegistry(mBus)
+	if err != nil {
+		return err
+	}
+
+	eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithVersions(versions), handlers.WithMetrics(metrics))
+
+	if opts.optimisticRetries != nil {
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithOptimisticLocking(*opts.optimisticRetries))
+	}
+
+	if len(opts.correlation) > 0 {
+		for evGK, rule := range opts.correlation {
+			if rule.EventField == "" || rule.SagaField == "" {
+				return errors.Errorf("correlation rule of event %s must specify both event and saga fields", evGK)
+			}
+		}
+
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithCorrelation(opts.correlation))
+	}
+
+	if opts.retry != nil {
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithRetryPolicy(opts.retry.maxAttempts, opts.retry.backoff))
+	}
+
+	if opts.updateRetry != nil {
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithUpdateRetry(opts.updateRetry.maxRetries, opts.updateRetry.backoff))
+	}
+
+	controlHandlerOpts := []handlers.ControlHandlerOpt{handlers.WithControlVersions(versions), handlers.WithControlMetrics(metrics)}
+
+	if opts.optimisticRetries != nil {
+		controlHandlerOpts = append(controlHandlerOpts, handlers.WithControlOptimisticLocking(*opts.optimisticRetries))
+	}
+
+	if opts.traceCarrier != nil {
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithTracePropagation(opts.traceCarrier))
+		controlHandlerOpts = append(controlHandlerOpts, handlers.WithControlTracePropagation(opts.traceCarrier))
+	}
+
+	var outbox saga.Outbox
+
+	if opts.outbox != nil {
+		transactionalStore, ok := store.(saga.TransactionalStore)
+		if !ok {
+			return errors.Errorf("outbox requires saga.TransactionalStore, %T isn't one", store)
+		}
+
+		db, driver := transactionalStore.DB()
+
+		sqlOutbox, err := saga.NewSQLOutbox(db, driver, mBus.Marshaller())
+		if err != nil {
+			return err
+		}
+
+		outbox = sqlOutbox
+
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithOutbox(outbox))
+		controlHandlerOpts = append(controlHandlerOpts, handlers.WithControlOutbox(outbox))
+		mBus.RegisterWorkers(c.shutdown.worker(saga.NewOutboxRelay(outbox, mBus.Router(), opts.outbox.relayInterval, opts.outbox.batchSize, mBus.Logger())))
+	}
+
+	if opts.schedule != nil {
+		transactionalStore, ok := store.(saga.TransactionalStore)
+		if !ok {
+			return errors.Errorf("scheduler requires saga.TransactionalStore, %T isn't one", store)
+		}
+
+		db, driver := transactionalStore.DB()
+
+		scheduler, err := saga.NewSQLScheduler(db, driver, mBus.Marshaller())
+		if err != nil {
+			return err
+		}
+
+		eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithScheduler(scheduler))
+		controlHandlerOpts = append(controlHandlerOpts, handlers.WithControlScheduler(scheduler))
+		mBus.RegisterWorkers(c.shutdown.worker(saga.NewScheduleDispatcher(scheduler, mBus.Router(), opts.schedule.interval, opts.schedule.batchSize, mBus.Logger())))
+	}
+
+	var operationRunner *status.OperationRunner
+
+	if opts.operations != nil {
+		operationRunner = status.NewOperationRunner(opts.operations.store, status.NewControlService(store, mBus.Router()), opts.operations.interval, mBus.Logger())
+		mBus.RegisterWorkers(c.shutdown.worker(operationRunner))
+	}
+
 	if opts.apiServerMux != nil {
-		initApiServer(opts.apiServerMux, store, mBus.Logger())
+		initApiServer(opts.apiServerMux, store, growthMonitor, versions, opts.metrics, mBus, opts.readOnlyApi, opts.operations, operationRunner, outbox)
 	}
 
-	eventHandler := handlers.NewEventsHandler(store, c.sagaMutex, mBus.SchemeRegistry(), opts.uidService)
-	sagaControlHandler := handlers.NewSagaControlHandler(store, c.sagaMutex, mBus.SchemeRegistry(), opts.uidService)
+	if opts.health != nil {
+		c.addHealthChecks(opts.health, store)
+
+		if opts.apiServerMux != nil {
+			opts.health.Register(opts.apiServerMux)
+		}
+	}
+
+	if opts.retention != nil {
+		mBus.RegisterWorkers(c.shutdown.worker(newRetentionSweeper(store, opts.retention.maxAge, opts.retention.interval, mBus.Logger())))
+	}
+
+	if opts.history != nil {
+		mBus.RegisterWorkers(c.shutdown.worker(retention.NewRunner(store, opts.history.maxAge, mBus.Logger(), opts.history.opts...)))
+	}
+
+	drain := handlers.NewDrain(mBus.Logger())
+	c.shutdown.drain = drain
+	c.shutdown.store = store
+	c.shutdown.apiServer = opts.apiServer
+	var sagaMutex mutex.Mutex
+	if c.sagaMutex != nil {
+		sagaMutex = drain.Mutex(mutex.LeaseRenewableLocks(c.sagaMutex, sagaLockRenewInterval(c.sagaMutex), mBus.Logger()))
+	}
+	eventsHandlerOpts = append(eventsHandlerOpts, handlers.WithDrain(drain))
+
+	eventHandler := handlers.NewEventsHandler(store, sagaMutex, mBus.SchemeRegistry(), opts.uidService, eventsHandlerOpts...)
+	controlHandlerOpts = append(controlHandlerOpts, handlers.WithControlDrain(drain))
+
+	sagaControlHandler := handlers.NewSagaControlHandler(store, sagaMutex, mBus.SchemeRegistry(), opts.uidService, controlHandlerOpts...)
 
 	contracts.RegisterSagaContracts(mBus.SchemeRegistry())
 
-	mBus.Dispatcher().SubscribeForCmd(&contracts.StartSagaCommand{}, sagaControlHandler.Handle)
-	mBus.Dispatcher().SubscribeForCmd(&contracts.RecoverSagaCommand{}, sagaControlHandler.Handle)
-	mBus.Dispatcher().SubscribeForCmd(&contracts.CompensateSagaCommand{}, sagaControlHandler.Handle)
+	if opts.verifier != nil {
+		if err := requireSignedContracts(opts.verifier, mBus.SchemeRegistry()); err != nil {
+			return err
+		}
+	}
 
-	for _, s := range c.sagas {
+	mBus.Dispatcher().HandleCommand(&contracts.StartSagaCommand{}, sagaControlHandler.Handle)
+	mBus.Dispatcher().HandleCommand(&contracts.RecoverSagaCommand{}, sagaControlHandler.Handle)
+	mBus.Dispatcher().HandleCommand(&contracts.CompensateSagaCommand{}, sagaControlHandler.Handle)
+	mBus.Dispatcher().HandleCommand(&contracts.TimeoutSagaCommand{}, sagaControlHandler.Handle)
+
+	for _, s := range c.allSagas() {
 		s.SetSchema(mBus.SchemeRegistry())
 		s.Init()
 
@@ -79,17 +309,31 @@ func (c Component) Init(mBus *foreman.MessageBus) error {
 		}
 	}
 
+	for _, ev := range c.expectedEvents {
+		mBus.Dispatcher().SubscribeForEvent(ev, eventHandler.Handle)
+	}
+
 	for _, sagaEndpoint := range c.endpoints {
 		mBus.Router().RegisterEndpoint(sagaEndpoint,
 			&contracts.StartSagaCommand{},
 			&contracts.RecoverSagaCommand{},
 			&contracts.CompensateSagaCommand{},
+			&contracts.TimeoutSagaCommand{},
 			&contracts.SagaCompletedEvent{},
 			&contracts.SagaChildCompletedEvent{},
 		)
 		mBus.Router().RegisterEndpoint(sagaEndpoint, c.contracts...)
 	}
 
+	// timeouts are saved with sagas by the scheduler, otherwise endpoints must hold them, a delay must not block a handler
+	if opts.schedule == nil {
+		for _, e := range mBus.Router().Route(&contracts.TimeoutSagaCommand{}) {
+			if !endpoint.SupportsDelay(e) {
+				return errors.Errorf("endpoint %s sending saga timeouts doesn't support delays, create it with endpoint.WithDelayedExchange or endpoint.WithDelayQueues, or enable WithScheduler", e.Name())
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -97,10 +341,25 @@ func (c *Component) RegisterSagas(sagas ...saga.Saga) {
 	c.sagas = append(c.sagas, sagas...)
 }
 
+// RegisterSagaVersions registers versions of one saga, a version is chosen by the selector for each new instance and persisted with it:
+// the instance is created as the type of the chosen version, events are handled by that type till the instance ends.
+// Versions are numbered from 1 in the order they are passed, the saga is listed at /sagas/definitions under the name of the first version.
+// StartSagaCommand may carry any of the versions, fields of the saga are copied into the chosen version by their json names.
+// A version must stay registered while its instances run, otherwise their events fail with saga.VersionMismatchErr.
+func (c *Component) RegisterSagaVersions(selector saga.VersionSelector, versions ...saga.Saga) {
+	c.sagaVersions = append(c.sagaVersions, sagaVersions{selector: selector, versions: versions})
+}
+
 func (c *Component) RegisterContracts(contracts ...message.Object) {
 	c.contracts = append(c.contracts, contracts...)
 }
 
+// RegisterExpectedEvents passes events of the types to the events handler even though no saga has a handler for them,
+// they are delivered only to sagas which wait for them, see saga.SagaContext.ExpectEvent. Types must be registered in the scheme.
+func (c *Component) RegisterExpectedEvents(events ...message.Object) {
+	c.expectedEvents = append(c.expectedEvents, events...)
+}
+
 func (c *Component) RegisterSagaEndpoints(endpoints ...endpoint.Endpoint) {
 	c.endpoints = append(c.endpoints, endpoints...)
 }
@@ -117,10 +376,304 @@ func WithSagaApiServer(mux *http.ServeMux) configOption {
 	}
 }
 
-func initApiServer(mux *http.ServeMux, store saga.Store, logger log.Logger) {
-	statusHandler := status.NewStatusHandler(logger, status.NewStatusService(store))
-	mux.HandleFunc("/sagas", statusHandler.GetFilteredBy)
-	mux.HandleFunc("/sagas/", statusHandler.GetStatus)
+// WithSagaApiServerShutdown makes Component.Shutdown shut down the server which serves the mux passed into WithSagaApiServer,
+// requests in progress are awaited until ctx of Shutdown is done
+func WithSagaApiServerShutdown(server *http.Server) configOption {
+	return func(o *opts) {
+		o.apiServer = server
+	}
+}
+
+// WithReadOnlyApi disables POST /sagas/{id}/recover, POST /sagas/{id}/compensate, DELETE /sagas/{id}, DELETE /sagas and POST /operations endpoints of the api server
+func WithReadOnlyApi() configOption {
+	return func(o *opts) {
+		o.readOnlyApi = true
+	}
+}
+
+// WithSagaRetention periodically deletes completed sagas last updated more than maxAge ago. The sweeper is a foreman.Worker,
+// it runs while MessageBus.RunWorkers runs and stops together with it. Replicas compete for its lock, so it sweeps in one of them at a time.
+func WithSagaRetention(maxAge time.Duration, interval time.Duration) configOption {
+	return func(o *opts) {
+		o.retention = &retentionOpts{maxAge: maxAge, interval: interval}
+	}
+}
+
+// WithHistoryRetention periodically deletes completed sagas last updated more than maxAge ago together with their history,
+// see retention.Runner. Unlike WithSagaRetention it deletes in batches, each saga in its own transaction, and can archive sagas before deletion.
+// Like the sweeper it runs in one replica at a time.
+func WithHistoryRetention(maxAge time.Duration, options ...retention.Opt) configOption {
+	return func(o *opts) {
+		o.history = &historyRetentionOpts{maxAge: maxAge, opts: options}
+	}
+}
+
+// WithGrowthLimits enables tracking of saga payload size and history length on each update, see saga.GrowthMonitor.
+// Stats are available at /sagas/stats if the api server is enabled.
+func WithGrowthLimits(limits ...saga.GrowthMonitorOpt) configOption {
+	return func(o *opts) {
+		o.monitorGrowth = true
+		o.growthLimits = limits
+	}
+}
+
+// WithMetrics registers prometheus metrics of saga handling in the registerer, see saga.Metrics.
+// If the registerer is also a prometheus.Gatherer (e.g. prometheus.NewRegistry()) metrics are served at /sagas/metrics of the api server.
+func WithMetrics(registerer prometheus.Registerer) configOption {
+	return func(o *opts) {
+		o.metrics = registerer
+	}
+}
+
+// WithBulkOperations enables bulk recovering and compensation of sagas tracked in the store. The api server serves
+// POST /operations?action=recover|compensate&status=...&sagaType=..., GET /operations/{id} with progress of the operation and
+// GET /sagas?excludeOperation={id} hiding sagas queued in it. Actions are applied by status.OperationRunner worker,
+// it checks for unfinished operations every interval and resumes them after a restart. It runs in one replica at a time under the worker lock.
+func WithBulkOperations(store saga.OperationStore, interval time.Duration) configOption {
+	return func(o *opts) {
+		o.operations = &operationsOpts{store: store, interval: interval}
+	}
+}
+
+// WithOutbox writes messages dispatched by sagas into saga_outbox table in the transaction which saves the saga, instead of sending them.
+// A worker sends up to batchSize pending messages every relayInterval and marks them as sent once endpoints accept them,
+// messages of one saga are sent in the order they were dispatched. Messages are sent at least once, a message may be sent again
+// if the process stops before it's marked as sent. The store must be saga.TransactionalStore, e.g. created by saga.NewSQLSagaStore.
+// Counts of pending and failed messages are served at /sagas/outbox of the api server.
+func WithOutbox(relayInterval time.Duration, batchSize int) configOption {
+	return func(o *opts) {
+		o.outbox = &outboxOpts{relayInterval: relayInterval, batchSize: batchSize}
+	}
+}
+
+// WithScheduler keeps events sagas schedule with SagaContext.Schedule in saga_schedule table, they are written in the transaction
+// which saves the saga and survive restarts, unlike timeouts delayed by the broker. A worker sends up to batchSize due events
+// every interval, pending events of a completed saga are cancelled. The store must be saga.TransactionalStore.
+func WithScheduler(interval time.Duration, batchSize int) configOption {
+	return func(o *opts) {
+		o.schedule = &scheduleOpts{interval: interval, batchSize: batchSize}
+	}
+}
+
+// WithOptimisticLocking handles saga events and commands without the saga mutex, concurrent updates are detected by saga versions
+// instead, see handlers.WithOptimisticLocking and handlers.WithControlOptimisticLocking. The mutex isn't used at all then
+// and may be nil. It requires WithOutbox, deliveries are written in the transaction which saves the saga.
+func WithOptimisticLocking(maxRetries int) configOption {
+	return func(o *opts) {
+		o.optimisticRetries = &maxRetries
+	}
+}
+
+// WithRetryPolicy handles a saga event again after a delay returned by backoff if a handler of the saga fails, see handlers.WithRetryPolicy.
+// Once maxAttempts are exhausted contracts.SagaHandlingFailedEvent is sent, route it to a dead letter endpoint with mBus.Router().RegisterEndpoint.
+func WithRetryPolicy(maxAttempts int, backoff handlers.BackoffFunc) configOption {
+	return func(o *opts) {
+		o.retry = &retryOpts{maxAttempts: maxAttempts, backoff: backoff}
+	}
+}
+
+// WithUpdateRetry changes how many times saving a saga is retried after a transient store error while an event is handled,
+// see handlers.WithUpdateRetry. An update is retried 3 times with 100ms backoff by default, maxRetries 0 disables retries.
+func WithUpdateRetry(maxRetries int, backoff time.Duration) configOption {
+	return func(o *opts) {
+		o.updateRetry = &updateRetryOpts{maxRetries: maxRetries, backoff: backoff}
+	}
+}
+
+// WithCorrelation finds sagas of the events listed in rules by a field of the event instead of saga uid in headers,
+// see saga.CorrelationRule. The store looks the saga up with Store.GetByCorrelation, an error is returned if several sagas match.
+func WithCorrelation(rules map[scheme.GroupKind]saga.CorrelationRule) configOption {
+	return func(o *opts) {
+		o.correlation = rules
+	}
+}
+
+// WithSignedContracts requires signatures of saga contracts, e.g. StartSagaCommand or CompensateSagaCommand, so they are accepted
+// only from trusted services. Pass the same verifier into foreman.WithSignatureVerification, create it with signing.WithOptionalSignatures
+// to leave events of sagas unsigned. Saga endpoints must sign messages with endpoint.WithSigner, the component sends contracts too.
+func WithSignedContracts(verifier *signing.Verifier) configOption {
+	return func(o *opts) {
+		o.verifier = verifier
+	}
+}
+
+// WithTracePropagation carries trace context of messages received by sagas over to messages they send, e.g. tracing.NewTraceCarrier().
+// Messages without a correlation id in message.TraceIDHeader get one, so logs of one saga flow can be found by it.
+func WithTracePropagation(carrier saga.TraceCarrier) configOption {
+	return func(o *opts) {
+		o.traceCarrier = carrier
+	}
+}
+
+// WithHealth adds checks of the saga store and the saga mutex to the readiness probe of h, if they implement health.Checker,
+// and serves /healthz and /readyz on the mux passed into WithSagaApiServer. The readiness probe fails once Component.Shutdown is called.
+// Add transports of the bus with h.AddTransport, so a lost broker connection fails both probes.
+func WithHealth(h *health.Health) configOption {
+	return func(o *opts) {
+		o.health = h
+	}
+}
+
+// allSagas returns sagas registered without versions and all versions of versioned sagas
+func (c Component) allSagas() []saga.Saga {
+	sagas := c.sagas
+
+	for _, v := range c.sagaVersions {
+		sagas = append(sagas[:len(sagas):len(sagas)], v.versions...)
+	}
+
+	return sagas
+}
+
+func (c Component) versionRegistry(mBus *foreman.MessageBus) (*saga.VersionRegistry, error) {
+	versions := saga.NewVersionRegistry()
+
+	for _, s := range c.sagas {
+		gk, err := mBus.SchemeRegistry().ObjectKind(s)
+		if err != nil {
+			// such saga can't be stored anyway, it's reported by the store on start
+			continue
+		}
+
+		if err := versions.Register(nil, *gk); err != nil {
+			return nil, errors.Wrap(err, "registering saga")
+		}
+	}
+
+	for _, v := range c.sagaVersions {
+		kinds := make([]scheme.GroupKind, 0, len(v.versions))
+
+		for _, s := range v.versions {
+			gk, err := mBus.SchemeRegistry().ObjectKind(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "saga version %T must be registered in scheme", s)
+			}
+
+			kinds = append(kinds, *gk)
+		}
+
+		if err := versions.Register(v.selector, kinds...); err != nil {
+			return nil, errors.Wrap(err, "registering saga versions")
+		}
+	}
+
+	return versions, nil
+}
+
+func (c Component) addHealthChecks(h *health.Health, store saga.Store) {
+	if checker, ok := store.(health.Checker); ok {
+		h.AddReadinessCheck("saga_store", checker)
+	}
+
+	if checker, ok := c.sagaMutex.(health.Checker); ok {
+		h.AddReadinessCheck("saga_mutex", checker)
+	}
+
+	h.AddReadinessCheck("saga_component", health.CheckerFunc(c.shutdown.checkHealth))
+}
+
+func requireSignedContracts(verifier *signing.Verifier, schemeRegistry scheme.KnownTypesRegistry) error {
+	var gks []scheme.GroupKind
+
+	for _, contract := range contracts.SagaContracts() {
+		gk, err := schemeRegistry.ObjectKind(contract)
+		if err != nil {
+			return errors.Wrapf(err, "saga contract %T must be registered in scheme", contract)
+		}
+
+		gks = append(gks, *gk)
+	}
+
+	verifier.Require(gks...)
+
+	return nil
+}
+
+func initApiServer(mux *http.ServeMux, store saga.Store, growthMonitor *saga.GrowthMonitor, versions *saga.VersionRegistry, metrics prometheus.Registerer, mBus *foreman.MessageBus, readOnly bool, operations *operationsOpts, operationRunner *status.OperationRunner, outbox saga.Outbox) {
+	logger := mBus.Logger()
+
+	var statusOpts []status.StatusServiceOpt
+
+	if operations != nil {
+		statusOpts = append(statusOpts, status.WithOperationStore(operations.store))
+		operationsHandler := status.NewOperationsHandler(logger, status.NewOperationService(store, operations.store, operationRunner))
+
+		mux.HandleFunc("/operations", func(resp http.ResponseWriter, r *http.Request) {
+			if readOnly {
+				http.NotFound(resp, r)
+				return
+			}
+
+			operationsHandler.Start(resp, r)
+		})
+
+		mux.HandleFunc("/operations/", operationsHandler.Get)
+	}
+
+	statusHandler := status.NewStatusHandler(logger, status.NewStatusService(store, statusOpts...))
+	controlHandler := status.NewControlHandler(logger, status.NewControlService(store, mBus.Router()))
+	graphHandler := status.NewGraphHandler(logger, status.NewGraphService(store, mBus.SchemeRegistry(), versions))
+
+	mux.HandleFunc("/sagas", func(resp http.ResponseWriter, r *http.Request) {
+		if !readOnly && r.Method == http.MethodDelete {
+			statusHandler.Purge(resp, r)
+			return
+		}
+
+		statusHandler.GetFilteredBy(resp, r)
+	})
+
+	mux.HandleFunc("/sagas/", func(resp http.ResponseWriter, r *http.Request) {
+		if !readOnly {
+			if status.IsControlRequest(r) {
+				controlHandler.Handle(resp, r)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				statusHandler.Delete(resp, r)
+				return
+			}
+		}
+
+		if status.IsTreeRequest(r) {
+			statusHandler.GetTree(resp, r)
+			return
+		}
+
+		if status.IsChildrenRequest(r) {
+			statusHandler.GetChildren(resp, r)
+			return
+		}
+
+		if status.IsHistoryRequest(r) {
+			statusHandler.GetHistory(resp, r)
+			return
+		}
+
+		if status.IsGraphRequest(r) {
+			graphHandler.GetGraph(resp, r)
+			return
+		}
+
+		statusHandler.GetStatus(resp, r)
+	})
+
+	mux.HandleFunc("/sagas/definitions", status.NewDefinitionsHandler(logger, versions).GetDefinitions)
+	mux.HandleFunc("/sagas/definitions/", graphHandler.GetDefinitionGraph)
+	mux.HandleFunc("/debug/scheme", status.NewSchemeHandler(logger, mBus.SchemeRegistry()).GetOwnership)
+
+	if growthMonitor != nil {
+		mux.HandleFunc("/sagas/stats", status.NewGrowthStatsHandler(logger, growthMonitor).GetStats)
+	}
+
+	if outbox != nil {
+		mux.HandleFunc("/sagas/outbox", status.NewOutboxStatsHandler(logger, outbox).GetStats)
+	}
+
+	if gatherer, ok := metrics.(prometheus.Gatherer); ok {
+		mux.Handle("/sagas/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	}
 }
 
 type StoreFactory func(msgMarshaller message.Marshaller) (saga.Store, error)
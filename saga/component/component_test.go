@@ -1,10 +1,14 @@
 package component
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/go-foreman/foreman/pubsub/endpoint"
 
@@ -14,16 +18,23 @@ import (
 
 	"github.com/go-foreman/foreman"
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/signing"
+	"github.com/go-foreman/foreman/pubsub/tracing"
 	"github.com/go-foreman/foreman/runtime/scheme"
 	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/handlers"
+	sagaMutex "github.com/go-foreman/foreman/saga/mutex"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
 	"github.com/go-foreman/foreman/testing/log"
 	messageMock "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
 	"github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
 	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/go-foreman/foreman/testing/mocks/saga"
 	"github.com/golang/mock/gomock"
 )
@@ -56,8 +67,112 @@ func TestComponent_Init(t *testing.T) {
 		assert.EqualError(t, err, "some error")
 	})
 
+	t.Run("mutex is nil", func(t *testing.T) {
+		storeFactory := func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return storeMock, nil
+		}
+
+		assert.EqualError(t, NewSagaComponent(storeFactory, nil).Init(mBus), "saga mutex is nil, it may be omitted only with WithOptimisticLocking")
+
+		store := newTransactionalStore(t, storeMock, "create table if not exists saga_outbox")
+		assert.NoError(t, NewSagaComponent(store.factory, nil, WithOptimisticLocking(1), WithOutbox(time.Second, 10)).Init(mBus))
+	})
+
+	t.Run("optimistic locking requires outbox", func(t *testing.T) {
+		storeFactory := func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return storeMock, nil
+		}
+
+		err := NewSagaComponent(storeFactory, nil, WithOptimisticLocking(1)).Init(mBus)
+		assert.EqualError(t, err, "optimistic locking requires WithOutbox, deliveries of a saga must be saved in the transaction of its update")
+	})
+
+	t.Run("outbox requires transactional store", func(t *testing.T) {
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return storeMock, nil
+			},
+			mutexMock,
+			WithOutbox(time.Second, 100),
+		)
+
+		assert.EqualError(t, c.Init(mBus), "outbox requires saga.TransactionalStore, *saga.MockStore isn't one")
+	})
+
+	t.Run("scheduler requires transactional store", func(t *testing.T) {
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return storeMock, nil
+			},
+			mutexMock,
+			WithScheduler(time.Second, 100),
+		)
+
+		assert.EqualError(t, c.Init(mBus), "scheduler requires saga.TransactionalStore, *saga.MockStore isn't one")
+	})
+
+	t.Run("correlation rule without fields", func(t *testing.T) {
+		evGK := scheme.GroupKind{Group: "example", Kind: "OrderPlaced"}
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return storeMock, nil
+			},
+			mutexMock,
+			WithCorrelation(map[scheme.GroupKind]sagaPkg.CorrelationRule{evGK: {Saga: scheme.GroupKind{Group: "example", Kind: "OrderSaga"}, EventField: "order_id"}}),
+		)
+
+		assert.EqualError(t, c.Init(mBus), "correlation rule of event example.OrderPlaced must specify both event and saga fields")
+	})
+
+	t.Run("signed contracts", func(t *testing.T) {
+		signedBus, err := foreman.NewMessageBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriberInstanceMock))
+		require.NoError(t, err)
+
+		verifier := signing.NewVerifier(nil, signing.WithOptionalSignatures())
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return storeMock, nil
+			},
+			mutexMock,
+			WithSignedContracts(verifier),
+		)
+
+		require.NoError(t, c.Init(signedBus))
+
+		assert.Error(t, verifier.Verify(scheme.GroupKind{Group: "systemSaga", Kind: "StartSagaCommand"}, []byte("{}"), message.Headers{}))
+		assert.Error(t, verifier.Verify(scheme.GroupKind{Group: "systemSaga", Kind: "CompensateSagaCommand"}, []byte("{}"), message.Headers{}))
+		assert.NoError(t, verifier.Verify(scheme.GroupKind{Group: "example", Kind: "OrderPlaced"}, []byte("{}"), message.Headers{}), "events of sagas may be unsigned")
+	})
+
+	t.Run("timeouts require delays or the scheduler", func(t *testing.T) {
+		mBus, err := foreman.NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry())
+		require.NoError(t, err)
+
+		sagaEndpoint := endpointMock.NewMockEndpoint(ctrl)
+		sagaEndpoint.EXPECT().Name().Return("sagas")
+
+		c := NewSagaComponent(func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return storeMock, nil
+		}, mutexMock)
+		c.RegisterSagaEndpoints(sagaEndpoint)
+
+		assert.EqualError(t, c.Init(mBus), "endpoint sagas sending saga timeouts doesn't support delays, create it with endpoint.WithDelayedExchange or endpoint.WithDelayQueues, or enable WithScheduler")
+	})
+
+	t.Run("scheduler keeps timeouts", func(t *testing.T) {
+		mBus, err := foreman.NewWorkerBus(testLogger, msgMarshallerMock, scheme.NewKnownTypesRegistry())
+		require.NoError(t, err)
+
+		store := newTransactionalStore(t, storeMock, "create table if not exists saga_schedule")
+
+		c := NewSagaComponent(store.factory, mutexMock, WithScheduler(time.Second, 10))
+		c.RegisterSagaEndpoints(endpointMock.NewMockEndpoint(ctrl))
+
+		assert.NoError(t, c.Init(mBus))
+	})
+
 	t.Run("init component with no errors", func(t *testing.T) {
-		endpointInstanceMock := endpointMock.NewMockEndpoint(ctrl)
+		endpointInstanceMock := delayingEndpoint{endpointMock.NewMockEndpoint(ctrl)}
 		mux := &http.ServeMux{}
 
 		c := NewSagaComponent(
@@ -75,6 +190,7 @@ func TestComponent_Init(t *testing.T) {
 
 		c.RegisterSagas(sagaExample)
 		c.RegisterContracts(&dataContract{})
+		c.RegisterExpectedEvents(&dataContract{}, &replyContract{})
 		c.RegisterSagaEndpoints(endpointInstanceMock)
 
 		err := c.Init(mBus)
@@ -99,6 +215,10 @@ func TestComponent_Init(t *testing.T) {
 		sagaHandlerFuncName := runtime.FuncForPC(reflect.ValueOf(sagaHandlersRegistered[0]).Pointer()).Name()
 		assert.Equal(t, sagaHandlerFuncName, "github.com/go-foreman/foreman/saga/handlers.SagaEventsHandler.Handle-fm")
 
+		expectedHandlers := mBus.Dispatcher().Match(&replyContract{})
+		require.Len(t, expectedHandlers, 1, "expected events without handlers are passed to the events handler")
+		assert.Equal(t, sagaHandlerFuncName, runtime.FuncForPC(reflect.ValueOf(expectedHandlers[0]).Pointer()).Name())
+
 		gk, err := mBus.SchemeRegistry().ObjectKind(&contracts.StartSagaCommand{})
 		require.NoError(t, err)
 		assert.Equal(t, gk, &scheme.GroupKind{Group: "systemSaga", Kind: "StartSagaCommand"})
@@ -141,10 +261,408 @@ func TestComponent_Init(t *testing.T) {
 	})
 }
 
+func TestComponent_WorkerMutex(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	storeMock := saga.NewMockStore(ctrl)
+	storeFactory := func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+		return storeMock, nil
+	}
+
+	newBus := func(t *testing.T, opts ...foreman.ConfigOption) *foreman.MessageBus {
+		mBus, err := foreman.NewWorkerBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), opts...)
+		require.NoError(t, err)
+
+		return mBus
+	}
+
+	t.Run("workers run under locks of the saga mutex", func(t *testing.T) {
+		mBus := newBus(t)
+		mutexMock := mutex.NewMockMutex(ctrl)
+
+		require.NoError(t, NewSagaComponent(storeFactory, mutexMock, WithSagaRetention(time.Hour, time.Minute)).Init(mBus))
+		require.NotNil(t, mBus.WorkerMutex())
+
+		mutexMock.EXPECT().Lock(gomock.Any(), retentionSweeperName).Return(nil, errors.New("database is down"))
+
+		err := mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker saga-retention-sweeper: acquiring exclusive lock saga-retention-sweeper: database is down")
+	})
+
+	t.Run("outbox relay runs under its lock", func(t *testing.T) {
+		mBus := newBus(t)
+		mutexMock := mutex.NewMockMutex(ctrl)
+		store := newTransactionalStore(t, storeMock, "create table if not exists saga_outbox")
+
+		require.NoError(t, NewSagaComponent(store.factory, mutexMock, WithOutbox(time.Second, 10)).Init(mBus))
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "saga-outbox-relay").Return(nil, errors.New("database is down"))
+
+		err := mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker saga-outbox-relay: acquiring exclusive lock saga-outbox-relay: database is down")
+	})
+
+	t.Run("schedule dispatcher runs under its lock", func(t *testing.T) {
+		mBus := newBus(t)
+		mutexMock := mutex.NewMockMutex(ctrl)
+		store := newTransactionalStore(t, storeMock, "create table if not exists saga_schedule")
+
+		require.NoError(t, NewSagaComponent(store.factory, mutexMock, WithScheduler(time.Second, 10)).Init(mBus))
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "saga-schedule-dispatcher").Return(nil, errors.New("database is down"))
+
+		err := mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker saga-schedule-dispatcher: acquiring exclusive lock saga-schedule-dispatcher: database is down")
+	})
+
+	t.Run("history retention runs under its lock", func(t *testing.T) {
+		mBus := newBus(t)
+		mutexMock := mutex.NewMockMutex(ctrl)
+
+		require.NoError(t, NewSagaComponent(storeFactory, mutexMock, WithHistoryRetention(time.Hour)).Init(mBus))
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "saga-history-retention").Return(nil, errors.New("database is down"))
+
+		err := mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker saga-history-retention: acquiring exclusive lock saga-history-retention: database is down")
+	})
+
+	t.Run("operation runner runs under its lock", func(t *testing.T) {
+		mBus := newBus(t)
+		mutexMock := mutex.NewMockMutex(ctrl)
+
+		require.NoError(t, NewSagaComponent(storeFactory, mutexMock, WithBulkOperations(saga.NewMockOperationStore(ctrl), time.Second)).Init(mBus))
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "saga-bulk-operations").Return(nil, errors.New("database is down"))
+
+		err := mBus.RunWorkers(context.Background())
+		assert.EqualError(t, err, "running worker saga-bulk-operations: acquiring exclusive lock saga-bulk-operations: database is down")
+	})
+
+	t.Run("configured worker mutex is kept", func(t *testing.T) {
+		workerMutex := mutex.NewMockMutex(ctrl)
+		mBus := newBus(t, foreman.WithWorkerMutex(workerMutex, time.Second))
+
+		require.NoError(t, NewSagaComponent(storeFactory, mutex.NewMockMutex(ctrl), WithSagaRetention(time.Hour, time.Minute)).Init(mBus))
+
+		workerMutex.EXPECT().Lock(gomock.Any(), retentionSweeperName).Return(nil, errors.New("database is down"))
+
+		assert.Error(t, mBus.RunWorkers(context.Background()))
+	})
+
+	t.Run("optimistic locking without worker mutex", func(t *testing.T) {
+		testLogger := log.NewNilLogger()
+		mBus, err := foreman.NewWorkerBus(testLogger, messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry())
+		require.NoError(t, err)
+
+		store := newTransactionalStore(t, storeMock, "create table if not exists saga_outbox")
+
+		require.NoError(t, NewSagaComponent(store.factory, nil, WithOptimisticLocking(1), WithOutbox(time.Second, 10)).Init(mBus))
+		assert.Nil(t, mBus.WorkerMutex())
+		testLogger.AssertContainsSubstr(t, "its workers run in every replica")
+	})
+}
+
+// delayingEndpoint is a mocked endpoint holding delayed messages like the one created with endpoint.WithDelayedExchange
+type delayingEndpoint struct {
+	*endpointMock.MockEndpoint
+}
+
+func (e delayingEndpoint) SupportsDelay() bool {
+	return true
+}
+
+// transactionalStore is a mocked store on a mocked mysql database, tables of workers are created in it by Init
+type transactionalStore struct {
+	*saga.MockStore
+	db *sagaSql.DB
+}
+
+func newTransactionalStore(t *testing.T, store *saga.MockStore, tables ...string) transactionalStore {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	for _, table := range tables {
+		mock.ExpectExec(table).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	return transactionalStore{MockStore: store, db: sagaSql.NewDB(db)}
+}
+
+func (s transactionalStore) UpdateTx(ctx context.Context, saga sagaPkg.Instance, inTx sagaPkg.TxFunc) error {
+	return errors.New("not expected")
+}
+
+func (s transactionalStore) DB() (*sagaSql.DB, sagaPkg.SQLDriver) {
+	return s.db, sagaPkg.MYSQLDriver
+}
+
+func (s transactionalStore) factory(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+	return s, nil
+}
+
+func TestSagaLockRenewInterval(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	redisMutex := sagaMutex.NewRedisMutex(nil, log.NewNilLogger(), sagaMutex.WithLockTTL(time.Second*6))
+	assert.Equal(t, time.Second*2, sagaLockRenewInterval(redisMutex), "expiring locks are renewed three times per ttl")
+	assert.Equal(t, workerRenewInterval, sagaLockRenewInterval(mutex.NewMockMutex(ctrl)))
+}
+
+func TestComponent_GrowthStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+
+	c := NewSagaComponent(
+		func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return saga.NewMockStore(ctrl), nil
+		},
+		mutex.NewMockMutex(ctrl),
+		WithSagaApiServer(mux),
+		WithGrowthLimits(),
+	)
+	require.NoError(t, c.Init(mBus))
+
+	req := httptest.NewRequest("GET", "/sagas/stats", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "{}", rr.Body.String())
+}
+
+func TestComponent_Metrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	initComponent := func(store sagaPkg.Store, opts ...configOption) (*http.ServeMux, error) {
+		mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return store, nil
+			},
+			mutex.NewMockMutex(ctrl),
+			append(opts, WithSagaApiServer(mux))...,
+		)
+
+		return mux, c.Init(mBus)
+	}
+
+	t.Run("metrics are served", func(t *testing.T) {
+		mux, err := initComponent(saga.NewMockStore(ctrl), WithMetrics(prometheus.NewRegistry()))
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sagas/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Header().Get("Content-Type"), "text/plain")
+	})
+
+	t.Run("metrics are disabled by default", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		storeMock.EXPECT().GetById(gomock.Any(), "metrics").Return(nil, nil)
+
+		mux, err := initComponent(storeMock)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sagas/metrics", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code, "it's a saga status request")
+	})
+
+	t.Run("metrics registered twice", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+
+		_, err := initComponent(saga.NewMockStore(ctrl), WithMetrics(registry))
+		require.NoError(t, err)
+
+		_, err = initComponent(saga.NewMockStore(ctrl), WithMetrics(registry))
+		assert.Error(t, err)
+	})
+}
+
+func TestComponent_ControlApi(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	initComponent := func(store sagaPkg.Store, opts ...configOption) *http.ServeMux {
+		mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return store, nil
+			},
+			mutex.NewMockMutex(ctrl),
+			append(opts, WithSagaApiServer(mux))...,
+		)
+		require.NoError(t, c.Init(mBus))
+
+		return mux
+	}
+
+	t.Run("control endpoints are served", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		storeMock.EXPECT().GetById(gomock.Any(), "123").Return(nil, nil)
+
+		rr := httptest.NewRecorder()
+		initComponent(storeMock).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/sagas/123/recover", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Equal(t, "saga '123' not found", rr.Body.String())
+	})
+
+	t.Run("read only api", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		storeMock.EXPECT().GetById(gomock.Any(), "123/recover").Return(nil, nil)
+
+		rr := httptest.NewRecorder()
+		initComponent(storeMock, WithReadOnlyApi()).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/sagas/123/recover", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Equal(t, "saga '123/recover' not found", rr.Body.String())
+	})
+
+	t.Run("bulk operations", func(t *testing.T) {
+		operationsMock := saga.NewMockOperationStore(ctrl)
+		operationsMock.EXPECT().GetOperation(gomock.Any(), "op-1").Return(nil, nil)
+
+		mux := initComponent(saga.NewMockStore(ctrl), WithBulkOperations(operationsMock, time.Minute), WithReadOnlyApi())
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/operations/op-1", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Equal(t, "operation 'op-1' not found", rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/operations?action=recover", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code, "starting operations isn't served by read only api")
+	})
+}
+
+func TestComponent_SagaVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	newComponent := func(mux *http.ServeMux) *Component {
+		return NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return saga.NewMockStore(ctrl), nil
+			},
+			mutex.NewMockMutex(ctrl),
+			WithSagaApiServer(mux),
+		)
+	}
+
+	t.Run("definitions list versions", func(t *testing.T) {
+		schemeRegistry := scheme.NewKnownTypesRegistry()
+		schemeRegistry.AddKnownTypes("test", &dataContract{}, &sagaExample{}, &sagaExampleV2{})
+
+		mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), schemeRegistry, foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+		c := newComponent(mux)
+		c.RegisterSagaVersions(func(startCmd *contracts.StartSagaCommand) int {
+			return 2
+		}, &sagaExample{}, &sagaExampleV2{})
+		require.NoError(t, c.Init(mBus))
+
+		assert.Len(t, mBus.Dispatcher().Match(&dataContract{}), 1)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sagas/definitions", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `[{"name":"test.sagaExample","versions":[{"version":1,"type":"test.sagaExample"},{"version":2,"type":"test.sagaExampleV2"}]}]`, rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/sagas/definitions/test.sagaExampleV2/graph", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `{"from":"in_progress","to":"in_progress","kind":"event","label":"test.dataContract"}`)
+	})
+
+	t.Run("version is not registered in scheme", func(t *testing.T) {
+		schemeRegistry := scheme.NewKnownTypesRegistry()
+		schemeRegistry.AddKnownTypes("test", &dataContract{}, &sagaExample{})
+
+		mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), schemeRegistry, foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+		require.NoError(t, err)
+
+		c := newComponent(http.NewServeMux())
+		c.RegisterSagaVersions(func(startCmd *contracts.StartSagaCommand) int {
+			return 1
+		}, &sagaExample{}, &sagaExampleV2{})
+
+		assert.EqualError(t, c.Init(mBus), "saga version *component.sagaExampleV2 must be registered in scheme: no kind is registered in schema for the type sagaExampleV2")
+	})
+}
+
+func TestComponent_SchemeOwnership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	schemeRegistry.Scoped("billing").AddKnownTypes("test", &dataContract{})
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), schemeRegistry, foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	c := NewSagaComponent(
+		func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return saga.NewMockStore(ctrl), nil
+		},
+		mutex.NewMockMutex(ctrl),
+		WithSagaApiServer(mux),
+		WithReadOnlyApi(),
+	)
+	require.NoError(t, c.Init(mBus))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/scheme", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var ownership []scheme.Ownership
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &ownership))
+	assert.Equal(t, schemeRegistry.DumpOwnership(), ownership)
+
+	var registered bool
+	for _, o := range ownership {
+		if o.GroupKind == (scheme.GroupKind{Group: "test", Kind: "dataContract"}) {
+			registered = true
+			assert.Equal(t, "billing", o.Owner)
+			assert.Contains(t, o.Site, "component_test.go")
+		}
+	}
+	assert.True(t, registered, "types registered by components are listed")
+}
+
 type sagaExample struct {
 	sagaPkg.BaseSaga
 }
 
+type sagaExampleV2 struct {
+	sagaExample
+}
+
 func (s *sagaExample) Init() {
 	s.AddEventHandler(&dataContract{}, s.HandleData)
 }
@@ -168,6 +686,10 @@ func (s *sagaExample) HandleData(sagaCtx sagaPkg.SagaContext) error {
 	return nil
 }
 
+type replyContract struct {
+	message.ObjectMeta
+}
+
 type dataContract struct {
 	message.ObjectMeta
 }
@@ -183,6 +705,9 @@ func TestOpts(t *testing.T) {
 	configs := []configOption{
 		WithSagaUIDService(sagaUIDServiceMock),
 		WithSagaApiServer(mux),
+		WithGrowthLimits(sagaPkg.WithPayloadSizeLimits(1, 2)),
+		WithRetryPolicy(3, handlers.ExponentialBackoff(time.Second, time.Minute)),
+		WithTracePropagation(tracing.NewTraceCarrier()),
 	}
 
 	opts := &opts{}
@@ -193,6 +718,12 @@ func TestOpts(t *testing.T) {
 
 	assert.Same(t, opts.uidService, sagaUIDServiceMock)
 	assert.Same(t, opts.apiServerMux, mux)
+	assert.True(t, opts.monitorGrowth)
+	assert.Len(t, opts.growthLimits, 1)
+	require.NotNil(t, opts.retry)
+	assert.Equal(t, 3, opts.retry.maxAttempts)
+	assert.Equal(t, time.Second*2, opts.retry.backoff(2))
+	assert.IsType(t, &tracing.TraceCarrier{}, opts.traceCarrier)
 
 	//req, err := http.NewRequest("GET", "/sagas", nil)
 	//require.NoError(t, err)
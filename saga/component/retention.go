@@ -0,0 +1,73 @@
+package component
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/retention"
+)
+
+const retentionSweeperName = "saga-retention-sweeper"
+
+type retentionOpts struct {
+	maxAge   time.Duration
+	interval time.Duration
+}
+
+type historyRetentionOpts struct {
+	maxAge time.Duration
+	opts   []retention.Opt
+}
+
+// retentionSweeper deletes completed sagas older than maxAge every interval, it's run under the worker lock named retentionSweeperName
+type retentionSweeper struct {
+	store    saga.Store
+	maxAge   time.Duration
+	interval time.Duration
+	logger   log.Logger
+}
+
+func newRetentionSweeper(store saga.Store, maxAge, interval time.Duration, logger log.Logger) *retentionSweeper {
+	return &retentionSweeper{store: store, maxAge: maxAge, interval: interval, logger: logger}
+}
+
+func (s *retentionSweeper) Name() string {
+	return retentionSweeperName
+}
+
+// Run sweeps until ctx is done. Failed sweeps are logged and retried on the next tick, so a temporary store outage doesn't stop the bus.
+func (s *retentionSweeper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *retentionSweeper) sweep(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	deleted, err := s.store.DeleteByFilter(ctx, saga.WithStatus("completed"), saga.WithUpdatedBefore(time.Now().Add(-s.maxAge)))
+
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.Logf(log.ErrorLevel, "deleting completed sagas older than %s. %s", s.maxAge, err)
+		}
+		return
+	}
+
+	if deleted > 0 {
+		s.logger.Logf(log.InfoLevel, "deleted %d completed sagas older than %s", deleted, s.maxAge)
+	}
+}
@@ -0,0 +1,133 @@
+package component
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/retention"
+	"github.com/go-foreman/foreman/testing/log"
+	messageMock "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	"github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionSweeper(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("sweeps until ctx is done", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		testLogger := log.NewNilLogger()
+		sweeper := newRetentionSweeper(storeMock, time.Hour, time.Millisecond*10, testLogger)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sweeps := 0
+		storeMock.
+			EXPECT().
+			DeleteByFilter(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, filters ...sagaPkg.FilterOption) (int, error) {
+				sweeps++
+				if sweeps == 1 {
+					return 0, errors.New("connection lost")
+				}
+				if sweeps == 3 {
+					cancel()
+				}
+				return 2, nil
+			}).
+			MinTimes(3)
+
+		done := make(chan error)
+		go func() {
+			done <- sweeper.Run(ctx)
+		}()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("sweeper didn't stop")
+		}
+
+		assert.Equal(t, retentionSweeperName, sweeper.Name())
+	})
+}
+
+func TestComponent_Retention(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+	require.NoError(t, err)
+
+	storeMock := saga.NewMockStore(ctrl)
+	mux := http.NewServeMux()
+
+	c := NewSagaComponent(
+		func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return storeMock, nil
+		},
+		mutex.NewMockMutex(ctrl),
+		WithSagaApiServer(mux),
+		WithSagaRetention(time.Hour*24*30, time.Hour),
+	)
+	require.NoError(t, c.Init(mBus))
+
+	require.Len(t, mBus.Workers(), 1)
+	assert.Equal(t, retentionSweeperName, mBus.Workers()[0].Name())
+
+	t.Run("bulk purge", func(t *testing.T) {
+		storeMock.EXPECT().DeleteByFilter(gomock.Any(), gomock.Any(), gomock.Any()).Return(4, nil)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/sagas?olderThan=720h", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"deleted":4}`, rr.Body.String())
+	})
+
+	t.Run("delete single saga", func(t *testing.T) {
+		storeMock.EXPECT().GetById(gomock.Any(), "123").Return(nil, nil)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/sagas/123", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestComponent_HistoryRetention(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+	require.NoError(t, err)
+
+	storeMock := saga.NewMockStore(ctrl)
+
+	c := NewSagaComponent(
+		func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return storeMock, nil
+		},
+		mutex.NewMockMutex(ctrl),
+		WithHistoryRetention(time.Hour*24*30, retention.WithBatchSize(1000)),
+	)
+	require.NoError(t, c.Init(mBus))
+
+	require.Len(t, mBus.Workers(), 1)
+	assert.Equal(t, "saga-history-retention", mBus.Workers()[0].Name())
+}
@@ -0,0 +1,103 @@
+package component
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	foreman "github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/handlers"
+	"github.com/pkg/errors"
+)
+
+// shutdown is shared by copies of the component, it's filled by Init
+type shutdown struct {
+	drain     *handlers.Drain
+	store     saga.Store
+	apiServer *http.Server
+	workers   chan struct{}
+	once      sync.Once
+	err       error
+}
+
+func newShutdown() *shutdown {
+	return &shutdown{workers: make(chan struct{})}
+}
+
+// Shutdown stops handling of saga messages, messages received from now on aren't acked and are redelivered.
+// The api server passed into WithSagaApiServerShutdown is shut down first.
+// It waits until handlers in flight return or ctx is done, then stops workers of the component and closes the store if it's an io.Closer.
+// If handlers don't return in time, their contexts are cancelled, saga locks they hold are released and
+// an error with the number of running handlers is returned. Calls after the first one return its result.
+func (c *Component) Shutdown(ctx context.Context) error {
+	c.shutdown.once.Do(func() {
+		c.shutdown.err = c.shutdown.run(ctx)
+	})
+
+	return c.shutdown.err
+}
+
+func (s *shutdown) run(ctx context.Context) error {
+	close(s.workers)
+
+	var serverErr error
+
+	if s.apiServer != nil {
+		serverErr = s.apiServer.Shutdown(ctx)
+	}
+
+	err := s.drain.Shutdown(ctx)
+
+	if serverErr != nil && err == nil {
+		err = errors.Wrap(serverErr, "shutting down api server")
+	}
+
+	if closer, ok := s.store.(io.Closer); ok {
+		if cErr := closer.Close(); cErr != nil && err == nil {
+			err = errors.Wrap(cErr, "closing saga store")
+		}
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "shutting down saga component")
+	}
+
+	return nil
+}
+
+// checkHealth fails once Shutdown is called, so no traffic is routed to the process while it's stopping
+func (s *shutdown) checkHealth(ctx context.Context) error {
+	select {
+	case <-s.workers:
+		return errors.New("saga component is shutting down")
+	default:
+		return nil
+	}
+}
+
+// worker stops the worker of the component on Shutdown even if MessageBus.RunWorkers is still running
+func (s *shutdown) worker(worker foreman.Worker) foreman.Worker {
+	return stoppableWorker{Worker: worker, stop: s.workers}
+}
+
+type stoppableWorker struct {
+	foreman.Worker
+	stop chan struct{}
+}
+
+func (w stoppableWorker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return w.Worker.Run(ctx)
+}
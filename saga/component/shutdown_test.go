@@ -0,0 +1,152 @@
+package component
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/health"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	messageMock "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/subscriber"
+	"github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closingStore struct {
+	sagaPkg.Store
+	closed int
+}
+
+func (s *closingStore) Close() error {
+	s.closed++
+	return nil
+}
+
+type pingedStore struct {
+	sagaPkg.Store
+	err error
+}
+
+func (s pingedStore) CheckHealth(ctx context.Context) error {
+	return s.err
+}
+
+func TestComponent_Shutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("shutdown before init", func(t *testing.T) {
+		c := NewSagaComponent(nil, mutex.NewMockMutex(ctrl))
+		assert.NoError(t, c.Shutdown(context.Background()))
+	})
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), messageMock.NewMockMarshaller(ctrl), scheme.NewKnownTypesRegistry(), foreman.WithSubscriber(subscriber.NewMockSubscriber(ctrl)))
+	require.NoError(t, err)
+
+	storeMock := saga.NewMockStore(ctrl)
+	store := &closingStore{Store: storeMock}
+
+	c := NewSagaComponent(
+		func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+			return store, nil
+		},
+		mutex.NewMockMutex(ctrl),
+		WithSagaRetention(time.Hour, time.Hour),
+	)
+	require.NoError(t, c.Init(mBus))
+	require.Len(t, mBus.Workers(), 1)
+
+	storeMock.EXPECT().DeleteByFilter(gomock.Any(), gomock.Any(), gomock.Any()).Return(0, nil).AnyTimes()
+
+	workerDone := make(chan error)
+	go func() {
+		workerDone <- mBus.Workers()[0].Run(context.Background())
+	}()
+
+	require.NoError(t, c.Shutdown(context.Background()))
+	require.NoError(t, c.Shutdown(context.Background()), "second shutdown is a no-op")
+	assert.Equal(t, 1, store.closed)
+
+	select {
+	case err := <-workerDone:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("worker didn't stop on shutdown")
+	}
+
+	t.Run("api server is shut down", func(t *testing.T) {
+		mux := http.NewServeMux()
+		server := &http.Server{Handler: mux}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		served := make(chan error)
+		go func() {
+			served <- server.Serve(listener)
+		}()
+
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return storeMock, nil
+			},
+			mutex.NewMockMutex(ctrl),
+			WithSagaApiServer(mux),
+			WithSagaApiServerShutdown(server),
+		)
+		require.NoError(t, c.Init(mBus))
+
+		storeMock.EXPECT().GetById(gomock.Any(), "123").Return(nil, nil)
+
+		resp, err := http.Get("http://" + listener.Addr().String() + "/sagas/123")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.NoError(t, c.Shutdown(context.Background()))
+		assert.Equal(t, http.ErrServerClosed, <-served)
+	})
+
+	t.Run("readiness fails once shut down", func(t *testing.T) {
+		mux := http.NewServeMux()
+
+		h, err := health.NewHealth()
+		require.NoError(t, err)
+
+		c := NewSagaComponent(
+			func(msgMarshaller message.Marshaller) (sagaPkg.Store, error) {
+				return pingedStore{Store: storeMock}, nil
+			},
+			mutex.NewMockMutex(ctrl),
+			WithSagaApiServer(mux),
+			WithHealth(h),
+		)
+		require.NoError(t, c.Init(mBus))
+		assert.Equal(t, []string{"saga_component", "saga_store"}, h.Names(health.Readiness))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, health.ReadinessPath, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		require.NoError(t, c.Shutdown(context.Background()))
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, health.ReadinessPath, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Contains(t, rr.Body.String(), "saga component is shutting down")
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, health.LivenessPath, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+}
@@ -2,11 +2,15 @@ package saga
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-foreman/foreman/log"
 	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/google/uuid"
 )
 
 //go:generate mockgen --build_flags=--mod=mod -destination ./context_mock_test.go -package saga . SagaContext
@@ -20,21 +24,55 @@ type SagaContext interface {
 	// Valid Deprecated
 	Valid() bool
 	Dispatch(payload message.Object, options ...endpoint.DeliveryOption)
+	// StartChildSaga dispatches StartSagaCommand of the child saga linked to this one and returns uid of the child.
+	// The child is saved with this saga as its parent, once it completes this saga receives contracts.SagaChildCompletedEvent
+	// with the uid, handle it to continue the step which started the child.
+	StartChildSaga(child message.Object, options ...endpoint.DeliveryOption) string
 	Deliveries() []*Delivery
 	Return(options ...endpoint.DeliveryOption) error
 	Logger() log.Logger
 	SagaInstance() Instance
+	// AddEntityRef marks the saga as touching an entity, e.g. AddEntityRef("order", "12345"). Refs are saved with the saga.
+	AddEntityRef(kind, id string) error
+	// ExpectEvent makes the saga wait for an event of the type with the correlation id of the handled message, even though the saga
+	// has no handler for the type. The event is passed to OnExpected of ExpectingSaga. If it doesn't come within the duration,
+	// the expectation is removed by a timeout with ExpectationTimeoutReason. Expecting the same type again replaces the expectation.
+	ExpectEvent(gk scheme.GroupKind, within time.Duration)
+	// Schedule delivers the event back to the saga after the duration, the saga handles it with its event handler.
+	// Scheduled events are saved with the saga by the Scheduler and are cancelled when the saga completes.
+	Schedule(after time.Duration, ev message.Object)
+	// Scheduled returns events scheduled while the message was handled
+	Scheduled() []*Scheduled
 }
 
-func NewSagaCtx(execCtx execution.MessageExecutionCtx, sagaInstance Instance) SagaContext {
-	return &sagaCtx{execCtx: execCtx, sagaInstance: sagaInstance, logger: execCtx.Logger().WithFields([]log.Field{{Name: sagaUIDKey, Val: sagaInstance.UID()}})}
+// SagaCtxOpt configures SagaContext created by NewSagaCtx
+type SagaCtxOpt func(s *sagaCtx)
+
+// WithScheduledTimeouts makes BaseSaga.ScheduleTimeout schedule TimeoutSagaCommand with Schedule instead of dispatching it delayed,
+// handlers pass it when events are kept by a Scheduler
+func WithScheduledTimeouts() SagaCtxOpt {
+	return func(s *sagaCtx) {
+		s.scheduledTimeouts = true
+	}
+}
+
+func NewSagaCtx(execCtx execution.MessageExecutionCtx, sagaInstance Instance, opts ...SagaCtxOpt) SagaContext {
+	s := &sagaCtx{execCtx: execCtx, sagaInstance: sagaInstance, logger: execCtx.Logger().WithFields([]log.Field{{Name: sagaUIDKey, Val: sagaInstance.UID()}})}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 type sagaCtx struct {
-	logger       log.Logger
-	execCtx      execution.MessageExecutionCtx
-	sagaInstance Instance
-	deliveries   []*Delivery
+	logger            log.Logger
+	execCtx           execution.MessageExecutionCtx
+	sagaInstance      Instance
+	deliveries        []*Delivery
+	scheduled         []*Scheduled
+	scheduledTimeouts bool
 }
 
 func (s sagaCtx) Message() *message.ReceivedMessage {
@@ -62,6 +100,38 @@ func (s sagaCtx) SagaInstance() Instance {
 	return s.sagaInstance
 }
 
+func (s sagaCtx) AddEntityRef(kind, id string) error {
+	return s.sagaInstance.AddEntityRef(EntityRef{Kind: kind, ID: id})
+}
+
+func (s *sagaCtx) ExpectEvent(gk scheme.GroupKind, within time.Duration) {
+	saga := s.sagaInstance.Saga()
+
+	expectations := saga.Expectations()
+	if expectations == nil {
+		expectations = make(map[string]Expectation)
+	}
+
+	expectations[gk.String()] = Expectation{GroupKind: gk, CorrelationID: s.Message().TraceID(), ExpiresAt: time.Now().Add(within)}
+	saga.SetExpectations(expectations)
+
+	if scheduler, ok := saga.(timeoutScheduler); ok {
+		scheduler.ScheduleTimeout(s, ExpectationTimeoutReason(gk), within)
+	}
+}
+
+func (s *sagaCtx) Schedule(after time.Duration, ev message.Object) {
+	s.scheduled = append(s.scheduled, &Scheduled{Payload: ev, FireAt: time.Now().Add(after)})
+}
+
+func (s sagaCtx) Scheduled() []*Scheduled {
+	return s.scheduled
+}
+
+func (s sagaCtx) schedulesTimeouts() bool {
+	return s.scheduledTimeouts
+}
+
 func (s *sagaCtx) Dispatch(toDeliver message.Object, options ...endpoint.DeliveryOption) {
 	s.deliveries = append(s.deliveries, &Delivery{
 		Payload: toDeliver,
@@ -69,10 +139,27 @@ func (s *sagaCtx) Dispatch(toDeliver message.Object, options ...endpoint.Deliver
 	})
 }
 
+func (s *sagaCtx) StartChildSaga(child message.Object, options ...endpoint.DeliveryOption) string {
+	childUID := uuid.New().String()
+	s.Dispatch(&contracts.StartSagaCommand{SagaUID: childUID, ParentUID: s.sagaInstance.UID(), Saga: child}, options...)
+
+	return childUID
+}
+
 func (s sagaCtx) Deliveries() []*Delivery {
 	return s.deliveries
 }
 
+// WithDelay postpones delivery of a dispatched message, it's a shortcut for endpoint.WithDelay
+func WithDelay(delay time.Duration) endpoint.DeliveryOption {
+	return endpoint.WithDelay(delay)
+}
+
+// WithDeliverAt postpones delivery of a dispatched message until specified time, it's a shortcut for endpoint.WithDeliverAt
+func WithDeliverAt(deliverAt time.Time) endpoint.DeliveryOption {
+	return endpoint.WithDeliverAt(deliverAt)
+}
+
 type Delivery struct {
 	Payload message.Object
 	Options []endpoint.DeliveryOption
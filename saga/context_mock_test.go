@@ -7,10 +7,12 @@ package saga
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	log "github.com/go-foreman/foreman/log"
 	endpoint "github.com/go-foreman/foreman/pubsub/endpoint"
 	message "github.com/go-foreman/foreman/pubsub/message"
+	scheme "github.com/go-foreman/foreman/runtime/scheme"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -37,6 +39,20 @@ func (m *MockSagaContext) EXPECT() *MockSagaContextMockRecorder {
 	return m.recorder
 }
 
+// AddEntityRef mocks base method.
+func (m *MockSagaContext) AddEntityRef(arg0, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddEntityRef", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddEntityRef indicates an expected call of AddEntityRef.
+func (mr *MockSagaContextMockRecorder) AddEntityRef(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddEntityRef", reflect.TypeOf((*MockSagaContext)(nil).AddEntityRef), arg0, arg1)
+}
+
 // Context mocks base method.
 func (m *MockSagaContext) Context() context.Context {
 	m.ctrl.T.Helper()
@@ -82,6 +98,18 @@ func (mr *MockSagaContextMockRecorder) Dispatch(arg0 interface{}, arg1 ...interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dispatch", reflect.TypeOf((*MockSagaContext)(nil).Dispatch), varargs...)
 }
 
+// ExpectEvent mocks base method.
+func (m *MockSagaContext) ExpectEvent(arg0 scheme.GroupKind, arg1 time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ExpectEvent", arg0, arg1)
+}
+
+// ExpectEvent indicates an expected call of ExpectEvent.
+func (mr *MockSagaContextMockRecorder) ExpectEvent(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpectEvent", reflect.TypeOf((*MockSagaContext)(nil).ExpectEvent), arg0, arg1)
+}
+
 // Logger mocks base method.
 func (m *MockSagaContext) Logger() log.Logger {
 	m.ctrl.T.Helper()
@@ -142,6 +170,51 @@ func (mr *MockSagaContextMockRecorder) SagaInstance() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SagaInstance", reflect.TypeOf((*MockSagaContext)(nil).SagaInstance))
 }
 
+// Schedule mocks base method.
+func (m *MockSagaContext) Schedule(arg0 time.Duration, arg1 message.Object) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Schedule", arg0, arg1)
+}
+
+// Schedule indicates an expected call of Schedule.
+func (mr *MockSagaContextMockRecorder) Schedule(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Schedule", reflect.TypeOf((*MockSagaContext)(nil).Schedule), arg0, arg1)
+}
+
+// Scheduled mocks base method.
+func (m *MockSagaContext) Scheduled() []*Scheduled {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Scheduled")
+	ret0, _ := ret[0].([]*Scheduled)
+	return ret0
+}
+
+// Scheduled indicates an expected call of Scheduled.
+func (mr *MockSagaContextMockRecorder) Scheduled() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Scheduled", reflect.TypeOf((*MockSagaContext)(nil).Scheduled))
+}
+
+// StartChildSaga mocks base method.
+func (m *MockSagaContext) StartChildSaga(arg0 message.Object, arg1 ...endpoint.DeliveryOption) string {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0}
+	for _, a := range arg1 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "StartChildSaga", varargs...)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// StartChildSaga indicates an expected call of StartChildSaga.
+func (mr *MockSagaContextMockRecorder) StartChildSaga(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0}, arg1...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartChildSaga", reflect.TypeOf((*MockSagaContext)(nil).StartChildSaga), varargs...)
+}
+
 // Valid mocks base method.
 func (m *MockSagaContext) Valid() bool {
 	m.ctrl.T.Helper()
@@ -10,6 +10,7 @@ import (
 	"github.com/go-foreman/foreman/pubsub/endpoint"
 
 	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/saga/contracts"
 	logMock "github.com/go-foreman/foreman/testing/mocks/log"
 
 	"github.com/stretchr/testify/assert"
@@ -45,10 +46,11 @@ func TestSagaContext(t *testing.T) {
 	assert.Same(t, sagaCtx.SagaInstance(), sagaInstance)
 	assert.Empty(t, sagaCtx.Deliveries())
 
-	sagaCtx.Dispatch(&DataContract{}, endpoint.WithDelay(time.Second))
+	sagaCtx.Dispatch(&DataContract{}, WithDelay(time.Second))
 	assert.Len(t, sagaCtx.Deliveries(), 1)
 	assert.Equal(t, sagaCtx.Deliveries()[0].Payload, &DataContract{})
 	assert.Len(t, sagaCtx.Deliveries()[0].Options, 1)
+	assert.Equal(t, time.Second, endpoint.DeliveryDelay(sagaCtx.Deliveries()[0].Options...))
 
 	receivedMsg := message.NewReceivedMessage("123", &DataContract{}, message.Headers{}, time.Now(), "origin")
 	msgExecCtxMock.EXPECT().Message().Return(receivedMsg)
@@ -60,3 +62,44 @@ func TestSagaContext(t *testing.T) {
 	err := sagaCtx.Return()
 	assert.NoError(t, err)
 }
+
+func TestSagaContext_AddEntityRef(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msgExecCtxMock := execution.NewMockMessageExecutionCtx(ctrl)
+	sagaInstance := NewSagaInstance("123", "", &sagaExample{})
+
+	loggerMock := logMock.NewMockLogger(ctrl)
+	msgExecCtxMock.EXPECT().Logger().Return(loggerMock)
+	loggerMock.EXPECT().WithFields(gomock.Any()).Return(loggerMock)
+
+	sagaCtx := NewSagaCtx(msgExecCtxMock, sagaInstance)
+
+	assert.NoError(t, sagaCtx.AddEntityRef("order", "12345"))
+	assert.Error(t, sagaCtx.AddEntityRef("order", ""))
+	assert.Equal(t, []EntityRef{{Kind: "order", ID: "12345"}}, sagaInstance.EntityRefs())
+}
+
+func TestSagaContext_StartChildSaga(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msgExecCtxMock := execution.NewMockMessageExecutionCtx(ctrl)
+	sagaInstance := NewSagaInstance("123", "", &sagaExample{})
+
+	loggerMock := logMock.NewMockLogger(ctrl)
+	msgExecCtxMock.EXPECT().Logger().Return(loggerMock)
+	loggerMock.EXPECT().WithFields(gomock.Any()).Return(loggerMock)
+
+	sagaCtx := NewSagaCtx(msgExecCtxMock, sagaInstance)
+
+	child := &sagaExample{}
+	childUID := sagaCtx.StartChildSaga(child, WithDelay(time.Second))
+	assert.NotEmpty(t, childUID)
+	assert.NotEqual(t, childUID, sagaCtx.StartChildSaga(&sagaExample{}), "every child gets own uid")
+
+	assert.Len(t, sagaCtx.Deliveries(), 2)
+	assert.Equal(t, &contracts.StartSagaCommand{SagaUID: childUID, ParentUID: "123", Saga: child}, sagaCtx.Deliveries()[0].Payload)
+	assert.Equal(t, time.Second, endpoint.DeliveryDelay(sagaCtx.Deliveries()[0].Options...))
+}
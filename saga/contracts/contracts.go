@@ -11,19 +11,30 @@ const (
 
 // RegisterSagaContracts registers all system saga contacts in specified scheme
 func RegisterSagaContracts(scheme scheme.KnownTypesRegistry) {
-	scheme.AddKnownTypes(
-		systemGroup,
+	for _, contract := range SagaContracts() {
+		scheme.AddKnownTypes(systemGroup, contract)
+	}
+}
+
+// SagaContracts returns all system saga contracts. They aren't proto messages, pass them into message.WithJsonEncodedTypes
+// if message.NewProtobufMarshaller is used.
+func SagaContracts() []message.Object {
+	return []message.Object{
 		&StartSagaCommand{},
 		&RecoverSagaCommand{},
 		&CompensateSagaCommand{},
+		&TimeoutSagaCommand{},
 		&SagaCompletedEvent{},
 		&SagaChildCompletedEvent{},
-	)
+		&SagaChildCompensationFailedEvent{},
+		&SagaHandlingFailedEvent{},
+	}
 }
 
 // StartSagaCommand once received will create SagaInstance, save it to Store and Start()
 type StartSagaCommand struct {
 	message.ObjectMeta
+	message.Command
 	SagaUID   string         `json:"saga_uid"`
 	ParentUID string         `json:"parent_uid"`
 	Saga      message.Object `json:"saga"`
@@ -31,20 +42,63 @@ type StartSagaCommand struct {
 
 type RecoverSagaCommand struct {
 	message.ObjectMeta
+	message.Command
 	SagaUID string `json:"saga_uid"`
 }
 
+// CompensateSagaCommand compensates a failed saga. Its children which haven't completed are compensated first,
+// the saga's own compensation is run once all of them have compensated.
 type CompensateSagaCommand struct {
 	message.ObjectMeta
+	message.Command
 	SagaUID string `json:"saga_uid"`
+	// Cascade set to false compensates the saga without its children
+	Cascade *bool `json:"cascade,omitempty"`
+	// ParentUID is set if the command is cascaded from the parent saga, the saga is compensated then even if it hasn't failed
+	ParentUID string `json:"parent_uid,omitempty"`
+}
+
+// Cascades tells whether children of the saga are compensated first
+func (c CompensateSagaCommand) Cascades() bool {
+	return c.Cascade == nil || *c.Cascade
+}
+
+// TimeoutSagaCommand is dispatched with a delay when saga schedules a timeout. It's ignored if the timeout was cancelled or rescheduled meanwhile.
+type TimeoutSagaCommand struct {
+	message.ObjectMeta
+	message.Command
+	SagaUID    string `json:"saga_uid"`
+	TimeoutUID string `json:"timeout_uid"`
+	Reason     string `json:"reason"`
 }
 
 type SagaCompletedEvent struct {
 	message.ObjectMeta
+	message.Event
 	SagaUID string `json:"saga_uid"`
 }
 
 type SagaChildCompletedEvent struct {
 	message.ObjectMeta
+	message.Event
 	SagaUID string `json:"saga_uid"`
 }
+
+// SagaChildCompensationFailedEvent is sent to the parent saga when compensation of its child cascaded from the parent fails
+type SagaChildCompensationFailedEvent struct {
+	message.ObjectMeta
+	message.Event
+	SagaUID string `json:"saga_uid"`
+}
+
+// SagaHandlingFailedEvent is sent when a handler of the saga keeps failing to handle an event and attempts of the retry policy are exhausted.
+// The event is dropped, the saga keeps its status. Route it to a dead letter endpoint to inspect or replay the event.
+type SagaHandlingFailedEvent struct {
+	message.ObjectMeta
+	message.Event
+	SagaUID    string         `json:"saga_uid"`
+	MessageUID string         `json:"message_uid"`
+	Payload    message.Object `json:"payload"`
+	Attempts   int            `json:"attempts"`
+	Reason     string         `json:"reason"`
+}
@@ -0,0 +1,156 @@
+package saga
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+// CorrelationRule finds the saga an event belongs to by a field of the event instead of saga uid in headers,
+// e.g. OrderPlaced.order_id is correlated with OrderSaga.order_id. Fields are referred by their json names.
+type CorrelationRule struct {
+	// Saga is a type of the saga the event is correlated with
+	Saga scheme.GroupKind
+	// EventField is a field of the event which keeps the correlation value
+	EventField string
+	// SagaField is a field of the saga which must be equal to the correlation value
+	SagaField string
+}
+
+// AmbiguousCorrelationErr is returned by Store.GetByCorrelation if several sagas in progress match the correlation value
+type AmbiguousCorrelationErr struct {
+	error
+}
+
+func WithAmbiguousCorrelationErr(err error) error {
+	return AmbiguousCorrelationErr{err}
+}
+
+// CorrelationValue returns a value of the field of obj by its json name formatted as a string.
+// False is returned if obj has no such field or it's null, an error if the field isn't a string, number or bool.
+func CorrelationValue(obj interface{}, field string) (string, bool, error) {
+	fields, err := decodeFields(obj)
+	if err != nil {
+		return "", false, err
+	}
+
+	val, ok, err := formatCorrelationValue(fields[field])
+	if err != nil {
+		return "", false, errors.Errorf("field '%s' of %T is %T, only strings, numbers and bools can be correlated", field, obj, fields[field])
+	}
+
+	return val, ok, nil
+}
+
+// maxCorrelationValueLen is the length of value column of sql store correlation table
+const maxCorrelationValueLen = 255
+
+// correlationValues returns values of all fields of obj which can be correlated, see CorrelationValue.
+func correlationValues(obj interface{}) (map[string]string, error) {
+	fields, err := decodeFields(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return scalarValues(fields), nil
+}
+
+// scalarValues returns formatted values of fields which can be correlated.
+// Fields with other types and values longer than maxCorrelationValueLen are skipped.
+func scalarValues(fields map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(fields))
+
+	for field, fieldVal := range fields {
+		val, ok, err := formatCorrelationValue(fieldVal)
+		if err != nil || !ok || len(val) > maxCorrelationValueLen {
+			continue
+		}
+
+		values[field] = val
+	}
+
+	return values
+}
+
+func decodeFields(obj interface{}) (map[string]interface{}, error) {
+	marshalled, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshalling %T", obj)
+	}
+
+	fields, err := decodeJSONFields(marshalled)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding fields of %T", obj)
+	}
+
+	return fields, nil
+}
+
+func decodeJSONFields(marshalled []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(marshalled))
+	decoder.UseNumber()
+
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return fields, nil
+}
+
+func formatCorrelationValue(fieldVal interface{}) (string, bool, error) {
+	switch val := fieldVal.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return val, true, nil
+	case json.Number:
+		return val.String(), true, nil
+	case bool:
+		return strconv.FormatBool(val), true, nil
+	default:
+		return "", false, errors.Errorf("%T can't be correlated", val)
+	}
+}
+
+// correlatedInstances returns instances whose saga field equals the value
+func correlatedInstances(instances []Instance, field, value string) ([]Instance, error) {
+	var matched []Instance
+
+	for _, instance := range instances {
+		sagaValue, ok, err := CorrelationValue(instance.Saga(), field)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading correlation field of saga '%s'", instance.UID())
+		}
+
+		if ok && sagaValue == value {
+			matched = append(matched, instance)
+		}
+	}
+
+	return matched, nil
+}
+
+// singleCorrelated returns the only instance or AmbiguousCorrelationErr if there are several of them
+func singleCorrelated(instances []Instance, sagaType, field, value string) (Instance, error) {
+	switch len(instances) {
+	case 0:
+		return nil, nil
+	case 1:
+		return instances[0], nil
+	default:
+		uids := make([]string, len(instances))
+		for i, instance := range instances {
+			uids[i] = instance.UID()
+		}
+
+		return nil, ambiguousCorrelation(uids, sagaType, field, value)
+	}
+}
+
+func ambiguousCorrelation(uids []string, sagaType, field, value string) error {
+	return WithAmbiguousCorrelationErr(errors.Errorf("%d sagas %s in progress have %s '%s': %v", len(uids), sagaType, field, value, uids))
+}
@@ -0,0 +1,48 @@
+package saga
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type correlatedEv struct {
+	OrderID  string                 `json:"order_id"`
+	Number   int64                  `json:"number"`
+	Paid     bool                   `json:"paid"`
+	Customer map[string]interface{} `json:"customer"`
+	Refund   *string                `json:"refund"`
+}
+
+func TestCorrelationValue(t *testing.T) {
+	ev := &correlatedEv{OrderID: "order-1", Number: 9007199254740993, Paid: true, Customer: map[string]interface{}{"id": 1}}
+
+	for field, expected := range map[string]string{"order_id": "order-1", "number": "9007199254740993", "paid": "true"} {
+		value, ok, err := CorrelationValue(ev, field)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, expected, value, field)
+	}
+
+	_, ok, err := CorrelationValue(ev, "refund")
+	require.NoError(t, err)
+	assert.False(t, ok, "null isn't a value")
+
+	_, ok, err = CorrelationValue(ev, "unknown")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = CorrelationValue(ev, "customer")
+	assert.EqualError(t, err, "field 'customer' of *saga.correlatedEv is map[string]interface {}, only strings, numbers and bools can be correlated")
+}
+
+func TestCorrelationValues(t *testing.T) {
+	longID := strings.Repeat("a", maxCorrelationValueLen+1)
+	ev := &correlatedEv{OrderID: "order-1", Number: 10, Paid: false, Customer: map[string]interface{}{"id": 1}, Refund: &longID}
+
+	values, err := correlationValues(ev)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"order_id": "order-1", "number": "10", "paid": "false"}, values, "objects, nulls and too long values are skipped")
+}
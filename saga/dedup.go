@@ -0,0 +1,159 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	processedMessagesTableName   = "processed_messages"
+	processedMessagesJanitorName = "processed-messages-janitor"
+)
+
+// SQLDeduplicator is subscriber.Deduplicator shared by replicas of a service, keys of processed messages are rows of a table.
+// Pass it into foreman.WithDeduplication and run NewProcessedMessagesJanitor to delete expired keys.
+type SQLDeduplicator struct {
+	db     *sagaSql.DB
+	driver SQLDriver
+}
+
+// NewSQLDeduplicator creates the table of processed messages if it doesn't exist, it supports mysql and postgres drivers
+func NewSQLDeduplicator(db *sagaSql.DB, driver SQLDriver) (*SQLDeduplicator, error) {
+	d := &SQLDeduplicator{db: db, driver: driver}
+
+	if err := d.initTable(); err != nil {
+		return nil, errors.Wrapf(err, "initializing table for SQLDeduplicator, driver %s", driver)
+	}
+
+	return d, nil
+}
+
+func (d *SQLDeduplicator) Processed(ctx context.Context, key string) (bool, error) {
+	var processed int
+
+	err := d.db.QueryRowContext(ctx, prepDriverQuery(d.driver, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE message_key=? AND expires_at > ?;", processedMessagesTableName)), key, time.Now()).Scan(&processed)
+	if err != nil {
+		return false, errors.Wrapf(err, "querying processed message %s", key)
+	}
+
+	return processed > 0, nil
+}
+
+// MarkProcessed inserts the key or prolongs an existing one
+func (d *SQLDeduplicator) MarkProcessed(ctx context.Context, key string, ttl time.Duration) error {
+	if _, err := d.db.ExecContext(ctx, prepDriverQuery(d.driver, d.upsertQuery()), key, time.Now().Add(ttl)); err != nil {
+		return errors.Wrapf(err, "inserting processed message %s", key)
+	}
+
+	return nil
+}
+
+// DeleteExpired deletes keys which expired before the passed time and returns the number of deleted keys
+func (d *SQLDeduplicator) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	res, err := d.db.ExecContext(ctx, prepDriverQuery(d.driver, fmt.Sprintf("DELETE FROM %s WHERE expires_at <= ?;", processedMessagesTableName)), before)
+	if err != nil {
+		return 0, errors.Wrap(err, "deleting expired processed messages")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting number of deleted processed messages")
+	}
+
+	return int(deleted), nil
+}
+
+func (d *SQLDeduplicator) upsertQuery() string {
+	if d.driver == PGDriver {
+		return fmt.Sprintf("INSERT INTO %s (message_key, expires_at) VALUES (?, ?) ON CONFLICT (message_key) DO UPDATE SET expires_at=EXCLUDED.expires_at;", processedMessagesTableName)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (message_key, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at=VALUES(expires_at);", processedMessagesTableName)
+}
+
+func (d *SQLDeduplicator) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	inlineIndex := ",\n\t\tindex processed_messages_expires_at_idx (expires_at)"
+
+	if d.driver == PGDriver {
+		inlineIndex = ""
+	}
+
+	_, err := d.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		message_key varchar(255) not null primary key,
+		expires_at timestamp null%s
+	);`, processedMessagesTableName, inlineIndex))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if d.driver == PGDriver {
+		if _, err := d.db.ExecContext(ctx, fmt.Sprintf("create index if not exists processed_messages_expires_at_idx on %s (expires_at);", processedMessagesTableName)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// ProcessedMessagesJanitor is a foreman.Worker which deletes expired keys of SQLDeduplicator every interval, register it with MessageBus.RegisterWorkers
+type ProcessedMessagesJanitor struct {
+	deduplicator *SQLDeduplicator
+	interval     time.Duration
+	logger       log.Logger
+}
+
+func NewProcessedMessagesJanitor(deduplicator *SQLDeduplicator, interval time.Duration, logger log.Logger) *ProcessedMessagesJanitor {
+	return &ProcessedMessagesJanitor{deduplicator: deduplicator, interval: interval, logger: logger}
+}
+
+func (j *ProcessedMessagesJanitor) Name() string {
+	return processedMessagesJanitorName
+}
+
+// Run cleans up until ctx is done. Failures are logged and retried on the next tick.
+func (j *ProcessedMessagesJanitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *ProcessedMessagesJanitor) cleanup(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	deleted, err := j.deduplicator.DeleteExpired(ctx, time.Now())
+
+	if err != nil {
+		if ctx.Err() == nil {
+			j.logger.Logf(log.ErrorLevel, "deleting expired processed messages. %s", err)
+		}
+		return
+	}
+
+	if deleted > 0 {
+		j.logger.Logf(log.DebugLevel, "deleted %d expired processed messages", deleted)
+	}
+}
+
+var _ subscriber.Deduplicator = (*SQLDeduplicator)(nil)
@@ -0,0 +1,100 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDeduplicator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("pg", func(t *testing.T) {
+		deduplicator, mock := createDeduplicator(t, PGDriver)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM processed_messages WHERE message_key=$1 AND expires_at > $2;").
+			WithArgs("queue:123", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		processed, err := deduplicator.Processed(ctx, "queue:123")
+		require.NoError(t, err)
+		assert.False(t, processed)
+
+		mock.ExpectExec("INSERT INTO processed_messages (message_key, expires_at) VALUES ($1, $2) ON CONFLICT (message_key) DO UPDATE SET expires_at=EXCLUDED.expires_at;").
+			WithArgs("queue:123", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		require.NoError(t, deduplicator.MarkProcessed(ctx, "queue:123", time.Hour))
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM processed_messages WHERE message_key=$1 AND expires_at > $2;").
+			WithArgs("queue:123", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		processed, err = deduplicator.Processed(ctx, "queue:123")
+		require.NoError(t, err)
+		assert.True(t, processed)
+
+		mock.ExpectExec("DELETE FROM processed_messages WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 3))
+		deleted, err := deduplicator.DeleteExpired(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 3, deleted)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		deduplicator, mock := createDeduplicator(t, MYSQLDriver)
+
+		mock.ExpectQuery("SELECT COUNT(*) FROM processed_messages WHERE message_key=? AND expires_at > ?;").
+			WithArgs("queue:123", sqlmock.AnyArg()).
+			WillReturnError(errors.New("connection lost"))
+		_, err := deduplicator.Processed(ctx, "queue:123")
+		assert.EqualError(t, err, "querying processed message queue:123: connection lost")
+
+		mock.ExpectExec("INSERT INTO processed_messages (message_key, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at=VALUES(expires_at);").
+			WithArgs("queue:123", sqlmock.AnyArg()).
+			WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, deduplicator.MarkProcessed(ctx, "queue:123", time.Hour), "inserting processed message queue:123: connection lost")
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestProcessedMessagesJanitor(t *testing.T) {
+	deduplicator, mock := createDeduplicator(t, PGDriver)
+
+	mock.ExpectExec("DELETE FROM processed_messages WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnError(errors.New("connection lost"))
+	mock.ExpectExec("DELETE FROM processed_messages WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	janitor := NewProcessedMessagesJanitor(deduplicator, time.Millisecond*20, log.NewNilLogger())
+	assert.Equal(t, "processed-messages-janitor", janitor.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	assert.NoError(t, janitor.Run(ctx), "failed cleanup doesn't stop the janitor")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func createDeduplicator(t *testing.T, driver SQLDriver) (*SQLDeduplicator, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	if driver == PGDriver {
+		mock.ExpectExec("create table if not exists processed_messages ( message_key varchar(255) not null primary key, expires_at timestamp null );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists processed_messages_expires_at_idx on processed_messages (expires_at);").WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec("create table if not exists processed_messages ( message_key varchar(255) not null primary key, expires_at timestamp null, index processed_messages_expires_at_idx (expires_at) );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	deduplicator, err := NewSQLDeduplicator(formanSql.NewDB(db), driver)
+	require.NoError(t, err)
+
+	return deduplicator, mock
+}
@@ -0,0 +1,278 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	delayTableName      = "delayed_messages"
+	delayDispatcherName = "delayed-messages-dispatcher"
+)
+
+// DelayedMessage is a message postponed by endpoint.WithStoreDelay, it's sent through Endpoint at DeliverAt with Options
+type DelayedMessage struct {
+	ID        int64
+	Endpoint  string
+	Message   *message.OutcomingMessage
+	DeliverAt time.Time
+	Options   []endpoint.DeliveryOption
+}
+
+// DelayedMessages keeps messages of endpoints whose transports don't support delays until they are due
+type DelayedMessages interface {
+	endpoint.DelayStore
+	// Due returns up to limit messages due at now or earlier in the order they are due
+	Due(ctx context.Context, now time.Time, limit int) ([]DelayedMessage, error)
+	// Delivered removes the message once it's sent
+	Delivered(ctx context.Context, id int64) error
+}
+
+// SQLDelayStore is DelayedMessages kept in delayed_messages table
+type SQLDelayStore struct {
+	db            *sagaSql.DB
+	driver        SQLDriver
+	msgMarshaller message.Marshaller
+}
+
+// NewSQLDelayStore creates the table of delayed messages if it doesn't exist, it supports mysql and postgres drivers
+func NewSQLDelayStore(db *sagaSql.DB, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLDelayStore, error) {
+	s := &SQLDelayStore{db: db, driver: driver, msgMarshaller: msgMarshaller}
+
+	if err := s.initTable(); err != nil {
+		return nil, errors.Wrapf(err, "initializing table for SQLDelayStore, driver %s", driver)
+	}
+
+	return s, nil
+}
+
+// delayUpgradeColumns are columns added to delayed_messages table after its first version
+var delayUpgradeColumns = []tableColumn{
+	{"idempotency_key", "varchar(255) null"},
+	{"idempotency_scope", "integer not null default 0"},
+}
+
+func (s *SQLDelayStore) Delay(ctx context.Context, endpointName string, msg *message.OutcomingMessage, deliverAt time.Time, options ...endpoint.DeliveryOption) error {
+	payload, err := s.msgMarshaller.Marshal(msg.Payload())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling delayed message %s", msg.UID())
+	}
+
+	headers, err := json.Marshal(msg.Headers())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling headers of delayed message %s", msg.UID())
+	}
+
+	idempotencyKey, idempotencyScope := endpoint.DeliveryIdempotencyKey(options...)
+
+	if _, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("INSERT INTO %s (endpoint, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", delayTableName)),
+		endpointName, msg.UID(), payload, string(headers), deliverAt, idempotencyKey, int(idempotencyScope), time.Now(),
+	); err != nil {
+		return errors.Wrapf(err, "inserting delayed message %s", msg.UID())
+	}
+
+	return nil
+}
+
+func (s *SQLDelayStore) Due(ctx context.Context, now time.Time, limit int) ([]DelayedMessage, error) {
+	rows, err := s.db.QueryContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("SELECT id, endpoint, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope FROM %s WHERE deliver_at <= ? ORDER BY deliver_at, id LIMIT ?;", delayTableName)), now, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying due delayed messages")
+	}
+
+	defer rows.Close()
+
+	var delayed []DelayedMessage
+
+	for rows.Next() {
+		var (
+			msg              DelayedMessage
+			msgUID, headers  string
+			payload          []byte
+			idempotencyKey   sql.NullString
+			idempotencyScope int
+		)
+
+		if err := rows.Scan(&msg.ID, &msg.Endpoint, &msgUID, &payload, &headers, &msg.DeliverAt, &idempotencyKey, &idempotencyScope); err != nil {
+			return nil, errors.Wrap(err, "scanning delayed message")
+		}
+
+		obj, err := s.msgMarshaller.Unmarshal(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling delayed message %d", msg.ID)
+		}
+
+		msgHeaders := make(message.Headers)
+		if err := json.Unmarshal([]byte(headers), &msgHeaders); err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling headers of delayed message %d", msg.ID)
+		}
+
+		msg.Message = message.NewOutcomingMessage(obj, message.WithHeaders(msgHeaders), message.WithUID(msgUID))
+
+		if idempotencyKey.String != "" {
+			msg.Options = append(msg.Options, endpoint.WithIdempotencyKey(idempotencyKey.String, endpoint.IdempotencyScope(idempotencyScope)))
+		}
+		delayed = append(delayed, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating over delayed messages")
+	}
+
+	return delayed, nil
+}
+
+func (s *SQLDelayStore) Delivered(ctx context.Context, id int64) error {
+	if _, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("DELETE FROM %s WHERE id=?;", delayTableName)), id); err != nil {
+		return errors.Wrapf(err, "removing delivered delayed message %d", id)
+	}
+
+	return nil
+}
+
+func (s *SQLDelayStore) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	idColumn, payloadColumn, inlineIndexes := "bigint not null auto_increment primary key", "longblob", ",\n\t\tindex delayed_messages_deliver_at_idx (deliver_at, id)"
+
+	if s.driver == PGDriver {
+		idColumn, payloadColumn, inlineIndexes = "bigserial primary key", "bytea", ""
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id %s,
+		endpoint varchar(255) not null,
+		msg_uid varchar(255) not null,
+		payload %s not null,
+		headers text not null,
+		deliver_at timestamp not null,
+		idempotency_key varchar(255) null,
+		idempotency_scope integer not null default 0,
+		created_at timestamp null%s
+	);`, delayTableName, idColumn, payloadColumn, inlineIndexes))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	upgradeQueries, err := addColumnsQueries(ctx, s.db, s.driver, delayTableName, delayUpgradeColumns)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range upgradeQueries {
+		if _, err := s.db.ExecContext(ctx, query); err != nil {
+			return errors.Wrapf(err, "upgrading table: %s", query)
+		}
+	}
+
+	if s.driver == PGDriver {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("create index if not exists delayed_messages_deliver_at_idx on %s (deliver_at, id);", delayTableName)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// DelayDispatcher is a foreman.Worker which sends due delayed messages every interval through endpoints they were delayed by.
+// Pass targets of endpoint.WithStoreDelay, they are looked up by name. A message is removed only after it's sent, so it may be
+// delivered more than once. Failed messages are retried on the next tick. Dispatchers of several replicas would send the same
+// due messages, so register it on a MessageBus with a worker mutex: the saga component provides one, otherwise use foreman.WithWorkerMutex.
+// A message delayed with endpoint.WithIdempotencyKey is sent with the same key, so an endpoint deduplicating sends delivers it once.
+type DelayDispatcher struct {
+	store     DelayedMessages
+	endpoints map[string]endpoint.Endpoint
+	interval  time.Duration
+	batchSize int
+	logger    log.Logger
+}
+
+func NewDelayDispatcher(store DelayedMessages, interval time.Duration, batchSize int, logger log.Logger, endpoints ...endpoint.Endpoint) *DelayDispatcher {
+	d := &DelayDispatcher{store: store, endpoints: make(map[string]endpoint.Endpoint, len(endpoints)), interval: interval, batchSize: batchSize, logger: logger}
+
+	for _, e := range endpoints {
+		d.endpoints[e.Name()] = e
+	}
+
+	return d
+}
+
+func (d *DelayDispatcher) Name() string {
+	return delayDispatcherName
+}
+
+// Run dispatches due messages until ctx is done. Failures are logged and retried on the next tick.
+func (d *DelayDispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.dispatch(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Logf(log.ErrorLevel, "dispatching delayed messages. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch sends batches of due messages until none is left or a message fails
+func (d *DelayDispatcher) dispatch(ctx context.Context) error {
+	for ctx.Err() == nil {
+		delayed, err := d.store.Due(ctx, time.Now(), d.batchSize)
+		if err != nil {
+			return err
+		}
+
+		failed := false
+
+		for _, msg := range delayed {
+			if err := d.send(ctx, msg); err != nil {
+				failed = true
+				d.logger.Logf(log.ErrorLevel, "sending delayed message %d. %s", msg.ID, err)
+
+				continue
+			}
+
+			if err := d.store.Delivered(ctx, msg.ID); err != nil {
+				return err
+			}
+		}
+
+		if len(delayed) < d.batchSize || failed {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (d *DelayDispatcher) send(ctx context.Context, delayed DelayedMessage) error {
+	e, exists := d.endpoints[delayed.Endpoint]
+	if !exists {
+		return errors.Errorf("endpoint %s of message %s isn't passed to the dispatcher", delayed.Endpoint, delayed.Message.UID())
+	}
+
+	if err := e.Send(ctx, delayed.Message, delayed.Options...); err != nil {
+		return errors.Wrapf(err, "sending message %s to endpoint %s", delayed.Message.UID(), e.Name())
+	}
+
+	return nil
+}
+
+var _ DelayedMessages = (*SQLDelayStore)(nil)
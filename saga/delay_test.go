@@ -0,0 +1,178 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDelayStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	deliverAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("pg delay", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		store, mock := createDelayStore(t, PGDriver, marshallerMock)
+		msg := message.NewOutcomingMessage(&ExampleEv{Data: "data"})
+
+		marshallerMock.EXPECT().Marshal(msg.Payload()).Return([]byte("payload"), nil)
+		mock.ExpectExec("INSERT INTO delayed_messages (endpoint, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);").
+			WithArgs("orders", msg.UID(), []byte("payload"), `{"uid":"`+msg.UID()+`"}`, deliverAt, "order-1", int(endpoint.SharedScope), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		require.NoError(t, store.Delay(ctx, "orders", msg, deliverAt, endpoint.WithDelay(time.Minute), endpoint.WithIdempotencyKey("order-1", endpoint.SharedScope)))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql due messages and delivered", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		store, mock := createDelayStore(t, MYSQLDriver, marshallerMock)
+		now := deliverAt.Add(time.Minute)
+
+		mock.ExpectQuery("SELECT id, endpoint, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope FROM delayed_messages WHERE deliver_at <= ? ORDER BY deliver_at, id LIMIT ?;").
+			WithArgs(now, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "endpoint", "msg_uid", "payload", "headers", "deliver_at", "idempotency_key", "idempotency_scope"}).
+				AddRow(1, "orders", "msg-1", []byte("payload"), `{"uid":"msg-1"}`, deliverAt, "order-1", int(endpoint.SharedScope)).
+				AddRow(2, "orders", "msg-2", []byte("payload"), `{"uid":"msg-2"}`, deliverAt, nil, 0),
+			)
+		marshallerMock.EXPECT().Unmarshal([]byte("payload")).Return(&ExampleEv{Data: "data"}, nil).Times(2)
+
+		delayed, err := store.Due(ctx, now, 10)
+		require.NoError(t, err)
+		require.Len(t, delayed, 2)
+
+		key, scope := endpoint.DeliveryIdempotencyKey(delayed[0].Options...)
+		assert.Equal(t, "order-1", key)
+		assert.Equal(t, endpoint.SharedScope, scope)
+		assert.Empty(t, delayed[1].Options, "message delayed without a key is sent without it")
+
+		assert.Equal(t, int64(1), delayed[0].ID)
+		assert.Equal(t, "orders", delayed[0].Endpoint)
+		assert.Equal(t, deliverAt, delayed[0].DeliverAt)
+		assert.Equal(t, "msg-1", delayed[0].Message.UID())
+		assert.Equal(t, &ExampleEv{Data: "data"}, delayed[0].Message.Payload())
+
+		mock.ExpectExec("DELETE FROM delayed_messages WHERE id=?;").WithArgs(1).WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, store.Delivered(ctx, 1), "removing delivered delayed message 1: connection lost")
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDelayDispatcher(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+	endpointInstance.EXPECT().Name().Return("orders").AnyTimes()
+
+	newDelayed := func(id int64, endpoint string) DelayedMessage {
+		return DelayedMessage{ID: id, Endpoint: endpoint, Message: message.NewOutcomingMessage(&ExampleEv{Data: endpoint})}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second, unknown := newDelayed(1, "orders"), newDelayed(2, "orders"), newDelayed(3, "invoices")
+	second.Options = []endpoint.DeliveryOption{endpoint.WithIdempotencyKey("order-2", endpoint.SharedScope)}
+	store := &fakeDelayStore{due: []DelayedMessage{first, second, unknown}, onDue: func(calls int) {
+		if calls == 2 {
+			cancel()
+		}
+	}}
+
+	dispatcher := NewDelayDispatcher(store, time.Millisecond*10, 10, log.NewNilLogger(), endpointInstance)
+	assert.Equal(t, "delayed-messages-dispatcher", dispatcher.Name())
+
+	gomock.InOrder(
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(errors.New("broker is down")),
+		endpointInstance.EXPECT().Send(gomock.Any(), second.Message, gomock.Any()).DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			key, _ := endpoint.DeliveryIdempotencyKey(options...)
+			assert.Equal(t, "order-2", key, "the message is sent with the key it was delayed with")
+			return nil
+		}),
+		// the failed message is sent again on the next tick
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(nil),
+	)
+
+	assert.NoError(t, dispatcher.Run(ctx))
+	assert.Equal(t, []int64{2, 1}, store.delivered)
+	assert.Equal(t, []DelayedMessage{unknown}, store.due, "message of an unknown endpoint is kept")
+}
+
+type fakeDelayStore struct {
+	DelayedMessages
+	due       []DelayedMessage
+	delivered []int64
+	dueCalls  int
+	onDue     func(calls int)
+}
+
+func (s *fakeDelayStore) Due(ctx context.Context, now time.Time, limit int) ([]DelayedMessage, error) {
+	s.dueCalls++
+	s.onDue(s.dueCalls)
+
+	due := make([]DelayedMessage, len(s.due))
+	copy(due, s.due)
+
+	if len(due) > limit {
+		return due[:limit], nil
+	}
+
+	return due, nil
+}
+
+func (s *fakeDelayStore) Delivered(ctx context.Context, id int64) error {
+	s.delivered = append(s.delivered, id)
+
+	for i, delayed := range s.due {
+		if delayed.ID == id {
+			s.due = append(s.due[:i], s.due[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func createDelayStore(t *testing.T, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLDelayStore, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	if driver == PGDriver {
+		mock.ExpectExec("create table if not exists delayed_messages ( id bigserial primary key, endpoint varchar(255) not null, msg_uid varchar(255) not null, payload bytea not null, headers text not null, deliver_at timestamp not null, idempotency_key varchar(255) null, idempotency_scope integer not null default 0, created_at timestamp null );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table delayed_messages add column if not exists idempotency_key varchar(255) null;").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table delayed_messages add column if not exists idempotency_scope integer not null default 0;").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists delayed_messages_deliver_at_idx on delayed_messages (deliver_at, id);").WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec("create table if not exists delayed_messages ( id bigint not null auto_increment primary key, endpoint varchar(255) not null, msg_uid varchar(255) not null, payload longblob not null, headers text not null, deliver_at timestamp not null, idempotency_key varchar(255) null, idempotency_scope integer not null default 0, created_at timestamp null, index delayed_messages_deliver_at_idx (deliver_at, id) );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		// the table was created by a previous version without idempotency columns
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('idempotency_key', 'idempotency_scope');").
+			WithArgs("delayed_messages").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}))
+		mock.ExpectExec("alter table delayed_messages add column idempotency_key varchar(255) null;").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table delayed_messages add column idempotency_scope integer not null default 0;").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	store, err := NewSQLDelayStore(formanSql.NewDB(db), driver, msgMarshaller)
+	require.NoError(t, err)
+
+	return store, mock
+}
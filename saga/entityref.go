@@ -0,0 +1,52 @@
+package saga
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxEntityRefs limits a number of entity references kept by one saga instance
+const MaxEntityRefs = 100
+
+// EntityRef references a business entity a saga touched, e.g. order 12345. Sagas can be found by their refs with WithEntityRef filter.
+type EntityRef struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// String formats the ref as kind:id
+func (r EntityRef) String() string {
+	return r.Kind + ":" + r.ID
+}
+
+// ParseEntityRef parses a ref formatted as kind:id, the id may contain colons
+func ParseEntityRef(ref string) (EntityRef, error) {
+	idx := strings.Index(ref, ":")
+	if idx <= 0 || idx == len(ref)-1 {
+		return EntityRef{}, errors.Errorf("entity ref '%s' is expected to be in format kind:id", ref)
+	}
+
+	return EntityRef{Kind: ref[:idx], ID: ref[idx+1:]}, nil
+}
+
+// EntityRefLimitErr is returned when a saga instance already has MaxEntityRefs refs
+type EntityRefLimitErr struct {
+	error
+}
+
+func WithEntityRefLimitErr(err error) error {
+	return EntityRefLimitErr{err}
+}
+
+func validateEntityRef(ref EntityRef) error {
+	if ref.Kind == "" || ref.ID == "" {
+		return errors.Errorf("entity ref '%s' must have both kind and id", ref)
+	}
+
+	if strings.Contains(ref.Kind, ":") {
+		return errors.Errorf("kind of entity ref '%s' must not contain ':'", ref)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package saga
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEntityRef(t *testing.T) {
+	ref, err := ParseEntityRef("order:12345")
+	require.NoError(t, err)
+	assert.Equal(t, EntityRef{Kind: "order", ID: "12345"}, ref)
+	assert.Equal(t, "order:12345", ref.String())
+
+	ref, err = ParseEntityRef("url:https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, EntityRef{Kind: "url", ID: "https://example.com"}, ref)
+
+	for _, invalid := range []string{"", "order", ":12345", "order:"} {
+		_, err := ParseEntityRef(invalid)
+		assert.EqualError(t, err, fmt.Sprintf("entity ref '%s' is expected to be in format kind:id", invalid))
+	}
+}
+
+func TestSagaInstance_AddEntityRef(t *testing.T) {
+	t.Run("refs are deduplicated", func(t *testing.T) {
+		instance := NewSagaInstance("123", "", &sagaExample{})
+
+		require.NoError(t, instance.AddEntityRef(EntityRef{Kind: "order", ID: "1"}))
+		require.NoError(t, instance.AddEntityRef(EntityRef{Kind: "customer", ID: "1"}))
+		require.NoError(t, instance.AddEntityRef(EntityRef{Kind: "order", ID: "1"}))
+
+		assert.Equal(t, []EntityRef{{Kind: "order", ID: "1"}, {Kind: "customer", ID: "1"}}, instance.EntityRefs())
+	})
+
+	t.Run("refs are capped", func(t *testing.T) {
+		instance := NewSagaInstance("123", "", &sagaExample{})
+
+		for i := 0; i < MaxEntityRefs; i++ {
+			require.NoError(t, instance.AddEntityRef(EntityRef{Kind: "order", ID: fmt.Sprint(i)}))
+		}
+
+		// an existing ref is still accepted
+		assert.NoError(t, instance.AddEntityRef(EntityRef{Kind: "order", ID: "0"}))
+
+		err := instance.AddEntityRef(EntityRef{Kind: "order", ID: "new"})
+		require.Error(t, err)
+		assert.IsType(t, EntityRefLimitErr{}, err)
+		assert.EqualError(t, err, "saga '123' already has 100 entity refs, can't add order:new")
+		assert.Len(t, instance.EntityRefs(), MaxEntityRefs)
+	})
+
+	t.Run("invalid refs", func(t *testing.T) {
+		instance := NewSagaInstance("123", "", &sagaExample{})
+
+		assert.EqualError(t, instance.AddEntityRef(EntityRef{Kind: "order"}), "entity ref 'order:' must have both kind and id")
+		assert.EqualError(t, instance.AddEntityRef(EntityRef{Kind: "a:b", ID: "1"}), "kind of entity ref 'a:b:1' must not contain ':'")
+		assert.Empty(t, instance.EntityRefs())
+	})
+}
@@ -0,0 +1,96 @@
+package saga
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+// expectationReasonPrefix starts reasons of timeouts scheduled for expectations
+const expectationReasonPrefix = "expect:"
+
+// Expectation is an event a saga instance waits for without a static handler, see SagaContext.ExpectEvent.
+// It's persisted together with the saga.
+type Expectation struct {
+	GroupKind scheme.GroupKind `json:"group_kind"`
+	// CorrelationID is the correlation id (message.TraceIDHeader) of the message handled when the expectation was recorded,
+	// only an event with the same correlation id fulfills it. An empty one is fulfilled by any event of the type.
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// ExpectingSaga is implemented by sagas which wait for events with SagaContext.ExpectEvent. OnExpected is called with an event
+// which fulfilled an expectation. Expectations are checked only for events the saga has no handler for.
+type ExpectingSaga interface {
+	OnExpected(sagaCtx SagaContext, ev message.Object) error
+}
+
+// ExpectationTimeoutReason is the reason of the timeout which fires when an expectation of events of the type expires.
+// Add a timeout handler with this reason to react to the expiry, the expectation is removed before it's called.
+func ExpectationTimeoutReason(gk scheme.GroupKind) string {
+	return expectationReasonPrefix + gk.String()
+}
+
+// expectedTypeOf returns the type of expected events if the timeout reason belongs to an expectation
+func expectedTypeOf(reason string) (string, bool) {
+	if !strings.HasPrefix(reason, expectationReasonPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(reason, expectationReasonPrefix), true
+}
+
+// timeoutScheduler is implemented by sagas embedding BaseSaga
+type timeoutScheduler interface {
+	ScheduleTimeout(sagaCtx SagaContext, reason string, after time.Duration)
+}
+
+// timeoutScheduling is implemented by SagaContext created with WithScheduledTimeouts
+type timeoutScheduling interface {
+	schedulesTimeouts() bool
+}
+
+// FulfillExpectation removes the expectation of the received event and cancels its timeout if the event fulfills it.
+// An expectation which has expired, but whose timeout hasn't fired yet, isn't fulfilled.
+func FulfillExpectation(saga Saga, msg *message.ReceivedMessage) bool {
+	gk := msg.Payload().GroupKind().String()
+
+	expectation, exists := saga.Expectations()[gk]
+	if !exists || !msg.ReceivedAt().Before(expectation.ExpiresAt) {
+		return false
+	}
+
+	if expectation.CorrelationID != "" && expectation.CorrelationID != msg.TraceID() {
+		return false
+	}
+
+	removeExpectation(saga, gk)
+	saga.CancelTimeout(expectationReasonPrefix + gk)
+
+	return true
+}
+
+func removeExpectation(saga Saga, gk string) {
+	expectations := saga.Expectations()
+	delete(expectations, gk)
+
+	if len(expectations) == 0 {
+		expectations = nil
+	}
+
+	saga.SetExpectations(expectations)
+}
+
+// ExpireExpectation removes the expectation whose timeout fired, false is returned if the reason doesn't belong to an expectation
+func ExpireExpectation(saga Saga, reason string) bool {
+	gk, ok := expectedTypeOf(reason)
+	if !ok {
+		return false
+	}
+
+	removeExpectation(saga, gk)
+
+	return true
+}
@@ -0,0 +1,99 @@
+package saga
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	replyGK := scheme.GroupKind{Group: "partner", Kind: "DataContract"}
+	reply := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "partner", Kind: "DataContract"}}}
+
+	expect := func(exp *sagaExample) SagaContext {
+		handled := message.NewReceivedMessage("msg-1", &DataContract{}, message.Headers{message.TraceIDHeader: "flow-1"}, time.Now(), "origin")
+
+		msgExecCtxMock := execution.NewMockMessageExecutionCtx(ctrl)
+		msgExecCtxMock.EXPECT().Logger().Return(log.NewNilLogger())
+		msgExecCtxMock.EXPECT().Message().Return(handled)
+
+		sagaCtx := NewSagaCtx(msgExecCtxMock, NewSagaInstance("123", "", exp))
+		sagaCtx.ExpectEvent(replyGK, time.Minute)
+
+		return sagaCtx
+	}
+
+	receive := func(traceID string, receivedAt time.Time) *message.ReceivedMessage {
+		return message.NewReceivedMessage("msg-2", reply, message.Headers{message.TraceIDHeader: traceID}, receivedAt, "origin")
+	}
+
+	t.Run("expectation is recorded with a timeout", func(t *testing.T) {
+		exp := &sagaExample{}
+		sagaCtx := expect(exp)
+
+		expectation, exists := exp.Expectations()[replyGK.String()]
+		require.True(t, exists)
+		assert.Equal(t, replyGK, expectation.GroupKind)
+		assert.Equal(t, "flow-1", expectation.CorrelationID)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), expectation.ExpiresAt, time.Second)
+
+		require.Len(t, sagaCtx.Deliveries(), 1)
+		timeout := sagaCtx.Deliveries()[0].Payload.(*contracts.TimeoutSagaCommand)
+		assert.Equal(t, ExpectationTimeoutReason(replyGK), timeout.Reason)
+		assert.True(t, exp.TimeoutPending(timeout.Reason, timeout.TimeoutUID))
+	})
+
+	t.Run("event with the correlation id fulfills the expectation", func(t *testing.T) {
+		exp := &sagaExample{}
+		expect(exp)
+
+		assert.False(t, FulfillExpectation(exp, receive("flow-2", time.Now())), "another flow")
+		assert.False(t, FulfillExpectation(exp, receive("flow-1", time.Now().Add(time.Hour))), "expired")
+
+		assert.True(t, FulfillExpectation(exp, receive("flow-1", time.Now())))
+		assert.Empty(t, exp.Expectations())
+		assert.Empty(t, exp.Timeouts, "timeout is cancelled")
+		assert.False(t, FulfillExpectation(exp, receive("flow-1", time.Now())), "fulfilled once")
+	})
+
+	t.Run("expectation is removed by its timeout", func(t *testing.T) {
+		exp := &sagaExample{}
+		expect(exp)
+
+		assert.False(t, ExpireExpectation(exp, "reply"))
+		assert.Len(t, exp.Expectations(), 1)
+
+		assert.True(t, ExpireExpectation(exp, ExpectationTimeoutReason(replyGK)))
+		assert.Empty(t, exp.Expectations())
+	})
+
+	t.Run("expectations are persisted with the saga", func(t *testing.T) {
+		exp := &sagaExample{}
+		expect(exp)
+
+		schema := scheme.NewKnownTypesRegistry()
+		schema.AddKnownTypes("someGroup", &sagaExample{})
+		marshaller := message.NewJsonMarshaller(schema)
+
+		payload, err := marshaller.Marshal(exp)
+		require.NoError(t, err)
+
+		decoded, err := marshaller.Unmarshal(payload)
+		require.NoError(t, err)
+
+		expectation := decoded.(*sagaExample).Expectations()[replyGK.String()]
+		assert.Equal(t, "flow-1", expectation.CorrelationID)
+		assert.True(t, exp.Expectations()[replyGK.String()].ExpiresAt.Equal(expectation.ExpiresAt))
+	})
+}
@@ -0,0 +1,153 @@
+package saga
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/saga/filter"
+)
+
+// MatchFilter tells whether the instance matches the filter the same way sql stores select sagas, a nil filter matches every instance.
+// Stores keeping sagas in memory use it instead of compiling the filter into a query.
+func MatchFilter(e filter.Expr, instance Instance) bool {
+	switch node := e.(type) {
+	case nil:
+		return true
+	case filter.AndExpr:
+		for _, child := range node.Exprs {
+			if !MatchFilter(child, instance) {
+				return false
+			}
+		}
+
+		return true
+	case filter.OrExpr:
+		for _, child := range node.Exprs {
+			if MatchFilter(child, instance) {
+				return true
+			}
+		}
+
+		return false
+	case filter.NotExpr:
+		return !MatchFilter(node.Expr, instance)
+	case filter.SagaIDExpr:
+		return contains(node.IDs, instance.UID())
+	case filter.StatusExpr:
+		return contains(node.Statuses, instance.Status().String())
+	case filter.NameExpr:
+		return instance.Saga() != nil && contains(node.Names, instance.Saga().GroupKind().String())
+	case filter.ParentIDExpr:
+		return instance.ParentID() == node.ID
+	case filter.TimeExpr:
+		return matchTime(node, instance)
+	case filter.EntityRefExpr:
+		for _, ref := range instance.EntityRefs() {
+			if ref.Kind == node.EntityKind && ref.ID == node.ID {
+				return true
+			}
+		}
+
+		return false
+	case filter.DataContainsExpr:
+		if instance.Saga() == nil {
+			return false
+		}
+
+		data, err := json.Marshal(instance.Saga())
+		if err != nil {
+			return false
+		}
+
+		if doc, ok := node.Document(); ok {
+			var value interface{}
+			if err := json.Unmarshal(data, &value); err != nil {
+				return false
+			}
+
+			return jsonContains(value, doc)
+		}
+
+		return strings.Contains(strings.ToLower(string(data)), strings.ToLower(node.Text))
+	default:
+		return false
+	}
+}
+
+// jsonContains tells whether the decoded json value contains the other one as postgres @> operator does:
+// an object contains the fields of the other one, an array contains each element of the other one, scalars are equal
+func jsonContains(value, other interface{}) bool {
+	switch o := other.(type) {
+	case map[string]interface{}:
+		v, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		for key, otherField := range o {
+			field, exists := v[key]
+			if !exists || !jsonContains(field, otherField) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		v, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+
+		for _, otherElem := range o {
+			found := false
+
+			for _, elem := range v {
+				if jsonContains(elem, otherElem) {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return value == other
+	}
+}
+
+func matchTime(e filter.TimeExpr, instance Instance) bool {
+	var t *time.Time
+
+	switch e.Kind() {
+	case filter.StartedFromKind, filter.StartedBeforeKind:
+		t = instance.StartedAt()
+	default:
+		t = instance.UpdatedAt()
+	}
+
+	if t == nil {
+		return false
+	}
+
+	switch e.Kind() {
+	case filter.StartedFromKind, filter.UpdatedFromKind:
+		return !t.Before(e.Time)
+	default:
+		return t.Before(e.Time)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
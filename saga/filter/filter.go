@@ -0,0 +1,345 @@
+// Package filter describes which sagas Store.GetByFilter and Store.DeleteByFilter select. A filter is a tree of predicates
+// combined with And, Or and Not, e.g. filter.And(filter.StatusIn("failed", "compensating"), filter.StartedFrom(t)).
+// Each store compiles the tree into its native query and fails on predicates it doesn't support, see Check.
+package filter
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind names a predicate, stores declare kinds they support
+type Kind string
+
+const (
+	AndKind           Kind = "and"
+	OrKind            Kind = "or"
+	NotKind           Kind = "not"
+	SagaIDKind        Kind = "sagaId"
+	StatusKind        Kind = "status"
+	NameKind          Kind = "name"
+	ParentIDKind      Kind = "parentId"
+	StartedFromKind   Kind = "startedFrom"
+	StartedBeforeKind Kind = "startedBefore"
+	UpdatedFromKind   Kind = "updatedFrom"
+	UpdatedBeforeKind Kind = "updatedBefore"
+	EntityRefKind     Kind = "entityRef"
+	DataContainsKind  Kind = "dataContains"
+)
+
+// AllKinds lists every predicate, a store which supports all of them returns it
+var AllKinds = []Kind{
+	AndKind, OrKind, NotKind, SagaIDKind, StatusKind, NameKind, ParentIDKind,
+	StartedFromKind, StartedBeforeKind, UpdatedFromKind, UpdatedBeforeKind, EntityRefKind, DataContainsKind,
+}
+
+// Expr is a node of a filter, it's one of the types declared in this package
+type Expr interface {
+	Kind() Kind
+	String() string
+	expr()
+}
+
+// AndExpr matches sagas matched by all of Exprs, an empty one matches every saga
+type AndExpr struct {
+	Exprs []Expr
+}
+
+// OrExpr matches sagas matched by any of Exprs, an empty one matches nothing
+type OrExpr struct {
+	Exprs []Expr
+}
+
+// NotExpr matches sagas not matched by Expr
+type NotExpr struct {
+	Expr Expr
+}
+
+// SagaIDExpr matches sagas with any of IDs
+type SagaIDExpr struct {
+	IDs []string
+}
+
+// StatusExpr matches sagas in any of Statuses
+type StatusExpr struct {
+	Statuses []string
+}
+
+// NameExpr matches sagas of any of types in Names, a type is formatted as group.kind
+type NameExpr struct {
+	Names []string
+}
+
+// ParentIDExpr matches children of the saga
+type ParentIDExpr struct {
+	ID string
+}
+
+// TimeExpr matches sagas by time they were started or last updated at. From kinds include the time, Before kinds exclude it.
+// Sagas without the time never match.
+type TimeExpr struct {
+	kind Kind
+	Time time.Time
+}
+
+// EntityRefExpr matches sagas which referenced the entity with SagaContext.AddEntityRef, see saga.EntityRef
+type EntityRefExpr struct {
+	EntityKind string
+	ID         string
+}
+
+// DataContainsExpr matches sagas whose marshalled data contains Text, case insensitive.
+// Text which is a json object is matched by containment instead, see Document.
+type DataContainsExpr struct {
+	Text string
+}
+
+// Document returns Text decoded if it's a json object. Such text matches sagas whose data contains the document,
+// e.g. {"email":"john@example.com"} matches sagas whose email field is exactly john@example.com.
+func (e DataContainsExpr) Document() (map[string]interface{}, bool) {
+	text := strings.TrimSpace(e.Text)
+	if !strings.HasPrefix(text, "{") {
+		return nil, false
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, false
+	}
+
+	return doc, true
+}
+
+// And combines predicates so all of them must match. Nested And are flattened.
+func And(exprs ...Expr) Expr {
+	flat := make([]Expr, 0, len(exprs))
+
+	for _, e := range exprs {
+		if and, ok := e.(AndExpr); ok {
+			flat = append(flat, and.Exprs...)
+			continue
+		}
+
+		flat = append(flat, e)
+	}
+
+	return AndExpr{Exprs: flat}
+}
+
+// Or combines predicates so any of them must match
+func Or(exprs ...Expr) Expr {
+	return OrExpr{Exprs: exprs}
+}
+
+// Not negates the predicate
+func Not(e Expr) Expr {
+	return NotExpr{Expr: e}
+}
+
+// SagaID matches sagas with any of the ids
+func SagaID(ids ...string) Expr {
+	return SagaIDExpr{IDs: ids}
+}
+
+// StatusIn matches sagas in any of the statuses
+func StatusIn(statuses ...string) Expr {
+	return StatusExpr{Statuses: statuses}
+}
+
+// Name matches sagas of any of the types, e.g. Name("orders.OrderSaga")
+func Name(names ...string) Expr {
+	return NameExpr{Names: names}
+}
+
+// ParentID matches children of the saga
+func ParentID(id string) Expr {
+	return ParentIDExpr{ID: id}
+}
+
+// StartedFrom matches sagas started at or after t
+func StartedFrom(t time.Time) Expr {
+	return TimeExpr{kind: StartedFromKind, Time: t}
+}
+
+// StartedBefore matches sagas started before t
+func StartedBefore(t time.Time) Expr {
+	return TimeExpr{kind: StartedBeforeKind, Time: t}
+}
+
+// UpdatedFrom matches sagas last updated at or after t
+func UpdatedFrom(t time.Time) Expr {
+	return TimeExpr{kind: UpdatedFromKind, Time: t}
+}
+
+// UpdatedBefore matches sagas last updated before t
+func UpdatedBefore(t time.Time) Expr {
+	return TimeExpr{kind: UpdatedBeforeKind, Time: t}
+}
+
+// EntityRef matches sagas which referenced the entity, regardless of their type and status
+func EntityRef(kind, id string) Expr {
+	return EntityRefExpr{EntityKind: kind, ID: id}
+}
+
+// DataContains is a free-text search over data of sagas, e.g. DataContains("john@example.com"). The text is matched against
+// the marshalled saga as it's stored, so search for values rather than fragments of json. It can't use an index,
+// combine it with predicates which narrow sagas down, e.g. by type and time.
+// A json object is matched by containment, e.g. DataContains(`{"email":"john@example.com"}`), postgres store backs it with an index.
+// Stores keeping sagas in a binary format don't support DataContains.
+func DataContains(text string) Expr {
+	return DataContainsExpr{Text: text}
+}
+
+func (AndExpr) Kind() Kind          { return AndKind }
+func (OrExpr) Kind() Kind           { return OrKind }
+func (NotExpr) Kind() Kind          { return NotKind }
+func (SagaIDExpr) Kind() Kind       { return SagaIDKind }
+func (StatusExpr) Kind() Kind       { return StatusKind }
+func (NameExpr) Kind() Kind         { return NameKind }
+func (ParentIDExpr) Kind() Kind     { return ParentIDKind }
+func (e TimeExpr) Kind() Kind       { return e.kind }
+func (EntityRefExpr) Kind() Kind    { return EntityRefKind }
+func (DataContainsExpr) Kind() Kind { return DataContainsKind }
+
+func (AndExpr) expr()          {}
+func (OrExpr) expr()           {}
+func (NotExpr) expr()          {}
+func (SagaIDExpr) expr()       {}
+func (StatusExpr) expr()       {}
+func (NameExpr) expr()         {}
+func (ParentIDExpr) expr()     {}
+func (TimeExpr) expr()         {}
+func (EntityRefExpr) expr()    {}
+func (DataContainsExpr) expr() {}
+
+func (e AndExpr) String() string {
+	return "and(" + joinExprs(e.Exprs) + ")"
+}
+
+func (e OrExpr) String() string {
+	return "or(" + joinExprs(e.Exprs) + ")"
+}
+
+func (e NotExpr) String() string {
+	return "not(" + e.Expr.String() + ")"
+}
+
+func (e SagaIDExpr) String() string {
+	return string(SagaIDKind) + " in (" + strings.Join(e.IDs, ", ") + ")"
+}
+
+func (e StatusExpr) String() string {
+	return string(StatusKind) + " in (" + strings.Join(e.Statuses, ", ") + ")"
+}
+
+func (e NameExpr) String() string {
+	return string(NameKind) + " in (" + strings.Join(e.Names, ", ") + ")"
+}
+
+func (e ParentIDExpr) String() string {
+	return string(ParentIDKind) + " = " + e.ID
+}
+
+func (e TimeExpr) String() string {
+	return string(e.kind) + " " + e.Time.Format(time.RFC3339Nano)
+}
+
+func (e EntityRefExpr) String() string {
+	return string(EntityRefKind) + " = " + e.EntityKind + ":" + e.ID
+}
+
+func (e DataContainsExpr) String() string {
+	return string(DataContainsKind) + " " + e.Text
+}
+
+func joinExprs(exprs []Expr) string {
+	parts := make([]string, len(exprs))
+	for i, e := range exprs {
+		parts[i] = e.String()
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// UnsupportedPredicateErr is returned by a store which can't compile a predicate of the filter
+type UnsupportedPredicateErr struct {
+	error
+}
+
+func WithUnsupportedPredicateErr(err error) error {
+	return UnsupportedPredicateErr{err}
+}
+
+// Check returns UnsupportedPredicateErr if the filter has a predicate of a kind which isn't supported, store names the store in the error.
+// A store calls it before compiling a filter, so a predicate is never silently ignored.
+func Check(e Expr, store string, supported ...Kind) error {
+	kinds := make(map[Kind]struct{}, len(supported))
+	for _, k := range supported {
+		kinds[k] = struct{}{}
+	}
+
+	return Walk(e, func(node Expr) error {
+		if _, ok := kinds[node.Kind()]; !ok {
+			return WithUnsupportedPredicateErr(errors.Errorf("filter predicate '%s' isn't supported by %s", node.Kind(), store))
+		}
+
+		return nil
+	})
+}
+
+// Walk calls fn for each node of the filter, parents before children, and stops on the first error
+func Walk(e Expr, fn func(node Expr) error) error {
+	if e == nil {
+		return nil
+	}
+
+	if err := fn(e); err != nil {
+		return err
+	}
+
+	var children []Expr
+
+	switch node := e.(type) {
+	case AndExpr:
+		children = node.Exprs
+	case OrExpr:
+		children = node.Exprs
+	case NotExpr:
+		children = []Expr{node.Expr}
+	}
+
+	for _, child := range children {
+		if err := Walk(child, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Conjuncts returns predicates which must all match, a filter which isn't And is the only one of them
+func Conjuncts(e Expr) []Expr {
+	if e == nil {
+		return nil
+	}
+
+	if and, ok := e.(AndExpr); ok {
+		return and.Exprs
+	}
+
+	return []Expr{e}
+}
+
+// SingleSagaID returns the id if the filter can match only the saga with it, e.g. a sharded store routes such a filter to one shard
+func SingleSagaID(e Expr) (string, bool) {
+	for _, conjunct := range Conjuncts(e) {
+		if byID, ok := conjunct.(SagaIDExpr); ok && len(byID.IDs) == 1 {
+			return byID.IDs[0], true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnd(t *testing.T) {
+	nested := And(StatusIn("failed"), And(Name("orders.OrderSaga"), ParentID("1")))
+
+	assert.Equal(t, AndExpr{Exprs: []Expr{StatusIn("failed"), Name("orders.OrderSaga"), ParentID("1")}}, nested)
+	assert.Len(t, Conjuncts(nested), 3)
+	assert.Equal(t, []Expr{StatusIn("failed")}, Conjuncts(StatusIn("failed")))
+	assert.Nil(t, Conjuncts(nil))
+}
+
+func TestExpr_String(t *testing.T) {
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	e := And(
+		Or(StatusIn("failed", "compensating"), Not(SagaID("1", "2"))),
+		StartedFrom(from),
+		EntityRef("order", "12345"),
+	)
+
+	assert.Equal(t, "and(or(status in (failed, compensating), not(sagaId in (1, 2))), startedFrom 2021-03-01T00:00:00Z, entityRef = order:12345)", e.String())
+	assert.Equal(t, UpdatedBeforeKind, UpdatedBefore(from).Kind())
+}
+
+func TestCheck(t *testing.T) {
+	e := And(StatusIn("failed"), Or(Name("orders.OrderSaga"), Not(EntityRef("order", "1"))))
+
+	assert.NoError(t, Check(e, "test store", AllKinds...))
+	assert.NoError(t, Check(nil, "test store"))
+
+	err := Check(e, "test store", AndKind, OrKind, StatusKind, NameKind, NotKind)
+	require.Error(t, err)
+	assert.IsType(t, UnsupportedPredicateErr{}, err)
+	assert.EqualError(t, err, "filter predicate 'entityRef' isn't supported by test store")
+}
+
+func TestSingleSagaID(t *testing.T) {
+	id, ok := SingleSagaID(And(StatusIn("failed"), SagaID("123")))
+	assert.True(t, ok)
+	assert.Equal(t, "123", id)
+
+	_, ok = SingleSagaID(SagaID("1", "2"))
+	assert.False(t, ok)
+
+	// a saga id under Or doesn't restrict the filter to the saga
+	_, ok = SingleSagaID(Or(SagaID("1"), StatusIn("failed")))
+	assert.False(t, ok)
+
+	_, ok = SingleSagaID(nil)
+	assert.False(t, ok)
+}
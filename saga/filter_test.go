@@ -0,0 +1,86 @@
+package saga
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/filter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchFilter(t *testing.T) {
+	startedAt := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	updatedAt := startedAt.Add(time.Hour)
+
+	s := &sagaExample{}
+	s.SetGroupKind(&scheme.GroupKind{Group: "orders", Kind: "OrderSaga"})
+
+	instance := &sagaInstance{
+		uid:            "123",
+		parentID:       "parent",
+		saga:           s,
+		entityRefs:     []EntityRef{{Kind: "order", ID: "1"}},
+		startedAt:      &startedAt,
+		updatedAt:      &updatedAt,
+		instanceStatus: instanceStatus{status: sagaStatusFailed},
+	}
+	created := &sagaInstance{uid: "456", saga: s, instanceStatus: instanceStatus{status: sagaStatusCreated}}
+
+	cases := []struct {
+		name    string
+		filter  filter.Expr
+		matched bool
+	}{
+		{"nil filter", nil, true},
+		{"saga id", filter.SagaID("1", "123"), true},
+		{"other saga id", filter.SagaID("1"), false},
+		{"status", filter.StatusIn("failed", "compensating"), true},
+		{"other status", filter.StatusIn("completed"), false},
+		{"name", filter.Name("orders.OrderSaga"), true},
+		{"other name", filter.Name("orders.RefundSaga"), false},
+		{"parent", filter.ParentID("parent"), true},
+		{"other parent", filter.ParentID("other"), false},
+		{"started from includes the time", filter.StartedFrom(startedAt), true},
+		{"started before excludes the time", filter.StartedBefore(startedAt), false},
+		{"updated from", filter.UpdatedFrom(updatedAt.Add(time.Second)), false},
+		{"updated before", filter.UpdatedBefore(updatedAt.Add(time.Second)), true},
+		{"entity ref", filter.EntityRef("order", "1"), true},
+		{"other entity ref", filter.EntityRef("order", "2"), false},
+		{"and", filter.And(filter.StatusIn("failed"), filter.ParentID("parent")), true},
+		{"and with a mismatch", filter.And(filter.StatusIn("failed"), filter.ParentID("other")), false},
+		{"empty and", filter.And(), true},
+		{"or", filter.Or(filter.StatusIn("completed"), filter.ParentID("parent")), true},
+		{"empty or", filter.Or(), false},
+		{"not", filter.Not(filter.StatusIn("completed")), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.matched, MatchFilter(c.filter, instance))
+		})
+	}
+
+	t.Run("saga without times", func(t *testing.T) {
+		assert.False(t, MatchFilter(filter.StartedFrom(startedAt), created))
+		assert.False(t, MatchFilter(filter.UpdatedBefore(updatedAt), created))
+		assert.True(t, MatchFilter(filter.Not(filter.UpdatedBefore(updatedAt)), created))
+	})
+
+	t.Run("data contains", func(t *testing.T) {
+		withReceipt := &sagaInstance{uid: "789", saga: &stepsExample{Receipt: "INV-2021_03"}}
+
+		assert.True(t, MatchFilter(filter.DataContains("inv-2021"), withReceipt), "text is matched case insensitively")
+		assert.False(t, MatchFilter(filter.DataContains("INV-2022"), withReceipt))
+		assert.False(t, MatchFilter(filter.DataContains("INV"), &sagaInstance{uid: "000"}))
+	})
+
+	t.Run("data contains json document", func(t *testing.T) {
+		withReceipt := &sagaInstance{uid: "789", saga: &stepsExample{Receipt: "INV-2021_03"}}
+
+		assert.True(t, MatchFilter(filter.DataContains(`{"receipt": "INV-2021_03"}`), withReceipt))
+		assert.False(t, MatchFilter(filter.DataContains(`{"receipt": "inv-2021_03"}`), withReceipt), "documents are matched exactly")
+		assert.False(t, MatchFilter(filter.DataContains(`{"receipt": "INV-2021"}`), withReceipt))
+		assert.False(t, MatchFilter(filter.DataContains(`{"missing": "INV-2021_03"}`), withReceipt))
+	})
+}
@@ -0,0 +1,369 @@
+package saga
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+const (
+	// GraphNodeStatus is a status of a saga, e.g. in_progress or completed
+	GraphNodeStatus = "status"
+	// GraphNodeStep is a step of a saga declared by StepsDefinition
+	GraphNodeStep = "step"
+
+	// GraphEdgeCommand is a transition made by a saga command, e.g. StartSagaCommand
+	GraphEdgeCommand = "command"
+	// GraphEdgeEvent is an event handled by the saga, the label is group.kind of the event
+	GraphEdgeEvent = "event"
+	// GraphEdgeTimeout is a timeout handled by the saga, the label is its reason
+	GraphEdgeTimeout = "timeout"
+	// GraphEdgeFailure is an event failing the saga
+	GraphEdgeFailure = "failure"
+	// GraphEdgeCompensation is a compensation of a step, the label is the event it waits for if any
+	GraphEdgeCompensation = "compensation"
+	// GraphEdgeOutcome is a transition decided by handlers of the saga at runtime, e.g. completion of a saga declared by event handlers
+	GraphEdgeOutcome = "outcome"
+)
+
+// Graph is the event handler graph of a saga. A graph of an instance marks where the instance is: Current is the node it's at,
+// Visited nodes and Taken edges are the ones it has passed, Waiting are events it waits for.
+type Graph struct {
+	Saga    string      `json:"saga"`
+	Nodes   []GraphNode `json:"nodes"`
+	Edges   []GraphEdge `json:"edges"`
+	Current string      `json:"current,omitempty"`
+	Waiting []string    `json:"waiting,omitempty"`
+}
+
+type GraphNode struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Visited bool   `json:"visited,omitempty"`
+}
+
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Kind  string `json:"kind"`
+	Label string `json:"label,omitempty"`
+	Taken bool   `json:"taken,omitempty"`
+}
+
+// steppedSaga is implemented by sagas embedding StepSaga
+type steppedSaga interface {
+	stepsDefinition() *StepsDefinition
+	stepProgress() StepProgress
+	kindOf(ev message.Object) scheme.GroupKind
+}
+
+// DescribeSaga builds the graph of the saga. Its schema must be set and Init called, so its handlers are known.
+// A saga declared by StepsDefinition is described by its steps, any other one by its statuses with events and timeouts it handles.
+func DescribeSaga(s Saga) *Graph {
+	if stepped, ok := s.(steppedSaga); ok && stepped.stepsDefinition() != nil {
+		return describeSteps(s.GroupKind().String(), stepped)
+	}
+
+	g := &Graph{Saga: s.GroupKind().String()}
+
+	for _, st := range []status{sagaStatusCreated, sagaStatusInProgress, sagaStatusRecovering, sagaStatusCompensating, sagaStatusFailed, sagaStatusCompleted} {
+		g.addNode(string(st), GraphNodeStatus)
+	}
+
+	g.addEdge(string(sagaStatusCreated), string(sagaStatusInProgress), GraphEdgeCommand, "StartSagaCommand")
+
+	// handlers are the same in every active status, they are drawn once
+	var events []string
+	for gk := range s.EventHandlers() {
+		events = append(events, gk.String())
+	}
+
+	sort.Strings(events)
+
+	for _, ev := range events {
+		g.addEdge(string(sagaStatusInProgress), string(sagaStatusInProgress), GraphEdgeEvent, ev)
+	}
+
+	var reasons []string
+	for reason := range s.TimeoutHandlers() {
+		reasons = append(reasons, reason)
+	}
+
+	sort.Strings(reasons)
+
+	for _, reason := range reasons {
+		g.addEdge(string(sagaStatusInProgress), string(sagaStatusInProgress), GraphEdgeTimeout, reason)
+	}
+
+	g.addEdge(string(sagaStatusInProgress), string(sagaStatusCompleted), GraphEdgeOutcome, "")
+	g.addEdge(string(sagaStatusInProgress), string(sagaStatusFailed), GraphEdgeOutcome, "")
+	g.addEdge(string(sagaStatusFailed), string(sagaStatusRecovering), GraphEdgeCommand, "RecoverSagaCommand")
+	g.addEdge(string(sagaStatusRecovering), string(sagaStatusInProgress), GraphEdgeOutcome, "")
+	g.addEdge(string(sagaStatusFailed), string(sagaStatusCompensating), GraphEdgeCommand, "CompensateSagaCommand")
+	g.addEdge(string(sagaStatusInProgress), string(sagaStatusCompensating), GraphEdgeCommand, "CompensateSagaCommand")
+	g.addEdge(string(sagaStatusCompensating), string(sagaStatusCompleted), GraphEdgeOutcome, "")
+
+	return g
+}
+
+func describeSteps(name string, stepSaga steppedSaga) *Graph {
+	g := &Graph{Saga: name}
+	definition := stepSaga.stepsDefinition()
+
+	g.addNode(string(sagaStatusCreated), GraphNodeStatus)
+
+	for _, st := range definition.steps {
+		g.addNode(st.name, GraphNodeStep)
+	}
+
+	g.addNode(string(sagaStatusFailed), GraphNodeStatus)
+	g.addNode(string(sagaStatusCompleted), GraphNodeStatus)
+
+	if len(definition.steps) == 0 {
+		g.addEdge(string(sagaStatusCreated), string(sagaStatusCompleted), GraphEdgeCommand, "StartSagaCommand")
+		return g
+	}
+
+	g.addEdge(string(sagaStatusCreated), definition.steps[0].name, GraphEdgeCommand, "StartSagaCommand")
+
+	for i, st := range definition.steps {
+		next := string(sagaStatusCompleted)
+		if i+1 < len(definition.steps) {
+			next = definition.steps[i+1].name
+		}
+
+		finished := false
+
+		for _, r := range st.reactions {
+			if r.fails {
+				g.addEdge(st.name, string(sagaStatusFailed), GraphEdgeFailure, stepSaga.kindOf(r.ev).String())
+				continue
+			}
+
+			finished = true
+			g.addEdge(st.name, next, GraphEdgeEvent, stepSaga.kindOf(r.ev).String())
+		}
+
+		// a step without events is done right after its action
+		if !finished {
+			g.addEdge(st.name, next, GraphEdgeOutcome, "")
+		}
+
+		if st.compensation == nil {
+			continue
+		}
+
+		previous := string(sagaStatusCompleted)
+		if i > 0 {
+			previous = definition.steps[i-1].name
+		}
+
+		label := ""
+		if st.compensatedOn != nil {
+			label = stepSaga.kindOf(st.compensatedOn).String()
+		}
+
+		g.addEdge(st.name, previous, GraphEdgeCompensation, label)
+	}
+
+	return g
+}
+
+// DescribeInstance builds the graph of the saga of the instance, see DescribeSaga, and marks the position of the instance in it
+func DescribeInstance(instance Instance) *Graph {
+	s := instance.Saga()
+	g := DescribeSaga(s)
+
+	handled := make(map[string]bool)
+	visited := map[string]bool{string(sagaStatusCreated): true}
+
+	for _, ev := range instance.HistoryEvents() {
+		if ev.Payload != nil {
+			handled[ev.Payload.GroupKind().String()] = true
+		}
+
+		visited[ev.SagaStatus] = true
+	}
+
+	g.Current = instance.Status().String()
+
+	if stepped, ok := s.(steppedSaga); ok && stepped.stepsDefinition() != nil {
+		progress := stepped.stepProgress()
+		// statuses aren't nodes of steps, except the created, failed and completed ones
+		visited = map[string]bool{string(sagaStatusCreated): true}
+
+		for _, name := range append(progress.Done, progress.Compensated...) {
+			visited[name] = true
+		}
+
+		switch {
+		case instance.Status().Completed(), instance.Status().Failed():
+			// the instance is at its status, the step it stopped at was visited
+			visited[progress.Current] = progress.Current != ""
+		case progress.Compensating != "":
+			g.Current = progress.Compensating
+			g.Waiting = stepWaiting(stepped, progress)
+		case progress.Current != "":
+			g.Current = progress.Current
+			g.Waiting = stepWaiting(stepped, progress)
+		}
+	}
+
+	for gk := range s.Expectations() {
+		g.Waiting = append(g.Waiting, gk)
+	}
+
+	sort.Strings(g.Waiting)
+
+	for i := range g.Nodes {
+		g.Nodes[i].Visited = visited[g.Nodes[i].ID]
+	}
+
+	for i := range g.Edges {
+		g.Edges[i].Taken = handled[g.Edges[i].Label]
+	}
+
+	return g
+}
+
+// stepWaiting returns events the current step waits for, or the event the compensation waits for
+func stepWaiting(stepSaga steppedSaga, progress StepProgress) []string {
+	definition := stepSaga.stepsDefinition()
+
+	if progress.Compensating != "" {
+		if step := definition.step(progress.Compensating); step != nil && step.compensatedOn != nil {
+			return []string{stepSaga.kindOf(step.compensatedOn).String()}
+		}
+
+		return nil
+	}
+
+	step := definition.step(progress.Current)
+	if step == nil {
+		return nil
+	}
+
+	waiting := make([]string, 0, len(step.reactions))
+	for _, r := range step.reactions {
+		waiting = append(waiting, stepSaga.kindOf(r.ev).String())
+	}
+
+	return waiting
+}
+
+func (g *Graph) addNode(id, kind string) {
+	g.Nodes = append(g.Nodes, GraphNode{ID: id, Kind: kind})
+}
+
+func (g *Graph) addEdge(from, to, kind, label string) {
+	g.Edges = append(g.Edges, GraphEdge{From: from, To: to, Kind: kind, Label: label})
+}
+
+// DOT renders the graph in graphviz format, the current node is filled with gold and visited nodes with grey
+func (g *Graph) DOT() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "digraph %q {\n\trankdir=LR;\n", g.Saga)
+
+	for _, n := range g.Nodes {
+		attrs := []string{"shape=ellipse"}
+		if n.Kind == GraphNodeStep {
+			attrs[0] = "shape=box"
+		}
+
+		switch {
+		case n.ID == g.Current:
+			attrs = append(attrs, "style=filled", `fillcolor="gold"`)
+		case n.Visited:
+			attrs = append(attrs, "style=filled", `fillcolor="lightgrey"`)
+		}
+
+		fmt.Fprintf(&b, "\t%q [%s];\n", n.ID, strings.Join(attrs, ", "))
+	}
+
+	for _, e := range g.Edges {
+		attrs := []string{fmt.Sprintf("label=%q", e.Label)}
+
+		switch e.Kind {
+		case GraphEdgeFailure:
+			attrs = append(attrs, `color="red"`)
+		case GraphEdgeCompensation:
+			attrs = append(attrs, "style=dashed")
+		case GraphEdgeTimeout:
+			attrs = append(attrs, "style=dotted")
+		case GraphEdgeOutcome:
+			attrs = append(attrs, "style=dashed", `color="grey"`)
+		}
+
+		if e.Taken {
+			attrs = append(attrs, "penwidth=2")
+		}
+
+		fmt.Fprintf(&b, "\t%q -> %q [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// Mermaid renders the graph as a mermaid flowchart, the current node has class current and visited nodes have class visited
+func (g *Graph) Mermaid() string {
+	var b strings.Builder
+
+	b.WriteString("flowchart LR\n")
+
+	ids := make(map[string]string, len(g.Nodes))
+
+	for i, n := range g.Nodes {
+		ids[n.ID] = fmt.Sprintf("n%d", i)
+
+		shape := "([%s])"
+		if n.Kind == GraphNodeStep {
+			shape = "[%s]"
+		}
+
+		fmt.Fprintf(&b, "\t%s"+shape+"\n", ids[n.ID], mermaidText(n.ID))
+	}
+
+	for _, e := range g.Edges {
+		arrow := "-->"
+
+		switch e.Kind {
+		case GraphEdgeCompensation, GraphEdgeTimeout, GraphEdgeOutcome:
+			arrow = "-.->"
+		}
+
+		if e.Taken {
+			arrow = "==>"
+		}
+
+		if e.Label == "" {
+			fmt.Fprintf(&b, "\t%s %s %s\n", ids[e.From], arrow, ids[e.To])
+			continue
+		}
+
+		fmt.Fprintf(&b, "\t%s %s|%s| %s\n", ids[e.From], arrow, mermaidText(e.Label), ids[e.To])
+	}
+
+	b.WriteString("\tclassDef current fill:#ffd54f\n\tclassDef visited fill:#e0e0e0\n")
+
+	for _, n := range g.Nodes {
+		switch {
+		case n.ID == g.Current:
+			fmt.Fprintf(&b, "\tclass %s current\n", ids[n.ID])
+		case n.Visited:
+			fmt.Fprintf(&b, "\tclass %s visited\n", ids[n.ID])
+		}
+	}
+
+	return b.String()
+}
+
+// mermaidText quotes a label, so dots and brackets of group.kind don't break the syntax
+func mermaidText(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, "#quot;") + `"`
+}
@@ -0,0 +1,111 @@
+package saga
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeSaga(t *testing.T) {
+	schema := scheme.NewKnownTypesRegistry()
+	schema.AddKnownTypes("example", &sagaExample{}, &stepsExample{}, &DataContract{}, &stockReserved{}, &paymentCharged{}, &paymentFailed{}, &paymentRefunded{})
+
+	t.Run("saga is described by its statuses", func(t *testing.T) {
+		exp := &sagaExample{}
+		exp.SetGroupKind(&scheme.GroupKind{Group: "example", Kind: "sagaExample"})
+		exp.SetSchema(schema)
+		exp.Init()
+		exp.AddTimeoutHandler("reply", func(sagaCtx SagaContext) error {
+			return nil
+		})
+
+		g := DescribeSaga(exp)
+		assert.Equal(t, "example.sagaExample", g.Saga)
+		require.Len(t, g.Nodes, 6)
+		assert.Equal(t, GraphNode{ID: "created", Kind: GraphNodeStatus}, g.Nodes[0])
+		assert.Contains(t, g.Edges, GraphEdge{From: "created", To: "in_progress", Kind: GraphEdgeCommand, Label: "StartSagaCommand"})
+		assert.Contains(t, g.Edges, GraphEdge{From: "in_progress", To: "in_progress", Kind: GraphEdgeEvent, Label: "example.DataContract"})
+		assert.Contains(t, g.Edges, GraphEdge{From: "in_progress", To: "in_progress", Kind: GraphEdgeTimeout, Label: "reply"})
+		assert.Contains(t, g.Edges, GraphEdge{From: "failed", To: "compensating", Kind: GraphEdgeCommand, Label: "CompensateSagaCommand"})
+	})
+
+	t.Run("step saga is described by its steps", func(t *testing.T) {
+		exp := &stepsExample{}
+		exp.SetSchema(schema)
+		exp.Init()
+
+		g := DescribeSaga(exp)
+		assert.Equal(t, []GraphNode{
+			{ID: "created", Kind: GraphNodeStatus},
+			{ID: "reserve", Kind: GraphNodeStep},
+			{ID: "charge", Kind: GraphNodeStep},
+			{ID: "notify", Kind: GraphNodeStep},
+			{ID: "failed", Kind: GraphNodeStatus},
+			{ID: "completed", Kind: GraphNodeStatus},
+		}, g.Nodes)
+		assert.Equal(t, []GraphEdge{
+			{From: "created", To: "reserve", Kind: GraphEdgeCommand, Label: "StartSagaCommand"},
+			{From: "reserve", To: "charge", Kind: GraphEdgeEvent, Label: "example.stockReserved"},
+			{From: "reserve", To: "completed", Kind: GraphEdgeCompensation},
+			{From: "charge", To: "notify", Kind: GraphEdgeEvent, Label: "example.paymentCharged"},
+			{From: "charge", To: "failed", Kind: GraphEdgeFailure, Label: "example.paymentFailed"},
+			{From: "charge", To: "reserve", Kind: GraphEdgeCompensation, Label: "example.paymentRefunded"},
+			{From: "notify", To: "completed", Kind: GraphEdgeOutcome},
+		}, g.Edges)
+	})
+}
+
+func TestDescribeInstance(t *testing.T) {
+	schema := scheme.NewKnownTypesRegistry()
+	schema.AddKnownTypes("example", &sagaExample{}, &stepsExample{}, &DataContract{}, &stockReserved{}, &paymentCharged{}, &paymentFailed{}, &paymentRefunded{})
+
+	t.Run("handled events are taken edges", func(t *testing.T) {
+		exp := &sagaExample{}
+		exp.SetSchema(schema)
+		exp.Init()
+
+		ev := &DataContract{}
+		ev.SetGroupKind(&scheme.GroupKind{Group: "example", Kind: "DataContract"})
+
+		sagaInstance := NewSagaInstance("123", "", exp)
+		sagaInstance.AddHistoryEvent(ev, nil)
+		sagaInstance.Fail(ev)
+
+		g := DescribeInstance(sagaInstance)
+		assert.Equal(t, "failed", g.Current)
+		assert.Contains(t, g.Nodes, GraphNode{ID: "created", Kind: GraphNodeStatus, Visited: true})
+		assert.Contains(t, g.Edges, GraphEdge{From: "in_progress", To: "in_progress", Kind: GraphEdgeEvent, Label: "example.DataContract", Taken: true})
+	})
+
+	t.Run("step saga is at its current step", func(t *testing.T) {
+		exp := &stepsExample{StepSaga: StepSaga{Progress: StepProgress{Current: "charge", Done: []string{"reserve"}}}}
+		exp.SetSchema(schema)
+		exp.Init()
+
+		g := DescribeInstance(NewSagaInstance("123", "", exp))
+		assert.Equal(t, "charge", g.Current)
+		assert.Equal(t, []string{"example.paymentCharged", "example.paymentFailed"}, g.Waiting)
+		assert.Contains(t, g.Nodes, GraphNode{ID: "reserve", Kind: GraphNodeStep, Visited: true})
+		assert.Contains(t, g.Nodes, GraphNode{ID: "notify", Kind: GraphNodeStep})
+
+		assert.Contains(t, g.DOT(), "\t\"charge\" [shape=box, style=filled, fillcolor=\"gold\"];\n")
+		assert.Contains(t, g.DOT(), "\t\"reserve\" [shape=box, style=filled, fillcolor=\"lightgrey\"];\n")
+		assert.Contains(t, g.DOT(), "\t\"charge\" -> \"failed\" [label=\"example.paymentFailed\", color=\"red\"];\n")
+
+		assert.Contains(t, g.Mermaid(), "\tn2[\"charge\"]\n")
+		assert.Contains(t, g.Mermaid(), "\tn1 -->|\"example.stockReserved\"| n2\n")
+		assert.Contains(t, g.Mermaid(), "\tclass n1 visited\n\tclass n2 current\n")
+	})
+
+	t.Run("compensating step saga waits for the compensation", func(t *testing.T) {
+		exp := &stepsExample{StepSaga: StepSaga{Progress: StepProgress{Compensating: "charge", Done: []string{"reserve", "charge"}}}}
+		exp.SetSchema(schema)
+		exp.Init()
+
+		g := DescribeInstance(NewSagaInstance("123", "", exp))
+		assert.Equal(t, "charge", g.Current)
+		assert.Equal(t, []string{"example.paymentRefunded"}, g.Waiting)
+	})
+}
@@ -0,0 +1,230 @@
+package saga
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+const defaultTopInstances = 10
+
+var (
+	payloadSizeBuckets   = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	historyLengthBuckets = []float64{10, 50, 100, 500, 1000, 5000, 10000}
+)
+
+// GrowthLimitErr is returned by GrowthMonitor when a saga exceeds a hard limit of payload size or history length
+type GrowthLimitErr struct {
+	error
+}
+
+func WithGrowthLimitErr(err error) error {
+	return GrowthLimitErr{err}
+}
+
+// GrowthObserver receives every measurement, implement it to export histograms into your metrics system
+type GrowthObserver interface {
+	ObservePayloadSize(sagaName string, bytes int)
+	ObserveHistoryLength(sagaName string, length int)
+}
+
+// Histogram counts observed values in buckets. Counts has one more element than Buckets for values above the last bound.
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) observe(v float64) {
+	idx := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[idx]++
+	h.Count++
+	h.Sum += v
+}
+
+func (h Histogram) copy() Histogram {
+	counts := make([]uint64, len(h.Counts))
+	copy(counts, h.Counts)
+	h.Counts = counts
+	return h
+}
+
+// InstanceSize is the last measurement of a saga instance
+type InstanceSize struct {
+	SagaUID       string `json:"saga_uid"`
+	PayloadSize   int    `json:"payload_size"`
+	HistoryLength int    `json:"history_length"`
+}
+
+// GrowthStats are collected per saga name
+type GrowthStats struct {
+	PayloadSize   Histogram `json:"payload_size"`
+	HistoryLength Histogram `json:"history_length"`
+	// Largest contains the biggest not completed instances observed by this process, sorted by payload size
+	Largest []InstanceSize `json:"largest"`
+}
+
+type growthStats struct {
+	payloadSize   *Histogram
+	historyLength *Histogram
+	largest       []InstanceSize
+}
+
+type limits struct {
+	warn int
+	max  int
+}
+
+// GrowthMonitorOpt configures GrowthMonitor
+type GrowthMonitorOpt func(m *GrowthMonitor)
+
+// WithPayloadSizeLimits sets thresholds in bytes for marshalled saga payload. Zero disables a threshold.
+func WithPayloadSizeLimits(warn, max int) GrowthMonitorOpt {
+	return func(m *GrowthMonitor) {
+		m.payloadSize = limits{warn: warn, max: max}
+	}
+}
+
+// WithHistoryLengthLimits sets thresholds for a number of history events. Zero disables a threshold.
+func WithHistoryLengthLimits(warn, max int) GrowthMonitorOpt {
+	return func(m *GrowthMonitor) {
+		m.historyLength = limits{warn: warn, max: max}
+	}
+}
+
+// WithGrowthObserver passes every measurement to the observer
+func WithGrowthObserver(observer GrowthObserver) GrowthMonitorOpt {
+	return func(m *GrowthMonitor) {
+		m.observer = observer
+	}
+}
+
+// WithTopInstances sets how many of the largest instances are kept per saga name, 10 by default
+func WithTopInstances(n int) GrowthMonitorOpt {
+	return func(m *GrowthMonitor) {
+		m.topN = n
+	}
+}
+
+// GrowthMonitor measures marshalled payload size and history length of sagas before they are updated in the store
+type GrowthMonitor struct {
+	marshaller    message.Marshaller
+	payloadSize   limits
+	historyLength limits
+	observer      GrowthObserver
+	topN          int
+
+	mutex sync.Mutex
+	stats map[string]*growthStats
+}
+
+// NewGrowthMonitor creates GrowthMonitor, without limits it only collects stats
+func NewGrowthMonitor(marshaller message.Marshaller, opts ...GrowthMonitorOpt) *GrowthMonitor {
+	m := &GrowthMonitor{marshaller: marshaller, topN: defaultTopInstances, stats: make(map[string]*growthStats)}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Check records the size of the saga instance, logs a warning above warn thresholds and returns GrowthLimitErr above hard limits
+func (m *GrowthMonitor) Check(instance Instance, logger log.Logger) error {
+	payload, err := m.marshaller.Marshal(instance.Saga())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling saga '%s' to measure its size", instance.UID())
+	}
+
+	sagaName := instance.Saga().GroupKind().String()
+	size := InstanceSize{SagaUID: instance.UID(), PayloadSize: len(payload), HistoryLength: len(instance.HistoryEvents())}
+
+	m.record(sagaName, size, instance.Status().Completed())
+
+	if m.observer != nil {
+		m.observer.ObservePayloadSize(sagaName, size.PayloadSize)
+		m.observer.ObserveHistoryLength(sagaName, size.HistoryLength)
+	}
+
+	if m.payloadSize.max > 0 && size.PayloadSize > m.payloadSize.max {
+		return WithGrowthLimitErr(errors.Errorf("payload of saga '%s' (%s) is %d bytes, limit is %d", instance.UID(), sagaName, size.PayloadSize, m.payloadSize.max))
+	}
+
+	if m.historyLength.max > 0 && size.HistoryLength > m.historyLength.max {
+		return WithGrowthLimitErr(errors.Errorf("history of saga '%s' (%s) has %d events, limit is %d", instance.UID(), sagaName, size.HistoryLength, m.historyLength.max))
+	}
+
+	if m.payloadSize.warn > 0 && size.PayloadSize > m.payloadSize.warn {
+		logger.Logf(log.WarnLevel, "payload of saga '%s' (%s) is %d bytes, warning threshold is %d", instance.UID(), sagaName, size.PayloadSize, m.payloadSize.warn)
+	}
+
+	if m.historyLength.warn > 0 && size.HistoryLength > m.historyLength.warn {
+		logger.Logf(log.WarnLevel, "history of saga '%s' (%s) has %d events, warning threshold is %d", instance.UID(), sagaName, size.HistoryLength, m.historyLength.warn)
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of collected stats per saga name
+func (m *GrowthMonitor) Stats() map[string]GrowthStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	res := make(map[string]GrowthStats, len(m.stats))
+
+	for sagaName, s := range m.stats {
+		largest := make([]InstanceSize, len(s.largest))
+		copy(largest, s.largest)
+
+		res[sagaName] = GrowthStats{
+			PayloadSize:   s.payloadSize.copy(),
+			HistoryLength: s.historyLength.copy(),
+			Largest:       largest,
+		}
+	}
+
+	return res
+}
+
+func (m *GrowthMonitor) record(sagaName string, size InstanceSize, completed bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.stats[sagaName]
+	if !exists {
+		s = &growthStats{payloadSize: newHistogram(payloadSizeBuckets), historyLength: newHistogram(historyLengthBuckets)}
+		m.stats[sagaName] = s
+	}
+
+	s.payloadSize.observe(float64(size.PayloadSize))
+	s.historyLength.observe(float64(size.HistoryLength))
+
+	// the previous measurement of the instance is replaced, completed instances are dropped
+	for i, l := range s.largest {
+		if l.SagaUID == size.SagaUID {
+			s.largest = append(s.largest[:i], s.largest[i+1:]...)
+			break
+		}
+	}
+
+	if completed || m.topN <= 0 {
+		return
+	}
+
+	s.largest = append(s.largest, size)
+	sort.SliceStable(s.largest, func(i, j int) bool {
+		return s.largest[i].PayloadSize > s.largest[j].PayloadSize
+	})
+
+	if len(s.largest) > m.topN {
+		s.largest = s.largest[:m.topN]
+	}
+}
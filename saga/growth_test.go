@@ -0,0 +1,109 @@
+package saga
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrowthMonitor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+	sagaMeta := message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "sagaExample", Group: "example"}}
+
+	newInstance := func(uid string, historyLen int) (Instance, *sagaExample) {
+		s := &sagaExample{BaseSaga: BaseSaga{ObjectMeta: sagaMeta}}
+		instance := NewSagaInstance(uid, "", s)
+		for i := 0; i < historyLen; i++ {
+			instance.AddHistoryEvent(&DataContract{}, nil)
+		}
+		return instance, s
+	}
+
+	t.Run("collects stats and keeps top largest instances", func(t *testing.T) {
+		observer := &growthObserverStub{}
+		monitor := NewGrowthMonitor(marshallerMock, WithTopInstances(2), WithGrowthObserver(observer))
+
+		for uid, size := range map[string]int{"a": 100, "b": 5000, "c": 300} {
+			instance, s := newInstance(uid, 1)
+			marshallerMock.EXPECT().Marshal(s).Return(make([]byte, size), nil)
+			require.NoError(t, monitor.Check(instance, testLogger))
+		}
+
+		stats := monitor.Stats()["example.sagaExample"]
+		assert.Equal(t, uint64(3), stats.PayloadSize.Count)
+		assert.Equal(t, float64(5400), stats.PayloadSize.Sum)
+		assert.Equal(t, []uint64{2, 0, 1, 0, 0, 0, 0, 0, 0}, stats.PayloadSize.Counts)
+		assert.Equal(t, uint64(3), stats.HistoryLength.Count)
+		assert.Equal(t, []InstanceSize{{SagaUID: "b", PayloadSize: 5000, HistoryLength: 1}, {SagaUID: "c", PayloadSize: 300, HistoryLength: 1}}, stats.Largest)
+		assert.Equal(t, 3, observer.payloads)
+		assert.Equal(t, 3, observer.histories)
+
+		completed, s := newInstance("b", 2)
+		completed.Complete()
+		marshallerMock.EXPECT().Marshal(s).Return(make([]byte, 6000), nil)
+		require.NoError(t, monitor.Check(completed, testLogger))
+
+		stats = monitor.Stats()["example.sagaExample"]
+		assert.Equal(t, []InstanceSize{{SagaUID: "c", PayloadSize: 300, HistoryLength: 1}}, stats.Largest, "completed instance is dropped")
+	})
+
+	t.Run("thresholds", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		monitor := NewGrowthMonitor(marshallerMock, WithPayloadSizeLimits(10, 20), WithHistoryLengthLimits(2, 3))
+
+		instance, s := newInstance("123", 3)
+		marshallerMock.EXPECT().Marshal(s).Return(make([]byte, 11), nil)
+		require.NoError(t, monitor.Check(instance, testLogger))
+		testLogger.AssertContainsSubstr(t, "payload of saga '123' (example.sagaExample) is 11 bytes, warning threshold is 10")
+		testLogger.AssertContainsSubstr(t, "history of saga '123' (example.sagaExample) has 3 events, warning threshold is 2")
+
+		instance, s = newInstance("123", 3)
+		marshallerMock.EXPECT().Marshal(s).Return(make([]byte, 21), nil)
+		err := monitor.Check(instance, testLogger)
+		require.Error(t, err)
+		assert.IsType(t, GrowthLimitErr{}, err)
+		assert.EqualError(t, err, "payload of saga '123' (example.sagaExample) is 21 bytes, limit is 20")
+
+		instance, s = newInstance("123", 4)
+		marshallerMock.EXPECT().Marshal(s).Return(make([]byte, 1), nil)
+		err = monitor.Check(instance, testLogger)
+		require.Error(t, err)
+		assert.IsType(t, GrowthLimitErr{}, err)
+		assert.EqualError(t, err, "history of saga '123' (example.sagaExample) has 4 events, limit is 3")
+	})
+
+	t.Run("marshalling error", func(t *testing.T) {
+		monitor := NewGrowthMonitor(marshallerMock)
+
+		instance, s := newInstance("123", 0)
+		marshallerMock.EXPECT().Marshal(s).Return(nil, errors.New("marshal error"))
+		err := monitor.Check(instance, testLogger)
+		assert.EqualError(t, err, "marshaling saga '123' to measure its size: marshal error")
+		assert.Empty(t, monitor.Stats())
+	})
+}
+
+type growthObserverStub struct {
+	payloads  int
+	histories int
+}
+
+func (g *growthObserverStub) ObservePayloadSize(sagaName string, bytes int) {
+	g.payloads++
+}
+
+func (g *growthObserverStub) ObserveHistoryLength(sagaName string, length int) {
+	g.histories++
+}
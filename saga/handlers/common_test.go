@@ -14,6 +14,7 @@ type SagaExample struct {
 
 func (s *SagaExample) Init() {
 	s.AddEventHandler(&DataContract{}, s.HandleData)
+	s.AddTimeoutHandler("reply", s.HandleTimeout)
 }
 
 func (s *SagaExample) Start(sagaCtx sagaPkg.SagaContext) error {
@@ -46,7 +47,18 @@ func (s *SagaExample) HandleData(sagaCtx sagaPkg.SagaContext) error {
 	return s.err
 }
 
+func (s *SagaExample) HandleTimeout(sagaCtx sagaPkg.SagaContext) error {
+	sagaCtx.Dispatch(&DataContract{Message: "timeout"})
+	return s.err
+}
+
 type DataContract struct {
 	message.ObjectMeta
 	Message string
 }
+
+// SagaExampleV2 is the next version of SagaExample
+type SagaExampleV2 struct {
+	SagaExample
+	Priority int
+}
@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 
 	log "github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/tracing"
 	"github.com/go-foreman/foreman/runtime/scheme"
 	sagaPkg "github.com/go-foreman/foreman/saga"
 	"github.com/go-foreman/foreman/saga/contracts"
@@ -13,8 +17,65 @@ import (
 	"github.com/pkg/errors"
 )
 
-func NewSagaControlHandler(sagaStore sagaPkg.Store, mutex mutex.Mutex, sagaRegistry scheme.KnownTypesRegistry, sagaUIDSvc sagaPkg.SagaUIDService) *SagaControlHandler {
-	return &SagaControlHandler{typesRegistry: sagaRegistry, store: sagaStore, mutex: mutex, sagaUIDSvc: sagaUIDSvc}
+// ControlHandlerOpt configures SagaControlHandler
+type ControlHandlerOpt func(h *SagaControlHandler)
+
+// WithControlVersions selects a version of a saga on start and refuses to handle instances of versions which are no longer registered
+func WithControlVersions(versions *sagaPkg.VersionRegistry) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.versions = versions
+	}
+}
+
+// WithControlMetrics records processed start, recover and compensate commands into prometheus metrics
+func WithControlMetrics(metrics *sagaPkg.Metrics) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.metrics = metrics
+	}
+}
+
+// WithControlOutbox writes deliveries into the outbox in the transaction of the saga update instead of sending them,
+// see WithOutbox. The store must be saga.TransactionalStore.
+func WithControlOutbox(outbox sagaPkg.Outbox) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.outbox = outbox
+	}
+}
+
+// WithControlScheduler keeps events scheduled by sagas in the scheduler, see WithScheduler. The store must be saga.TransactionalStore.
+func WithControlScheduler(scheduler sagaPkg.Scheduler) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.scheduler = scheduler
+	}
+}
+
+// WithControlTracePropagation carries trace context and correlation id of a received command over to messages sent by the saga,
+// see WithTracePropagation
+func WithControlTracePropagation(carrier sagaPkg.TraceCarrier) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.propagation = newTracePropagation(carrier)
+	}
+}
+
+// WithControlOptimisticLocking handles commands without the mutex, see WithOptimisticLocking. A saga is saved only if it wasn't
+// saved by someone else since it was loaded. On a conflict the command is handled again with the reloaded saga up to maxRetries times,
+// then the error is returned and the message is redelivered. The outbox is required, see WithControlOutbox: deliveries are written
+// in the transaction of the update, sent afterwards they would be lost if sending fails, the redelivered command finds the saga handled.
+func WithControlOptimisticLocking(maxRetries int) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.optimisticLocking = true
+		h.maxConflictRetries = maxRetries
+	}
+}
+
+func NewSagaControlHandler(sagaStore sagaPkg.Store, mutex mutex.Mutex, sagaRegistry scheme.KnownTypesRegistry, sagaUIDSvc sagaPkg.SagaUIDService, opts ...ControlHandlerOpt) *SagaControlHandler {
+	h := &SagaControlHandler{typesRegistry: sagaRegistry, store: sagaStore, mutex: mutex, sagaUIDSvc: sagaUIDSvc}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
 type SagaControlHandler struct {
@@ -22,19 +83,61 @@ type SagaControlHandler struct {
 	store         sagaPkg.Store
 	mutex         mutex.Mutex
 	sagaUIDSvc    sagaPkg.SagaUIDService
+	versions      *sagaPkg.VersionRegistry
+	metrics       *sagaPkg.Metrics
+	drain         *Drain
+	outbox        sagaPkg.Outbox
+	scheduler     sagaPkg.Scheduler
+	propagation   *tracePropagation
+	// optimisticLocking is set by WithControlOptimisticLocking, the mutex isn't used then
+	optimisticLocking  bool
+	maxConflictRetries int
 }
 
 func (h SagaControlHandler) Handle(execCtx execution.MessageExecutionCtx) error {
+	if h.optimisticLocking && h.outbox == nil {
+		return errors.New("optimistic locking requires the outbox, see WithControlOutbox")
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := h.handle(execCtx)
+
+		if _, conflict := errors.Cause(err).(sagaPkg.VersionConflictErr); conflict && h.optimisticLocking && attempt < h.maxConflictRetries {
+			execCtx.Logger().Logf(log.DebugLevel, "saga was updated concurrently, handling command '%s' again. %s", execCtx.Message().UID(), err)
+			continue
+		}
+
+		return err
+	}
+}
+
+func (h SagaControlHandler) handle(execCtx execution.MessageExecutionCtx) (handleErr error) {
 	var (
 		sagaInstance sagaPkg.Instance
 		sagaCtx      sagaPkg.SagaContext
 		err          error
+		// parentEv tells the parent about the outcome of compensation cascaded from it
+		parentEv message.Object
 	)
 
+	execCtx, done, err := h.drain.enter(execCtx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	execCtx = h.propagation.begin(execCtx)
+
 	ctx := execCtx.Context()
 	msg := execCtx.Message()
 	logger := execCtx.Logger()
 
+	handling := h.metrics.HandleCommand(msg.Payload())
+	defer func() {
+		handling.Done(handleErr)
+	}()
+
 	switch cmd := msg.Payload().(type) {
 	case *contracts.StartSagaCommand:
 		logger.Logf(log.DebugLevel, "creating saga '%s'", cmd.SagaUID)
@@ -44,11 +147,16 @@ func (h SagaControlHandler) Handle(execCtx execution.MessageExecutionCtx) error
 			return errors.WithStack(err)
 		}
 
-		lock, err := h.mutex.Lock(ctx, cmd.SagaUID)
+		handling.SetInstance(sagaInstance)
+		tracing.TagSaga(ctx, sagaInstance.UID(), sagaInstance.Saga().GroupKind().String())
+
+		lock, err := h.lock(ctx, cmd.SagaUID)
 		if err != nil {
 			return errors.Wrap(err, "locking saga")
 		}
 
+		ctx = withFencingToken(ctx, lock)
+
 		defer func() {
 			if err := lock.Release(ctx); err != nil {
 				logger.Log(log.ErrorLevel, err.Error())
@@ -61,18 +169,20 @@ func (h SagaControlHandler) Handle(execCtx execution.MessageExecutionCtx) error
 
 		logger.Logf(log.DebugLevel, "saga '%s' created in store", cmd.SagaUID)
 
-		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance)
+		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance, h.scheduling().sagaCtxOpts()...)
 
 		if err := sagaInstance.Start(sagaCtx); err != nil {
 			return errors.Wrapf(err, "starting saga '%s'", sagaInstance.UID())
 		}
 
 	case *contracts.RecoverSagaCommand:
-		lock, err := h.mutex.Lock(ctx, cmd.SagaUID)
+		lock, err := h.lock(ctx, cmd.SagaUID)
 		if err != nil {
 			return errors.Wrapf(err, "locking saga '%s'", cmd.SagaUID)
 		}
 
+		ctx = withFencingToken(ctx, lock)
+
 		defer func() {
 			if err := lock.Release(ctx); err != nil {
 				logger.Log(log.ErrorLevel, err.Error())
@@ -85,23 +195,28 @@ func (h SagaControlHandler) Handle(execCtx execution.MessageExecutionCtx) error
 			return errors.WithStack(err)
 		}
 
+		handling.SetInstance(sagaInstance)
+		tracing.TagSaga(ctx, sagaInstance.UID(), sagaInstance.Saga().GroupKind().String())
+
 		if !sagaInstance.Status().Failed() || sagaInstance.Status().Completed() || sagaInstance.Status().Recovering() || sagaInstance.Status().Compensating() {
 			logger.Logf(log.InfoLevel, "Saga '%s' has status '%s', you can't start recovering the process", sagaInstance.UID(), sagaInstance.Status())
 			return nil
 		}
 
-		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance)
+		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance, h.scheduling().sagaCtxOpts()...)
 
 		if err := sagaInstance.Recover(sagaCtx); err != nil {
 			return errors.Wrapf(err, "recovering saga '%s'", sagaInstance.UID())
 		}
 
 	case *contracts.CompensateSagaCommand:
-		lock, err := h.mutex.Lock(ctx, cmd.SagaUID)
+		lock, err := h.lock(ctx, cmd.SagaUID)
 		if err != nil {
 			return errors.Wrapf(err, "locking saga '%s'", cmd.SagaUID)
 		}
 
+		ctx = withFencingToken(ctx, lock)
+
 		defer func() {
 			if err := lock.Release(ctx); err != nil {
 				logger.Log(log.ErrorLevel, err.Error())
@@ -114,35 +229,294 @@ func (h SagaControlHandler) Handle(execCtx execution.MessageExecutionCtx) error
 			return errors.WithStack(err)
 		}
 
-		if !sagaInstance.Status().Failed() || sagaInstance.Status().Compensating() {
+		handling.SetInstance(sagaInstance)
+		tracing.TagSaga(ctx, sagaInstance.UID(), sagaInstance.Saga().GroupKind().String())
+
+		if !compensatable(sagaInstance.Status(), cmd) {
 			logger.Logf(log.InfoLevel, "Saga '%s' has status '%s', you can't compensate the process", sagaInstance.UID(), sagaInstance.Status())
 			return nil
 		}
 
-		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance)
+		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance, h.scheduling().sagaCtxOpts()...)
+
+		var children []string
+
+		if cmd.Cascades() {
+			children, err = h.childrenToCompensate(ctx, sagaInstance.UID())
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(children) > 0 {
+			logger.Logf(log.InfoLevel, "Saga '%s' waits for compensation of %d children before its own", sagaInstance.UID(), len(children))
+			sagaInstance.CompensateChildren(children)
 
-		if err := sagaInstance.Compensate(sagaCtx); err != nil {
+			for _, childUID := range children {
+				sagaCtx.Dispatch(&contracts.CompensateSagaCommand{SagaUID: childUID, ParentUID: sagaInstance.UID()})
+			}
+		} else if err := sagaInstance.Compensate(sagaCtx); err != nil {
 			return errors.Wrapf(err, "compensating saga '%s'", sagaInstance.UID())
 		}
 
+		if cmd.ParentUID != "" {
+			parentEv = compensationOutcome(sagaInstance)
+		}
+
+	case *contracts.TimeoutSagaCommand:
+		lock, err := h.lock(ctx, cmd.SagaUID)
+		if err != nil {
+			return errors.Wrapf(err, "locking saga '%s'", cmd.SagaUID)
+		}
+
+		ctx = withFencingToken(ctx, lock)
+
+		defer func() {
+			if err := lock.Release(ctx); err != nil {
+				logger.Log(log.ErrorLevel, err.Error())
+			}
+		}()
+
+		sagaInstance, err = h.fetchSaga(ctx, cmd.SagaUID)
+
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		handling.SetInstance(sagaInstance)
+		tracing.TagSaga(ctx, sagaInstance.UID(), sagaInstance.Saga().GroupKind().String())
+
+		if sagaInstance.Status().Completed() {
+			logger.Logf(log.InfoLevel, "Saga '%s' has already completed, timeout '%s' is ignored", sagaInstance.UID(), cmd.Reason)
+			return nil
+		}
+
+		saga := sagaInstance.Saga()
+		saga.SetSchema(h.typesRegistry)
+		saga.Init()
+
+		if !saga.TimeoutPending(cmd.Reason, cmd.TimeoutUID) {
+			logger.Logf(log.InfoLevel, "Timeout '%s' of saga '%s' was cancelled or rescheduled, ignoring it", cmd.Reason, sagaInstance.UID())
+			return nil
+		}
+
+		saga.CancelTimeout(cmd.Reason)
+		expired := sagaPkg.ExpireExpectation(saga, cmd.Reason)
+
+		sagaCtx = sagaPkg.NewSagaCtx(execCtx, sagaInstance, h.scheduling().sagaCtxOpts()...)
+
+		if handler, exists := saga.TimeoutHandlers()[cmd.Reason]; exists {
+			if err := handler(sagaCtx); err != nil {
+				return errors.Wrapf(err, "handling timeout '%s' of saga '%s'", cmd.Reason, sagaInstance.UID())
+			}
+		} else if expired {
+			logger.Logf(log.InfoLevel, "expectation '%s' of saga '%s' has expired", cmd.Reason, sagaInstance.UID())
+		} else {
+			logger.Logf(log.WarnLevel, "no handler defined for timeout '%s' of saga '%s'", cmd.Reason, sagaInstance.UID())
+		}
+
 	default:
-		return errors.Errorf("unknown command type '%s' for SagaControlHandler. Supported: StartSagaCommand, RecoverSagaCommand, CompensateSagaCommand", msg.Payload().GroupKind().String())
+		return errors.Errorf("unknown command type '%s' for SagaControlHandler. Supported: StartSagaCommand, RecoverSagaCommand, CompensateSagaCommand, TimeoutSagaCommand", msg.Payload().GroupKind().String())
+	}
+
+	if err := h.scheduling().check(sagaCtx); err != nil {
+		return err
 	}
 
 	sagaInstance.AddHistoryEvent(msg.Payload(), &sagaPkg.AddHistoryEvent{Origin: msg.Origin(), TraceUID: msg.UID()})
 
+	if h.outbox != nil {
+		if err := h.updateWithOutbox(ctx, execCtx, sagaCtx, parentEv); err != nil {
+			return err
+		}
+
+		if sagaInstance.Status().Completed() {
+			h.metrics.SagaCompleted(sagaInstance.Saga().GroupKind())
+		}
+
+		return nil
+	}
+
+	for _, delivery := range sagaCtx.Deliveries() {
+		sagaInstance.AddHistoryEvent(delivery.Payload, nil)
+	}
+
+	sendDeliveries := func() error {
+		//more than one delivery is sent at once
+		if deliveries := sagaCtx.Deliveries(); len(deliveries) > 1 {
+			h.sagaUIDSvc.AddSagaId(msg.Headers(), sagaCtx.SagaInstance().UID())
+
+			messages := make([]*message.OutcomingMessage, len(deliveries))
+			for i, delivery := range deliveries {
+				messages[i] = message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
+				h.propagation.inject(execCtx, messages[i])
+			}
+
+			if err := sendBatch(execCtx, deliveries, messages); err != nil {
+				logger.Logf(log.ErrorLevel, "sending deliveries for saga '%s'. %s", sagaCtx.SagaInstance().UID(), err)
+				return errors.Wrapf(err, "sending deliveries for saga '%s'", sagaCtx.SagaInstance().UID())
+			}
+
+			return nil
+		}
+
+		for _, delivery := range sagaCtx.Deliveries() {
+			h.sagaUIDSvc.AddSagaId(msg.Headers(), sagaCtx.SagaInstance().UID())
+			outcomingMessage := message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
+			h.propagation.inject(execCtx, outcomingMessage)
+
+			if err := execCtx.Send(outcomingMessage, delivery.Options...); err != nil {
+				logger.Logf(log.ErrorLevel, "sending delivery for saga '%s'. Delivery: (%v). %s", sagaCtx.SagaInstance().UID(), delivery, err)
+				return errors.Wrapf(err, "sending delivery for saga '%s'. Delivery: (%v)", sagaCtx.SagaInstance().UID(), delivery)
+			}
+		}
+
+		return nil
+	}
+
+	if err := sendDeliveries(); err != nil {
+		return err
+	}
+
+	if err := h.update(ctx, execCtx, sagaCtx); err != nil {
+		return err
+	}
+
+	//the parent is told after the saga is saved, so it doesn't proceed before the child has compensated
+	if parentEv != nil {
+		if err := h.notifyParent(execCtx, sagaInstance, parentEv, execCtx.Send); err != nil {
+			return errors.Wrapf(err, "notifying parent '%s' of saga '%s'", sagaInstance.ParentID(), sagaInstance.UID())
+		}
+	}
+
+	if sagaInstance.Status().Completed() {
+		h.metrics.SagaCompleted(sagaInstance.Saga().GroupKind())
+	}
+
+	return nil
+}
+
+// updateWithOutbox saves the saga, writes its deliveries and the event for the parent into the outbox and scheduled events
+// into the scheduler in one transaction
+func (h SagaControlHandler) updateWithOutbox(ctx context.Context, execCtx execution.MessageExecutionCtx, sagaCtx sagaPkg.SagaContext, parentEv message.Object) error {
+	msg := execCtx.Message()
+	sagaInstance := sagaCtx.SagaInstance()
+
+	store, ok := h.store.(sagaPkg.TransactionalStore)
+	if !ok {
+		return errors.Errorf("outbox requires saga.TransactionalStore, %T isn't one", h.store)
+	}
+
 	for _, delivery := range sagaCtx.Deliveries() {
-		h.sagaUIDSvc.AddSagaId(msg.Headers(), sagaCtx.SagaInstance().UID())
-		outcomingMessage := message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
+		sagaInstance.AddHistoryEvent(delivery.Payload, nil)
+	}
+
+	return store.UpdateTx(ctx, sagaInstance, func(ctx context.Context, tx *sql.Tx) error {
+		for _, delivery := range sagaCtx.Deliveries() {
+			h.sagaUIDSvc.AddSagaId(msg.Headers(), sagaInstance.UID())
+			outcomingMessage := message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
+			h.propagation.inject(execCtx, outcomingMessage)
 
-		if err := execCtx.Send(outcomingMessage, delivery.Options...); err != nil {
-			logger.Logf(log.ErrorLevel, "sending delivery for saga '%s'. Delivery: (%v). %s", sagaCtx.SagaInstance().UID(), delivery, err)
-			return errors.Wrapf(err, "sending delivery for saga '%s'. Delivery: (%v)", sagaCtx.SagaInstance().UID(), delivery)
+			if err := h.outbox.Add(ctx, tx, sagaInstance.UID(), outcomingMessage, delivery.Options...); err != nil {
+				return errors.Wrapf(err, "writing delivery for saga '%s' into outbox. Delivery: (%v)", sagaInstance.UID(), delivery)
+			}
+		}
+
+		if parentEv != nil {
+			if err := h.notifyParent(execCtx, sagaInstance, parentEv, func(outcomingMsg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				return h.outbox.Add(ctx, tx, sagaInstance.UID(), outcomingMsg, options...)
+			}); err != nil {
+				return err
+			}
 		}
-		sagaCtx.SagaInstance().AddHistoryEvent(delivery.Payload, nil)
+
+		return h.scheduling().save(ctx, tx, execCtx, sagaCtx)
+	})
+}
+
+// lock locks the saga, with optimistic locking nothing is locked and the saga is guarded by its version instead
+func (h SagaControlHandler) lock(ctx context.Context, sagaId string) (mutex.Lock, error) {
+	if h.optimisticLocking {
+		return noLock{}, nil
+	}
+
+	return h.mutex.Lock(ctx, sagaId)
+}
+
+type noLock struct{}
+
+func (noLock) Release(ctx context.Context) error {
+	return nil
+}
+
+// update saves the saga, with the scheduler events it scheduled are saved in the same transaction
+func (h SagaControlHandler) update(ctx context.Context, execCtx execution.MessageExecutionCtx, sagaCtx sagaPkg.SagaContext) error {
+	if h.scheduler == nil {
+		return h.store.Update(ctx, sagaCtx.SagaInstance())
+	}
+
+	store, ok := h.store.(sagaPkg.TransactionalStore)
+	if !ok {
+		return errors.Errorf("scheduler requires saga.TransactionalStore, %T isn't one", h.store)
 	}
 
-	return h.store.Update(ctx, sagaInstance)
+	return store.UpdateTx(ctx, sagaCtx.SagaInstance(), func(ctx context.Context, tx *sql.Tx) error {
+		return h.scheduling().save(ctx, tx, execCtx, sagaCtx)
+	})
+}
+
+func (h SagaControlHandler) scheduling() scheduling {
+	return scheduling{scheduler: h.scheduler, sagaUIDSvc: h.sagaUIDSvc, propagation: h.propagation}
+}
+
+func (h SagaControlHandler) notifyParent(execCtx execution.MessageExecutionCtx, sagaInstance sagaPkg.Instance, ev message.Object, send sendFunc) error {
+	msg := execCtx.Message()
+	h.sagaUIDSvc.AddSagaId(msg.Headers(), sagaInstance.ParentID())
+
+	outcomingMsg := message.NewOutcomingMessage(ev, message.WithHeaders(msg.Headers()))
+	h.propagation.inject(execCtx, outcomingMsg)
+
+	return send(outcomingMsg)
+}
+
+// childrenToCompensate returns uids of children of the saga which haven't completed
+func (h SagaControlHandler) childrenToCompensate(ctx context.Context, sagaId string) ([]string, error) {
+	batch, err := h.store.GetByFilter(ctx, sagaPkg.WithParentId(sagaId))
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading children of saga '%s'", sagaId)
+	}
+
+	var children []string
+
+	for _, child := range batch.Items {
+		if !child.Status().Completed() {
+			children = append(children, child.UID())
+		}
+	}
+
+	return children, nil
+}
+
+// compensatable tells whether the saga can be compensated. A failed saga is compensated on demand, a child is compensated
+// in any status but completed if compensation is cascaded from the parent.
+func compensatable(status sagaPkg.Status, cmd *contracts.CompensateSagaCommand) bool {
+	if status.Completed() || status.Compensating() || status.CompensatingChildren() {
+		return false
+	}
+
+	return status.Failed() || status.ChildCompensationFailed() || cmd.ParentUID != ""
+}
+
+// compensationOutcome returns an event for the parent saga once the child has compensated or failed to, nil while it's compensating
+func compensationOutcome(sagaInstance sagaPkg.Instance) message.Object {
+	switch {
+	case sagaInstance.Status().Completed():
+		return &contracts.SagaChildCompletedEvent{SagaUID: sagaInstance.UID()}
+	case sagaInstance.Status().Failed(), sagaInstance.Status().ChildCompensationFailed():
+		return &contracts.SagaChildCompensationFailedEvent{SagaUID: sagaInstance.UID()}
+	default:
+		return nil
+	}
 }
 
 //saga is map[string]interface{} on this step
@@ -155,7 +529,22 @@ func (h SagaControlHandler) createSaga(startCmd *contracts.StartSagaCommand) (sa
 		return nil, errors.Errorf("saga payload is nil")
 	}
 
-	saga, ok := startCmd.Saga.(sagaPkg.Saga)
+	payload := startCmd.Saga
+
+	if h.versions != nil {
+		gk, err := h.versions.Select(startCmd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "selecting version of saga '%s'", startCmd.SagaUID)
+		}
+
+		if gk != payload.GroupKind() {
+			if payload, err = h.convertSaga(payload, gk); err != nil {
+				return nil, errors.Wrapf(err, "converting saga '%s' into version '%s'", startCmd.SagaUID, gk)
+			}
+		}
+	}
+
+	saga, ok := payload.(sagaPkg.Saga)
 
 	if !ok {
 		return nil, errors.Errorf("error asserting that startCmd.Saga is Saga type")
@@ -164,6 +553,27 @@ func (h SagaControlHandler) createSaga(startCmd *contracts.StartSagaCommand) (sa
 	return sagaPkg.NewSagaInstance(startCmd.SagaUID, startCmd.ParentUID, saga), nil
 }
 
+// convertSaga copies exported fields of the saga sent in StartSagaCommand into a new object of the selected version by json names
+func (h SagaControlHandler) convertSaga(payload message.Object, gk scheme.GroupKind) (message.Object, error) {
+	obj, err := h.typesRegistry.NewObject(gk)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshaling %s", payload.GroupKind())
+	}
+
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling into %s", gk)
+	}
+
+	obj.SetGroupKind(&gk)
+
+	return obj, nil
+}
+
 func (h SagaControlHandler) fetchSaga(ctx context.Context, sagaId string) (sagaPkg.Instance, error) {
 	sagaInstance, err := h.store.GetById(ctx, sagaId)
 
@@ -175,5 +585,11 @@ func (h SagaControlHandler) fetchSaga(ctx context.Context, sagaId string) (sagaP
 		return nil, errors.Errorf("saga instance '%s' not found", sagaId)
 	}
 
+	if h.versions != nil {
+		if err := h.versions.Check(sagaInstance); err != nil {
+			return nil, err
+		}
+	}
+
 	return sagaInstance, nil
 }
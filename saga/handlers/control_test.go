@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"testing"
 	"time"
@@ -17,8 +18,10 @@ import (
 	"github.com/go-foreman/foreman/pubsub/message"
 	sagaPkg "github.com/go-foreman/foreman/saga"
 
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
 	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/testing/mocks/saga"
@@ -333,6 +336,109 @@ func TestRecoverSaga(t *testing.T) {
 	})
 }
 
+func TestControlHandlerOptimisticLocking(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := saga.NewMockStore(ctrl)
+	idService := saga.NewMockSagaUIDService(ctrl)
+	testLogger := log.NewNilLogger()
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+	outbox := &memoryOutbox{}
+
+	// Send isn't expected, deliveries are written into the outbox in the transaction of the update
+	handler := NewSagaControlHandler(&versionedTxStore{Store: sagaStoreMock, outbox: outbox}, nil, scheme.NewKnownTypesRegistry(), idService, WithControlOptimisticLocking(1), WithControlOutbox(outbox))
+
+	recoverSagaCmd := &contracts.RecoverSagaCommand{
+		ObjectMeta: message.ObjectMeta{
+			TypeMeta: scheme.TypeMeta{
+				Kind:  "RecoverSagaCommand",
+				Group: "systemSaga",
+			},
+		},
+		SagaUID: "123",
+	}
+
+	ctx := context.Background()
+	receivedMsg := message.NewReceivedMessage("123", recoverSagaCmd, message.Headers{}, time.Now(), "origin")
+	msgExecutionCtx.EXPECT().Message().Return(receivedMsg).AnyTimes()
+	msgExecutionCtx.EXPECT().Context().Return(ctx).AnyTimes()
+	msgExecutionCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+	failedSaga := func() sagaPkg.Instance {
+		sagaInst := sagaPkg.NewSagaInstance(recoverSagaCmd.SagaUID, "", &SagaExample{})
+		sagaInst.Fail(nil)
+		return sagaInst
+	}
+
+	t.Run("command is handled again after a conflict, deliveries are saved with the saga", func(t *testing.T) {
+		conflicting, reloaded := failedSaga(), failedSaga()
+
+		gomock.InOrder(
+			sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(conflicting, nil),
+			sagaStoreMock.EXPECT().Update(ctx, conflicting).Return(sagaPkg.WithVersionConflictErr(errors.New("conflict"))),
+			sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(reloaded, nil),
+			sagaStoreMock.EXPECT().Update(ctx, reloaded).Return(nil),
+		)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID).Times(2)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.True(t, reloaded.Status().Recovering())
+		testLogger.AssertContainsSubstr(t, "saga was updated concurrently, handling command '123' again")
+
+		require.Len(t, outbox.pending, 1, "the delivery of the attempt which lost the race is rolled back with it")
+		assert.Equal(t, &DataContract{Message: "recover"}, outbox.pending[0].Message.Payload())
+
+		t.Run("delivery is sent after the endpoint failed and the command was redelivered", func(t *testing.T) {
+			endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+			endpointInstance.EXPECT().Name().Return("saga-endpoint").AnyTimes()
+			router := endpoint.NewRouter()
+			router.RegisterEndpoint(endpointInstance, &DataContract{})
+
+			relayCtx, cancel := context.WithCancel(ctx)
+			endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				cancel()
+				return errors.New("broker is down")
+			})
+			require.NoError(t, sagaPkg.NewOutboxRelay(outbox, router, time.Millisecond*10, 10, testLogger).Run(relayCtx))
+
+			// the redelivered command finds the saga recovering already and doesn't save anything
+			sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(reloaded, nil)
+			require.NoError(t, handler.Handle(msgExecutionCtx))
+			assert.Len(t, outbox.pending, 1)
+
+			relayCtx, cancel = context.WithCancel(ctx)
+			endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				cancel()
+				return nil
+			})
+			require.NoError(t, sagaPkg.NewOutboxRelay(outbox, router, time.Millisecond*10, 10, testLogger).Run(relayCtx))
+
+			assert.Empty(t, outbox.pending)
+			require.Len(t, outbox.sent, 1)
+			assert.Equal(t, &DataContract{Message: "recover"}, outbox.sent[0].Payload())
+		})
+	})
+
+	t.Run("conflict after retries", func(t *testing.T) {
+		sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).DoAndReturn(func(ctx context.Context, sagaId string) (sagaPkg.Instance, error) {
+			return failedSaga(), nil
+		}).Times(2)
+		sagaStoreMock.EXPECT().Update(ctx, gomock.Any()).Return(sagaPkg.WithVersionConflictErr(errors.New("conflict"))).Times(2)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID).Times(2)
+
+		err := handler.Handle(msgExecutionCtx)
+		require.Error(t, err)
+		assert.IsType(t, sagaPkg.VersionConflictErr{}, errors.Cause(err))
+	})
+
+	t.Run("outbox is required", func(t *testing.T) {
+		handler := NewSagaControlHandler(sagaStoreMock, nil, scheme.NewKnownTypesRegistry(), idService, WithControlOptimisticLocking(1))
+
+		assert.EqualError(t, handler.Handle(msgExecutionCtx), "optimistic locking requires the outbox, see WithControlOutbox")
+	})
+}
+
 func TestCompensate(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -374,6 +480,7 @@ func TestCompensate(t *testing.T) {
 		sagaInst.Fail(nil)
 
 		sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(sagaInst, nil)
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{}, nil)
 		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID)
 
 		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
@@ -405,6 +512,7 @@ func TestCompensate(t *testing.T) {
 		sagaInst.Fail(nil)
 
 		sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(sagaInst, nil)
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{}, nil)
 		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID)
 
 		msgExecutionCtx.
@@ -473,9 +581,387 @@ func TestCompensate(t *testing.T) {
 		sagaInst := sagaPkg.NewSagaInstance(recoverSagaCmd.SagaUID, "", &SagaExample{err: errors.New("error compensating")})
 		sagaInst.Fail(nil)
 		sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(sagaInst, nil)
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{}, nil)
 
 		err := handler.Handle(msgExecutionCtx)
 		assert.Error(t, err)
 		assert.EqualError(t, err, "compensating saga '123': error compensating")
 	})
+
+	expectLockedFetch := func(cmd *contracts.CompensateSagaCommand, sagaInst sagaPkg.Instance) *message.ReceivedMessage {
+		receivedMsg := message.NewReceivedMessage("123", cmd, message.Headers{}, now, "origin")
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, cmd.SagaUID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(ctx).Return(nil)
+
+		sagaStoreMock.EXPECT().GetById(ctx, cmd.SagaUID).Return(sagaInst, nil)
+
+		return receivedMsg
+	}
+
+	t.Run("children are compensated first", func(t *testing.T) {
+		sagaExample := &SagaExample{}
+		sagaInst := sagaPkg.NewSagaInstance(recoverSagaCmd.SagaUID, "", sagaExample)
+		sagaInst.Fail(nil)
+		receivedMsg := expectLockedFetch(recoverSagaCmd, sagaInst)
+
+		completedChild := sagaPkg.NewSagaInstance("child-2", "123", &SagaExample{})
+		completedChild.Complete()
+
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{Total: 2, Items: []sagaPkg.Instance{
+			sagaPkg.NewSagaInstance("child-1", "123", &SagaExample{}),
+			completedChild,
+		}}, nil)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
+
+		msgExecutionCtx.
+			EXPECT().
+			Send(gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &contracts.CompensateSagaCommand{SagaUID: "child-1", ParentUID: "123"}, msg.Payload())
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.True(t, sagaInst.Status().CompensatingChildren())
+		assert.Equal(t, map[string]sagaPkg.ChildCompensationResult{"child-1": sagaPkg.ChildCompensationPending}, sagaExample.ChildCompensations())
+	})
+
+	t.Run("compensation isn't cascaded", func(t *testing.T) {
+		cascade := false
+		cmd := &contracts.CompensateSagaCommand{ObjectMeta: recoverSagaCmd.ObjectMeta, SagaUID: "123", Cascade: &cascade}
+		sagaInst := sagaPkg.NewSagaInstance(cmd.SagaUID, "", &SagaExample{})
+		sagaInst.Fail(nil)
+		receivedMsg := expectLockedFetch(cmd, sagaInst)
+
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), cmd.SagaUID)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
+
+		msgExecutionCtx.
+			EXPECT().
+			Send(gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &DataContract{Message: "compensate"}, msg.Payload())
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.True(t, sagaInst.Status().Compensating())
+	})
+
+	t.Run("child in progress is compensated by the parent", func(t *testing.T) {
+		cmd := &contracts.CompensateSagaCommand{ObjectMeta: recoverSagaCmd.ObjectMeta, SagaUID: "child-1", ParentUID: "123"}
+		sagaInst := sagaPkg.NewSagaInstance(cmd.SagaUID, "123", &SagaExample{})
+		require.NoError(t, sagaInst.Start(sagaPkg.NewSagaCtx(msgExecutionCtx, sagaInst)))
+		receivedMsg := expectLockedFetch(cmd, sagaInst)
+
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{}, nil)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), cmd.SagaUID)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.True(t, sagaInst.Status().Compensating())
+	})
+
+	t.Run("child compensation failed", func(t *testing.T) {
+		sagaExample := &SagaExample{}
+		sagaInst := sagaPkg.NewSagaInstance(recoverSagaCmd.SagaUID, "", sagaExample)
+		sagaInst.CompensateChildren([]string{"child-1"})
+		_, err := sagaInst.ChildCompensated(nil, "child-1", false)
+		require.NoError(t, err)
+		require.True(t, sagaInst.Status().ChildCompensationFailed())
+
+		receivedMsg := expectLockedFetch(recoverSagaCmd, sagaInst)
+
+		sagaStoreMock.EXPECT().GetByFilter(ctx, gomock.Any()).Return(&sagaPkg.InstancesBatch{Items: []sagaPkg.Instance{sagaPkg.NewSagaInstance("child-1", "123", &SagaExample{})}}, nil)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), recoverSagaCmd.SagaUID)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx), "compensation is cascaded again")
+		assert.True(t, sagaInst.Status().CompensatingChildren())
+		assert.Equal(t, map[string]sagaPkg.ChildCompensationResult{"child-1": sagaPkg.ChildCompensationPending}, sagaExample.ChildCompensations())
+	})
+}
+
+func TestTimeoutSaga(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := saga.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	idService := saga.NewMockSagaUIDService(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	schemeRegistry.AddKnownTypes("example", &DataContract{})
+	testLogger := log.NewNilLogger()
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+
+	handler := NewSagaControlHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService)
+
+	timeoutCmd := &contracts.TimeoutSagaCommand{
+		ObjectMeta: message.ObjectMeta{
+			TypeMeta: scheme.TypeMeta{
+				Kind:  "TimeoutSagaCommand",
+				Group: "systemSaga",
+			},
+		},
+		SagaUID:    "123",
+		TimeoutUID: "timeout-uid",
+		Reason:     "reply",
+	}
+
+	now := time.Now()
+	ctx := context.Background()
+
+	expectLockedFetch := func(sagaInst sagaPkg.Instance) *message.ReceivedMessage {
+		receivedMsg := message.NewReceivedMessage("123", timeoutCmd, message.Headers{}, now, "origin")
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, timeoutCmd.SagaUID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(ctx).Return(nil)
+
+		sagaStoreMock.EXPECT().GetById(ctx, timeoutCmd.SagaUID).Return(sagaInst, nil)
+
+		return receivedMsg
+	}
+
+	t.Run("success", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaExample := &SagaExample{}
+		sagaExample.Timeouts = map[string]string{"reply": "timeout-uid"}
+		sagaInst := sagaPkg.NewSagaInstance(timeoutCmd.SagaUID, "", sagaExample)
+		receivedMsg := expectLockedFetch(sagaInst)
+
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), timeoutCmd.SagaUID)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInst).Return(nil)
+
+		msgExecutionCtx.
+			EXPECT().
+			Send(gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &DataContract{Message: "timeout"}, msg.Payload())
+				return nil
+			})
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.NoError(t, err)
+		assert.False(t, sagaExample.TimeoutPending("reply", "timeout-uid"))
+		assert.Len(t, sagaInst.HistoryEvents(), 2)
+	})
+
+	t.Run("saga has already completed", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaExample := &SagaExample{}
+		sagaExample.Timeouts = map[string]string{"reply": "timeout-uid"}
+		sagaInst := sagaPkg.NewSagaInstance(timeoutCmd.SagaUID, "", sagaExample)
+		sagaInst.Complete()
+		expectLockedFetch(sagaInst)
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.NoError(t, err)
+		testLogger.AssertContainsSubstr(t, "Saga '123' has already completed, timeout 'reply' is ignored")
+	})
+
+	t.Run("timeout was cancelled", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaInst := sagaPkg.NewSagaInstance(timeoutCmd.SagaUID, "", &SagaExample{})
+		expectLockedFetch(sagaInst)
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.NoError(t, err)
+		testLogger.AssertContainsSubstr(t, "Timeout 'reply' of saga '123' was cancelled or rescheduled, ignoring it")
+	})
+
+	t.Run("timeout was rescheduled", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaExample := &SagaExample{}
+		sagaExample.Timeouts = map[string]string{"reply": "another-uid"}
+		sagaInst := sagaPkg.NewSagaInstance(timeoutCmd.SagaUID, "", sagaExample)
+		expectLockedFetch(sagaInst)
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.NoError(t, err)
+		assert.True(t, sagaExample.TimeoutPending("reply", "another-uid"))
+		testLogger.AssertContainsSubstr(t, "Timeout 'reply' of saga '123' was cancelled or rescheduled, ignoring it")
+	})
+
+	t.Run("timeout handler returns an error", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaExample := &SagaExample{err: errors.New("timeout err")}
+		sagaExample.Timeouts = map[string]string{"reply": "timeout-uid"}
+		sagaInst := sagaPkg.NewSagaInstance(timeoutCmd.SagaUID, "", sagaExample)
+		expectLockedFetch(sagaInst)
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.Error(t, err)
+		assert.EqualError(t, err, "handling timeout 'reply' of saga '123': timeout err")
+	})
+}
+
+func TestControlHandlerSagaVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := saga.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	idService := saga.NewMockSagaUIDService(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	testLogger := log.NewNilLogger()
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &SagaExample{}, &SagaExampleV2{}, &DataContract{})
+	v1 := scheme.GroupKind{Group: g, Kind: "SagaExample"}
+	v2 := scheme.GroupKind{Group: g, Kind: "SagaExampleV2"}
+
+	version := 2
+	versions := sagaPkg.NewVersionRegistry()
+	require.NoError(t, versions.Register(func(startCmd *contracts.StartSagaCommand) int {
+		return version
+	}, v1, v2))
+
+	handler := NewSagaControlHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithControlVersions(versions))
+
+	sagaV1 := &SagaExample{Data: "data"}
+	sagaV1.SetGroupKind(&v1)
+	startSagaCmd := &contracts.StartSagaCommand{SagaUID: "123", Saga: sagaV1}
+
+	ctx := context.Background()
+
+	t.Run("start selected version", func(t *testing.T) {
+		receivedMsg := message.NewReceivedMessage("123", startSagaCmd, message.Headers{}, time.Now(), "origin")
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).Times(2)
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, startSagaCmd.SagaUID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(ctx).Return(nil)
+
+		sagaStoreMock.
+			EXPECT().
+			Create(ctx, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, sagaInst sagaPkg.Instance) error {
+				require.IsType(t, &SagaExampleV2{}, sagaInst.Saga())
+				assert.Equal(t, "data", sagaInst.Saga().(*SagaExampleV2).Data)
+				assert.Equal(t, v2, sagaInst.Saga().GroupKind())
+				return nil
+			})
+		sagaStoreMock.EXPECT().Update(ctx, gomock.Any()).Return(nil)
+
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), startSagaCmd.SagaUID)
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+
+		assert.NoError(t, handler.Handle(msgExecutionCtx))
+	})
+
+	t.Run("selector returns unknown version", func(t *testing.T) {
+		version = 3
+		defer func() { version = 2 }()
+
+		receivedMsg := message.NewReceivedMessage("123", startSagaCmd, message.Headers{}, time.Now(), "origin")
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger)
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.EqualError(t, err, "selecting version of saga '123': version selector of saga 'example.SagaExample' returned version 3, registered versions are 1-2")
+	})
+
+	t.Run("recover instance of unregistered version", func(t *testing.T) {
+		recoverSagaCmd := &contracts.RecoverSagaCommand{SagaUID: "123"}
+		receivedMsg := message.NewReceivedMessage("123", recoverSagaCmd, message.Headers{}, time.Now(), "origin")
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger)
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, recoverSagaCmd.SagaUID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(ctx).Return(nil)
+
+		sagaV0 := &SagaExample{}
+		sagaV0.SetGroupKind(&scheme.GroupKind{Group: g, Kind: "SagaExampleV0"})
+		sagaInst := sagaPkg.NewSagaInstance(recoverSagaCmd.SagaUID, "", sagaV0)
+		sagaInst.Fail(nil)
+		sagaStoreMock.EXPECT().GetById(ctx, recoverSagaCmd.SagaUID).Return(sagaInst, nil)
+
+		err := handler.Handle(msgExecutionCtx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "saga '123' was started with 'example.SagaExampleV0' which is no longer registered")
+	})
+}
+
+func TestControlHandlerScheduler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &schedulingSaga{}, &DataContract{})
+
+	store := &transactionalStore{marshallingStore: &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}}
+	schedulerMock := saga.NewMockScheduler(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	idService := sagaPkg.NewSagaUIDService()
+	ctx := context.Background()
+
+	start := func(sagaId string) *execution.MockMessageExecutionCtx {
+		sagaObj := &schedulingSaga{}
+		sagaObj.SetGroupKind(&scheme.GroupKind{Group: g, Kind: "schedulingSaga"})
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(sagaId, &contracts.StartSagaCommand{SagaUID: sagaId, Saga: sagaObj}, message.Headers{}, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(log.NewNilLogger()).AnyTimes()
+
+		return execCtx
+	}
+
+	t.Run("event scheduled on start is written in the transaction of the update", func(t *testing.T) {
+		handler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService, WithControlScheduler(schedulerMock))
+
+		schedulerMock.
+			EXPECT().
+			Schedule(gomock.Any(), store.tx, "123", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, fireAt time.Time) error {
+				assert.Equal(t, &DataContract{Message: "expire"}, msg.Payload())
+				assert.WithinDuration(t, time.Now().Add(time.Hour), fireAt, time.Second)
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(start("123")))
+	})
+
+	t.Run("scheduler isn't configured", func(t *testing.T) {
+		handler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService)
+
+		assert.EqualError(t, handler.Handle(start("234")), "saga '234' scheduled events, but no scheduler is configured")
+	})
+
+	t.Run("store isn't transactional", func(t *testing.T) {
+		handler := NewSagaControlHandler(store.marshallingStore, sagaMutexMock, schemeRegistry, idService, WithControlScheduler(schedulerMock))
+
+		assert.EqualError(t, handler.Handle(start("345")), "scheduler requires saga.TransactionalStore, *handlers.marshallingStore isn't one")
+	})
 }
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	sagaMutex "github.com/go-foreman/foreman/saga/mutex"
+	"github.com/pkg/errors"
+)
+
+// ShuttingDownErr is returned by handlers for messages received after Drain.Shutdown is called.
+// The message isn't acked and is redelivered to another consumer.
+type ShuttingDownErr struct {
+	error
+}
+
+func WithShuttingDownErr(err error) error {
+	return ShuttingDownErr{err}
+}
+
+// Drain tracks handlers in flight so they can finish before the process stops. Pass it into handlers by WithDrain
+// and WithControlDrain and wrap their mutex by Drain.Mutex. A nil *Drain tracks nothing.
+type Drain struct {
+	mutex    sync.Mutex
+	closed   bool
+	inFlight int
+	idle     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	locks    map[*drainLock]struct{}
+	logger   log.Logger
+}
+
+func NewDrain(logger log.Logger) *Drain {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Drain{
+		idle:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		locks:  make(map[*drainLock]struct{}),
+		logger: logger,
+	}
+}
+
+// WithDrain makes the handler refuse messages once the drain is shut down and wait for it otherwise
+func WithDrain(drain *Drain) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.drain = drain
+	}
+}
+
+// WithControlDrain makes the handler refuse messages once the drain is shut down and wait for it otherwise
+func WithControlDrain(drain *Drain) ControlHandlerOpt {
+	return func(h *SagaControlHandler) {
+		h.drain = drain
+	}
+}
+
+// enter registers a handler in flight. Context of the returned execCtx is cancelled if Shutdown gives up waiting,
+// done must be called once the handler returns.
+func (d *Drain) enter(execCtx execution.MessageExecutionCtx) (execution.MessageExecutionCtx, func(), error) {
+	if d == nil {
+		return execCtx, func() {}, nil
+	}
+
+	d.mutex.Lock()
+
+	if d.closed {
+		d.mutex.Unlock()
+		return nil, nil, WithShuttingDownErr(errors.Errorf("saga handlers are shutting down, message '%s' is left for redelivery", execCtx.Message().UID()))
+	}
+
+	d.inFlight++
+	d.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(execCtx.Context())
+	returned := make(chan struct{})
+
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			cancel()
+		case <-returned:
+		}
+	}()
+
+	done := func() {
+		close(returned)
+		cancel()
+		d.leave()
+	}
+
+	return execution.WithContext(execCtx, ctx), done, nil
+}
+
+func (d *Drain) leave() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.inFlight--
+
+	if d.closed && d.inFlight == 0 {
+		close(d.idle)
+	}
+}
+
+// Shutdown stops accepting messages and waits until handlers in flight return or ctx is done. If they don't return in time,
+// their contexts are cancelled, locks they hold are released and an error with the number of running handlers is returned.
+// Calls after the first one do nothing.
+func (d *Drain) Shutdown(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+
+	if d.closed {
+		d.mutex.Unlock()
+		return nil
+	}
+
+	d.closed = true
+
+	if d.inFlight == 0 {
+		close(d.idle)
+	}
+
+	d.mutex.Unlock()
+
+	select {
+	case <-d.idle:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.cancel()
+
+	d.mutex.Lock()
+	running := d.inFlight
+	locks := make([]*drainLock, 0, len(d.locks))
+	for lock := range d.locks {
+		locks = append(locks, lock)
+	}
+	d.mutex.Unlock()
+
+	releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	for _, lock := range locks {
+		if err := lock.Release(releaseCtx); err != nil {
+			d.logger.Logf(log.ErrorLevel, "error releasing mutex '%s' on shutdown: %s", lock.sagaId, err)
+		}
+	}
+
+	return errors.Errorf("%d saga handlers are still running after shutdown timeout, released %d saga locks held by them: %s", running, len(locks), ctx.Err())
+}
+
+// Mutex wraps the mutex so locks held by handlers are known to the drain and released by Shutdown if handlers don't return in time
+func (d *Drain) Mutex(mutex sagaMutex.Mutex) sagaMutex.Mutex {
+	if d == nil {
+		return mutex
+	}
+
+	return drainMutex{mutex: mutex, drain: d}
+}
+
+func (d *Drain) track(lock *drainLock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.locks[lock] = struct{}{}
+}
+
+func (d *Drain) untrack(lock *drainLock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.locks, lock)
+}
+
+type drainMutex struct {
+	mutex sagaMutex.Mutex
+	drain *Drain
+}
+
+func (m drainMutex) Lock(ctx context.Context, sagaId string) (sagaMutex.Lock, error) {
+	lock, err := m.mutex.Lock(ctx, sagaId)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &drainLock{lock: lock, sagaId: sagaId, drain: m.drain}
+	m.drain.track(tracked)
+
+	if leased, ok := lock.(sagaMutex.LeasedLock); ok {
+		return drainLeasedLock{drainLock: tracked, ctx: leased.Context()}, nil
+	}
+
+	return tracked, nil
+}
+
+// drainLock is released once, either by the handler or by Drain.Shutdown, whichever comes first
+type drainLock struct {
+	lock     sagaMutex.Lock
+	sagaId   string
+	drain    *Drain
+	released sync.Once
+}
+
+// Unwrap returns the tracked lock, see sagaMutex.FencingToken
+func (l *drainLock) Unwrap() sagaMutex.Lock {
+	return l.lock
+}
+
+func (l *drainLock) Release(ctx context.Context) error {
+	var err error
+
+	l.released.Do(func() {
+		err = l.lock.Release(ctx)
+		l.drain.untrack(l)
+	})
+
+	return err
+}
+
+type drainLeasedLock struct {
+	*drainLock
+	ctx context.Context
+}
+
+func (l drainLeasedLock) Context() context.Context {
+	return l.ctx
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	sagaMocks "github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	testLogger := log.NewNilLogger()
+	execCtxFactory := execution.NewMessageExecutionCtxFactory(nil, testLogger)
+	newExecCtx := func() execution.MessageExecutionCtx {
+		return execCtxFactory.CreateCtx(context.Background(), message.NewReceivedMessage("123", &DataContract{}, message.Headers{}, time.Now(), "test"))
+	}
+
+	t.Run("disabled drain passes messages through", func(t *testing.T) {
+		var drain *Drain
+
+		execCtx := newExecCtx()
+		passed, done, err := drain.enter(execCtx)
+		require.NoError(t, err)
+		done()
+
+		assert.Same(t, execCtx, passed)
+		assert.NoError(t, drain.Shutdown(context.Background()))
+	})
+
+	t.Run("shutdown waits for handlers in flight", func(t *testing.T) {
+		drain := NewDrain(testLogger)
+
+		_, done, err := drain.enter(newExecCtx())
+		require.NoError(t, err)
+
+		shutdown := make(chan error)
+		go func() {
+			shutdown <- drain.Shutdown(context.Background())
+		}()
+
+		select {
+		case <-shutdown:
+			t.Fatal("shutdown returned while a handler is in flight")
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		_, _, err = drain.enter(newExecCtx())
+		assert.IsType(t, ShuttingDownErr{}, err)
+		assert.EqualError(t, err, "saga handlers are shutting down, message '123' is left for redelivery")
+
+		done()
+		assert.NoError(t, <-shutdown)
+		assert.NoError(t, drain.Shutdown(context.Background()), "second shutdown is a no-op")
+	})
+
+	t.Run("timeout cancels handlers and releases their locks", func(t *testing.T) {
+		drain := NewDrain(testLogger)
+		mutexMock := mutex.NewMockMutex(ctrl)
+		lockMock := mutex.NewMockLock(ctrl)
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "123").Return(lockMock, nil)
+		lockMock.EXPECT().Release(gomock.Any()).Return(nil).Times(1)
+
+		execCtx, done, err := drain.enter(newExecCtx())
+		require.NoError(t, err)
+
+		lock, err := drain.Mutex(mutexMock).Lock(execCtx.Context(), "123")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		defer cancel()
+
+		err = drain.Shutdown(ctx)
+		assert.EqualError(t, err, "1 saga handlers are still running after shutdown timeout, released 1 saga locks held by them: context deadline exceeded")
+
+		select {
+		case <-execCtx.Context().Done():
+		case <-time.After(time.Second):
+			t.Fatal("context of the handler wasn't cancelled")
+		}
+
+		assert.NoError(t, lock.Release(context.Background()), "lock released by shutdown isn't released twice")
+		done()
+	})
+
+	t.Run("leased locks stay leased", func(t *testing.T) {
+		drain := NewDrain(testLogger)
+		mutexMock := mutex.NewMockMutex(ctrl)
+		lockMock := mutex.NewMockLeasedLock(ctrl)
+		leaseCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		mutexMock.EXPECT().Lock(gomock.Any(), "123").Return(lockMock, nil)
+		lockMock.EXPECT().Context().Return(leaseCtx)
+		lockMock.EXPECT().Release(gomock.Any()).Return(nil)
+
+		lock, err := drain.Mutex(mutexMock).Lock(context.Background(), "123")
+		require.NoError(t, err)
+		require.Implements(t, (*interface{ Context() context.Context })(nil), lock)
+
+		require.NoError(t, lock.Release(context.Background()))
+		assert.NoError(t, drain.Shutdown(context.Background()))
+	})
+
+	t.Run("handler refuses messages after shutdown", func(t *testing.T) {
+		drain := NewDrain(testLogger)
+		require.NoError(t, drain.Shutdown(context.Background()))
+
+		handler := NewEventsHandler(sagaMocks.NewMockStore(ctrl), mutex.NewMockMutex(ctrl), nil, sagaPkg.NewSagaUIDService(), WithDrain(drain))
+		assert.IsType(t, ShuttingDownErr{}, handler.Handle(newExecCtx()))
+
+		controlHandler := NewSagaControlHandler(sagaMocks.NewMockStore(ctrl), mutex.NewMockMutex(ctrl), nil, sagaPkg.NewSagaUIDService(), WithControlDrain(drain))
+		assert.IsType(t, ShuttingDownErr{}, controlHandler.Handle(newExecCtx()))
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	log "github.com/go-foreman/foreman/log"
@@ -10,36 +11,279 @@ import (
 
 	"fmt"
 
+	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/tracing"
 	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/saga/contracts"
 	"github.com/pkg/errors"
 )
 
 type SagaEventsHandler struct {
-	sagaStore  sagaPkg.Store
-	sagaUIDSvc sagaPkg.SagaUIDService
-	scheme     scheme.KnownTypesRegistry
-	mutex      sagaMutex.Mutex
+	sagaStore     sagaPkg.Store
+	sagaUIDSvc    sagaPkg.SagaUIDService
+	scheme        scheme.KnownTypesRegistry
+	mutex         sagaMutex.Mutex
+	growthMonitor *sagaPkg.GrowthMonitor
+	versions      *sagaPkg.VersionRegistry
+	metrics       *sagaPkg.Metrics
+	drain         *Drain
+
+	optimisticLocking  bool
+	maxConflictRetries int
+
+	outbox    sagaPkg.Outbox
+	scheduler sagaPkg.Scheduler
+
+	maxAttempts int
+	backoff     BackoffFunc
+
+	maxUpdateRetries int
+	updateBackoff    time.Duration
+
+	correlation map[scheme.GroupKind]sagaPkg.CorrelationRule
+
+	propagation *tracePropagation
 }
 
-func NewEventsHandler(sagaStore sagaPkg.Store, mutex sagaMutex.Mutex, scheme scheme.KnownTypesRegistry, extractor sagaPkg.SagaUIDService) *SagaEventsHandler {
-	return &SagaEventsHandler{sagaStore: sagaStore, sagaUIDSvc: extractor, scheme: scheme, mutex: mutex}
+const (
+	// DefaultMaxUpdateRetries is how many times an update failed with a transient store error is retried unless WithUpdateRetry says otherwise
+	DefaultMaxUpdateRetries = 3
+	// DefaultUpdateBackoff is a delay before an update is retried unless WithUpdateRetry says otherwise
+	DefaultUpdateBackoff = time.Millisecond * 100
+)
+
+// BackoffFunc returns a delay before an event is handled again after the attempt failed, attempts are counted from 1
+type BackoffFunc func(attempt int) time.Duration
+
+// ExponentialBackoff doubles the delay after every failed attempt starting from initial up to max, max <= 0 doesn't limit it
+func ExponentialBackoff(initial, max time.Duration) BackoffFunc {
+	return func(attempt int) time.Duration {
+		backoff := initial
+		for i := 1; i < attempt && (max <= 0 || backoff < max); i++ {
+			backoff *= 2
+		}
+
+		if max > 0 && backoff > max {
+			return max
+		}
+
+		return backoff
+	}
 }
 
-func (e SagaEventsHandler) Handle(execCtx execution.MessageExecutionCtx) error {
-	msg := execCtx.Message()
-	ctx := execCtx.Context()
-	logger := execCtx.Logger()
-	msgGK := msg.Payload().GroupKind().String()
+// EventsHandlerOpt configures SagaEventsHandler
+type EventsHandlerOpt func(h *SagaEventsHandler)
 
-	sagaId, err := e.sagaUIDSvc.ExtractSagaUID(msg.Headers())
+// WithGrowthMonitor checks size of each saga before it's updated. A saga which exceeds hard limits is marked as failed
+// on the received event and its previous state is kept in the store.
+func WithGrowthMonitor(monitor *sagaPkg.GrowthMonitor) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.growthMonitor = monitor
+	}
+}
+
+// WithVersions refuses to handle events of instances started with a saga version which is no longer registered
+func WithVersions(versions *sagaPkg.VersionRegistry) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.versions = versions
+	}
+}
+
+// WithMetrics records handled events and completed sagas into prometheus metrics
+func WithMetrics(metrics *sagaPkg.Metrics) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.metrics = metrics
+	}
+}
+
+// WithOptimisticLocking handles events without the mutex, a saga is saved only if it wasn't saved by someone else since it was loaded,
+// see saga.VersionConflictErr. On a conflict the saga is reloaded and the event is handled again up to maxRetries times,
+// then the error is returned and the message is redelivered. The outbox is required, see WithOutbox: deliveries sent after the saga
+// is saved would be lost if sending fails, because the redelivered event is recognized as applied.
+func WithOptimisticLocking(maxRetries int) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.optimisticLocking = true
+		h.maxConflictRetries = maxRetries
+	}
+}
+
+// WithOutbox writes deliveries into the outbox in the transaction of the saga update instead of sending them,
+// they are sent by saga.OutboxRelay. The store must be saga.TransactionalStore.
+func WithOutbox(outbox sagaPkg.Outbox) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.outbox = outbox
+	}
+}
+
+// WithScheduler keeps events scheduled by sagas with SagaContext.Schedule in the scheduler, they are written in the transaction
+// of the saga update and pending ones are cancelled when the saga completes. The store must be saga.TransactionalStore.
+func WithScheduler(scheduler sagaPkg.Scheduler) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.scheduler = scheduler
+	}
+}
+
+// WithRetryPolicy handles an event again if a handler of the saga returns an error. The message is sent back with a delay returned
+// by backoff, the endpoint must support endpoint.WithDelay. Attempts are counted per message in message.HandlingAttemptsHeader,
+// messages dispatched by the saga don't carry the counter. Once maxAttempts are exhausted the message is dropped and
+// contracts.SagaHandlingFailedEvent is sent instead, the saga isn't marked as failed.
+func WithRetryPolicy(maxAttempts int, backoff BackoffFunc) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.maxAttempts = maxAttempts
+		h.backoff = backoff
+	}
+}
+
+// WithUpdateRetry retries saving a saga (its state and history are saved together) up to maxRetries times with the backoff
+// between attempts if the store fails with a transient error, see saga.IsTransientErr. The event isn't handled again and
+// the lock is held meanwhile, so a short outage of the database doesn't make handlers repeat their side effects.
+// If retries are exhausted the error is returned and the message is redelivered. By default an update is retried
+// DefaultMaxUpdateRetries times with DefaultUpdateBackoff, maxRetries 0 disables retries.
+func WithUpdateRetry(maxRetries int, backoff time.Duration) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.maxUpdateRetries = maxRetries
+		h.updateBackoff = backoff
+	}
+}
+
+// WithCorrelation finds the saga of an event listed in rules by the correlation value, see saga.CorrelationRule.
+// Saga uid in headers of such event is ignored, other events are handled by saga uid in headers as usual.
+func WithCorrelation(rules map[scheme.GroupKind]sagaPkg.CorrelationRule) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.correlation = rules
+	}
+}
+
+// WithTracePropagation carries trace context and correlation id of a received event over to messages sent by the saga, see saga.TraceCarrier
+func WithTracePropagation(carrier sagaPkg.TraceCarrier) EventsHandlerOpt {
+	return func(h *SagaEventsHandler) {
+		h.propagation = newTracePropagation(carrier)
+	}
+}
+
+func NewEventsHandler(sagaStore sagaPkg.Store, mutex sagaMutex.Mutex, scheme scheme.KnownTypesRegistry, extractor sagaPkg.SagaUIDService, opts ...EventsHandlerOpt) *SagaEventsHandler {
+	h := &SagaEventsHandler{
+		sagaStore:        sagaStore,
+		sagaUIDSvc:       extractor,
+		scheme:           scheme,
+		mutex:            mutex,
+		maxUpdateRetries: DefaultMaxUpdateRetries,
+		updateBackoff:    DefaultUpdateBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+func (e SagaEventsHandler) Handle(execCtx execution.MessageExecutionCtx) (err error) {
+	execCtx, done, err := e.drain.enter(execCtx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	execCtx = e.propagation.begin(execCtx)
+
+	handling := e.metrics.HandleEvent()
+	defer func() {
+		handling.Done(err)
+	}()
+
+	h := &eventHandling{
+		execCtx:  execCtx,
+		msg:      execCtx.Message(),
+		ctx:      execCtx.Context(),
+		logger:   execCtx.Logger(),
+		handling: handling,
+	}
+
+	h.sagaId, err = e.resolveSagaId(h)
 
 	if err != nil {
-		return errors.Wrapf(err, "extracting saga id from message '%s'", msg.UID())
+		return err
 	}
 
+	//the counter belongs to the received message only, deliveries copy its headers
+	h.attempts = h.msg.Headers().HandlingAttempts()
+	delete(h.msg.Headers(), message.HandlingAttemptsHeader)
+
+	if e.optimisticLocking {
+		err = e.handleOptimistically(h)
+	} else {
+		err = e.handleLocked(h)
+	}
+
+	if handlerErr, failed := errors.Cause(err).(handlerErr); failed && e.maxAttempts > 0 {
+		return e.retry(h, handlerErr)
+	}
+
+	return err
+}
+
+// resolveSagaId finds the saga by the correlation rule of the event if there is one, otherwise saga uid is taken from headers
+func (e SagaEventsHandler) resolveSagaId(h *eventHandling) (string, error) {
+	msgGK := h.msg.Payload().GroupKind()
+
+	rule, correlated := e.correlation[msgGK]
+	if !correlated {
+		sagaId, err := e.sagaUIDSvc.ExtractSagaUID(h.msg.Headers())
+		if err != nil {
+			return "", errors.Wrapf(err, "extracting saga id from message '%s'", h.msg.UID())
+		}
+
+		return sagaId, nil
+	}
+
+	value, ok, err := sagaPkg.CorrelationValue(h.msg.Payload(), rule.EventField)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading correlation value of message '%s'", h.msg.UID())
+	}
+
+	if !ok {
+		return "", errors.Errorf("event '%s' from message '%s' has no correlation value in field '%s'", msgGK, h.msg.UID(), rule.EventField)
+	}
+
+	sagaInstance, err := e.sagaStore.GetByCorrelation(h.ctx, rule.Saga.String(), rule.SagaField, value)
+	if err != nil {
+		return "", errors.Wrapf(err, "correlating message '%s' with saga %s", h.msg.UID(), rule.Saga)
+	}
+
+	if sagaInstance == nil {
+		return "", errors.Errorf("no saga %s in progress has %s '%s' of message '%s'", rule.Saga, rule.SagaField, value, h.msg.UID())
+	}
+
+	return sagaInstance.UID(), nil
+}
+
+// handlerErr is returned if a handler of the saga fails to handle the event
+type handlerErr struct {
+	error
+}
+
+// eventHandling keeps what is taken from the execution context once per received event
+type eventHandling struct {
+	execCtx  execution.MessageExecutionCtx
+	msg      *message.ReceivedMessage
+	ctx      context.Context
+	logger   log.Logger
+	sagaId   string
+	handling *sagaPkg.Handling
+	// compensationFailed is set if the event failed compensation of the saga, the parent is told about it
+	compensationFailed bool
+	// attempts is a number of previous failed attempts to handle the message
+	attempts int
+}
+
+// handleLocked handles the event under the saga lock, deliveries are sent before the saga is saved
+func (e SagaEventsHandler) handleLocked(h *eventHandling) error {
+	ctx, logger, sagaId := h.ctx, h.logger, h.sagaId
+
 	//lock saga so nobody can process events for this saga in another consumer's replicas
 	lock, err := e.mutex.Lock(ctx, sagaId)
 	if err != nil {
@@ -48,6 +292,16 @@ func (e SagaEventsHandler) Handle(execCtx execution.MessageExecutionCtx) error {
 
 	logger.Logf(log.DebugLevel, "locked saga '%s'", sagaId)
 
+	//a leased lock may be lost while the event is handled, its context is cancelled then
+	var lease context.Context
+	if leased, ok := lock.(sagaMutex.LeasedLock); ok {
+		lease = leased.Context()
+		ctx = lease
+	}
+
+	ctx = withFencingToken(ctx, lock)
+	h.ctx = ctx
+
 	defer func() {
 		releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 		defer cancel()
@@ -60,48 +314,153 @@ func (e SagaEventsHandler) Handle(execCtx execution.MessageExecutionCtx) error {
 		logger.Logf(log.DebugLevel, "released saga '%s'", sagaId)
 	}()
 
+	sagaInstance, sagaCtx, err := e.applyEvent(h)
+	if err != nil || sagaInstance == nil {
+		return err
+	}
+
+	if err := checkLease(lease, sagaId); err != nil {
+		return err
+	}
+
+	if e.outbox != nil {
+		if err := e.update(h, sagaInstance, sagaCtx); err != nil {
+			return errors.Wrapf(err, "saving saga's '%s' state to db", sagaInstance.UID())
+		}
+
+		e.outboxCompleted(sagaInstance)
+
+		return nil
+	}
+
+	if err := e.publishDeliveries(h, sagaCtx); err != nil {
+		return err
+	}
+
+	if err := checkLease(lease, sagaId); err != nil {
+		return err
+	}
+
+	if err := e.update(h, sagaInstance, sagaCtx); err != nil {
+		return errors.Wrapf(err, "saving saga's '%s' state to db", sagaInstance.UID())
+	}
+
+	return e.notifyCompleted(h, sagaInstance)
+}
+
+// handleOptimistically handles the event without the lock. The saga is saved only if nobody else saved it since it was loaded,
+// otherwise the event is applied again to the reloaded saga. Deliveries are written into the outbox in the transaction of the update,
+// so deliveries of an attempt which lost the race are rolled back with it and deliveries of a saved saga are sent by the relay
+// even if the redelivered message is recognized as applied.
+func (e SagaEventsHandler) handleOptimistically(h *eventHandling) error {
+	if e.outbox == nil {
+		return errors.New("optimistic locking requires the outbox, see WithOutbox")
+	}
+
+	for attempt := 0; ; attempt++ {
+		sagaInstance, sagaCtx, err := e.applyEvent(h)
+		if err != nil || sagaInstance == nil {
+			return err
+		}
+
+		err = e.update(h, sagaInstance, sagaCtx)
+
+		if _, conflict := errors.Cause(err).(sagaPkg.VersionConflictErr); conflict && attempt < e.maxConflictRetries {
+			h.logger.Logf(log.DebugLevel, "saga '%s' was updated concurrently, handling message '%s' again. %s", h.sagaId, h.msg.UID(), err)
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "saving saga's '%s' state to db", sagaInstance.UID())
+		}
+
+		e.outboxCompleted(sagaInstance)
+
+		return nil
+	}
+}
+
+// applyEvent loads the saga and lets it handle the event, the saga isn't saved. A nil instance is returned if there is nothing
+// to save, e.g. the message has already been applied or the saga has been failed because it's oversized.
+func (e SagaEventsHandler) applyEvent(h *eventHandling) (sagaPkg.Instance, sagaPkg.SagaContext, error) {
+	execCtx, msg, ctx, logger, sagaId := h.execCtx, h.msg, h.ctx, h.logger, h.sagaId
+	msgGK := msg.Payload().GroupKind().String()
+
 	sagaInstance, err := e.sagaStore.GetById(ctx, sagaId)
 
 	if err != nil {
-		return errors.Wrapf(err, "retrieving saga '%s' from store", sagaId)
+		return nil, nil, errors.Wrapf(err, "retrieving saga '%s' from store", sagaId)
 	}
 
 	logger.Logf(log.DebugLevel, "loaded saga '%s'", sagaId)
 
 	if sagaInstance == nil {
-		return errors.Errorf("saga '%s' not found", sagaId)
+		return nil, nil, errors.Errorf("saga '%s' not found", sagaId)
+	}
+
+	h.handling.SetInstance(sagaInstance)
+	tracing.TagSaga(ctx, sagaId, sagaInstance.Saga().GroupKind().String())
+
+	//at-least-once delivery: the received message is written into history in the same update as the saga state,
+	//the check is done under the lock or the version, so only one of concurrent deliveries of the message is applied
+	if isApplied(sagaInstance, msg.UID()) {
+		logger.Logf(log.DebugLevel, "message '%s' has already been applied to saga '%s', skipping it", msg.UID(), sagaId)
+		return nil, nil, nil
 	}
 
 	if sagaInstance.Status().Completed() {
-		return errors.Errorf("saga '%s' has already completed", sagaId)
+		return nil, nil, errors.Errorf("saga '%s' has already completed", sagaId)
+	}
+
+	if e.versions != nil {
+		if err := e.versions.Check(sagaInstance); err != nil {
+			logger.Logf(log.ErrorLevel, "%s", err)
+			return nil, nil, err
+		}
 	}
 
 	saga := sagaInstance.Saga()
 	saga.SetSchema(e.scheme)
 	saga.Init()
 
-	sagaCtx := sagaPkg.NewSagaCtx(execCtx, sagaInstance)
+	sagaCtx := sagaPkg.NewSagaCtx(execCtx, sagaInstance, e.scheduling().sagaCtxOpts()...)
+	wasCompensating := sagaInstance.Status().Compensating() || sagaInstance.Status().CompensatingChildren()
+
+	//events of children compensated before the saga are consumed by the cascade, handlers of the saga don't get them
+	handled, err := applyChildCompensation(sagaCtx, msg.Payload())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "compensating saga '%s' after its children", sagaId)
+	}
 
-	if handler, exists := saga.EventHandlers()[msg.Payload().GroupKind()]; exists {
+	handler, exists := saga.EventHandlers()[msg.Payload().GroupKind()]
 
+	if handled {
+		logger.Logf(log.DebugLevel, "event '%s' from message '%s' is applied to compensation of children", msgGK, msg.UID())
+	} else if exists {
 		if err := handler(sagaCtx); err != nil {
 			logger.Log(log.ErrorLevel, fmt.Sprintf("error handling saga event '%s' from message '%s': %s", msgGK, msg.UID(), err))
-			return errors.Wrapf(err, "handling event '%s' from message '%s'", msgGK, msg.UID())
+			return nil, nil, handlerErr{errors.Wrapf(err, "handling event '%s' from message '%s'", msgGK, msg.UID())}
+		}
+	} else if sagaPkg.FulfillExpectation(saga, msg) {
+		expecting, ok := saga.(sagaPkg.ExpectingSaga)
+		if !ok {
+			return nil, nil, errors.Errorf("saga '%s' expects event '%s', but doesn't implement saga.ExpectingSaga", sagaId, msgGK)
 		}
 
-		for _, delivery := range sagaCtx.Deliveries() {
-			e.sagaUIDSvc.AddSagaId(msg.Headers(), sagaInstance.UID())
-			outcomingMsg := message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
-
-			if err := execCtx.Send(outcomingMsg, delivery.Options...); err != nil {
-				logger.Log(log.ErrorLevel, fmt.Sprintf("error sending delivery for saga '%s'. Delivery: (%v). %s", sagaCtx.SagaInstance().UID(), delivery, err))
-				return errors.Wrapf(err, "sending delivery for saga '%s'. Delivery: (%v)", sagaCtx.SagaInstance().UID(), delivery)
-			}
+		if err := expecting.OnExpected(sagaCtx, msg.Payload()); err != nil {
+			logger.Log(log.ErrorLevel, fmt.Sprintf("error handling expected saga event '%s' from message '%s': %s", msgGK, msg.UID(), err))
+			return nil, nil, handlerErr{errors.Wrapf(err, "handling expected event '%s' from message '%s'", msgGK, msg.UID())}
 		}
 	} else {
 		logger.Logf(log.WarnLevel, "no handler defined for event '%s' from message '%s'", msgGK, msg.UID())
 	}
 
+	h.compensationFailed = wasCompensating && (sagaInstance.Status().Failed() || sagaInstance.Status().ChildCompensationFailed())
+
+	if err := e.scheduling().check(sagaCtx); err != nil {
+		return nil, nil, err
+	}
+
 	//write received event into history
 	sagaInstance.AddHistoryEvent(msg.Payload(), &sagaPkg.AddHistoryEvent{
 		TraceUID: msg.UID(),
@@ -113,18 +472,355 @@ func (e SagaEventsHandler) Handle(execCtx execution.MessageExecutionCtx) error {
 		sagaInstance.AddHistoryEvent(ev.Payload, nil)
 	}
 
-	if err := e.sagaStore.Update(ctx, sagaInstance); err != nil {
-		return errors.Wrapf(err, "saving saga's '%s' state to db", sagaInstance.UID())
+	//the size is checked before sending anything out, an oversized saga must not continue
+	if e.growthMonitor != nil {
+		if err := e.growthMonitor.Check(sagaInstance, logger); err != nil {
+			if _, ok := err.(sagaPkg.GrowthLimitErr); ok {
+				return nil, nil, e.failOversizedSaga(execCtx, sagaId, err)
+			}
+
+			return nil, nil, errors.WithStack(err)
+		}
 	}
 
-	//sending an event about saga completion to parent if it exists and to all regular handlers.
-	if sagaInstance.Status().Completed() {
-		//if parent exists - we should forward this event to parent saga
-		if sagaInstance.ParentID() != "" {
-			e.sagaUIDSvc.AddSagaId(msg.Headers(), sagaInstance.ParentID())
+	return sagaInstance, sagaCtx, nil
+}
+
+// sendFunc sends a message or writes it into the outbox
+type sendFunc func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error
+
+func (e SagaEventsHandler) sendDeliveries(h *eventHandling, sagaCtx sagaPkg.SagaContext, send sendFunc) error {
+	msg := h.msg
+
+	for _, delivery := range sagaCtx.Deliveries() {
+		e.sagaUIDSvc.AddSagaId(msg.Headers(), sagaCtx.SagaInstance().UID())
+		outcomingMsg := message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(msg.Headers()))
+		e.propagation.inject(h.execCtx, outcomingMsg)
+
+		if err := send(outcomingMsg, delivery.Options...); err != nil {
+			h.logger.Log(log.ErrorLevel, fmt.Sprintf("error sending delivery for saga '%s'. Delivery: (%v). %s", sagaCtx.SagaInstance().UID(), delivery, err))
+			return errors.Wrapf(err, "sending delivery for saga '%s'. Delivery: (%v)", sagaCtx.SagaInstance().UID(), delivery)
+		}
+	}
+
+	return nil
+}
+
+// publishDeliveries sends deliveries out, more than one of them are sent at once by sendBatch
+func (e SagaEventsHandler) publishDeliveries(h *eventHandling, sagaCtx sagaPkg.SagaContext) error {
+	deliveries := sagaCtx.Deliveries()
+	if len(deliveries) < 2 {
+		return e.sendDeliveries(h, sagaCtx, h.execCtx.Send)
+	}
+
+	e.sagaUIDSvc.AddSagaId(h.msg.Headers(), sagaCtx.SagaInstance().UID())
+
+	messages := make([]*message.OutcomingMessage, len(deliveries))
+	for i, delivery := range deliveries {
+		messages[i] = message.NewOutcomingMessage(delivery.Payload, message.WithHeaders(h.msg.Headers()))
+		e.propagation.inject(h.execCtx, messages[i])
+	}
+
+	if err := sendBatch(h.execCtx, deliveries, messages); err != nil {
+		h.logger.Logf(log.ErrorLevel, "error sending deliveries for saga '%s'. %s", sagaCtx.SagaInstance().UID(), err)
+		return errors.Wrapf(err, "sending deliveries for saga '%s'", sagaCtx.SagaInstance().UID())
+	}
+
+	return nil
+}
+
+// sendBatch sends messages of deliveries, consecutive deliveries dispatched without options are sent by a single
+// MessageExecutionCtx.SendBatch, so a saga emitting many commands from one event publishes them at once.
+// A delivery with options is sent on its own, options of a batch are shared by all its messages.
+func sendBatch(execCtx execution.MessageExecutionCtx, deliveries []*sagaPkg.Delivery, messages []*message.OutcomingMessage) error {
+	var batch []*message.OutcomingMessage
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := execCtx.SendBatch(batch)
+		batch = nil
+
+		return err
+	}
+
+	for i, delivery := range deliveries {
+		if len(delivery.Options) == 0 {
+			batch = append(batch, messages[i])
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if err := execCtx.Send(messages[i], delivery.Options...); err != nil {
+			return errors.Wrapf(err, "delivery (%v)", delivery)
+		}
+	}
+
+	return flush()
+}
+
+// notifyCompleted sends an event about saga completion or failed compensation to parent if it exists
+func (e SagaEventsHandler) notifyCompleted(h *eventHandling, sagaInstance sagaPkg.Instance) error {
+	if h.compensationFailed && sagaInstance.ParentID() != "" {
+		return e.notifyParent(h, sagaInstance, h.execCtx.Send)
+	}
+
+	if !sagaInstance.Status().Completed() {
+		return nil
+	}
 
-			return execCtx.Send(message.NewOutcomingMessage(&contracts.SagaChildCompletedEvent{SagaUID: sagaInstance.UID()}, message.WithHeaders(msg.Headers())))
+	e.metrics.SagaCompleted(sagaInstance.Saga().GroupKind())
+
+	//if parent exists - we should forward this event to parent saga
+	if sagaInstance.ParentID() != "" {
+		err := e.notifyParent(h, sagaInstance, h.execCtx.Send)
+		e.metrics.SagaChildCompleted(sagaInstance.Saga().GroupKind(), err)
+
+		return err
+	}
+
+	return nil
+}
+
+// notifyParent sends SagaChildCompletedEvent to the parent of a completed saga or SagaChildCompensationFailedEvent if compensation failed
+func (e SagaEventsHandler) notifyParent(h *eventHandling, sagaInstance sagaPkg.Instance, send sendFunc) error {
+	e.sagaUIDSvc.AddSagaId(h.msg.Headers(), sagaInstance.ParentID())
+
+	var ev message.Object = &contracts.SagaChildCompletedEvent{SagaUID: sagaInstance.UID()}
+	if h.compensationFailed {
+		ev = &contracts.SagaChildCompensationFailedEvent{SagaUID: sagaInstance.UID()}
+	}
+
+	outcomingMsg := message.NewOutcomingMessage(ev, message.WithHeaders(h.msg.Headers()))
+	e.propagation.inject(h.execCtx, outcomingMsg)
+
+	return send(outcomingMsg)
+}
+
+// update saves the saga, with the outbox deliveries and with the scheduler scheduled events are saved in the same transaction. An update failed with a transient error
+// is retried without handling the event again, a lost lease cancels h.ctx and stops retries.
+func (e SagaEventsHandler) update(h *eventHandling, sagaInstance sagaPkg.Instance, sagaCtx sagaPkg.SagaContext) error {
+	save := func() error {
+		if e.outbox != nil {
+			return e.updateWithOutbox(h, sagaInstance, sagaCtx)
+		}
+
+		if e.scheduler != nil {
+			return e.updateWithSchedule(h, sagaInstance, sagaCtx)
+		}
+
+		return e.sagaStore.Update(h.ctx, sagaInstance)
+	}
+
+	err := save()
+	retries := 0
+
+	for ; err != nil && retries < e.maxUpdateRetries && sagaPkg.IsTransientErr(err); retries++ {
+		h.logger.Logf(log.WarnLevel, "transient error saving saga '%s', retry %d of %d in %s. %s", sagaInstance.UID(), retries+1, e.maxUpdateRetries, e.updateBackoff, err)
+
+		timer := time.NewTimer(e.updateBackoff)
+
+		select {
+		case <-h.ctx.Done():
+			timer.Stop()
+			e.metrics.UpdateRetried(sagaInstance.Saga().GroupKind(), err)
+
+			return errors.Wrapf(err, "retrying update stopped: %s", h.ctx.Err())
+		case <-timer.C:
+		}
+
+		err = save()
+	}
+
+	if retries > 0 {
+		e.metrics.UpdateRetried(sagaInstance.Saga().GroupKind(), err)
+	}
+
+	return err
+}
+
+// updateWithOutbox saves the saga together with its deliveries and the event for the parent saga written into the outbox
+func (e SagaEventsHandler) updateWithOutbox(h *eventHandling, sagaInstance sagaPkg.Instance, sagaCtx sagaPkg.SagaContext) error {
+	store, ok := e.sagaStore.(sagaPkg.TransactionalStore)
+	if !ok {
+		return errors.Errorf("outbox requires saga.TransactionalStore, %T isn't one", e.sagaStore)
+	}
+
+	return store.UpdateTx(h.ctx, sagaInstance, func(ctx context.Context, tx *sql.Tx) error {
+		add := func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			return e.outbox.Add(ctx, tx, sagaInstance.UID(), msg, options...)
+		}
+
+		if err := e.sendDeliveries(h, sagaCtx, add); err != nil {
+			return err
+		}
+
+		if (sagaInstance.Status().Completed() || h.compensationFailed) && sagaInstance.ParentID() != "" {
+			if err := e.notifyParent(h, sagaInstance, add); err != nil {
+				return err
+			}
 		}
+
+		return e.scheduling().save(ctx, tx, h.execCtx, sagaCtx)
+	})
+}
+
+// updateWithSchedule saves the saga together with events it scheduled
+func (e SagaEventsHandler) updateWithSchedule(h *eventHandling, sagaInstance sagaPkg.Instance, sagaCtx sagaPkg.SagaContext) error {
+	store, ok := e.sagaStore.(sagaPkg.TransactionalStore)
+	if !ok {
+		return errors.Errorf("scheduler requires saga.TransactionalStore, %T isn't one", e.sagaStore)
+	}
+
+	return store.UpdateTx(h.ctx, sagaInstance, func(ctx context.Context, tx *sql.Tx) error {
+		return e.scheduling().save(ctx, tx, h.execCtx, sagaCtx)
+	})
+}
+
+func (e SagaEventsHandler) scheduling() scheduling {
+	return scheduling{scheduler: e.scheduler, sagaUIDSvc: e.sagaUIDSvc, propagation: e.propagation}
+}
+
+// outboxCompleted records metrics of the completed saga once the event for its parent is in the outbox
+func (e SagaEventsHandler) outboxCompleted(sagaInstance sagaPkg.Instance) {
+	if !sagaInstance.Status().Completed() {
+		return
+	}
+
+	e.metrics.SagaCompleted(sagaInstance.Saga().GroupKind())
+
+	if sagaInstance.ParentID() != "" {
+		e.metrics.SagaChildCompleted(sagaInstance.Saga().GroupKind(), nil)
+	}
+}
+
+// retry sends the message back to be handled again after the backoff, once attempts are exhausted the message is dropped
+// and SagaHandlingFailedEvent is sent instead
+func (e SagaEventsHandler) retry(h *eventHandling, handlingErr error) error {
+	attempts := h.attempts + 1
+
+	if attempts < e.maxAttempts {
+		var (
+			backoff time.Duration
+			opts    []endpoint.DeliveryOption
+		)
+
+		if e.backoff != nil {
+			backoff = e.backoff(attempts)
+		}
+
+		if backoff > 0 {
+			opts = append(opts, endpoint.WithDelay(backoff))
+		}
+
+		h.msg.Headers().SetHandlingAttempts(attempts)
+
+		if err := h.execCtx.Return(opts...); err != nil {
+			return errors.Wrapf(err, "returning message '%s' to handle it again", h.msg.UID())
+		}
+
+		h.logger.Logf(log.WarnLevel, "attempt %d of %d to handle message '%s' by saga '%s' failed, retrying in %s", attempts, e.maxAttempts, h.msg.UID(), h.sagaId, backoff)
+
+		return nil
+	}
+
+	failedEv := &contracts.SagaHandlingFailedEvent{
+		SagaUID:    h.sagaId,
+		MessageUID: h.msg.UID(),
+		Payload:    h.msg.Payload(),
+		Attempts:   attempts,
+		Reason:     handlingErr.Error(),
+	}
+
+	outcomingMsg := message.NewOutcomingMessage(failedEv, message.WithHeaders(h.msg.Headers()))
+	e.propagation.inject(h.execCtx, outcomingMsg)
+
+	if err := h.execCtx.Send(outcomingMsg); err != nil {
+		return errors.Wrapf(err, "sending SagaHandlingFailedEvent for message '%s'", h.msg.UID())
+	}
+
+	h.logger.Logf(log.ErrorLevel, "saga '%s' failed to handle message '%s' %d times, dropped it", h.sagaId, h.msg.UID(), attempts)
+
+	return nil
+}
+
+// applyChildCompensation records an outcome of compensation of a child if the saga waits for it, true is returned then
+func applyChildCompensation(sagaCtx sagaPkg.SagaContext, ev message.Object) (bool, error) {
+	sagaInstance := sagaCtx.SagaInstance()
+
+	if !sagaInstance.Status().CompensatingChildren() {
+		return false, nil
+	}
+
+	switch childEv := ev.(type) {
+	case *contracts.SagaChildCompletedEvent:
+		return sagaInstance.ChildCompensated(sagaCtx, childEv.SagaUID, true)
+	case *contracts.SagaChildCompensationFailedEvent:
+		return sagaInstance.ChildCompensated(sagaCtx, childEv.SagaUID, false)
+	default:
+		return false, nil
+	}
+}
+
+// isApplied tells whether the message was already handled by the saga instance
+func isApplied(sagaInstance sagaPkg.Instance, msgUID string) bool {
+	for _, ev := range sagaInstance.HistoryEvents() {
+		if ev.TraceUID == msgUID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withFencingToken passes the fencing token of the lock to the store, so it rejects the update if the lock has expired meanwhile
+func withFencingToken(ctx context.Context, lock sagaMutex.Lock) context.Context {
+	if token, ok := sagaMutex.FencingToken(lock); ok && token > 0 {
+		return sagaPkg.WithFencingToken(ctx, token)
+	}
+
+	return ctx
+}
+
+// checkLease returns an error if the lease of saga's lock is lost, nothing must be sent or saved then
+func checkLease(lease context.Context, sagaId string) error {
+	if lease == nil || lease.Err() == nil {
+		return nil
+	}
+
+	return errors.Wrapf(lease.Err(), "lease of saga '%s' lock is lost, aborting", sagaId)
+}
+
+// failOversizedSaga reloads the last stored state of the saga and marks it as failed on the received event,
+// so the oversized state never reaches the store
+func (e SagaEventsHandler) failOversizedSaga(execCtx execution.MessageExecutionCtx, sagaId string, limitErr error) error {
+	msg := execCtx.Message()
+	ctx := execCtx.Context()
+
+	execCtx.Logger().Logf(log.ErrorLevel, "saga '%s' is marked as failed: %s", sagaId, limitErr)
+
+	sagaInstance, err := e.sagaStore.GetById(ctx, sagaId)
+	if err != nil {
+		return errors.Wrapf(err, "retrieving saga '%s' from store", sagaId)
+	}
+
+	if sagaInstance == nil {
+		return errors.Errorf("saga '%s' not found", sagaId)
+	}
+
+	sagaInstance.Fail(msg.Payload())
+	sagaInstance.AddHistoryEvent(msg.Payload(), &sagaPkg.AddHistoryEvent{
+		TraceUID: msg.UID(),
+		Origin:   msg.Origin(),
+	})
+
+	if err := e.sagaStore.Update(ctx, sagaInstance); err != nil {
+		return errors.Wrapf(err, "saving failed saga's '%s' state to db", sagaInstance.UID())
 	}
 
 	return nil
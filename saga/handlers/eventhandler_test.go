@@ -2,9 +2,16 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/stretchr/testify/require"
 
 	"github.com/go-foreman/foreman/saga/contracts"
@@ -13,11 +20,14 @@ import (
 
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/saga"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	messageMock "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
 	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
 	sagaMocks "github.com/go-foreman/foreman/testing/mocks/saga"
 	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
@@ -81,7 +91,8 @@ func TestEventHandler(t *testing.T) {
 		sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(lockMock, nil).Times(times)
 		lockMock.EXPECT().Release(gomock.Any()).Return(errors.New("error releasing mutex")).Times(times)
 
-		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(sagaInstance, nil).Times(times)
+		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(sagaInstance, nil)
+		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(saga.NewSagaInstance(sagaID, "777", sagaObj), nil)
 		sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(nil)
 
 		idService.EXPECT().AddSagaId(receivedMsg.Headers(), sagaID).Return().Times(times)
@@ -110,6 +121,33 @@ func TestEventHandler(t *testing.T) {
 		assert.Contains(t, err.Error(), "error sending msg")
 	})
 
+	t.Run("message is already applied", func(t *testing.T) {
+		sagaID := "123"
+		ev := &DataContract{
+			ObjectMeta: evObjMeta,
+			Message:    "something happened",
+		}
+		receivedMsg := message.NewReceivedMessage("msg-1", ev, message.Headers{}, time.Now(), "origin")
+
+		sagaInstance := saga.NewSagaInstance(sagaID, "777", sagaObj)
+		sagaInstance.AddHistoryEvent(ev, &saga.AddHistoryEvent{TraceUID: "msg-1", Origin: "origin"})
+
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger)
+
+		idService.EXPECT().ExtractSagaUID(receivedMsg.Headers()).Return(sagaID, nil)
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(gomock.Any()).Return(nil)
+
+		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(sagaInstance, nil)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.Len(t, sagaInstance.HistoryEvents(), 1)
+	})
+
 	t.Run("success with parent id", func(t *testing.T) {
 		defer testLogger.Clear()
 
@@ -310,4 +348,1230 @@ func TestEventHandler(t *testing.T) {
 		assert.Error(t, err)
 		assert.EqualError(t, err, "saga '123' has already completed")
 	})
+
+	t.Run("lease of the lock is lost while handling", func(t *testing.T) {
+		sagaID := "123"
+		ev := &DataContract{
+			ObjectMeta: evObjMeta,
+			Message:    "something happened",
+		}
+		receivedMsg := message.NewReceivedMessage(sagaID, ev, message.Headers{}, time.Now(), "origin")
+
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).Times(2)
+		idService.EXPECT().ExtractSagaUID(receivedMsg.Headers()).Return(sagaID, nil)
+
+		leaseCtx, cancelLease := context.WithCancel(ctx)
+		lockMock := mutex.NewMockLeasedLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(lockMock, nil)
+		lockMock.EXPECT().Context().Return(leaseCtx)
+		lockMock.EXPECT().Release(gomock.Any()).Return(nil)
+
+		sagaInstance := saga.NewSagaInstance(sagaID, "777", sagaObj)
+
+		sagaStoreMock.
+			EXPECT().
+			GetById(leaseCtx, sagaID).
+			DoAndReturn(func(ctx context.Context, sagaID string) (saga.Instance, error) {
+				cancelLease()
+				return sagaInstance, nil
+			})
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.EqualError(t, err, "lease of saga '123' lock is lost, aborting: context canceled")
+	})
+
+	t.Run("fencing token of the lock is passed to the store", func(t *testing.T) {
+		sagaID := "123"
+		ev := &DataContract{
+			ObjectMeta: evObjMeta,
+			Message:    "something happened",
+		}
+		receivedMsg := message.NewReceivedMessage(sagaID, ev, message.Headers{}, time.Now(), "origin")
+		sagaInstance := saga.NewSagaInstance(sagaID, "777", sagaObj)
+
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+		msgExecutionCtx.EXPECT().Context().Return(ctx)
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).Times(2)
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+		idService.EXPECT().ExtractSagaUID(receivedMsg.Headers()).Return(sagaID, nil)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), sagaID)
+
+		sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(&fencedLock{token: 5}, nil)
+		sagaStoreMock.EXPECT().GetById(gomock.Any(), sagaID).Return(sagaInstance, nil)
+		sagaStoreMock.
+			EXPECT().
+			Update(gomock.Any(), sagaInstance).
+			DoAndReturn(func(ctx context.Context, sagaInstance saga.Instance) error {
+				token, ok := saga.FencingTokenFromContext(ctx)
+				assert.True(t, ok)
+				assert.Equal(t, int64(5), token)
+
+				return saga.WithStaleFencingTokenErr(errors.New("saga 123 was saved under fencing token 6, the lock with token 5 has expired"))
+			})
+
+		err := handler.Handle(msgExecutionCtx)
+		assert.IsType(t, saga.StaleFencingTokenErr{}, errors.Cause(err))
+	})
+}
+
+// fencedLock is a lock of a mutex with fencing tokens, see mutex.FencedLock
+type fencedLock struct {
+	token int64
+}
+
+func (l *fencedLock) FencingToken() int64 {
+	return l.token
+}
+
+func (l *fencedLock) Release(ctx context.Context) error {
+	return nil
+}
+
+func TestEventHandlerGrowthLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	idService := sagaMocks.NewMockSagaUIDService(ctrl)
+	marshallerMock := messageMock.NewMockMarshaller(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	testLogger := log.NewNilLogger()
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+	ctx := context.Background()
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &DataContract{})
+
+	monitor := saga.NewGrowthMonitor(marshallerMock, saga.WithPayloadSizeLimits(10, 20))
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithGrowthMonitor(monitor))
+
+	sagaID := "123"
+	ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "something happened"}
+	sagaMeta := message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}
+	receivedMsg := message.NewReceivedMessage(sagaID, ev, message.Headers{}, time.Now(), "origin")
+
+	expectLoaded := func(sagaInstance saga.Instance) {
+		msgExecutionCtx.EXPECT().Message().Return(receivedMsg).AnyTimes()
+		msgExecutionCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		msgExecutionCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		idService.EXPECT().ExtractSagaUID(receivedMsg.Headers()).Return(sagaID, nil)
+
+		lockMock := mutex.NewMockLock(ctrl)
+		sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(lockMock, nil)
+		lockMock.EXPECT().Release(gomock.Any()).Return(nil)
+
+		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(sagaInstance, nil)
+	}
+
+	t.Run("payload above warning threshold", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaObj := &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: sagaMeta}, Data: "data"}
+		sagaInstance := saga.NewSagaInstance(sagaID, "", sagaObj)
+		expectLoaded(sagaInstance)
+
+		marshallerMock.EXPECT().Marshal(sagaObj).Return(make([]byte, 15), nil)
+		idService.EXPECT().AddSagaId(receivedMsg.Headers(), sagaID)
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(nil)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		testLogger.AssertContainsSubstr(t, "payload of saga '123' (example.SagaExample) is 15 bytes, warning threshold is 10")
+	})
+
+	t.Run("payload above hard limit fails the saga and keeps stored state", func(t *testing.T) {
+		defer testLogger.Clear()
+
+		sagaObj := &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: sagaMeta}, Data: "data"}
+		sagaInstance := saga.NewSagaInstance(sagaID, "", sagaObj)
+		expectLoaded(sagaInstance)
+
+		marshallerMock.EXPECT().Marshal(sagaObj).Return(make([]byte, 25), nil)
+
+		storedInstance := saga.NewSagaInstance(sagaID, "", &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: sagaMeta}, Data: "stored"})
+		sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(storedInstance, nil)
+		sagaStoreMock.EXPECT().Update(ctx, storedInstance).Return(nil)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+		assert.True(t, storedInstance.Status().Failed())
+		assert.Equal(t, ev, storedInstance.Status().FailedOnEvent())
+		require.Len(t, storedInstance.HistoryEvents(), 1)
+		testLogger.AssertContainsSubstr(t, "saga '123' is marked as failed: payload of saga '123' (example.SagaExample) is 25 bytes, limit is 20")
+
+		largest := monitor.Stats()["example.SagaExample"].Largest
+		require.Len(t, largest, 1)
+		assert.Equal(t, 25, largest[0].PayloadSize)
+	})
+}
+
+func TestEventHandlerSagaVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	idService := sagaMocks.NewMockSagaUIDService(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	testLogger := log.NewNilLogger()
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+	ctx := context.Background()
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &DataContract{})
+
+	versions := saga.NewVersionRegistry()
+	require.NoError(t, versions.Register(func(startCmd *contracts.StartSagaCommand) int {
+		return 1
+	}, scheme.GroupKind{Group: g, Kind: "SagaExampleV2"}, scheme.GroupKind{Group: g, Kind: "SagaExampleV3"}))
+
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithVersions(versions))
+
+	sagaID := "123"
+	ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "something happened"}
+	receivedMsg := message.NewReceivedMessage(sagaID, ev, message.Headers{}, time.Now(), "origin")
+
+	msgExecutionCtx.EXPECT().Message().Return(receivedMsg)
+	msgExecutionCtx.EXPECT().Context().Return(ctx)
+	msgExecutionCtx.EXPECT().Logger().Return(testLogger)
+
+	idService.EXPECT().ExtractSagaUID(receivedMsg.Headers()).Return(sagaID, nil)
+
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(ctx, sagaID).Return(lockMock, nil)
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil)
+
+	sagaObj := &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}}}
+	sagaStoreMock.EXPECT().GetById(ctx, sagaID).Return(saga.NewSagaInstance(sagaID, "", sagaObj), nil)
+
+	err := handler.Handle(msgExecutionCtx)
+	require.Error(t, err)
+	assert.IsType(t, saga.VersionMismatchErr{}, err)
+	assert.EqualError(t, err, "saga '123' was started with 'example.SagaExample' which is no longer registered, keep registering the version until all its instances end")
+	testLogger.AssertContainsSubstr(t, "no longer registered")
+}
+
+func TestEventHandlerMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	schemeRegistry.AddKnownTypes("example", &DataContract{})
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+
+	registry := prometheus.NewRegistry()
+	metrics, err := saga.NewMetrics(registry)
+	require.NoError(t, err)
+
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithMetrics(metrics))
+
+	sagaObj := &SagaExample{handleCallback: func(sagaInst saga.Instance) {
+		sagaInst.Complete()
+	}}
+	sagaObj.SetGroupKind(&scheme.GroupKind{Group: "example", Kind: "SagaExample"})
+	sagaInstance := saga.NewSagaInstance("123", "777", sagaObj)
+
+	headers := message.Headers{}
+	idService.AddSagaId(headers, "123")
+	ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: "example"}}}
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+	msgExecutionCtx.EXPECT().Message().Return(message.NewReceivedMessage("msg-1", ev, headers, time.Now(), "origin")).AnyTimes()
+	msgExecutionCtx.EXPECT().Context().Return(ctx).AnyTimes()
+	msgExecutionCtx.EXPECT().Logger().Return(log.NewNilLogger()).AnyTimes()
+
+	sagaMutexMock.EXPECT().Lock(ctx, "123").Return(lockMock, nil).Times(2)
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).Times(2)
+	sagaStoreMock.EXPECT().GetById(ctx, "123").Return(sagaInstance, nil)
+	sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(nil)
+	msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+	msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(errors.New("broker is down"))
+
+	assert.Error(t, handler.Handle(msgExecutionCtx), "SagaChildCompletedEvent isn't sent")
+
+	// the completed saga has put id of the parent into headers
+	idService.AddSagaId(headers, "123")
+	sagaStoreMock.EXPECT().GetById(ctx, "123").Return(nil, nil)
+	assert.Error(t, handler.Handle(msgExecutionCtx))
+
+	expected := `
+# HELP foreman_saga_events_total Number of saga completion events.
+# TYPE foreman_saga_events_total counter
+foreman_saga_events_total{event="SagaChildCompleted",outcome="error",saga="example.SagaExample"} 1
+foreman_saga_events_total{event="SagaCompleted",outcome="success",saga="example.SagaExample"} 1
+# HELP foreman_saga_in_flight Number of sagas being handled.
+# TYPE foreman_saga_in_flight gauge
+foreman_saga_in_flight{saga="example.SagaExample"} 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "foreman_saga_events_total", "foreman_saga_in_flight"))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	observed := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "foreman_saga_event_handling_duration_seconds" {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			observed[m.GetLabel()[1].GetValue()+"/"+m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+		}
+	}
+
+	assert.Equal(t, map[string]uint64{"example.SagaExample/error": 1, "unknown/error": 1}, observed)
+}
+
+func TestEventHandlerUpdateRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	schemeRegistry.AddKnownTypes("example", &DataContract{})
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+
+	registry := prometheus.NewRegistry()
+	metrics, err := saga.NewMetrics(registry)
+	require.NoError(t, err)
+
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithMetrics(metrics), WithUpdateRetry(2, time.Millisecond))
+
+	headers := message.Headers{}
+	idService.AddSagaId(headers, "123")
+	ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: "example"}}}
+
+	msgExecutionCtx := execution.NewMockMessageExecutionCtx(ctrl)
+	msgExecutionCtx.EXPECT().Message().Return(message.NewReceivedMessage("msg-1", ev, headers, time.Now(), "origin")).AnyTimes()
+	msgExecutionCtx.EXPECT().Context().Return(ctx).AnyTimes()
+	msgExecutionCtx.EXPECT().Logger().Return(log.NewNilLogger()).AnyTimes()
+
+	sagaMutexMock.EXPECT().Lock(ctx, "123").Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	loadSaga := func() saga.Instance {
+		sagaObj := &SagaExample{}
+		sagaObj.SetGroupKind(&scheme.GroupKind{Group: "example", Kind: "SagaExample"})
+		sagaInstance := saga.NewSagaInstance("123", "", sagaObj)
+		sagaStoreMock.EXPECT().GetById(ctx, "123").Return(sagaInstance, nil)
+
+		return sagaInstance
+	}
+
+	transientErr := errors.Wrap(driver.ErrBadConn, "committing transaction")
+
+	t.Run("update is retried without handling the event again", func(t *testing.T) {
+		sagaInstance := loadSaga()
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+
+		gomock.InOrder(
+			sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(transientErr),
+			sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(nil),
+		)
+
+		require.NoError(t, handler.Handle(msgExecutionCtx))
+	})
+
+	t.Run("message is redelivered once retries are exhausted", func(t *testing.T) {
+		sagaInstance := loadSaga()
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(transientErr).Times(3)
+
+		err := handler.Handle(msgExecutionCtx)
+		require.Error(t, err)
+		assert.Equal(t, driver.ErrBadConn, errors.Cause(err))
+	})
+
+	t.Run("other errors aren't retried", func(t *testing.T) {
+		sagaInstance := loadSaga()
+		msgExecutionCtx.EXPECT().Send(gomock.Any()).Return(nil)
+		sagaStoreMock.EXPECT().Update(ctx, sagaInstance).Return(errors.New("data too long"))
+
+		assert.EqualError(t, handler.Handle(msgExecutionCtx), "saving saga's '123' state to db: data too long")
+	})
+
+	expected := `
+# HELP foreman_saga_update_retries_total Number of saga updates retried after transient store errors.
+# TYPE foreman_saga_update_retries_total counter
+foreman_saga_update_retries_total{outcome="error",saga="example.SagaExample"} 1
+foreman_saga_update_retries_total{outcome="success",saga="example.SagaExample"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "foreman_saga_update_retries_total"))
+}
+
+// loadBarrier makes the first loads of the saga wait for each other, so concurrent handlers start from the same version
+type loadBarrier struct {
+	*marshallingStore
+	loaded sync.WaitGroup
+	mutex  sync.Mutex
+	loads  int
+}
+
+func (s *loadBarrier) GetById(ctx context.Context, sagaId string) (saga.Instance, error) {
+	instance, err := s.marshallingStore.GetById(ctx, sagaId)
+
+	s.mutex.Lock()
+	s.loads++
+	first := s.loads <= 2
+	s.mutex.Unlock()
+
+	if first {
+		s.loaded.Done()
+		s.loaded.Wait()
+	}
+
+	return instance, err
+}
+
+func TestEventHandlerOptimisticLocking(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &SagaExample{}, &DataContract{})
+
+	marshaller := message.NewJsonMarshaller(schemeRegistry)
+	barrier := &loadBarrier{marshallingStore: &marshallingStore{marshaller: marshaller, sagas: make(map[string]*marshalledSaga)}}
+	barrier.loaded.Add(2)
+	outbox := &memoryOutbox{}
+	store := &versionedTxStore{Store: barrier, outbox: outbox}
+
+	testLogger := log.NewNilLogger()
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+	sagaID := "123"
+
+	sagaObj := &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}}}
+	require.NoError(t, store.Create(ctx, saga.NewSagaInstance(sagaID, "", sagaObj)))
+
+	// the mutex isn't used in optimistic mode, any call fails the test
+	handler := NewEventsHandler(store, mutex.NewMockMutex(ctrl), schemeRegistry, idService, WithOptimisticLocking(1), WithOutbox(outbox))
+
+	// Send isn't expected, deliveries are written into the outbox in the transaction of the update
+	receive := func(uid string) *execution.MockMessageExecutionCtx {
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: uid}
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+
+	for i, uid := range []string{"msg-1", "msg-2"} {
+		wg.Add(1)
+		go func(i int, execCtx *execution.MockMessageExecutionCtx) {
+			defer wg.Done()
+			errs[i] = handler.Handle(execCtx)
+		}(i, receive(uid))
+	}
+
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	assert.Equal(t, 3, barrier.loads, "the handler which lost the race reloads the saga once")
+	assert.Len(t, outbox.pending, 2, "deliveries of the attempt which lost the race are rolled back with it")
+
+	stored, err := store.GetById(ctx, sagaID)
+	require.NoError(t, err)
+	assert.True(t, isApplied(stored, "msg-1"))
+	assert.True(t, isApplied(stored, "msg-2"))
+	assert.Equal(t, 2, stored.Version())
+
+	t.Run("deliveries are sent after the endpoint failed and the event was redelivered", func(t *testing.T) {
+		endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+		endpointInstance.EXPECT().Name().Return("saga-endpoint").AnyTimes()
+		router := endpoint.NewRouter()
+		router.RegisterEndpoint(endpointInstance, &DataContract{})
+
+		relayCtx, cancel := context.WithCancel(ctx)
+		endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			cancel()
+			return errors.New("broker is down")
+		})
+		require.NoError(t, saga.NewOutboxRelay(outbox, router, time.Millisecond*10, 10, testLogger).Run(relayCtx))
+
+		require.NoError(t, handler.Handle(receive("msg-1")))
+		assert.Len(t, outbox.pending, 2, "the redelivered event is applied already, its deliveries stay in the outbox")
+
+		relayCtx, cancel = context.WithCancel(ctx)
+		endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).Return(nil)
+		endpointInstance.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			cancel()
+			return nil
+		})
+		require.NoError(t, saga.NewOutboxRelay(outbox, router, time.Millisecond*10, 10, testLogger).Run(relayCtx))
+
+		assert.Empty(t, outbox.pending)
+		assert.Len(t, outbox.sent, 2)
+	})
+
+	t.Run("conflicts over the retries are returned", func(t *testing.T) {
+		conflictingStore := sagaMocks.NewMockStore(ctrl)
+		handler := NewEventsHandler(&versionedTxStore{Store: conflictingStore, outbox: outbox}, mutex.NewMockMutex(ctrl), schemeRegistry, idService, WithOptimisticLocking(1), WithOutbox(outbox))
+
+		conflictingStore.EXPECT().GetById(ctx, sagaID).DoAndReturn(func(ctx context.Context, sagaId string) (saga.Instance, error) {
+			return saga.NewSagaInstance(sagaID, "", &SagaExample{BaseSaga: sagaObj.BaseSaga}), nil
+		}).Times(2)
+		conflictingStore.EXPECT().Update(ctx, gomock.Any()).Return(saga.WithVersionConflictErr(errors.New("conflict"))).Times(2)
+
+		err := handler.Handle(receive("msg-3"))
+		require.Error(t, err)
+		assert.IsType(t, saga.VersionConflictErr{}, errors.Cause(err))
+		assert.EqualError(t, err, "saving saga's '123' state to db: conflict")
+		assert.Len(t, outbox.pending, 0)
+	})
+
+	t.Run("outbox is required", func(t *testing.T) {
+		handler := NewEventsHandler(store, mutex.NewMockMutex(ctrl), schemeRegistry, idService, WithOptimisticLocking(1))
+
+		assert.EqualError(t, handler.Handle(receive("msg-4")), "optimistic locking requires the outbox, see WithOutbox")
+	})
+}
+
+// memoryOutbox keeps messages in memory, messages added in a transaction of versionedTxStore are kept only if it commits
+type memoryOutbox struct {
+	mutex   sync.Mutex
+	lastID  int64
+	pending []saga.OutboxMessage
+	sent    []*message.OutcomingMessage
+}
+
+type stagedOutboxKey struct{}
+
+func (o *memoryOutbox) Add(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	staged := ctx.Value(stagedOutboxKey{}).(*[]saga.OutboxMessage)
+	*staged = append(*staged, saga.OutboxMessage{SagaUID: sagaId, Message: msg, Options: options})
+
+	return nil
+}
+
+func (o *memoryOutbox) commit(staged []saga.OutboxMessage) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, outboxMsg := range staged {
+		o.lastID++
+		outboxMsg.ID = o.lastID
+		o.pending = append(o.pending, outboxMsg)
+	}
+}
+
+func (o *memoryOutbox) Pending(ctx context.Context, limit int) ([]saga.OutboxMessage, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.pending) < limit {
+		limit = len(o.pending)
+	}
+
+	return append([]saga.OutboxMessage(nil), o.pending[:limit]...), nil
+}
+
+func (o *memoryOutbox) MarkSent(ctx context.Context, id int64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for i, outboxMsg := range o.pending {
+		if outboxMsg.ID == id {
+			o.sent = append(o.sent, outboxMsg.Message)
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (o *memoryOutbox) MarkFailed(ctx context.Context, id int64, sendErr error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for i := range o.pending {
+		if o.pending[i].ID == id {
+			o.pending[i].Attempts++
+		}
+	}
+
+	return nil
+}
+
+func (o *memoryOutbox) Stats(ctx context.Context) (saga.OutboxStats, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return saga.OutboxStats{Pending: len(o.pending)}, nil
+}
+
+// versionedTxStore commits writes of the transaction into the outbox only if the versioned update succeeds, as the sql store does
+type versionedTxStore struct {
+	saga.Store
+	outbox *memoryOutbox
+}
+
+func (s *versionedTxStore) UpdateTx(ctx context.Context, sagaInstance saga.Instance, inTx saga.TxFunc) error {
+	var staged []saga.OutboxMessage
+
+	if err := inTx(context.WithValue(ctx, stagedOutboxKey{}, &staged), nil); err != nil {
+		return err
+	}
+
+	if err := s.Update(ctx, sagaInstance); err != nil {
+		return err
+	}
+
+	s.outbox.commit(staged)
+
+	return nil
+}
+
+func (s *versionedTxStore) DB() (*sagaSql.DB, saga.SQLDriver) {
+	return nil, saga.PGDriver
+}
+
+type fanOutSaga struct {
+	SagaExample
+}
+
+func (s *fanOutSaga) Init() {
+	s.AddEventHandler(&DataContract{}, s.fanOut)
+}
+
+func (s *fanOutSaga) fanOut(sagaCtx saga.SagaContext) error {
+	sagaCtx.Dispatch(&DataContract{Message: "first"})
+	sagaCtx.Dispatch(&DataContract{Message: "second"})
+	sagaCtx.Dispatch(&DataContract{Message: "delayed"}, endpoint.WithDelay(time.Minute))
+	sagaCtx.Dispatch(&DataContract{Message: "third"})
+
+	return nil
+}
+
+func TestEventHandlerBatchSending(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &fanOutSaga{}, &DataContract{})
+
+	store := &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}
+	idService := saga.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+	ctx := context.Background()
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	handler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService)
+
+	receive := func(sagaID string) *execution.MockMessageExecutionCtx {
+		sagaObj := &fanOutSaga{SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "fanOutSaga", Group: g.String()}}}}}
+		require.NoError(t, store.Create(ctx, saga.NewSagaInstance(sagaID, "", sagaObj)))
+
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "placed"}
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage("msg-"+sagaID, ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx
+	}
+
+	payloads := func(messages []*message.OutcomingMessage) []string {
+		var sent []string
+		for _, msg := range messages {
+			sent = append(sent, msg.Payload().(*DataContract).Message)
+		}
+
+		return sent
+	}
+
+	t.Run("deliveries without options are sent in batches", func(t *testing.T) {
+		execCtx := receive("1")
+
+		gomock.InOrder(
+			execCtx.EXPECT().SendBatch(gomock.Any()).DoAndReturn(func(messages []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, []string{"first", "second"}, payloads(messages))
+				return nil
+			}),
+			execCtx.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, "delayed", msg.Payload().(*DataContract).Message)
+				return nil
+			}),
+			execCtx.EXPECT().SendBatch(gomock.Any()).DoAndReturn(func(messages []*message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, []string{"third"}, payloads(messages))
+				return nil
+			}),
+		)
+
+		require.NoError(t, handler.Handle(execCtx))
+	})
+
+	t.Run("failed batch is returned", func(t *testing.T) {
+		execCtx := receive("2")
+
+		execCtx.
+			EXPECT().
+			SendBatch(gomock.Any()).
+			Return(endpoint.WithBatchSendErr(errors.New("1 of 2 messages weren't sent"), map[string]error{"uid": errors.New("nacked")}))
+
+		err := handler.Handle(execCtx)
+		require.Error(t, err)
+		assert.IsType(t, endpoint.BatchSendErr{}, errors.Cause(err))
+		assert.EqualError(t, err, "sending deliveries for saga '2': 1 of 2 messages weren't sent")
+	})
+}
+
+func TestEventHandlerOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &SagaExample{}, &DataContract{})
+
+	store := &transactionalStore{marshallingStore: &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}}
+	outboxMock := sagaMocks.NewMockOutbox(ctrl)
+	testLogger := log.NewNilLogger()
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+	sagaID := "123"
+
+	sagaObj := &SagaExample{BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}}}
+	require.NoError(t, store.Create(ctx, saga.NewSagaInstance(sagaID, "", sagaObj)))
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), sagaID).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	handler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService, WithOutbox(outboxMock))
+
+	// Send isn't expected, deliveries are sent by the relay
+	receive := func(uid string) *execution.MockMessageExecutionCtx {
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: uid}
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx
+	}
+
+	t.Run("deliveries are written in the transaction of the update", func(t *testing.T) {
+		outboxMock.
+			EXPECT().
+			Add(gomock.Any(), store.tx, sagaID, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &DataContract{Message: "handle"}, msg.Payload())
+				extracted, err := idService.ExtractSagaUID(msg.Headers())
+				require.NoError(t, err)
+				assert.Equal(t, sagaID, extracted)
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(receive("msg-1")))
+
+		stored, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+		assert.True(t, isApplied(stored, "msg-1"))
+	})
+
+	t.Run("saga isn't saved if the outbox fails", func(t *testing.T) {
+		outboxMock.EXPECT().Add(gomock.Any(), store.tx, sagaID, gomock.Any()).Return(errors.New("connection lost"))
+
+		err := handler.Handle(receive("msg-2"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection lost")
+
+		stored, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+		assert.False(t, isApplied(stored, "msg-2"))
+	})
+
+	t.Run("store isn't transactional", func(t *testing.T) {
+		handler := NewEventsHandler(store.marshallingStore, sagaMutexMock, schemeRegistry, idService, WithOutbox(outboxMock))
+
+		err := handler.Handle(receive("msg-3"))
+		assert.EqualError(t, err, "saving saga's '123' state to db: outbox requires saga.TransactionalStore, *handlers.marshallingStore isn't one")
+	})
+}
+
+func TestEventHandlerScheduler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &schedulingSaga{}, &DataContract{})
+
+	store := &transactionalStore{marshallingStore: &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}}
+	schedulerMock := sagaMocks.NewMockScheduler(ctrl)
+	testLogger := log.NewNilLogger()
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+	sagaID := "123"
+
+	sagaObj := &schedulingSaga{BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "schedulingSaga", Group: g.String()}}}}
+	require.NoError(t, store.Create(ctx, saga.NewSagaInstance(sagaID, "", sagaObj)))
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), sagaID).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	handler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService, WithScheduler(schedulerMock))
+
+	receive := func(uid, data string) *execution.MockMessageExecutionCtx {
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: data}
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+		execCtx.EXPECT().Send(gomock.Any()).Return(nil).AnyTimes()
+
+		return execCtx
+	}
+
+	t.Run("scheduled event is written in the transaction of the update", func(t *testing.T) {
+		schedulerMock.
+			EXPECT().
+			Schedule(gomock.Any(), store.tx, sagaID, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, fireAt time.Time) error {
+				assert.Equal(t, &DataContract{Message: "reminder"}, msg.Payload())
+				extracted, err := idService.ExtractSagaUID(msg.Headers())
+				require.NoError(t, err)
+				assert.Equal(t, sagaID, extracted)
+				assert.WithinDuration(t, time.Now().Add(time.Minute), fireAt, time.Second)
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(receive("msg-1", "schedule")))
+
+		stored, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+		assert.True(t, isApplied(stored, "msg-1"))
+	})
+
+	t.Run("saga isn't saved if the scheduler fails", func(t *testing.T) {
+		schedulerMock.EXPECT().Schedule(gomock.Any(), store.tx, sagaID, gomock.Any(), gomock.Any()).Return(errors.New("connection lost"))
+
+		err := handler.Handle(receive("msg-2", "schedule"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "saving saga's '123' state to db: scheduling event for saga '123' at")
+		assert.Contains(t, err.Error(), "connection lost")
+
+		stored, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+		assert.False(t, isApplied(stored, "msg-2"))
+	})
+
+	t.Run("timeouts are scheduled instead of being sent delayed", func(t *testing.T) {
+		schedulerMock.
+			EXPECT().
+			Schedule(gomock.Any(), store.tx, sagaID, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, fireAt time.Time) error {
+				timeout, ok := msg.Payload().(*contracts.TimeoutSagaCommand)
+				require.True(t, ok)
+				assert.Equal(t, "reply", timeout.Reason)
+				assert.WithinDuration(t, time.Now().Add(time.Minute), fireAt, time.Second)
+				return nil
+			})
+
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "timeout"}
+
+		// Send isn't expected, the timeout is fired by the schedule dispatcher
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage("msg-6", ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		require.NoError(t, handler.Handle(execCtx))
+
+		stored, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+		assert.Len(t, stored.Saga().(*schedulingSaga).Timeouts, 1)
+	})
+
+	t.Run("scheduler isn't configured", func(t *testing.T) {
+		handler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService)
+
+		err := handler.Handle(receive("msg-4", "schedule"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "saga '123' scheduled events, but no scheduler is configured")
+	})
+
+	t.Run("store isn't transactional", func(t *testing.T) {
+		handler := NewEventsHandler(store.marshallingStore, sagaMutexMock, schemeRegistry, idService, WithScheduler(schedulerMock))
+
+		err := handler.Handle(receive("msg-5", "data"))
+		assert.EqualError(t, err, "saving saga's '123' state to db: scheduler requires saga.TransactionalStore, *handlers.marshallingStore isn't one")
+	})
+
+	t.Run("pending events are cancelled when the saga completes", func(t *testing.T) {
+		schedulerMock.EXPECT().Cancel(gomock.Any(), store.tx, sagaID).Return(nil)
+
+		require.NoError(t, handler.Handle(receive("msg-3", "complete")))
+	})
+}
+
+// schedulingSaga schedules an expiration on start, a reminder or completes depending on the message of a received event
+type schedulingSaga struct {
+	saga.BaseSaga
+}
+
+func (s *schedulingSaga) Init() {
+	s.AddEventHandler(&DataContract{}, s.HandleData)
+}
+
+func (s *schedulingSaga) Start(sagaCtx saga.SagaContext) error {
+	sagaCtx.Schedule(time.Hour, &DataContract{Message: "expire"})
+	return nil
+}
+
+func (s *schedulingSaga) Compensate(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (s *schedulingSaga) Recover(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (s *schedulingSaga) HandleData(sagaCtx saga.SagaContext) error {
+	switch sagaCtx.Message().Payload().(*DataContract).Message {
+	case "schedule":
+		sagaCtx.Schedule(time.Minute, &DataContract{Message: "reminder"})
+	case "timeout":
+		s.ScheduleTimeout(sagaCtx, "reply", time.Minute)
+	case "complete":
+		sagaCtx.SagaInstance().Complete()
+	}
+
+	return nil
+}
+
+// transactionalStore runs writes of the transaction before the update, the update is skipped if they fail
+type transactionalStore struct {
+	*marshallingStore
+	tx *sql.Tx
+}
+
+func (s *transactionalStore) UpdateTx(ctx context.Context, sagaInstance saga.Instance, inTx saga.TxFunc) error {
+	if inTx != nil {
+		if err := inTx(ctx, s.tx); err != nil {
+			return err
+		}
+	}
+
+	return s.Update(ctx, sagaInstance)
+}
+
+func (s *transactionalStore) DB() (*sagaSql.DB, saga.SQLDriver) {
+	return nil, saga.PGDriver
+}
+
+func TestEventHandlerCascadingCompensation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &DataContract{})
+
+	idService := saga.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+	ctx := context.Background()
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService)
+
+	receive := func(sagaId string, ev message.Object) *execution.MockMessageExecutionCtx {
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaId)
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage("msg-1", ev, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx
+	}
+
+	t.Run("parent is compensated once children have compensated", func(t *testing.T) {
+		parent := saga.NewSagaInstance("parent", "", &SagaExample{})
+		parent.CompensateChildren([]string{"child-1"})
+
+		sagaStoreMock.EXPECT().GetById(ctx, "parent").Return(parent, nil)
+		sagaStoreMock.EXPECT().Update(ctx, parent).Return(nil)
+
+		execCtx := receive("parent", &contracts.SagaChildCompletedEvent{SagaUID: "child-1"})
+		execCtx.
+			EXPECT().
+			Send(gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				assert.Equal(t, &DataContract{Message: "compensate"}, msg.Payload(), "own compensation of the parent")
+				return nil
+			})
+
+		require.NoError(t, handler.Handle(execCtx))
+		assert.True(t, parent.Status().Compensating())
+	})
+
+	t.Run("parent fails if compensation of a child fails", func(t *testing.T) {
+		parent := saga.NewSagaInstance("parent", "", &SagaExample{})
+		parent.CompensateChildren([]string{"child-1"})
+
+		sagaStoreMock.EXPECT().GetById(ctx, "parent").Return(parent, nil)
+		sagaStoreMock.EXPECT().Update(ctx, parent).Return(nil)
+
+		require.NoError(t, handler.Handle(receive("parent", &contracts.SagaChildCompensationFailedEvent{SagaUID: "child-1"})))
+		assert.True(t, parent.Status().ChildCompensationFailed())
+	})
+
+	t.Run("child tells the parent its compensation failed", func(t *testing.T) {
+		child := saga.NewSagaInstance("child-1", "parent", &SagaExample{handleCallback: func(sagaInst saga.Instance) {
+			sagaInst.Fail(nil)
+		}})
+		require.NoError(t, child.Compensate(saga.NewSagaCtx(receive("child-1", &DataContract{}), child)))
+
+		sagaStoreMock.EXPECT().GetById(ctx, "child-1").Return(child, nil)
+		sagaStoreMock.EXPECT().Update(ctx, child).Return(nil)
+
+		execCtx := receive("child-1", &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "refund failed"})
+		gomock.InOrder(
+			execCtx.EXPECT().Send(gomock.Any()).Return(nil),
+			execCtx.
+				EXPECT().
+				Send(gomock.Any()).
+				DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+					assert.Equal(t, &contracts.SagaChildCompensationFailedEvent{SagaUID: "child-1"}, msg.Payload())
+					parentId, err := idService.ExtractSagaUID(msg.Headers())
+					require.NoError(t, err)
+					assert.Equal(t, "parent", parentId)
+					return nil
+				}),
+		)
+
+		require.NoError(t, handler.Handle(execCtx))
+		assert.True(t, child.Status().Failed())
+	})
+}
+
+func TestEventHandlerRetryPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &DataContract{})
+
+	sagaStoreMock := sagaMocks.NewMockStore(ctrl)
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	testLogger := log.NewNilLogger()
+	idService := saga.NewSagaUIDService()
+	ctx := context.Background()
+	sagaID := "123"
+
+	sagaObj := &SagaExample{
+		BaseSaga: saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}},
+		err:      errors.New("payment service is down"),
+	}
+	sagaStoreMock.EXPECT().GetById(ctx, sagaID).DoAndReturn(func(ctx context.Context, sagaId string) (saga.Instance, error) {
+		return saga.NewSagaInstance(sagaID, "", sagaObj), nil
+	}).AnyTimes()
+
+	handler := NewEventsHandler(sagaStoreMock, sagaMutexMock, schemeRegistry, idService, WithRetryPolicy(3, ExponentialBackoff(time.Second, time.Minute)))
+
+	receive := func(attempts int) (*execution.MockMessageExecutionCtx, *message.ReceivedMessage) {
+		headers := message.Headers{}
+		idService.AddSagaId(headers, sagaID)
+		if attempts > 0 {
+			headers.SetHandlingAttempts(attempts)
+		}
+
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: "paid"}
+		receivedMsg := message.NewReceivedMessage("msg-1", ev, headers, time.Now(), "origin")
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(receivedMsg).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx, receivedMsg
+	}
+
+	t.Run("failed message is returned with a delay", func(t *testing.T) {
+		execCtx, receivedMsg := receive(1)
+		execCtx.EXPECT().Return(gomock.Any()).DoAndReturn(func(options ...endpoint.DeliveryOption) error {
+			assert.Equal(t, time.Second*2, endpoint.DeliveryDelay(options...))
+			assert.Equal(t, 2, receivedMsg.Headers().HandlingAttempts())
+			return nil
+		})
+
+		require.NoError(t, handler.Handle(execCtx))
+	})
+
+	t.Run("saga handling failed event is sent after the last attempt", func(t *testing.T) {
+		execCtx, _ := receive(2)
+		execCtx.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			failedEv, ok := msg.Payload().(*contracts.SagaHandlingFailedEvent)
+			require.True(t, ok)
+			assert.Equal(t, sagaID, failedEv.SagaUID)
+			assert.Equal(t, "msg-1", failedEv.MessageUID)
+			assert.Equal(t, 3, failedEv.Attempts)
+			assert.Equal(t, "handling event 'example.DataContract' from message 'msg-1': payment service is down", failedEv.Reason)
+			assert.IsType(t, &DataContract{}, failedEv.Payload)
+			assert.NotContains(t, msg.Headers(), message.HandlingAttemptsHeader)
+			return nil
+		})
+
+		require.NoError(t, handler.Handle(execCtx))
+	})
+
+	t.Run("deliveries of a successful attempt don't carry the counter", func(t *testing.T) {
+		sagaObj.err = nil
+		defer func() {
+			sagaObj.err = errors.New("payment service is down")
+		}()
+
+		execCtx, _ := receive(2)
+		execCtx.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			assert.Equal(t, &DataContract{Message: "handle"}, msg.Payload())
+			assert.NotContains(t, msg.Headers(), message.HandlingAttemptsHeader)
+			return nil
+		})
+		sagaStoreMock.EXPECT().Update(ctx, gomock.Any()).Return(nil)
+
+		require.NoError(t, handler.Handle(execCtx))
+	})
+
+	t.Run("errors of the store aren't retried", func(t *testing.T) {
+		execCtx, _ := receive(0)
+		failingStore := sagaMocks.NewMockStore(ctrl)
+		failingStore.EXPECT().GetById(ctx, sagaID).Return(nil, errors.New("connection lost"))
+		handler := NewEventsHandler(failingStore, sagaMutexMock, schemeRegistry, idService, WithRetryPolicy(3, nil))
+
+		assert.EqualError(t, handler.Handle(execCtx), "retrieving saga '123' from store: connection lost")
+	})
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, time.Second*5)
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, time.Second*4, backoff(3))
+	assert.Equal(t, time.Second*5, backoff(10))
+	assert.Equal(t, time.Second*8, ExponentialBackoff(time.Second, 0)(4))
+}
+
+func TestEventHandlerCorrelation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &SagaExample{}, &DataContract{})
+
+	store := &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}
+	idService := saga.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+	ctx := context.Background()
+
+	sagaMeta := saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}}
+	require.NoError(t, store.Create(ctx, saga.NewSagaInstance("1", "", &SagaExample{BaseSaga: sagaMeta, Data: "order-1"})))
+	require.NoError(t, store.Create(ctx, saga.NewSagaInstance("2", "", &SagaExample{BaseSaga: sagaMeta, Data: "order-2"})))
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	evGK := scheme.GroupKind{Group: g, Kind: "DataContract"}
+	rules := map[scheme.GroupKind]saga.CorrelationRule{evGK: {Saga: scheme.GroupKind{Group: g, Kind: "SagaExample"}, EventField: "Message", SagaField: "Data"}}
+	handler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService, WithCorrelation(rules))
+
+	receive := func(uid, orderID string) *execution.MockMessageExecutionCtx {
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}, Message: orderID}
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, ev, message.Headers{}, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+
+		return execCtx
+	}
+
+	t.Run("saga is found by the correlation value", func(t *testing.T) {
+		execCtx := receive("msg-1", "order-2")
+		execCtx.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			sagaId, err := idService.ExtractSagaUID(msg.Headers())
+			require.NoError(t, err)
+			assert.Equal(t, "2", sagaId, "deliveries carry the uid of the correlated saga")
+			return nil
+		})
+
+		require.NoError(t, handler.Handle(execCtx))
+
+		stored, err := store.GetById(ctx, "2")
+		require.NoError(t, err)
+		assert.True(t, isApplied(stored, "msg-1"))
+	})
+
+	t.Run("no saga matches", func(t *testing.T) {
+		err := handler.Handle(receive("msg-2", "order-3"))
+		assert.EqualError(t, err, "no saga example.SagaExample in progress has Data 'order-3' of message 'msg-2'")
+	})
+
+	t.Run("several sagas match", func(t *testing.T) {
+		require.NoError(t, store.Create(ctx, saga.NewSagaInstance("3", "", &SagaExample{BaseSaga: sagaMeta, Data: "order-1"})))
+
+		err := handler.Handle(receive("msg-3", "order-1"))
+		require.Error(t, err)
+		assert.IsType(t, saga.AmbiguousCorrelationErr{}, errors.Cause(err))
+		assert.Contains(t, err.Error(), "correlating message 'msg-3' with saga example.SagaExample")
+	})
 }
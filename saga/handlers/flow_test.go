@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
+	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
+	"github.com/go-foreman/foreman/testing/protobuf/examplepb"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type protoOrderSaga struct {
+	sagaPkg.BaseSaga
+	examplepb.OrderState
+}
+
+func (s *protoOrderSaga) Init() {
+	s.AddEventHandler(&protoOrderPaid{}, s.HandlePaid)
+}
+
+func (s *protoOrderSaga) Start(sagaCtx sagaPkg.SagaContext) error {
+	s.Status = "awaiting_payment"
+	sagaCtx.Dispatch(&protoOrderCreated{OrderCreated: examplepb.OrderCreated{OrderId: s.OrderId, Amount: 100}})
+	return nil
+}
+
+func (s *protoOrderSaga) Compensate(sagaCtx sagaPkg.SagaContext) error {
+	return nil
+}
+
+func (s *protoOrderSaga) Recover(sagaCtx sagaPkg.SagaContext) error {
+	return nil
+}
+
+func (s *protoOrderSaga) HandlePaid(sagaCtx sagaPkg.SagaContext) error {
+	s.Status = "paid"
+	s.Items = append(s.Items, "receipt")
+	sagaCtx.SagaInstance().Complete()
+	return nil
+}
+
+type protoOrderCreated struct {
+	message.ObjectMeta
+	examplepb.OrderCreated
+}
+
+type protoOrderPaid struct {
+	message.ObjectMeta
+	examplepb.OrderPaid
+}
+
+func TestSagaFlowWithProtobufMarshaller(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	schemeRegistry.AddKnownTypes("orders", &protoOrderSaga{}, &protoOrderCreated{}, &protoOrderPaid{})
+
+	marshaller := message.NewProtobufMarshaller(schemeRegistry, message.WithJsonEncodedTypes(contracts.SagaContracts()...))
+	store := &marshallingStore{marshaller: marshaller, sagas: make(map[string]*marshalledSaga)}
+	idService := sagaPkg.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+	ctx := context.Background()
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), "order-1").Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	controlHandler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService)
+	eventsHandler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService)
+
+	// receive passes a payload over the wire: it's marshalled and unmarshalled as by an endpoint and a subscriber
+	receive := func(uid string, payload message.Object, headers message.Headers) (*execution.MockMessageExecutionCtx, *[]message.Object) {
+		data, err := marshaller.Marshal(payload)
+		require.NoError(t, err)
+
+		decoded, err := marshaller.Unmarshal(data)
+		require.NoError(t, err)
+
+		var sent []message.Object
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, decoded, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+		execCtx.
+			EXPECT().
+			Send(gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				data, err := marshaller.Marshal(msg.Payload())
+				if err != nil {
+					return err
+				}
+
+				decoded, err := marshaller.Unmarshal(data)
+				if err != nil {
+					return err
+				}
+
+				sent = append(sent, decoded)
+				return nil
+			}).
+			AnyTimes()
+
+		return execCtx, &sent
+	}
+
+	startCmd := &contracts.StartSagaCommand{SagaUID: "order-1", Saga: &protoOrderSaga{OrderState: examplepb.OrderState{OrderId: "o-1"}}}
+	execCtx, sent := receive("msg-1", startCmd, message.Headers{})
+	require.NoError(t, controlHandler.Handle(execCtx))
+
+	require.Len(t, *sent, 1)
+	require.IsType(t, &protoOrderCreated{}, (*sent)[0])
+	assert.Equal(t, "o-1", (*sent)[0].(*protoOrderCreated).GetOrderId())
+	assert.Equal(t, int64(100), (*sent)[0].(*protoOrderCreated).GetAmount())
+
+	headers := message.Headers{}
+	idService.AddSagaId(headers, "order-1")
+	execCtx, _ = receive("msg-2", &protoOrderPaid{OrderPaid: examplepb.OrderPaid{OrderId: "o-1"}}, headers)
+	require.NoError(t, eventsHandler.Handle(execCtx))
+
+	sagaInstance, err := store.GetById(ctx, "order-1")
+	require.NoError(t, err)
+	require.NotNil(t, sagaInstance)
+
+	assert.True(t, sagaInstance.Status().Completed())
+	require.IsType(t, &protoOrderSaga{}, sagaInstance.Saga())
+	orderSaga := sagaInstance.Saga().(*protoOrderSaga)
+	assert.Equal(t, "o-1", orderSaga.GetOrderId())
+	assert.Equal(t, "paid", orderSaga.GetStatus())
+	assert.Equal(t, []string{"receipt"}, orderSaga.GetItems())
+
+	var history []string
+	for _, ev := range sagaInstance.HistoryEvents() {
+		history = append(history, ev.Payload.GroupKind().String())
+	}
+
+	assert.Equal(t, []string{"systemSaga.StartSagaCommand", "orders.protoOrderCreated", "orders.protoOrderPaid"}, history)
+}
+
+// partnerSaga waits for a reply whose type depends on the partner, it has no handler for it
+type partnerSaga struct {
+	sagaPkg.BaseSaga
+	Reply   string
+	Expired bool
+}
+
+var partnerReplyGK = scheme.GroupKind{Group: "partners", Kind: "partnerReply"}
+
+func (s *partnerSaga) Init() {
+	s.AddTimeoutHandler(sagaPkg.ExpectationTimeoutReason(partnerReplyGK), func(sagaCtx sagaPkg.SagaContext) error {
+		s.Expired = true
+		return nil
+	})
+}
+
+func (s *partnerSaga) Start(sagaCtx sagaPkg.SagaContext) error {
+	sagaCtx.ExpectEvent(partnerReplyGK, time.Minute)
+	return nil
+}
+
+func (s *partnerSaga) Compensate(sagaCtx sagaPkg.SagaContext) error {
+	return nil
+}
+
+func (s *partnerSaga) Recover(sagaCtx sagaPkg.SagaContext) error {
+	return nil
+}
+
+func (s *partnerSaga) OnExpected(sagaCtx sagaPkg.SagaContext, ev message.Object) error {
+	s.Reply = ev.(*partnerReply).Status
+	sagaCtx.SagaInstance().Complete()
+	return nil
+}
+
+type partnerReply struct {
+	message.ObjectMeta
+	Status string
+}
+
+func TestSagaFlowWithExpectedEvent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	contracts.RegisterSagaContracts(schemeRegistry)
+	schemeRegistry.AddKnownTypes("partners", &partnerSaga{}, &partnerReply{})
+
+	marshaller := message.NewJsonMarshaller(schemeRegistry)
+	store := &marshallingStore{marshaller: marshaller, sagas: make(map[string]*marshalledSaga)}
+	idService := sagaPkg.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+	ctx := context.Background()
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	controlHandler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService)
+	eventsHandler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService)
+
+	receive := func(uid string, payload message.Object, sagaID, traceID string) (*execution.MockMessageExecutionCtx, *[]message.Object) {
+		headers := message.Headers{message.TraceIDHeader: traceID}
+		idService.AddSagaId(headers, sagaID)
+
+		data, err := marshaller.Marshal(payload)
+		require.NoError(t, err)
+
+		decoded, err := marshaller.Unmarshal(data)
+		require.NoError(t, err)
+
+		var sent []message.Object
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, decoded, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(ctx).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+		execCtx.
+			EXPECT().
+			Send(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+				sent = append(sent, msg.Payload())
+				return nil
+			}).
+			AnyTimes()
+
+		return execCtx, &sent
+	}
+
+	start := func(sagaID string) *contracts.TimeoutSagaCommand {
+		execCtx, sent := receive(sagaID+"-start", &contracts.StartSagaCommand{SagaUID: sagaID, Saga: &partnerSaga{}}, "", "flow-1")
+		require.NoError(t, controlHandler.Handle(execCtx))
+		require.Len(t, *sent, 1)
+
+		return (*sent)[0].(*contracts.TimeoutSagaCommand)
+	}
+
+	load := func(sagaID string) (sagaPkg.Instance, *partnerSaga) {
+		sagaInstance, err := store.GetById(ctx, sagaID)
+		require.NoError(t, err)
+
+		return sagaInstance, sagaInstance.Saga().(*partnerSaga)
+	}
+
+	t.Run("reply is delivered to OnExpected", func(t *testing.T) {
+		start("partner-1")
+
+		execCtx, _ := receive("reply-1", &partnerReply{Status: "rejected"}, "partner-1", "flow-2")
+		require.NoError(t, eventsHandler.Handle(execCtx))
+
+		_, expecting := load("partner-1")
+		assert.Empty(t, expecting.Reply, "reply of another flow is ignored")
+		assert.Len(t, expecting.Expectations(), 1)
+
+		execCtx, _ = receive("reply-2", &partnerReply{Status: "accepted"}, "partner-1", "flow-1")
+		require.NoError(t, eventsHandler.Handle(execCtx))
+
+		sagaInstance, expecting := load("partner-1")
+		assert.Equal(t, "accepted", expecting.Reply)
+		assert.True(t, sagaInstance.Status().Completed())
+		assert.Empty(t, expecting.Expectations())
+		assert.Empty(t, expecting.Timeouts)
+	})
+
+	t.Run("expectation is removed by the timeout", func(t *testing.T) {
+		timeout := start("partner-2")
+
+		execCtx, _ := receive("timeout-1", timeout, "", "flow-1")
+		require.NoError(t, controlHandler.Handle(execCtx))
+
+		_, expecting := load("partner-2")
+		assert.True(t, expecting.Expired)
+		assert.Empty(t, expecting.Expectations())
+
+		execCtx, _ = receive("reply-3", &partnerReply{Status: "accepted"}, "partner-2", "flow-1")
+		require.NoError(t, eventsHandler.Handle(execCtx))
+
+		_, expecting = load("partner-2")
+		assert.Empty(t, expecting.Reply, "late reply isn't delivered")
+	})
+}
+
+// marshallingStore keeps sagas encoded by the marshaller, as the sql store does, and decodes them on each load.
+// Update checks versions the same way the sql store does.
+type marshallingStore struct {
+	marshaller message.Marshaller
+	sagas      map[string]*marshalledSaga
+	mutex      sync.Mutex
+}
+
+type marshalledSaga struct {
+	parentID  string
+	completed bool
+	payload   []byte
+	history   []marshalledEvent
+	version   int
+}
+
+type marshalledEvent struct {
+	payload  []byte
+	traceUID string
+	origin   string
+}
+
+func (s *marshallingStore) Create(ctx context.Context, sagaInstance sagaPkg.Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.save(sagaInstance)
+}
+
+func (s *marshallingStore) Update(ctx context.Context, sagaInstance sagaPkg.Instance) error {
+	return s.UpdateIfVersion(ctx, sagaInstance, sagaInstance.Version())
+}
+
+func (s *marshallingStore) UpdateIfVersion(ctx context.Context, sagaInstance sagaPkg.Instance, expectedVersion int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stored, exists := s.sagas[sagaInstance.UID()]; !exists || stored.version != expectedVersion {
+		return sagaPkg.WithVersionConflictErr(errors.Errorf("saga %s isn't at version %d anymore", sagaInstance.UID(), expectedVersion))
+	}
+
+	if err := s.save(sagaInstance); err != nil {
+		return err
+	}
+
+	sagaInstance.SetVersion(expectedVersion + 1)
+	s.sagas[sagaInstance.UID()].version = sagaInstance.Version()
+
+	return nil
+}
+
+func (s *marshallingStore) save(sagaInstance sagaPkg.Instance) error {
+	payload, err := s.marshaller.Marshal(sagaInstance.Saga())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling saga %s", sagaInstance.UID())
+	}
+
+	stored := &marshalledSaga{parentID: sagaInstance.ParentID(), completed: sagaInstance.Status().Completed(), payload: payload}
+
+	for _, ev := range sagaInstance.HistoryEvents() {
+		evPayload, err := s.marshaller.Marshal(ev.Payload)
+		if err != nil {
+			return errors.Wrapf(err, "marshaling history event of saga %s", sagaInstance.UID())
+		}
+
+		stored.history = append(stored.history, marshalledEvent{payload: evPayload, traceUID: ev.TraceUID, origin: ev.OriginSource})
+	}
+
+	s.sagas[sagaInstance.UID()] = stored
+
+	return nil
+}
+
+func (s *marshallingStore) GetById(ctx context.Context, sagaId string) (sagaPkg.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.sagas[sagaId]
+	if !exists {
+		return nil, nil
+	}
+
+	payload, err := s.marshaller.Unmarshal(stored.payload)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sagaInstance := sagaPkg.NewSagaInstance(sagaId, stored.parentID, payload.(sagaPkg.Saga))
+
+	for _, ev := range stored.history {
+		evPayload, err := s.marshaller.Unmarshal(ev.payload)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		sagaInstance.AddHistoryEvent(evPayload, &sagaPkg.AddHistoryEvent{TraceUID: ev.traceUID, Origin: ev.origin})
+	}
+
+	if stored.completed {
+		sagaInstance.Complete()
+	}
+
+	sagaInstance.SetVersion(stored.version)
+
+	return sagaInstance, nil
+}
+
+func (s *marshallingStore) GetByFilter(ctx context.Context, filters ...sagaPkg.FilterOption) (*sagaPkg.InstancesBatch, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *marshallingStore) GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (sagaPkg.Instance, error) {
+	s.mutex.Lock()
+	ids := make([]string, 0, len(s.sagas))
+	for id := range s.sagas {
+		ids = append(ids, id)
+	}
+	s.mutex.Unlock()
+
+	var matched []string
+
+	for _, id := range ids {
+		sagaInstance, err := s.GetById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		sagaValue, ok, err := sagaPkg.CorrelationValue(sagaInstance.Saga(), field)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && sagaValue == value && !sagaInstance.Status().Completed() {
+			matched = append(matched, id)
+		}
+	}
+
+	switch len(matched) {
+	case 0:
+		return nil, nil
+	case 1:
+		return s.GetById(ctx, matched[0])
+	default:
+		return nil, sagaPkg.WithAmbiguousCorrelationErr(errors.Errorf("sagas %v have %s '%s'", matched, field, value))
+	}
+}
+
+func (s *marshallingStore) Delete(ctx context.Context, sagaId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sagas, sagaId)
+	return nil
+}
+
+func (s *marshallingStore) DeleteByFilter(ctx context.Context, filters ...sagaPkg.FilterOption) (int, error) {
+	return 0, errors.New("not supported")
+}
+
+func (s *marshallingStore) DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...sagaPkg.DeleteOption) (int, error) {
+	return 0, errors.New("not supported")
+}
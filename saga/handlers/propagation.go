@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	log "github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/google/uuid"
+)
+
+// tracePropagation carries trace context and correlation id of a received message over to messages sent while it's handled.
+// A nil tracePropagation changes nothing.
+type tracePropagation struct {
+	carrier sagaPkg.TraceCarrier
+}
+
+func newTracePropagation(carrier sagaPkg.TraceCarrier) *tracePropagation {
+	if carrier == nil {
+		return nil
+	}
+
+	return &tracePropagation{carrier: carrier}
+}
+
+// begin returns execCtx whose context carries trace context extracted from the received message. A message without
+// a correlation id in message.TraceIDHeader gets a new one and it's added to the logger. Messages sent by handlers copy
+// headers of the received message, so the id is forwarded to them and logs of one saga flow share it.
+func (p *tracePropagation) begin(execCtx execution.MessageExecutionCtx) execution.MessageExecutionCtx {
+	if p == nil {
+		return execCtx
+	}
+
+	msg := execCtx.Message()
+	execCtx = execution.WithContext(execCtx, p.carrier.Extract(execCtx.Context(), msg.Headers()))
+
+	if msg.TraceID() == "" && msg.Headers() != nil {
+		traceID := uuid.New().String()
+		msg.Headers()[message.TraceIDHeader] = traceID
+		execCtx = execution.WithLogger(execCtx, execCtx.Logger().WithFields([]log.Field{{Name: "traceId", Val: traceID}}))
+	}
+
+	return execCtx
+}
+
+// inject writes trace context of the handling into headers of an outcoming message
+func (p *tracePropagation) inject(execCtx execution.MessageExecutionCtx, msg *message.OutcomingMessage) {
+	if p == nil {
+		return
+	}
+
+	p.carrier.Inject(execCtx.Context(), msg.Headers())
+}
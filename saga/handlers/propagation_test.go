@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
+	"github.com/go-foreman/foreman/testing/mocks/saga/mutex"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type spanKey struct{}
+
+// headerCarrier keeps a span id in ctx, the span of an outcoming message is a child of the received one
+type headerCarrier struct{}
+
+func (c headerCarrier) Extract(ctx context.Context, headers message.Headers) context.Context {
+	span, _ := headers["span"].(string)
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func (c headerCarrier) Inject(ctx context.Context, headers message.Headers) {
+	headers["span"] = ctx.Value(spanKey{}).(string) + "/child"
+}
+
+func TestTracePropagation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	g := scheme.Group("example")
+	schemeRegistry.AddKnownTypes(g, &SagaExample{}, &DataContract{})
+	contracts.RegisterSagaContracts(schemeRegistry)
+
+	store := &marshallingStore{marshaller: message.NewJsonMarshaller(schemeRegistry), sagas: make(map[string]*marshalledSaga)}
+	idService := saga.NewSagaUIDService()
+	testLogger := log.NewNilLogger()
+
+	sagaMutexMock := mutex.NewMockMutex(ctrl)
+	lockMock := mutex.NewMockLock(ctrl)
+	sagaMutexMock.EXPECT().Lock(gomock.Any(), gomock.Any()).Return(lockMock, nil).AnyTimes()
+	lockMock.EXPECT().Release(gomock.Any()).Return(nil).AnyTimes()
+
+	controlHandler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService, WithControlTracePropagation(headerCarrier{}))
+	eventsHandler := NewEventsHandler(store, sagaMutexMock, schemeRegistry, idService, WithTracePropagation(headerCarrier{}))
+
+	receive := func(uid string, payload message.Object, headers message.Headers) (*execution.MockMessageExecutionCtx, *[]*message.OutcomingMessage) {
+		var sent []*message.OutcomingMessage
+
+		execCtx := execution.NewMockMessageExecutionCtx(ctrl)
+		execCtx.EXPECT().Message().Return(message.NewReceivedMessage(uid, payload, headers, time.Now(), "origin")).AnyTimes()
+		execCtx.EXPECT().Context().Return(context.Background()).AnyTimes()
+		execCtx.EXPECT().Logger().Return(testLogger).AnyTimes()
+		execCtx.EXPECT().Send(gomock.Any()).DoAndReturn(func(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+			sent = append(sent, msg)
+			return nil
+		}).AnyTimes()
+
+		return execCtx, &sent
+	}
+
+	sagaMeta := saga.BaseSaga{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "SagaExample", Group: g.String()}}}
+	startCmd := &contracts.StartSagaCommand{SagaUID: "1", Saga: &SagaExample{BaseSaga: sagaMeta}}
+
+	t.Run("correlation id is generated for a message without one", func(t *testing.T) {
+		execCtx, sent := receive("msg-1", startCmd, message.Headers{"span": "http"})
+		require.NoError(t, controlHandler.Handle(execCtx))
+
+		require.Len(t, *sent, 1)
+		assert.Equal(t, "http/child", (*sent)[0].Headers()["span"])
+		assert.NotEmpty(t, (*sent)[0].Headers()[message.TraceIDHeader])
+	})
+
+	t.Run("correlation id of the received message is forwarded", func(t *testing.T) {
+		headers := message.Headers{"span": "http/child", message.TraceIDHeader: "flow-1"}
+		idService.AddSagaId(headers, "1")
+
+		ev := &DataContract{ObjectMeta: message.ObjectMeta{TypeMeta: scheme.TypeMeta{Kind: "DataContract", Group: g.String()}}}
+		execCtx, sent := receive("msg-2", ev, headers)
+		require.NoError(t, eventsHandler.Handle(execCtx))
+
+		require.Len(t, *sent, 1)
+		assert.Equal(t, "http/child/child", (*sent)[0].Headers()["span"])
+		assert.Equal(t, "flow-1", (*sent)[0].Headers()[message.TraceIDHeader])
+	})
+
+	t.Run("nothing is propagated if not configured", func(t *testing.T) {
+		controlHandler := NewSagaControlHandler(store, sagaMutexMock, schemeRegistry, idService, WithControlTracePropagation(nil))
+		startCmd := &contracts.StartSagaCommand{SagaUID: "2", Saga: &SagaExample{BaseSaga: sagaMeta}}
+
+		execCtx, sent := receive("msg-3", startCmd, message.Headers{"span": "http"})
+		require.NoError(t, controlHandler.Handle(execCtx))
+
+		require.Len(t, *sent, 1)
+		assert.Equal(t, "http", (*sent)[0].Headers()["span"])
+		assert.NotContains(t, (*sent)[0].Headers(), message.TraceIDHeader)
+	})
+}
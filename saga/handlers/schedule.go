@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+// scheduling writes events scheduled by sagas into the scheduler
+type scheduling struct {
+	scheduler   sagaPkg.Scheduler
+	sagaUIDSvc  sagaPkg.SagaUIDService
+	propagation *tracePropagation
+}
+
+// sagaCtxOpts makes timeouts of sagas scheduled in the scheduler instead of being dispatched delayed
+func (s scheduling) sagaCtxOpts() []sagaPkg.SagaCtxOpt {
+	if s.scheduler == nil {
+		return nil
+	}
+
+	return []sagaPkg.SagaCtxOpt{sagaPkg.WithScheduledTimeouts()}
+}
+
+// check fails if the saga scheduled events, but there is no scheduler to keep them
+func (s scheduling) check(sagaCtx sagaPkg.SagaContext) error {
+	if s.scheduler == nil && len(sagaCtx.Scheduled()) > 0 {
+		return errors.Errorf("saga '%s' scheduled events, but no scheduler is configured", sagaCtx.SagaInstance().UID())
+	}
+
+	return nil
+}
+
+// save writes events scheduled by the saga within the transaction of the saga update. Pending events of a completed saga
+// are cancelled instead, it handles none of them anymore.
+func (s scheduling) save(ctx context.Context, tx *sql.Tx, execCtx execution.MessageExecutionCtx, sagaCtx sagaPkg.SagaContext) error {
+	if s.scheduler == nil {
+		return nil
+	}
+
+	sagaInstance := sagaCtx.SagaInstance()
+
+	if sagaInstance.Status().Completed() {
+		return s.scheduler.Cancel(ctx, tx, sagaInstance.UID())
+	}
+
+	for _, scheduled := range sagaCtx.Scheduled() {
+		s.sagaUIDSvc.AddSagaId(execCtx.Message().Headers(), sagaInstance.UID())
+		outcomingMsg := message.NewOutcomingMessage(scheduled.Payload, message.WithHeaders(execCtx.Message().Headers()))
+		s.propagation.inject(execCtx, outcomingMsg)
+
+		if err := s.scheduler.Schedule(ctx, tx, sagaInstance.UID(), outcomingMsg, scheduled.FireAt); err != nil {
+			return errors.Wrapf(err, "scheduling event for saga '%s' at %s", sagaInstance.UID(), scheduled.FireAt.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,366 @@
+package saga
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+// memoryStore keeps sagas in memory of the process. Sagas and events are kept marshaled like sql store keeps them,
+// so an instance loaded from the store doesn't share state with the one saved and a failed update changes nothing.
+type memoryStore struct {
+	mutex         sync.RWMutex
+	msgMarshaller message.Marshaller
+	sagas         map[string]*memorySaga
+}
+
+type memorySaga struct {
+	uid          string
+	parentID     string
+	name         string
+	payload      []byte
+	status       string
+	lastFailedEv []byte
+	startedAt    *time.Time
+	updatedAt    *time.Time
+	version      int
+	history      []memoryEvent
+	entityRefs   []EntityRef
+}
+
+type memoryEvent struct {
+	HistoryEvent
+	payload []byte
+}
+
+// NewMemoryStore creates a Store which keeps sagas in memory, it's meant for tests and local development.
+// It behaves like sql store: updates are checked against versions and filters are matched by MatchFilter.
+func NewMemoryStore(msgMarshaller message.Marshaller) Store {
+	return &memoryStore{msgMarshaller: msgMarshaller, sagas: make(map[string]*memorySaga)}
+}
+
+func (s *memoryStore) Create(ctx context.Context, sagaInstance Instance) error {
+	record, err := s.marshal(sagaInstance, nil)
+	if err != nil {
+		return errors.Wrapf(err, "marshaling saga instance %s on create", sagaInstance.UID())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.sagas[sagaInstance.UID()]; exists {
+		return errors.Errorf("saga instance %s already exists", sagaInstance.UID())
+	}
+
+	record.version = 0
+	s.sagas[record.uid] = record
+
+	return nil
+}
+
+func (s *memoryStore) GetById(ctx context.Context, sagaId string) (Instance, error) {
+	s.mutex.RLock()
+	record, exists := s.sagas[sagaId]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return nil, nil
+	}
+
+	return s.unmarshal(record)
+}
+
+func (s *memoryStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*InstancesBatch, error) {
+	if len(filters) == 0 {
+		return nil, errors.Errorf("no filters found, you have to specify at least one so result won't be whole store")
+	}
+
+	opts := newFilterOptions(filters)
+
+	if opts.filter() == nil && opts.limit == nil {
+		return nil, errors.Errorf("all specified filters are empty, you have to specify at least one so result won't be whole store")
+	}
+
+	field, order, err := opts.orderBy()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	matched, err := s.matching(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sortInstances(matched, field, order)
+
+	res := &InstancesBatch{Total: len(matched), Items: matched}
+
+	if opts.offset != nil {
+		offset := *opts.offset
+		if offset > len(res.Items) {
+			offset = len(res.Items)
+		}
+
+		res.Items = res.Items[offset:]
+	}
+
+	if opts.limit != nil && *opts.limit < len(res.Items) {
+		res.Items = res.Items[:*opts.limit]
+	}
+
+	return res, nil
+}
+
+func (s *memoryStore) GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (Instance, error) {
+	s.mutex.RLock()
+	var records []*memorySaga
+	for _, record := range s.sagas {
+		if record.name == sagaType && record.status != sagaStatusCompleted.String() {
+			records = append(records, record)
+		}
+	}
+	s.mutex.RUnlock()
+
+	instances := make([]Instance, 0, len(records))
+
+	for _, record := range records {
+		instance, err := s.unmarshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, instance)
+	}
+
+	matched, err := correlatedInstances(instances, field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return singleCorrelated(matched, sagaType, field, value)
+}
+
+func (s *memoryStore) Update(ctx context.Context, sagaInstance Instance) error {
+	return s.UpdateIfVersion(ctx, sagaInstance, sagaInstance.Version())
+}
+
+func (s *memoryStore) UpdateIfVersion(ctx context.Context, sagaInstance Instance, expectedVersion int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.sagas[sagaInstance.UID()]
+	if !exists || stored.version != expectedVersion {
+		return WithVersionConflictErr(errors.Errorf("saga %s isn't at version %d anymore, it was updated or deleted concurrently", sagaInstance.UID(), expectedVersion))
+	}
+
+	record, err := s.marshal(sagaInstance, stored.history)
+	if err != nil {
+		return errors.Wrapf(err, "marshaling saga instance %s on update", sagaInstance.UID())
+	}
+
+	record.version = expectedVersion + 1
+	s.sagas[record.uid] = record
+	sagaInstance.SetVersion(record.version)
+
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, sagaId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.sagas[sagaId]; !exists {
+		return errors.Errorf("no saga instance %s found", sagaId)
+	}
+
+	delete(s.sagas, sagaId)
+
+	return nil
+}
+
+func (s *memoryStore) DeleteByFilter(ctx context.Context, filters ...FilterOption) (int, error) {
+	opts := newFilterOptions(filters)
+
+	if opts.filter() == nil {
+		return 0, errors.Errorf("all specified filters are empty, you have to specify at least one so whole store won't be deleted")
+	}
+
+	matched, err := s.matching(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, instance := range matched {
+		delete(s.sagas, instance.UID())
+	}
+
+	return len(matched), nil
+}
+
+// DeleteOlderThan deletes completed sagas oldest first, a saga updated since it was selected is kept
+func (s *memoryStore) DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...DeleteOption) (int, error) {
+	options := newDeleteOptions(opts)
+
+	completed, err := s.GetByFilter(ctx, WithStatus(sagaStatusCompleted.String()), WithUpdatedBefore(cutoff), WithSorting(SortByUpdatedAt, SortAsc))
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+
+	for _, instance := range completed.Items {
+		if options.limit > 0 && deleted >= options.limit {
+			break
+		}
+
+		if options.archiver != nil {
+			if err := options.archiver(ctx, instance); err != nil {
+				return deleted, errors.Wrapf(err, "archiving saga %s", instance.UID())
+			}
+		}
+
+		s.mutex.Lock()
+		if stored, exists := s.sagas[instance.UID()]; exists && stored.version == instance.Version() {
+			delete(s.sagas, instance.UID())
+			deleted++
+		}
+		s.mutex.Unlock()
+	}
+
+	return deleted, nil
+}
+
+// matching returns instances matching the filter of opts in no particular order
+func (s *memoryStore) matching(opts *filterOptions) ([]Instance, error) {
+	s.mutex.RLock()
+	records := make([]*memorySaga, 0, len(s.sagas))
+	for _, record := range s.sagas {
+		records = append(records, record)
+	}
+	s.mutex.RUnlock()
+
+	var matched []Instance
+
+	for _, record := range records {
+		instance, err := s.unmarshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		if MatchFilter(opts.filter(), instance) {
+			matched = append(matched, instance)
+		}
+	}
+
+	return matched, nil
+}
+
+// marshal makes a record of the instance, events already kept in the store aren't marshaled again
+func (s *memoryStore) marshal(sagaInstance Instance, storedHistory []memoryEvent) (*memorySaga, error) {
+	payload, err := s.msgMarshaller.Marshal(sagaInstance.Saga())
+	if err != nil {
+		return nil, err
+	}
+
+	record := &memorySaga{
+		uid:        sagaInstance.UID(),
+		parentID:   sagaInstance.ParentID(),
+		name:       sagaInstance.Saga().GroupKind().String(),
+		payload:    payload,
+		status:     sagaInstance.Status().String(),
+		startedAt:  copyTime(sagaInstance.StartedAt()),
+		updatedAt:  copyTime(sagaInstance.UpdatedAt()),
+		entityRefs: append([]EntityRef(nil), sagaInstance.EntityRefs()...),
+	}
+
+	if failedEv := sagaInstance.Status().FailedOnEvent(); failedEv != nil {
+		if record.lastFailedEv, err = s.msgMarshaller.Marshal(failedEv); err != nil {
+			return nil, errors.Wrap(err, "marshaling last failed event")
+		}
+	}
+
+	stored := make(map[string]memoryEvent, len(storedHistory))
+	for _, ev := range storedHistory {
+		stored[ev.UID] = ev
+	}
+
+	for _, ev := range sagaInstance.HistoryEvents() {
+		if storedEv, exists := stored[ev.UID]; exists {
+			record.history = append(record.history, storedEv)
+			continue
+		}
+
+		evPayload, err := s.msgMarshaller.Marshal(ev.Payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshaling history event %s", ev.UID)
+		}
+
+		record.history = append(record.history, memoryEvent{HistoryEvent: ev, payload: evPayload})
+	}
+
+	return record, nil
+}
+
+func (s *memoryStore) unmarshal(record *memorySaga) (Instance, error) {
+	status, err := statusFromStr(record.status)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing status of %s", record.uid)
+	}
+
+	payload, err := s.msgMarshaller.Unmarshal(record.payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error deserializing payload into saga %s", record.name)
+	}
+
+	sagaInterface, ok := payload.(Saga)
+	if !ok {
+		return nil, errors.Errorf("payload of saga %s is %T, it doesn't implement Saga interface", record.uid, payload)
+	}
+
+	instance := &sagaInstance{
+		uid:            record.uid,
+		parentID:       record.parentID,
+		saga:           sagaInterface,
+		historyEvents:  make([]HistoryEvent, 0, len(record.history)),
+		entityRefs:     append([]EntityRef(nil), record.entityRefs...),
+		startedAt:      copyTime(record.startedAt),
+		updatedAt:      copyTime(record.updatedAt),
+		instanceStatus: instanceStatus{status: status},
+		version:        record.version,
+	}
+
+	if len(record.lastFailedEv) > 0 {
+		if instance.instanceStatus.lastFailedEv, err = s.msgMarshaller.Unmarshal(record.lastFailedEv); err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling last failed ev for saga %s", record.uid)
+		}
+	}
+
+	for _, ev := range record.history {
+		evPayload, err := s.msgMarshaller.Unmarshal(ev.payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error deserializing payload into event %s", ev.UID)
+		}
+
+		historyEv := ev.HistoryEvent
+		historyEv.Payload = evPayload
+		instance.historyEvents = append(instance.historyEvents, historyEv)
+	}
+
+	return instance, nil
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	copied := *t
+
+	return &copied
+}
@@ -0,0 +1,199 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+
+	knownTypes := scheme.NewKnownTypesRegistry()
+	knownTypes.AddKnownTypes("example", &SagaExample{}, &DataContract{})
+	store := NewMemoryStore(message.NewJsonMarshaller(knownTypes))
+
+	t.Run("create and get", func(t *testing.T) {
+		sagaInstance := NewSagaInstance("create-1", "parent-1", &SagaExample{Data: "data"})
+		sagaInstance.AddHistoryEvent(&DataContract{Message: "started"}, nil)
+		require.NoError(t, store.Create(ctx, sagaInstance))
+
+		loaded, err := store.GetById(ctx, "create-1")
+		require.NoError(t, err)
+		require.NotNil(t, loaded)
+		assert.Equal(t, "parent-1", loaded.ParentID())
+		assert.Equal(t, "data", loaded.Saga().(*SagaExample).Data)
+		assert.Equal(t, 0, loaded.Version())
+		require.Len(t, loaded.HistoryEvents(), 1)
+		assert.Equal(t, "started", loaded.HistoryEvents()[0].Payload.(*DataContract).Message)
+
+		loaded.Saga().(*SagaExample).Data = "changed"
+		reloaded, err := store.GetById(ctx, "create-1")
+		require.NoError(t, err)
+		assert.Equal(t, "data", reloaded.Saga().(*SagaExample).Data, "loaded instances don't share state with the store")
+
+		assert.EqualError(t, store.Create(ctx, sagaInstance), "saga instance create-1 already exists")
+	})
+
+	t.Run("get not existing saga", func(t *testing.T) {
+		loaded, err := store.GetById(ctx, "unknown")
+		require.NoError(t, err)
+		assert.Nil(t, loaded)
+	})
+
+	t.Run("update checks version", func(t *testing.T) {
+		sagaInstance := NewSagaInstance("update-1", "", &SagaExample{Data: "data"})
+		require.NoError(t, store.Create(ctx, sagaInstance))
+
+		first, err := store.GetById(ctx, "update-1")
+		require.NoError(t, err)
+		stale, err := store.GetById(ctx, "update-1")
+		require.NoError(t, err)
+
+		first.AddHistoryEvent(&DataContract{Message: "handled"}, nil)
+		first.Complete()
+		require.NoError(t, store.Update(ctx, first))
+		assert.Equal(t, 1, first.Version())
+
+		stale.Fail(&DataContract{Message: "failed"})
+		err = store.Update(ctx, stale)
+		require.Error(t, err)
+		assert.IsType(t, VersionConflictErr{}, err)
+		assert.EqualError(t, err, "saga update-1 isn't at version 0 anymore, it was updated or deleted concurrently")
+
+		loaded, err := store.GetById(ctx, "update-1")
+		require.NoError(t, err)
+		assert.True(t, loaded.Status().Completed())
+		assert.Equal(t, 1, loaded.Version())
+		require.Len(t, loaded.HistoryEvents(), 1)
+		assert.Equal(t, first.HistoryEvents()[0].UID, loaded.HistoryEvents()[0].UID)
+
+		loaded.Fail(&DataContract{Message: "failed"})
+		require.NoError(t, store.Update(ctx, loaded))
+
+		failed, err := store.GetById(ctx, "update-1")
+		require.NoError(t, err)
+		assert.True(t, failed.Status().Failed())
+		assert.Equal(t, "failed", failed.Status().FailedOnEvent().(*DataContract).Message)
+	})
+
+	t.Run("update if version", func(t *testing.T) {
+		sagaInstance := NewSagaInstance("update-2", "", &SagaExample{Data: "data"})
+		require.NoError(t, store.Create(ctx, sagaInstance))
+
+		sagaInstance.Complete()
+		err := store.UpdateIfVersion(ctx, sagaInstance, 1)
+		assert.IsType(t, VersionConflictErr{}, err)
+		assert.EqualError(t, err, "saga update-2 isn't at version 1 anymore, it was updated or deleted concurrently")
+		assert.Equal(t, 0, sagaInstance.Version())
+
+		require.NoError(t, store.UpdateIfVersion(ctx, sagaInstance, 0))
+		assert.Equal(t, 1, sagaInstance.Version())
+
+		loaded, err := store.GetById(ctx, "update-2")
+		require.NoError(t, err)
+		assert.True(t, loaded.Status().Completed())
+		assert.Equal(t, 1, loaded.Version())
+	})
+
+	t.Run("update of not existing saga", func(t *testing.T) {
+		err := store.Update(ctx, NewSagaInstance("unknown", "", &SagaExample{}))
+		assert.IsType(t, VersionConflictErr{}, err)
+	})
+
+	t.Run("get by filter", func(t *testing.T) {
+		store := NewMemoryStore(message.NewJsonMarshaller(knownTypes))
+
+		for _, uid := range []string{"filter-1", "filter-2", "filter-3"} {
+			sagaInstance := NewSagaInstance(uid, "", &SagaExample{Data: uid})
+			sagaInstance.Complete()
+			require.NoError(t, store.Create(ctx, sagaInstance))
+		}
+
+		_, err := store.GetByFilter(ctx)
+		assert.EqualError(t, err, "no filters found, you have to specify at least one so result won't be whole store")
+
+		batch, err := store.GetByFilter(ctx, WithStatus("completed"), WithSorting(SortByUpdatedAt, SortAsc), WithOffsetAndLimit(1, 1))
+		require.NoError(t, err)
+		assert.Equal(t, 3, batch.Total)
+		require.Len(t, batch.Items, 1)
+
+		batch, err = store.GetByFilter(ctx, WithSagaId("filter-2"))
+		require.NoError(t, err)
+		require.Len(t, batch.Items, 1)
+		assert.Equal(t, "filter-2", batch.Items[0].UID())
+
+		batch, err = store.GetByFilter(ctx, WithStatus("failed"))
+		require.NoError(t, err)
+		assert.Equal(t, 0, batch.Total)
+		assert.Empty(t, batch.Items)
+
+		deleted, err := store.DeleteByFilter(ctx, WithSagaId("filter-1"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		_, err = store.DeleteByFilter(ctx)
+		assert.EqualError(t, err, "all specified filters are empty, you have to specify at least one so whole store won't be deleted")
+	})
+
+	t.Run("get by correlation", func(t *testing.T) {
+		store := NewMemoryStore(message.NewJsonMarshaller(knownTypes))
+
+		sagaInstance := NewSagaInstance("correlated-1", "", &SagaExample{Data: "order-1"})
+		require.NoError(t, store.Create(ctx, sagaInstance))
+		sagaName := sagaInstance.Saga().GroupKind().String()
+
+		correlated, err := store.GetByCorrelation(ctx, sagaName, "Data", "order-1")
+		require.NoError(t, err)
+		require.NotNil(t, correlated)
+		assert.Equal(t, "correlated-1", correlated.UID())
+
+		correlated, err = store.GetByCorrelation(ctx, sagaName, "Data", "order-2")
+		require.NoError(t, err)
+		assert.Nil(t, correlated)
+
+		require.NoError(t, store.Create(ctx, NewSagaInstance("correlated-2", "", &SagaExample{Data: "order-1"})))
+		_, err = store.GetByCorrelation(ctx, sagaName, "Data", "order-1")
+		assert.IsType(t, AmbiguousCorrelationErr{}, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, store.Create(ctx, NewSagaInstance("delete-1", "", &SagaExample{})))
+		require.NoError(t, store.Delete(ctx, "delete-1"))
+		assert.EqualError(t, store.Delete(ctx, "delete-1"), "no saga instance delete-1 found")
+	})
+
+	t.Run("delete older than", func(t *testing.T) {
+		store := NewMemoryStore(message.NewJsonMarshaller(knownTypes))
+
+		for _, uid := range []string{"old-1", "old-2", "running"} {
+			sagaInstance := NewSagaInstance(uid, "", &SagaExample{})
+			if uid != "running" {
+				sagaInstance.Complete()
+			}
+			require.NoError(t, store.Create(ctx, sagaInstance))
+		}
+
+		var archived []string
+		deleted, err := store.DeleteOlderThan(ctx, time.Now().Add(time.Second), WithDeleteLimit(1), WithArchiver(func(ctx context.Context, sagaInstance Instance) error {
+			archived = append(archived, sagaInstance.UID())
+			return nil
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		assert.Len(t, archived, 1)
+
+		deleted, err = store.DeleteOlderThan(ctx, time.Now().Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		running, err := store.GetById(ctx, "running")
+		require.NoError(t, err)
+		assert.NotNil(t, running)
+	})
+}
@@ -0,0 +1,219 @@
+package saga
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "foreman"
+	metricsSubsystem = "saga"
+
+	// UnknownSagaLabel is the saga label of messages failed before the saga instance is loaded
+	UnknownSagaLabel = "unknown"
+
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Metrics collects prometheus metrics of saga handling, all of them are labeled by saga type (group and kind):
+//
+//	foreman_saga_commands_total{command, saga, outcome} - processed start, recover and compensate commands
+//	foreman_saga_events_total{event, saga, outcome} - SagaCompleted (a saga completed) and SagaChildCompleted (sent to the parent saga) events
+//	foreman_saga_in_flight{saga} - sagas being handled right now by this process
+//	foreman_saga_event_handling_duration_seconds{saga, outcome} - duration of handling an event by the events handler
+//	foreman_saga_update_retries_total{saga, outcome} - updates retried after transient store errors, success if a retry saved the saga
+//	foreman_saga_transitions_total{saga, from, to} - changes of saga status made by successfully handled messages
+//
+// A nil *Metrics is valid and records nothing, handlers use it when metrics are disabled.
+type Metrics struct {
+	commands    *prometheus.CounterVec
+	events      *prometheus.CounterVec
+	inFlight    *prometheus.GaugeVec
+	duration    *prometheus.HistogramVec
+	retries     *prometheus.CounterVec
+	transitions *prometheus.CounterVec
+}
+
+// NewMetrics creates collectors and registers them in the registerer
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "commands_total",
+			Help:      "Number of processed saga commands.",
+		}, []string{"command", "saga", "outcome"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "events_total",
+			Help:      "Number of saga completion events.",
+		}, []string{"event", "saga", "outcome"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "in_flight",
+			Help:      "Number of sagas being handled.",
+		}, []string{"saga"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "event_handling_duration_seconds",
+			Help:      "Duration of handling an event by a saga.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"saga", "outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "update_retries_total",
+			Help:      "Number of saga updates retried after transient store errors.",
+		}, []string{"saga", "outcome"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "transitions_total",
+			Help:      "Number of saga status changes.",
+		}, []string{"saga", "from", "to"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.commands, m.events, m.inFlight, m.duration, m.retries, m.transitions} {
+		if err := registerer.Register(c); err != nil {
+			return nil, errors.Wrap(err, "registering saga metrics")
+		}
+	}
+
+	return m, nil
+}
+
+// Handling tracks handling of one message by a saga handler. A nil *Handling records nothing.
+type Handling struct {
+	metrics  *Metrics
+	command  string
+	event    bool
+	saga     string
+	started  time.Time
+	inFlight bool
+	instance Instance
+	status   string
+}
+
+// HandleCommand starts tracking of a saga command. Commands other than start, recover and compensate aren't tracked.
+func (m *Metrics) HandleCommand(cmd message.Object) *Handling {
+	if m == nil {
+		return nil
+	}
+
+	var command string
+
+	switch cmd.(type) {
+	case *contracts.StartSagaCommand:
+		command = "start"
+	case *contracts.RecoverSagaCommand:
+		command = "recover"
+	case *contracts.CompensateSagaCommand:
+		command = "compensate"
+	default:
+		return nil
+	}
+
+	return &Handling{metrics: m, command: command, saga: UnknownSagaLabel}
+}
+
+// HandleEvent starts tracking of an event handled by a saga, the duration is measured till Done
+func (m *Metrics) HandleEvent() *Handling {
+	if m == nil {
+		return nil
+	}
+
+	return &Handling{metrics: m, event: true, saga: UnknownSagaLabel, started: time.Now()}
+}
+
+// SetSaga sets the type of the handled saga once it's known and counts the saga as in flight
+func (h *Handling) SetSaga(gk scheme.GroupKind) {
+	if h == nil || h.inFlight {
+		return
+	}
+
+	h.saga = gk.String()
+	h.inFlight = true
+	h.metrics.inFlight.WithLabelValues(h.saga).Inc()
+}
+
+// SetInstance sets the handled saga like SetSaga and remembers its status, Done counts the transition if the status changed.
+// A saga loaded again, e.g. after a version conflict, replaces the previous one.
+func (h *Handling) SetInstance(instance Instance) {
+	if h == nil {
+		return
+	}
+
+	h.SetSaga(instance.Saga().GroupKind())
+	h.instance = instance
+	h.status = instance.Status().String()
+}
+
+// Done records the outcome of handling
+func (h *Handling) Done(err error) {
+	if h == nil {
+		return
+	}
+
+	outcome := outcomeOf(err)
+
+	if err == nil && h.instance != nil {
+		if status := h.instance.Status().String(); status != h.status {
+			h.metrics.transitions.WithLabelValues(h.saga, h.status, status).Inc()
+		}
+	}
+
+	if h.inFlight {
+		h.metrics.inFlight.WithLabelValues(h.saga).Dec()
+	}
+
+	if h.event {
+		h.metrics.duration.WithLabelValues(h.saga, outcome).Observe(time.Since(h.started).Seconds())
+		return
+	}
+
+	h.metrics.commands.WithLabelValues(h.command, h.saga, outcome).Inc()
+}
+
+// SagaCompleted counts a saga which has completed
+func (m *Metrics) SagaCompleted(gk scheme.GroupKind) {
+	if m == nil {
+		return
+	}
+
+	m.events.WithLabelValues("SagaCompleted", gk.String(), OutcomeSuccess).Inc()
+}
+
+// SagaChildCompleted counts SagaChildCompletedEvent sent by a completed child saga, err is the result of sending
+func (m *Metrics) SagaChildCompleted(gk scheme.GroupKind, err error) {
+	if m == nil {
+		return
+	}
+
+	m.events.WithLabelValues("SagaChildCompleted", gk.String(), outcomeOf(err)).Inc()
+}
+
+// UpdateRetried counts an update of a saga retried after transient store errors, err is the result of the last attempt
+func (m *Metrics) UpdateRetried(gk scheme.GroupKind, err error) {
+	if m == nil {
+		return
+	}
+
+	m.retries.WithLabelValues(gk.String(), outcomeOf(err)).Inc()
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+
+	return OutcomeSuccess
+}
@@ -0,0 +1,141 @@
+package saga
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	sagaGK := scheme.GroupKind{Group: "orders", Kind: "OrderSaga"}
+
+	t.Run("disabled metrics record nothing", func(t *testing.T) {
+		var metrics *Metrics
+
+		assert.NotPanics(t, func() {
+			handling := metrics.HandleCommand(&contracts.StartSagaCommand{})
+			handling.SetSaga(sagaGK)
+			handling.Done(nil)
+
+			handling = metrics.HandleEvent()
+			handling.SetSaga(sagaGK)
+			handling.SetInstance(NewSagaInstance("123", "", &sagaExample{}))
+			handling.Done(errors.New("failed"))
+
+			metrics.SagaCompleted(sagaGK)
+			metrics.SagaChildCompleted(sagaGK, nil)
+			metrics.UpdateRetried(sagaGK, nil)
+		})
+	})
+
+	t.Run("commands", func(t *testing.T) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+
+		handling := metrics.HandleCommand(&contracts.StartSagaCommand{})
+		handling.SetSaga(sagaGK)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.inFlight.WithLabelValues("orders.OrderSaga")))
+		handling.Done(nil)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.inFlight.WithLabelValues("orders.OrderSaga")))
+
+		metrics.HandleCommand(&contracts.RecoverSagaCommand{}).Done(errors.New("saga not found"))
+		assert.Nil(t, metrics.HandleCommand(&contracts.TimeoutSagaCommand{}), "timeouts aren't counted")
+
+		expected := `
+# HELP foreman_saga_commands_total Number of processed saga commands.
+# TYPE foreman_saga_commands_total counter
+foreman_saga_commands_total{command="recover",outcome="error",saga="unknown"} 1
+foreman_saga_commands_total{command="start",outcome="success",saga="orders.OrderSaga"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.commands, strings.NewReader(expected)))
+	})
+
+	t.Run("events", func(t *testing.T) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+
+		handling := metrics.HandleEvent()
+		handling.SetSaga(sagaGK)
+		handling.SetSaga(sagaGK)
+		handling.Done(nil)
+		metrics.HandleEvent().Done(errors.New("saga not found"))
+
+		assert.Equal(t, 2, testutil.CollectAndCount(metrics.duration))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.inFlight.WithLabelValues("orders.OrderSaga")), "saga set twice is in flight once")
+
+		metrics.SagaCompleted(sagaGK)
+		metrics.SagaChildCompleted(sagaGK, errors.New("send failed"))
+
+		expected := `
+# HELP foreman_saga_events_total Number of saga completion events.
+# TYPE foreman_saga_events_total counter
+foreman_saga_events_total{event="SagaChildCompleted",outcome="error",saga="orders.OrderSaga"} 1
+foreman_saga_events_total{event="SagaCompleted",outcome="success",saga="orders.OrderSaga"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.events, strings.NewReader(expected)))
+	})
+
+	t.Run("update retries", func(t *testing.T) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+
+		metrics.UpdateRetried(sagaGK, nil)
+		metrics.UpdateRetried(sagaGK, errors.New("deadlock"))
+
+		expected := `
+# HELP foreman_saga_update_retries_total Number of saga updates retried after transient store errors.
+# TYPE foreman_saga_update_retries_total counter
+foreman_saga_update_retries_total{outcome="error",saga="orders.OrderSaga"} 1
+foreman_saga_update_retries_total{outcome="success",saga="orders.OrderSaga"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.retries, strings.NewReader(expected)))
+	})
+
+	t.Run("transitions", func(t *testing.T) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+
+		sagaObj := &sagaExample{}
+		sagaObj.SetGroupKind(&sagaGK)
+
+		completed := NewSagaInstance("123", "", sagaObj)
+		handling := metrics.HandleEvent()
+		handling.SetInstance(completed)
+		completed.Complete()
+		handling.Done(nil)
+
+		failed := NewSagaInstance("234", "", sagaObj)
+		handling = metrics.HandleEvent()
+		handling.SetInstance(failed)
+		failed.Complete()
+		handling.Done(errors.New("saga isn't saved"))
+
+		handling = metrics.HandleEvent()
+		handling.SetInstance(NewSagaInstance("345", "", sagaObj))
+		handling.Done(nil)
+
+		expected := `
+# HELP foreman_saga_transitions_total Number of saga status changes.
+# TYPE foreman_saga_transitions_total counter
+foreman_saga_transitions_total{from="created",saga="orders.OrderSaga",to="completed"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.transitions, strings.NewReader(expected)))
+	})
+
+	t.Run("registered twice", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		_, err := NewMetrics(registry)
+		require.NoError(t, err)
+
+		_, err = NewMetrics(registry)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registering saga metrics")
+	})
+}
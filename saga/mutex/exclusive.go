@@ -0,0 +1,66 @@
+package mutex
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+const exclusiveReleaseTimeout = time.Second * 30
+
+// RunExclusively runs fn only while the lock of name is held, so among all replicas (message handling ones and ones in worker mode)
+// only one runs fn at a time and the others wait for the lock. With NewLeasedMutex ctx passed into fn is cancelled once the lease is lost,
+// then fn is started again after the lock is reacquired. Returns when ctx is done or fn returns by itself.
+func RunExclusively(ctx context.Context, m Mutex, name string, logger log.Logger, fn func(ctx context.Context) error) error {
+	for ctx.Err() == nil {
+		lock, err := m.Lock(ctx, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return errors.Wrapf(err, "acquiring exclusive lock %s", name)
+		}
+
+		// the lock may be acquired right after ctx is done, when the previous holder released it because of the same ctx
+		if ctx.Err() != nil {
+			releaseLock(lock, name, logger)
+			return nil
+		}
+
+		logger.Logf(log.InfoLevel, "acquired exclusive lock %s", name)
+
+		runCtx := ctx
+		if leased, ok := lock.(LeasedLock); ok {
+			runCtx = leased.Context()
+		}
+
+		err = fn(runCtx)
+		// releasing a leased lock cancels its context
+		interrupted := runCtx.Err() != nil
+
+		releaseLock(lock, name, logger)
+
+		// fn has finished by itself
+		if !interrupted {
+			return err
+		}
+
+		if ctx.Err() == nil {
+			logger.Logf(log.WarnLevel, "exclusive lock %s is lost, waiting to acquire it again", name)
+		}
+	}
+
+	return nil
+}
+
+func releaseLock(lock Lock, name string, logger log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), exclusiveReleaseTimeout)
+	defer cancel()
+
+	if err := lock.Release(ctx); err != nil {
+		logger.Logf(log.ErrorLevel, "releasing exclusive lock %s. %s", name, err)
+	}
+}
@@ -0,0 +1,100 @@
+package mutex
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-foreman/foreman/testing/log"
+)
+
+func TestRunExclusively(t *testing.T) {
+	t.Run("only one replica runs at a time", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewLeasedMutex(NewRedisMutex(client, log.NewNilLogger(), WithLockTTL(time.Millisecond*50), WithRetryDelay(time.Millisecond*5)), time.Millisecond*10, log.NewNilLogger())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			running int
+			maxRuns int
+			started int
+		)
+
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := RunExclusively(ctx, m, "relay", log.NewNilLogger(), func(ctx context.Context) error {
+					mu.Lock()
+					running++
+					started++
+					if running > maxRuns {
+						maxRuns = running
+					}
+					mu.Unlock()
+
+					<-ctx.Done()
+
+					mu.Lock()
+					running--
+					mu.Unlock()
+
+					return ctx.Err()
+				})
+				assert.NoError(t, err)
+			}()
+		}
+
+		wg.Wait()
+		assert.Equal(t, 1, maxRuns)
+		assert.Equal(t, 1, started, "the lease is renewed, nobody else takes over")
+	})
+
+	t.Run("fn is restarted after the lease is lost", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewLeasedMutex(NewRedisMutex(client, log.NewNilLogger(), WithLockTTL(time.Second), WithRetryDelay(time.Millisecond*5)), time.Millisecond*10, log.NewNilLogger())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		runs := 0
+		err := RunExclusively(ctx, m, "relay", log.NewNilLogger(), func(runCtx context.Context) error {
+			runs++
+			if runs == 1 {
+				client.mutex.Lock()
+				delete(client.keys, defaultRedisKeyPrefix+"relay")
+				client.mutex.Unlock()
+
+				<-runCtx.Done()
+				return runCtx.Err()
+			}
+
+			return errors.New("worker failed")
+		})
+
+		assert.EqualError(t, err, "worker failed")
+		assert.Equal(t, 2, runs)
+		assert.False(t, client.exists(defaultRedisKeyPrefix+"relay"))
+	})
+
+	t.Run("error acquiring the lock", func(t *testing.T) {
+		client := newFakeRedis()
+		client.err = errors.New("connection refused")
+
+		err := RunExclusively(context.Background(), NewRedisMutex(client, log.NewNilLogger()), "relay", log.NewNilLogger(), func(ctx context.Context) error {
+			t.Fatal("must not be called")
+			return nil
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "acquiring exclusive lock relay: acquiring lock for saga relay: connection refused")
+	})
+}
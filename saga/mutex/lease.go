@@ -0,0 +1,137 @@
+package mutex
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/health"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+// RenewableLock is a Lock which can be lost (expired, connection closed) and must be renewed while it's held
+type RenewableLock interface {
+	Lock
+	// Renew extends the lock, returns an error if the lock isn't held anymore
+	Renew(ctx context.Context) error
+}
+
+// LeasedLock is a Lock renewed in background until it's released
+type LeasedLock interface {
+	Lock
+	// Context is done once the lease is lost or the lock is released. Work done under the lock must not be committed after that.
+	Context() context.Context
+}
+
+// NewLeasedMutex wraps a Mutex whose locks implement RenewableLock. Each acquired lock is renewed every renewInterval
+// until it's released or ctx passed into Lock is done. Returned locks implement LeasedLock, their Context is cancelled if renewal fails.
+// renewInterval should be a few times less than TTL of the lock.
+func NewLeasedMutex(mutex Mutex, renewInterval time.Duration, logger log.Logger) Mutex {
+	return &leasedMutex{mutex: mutex, renewInterval: renewInterval, logger: logger}
+}
+
+// LeaseRenewableLocks is NewLeasedMutex which returns locks not implementing RenewableLock as they are instead of failing
+func LeaseRenewableLocks(mutex Mutex, renewInterval time.Duration, logger log.Logger) Mutex {
+	return &leasedMutex{mutex: mutex, renewInterval: renewInterval, logger: logger, optional: true}
+}
+
+type leasedMutex struct {
+	mutex         Mutex
+	renewInterval time.Duration
+	logger        log.Logger
+	// optional leases only renewable locks, see LeaseRenewableLocks
+	optional bool
+}
+
+// CheckHealth checks the wrapped mutex if it implements health.Checker
+func (m *leasedMutex) CheckHealth(ctx context.Context) error {
+	if checker, ok := m.mutex.(health.Checker); ok {
+		return checker.CheckHealth(ctx)
+	}
+
+	return nil
+}
+
+func (m *leasedMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
+	lock, err := m.mutex.Lock(ctx, sagaId)
+	if err != nil {
+		return nil, err
+	}
+
+	renewable, ok := lock.(RenewableLock)
+	if !ok && m.optional {
+		return lock, nil
+	}
+
+	if !ok {
+		if err := lock.Release(ctx); err != nil {
+			m.logger.Logf(log.ErrorLevel, "releasing not renewable lock of saga %s. %s", sagaId, err)
+		}
+
+		return nil, WithMutexErr(errors.Errorf("lock %T of saga %s doesn't implement RenewableLock", lock, sagaId))
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+
+	l := &leasedLock{
+		lock:    renewable,
+		sagaId:  sagaId,
+		ctx:     leaseCtx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+
+	go l.renew(m.renewInterval, m.logger)
+
+	return l, nil
+}
+
+type leasedLock struct {
+	lock    RenewableLock
+	sagaId  string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func (l *leasedLock) Context() context.Context {
+	return l.ctx
+}
+
+// Unwrap returns the renewed lock
+func (l *leasedLock) Unwrap() Lock {
+	return l.lock
+}
+
+func (l *leasedLock) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.stopped
+
+	return l.lock.Release(ctx)
+}
+
+func (l *leasedLock) renew(interval time.Duration, logger log.Logger) {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.lock.Renew(l.ctx); err != nil {
+				// the lock is being released concurrently
+				if l.ctx.Err() != nil {
+					return
+				}
+
+				logger.Logf(log.ErrorLevel, "lease of saga %s lock is lost. %s", l.sagaId, err)
+				l.cancel()
+
+				return
+			}
+		}
+	}
+}
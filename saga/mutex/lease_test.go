@@ -0,0 +1,122 @@
+package mutex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-foreman/foreman/testing/log"
+)
+
+type notRenewableLock struct {
+	released bool
+}
+
+func (l *notRenewableLock) Release(ctx context.Context) error {
+	l.released = true
+	return nil
+}
+
+type notRenewableMutex struct {
+	lock *notRenewableLock
+}
+
+func (m notRenewableMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
+	return m.lock, nil
+}
+
+func TestLeasedMutex(t *testing.T) {
+	t.Run("lock is held longer than ttl while it's renewed", func(t *testing.T) {
+		client := newFakeRedis()
+		redisMutex := NewRedisMutex(client, log.NewNilLogger(), WithLockTTL(time.Millisecond*30), WithRetryDelay(time.Millisecond*5))
+		m := NewLeasedMutex(redisMutex, time.Millisecond*10, log.NewNilLogger())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+
+		leased, ok := lock.(LeasedLock)
+		require.True(t, ok)
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*100)
+		defer waitCancel()
+
+		_, err = redisMutex.Lock(waitCtx, "123")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "waiting for lock of saga 123")
+		assert.NoError(t, leased.Context().Err())
+
+		require.NoError(t, lock.Release(ctx))
+		assert.Error(t, leased.Context().Err())
+		assert.False(t, client.exists(defaultRedisKeyPrefix+"123"))
+	})
+
+	t.Run("context of the lock is cancelled when the lease is lost", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewLeasedMutex(NewRedisMutex(client, log.NewNilLogger(), WithLockTTL(time.Second)), time.Millisecond*10, log.NewNilLogger())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+
+		client.mutex.Lock()
+		delete(client.keys, defaultRedisKeyPrefix+"123")
+		client.mutex.Unlock()
+
+		select {
+		case <-lock.(LeasedLock).Context().Done():
+		case <-ctx.Done():
+			t.Fatal("context of the lost lock wasn't cancelled")
+		}
+
+		err = lock.Release(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "lock for saga 123 is not held by this owner")
+	})
+
+	t.Run("lock isn't renewable", func(t *testing.T) {
+		lock := &notRenewableLock{}
+		m := NewLeasedMutex(notRenewableMutex{lock: lock}, time.Millisecond*10, log.NewNilLogger())
+
+		_, err := m.Lock(context.Background(), "123")
+		require.Error(t, err)
+		assert.IsType(t, MutexErr{}, err)
+		assert.EqualError(t, err, "lock *mutex.notRenewableLock of saga 123 doesn't implement RenewableLock")
+		assert.True(t, lock.released)
+	})
+}
+
+func TestLeaseRenewableLocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	t.Run("renewable lock is leased", func(t *testing.T) {
+		m := LeaseRenewableLocks(NewRedisMutex(newFakeRedis(), log.NewNilLogger(), WithFencingTokens()), time.Millisecond*10, log.NewNilLogger())
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		assert.Implements(t, (*LeasedLock)(nil), lock)
+
+		token, ok := FencingToken(lock)
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), token)
+		require.NoError(t, lock.Release(ctx))
+	})
+
+	t.Run("lock which isn't renewable is returned as is", func(t *testing.T) {
+		notRenewable := &notRenewableLock{}
+		m := LeaseRenewableLocks(notRenewableMutex{lock: notRenewable}, time.Millisecond*10, log.NewNilLogger())
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		assert.Same(t, notRenewable, lock)
+		assert.False(t, notRenewable.released)
+	})
+}
@@ -16,7 +16,7 @@ type Lock interface {
 	Release(ctx context.Context) error
 }
 
-//go:generate mockgen --build_flags=--mod=mod -destination ./../../testing/mocks/saga/mutex/mutex.go -package mutex . Mutex,Lock
+//go:generate mockgen --build_flags=--mod=mod -destination ./../../testing/mocks/saga/mutex/mutex.go -package mutex  . Mutex,Lock,LeasedLock
 
 type Mutex interface {
 	Lock(ctx context.Context, sagaId string) (Lock, error)
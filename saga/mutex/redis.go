@@ -0,0 +1,386 @@
+package mutex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+// RedisClient is a subset of redis commands used by redis mutex. It keeps foreman free of a particular redis library,
+// an adapter for go-redis is a few lines:
+//
+//	type goRedisAdapter struct{ c *redis.Client }
+//
+//	func (a goRedisAdapter) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+//		return a.c.SetNX(ctx, key, value, ttl).Result()
+//	}
+//
+//	func (a goRedisAdapter) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return a.c.Eval(ctx, script, keys, args...).Result()
+//	}
+type RedisClient interface {
+	// SetNX sets key to value with expiration only if key does not exist. Returns true if the key was set.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// Eval executes lua script
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// releaseScript deletes the key only if it still holds the token of the lock owner
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// renewScript extends expiration of the key only if it still holds the token of the lock owner
+const renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// acquireFencedScript sets the key like SET NX PX and increments the fencing counter of the saga, returns the new counter or 0 if the key is held
+const acquireFencedScript = `if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return redis.call("INCR", KEYS[2]) else return 0 end`
+
+// pingScript is evaluated by health checks, a redis instance answers 1 if it's reachable
+const pingScript = `return 1`
+
+// raiseFenceScript sets the fencing counter to ARGV[1] if it's lower, so counters of all instances reach the token of the lock
+const raiseFenceScript = `if tonumber(redis.call("GET", KEYS[1]) or "0") < tonumber(ARGV[1]) then redis.call("SET", KEYS[1], ARGV[1]) end return 1`
+
+const (
+	defaultRedisLockTTL    = time.Second * 30
+	defaultRedisRetryDelay = time.Millisecond * 50
+	defaultRedisKeyPrefix  = "foreman:saga:lock:"
+	fenceKeySuffix         = ":fence"
+	// redlockClockDrift is the share of TTL reserved for the clock drift between redis instances
+	redlockClockDrift = 0.01
+)
+
+// FencedLock is a Lock carrying a fencing token. Tokens of locks of a saga grow with each acquired lock, so a storage which remembers
+// the last token it saw can reject writes of a holder whose lock has expired meanwhile.
+type FencedLock interface {
+	Lock
+	FencingToken() int64
+}
+
+// FencingToken returns the fencing token of the lock, it unwraps locks which wrap another one (Unwrap() Lock),
+// e.g. locks returned by NewLeasedMutex. false means the lock has no token.
+func FencingToken(lock Lock) (int64, bool) {
+	for {
+		if fenced, ok := lock.(FencedLock); ok {
+			return fenced.FencingToken(), true
+		}
+
+		wrapper, ok := lock.(interface{ Unwrap() Lock })
+		if !ok {
+			return 0, false
+		}
+
+		lock = wrapper.Unwrap()
+	}
+}
+
+// RedisMutexOpt configures redis mutex
+type RedisMutexOpt func(m *redisMutex)
+
+// WithLockTTL sets expiration of a lock. If a consumer dies while holding a lock, the lock is released by redis after TTL.
+func WithLockTTL(ttl time.Duration) RedisMutexOpt {
+	return func(m *redisMutex) {
+		m.ttl = ttl
+	}
+}
+
+// WithRetryDelay sets a delay between attempts to acquire a lock that is held by someone else
+func WithRetryDelay(delay time.Duration) RedisMutexOpt {
+	return func(m *redisMutex) {
+		m.retryDelay = delay
+	}
+}
+
+// WithKeyPrefix sets a prefix of redis keys used for locks
+func WithKeyPrefix(prefix string) RedisMutexOpt {
+	return func(m *redisMutex) {
+		m.keyPrefix = prefix
+	}
+}
+
+// WithFencingTokens makes locks implement FencedLock. A counter of each saga is kept in a key with ":fence" suffix next to the lock key,
+// in Redis Cluster put both into one slot with a hash tag in the key prefix, e.g. "{foreman}:saga:lock:".
+func WithFencingTokens() RedisMutexOpt {
+	return func(m *redisMutex) {
+		m.fencing = true
+	}
+}
+
+// NewRedisMutex creates Mutex backed by redis (SET NX PX + token checked release).
+// Lock blocks retrying until the lock is acquired or ctx is done.
+func NewRedisMutex(client RedisClient, logger log.Logger, opts ...RedisMutexOpt) Mutex {
+	return NewRedlockMutex([]RedisClient{client}, logger, opts...)
+}
+
+// NewRedlockMutex creates Mutex backed by independent redis instances (Redlock). A lock is acquired once a majority of instances
+// accepted it within TTL reduced by the time it took and the clock drift, otherwise it's released on all of them and Lock retries.
+// Renew and Release succeed if a majority of instances still hold the lock. Lock fails at once if so many instances return errors
+// that a majority can't be reached.
+func NewRedlockMutex(clients []RedisClient, logger log.Logger, opts ...RedisMutexOpt) Mutex {
+	m := &redisMutex{
+		clients:    clients,
+		logger:     logger,
+		ttl:        defaultRedisLockTTL,
+		retryDelay: defaultRedisRetryDelay,
+		keyPrefix:  defaultRedisKeyPrefix,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+type redisMutex struct {
+	clients    []RedisClient
+	logger     log.Logger
+	ttl        time.Duration
+	retryDelay time.Duration
+	keyPrefix  string
+	fencing    bool
+}
+
+// LockTTL returns expiration of locks, they must be renewed more often than that, see NewLeasedMutex
+func (m *redisMutex) LockTTL() time.Duration {
+	return m.ttl
+}
+
+func (m *redisMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
+	token, err := newLockToken()
+	if err != nil {
+		return nil, WithMutexErr(errors.Wrapf(err, "generating lock token for saga %s", sagaId))
+	}
+
+	lock := &redisLock{clients: m.clients, key: m.keyPrefix + sagaId, token: token, sagaId: sagaId, ttl: m.ttl, logger: m.logger}
+
+	for {
+		acquired, err := m.acquire(ctx, lock)
+		if err != nil {
+			return nil, WithMutexErr(errors.Wrapf(err, "acquiring lock for saga %s", sagaId))
+		}
+
+		if acquired {
+			return lock, nil
+		}
+
+		m.logger.Logf(log.DebugLevel, "lock for saga %s is held by someone else, retrying in %s", sagaId, m.retryDelay)
+
+		timer := time.NewTimer(m.retryDelay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, WithMutexErr(errors.Wrapf(ctx.Err(), "waiting for lock of saga %s", sagaId))
+		case <-timer.C:
+		}
+	}
+}
+
+// CheckHealth fails if a majority of redis instances can't be reached, locks can't be acquired then, see health.Checker
+func (m *redisMutex) CheckHealth(ctx context.Context) error {
+	var (
+		reachable int
+		firstErr  error
+	)
+
+	for _, client := range m.clients {
+		if _, err := client.Eval(ctx, pingScript, nil); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		reachable++
+	}
+
+	if reachable < len(m.clients)/2+1 {
+		if firstErr == nil {
+			return errors.New("no redis instances are configured")
+		}
+
+		return errors.Wrapf(firstErr, "%d of %d redis instances are reachable", reachable, len(m.clients))
+	}
+
+	return nil
+}
+
+// acquire tries to set the lock on every instance once. If a majority isn't reached in time, the lock is released on all instances.
+func (m *redisMutex) acquire(ctx context.Context, lock *redisLock) (bool, error) {
+	var (
+		started  = time.Now()
+		acquired int
+		failed   []error
+		fence    int64
+	)
+
+	for _, client := range m.clients {
+		ok, counter, err := m.set(ctx, client, lock)
+		if err != nil {
+			failed = append(failed, err)
+			continue
+		}
+
+		if ok {
+			acquired++
+		}
+
+		if counter > fence {
+			fence = counter
+		}
+	}
+
+	drift := time.Duration(float64(m.ttl)*redlockClockDrift) + time.Millisecond*2
+	if acquired >= lock.quorum() && time.Since(started)+drift < m.ttl {
+		if !m.fencing || m.raiseFence(ctx, lock, fence) {
+			lock.fencingToken = fence
+			return true, nil
+		}
+	}
+
+	if acquired > 0 {
+		lock.releaseQuietly(ctx)
+	}
+
+	if len(failed) > len(m.clients)-lock.quorum() {
+		return false, failed[0]
+	}
+
+	return false, nil
+}
+
+// set sets the lock on one instance, with fencing tokens it returns the incremented counter of the instance
+func (m *redisMutex) set(ctx context.Context, client RedisClient, lock *redisLock) (bool, int64, error) {
+	if !m.fencing {
+		ok, err := client.SetNX(ctx, lock.key, lock.token, m.ttl)
+		return ok, 0, err
+	}
+
+	res, err := client.Eval(ctx, acquireFencedScript, []string{lock.key, lock.key + fenceKeySuffix}, lock.token, m.ttl.Milliseconds())
+	if err != nil {
+		return false, 0, err
+	}
+
+	counter, _ := res.(int64)
+
+	return counter > 0, counter, nil
+}
+
+// raiseFence brings counters of a majority of instances up to the token, so any later majority sees it and issues a greater one
+func (m *redisMutex) raiseFence(ctx context.Context, lock *redisLock, fence int64) bool {
+	if len(m.clients) == 1 {
+		return true
+	}
+
+	raised := 0
+
+	for _, client := range m.clients {
+		if _, err := client.Eval(ctx, raiseFenceScript, []string{lock.key + fenceKeySuffix}, fence); err != nil {
+			m.logger.Logf(log.WarnLevel, "raising fencing counter of saga %s. %s", lock.sagaId, err)
+			continue
+		}
+
+		raised++
+	}
+
+	return raised >= lock.quorum()
+}
+
+type redisLock struct {
+	clients      []RedisClient
+	key          string
+	token        string
+	sagaId       string
+	ttl          time.Duration
+	fencingToken int64
+	logger       log.Logger
+}
+
+// FencingToken is 0 unless the mutex is created with WithFencingTokens
+func (l *redisLock) FencingToken() int64 {
+	return l.fencingToken
+}
+
+// Renew extends the lock by TTL, wrap the mutex with NewLeasedMutex to renew locks in background
+func (l *redisLock) Renew(ctx context.Context) error {
+	held, err := l.evalOnQuorum(ctx, renewScript, l.token, l.ttl.Milliseconds())
+	if err != nil {
+		return WithMutexErr(errors.Wrapf(err, "renewing lock for saga %s", l.sagaId))
+	}
+
+	if !held {
+		return WithMutexErr(errors.Errorf("lock for saga %s is not held by this owner, probably it expired", l.sagaId))
+	}
+
+	return nil
+}
+
+func (l *redisLock) Release(ctx context.Context) error {
+	held, err := l.evalOnQuorum(ctx, releaseScript, l.token)
+	if err != nil {
+		return WithMutexErr(errors.Wrapf(err, "releasing lock for saga %s", l.sagaId))
+	}
+
+	if !held {
+		return WithMutexErr(errors.Errorf("lock for saga %s is not held by this owner, probably it expired", l.sagaId))
+	}
+
+	return nil
+}
+
+// evalOnQuorum runs the script on all instances, the lock is held if a majority of them returned 1.
+// If it isn't, the first error returned by an instance is returned, if any.
+func (l *redisLock) evalOnQuorum(ctx context.Context, script string, args ...interface{}) (bool, error) {
+	var (
+		succeeded int
+		firstErr  error
+	)
+
+	for _, client := range l.clients {
+		res, err := client.Eval(ctx, script, []string{l.key}, args...)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		if ok, isInt := res.(int64); isInt && ok == 1 {
+			succeeded++
+		}
+	}
+
+	if succeeded >= l.quorum() {
+		return true, nil
+	}
+
+	return false, firstErr
+}
+
+// releaseQuietly removes the lock from instances which accepted it when a majority wasn't reached
+func (l *redisLock) releaseQuietly(ctx context.Context) {
+	for _, client := range l.clients {
+		if _, err := client.Eval(ctx, releaseScript, []string{l.key}, l.token); err != nil {
+			l.logger.Logf(log.WarnLevel, "releasing partially acquired lock of saga %s. %s", l.sagaId, err)
+		}
+	}
+}
+
+func (l *redisLock) quorum() int {
+	return len(l.clients)/2 + 1
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,356 @@
+package mutex
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-foreman/foreman/testing/log"
+)
+
+func TestRedisMutex(t *testing.T) {
+	t.Run("successfully lock saga and unlock", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewRedisMutex(client, log.NewNilLogger())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		assert.True(t, client.exists(defaultRedisKeyPrefix+"123"))
+
+		require.NoError(t, lock.Release(ctx))
+		assert.False(t, client.exists(defaultRedisKeyPrefix+"123"))
+	})
+
+	t.Run("two goroutines lock the same saga", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewRedisMutex(client, log.NewNilLogger(), WithRetryDelay(time.Millisecond))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		var (
+			wg       sync.WaitGroup
+			counter  int
+			inside   int
+			maxInner int
+			mu       sync.Mutex
+		)
+
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					lock, err := m.Lock(ctx, "hot")
+					if !assert.NoError(t, err) {
+						return
+					}
+
+					mu.Lock()
+					inside++
+					if inside > maxInner {
+						maxInner = inside
+					}
+					counter++
+					mu.Unlock()
+
+					time.Sleep(time.Microsecond * 100)
+
+					mu.Lock()
+					inside--
+					mu.Unlock()
+
+					assert.NoError(t, lock.Release(ctx))
+				}
+			}()
+		}
+
+		wg.Wait()
+		assert.Equal(t, 40, counter)
+		assert.Equal(t, 1, maxInner, "only one holder at a time")
+	})
+
+	t.Run("ctx is canceled while waiting for the lock", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewRedisMutex(client, log.NewNilLogger(), WithRetryDelay(time.Millisecond*10))
+
+		_, err := m.Lock(context.Background(), "123")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+
+		_, err = m.Lock(ctx, "123")
+		require.Error(t, err)
+		assert.IsType(t, MutexErr{}, err)
+		assert.Contains(t, err.Error(), "waiting for lock of saga 123")
+	})
+
+	t.Run("expired lock can be taken by another consumer and the first one can't release it", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewRedisMutex(client, log.NewNilLogger(), WithLockTTL(time.Millisecond*20), WithRetryDelay(time.Millisecond*5), WithKeyPrefix("test:"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		first, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+
+		second, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+
+		err = first.Release(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "lock for saga 123 is not held by this owner")
+
+		assert.True(t, client.exists("test:123"))
+		assert.NoError(t, second.Release(ctx))
+	})
+
+	t.Run("redis returns an error", func(t *testing.T) {
+		client := newFakeRedis()
+		client.err = errors.New("connection refused")
+		m := NewRedisMutex(client, log.NewNilLogger())
+
+		_, err := m.Lock(context.Background(), "123")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "acquiring lock for saga 123: connection refused")
+	})
+}
+
+func TestRedisMutexFencingTokens(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	t.Run("tokens grow with each lock of a saga", func(t *testing.T) {
+		client := newFakeRedis()
+		m := NewRedisMutex(client, log.NewNilLogger(), WithFencingTokens())
+
+		first, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		firstToken, ok := FencingToken(first)
+		require.True(t, ok)
+		require.NoError(t, first.Release(ctx))
+
+		second, err := NewLeasedMutex(m, time.Second, log.NewNilLogger()).Lock(ctx, "123")
+		require.NoError(t, err)
+		secondToken, ok := FencingToken(second)
+		require.True(t, ok, "token of a leased lock is taken from the wrapped lock")
+		require.NoError(t, second.Release(ctx))
+
+		assert.Equal(t, int64(1), firstToken)
+		assert.Equal(t, int64(2), secondToken)
+		assert.Equal(t, int64(2), client.counters[defaultRedisKeyPrefix+"123"+fenceKeySuffix])
+	})
+
+	t.Run("lock of other mutex has no token", func(t *testing.T) {
+		_, ok := FencingToken(&unfencedLock{})
+		assert.False(t, ok)
+	})
+}
+
+func TestRedlockMutex(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	newInstances := func() []*fakeRedis {
+		return []*fakeRedis{newFakeRedis(), newFakeRedis(), newFakeRedis()}
+	}
+
+	clientsOf := func(instances []*fakeRedis) []RedisClient {
+		clients := make([]RedisClient, len(instances))
+		for i, instance := range instances {
+			clients[i] = instance
+		}
+
+		return clients
+	}
+
+	t.Run("lock is acquired on a majority of instances", func(t *testing.T) {
+		instances := newInstances()
+		instances[2].err = errors.New("connection refused")
+		m := NewRedlockMutex(clientsOf(instances), log.NewNilLogger(), WithFencingTokens())
+
+		lock, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		assert.True(t, instances[0].exists(defaultRedisKeyPrefix+"123"))
+		assert.True(t, instances[1].exists(defaultRedisKeyPrefix+"123"))
+
+		token, _ := FencingToken(lock)
+		assert.Equal(t, int64(1), token)
+
+		require.NoError(t, lock.(RenewableLock).Renew(ctx))
+		require.NoError(t, lock.Release(ctx))
+		assert.False(t, instances[0].exists(defaultRedisKeyPrefix+"123"))
+	})
+
+	t.Run("majority can't be reached because of errors", func(t *testing.T) {
+		instances := newInstances()
+		instances[1].err = errors.New("connection refused")
+		instances[2].err = errors.New("connection refused")
+		m := NewRedlockMutex(clientsOf(instances), log.NewNilLogger())
+
+		_, err := m.Lock(ctx, "123")
+		require.Error(t, err)
+		assert.IsType(t, MutexErr{}, err)
+		assert.Contains(t, err.Error(), "acquiring lock for saga 123: connection refused")
+		assert.False(t, instances[0].exists(defaultRedisKeyPrefix+"123"), "the lock is released on instances which accepted it")
+	})
+
+	t.Run("lock held on a majority blocks others", func(t *testing.T) {
+		instances := newInstances()
+		m := NewRedlockMutex(clientsOf(instances), log.NewNilLogger(), WithRetryDelay(time.Millisecond*5))
+
+		// another owner holds the lock on two instances
+		for _, instance := range instances[1:] {
+			_, err := instance.SetNX(ctx, defaultRedisKeyPrefix+"123", "other", time.Minute)
+			require.NoError(t, err)
+		}
+
+		waitCtx, cancelWait := context.WithTimeout(ctx, time.Millisecond*30)
+		defer cancelWait()
+
+		_, err := m.Lock(waitCtx, "123")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "waiting for lock of saga 123")
+		assert.False(t, instances[0].exists(defaultRedisKeyPrefix+"123"), "the lock is released on instances which accepted it")
+	})
+
+	t.Run("token grows when the next majority differs", func(t *testing.T) {
+		instances := newInstances()
+		m := NewRedlockMutex(clientsOf(instances), log.NewNilLogger(), WithFencingTokens())
+
+		// the counter of the first instance is ahead after it was the only one reachable for other locks
+		instances[0].counters[defaultRedisKeyPrefix+"123"+fenceKeySuffix] = 5
+
+		first, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		firstToken, _ := FencingToken(first)
+		require.NoError(t, first.Release(ctx))
+
+		instances[0].err = errors.New("connection refused")
+
+		second, err := m.Lock(ctx, "123")
+		require.NoError(t, err)
+		secondToken, _ := FencingToken(second)
+
+		assert.Equal(t, int64(6), firstToken)
+		assert.Equal(t, int64(7), secondToken)
+	})
+}
+
+func TestRedisMutex_CheckHealth(t *testing.T) {
+	ctx := context.Background()
+	instances := []*fakeRedis{newFakeRedis(), newFakeRedis(), newFakeRedis()}
+	m := NewRedlockMutex([]RedisClient{instances[0], instances[1], instances[2]}, log.NewNilLogger()).(*redisMutex)
+
+	instances[2].err = errors.New("connection refused")
+	assert.NoError(t, m.CheckHealth(ctx), "a majority of instances is reachable")
+
+	instances[1].err = errors.New("connection refused")
+	assert.EqualError(t, m.CheckHealth(ctx), "1 of 3 redis instances are reachable: connection refused")
+
+	leased := NewLeasedMutex(m, time.Second, log.NewNilLogger()).(*leasedMutex)
+	assert.Error(t, leased.CheckHealth(ctx), "leased mutex checks the wrapped one")
+}
+
+type unfencedLock struct {
+	Lock
+}
+
+// fakeRedis emulates SET NX PX, the acquire, fence, release and renew scripts in memory
+type fakeRedis struct {
+	mutex    sync.Mutex
+	keys     map[string]fakeRedisValue
+	counters map[string]int64
+	err      error
+}
+
+type fakeRedisValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{keys: make(map[string]fakeRedisValue), counters: make(map[string]int64)}
+}
+
+func (f *fakeRedis) SetNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err != nil {
+		return false, f.err
+	}
+
+	if v, exists := f.keys[key]; exists && time.Now().Before(v.expiresAt) {
+		return false, nil
+	}
+
+	f.keys[key] = fakeRedisValue{value: value, expiresAt: time.Now().Add(ttl)}
+
+	return true, nil
+}
+
+func (f *fakeRedis) Eval(_ context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	switch script {
+	case acquireFencedScript:
+		if v, exists := f.keys[keys[0]]; exists && time.Now().Before(v.expiresAt) {
+			return int64(0), nil
+		}
+
+		f.keys[keys[0]] = fakeRedisValue{value: args[0].(string), expiresAt: time.Now().Add(time.Duration(args[1].(int64)) * time.Millisecond)}
+		f.counters[keys[1]]++
+
+		return f.counters[keys[1]], nil
+	case raiseFenceScript:
+		if f.counters[keys[0]] < args[0].(int64) {
+			f.counters[keys[0]] = args[0].(int64)
+		}
+
+		return int64(1), nil
+	case pingScript:
+		return int64(1), nil
+	}
+
+	v, exists := f.keys[keys[0]]
+	if !exists || time.Now().After(v.expiresAt) || v.value != args[0] {
+		return int64(0), nil
+	}
+
+	switch script {
+	case releaseScript:
+		delete(f.keys, keys[0])
+	case renewScript:
+		v.expiresAt = time.Now().Add(time.Duration(args[1].(int64)) * time.Millisecond)
+		f.keys[keys[0]] = v
+	default:
+		return nil, errors.Errorf("unknown script %s", script)
+	}
+
+	return int64(1), nil
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	v, exists := f.keys[key]
+
+	return exists && time.Now().Before(v.expiresAt)
+}
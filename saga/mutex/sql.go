@@ -15,6 +15,17 @@ import (
 
 type sqlLock struct {
 	releaseFunc func(context.Context) error
+	conn        *sagaSql.Conn
+	sagaId      string
+}
+
+// Renew checks that the connection holding the lock is alive, the lock is released by the database once the connection is closed
+func (l *sqlLock) Renew(ctx context.Context) error {
+	if err := l.conn.PingContext(ctx); err != nil {
+		return WithMutexErr(errors.Wrapf(err, "connection holding lock for saga %s is lost", l.sagaId))
+	}
+
+	return nil
 }
 
 func (l *sqlLock) Release(ctx context.Context) error {
@@ -33,6 +44,11 @@ func NewSqlMutex(db *sagaSql.DB, driver saga.SQLDriver, logger log.Logger) Mutex
 	return &pgsqlMutex{db: db, logger: logger}
 }
 
+// CheckHealth pings the database locks are acquired in, see health.Checker
+func (m *mysqlMutex) CheckHealth(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
 func (m *mysqlMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
 	conn, err := m.db.Conn(ctx, sagaId, true)
 
@@ -58,6 +74,8 @@ func (m *mysqlMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
 			releaseFunc: func(ctx context.Context) error {
 				return m.release(ctx, conn, sagaId)
 			},
+			conn:   conn,
+			sagaId: sagaId,
 		}, nil
 	}
 
@@ -92,6 +110,11 @@ type pgsqlMutex struct {
 	logger log.Logger
 }
 
+// CheckHealth pings the database locks are acquired in, see health.Checker
+func (p *pgsqlMutex) CheckHealth(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
 func (p *pgsqlMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
 	var (
 		conn *sagaSql.Conn
@@ -141,6 +164,8 @@ func (p *pgsqlMutex) Lock(ctx context.Context, sagaId string) (Lock, error) {
 		releaseFunc: func(ctx context.Context) error {
 			return p.release(ctx, conn, sagaId)
 		},
+		conn:   conn,
+		sagaId: sagaId,
 	}, nil
 }
 
@@ -0,0 +1,290 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	operationTableName     = "saga_operation"
+	operationItemTableName = "saga_operation_item"
+)
+
+// OperationResult is a result of an action applied to one saga of a bulk operation
+type OperationResult string
+
+const (
+	// OperationPending means the saga is queued, the action isn't applied yet
+	OperationPending OperationResult = "pending"
+	// OperationSent means the command of the action was sent
+	OperationSent OperationResult = "sent"
+	// OperationFailed means the action couldn't be applied, see OperationItem.Error
+	OperationFailed OperationResult = "failed"
+)
+
+// Operation tracks a bulk action applied to sagas matching a filter. Matching sagas are queued as items when the operation starts,
+// so the work left is known after a restart and sagas which started matching later aren't touched.
+type Operation struct {
+	ID         string          `json:"id"`
+	Action     string          `json:"action"`
+	Filter     OperationFilter `json:"filter"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Items      []OperationItem `json:"items"`
+}
+
+// OperationFilter is a filter sagas of an operation were selected by
+type OperationFilter struct {
+	Status   string `json:"status,omitempty"`
+	SagaName string `json:"saga_name,omitempty"`
+}
+
+type OperationItem struct {
+	SagaUID string          `json:"saga_uid"`
+	Result  OperationResult `json:"result"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// OperationProgress counts items of an operation by their results
+type OperationProgress struct {
+	Total   int `json:"total"`
+	Pending int `json:"pending"`
+	Sent    int `json:"sent"`
+	Failed  int `json:"failed"`
+}
+
+func (o Operation) Progress() OperationProgress {
+	progress := OperationProgress{Total: len(o.Items)}
+
+	for _, item := range o.Items {
+		switch item.Result {
+		case OperationPending:
+			progress.Pending++
+		case OperationSent:
+			progress.Sent++
+		case OperationFailed:
+			progress.Failed++
+		}
+	}
+
+	return progress
+}
+
+// Finished tells whether all items of the operation are processed
+func (o Operation) Finished() bool {
+	return o.FinishedAt != nil
+}
+
+// SagaUIDs returns uids of all sagas queued in the operation
+func (o Operation) SagaUIDs() []string {
+	uids := make([]string, len(o.Items))
+	for i, item := range o.Items {
+		uids[i] = item.SagaUID
+	}
+
+	return uids
+}
+
+//go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/operation.go -package saga . OperationStore
+
+// OperationStore persists bulk operations together with results of their items
+type OperationStore interface {
+	// CreateOperation saves the operation with its items at once
+	CreateOperation(ctx context.Context, operation *Operation) error
+	// GetOperation returns nil if the operation isn't found
+	GetOperation(ctx context.Context, operationId string) (*Operation, error)
+	// GetUnfinishedOperations returns operations which have pending items or aren't marked as finished, oldest first
+	GetUnfinishedOperations(ctx context.Context) ([]*Operation, error)
+	// SetItemResult saves the result of the action applied to one saga of the operation
+	SetItemResult(ctx context.Context, operationId string, item OperationItem) error
+	// FinishOperation marks the operation as finished
+	FinishOperation(ctx context.Context, operationId string, finishedAt time.Time) error
+}
+
+// SQLOperationStore is an OperationStore keeping operations in saga_operation table and their items in saga_operation_item table
+type SQLOperationStore struct {
+	db     *sagaSql.DB
+	driver SQLDriver
+}
+
+// NewSQLOperationStore creates tables of operations if they don't exist, it supports mysql and postgres drivers
+func NewSQLOperationStore(db *sagaSql.DB, driver SQLDriver) (*SQLOperationStore, error) {
+	s := &SQLOperationStore{db: db, driver: driver}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrapf(err, "initializing tables for SQLOperationStore, driver %s", driver)
+	}
+
+	return s, nil
+}
+
+func (s *SQLOperationStore) CreateOperation(ctx context.Context, operation *Operation) error {
+	filter, err := json.Marshal(operation.Filter)
+	if err != nil {
+		return errors.Wrapf(err, "marshaling filter of operation %s", operation.ID)
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("INSERT INTO %s (id, action, filters, started_at, finished_at) VALUES (?, ?, ?, ?, ?);", operationTableName)),
+		operation.ID, operation.Action, string(filter), operation.StartedAt, operation.FinishedAt,
+	); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return errors.Wrapf(err, "inserting operation %s", operation.ID)
+	}
+
+	for _, item := range operation.Items {
+		if _, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("INSERT INTO %s (operation_id, saga_uid, result, error) VALUES (?, ?, ?, ?);", operationItemTableName)),
+			operation.ID, item.SagaUID, string(item.Result), item.Error,
+		); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return errors.Wrapf(rErr, "rollback when %s", err)
+			}
+			return errors.Wrapf(err, "inserting saga %s of operation %s", item.SagaUID, operation.ID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "committing operation %s", operation.ID)
+	}
+
+	return nil
+}
+
+func (s *SQLOperationStore) GetOperation(ctx context.Context, operationId string) (*Operation, error) {
+	operations, err := s.queryOperations(ctx, "id = ?", operationId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(operations) == 0 {
+		return nil, nil
+	}
+
+	return operations[0], nil
+}
+
+func (s *SQLOperationStore) GetUnfinishedOperations(ctx context.Context) ([]*Operation, error) {
+	return s.queryOperations(ctx, "finished_at IS NULL")
+}
+
+func (s *SQLOperationStore) SetItemResult(ctx context.Context, operationId string, item OperationItem) error {
+	if _, err := s.db.ExecContext(ctx, s.prepQuery(fmt.Sprintf("UPDATE %s SET result=?, error=? WHERE operation_id=? AND saga_uid=?;", operationItemTableName)),
+		string(item.Result), item.Error, operationId, item.SagaUID,
+	); err != nil {
+		return errors.Wrapf(err, "updating saga %s of operation %s", item.SagaUID, operationId)
+	}
+
+	return nil
+}
+
+func (s *SQLOperationStore) FinishOperation(ctx context.Context, operationId string, finishedAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, s.prepQuery(fmt.Sprintf("UPDATE %s SET finished_at=? WHERE id=?;", operationTableName)), finishedAt, operationId); err != nil {
+		return errors.Wrapf(err, "finishing operation %s", operationId)
+	}
+
+	return nil
+}
+
+func (s *SQLOperationStore) queryOperations(ctx context.Context, condition string, args ...interface{}) ([]*Operation, error) {
+	rows, err := s.db.QueryContext(ctx, s.prepQuery(fmt.Sprintf(
+		"SELECT o.id, o.action, o.filters, o.started_at, o.finished_at, i.saga_uid, i.result, i.error FROM %s o LEFT JOIN %s i ON i.operation_id = o.id WHERE o.%s ORDER BY o.started_at, o.id, i.saga_uid;",
+		operationTableName, operationItemTableName, condition,
+	)), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying operations")
+	}
+
+	defer rows.Close()
+
+	var (
+		operations []*Operation
+		current    *Operation
+	)
+
+	for rows.Next() {
+		var (
+			id, action, filter      string
+			startedAt               time.Time
+			finishedAt              sql.NullTime
+			sagaUID, result, errMsg sql.NullString
+		)
+
+		if err := rows.Scan(&id, &action, &filter, &startedAt, &finishedAt, &sagaUID, &result, &errMsg); err != nil {
+			return nil, errors.Wrap(err, "scanning operation")
+		}
+
+		if current == nil || current.ID != id {
+			current = &Operation{ID: id, Action: action, StartedAt: startedAt}
+
+			if finishedAt.Valid {
+				current.FinishedAt = &finishedAt.Time
+			}
+
+			if err := json.Unmarshal([]byte(filter), &current.Filter); err != nil {
+				return nil, errors.Wrapf(err, "unmarshaling filter of operation %s", id)
+			}
+
+			operations = append(operations, current)
+		}
+
+		if sagaUID.Valid {
+			current.Items = append(current.Items, OperationItem{SagaUID: sagaUID.String, Result: OperationResult(result.String), Error: errMsg.String})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating over operations")
+	}
+
+	return operations, nil
+}
+
+func (s *SQLOperationStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id varchar(255) not null primary key,
+		action varchar(255) not null,
+		filters text not null,
+		started_at timestamp null,
+		finished_at timestamp null
+	);`, operationTableName)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		operation_id varchar(255) not null,
+		saga_uid varchar(255) not null,
+		result varchar(255) not null,
+		error text null,
+		primary key (operation_id, saga_uid),
+		constraint saga_operation_item_operation_id_fk
+			foreign key (operation_id) references %[2]v (id)
+				on update cascade on delete cascade
+	);`, operationItemTableName, operationTableName)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (s *SQLOperationStore) prepQuery(query string) string {
+	return prepDriverQuery(s.driver, query)
+}
+
+var _ OperationStore = (*SQLOperationStore)(nil)
@@ -0,0 +1,131 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLOperationStore(t *testing.T) {
+	ctx := context.Background()
+	startedAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	operationColumns := []string{"o.id", "o.action", "o.filters", "o.started_at", "o.finished_at", "i.saga_uid", "i.result", "i.error"}
+
+	t.Run("pg create and get operation", func(t *testing.T) {
+		store, mock := createOperationStore(t, PGDriver)
+		operation := &Operation{
+			ID:        "op-1",
+			Action:    "recover",
+			Filter:    OperationFilter{Status: "failed"},
+			StartedAt: startedAt,
+			Items:     []OperationItem{{SagaUID: "1", Result: OperationPending}, {SagaUID: "2", Result: OperationPending}},
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO saga_operation (id, action, filters, started_at, finished_at) VALUES ($1, $2, $3, $4, $5);").
+			WithArgs("op-1", "recover", `{"status":"failed"}`, startedAt, nil).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO saga_operation_item (operation_id, saga_uid, result, error) VALUES ($1, $2, $3, $4);").
+			WithArgs("op-1", "1", "pending", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO saga_operation_item (operation_id, saga_uid, result, error) VALUES ($1, $2, $3, $4);").
+			WithArgs("op-1", "2", "pending", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, store.CreateOperation(ctx, operation))
+
+		mock.ExpectQuery("SELECT o.id, o.action, o.filters, o.started_at, o.finished_at, i.saga_uid, i.result, i.error FROM saga_operation o LEFT JOIN saga_operation_item i ON i.operation_id = o.id WHERE o.id = $1 ORDER BY o.started_at, o.id, i.saga_uid;").
+			WithArgs("op-1").
+			WillReturnRows(sqlmock.NewRows(operationColumns).
+				AddRow("op-1", "recover", `{"status":"failed"}`, startedAt, nil, "1", "sent", nil).
+				AddRow("op-1", "recover", `{"status":"failed"}`, startedAt, nil, "2", "failed", "saga not found"),
+			)
+
+		loaded, err := store.GetOperation(ctx, "op-1")
+		require.NoError(t, err)
+		assert.Equal(t, &Operation{
+			ID:        "op-1",
+			Action:    "recover",
+			Filter:    OperationFilter{Status: "failed"},
+			StartedAt: startedAt,
+			Items:     []OperationItem{{SagaUID: "1", Result: OperationSent}, {SagaUID: "2", Result: OperationFailed, Error: "saga not found"}},
+		}, loaded)
+		assert.Equal(t, OperationProgress{Total: 2, Sent: 1, Failed: 1}, loaded.Progress())
+
+		mock.ExpectQuery("SELECT o.id, o.action, o.filters, o.started_at, o.finished_at, i.saga_uid, i.result, i.error FROM saga_operation o LEFT JOIN saga_operation_item i ON i.operation_id = o.id WHERE o.id = $1 ORDER BY o.started_at, o.id, i.saga_uid;").
+			WithArgs("op-2").
+			WillReturnRows(sqlmock.NewRows(operationColumns))
+
+		loaded, err = store.GetOperation(ctx, "op-2")
+		require.NoError(t, err)
+		assert.Nil(t, loaded)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql create operation rolls back", func(t *testing.T) {
+		store, mock := createOperationStore(t, MYSQLDriver)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO saga_operation (id, action, filters, started_at, finished_at) VALUES (?, ?, ?, ?, ?);").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO saga_operation_item (operation_id, saga_uid, result, error) VALUES (?, ?, ?, ?);").
+			WillReturnError(errors.New("connection lost"))
+		mock.ExpectRollback()
+
+		err := store.CreateOperation(ctx, &Operation{ID: "op-1", Action: "recover", StartedAt: startedAt, Items: []OperationItem{{SagaUID: "1", Result: OperationPending}}})
+		assert.EqualError(t, err, "inserting saga 1 of operation op-1: connection lost")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql unfinished operations and progress", func(t *testing.T) {
+		store, mock := createOperationStore(t, MYSQLDriver)
+
+		mock.ExpectQuery("SELECT o.id, o.action, o.filters, o.started_at, o.finished_at, i.saga_uid, i.result, i.error FROM saga_operation o LEFT JOIN saga_operation_item i ON i.operation_id = o.id WHERE o.finished_at IS NULL ORDER BY o.started_at, o.id, i.saga_uid;").
+			WillReturnRows(sqlmock.NewRows(operationColumns).
+				AddRow("op-1", "compensate", `{"saga_name":"order"}`, startedAt, nil, "1", "pending", nil).
+				AddRow("op-2", "recover", `{}`, startedAt, nil, nil, nil, nil),
+			)
+
+		operations, err := store.GetUnfinishedOperations(ctx)
+		require.NoError(t, err)
+		require.Len(t, operations, 2)
+		assert.Equal(t, OperationFilter{SagaName: "order"}, operations[0].Filter)
+		assert.Equal(t, []string{"1"}, operations[0].SagaUIDs())
+		assert.Empty(t, operations[1].Items)
+
+		mock.ExpectExec("UPDATE saga_operation_item SET result=?, error=? WHERE operation_id=? AND saga_uid=?;").
+			WithArgs("failed", "boom", "op-1", "1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		require.NoError(t, store.SetItemResult(ctx, "op-1", OperationItem{SagaUID: "1", Result: OperationFailed, Error: "boom"}))
+
+		mock.ExpectExec("UPDATE saga_operation SET finished_at=? WHERE id=?;").
+			WithArgs(startedAt, "op-1").
+			WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, store.FinishOperation(ctx, "op-1", startedAt), "finishing operation op-1: connection lost")
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func createOperationStore(t *testing.T, driver SQLDriver) (*SQLOperationStore, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	mock.ExpectExec("create table if not exists saga_operation ( id varchar(255) not null primary key, action varchar(255) not null, filters text not null, started_at timestamp null, finished_at timestamp null );").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists saga_operation_item ( operation_id varchar(255) not null, saga_uid varchar(255) not null, result varchar(255) not null, error text null, primary key (operation_id, saga_uid), constraint saga_operation_item_operation_id_fk foreign key (operation_id) references saga_operation (id) on update cascade on delete cascade );").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	store, err := NewSQLOperationStore(formanSql.NewDB(db), driver)
+	require.NoError(t, err)
+
+	return store, mock
+}
@@ -0,0 +1,358 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	outboxTableName = "saga_outbox"
+	outboxRelayName = "saga-outbox-relay"
+)
+
+// OutboxMessage is a message written into the outbox and not sent yet
+type OutboxMessage struct {
+	ID      int64
+	SagaUID string
+	Message *message.OutcomingMessage
+	Options []endpoint.DeliveryOption
+	// Attempts is a number of failed sends
+	Attempts int
+}
+
+// OutboxStats counts messages of the outbox which aren't sent yet
+type OutboxStats struct {
+	Pending int `json:"pending"`
+	// Failed are pending messages which failed to be sent at least once
+	Failed int `json:"failed"`
+}
+
+//go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/outbox.go -package saga . Outbox
+
+// Outbox keeps messages dispatched by saga handlers until they are sent, so the saga state and its messages are saved together
+type Outbox interface {
+	// Add writes the message within the transaction of the saga update. Delay and idempotency key of options are kept with it.
+	Add(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error
+	// Pending returns up to limit messages which aren't sent yet in the order they were added
+	Pending(ctx context.Context, limit int) ([]OutboxMessage, error)
+	MarkSent(ctx context.Context, id int64) error
+	// MarkFailed keeps the message pending and records the error of the attempt
+	MarkFailed(ctx context.Context, id int64, sendErr error) error
+	Stats(ctx context.Context) (OutboxStats, error)
+}
+
+// SQLOutbox is an Outbox kept in saga_outbox table of the database of TransactionalStore
+type SQLOutbox struct {
+	db            *sagaSql.DB
+	driver        SQLDriver
+	msgMarshaller message.Marshaller
+}
+
+// NewSQLOutbox creates the outbox table if it doesn't exist, it supports mysql and postgres drivers
+func NewSQLOutbox(db *sagaSql.DB, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLOutbox, error) {
+	o := &SQLOutbox{db: db, driver: driver, msgMarshaller: msgMarshaller}
+
+	if err := o.initTable(); err != nil {
+		return nil, errors.Wrapf(err, "initializing table for SQLOutbox, driver %s", driver)
+	}
+
+	return o, nil
+}
+
+func (o *SQLOutbox) Add(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	payload, err := o.msgMarshaller.Marshal(msg.Payload())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling message %s of saga %s into outbox", msg.UID(), sagaId)
+	}
+
+	headers, err := json.Marshal(msg.Headers())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling headers of message %s of saga %s into outbox", msg.UID(), sagaId)
+	}
+
+	now := time.Now()
+
+	// a delay is counted from the moment the message is dispatched, not from the moment the relay sends it
+	var deliverAt *time.Time
+	if delay := endpoint.DeliveryDelay(options...); delay > 0 {
+		at := now.Add(delay)
+		deliverAt = &at
+	}
+
+	idempotencyKey, idempotencyScope := endpoint.DeliveryIdempotencyKey(options...)
+
+	if _, err := tx.ExecContext(ctx, prepDriverQuery(o.driver, fmt.Sprintf("INSERT INTO %s (saga_uid, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", outboxTableName)),
+		sagaId, msg.UID(), payload, string(headers), deliverAt, idempotencyKey, int(idempotencyScope), now,
+	); err != nil {
+		return errors.Wrapf(err, "inserting message %s of saga %s into outbox", msg.UID(), sagaId)
+	}
+
+	return nil
+}
+
+func (o *SQLOutbox) Pending(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	rows, err := o.db.QueryContext(ctx, prepDriverQuery(o.driver, fmt.Sprintf("SELECT id, saga_uid, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, attempts FROM %s WHERE sent_at IS NULL ORDER BY id LIMIT ?;", outboxTableName)), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying pending outbox messages")
+	}
+
+	defer rows.Close()
+
+	var messages []OutboxMessage
+
+	for rows.Next() {
+		var (
+			outboxMsg        OutboxMessage
+			msgUID, headers  string
+			payload          []byte
+			deliverAt        sql.NullTime
+			idempotencyKey   sql.NullString
+			idempotencyScope int
+		)
+
+		if err := rows.Scan(&outboxMsg.ID, &outboxMsg.SagaUID, &msgUID, &payload, &headers, &deliverAt, &idempotencyKey, &idempotencyScope, &outboxMsg.Attempts); err != nil {
+			return nil, errors.Wrap(err, "scanning outbox message")
+		}
+
+		obj, err := o.msgMarshaller.Unmarshal(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling outbox message %d", outboxMsg.ID)
+		}
+
+		msgHeaders := make(message.Headers)
+		if err := json.Unmarshal([]byte(headers), &msgHeaders); err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling headers of outbox message %d", outboxMsg.ID)
+		}
+
+		outboxMsg.Message = message.NewOutcomingMessage(obj, message.WithHeaders(msgHeaders), message.WithUID(msgUID))
+
+		if deliverAt.Valid {
+			outboxMsg.Options = append(outboxMsg.Options, endpoint.WithDeliverAt(deliverAt.Time))
+		}
+
+		if idempotencyKey.String != "" {
+			outboxMsg.Options = append(outboxMsg.Options, endpoint.WithIdempotencyKey(idempotencyKey.String, endpoint.IdempotencyScope(idempotencyScope)))
+		}
+
+		messages = append(messages, outboxMsg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating over outbox messages")
+	}
+
+	return messages, nil
+}
+
+func (o *SQLOutbox) MarkSent(ctx context.Context, id int64) error {
+	if _, err := o.db.ExecContext(ctx, prepDriverQuery(o.driver, fmt.Sprintf("UPDATE %s SET sent_at=?, last_error=NULL WHERE id=?;", outboxTableName)), time.Now(), id); err != nil {
+		return errors.Wrapf(err, "marking outbox message %d as sent", id)
+	}
+
+	return nil
+}
+
+func (o *SQLOutbox) MarkFailed(ctx context.Context, id int64, sendErr error) error {
+	if _, err := o.db.ExecContext(ctx, prepDriverQuery(o.driver, fmt.Sprintf("UPDATE %s SET attempts=attempts+1, last_error=? WHERE id=?;", outboxTableName)), sendErr.Error(), id); err != nil {
+		return errors.Wrapf(err, "marking outbox message %d as failed", id)
+	}
+
+	return nil
+}
+
+func (o *SQLOutbox) Stats(ctx context.Context) (OutboxStats, error) {
+	var stats OutboxStats
+
+	err := o.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(CASE WHEN attempts > 0 THEN 1 ELSE 0 END), 0) FROM %s WHERE sent_at IS NULL;", outboxTableName)).
+		Scan(&stats.Pending, &stats.Failed)
+
+	if err != nil {
+		return stats, errors.Wrap(err, "counting pending outbox messages")
+	}
+
+	return stats, nil
+}
+
+func (o *SQLOutbox) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	idColumn, payloadColumn, inlineIndex := "bigint not null auto_increment primary key", "longblob", ",\n\t\tindex saga_outbox_sent_at_idx (sent_at, id)"
+
+	if o.driver == PGDriver {
+		idColumn, payloadColumn, inlineIndex = "bigserial primary key", "bytea", ""
+	}
+
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id %s,
+		saga_uid varchar(255) not null,
+		msg_uid varchar(255) not null,
+		payload %s not null,
+		headers text not null,
+		deliver_at timestamp null,
+		idempotency_key varchar(255) null,
+		idempotency_scope integer not null default 0,
+		created_at timestamp null,
+		sent_at timestamp null,
+		attempts integer not null default 0,
+		last_error text null%s
+	);`, outboxTableName, idColumn, payloadColumn, inlineIndex))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if o.driver == PGDriver {
+		if _, err := o.db.ExecContext(ctx, fmt.Sprintf("create index if not exists saga_outbox_sent_at_idx on %s (sent_at, id);", outboxTableName)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// OutboxRelay is a foreman.Worker which sends pending messages of the outbox every interval through endpoints the router
+// resolves for them, like MessageExecutionCtx.Send does. A message is marked as sent only after all its endpoints accepted it,
+// so it may be sent more than once, e.g. if the process dies before it's marked. Once a message of a saga fails,
+// following messages of the saga wait for the next run, so messages of one saga are sent in the order they were dispatched.
+// Relays of several replicas would send the same pending messages, so it must run under a worker mutex of MessageBus,
+// the saga component provides one, see foreman.WithWorkerMutex.
+type OutboxRelay struct {
+	outbox    Outbox
+	router    endpoint.Router
+	interval  time.Duration
+	batchSize int
+	logger    log.Logger
+}
+
+func NewOutboxRelay(outbox Outbox, router endpoint.Router, interval time.Duration, batchSize int, logger log.Logger) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, router: router, interval: interval, batchSize: batchSize, logger: logger}
+}
+
+func (r *OutboxRelay) Name() string {
+	return outboxRelayName
+}
+
+// Run relays pending messages until ctx is done. Failures are logged and retried on the next tick.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.relay(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Logf(log.ErrorLevel, "relaying outbox messages. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay sends batches of pending messages until the outbox is drained or a message fails
+func (r *OutboxRelay) relay(ctx context.Context) error {
+	for ctx.Err() == nil {
+		messages, err := r.outbox.Pending(ctx, r.batchSize)
+		if err != nil {
+			return err
+		}
+
+		failedSagas := make(map[string]struct{})
+
+		for _, outboxMsg := range messages {
+			if _, failed := failedSagas[outboxMsg.SagaUID]; failed {
+				continue
+			}
+
+			if err := r.send(ctx, outboxMsg); err != nil {
+				failedSagas[outboxMsg.SagaUID] = struct{}{}
+				r.logger.Logf(log.ErrorLevel, "sending outbox message %d of saga '%s', attempt %d. %s", outboxMsg.ID, outboxMsg.SagaUID, outboxMsg.Attempts+1, err)
+
+				if err := r.outbox.MarkFailed(ctx, outboxMsg.ID, err); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := r.outbox.MarkSent(ctx, outboxMsg.ID); err != nil {
+				return err
+			}
+		}
+
+		if len(messages) < r.batchSize || len(failedSagas) > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (r *OutboxRelay) send(ctx context.Context, outboxMsg OutboxMessage) error {
+	endpoints, err := routeRelayed(r.router, outboxMsg.Message)
+	if err != nil {
+		return err
+	}
+
+	if len(endpoints) == 0 {
+		r.logger.Logf(log.WarnLevel, "no endpoints defined for outbox message %d", outboxMsg.ID)
+		return nil
+	}
+
+	for _, endp := range endpoints {
+		if err := endp.Send(ctx, outboxMsg.Message, outboxMsg.Options...); err != nil {
+			return errors.Wrapf(err, "sending message %s to endpoint %s", outboxMsg.Message.UID(), endp.Name())
+		}
+	}
+
+	return nil
+}
+
+// routeRelayed returns endpoints a relayed message is sent through. endpoint.OutboxEndpoint is replaced by its target, a message
+// written by one of them is sent only through its target, other endpoints got it when it was written.
+func routeRelayed(router endpoint.Router, msg *message.OutcomingMessage) ([]endpoint.Endpoint, error) {
+	routed := router.Route(msg.Payload())
+	headers := msg.Headers()
+
+	writtenBy, writtenByEndpoint := headers[endpoint.OutboxEndpointHeader].(string)
+	delete(headers, endpoint.OutboxEndpointHeader)
+
+	endpoints := make([]endpoint.Endpoint, 0, len(routed))
+
+	for _, endp := range routed {
+		outboxEndpoint, isOutboxEndpoint := endp.(*endpoint.OutboxEndpoint)
+		if !isOutboxEndpoint {
+			endpoints = append(endpoints, endp)
+			continue
+		}
+
+		if writtenByEndpoint && outboxEndpoint.Name() == writtenBy {
+			return []endpoint.Endpoint{outboxEndpoint.Target()}, nil
+		}
+
+		endpoints = append(endpoints, outboxEndpoint.Target())
+	}
+
+	if writtenByEndpoint {
+		return nil, errors.Errorf("outbox endpoint %s isn't routed for message %s anymore", writtenBy, msg.UID())
+	}
+
+	return endpoints, nil
+}
+
+var (
+	_ Outbox                = (*SQLOutbox)(nil)
+	_ endpoint.OutboxWriter = (*SQLOutbox)(nil)
+)
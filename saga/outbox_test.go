@@ -0,0 +1,237 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	outboxColumns := []string{"id", "saga_uid", "msg_uid", "payload", "headers", "deliver_at", "idempotency_key", "idempotency_scope", "attempts"}
+
+	t.Run("pg add message in transaction", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		outbox, db, mock := createOutbox(t, PGDriver, marshallerMock)
+		msg := message.NewOutcomingMessage(&ExampleEv{Data: "data"}, message.WithHeaders(message.Headers{"sagaId": "123"}))
+
+		marshallerMock.EXPECT().Marshal(msg.Payload()).Return([]byte("payload"), nil)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO saga_outbox (saga_uid, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);").
+			WithArgs("123", msg.UID(), []byte("payload"), `{"sagaId":"123","uid":"`+msg.UID()+`"}`, sqlmock.AnyArg(), "order-1", int(endpoint.SharedScope), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		tx, err := db.Begin()
+		require.NoError(t, err)
+		require.NoError(t, outbox.Add(ctx, tx, "123", msg, endpoint.WithDelay(time.Minute), endpoint.WithIdempotencyKey("order-1", endpoint.SharedScope)))
+		require.NoError(t, tx.Commit())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql pending messages", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		outbox, _, mock := createOutbox(t, MYSQLDriver, marshallerMock)
+		deliverAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		mock.ExpectQuery("SELECT id, saga_uid, msg_uid, payload, headers, deliver_at, idempotency_key, idempotency_scope, attempts FROM saga_outbox WHERE sent_at IS NULL ORDER BY id LIMIT ?;").
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows(outboxColumns).
+				AddRow(1, "123", "msg-1", []byte("payload"), `{"sagaId":"123","uid":"msg-1"}`, deliverAt, "order-1", 1, 2).
+				AddRow(2, "123", "msg-2", []byte("payload"), `{}`, nil, nil, 0, 0),
+			)
+		marshallerMock.EXPECT().Unmarshal([]byte("payload")).Return(&ExampleEv{Data: "data"}, nil).Times(2)
+
+		messages, err := outbox.Pending(ctx, 10)
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+
+		assert.Equal(t, int64(1), messages[0].ID)
+		assert.Equal(t, 2, messages[0].Attempts)
+		assert.Equal(t, "msg-1", messages[0].Message.UID())
+		assert.Equal(t, "123", messages[0].Message.Headers()["sagaId"])
+		assert.Equal(t, &ExampleEv{Data: "data"}, messages[0].Message.Payload())
+		assert.Len(t, messages[0].Options, 2)
+		key, scope := endpoint.DeliveryIdempotencyKey(messages[0].Options...)
+		assert.Equal(t, "order-1", key)
+		assert.Equal(t, endpoint.SharedScope, scope)
+
+		assert.Equal(t, "msg-2", messages[1].Message.UID())
+		assert.Empty(t, messages[1].Options)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mark sent, failed and count", func(t *testing.T) {
+		outbox, _, mock := createOutbox(t, PGDriver, mockMessage.NewMockMarshaller(ctrl))
+
+		mock.ExpectExec("UPDATE saga_outbox SET sent_at=$1, last_error=NULL WHERE id=$2;").WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		require.NoError(t, outbox.MarkSent(ctx, 1))
+
+		mock.ExpectExec("UPDATE saga_outbox SET attempts=attempts+1, last_error=$1 WHERE id=$2;").WithArgs("broker is down", 2).WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, outbox.MarkFailed(ctx, 2, errors.New("broker is down")), "marking outbox message 2 as failed: connection lost")
+
+		mock.ExpectQuery("SELECT COUNT(*), COALESCE(SUM(CASE WHEN attempts > 0 THEN 1 ELSE 0 END), 0) FROM saga_outbox WHERE sent_at IS NULL;").
+			WillReturnRows(sqlmock.NewRows([]string{"pending", "failed"}).AddRow(5, 2))
+		stats, err := outbox.Stats(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, OutboxStats{Pending: 5, Failed: 2}, stats)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+	endpointInstance.EXPECT().Name().Return("saga-endpoint").AnyTimes()
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(endpointInstance, &ExampleEv{})
+
+	newOutboxMsg := func(id int64, sagaId string) OutboxMessage {
+		return OutboxMessage{ID: id, SagaUID: sagaId, Message: message.NewOutcomingMessage(&ExampleEv{Data: sagaId})}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second, third := newOutboxMsg(1, "a"), newOutboxMsg(2, "b"), newOutboxMsg(3, "a")
+	outbox := &fakeOutbox{pending: []OutboxMessage{first, second, third}, failed: make(map[int64]error), onPending: func(calls int) {
+		if calls == 2 {
+			cancel()
+		}
+	}}
+
+	relay := NewOutboxRelay(outbox, router, time.Millisecond*10, 3, log.NewNilLogger())
+	assert.Equal(t, "saga-outbox-relay", relay.Name())
+
+	gomock.InOrder(
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(errors.New("broker is down")),
+		endpointInstance.EXPECT().Send(gomock.Any(), second.Message).Return(nil),
+		// message 3 of saga a waits for message 1 till the next tick
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(nil),
+		endpointInstance.EXPECT().Send(gomock.Any(), third.Message).Return(nil),
+	)
+
+	assert.NoError(t, relay.Run(ctx))
+	assert.Equal(t, []int64{2, 1, 3}, outbox.sent)
+	assert.EqualError(t, outbox.failed[1], "sending message "+first.Message.UID()+" to endpoint saga-endpoint: broker is down")
+}
+
+func TestOutboxRelayOutboxEndpoints(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ordersTarget := endpointMock.NewMockEndpoint(ctrl)
+	ordersTarget.EXPECT().Name().Return("orders").AnyTimes()
+	auditEndpoint := endpointMock.NewMockEndpoint(ctrl)
+	auditEndpoint.EXPECT().Name().Return("audit").AnyTimes()
+
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(endpoint.NewOutboxEndpoint(ordersTarget, &fakeOutbox{}), &ExampleEv{})
+	router.RegisterEndpoint(auditEndpoint, &ExampleEv{})
+
+	relay := NewOutboxRelay(&fakeOutbox{}, router, time.Second, 10, log.NewNilLogger())
+
+	t.Run("message written by outbox endpoint is sent only through its target", func(t *testing.T) {
+		msg := message.NewOutcomingMessage(&ExampleEv{}, message.WithHeaders(message.Headers{endpoint.OutboxEndpointHeader: "orders"}))
+
+		ordersTarget.EXPECT().Send(gomock.Any(), msg).Return(nil)
+
+		require.NoError(t, relay.send(context.Background(), OutboxMessage{ID: 1, SagaUID: "orders", Message: msg}))
+		assert.NotContains(t, msg.Headers(), endpoint.OutboxEndpointHeader)
+	})
+
+	t.Run("message of a saga is sent through targets of outbox endpoints", func(t *testing.T) {
+		msg := message.NewOutcomingMessage(&ExampleEv{})
+
+		ordersTarget.EXPECT().Send(gomock.Any(), msg).Return(nil)
+		auditEndpoint.EXPECT().Send(gomock.Any(), msg).Return(nil)
+
+		require.NoError(t, relay.send(context.Background(), OutboxMessage{ID: 2, SagaUID: "123", Message: msg}))
+		assert.IsType(t, &endpoint.OutboxEndpoint{}, router.Route(&ExampleEv{})[0], "routes aren't changed")
+	})
+
+	t.Run("outbox endpoint isn't routed anymore", func(t *testing.T) {
+		msg := message.NewOutcomingMessage(&ExampleEv{}, message.WithHeaders(message.Headers{endpoint.OutboxEndpointHeader: "payments"}))
+
+		err := relay.send(context.Background(), OutboxMessage{ID: 3, SagaUID: "payments", Message: msg})
+		assert.EqualError(t, err, "outbox endpoint payments isn't routed for message "+msg.UID()+" anymore")
+	})
+}
+
+type fakeOutbox struct {
+	Outbox
+	pending      []OutboxMessage
+	sent         []int64
+	failed       map[int64]error
+	pendingCalls int
+	onPending    func(calls int)
+}
+
+func (o *fakeOutbox) Pending(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	o.pendingCalls++
+	o.onPending(o.pendingCalls)
+
+	if len(o.pending) > limit {
+		return o.pending[:limit], nil
+	}
+
+	return o.pending, nil
+}
+
+func (o *fakeOutbox) MarkSent(ctx context.Context, id int64) error {
+	o.sent = append(o.sent, id)
+
+	for i, outboxMsg := range o.pending {
+		if outboxMsg.ID == id {
+			o.pending = append(o.pending[:i:i], o.pending[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (o *fakeOutbox) MarkFailed(ctx context.Context, id int64, sendErr error) error {
+	o.failed[id] = sendErr
+	return nil
+}
+
+func createOutbox(t *testing.T, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLOutbox, *formanSql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	if driver == PGDriver {
+		mock.ExpectExec("create table if not exists saga_outbox ( id bigserial primary key, saga_uid varchar(255) not null, msg_uid varchar(255) not null, payload bytea not null, headers text not null, deliver_at timestamp null, idempotency_key varchar(255) null, idempotency_scope integer not null default 0, created_at timestamp null, sent_at timestamp null, attempts integer not null default 0, last_error text null );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists saga_outbox_sent_at_idx on saga_outbox (sent_at, id);").WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec("create table if not exists saga_outbox ( id bigint not null auto_increment primary key, saga_uid varchar(255) not null, msg_uid varchar(255) not null, payload longblob not null, headers text not null, deliver_at timestamp null, idempotency_key varchar(255) null, idempotency_scope integer not null default 0, created_at timestamp null, sent_at timestamp null, attempts integer not null default 0, last_error text null, index saga_outbox_sent_at_idx (sent_at, id) );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	wrapper := formanSql.NewDB(db)
+	outbox, err := NewSQLOutbox(wrapper, driver, msgMarshaller)
+	require.NoError(t, err)
+
+	return outbox, wrapper, mock
+}
@@ -0,0 +1,16 @@
+package saga
+
+import (
+	"context"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+)
+
+// TraceCarrier carries trace context of a message received by a saga over to messages the saga dispatches,
+// so a tree of sagas is one connected trace. tracing.NewTraceCarrier propagates OpenTelemetry span context.
+type TraceCarrier interface {
+	// Extract returns ctx with trace context read from headers of a received message
+	Extract(ctx context.Context, headers message.Headers) context.Context
+	// Inject writes trace context of ctx into headers of an outcoming message
+	Inject(ctx context.Context, headers message.Headers)
+}
@@ -0,0 +1,54 @@
+package saga
+
+import "context"
+
+// DefaultDeleteBatchSize is the number of sagas DeleteOlderThan selects at once when no limit is passed
+const DefaultDeleteBatchSize = 100
+
+// Archiver receives a saga with its full history before DeleteOlderThan deletes it, e.g. to copy it into cold storage.
+// The saga is kept if the archiver returns an error. It may receive the same saga again if the deletion fails after archiving.
+type Archiver func(ctx context.Context, sagaInstance Instance) error
+
+type DeleteOption func(opts *deleteOptions)
+
+// WithDeleteLimit limits the number of sagas deleted by one call of DeleteOlderThan, by default all matching sagas are deleted
+func WithDeleteLimit(limit int) DeleteOption {
+	return func(opts *deleteOptions) {
+		opts.limit = limit
+	}
+}
+
+// WithArchiver passes each saga into the archiver before it's deleted
+func WithArchiver(archiver Archiver) DeleteOption {
+	return func(opts *deleteOptions) {
+		opts.archiver = archiver
+	}
+}
+
+type deleteOptions struct {
+	limit    int
+	archiver Archiver
+}
+
+func newDeleteOptions(opts []DeleteOption) *deleteOptions {
+	o := &deleteOptions{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// batchSize returns how many sagas to select when remaining sagas are still allowed to be deleted
+func (o deleteOptions) batchSize(deleted int) int {
+	if o.limit <= 0 {
+		return DefaultDeleteBatchSize
+	}
+
+	if left := o.limit - deleted; left < DefaultDeleteBatchSize {
+		return left
+	}
+
+	return DefaultDeleteBatchSize
+}
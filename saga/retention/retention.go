@@ -0,0 +1,123 @@
+// Package retention deletes completed sagas together with their history once they outlive the retention period.
+package retention
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/saga"
+)
+
+const (
+	DefaultBatchSize = 1000
+	DefaultInterval  = time.Hour
+
+	runnerName = "saga-history-retention"
+)
+
+type Opt func(o *opts)
+
+// WithBatchSize sets the number of sagas deleted by one call of saga.Store.DeleteOlderThan, the runner calls it until everything is deleted.
+// Non positive size means DefaultBatchSize.
+func WithBatchSize(size int) Opt {
+	return func(o *opts) {
+		o.batchSize = size
+	}
+}
+
+// WithInterval sets how often the runner deletes outdated sagas
+func WithInterval(interval time.Duration) Opt {
+	return func(o *opts) {
+		o.interval = interval
+	}
+}
+
+// WithArchiver passes each saga with its history into the archiver before it's deleted, see saga.Archiver
+func WithArchiver(archiver saga.Archiver) Opt {
+	return func(o *opts) {
+		o.archiver = archiver
+	}
+}
+
+type opts struct {
+	batchSize int
+	interval  time.Duration
+	archiver  saga.Archiver
+}
+
+// Runner is a foreman.Worker which deletes completed sagas last updated more than maxAge ago every interval.
+// Register it with MessageBus.RegisterWorkers or enable it by component.WithHistoryRetention. Replicas running it at once would
+// archive the same sagas twice, so the bus must have a worker mutex, see foreman.WithWorkerMutex.
+type Runner struct {
+	store  saga.Store
+	maxAge time.Duration
+	logger log.Logger
+	opts   opts
+}
+
+func NewRunner(store saga.Store, maxAge time.Duration, logger log.Logger, options ...Opt) *Runner {
+	o := opts{batchSize: DefaultBatchSize, interval: DefaultInterval}
+
+	for _, opt := range options {
+		opt(&o)
+	}
+
+	if o.batchSize <= 0 {
+		o.batchSize = DefaultBatchSize
+	}
+
+	return &Runner{store: store, maxAge: maxAge, logger: logger, opts: o}
+}
+
+func (r *Runner) Name() string {
+	return runnerName
+}
+
+// Run deletes outdated sagas until ctx is done. Failures are logged and retried on the next tick.
+func (r *Runner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		r.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup deletes sagas in batches, so each call of the store is short and a failure doesn't roll back the sagas deleted before
+func (r *Runner) cleanup(ctx context.Context) {
+	cutoff := time.Now().Add(-r.maxAge)
+	deleteOpts := []saga.DeleteOption{saga.WithDeleteLimit(r.opts.batchSize)}
+
+	if r.opts.archiver != nil {
+		deleteOpts = append(deleteOpts, saga.WithArchiver(r.opts.archiver))
+	}
+
+	total := 0
+
+	for ctx.Err() == nil {
+		deleted, err := r.store.DeleteOlderThan(ctx, cutoff, deleteOpts...)
+		total += deleted
+
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Logf(log.ErrorLevel, "deleting completed sagas older than %s. %s", r.maxAge, err)
+			}
+			break
+		}
+
+		if deleted < r.opts.batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		r.logger.Logf(log.InfoLevel, "deleted %d completed sagas older than %s", total, r.maxAge)
+	}
+}
@@ -0,0 +1,85 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sagaPkg "github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/saga"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunner(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("deletes in batches until everything is deleted", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		runner := NewRunner(storeMock, time.Hour, log.NewNilLogger(), WithBatchSize(2), WithInterval(time.Hour))
+		assert.Equal(t, "saga-history-retention", runner.Name())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var cutoffs []time.Time
+
+		storeMock.
+			EXPECT().
+			DeleteOlderThan(gomock.Any(), gomock.Any(), gomock.Len(1)).
+			DoAndReturn(func(ctx context.Context, cutoff time.Time, opts ...sagaPkg.DeleteOption) (int, error) {
+				cutoffs = append(cutoffs, cutoff)
+				if len(cutoffs) == 3 {
+					cancel()
+					return 1, nil
+				}
+				return 2, nil
+			}).
+			Times(3)
+
+		assert.NoError(t, runner.Run(ctx))
+		assert.WithinDuration(t, time.Now().Add(-time.Hour), cutoffs[0], time.Second)
+		assert.Equal(t, cutoffs[0], cutoffs[2], "all batches of one run use the same cutoff")
+	})
+
+	t.Run("failed cleanup is retried on the next tick", func(t *testing.T) {
+		storeMock := saga.NewMockStore(ctrl)
+		archiver := func(ctx context.Context, sagaInstance sagaPkg.Instance) error {
+			return nil
+		}
+		runner := NewRunner(storeMock, time.Hour, log.NewNilLogger(), WithInterval(time.Millisecond*10), WithArchiver(archiver))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		calls := 0
+
+		storeMock.
+			EXPECT().
+			DeleteOlderThan(gomock.Any(), gomock.Any(), gomock.Len(2)).
+			DoAndReturn(func(ctx context.Context, cutoff time.Time, opts ...sagaPkg.DeleteOption) (int, error) {
+				calls++
+				if calls == 1 {
+					return 5, errors.New("connection lost")
+				}
+				cancel()
+				return 0, nil
+			}).
+			Times(2)
+
+		done := make(chan error)
+		go func() {
+			done <- runner.Run(ctx)
+		}()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("runner didn't stop")
+		}
+	})
+}
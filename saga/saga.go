@@ -2,11 +2,14 @@ package saga
 
 import (
 	"reflect"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
 )
 
 //go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/saga.go -package saga . Saga
@@ -24,14 +27,44 @@ type Saga interface {
 	Recover(sagaCtx SagaContext) error
 	// EventHandlers returns a list of assigned executors per type in Init()
 	EventHandlers() map[scheme.GroupKind]Executor
+	// TimeoutHandlers returns a list of assigned timeout executors per reason in Init()
+	TimeoutHandlers() map[string]Executor
+	// TimeoutPending returns true if the timeout wasn't cancelled or rescheduled since it was scheduled
+	TimeoutPending(reason, timeoutUID string) bool
+	// CancelTimeout forgets about a scheduled timeout, when it fires it will be ignored
+	CancelTimeout(reason string)
 	// SetSchema allows to set schema instance during the saga runtime
 	SetSchema(scheme scheme.KnownTypesRegistry)
+	// ChildCompensations returns outcomes of compensation per child uid while the saga compensates its children first
+	ChildCompensations() map[string]ChildCompensationResult
+	// SetChildCompensations replaces outcomes of compensation of children
+	SetChildCompensations(results map[string]ChildCompensationResult)
+	// Expectations returns events the saga waits for per group.kind, see SagaContext.ExpectEvent
+	Expectations() map[string]Expectation
+	// SetExpectations replaces events the saga waits for
+	SetExpectations(expectations map[string]Expectation)
 }
 
+// ChildCompensationResult is an outcome of compensation of a child saga cascaded from its parent
+type ChildCompensationResult string
+
+const (
+	ChildCompensationPending ChildCompensationResult = "pending"
+	ChildCompensationDone    ChildCompensationResult = "compensated"
+	ChildCompensationFailed  ChildCompensationResult = "failed"
+)
+
 type BaseSaga struct {
 	message.ObjectMeta
-	adjacencyMap map[scheme.GroupKind]Executor
-	scheme       scheme.KnownTypesRegistry
+	// Timeouts holds uid of the last scheduled timeout per reason, it's persisted together with the saga
+	Timeouts map[string]string `json:"timeouts,omitempty"`
+	// CompensatedChildren holds outcomes of compensation of children which are compensated before the saga, it's persisted together with the saga
+	CompensatedChildren map[string]ChildCompensationResult `json:"compensated_children,omitempty"`
+	// ExpectedEvents holds events the saga waits for per group.kind, it's persisted together with the saga
+	ExpectedEvents  map[string]Expectation `json:"expected_events,omitempty"`
+	adjacencyMap    map[scheme.GroupKind]Executor
+	timeoutHandlers map[string]Executor
+	scheme          scheme.KnownTypesRegistry
 }
 
 type Executor func(execCtx SagaContext) error
@@ -63,3 +96,68 @@ func (b *BaseSaga) SetSchema(scheme scheme.KnownTypesRegistry) {
 func (b BaseSaga) EventHandlers() map[scheme.GroupKind]Executor {
 	return b.adjacencyMap
 }
+
+// AddTimeoutHandler assigns a handler which will be called when a timeout with the reason fires
+func (b *BaseSaga) AddTimeoutHandler(reason string, handler Executor) *BaseSaga {
+	//lazy initialization
+	if b.timeoutHandlers == nil {
+		b.timeoutHandlers = make(map[string]Executor)
+	}
+
+	b.timeoutHandlers[reason] = handler
+	return b
+}
+
+func (b BaseSaga) TimeoutHandlers() map[string]Executor {
+	return b.timeoutHandlers
+}
+
+// ScheduleTimeout schedules TimeoutSagaCommand. With a Scheduler it's saved together with the saga, see WithScheduledTimeouts,
+// otherwise it's dispatched delayed and the endpoint must hold it, e.g. the broker. Scheduling a timeout with the same reason
+// again replaces the pending one.
+func (b *BaseSaga) ScheduleTimeout(sagaCtx SagaContext, reason string, after time.Duration) {
+	if b.Timeouts == nil {
+		b.Timeouts = make(map[string]string)
+	}
+
+	timeoutUID := uuid.New().String()
+	b.Timeouts[reason] = timeoutUID
+
+	timeout := &contracts.TimeoutSagaCommand{
+		SagaUID:    sagaCtx.SagaInstance().UID(),
+		TimeoutUID: timeoutUID,
+		Reason:     reason,
+	}
+
+	if scheduling, ok := sagaCtx.(timeoutScheduling); ok && scheduling.schedulesTimeouts() {
+		sagaCtx.Schedule(after, timeout)
+		return
+	}
+
+	sagaCtx.Dispatch(timeout, WithDelay(after))
+}
+
+func (b *BaseSaga) CancelTimeout(reason string) {
+	delete(b.Timeouts, reason)
+}
+
+func (b BaseSaga) TimeoutPending(reason, timeoutUID string) bool {
+	uid, exists := b.Timeouts[reason]
+	return exists && uid == timeoutUID
+}
+
+func (b BaseSaga) ChildCompensations() map[string]ChildCompensationResult {
+	return b.CompensatedChildren
+}
+
+func (b *BaseSaga) SetChildCompensations(results map[string]ChildCompensationResult) {
+	b.CompensatedChildren = results
+}
+
+func (b BaseSaga) Expectations() map[string]Expectation {
+	return b.ExpectedEvents
+}
+
+func (b *BaseSaga) SetExpectations(expectations map[string]Expectation) {
+	b.ExpectedEvents = expectations
+}
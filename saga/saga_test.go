@@ -2,8 +2,14 @@ package saga
 
 import (
 	"testing"
+	"time"
 
+	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
+	"github.com/stretchr/testify/require"
 
 	"github.com/stretchr/testify/assert"
 
@@ -43,3 +49,76 @@ func TestBaseSaga(t *testing.T) {
 
 	assert.Equal(t, scheme.GroupKind{Group: g, Kind: "DataContract"}, singleGK)
 }
+
+func TestBaseSagaTimeouts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msgExecCtxMock := execution.NewMockMessageExecutionCtx(ctrl)
+	msgExecCtxMock.EXPECT().Logger().Return(log.NewNilLogger())
+
+	exp := &sagaExample{}
+	assert.Empty(t, exp.TimeoutHandlers())
+
+	exp.AddTimeoutHandler("reply", func(execCtx SagaContext) error {
+		return nil
+	})
+	assert.Len(t, exp.TimeoutHandlers(), 1)
+
+	sagaCtx := NewSagaCtx(msgExecCtxMock, NewSagaInstance("123", "", exp))
+
+	exp.ScheduleTimeout(sagaCtx, "reply", time.Minute)
+	require.Len(t, sagaCtx.Deliveries(), 1)
+
+	first, ok := sagaCtx.Deliveries()[0].Payload.(*contracts.TimeoutSagaCommand)
+	require.True(t, ok)
+	assert.Equal(t, "123", first.SagaUID)
+	assert.Equal(t, "reply", first.Reason)
+	assert.NotEmpty(t, first.TimeoutUID)
+	assert.Len(t, sagaCtx.Deliveries()[0].Options, 1)
+	assert.True(t, exp.TimeoutPending("reply", first.TimeoutUID))
+
+	t.Run("rescheduled timeout replaces the pending one", func(t *testing.T) {
+		exp.ScheduleTimeout(sagaCtx, "reply", time.Minute)
+		require.Len(t, sagaCtx.Deliveries(), 2)
+
+		second := sagaCtx.Deliveries()[1].Payload.(*contracts.TimeoutSagaCommand)
+		assert.False(t, exp.TimeoutPending("reply", first.TimeoutUID))
+		assert.True(t, exp.TimeoutPending("reply", second.TimeoutUID))
+	})
+
+	t.Run("cancelled timeout is not pending", func(t *testing.T) {
+		exp.CancelTimeout("reply")
+		assert.Empty(t, exp.Timeouts)
+	})
+
+	t.Run("timeouts are persisted with the saga", func(t *testing.T) {
+		exp.ScheduleTimeout(sagaCtx, "reply", time.Minute)
+
+		schema := scheme.NewKnownTypesRegistry()
+		schema.AddKnownTypes("someGroup", &sagaExample{})
+		marshaller := message.NewJsonMarshaller(schema)
+
+		payload, err := marshaller.Marshal(exp)
+		require.NoError(t, err)
+
+		decoded, err := marshaller.Unmarshal(payload)
+		require.NoError(t, err)
+		assert.Equal(t, exp.Timeouts, decoded.(*sagaExample).Timeouts)
+	})
+
+	t.Run("timeouts are scheduled with the scheduler", func(t *testing.T) {
+		msgExecCtxMock.EXPECT().Logger().Return(log.NewNilLogger())
+		scheduledCtx := NewSagaCtx(msgExecCtxMock, NewSagaInstance("123", "", exp), WithScheduledTimeouts())
+
+		exp.ScheduleTimeout(scheduledCtx, "reply", time.Minute)
+		assert.Empty(t, scheduledCtx.Deliveries())
+		require.Len(t, scheduledCtx.Scheduled(), 1)
+
+		timeout, ok := scheduledCtx.Scheduled()[0].Payload.(*contracts.TimeoutSagaCommand)
+		require.True(t, ok)
+		assert.Equal(t, "reply", timeout.Reason)
+		assert.True(t, exp.TimeoutPending("reply", timeout.TimeoutUID))
+		assert.WithinDuration(t, time.Now().Add(time.Minute), scheduledCtx.Scheduled()[0].FireAt, time.Second)
+	})
+}
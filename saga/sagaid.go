@@ -2,6 +2,8 @@ package saga
 
 import (
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/transport"
 	"github.com/pkg/errors"
 )
 
@@ -15,17 +17,34 @@ type SagaUIDService interface {
 	AddSagaId(headers message.Headers, sagaUID string)
 }
 
+// SagaUIDServiceOpt configures default implementation of SagaUIDService
+type SagaUIDServiceOpt func(s *sagaUIDService)
+
+// WithSagaUIDHeader keeps saga uid in the header instead of sagaUID, e.g. when infrastructure stamps messages with its own header
+func WithSagaUIDHeader(key string) SagaUIDServiceOpt {
+	return func(s *sagaUIDService) {
+		s.key = key
+	}
+}
+
 // NewSagaUIDService constructs default implementation of SagaUIDService
-func NewSagaUIDService() SagaUIDService {
-	return &sagaUIDService{}
+func NewSagaUIDService(opts ...SagaUIDServiceOpt) SagaUIDService {
+	s := &sagaUIDService{key: sagaUIDKey}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 type sagaUIDService struct {
+	key string
 }
 
 // ExtractSagaUID extracts sagaUID key from headers
 func (i sagaUIDService) ExtractSagaUID(headers message.Headers) (string, error) {
-	if val, ok := headers[sagaUIDKey]; ok {
+	if val, ok := headers[i.key]; ok {
 		sagaId, converted := val.(string)
 
 		if !converted {
@@ -35,10 +54,19 @@ func (i sagaUIDService) ExtractSagaUID(headers message.Headers) (string, error)
 		return sagaId, nil
 	}
 
-	return "", errors.Errorf("saga uid was not found in headers by key %s", sagaUIDKey)
+	return "", errors.Errorf("saga uid was not found in headers by key %s", i.key)
 }
 
 // AddSagaId adds sagaUID to headers
 func (i sagaUIDService) AddSagaId(headers message.Headers, sagaUID string) {
-	headers[sagaUIDKey] = sagaUID
+	headers[i.key] = sagaUID
+}
+
+// OrderingKey keys messages by the saga uid read by svc, pass it into subscriber.WithOrderingKey to process messages of a saga
+// one by one instead of contending for its mutex. Messages without the saga uid, e.g. StartSagaCommand, aren't ordered.
+func OrderingKey(svc SagaUIDService) subscriber.KeyFunc {
+	return func(pkg transport.IncomingPkg) string {
+		sagaUID, _ := svc.ExtractSagaUID(pkg.Headers())
+		return sagaUID
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/go-foreman/foreman/pubsub/message"
+	transportMock "github.com/go-foreman/foreman/testing/mocks/pubsub/transport"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -43,4 +45,32 @@ func TestNewSagaUIDService(t *testing.T) {
 
 		assert.Equal(t, headers[sagaUIDKey], "uid")
 	})
+
+	t.Run("custom header", func(t *testing.T) {
+		svc := NewSagaUIDService(WithSagaUIDHeader("x-order-saga"))
+		headers := message.Headers{"x-order-saga": "uid"}
+
+		extractedUID, err := svc.ExtractSagaUID(headers)
+		require.NoError(t, err)
+		assert.Equal(t, "uid", extractedUID)
+
+		_, err = svc.ExtractSagaUID(message.Headers{sagaUIDKey: "uid"})
+		assert.EqualError(t, err, "saga uid was not found in headers by key x-order-saga")
+
+		svc.AddSagaId(headers, "other")
+		assert.Equal(t, "other", headers["x-order-saga"])
+	})
+	t.Run("ordering key", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		key := OrderingKey(NewSagaUIDService(WithSagaUIDHeader("x-order-saga")))
+
+		inPkg := transportMock.NewMockIncomingPkg(ctrl)
+		inPkg.EXPECT().Headers().Return(map[string]interface{}{"x-order-saga": "uid"})
+		assert.Equal(t, "uid", key(inPkg))
+
+		inPkg.EXPECT().Headers().Return(map[string]interface{}{})
+		assert.Empty(t, key(inPkg))
+	})
 }
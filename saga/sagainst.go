@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -14,6 +15,10 @@ const (
 	sagaStatusCreated      status = "created"
 	sagaStatusCompensating status = "compensating"
 	sagaStatusRecovering   status = "recovering"
+	// sagaStatusCompensatingChildren is a saga waiting for its children to compensate before its own compensation
+	sagaStatusCompensatingChildren status = "compensating_children"
+	// sagaStatusChildCompensationFailed is a saga which children didn't compensate, its own compensation wasn't run
+	sagaStatusChildCompensationFailed status = "child_compensation_failed"
 )
 
 //go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/instance.go -package saga . Instance
@@ -29,12 +34,31 @@ type Instance interface {
 	Complete()
 	Fail(ev message.Object)
 
+	// CompensateChildren puts the saga into compensating_children status until the children have compensated,
+	// its own Compensate is run by ChildCompensated afterwards
+	CompensateChildren(childUIDs []string)
+	// ChildCompensated records an outcome of compensation of the child. Once all children have compensated, Compensate
+	// of the saga is run. If any of them failed, the saga gets child_compensation_failed status instead.
+	// False is returned if the saga doesn't wait for the child.
+	ChildCompensated(sagaCtx SagaContext, childUID string, compensated bool) (bool, error)
+
 	HistoryEvents() []HistoryEvent
 	AddHistoryEvent(ev message.Object, ahv *AddHistoryEvent)
 
+	// EntityRefs returns references to business entities the saga touched
+	EntityRefs() []EntityRef
+	// AddEntityRef adds a reference, adding the same ref again is a no-op. Returns EntityRefLimitErr above MaxEntityRefs refs.
+	AddEntityRef(ref EntityRef) error
+
 	StartedAt() *time.Time
 	UpdatedAt() *time.Time
 	ParentID() string
+
+	// Version is the version of the instance in the store, it's increased by each Store.Update.
+	// Update fails with VersionConflictErr if the stored instance has changed since this one was loaded.
+	Version() int
+	// SetVersion is called by a store when the instance is loaded or saved
+	SetVersion(version int)
 }
 
 type Status interface {
@@ -44,6 +68,10 @@ type Status interface {
 	Recovering() bool
 	Compensating() bool
 	Completed() bool
+	// CompensatingChildren tells whether the saga waits for its children to compensate before its own compensation
+	CompensatingChildren() bool
+	// ChildCompensationFailed tells whether compensation of some children failed, the saga can be compensated again
+	ChildCompensationFailed() bool
 	String() string
 }
 
@@ -64,15 +92,25 @@ type sagaInstance struct {
 	parentID       string
 	saga           Saga
 	historyEvents  []HistoryEvent
+	entityRefs     []EntityRef
 	startedAt      *time.Time
 	updatedAt      *time.Time
 	instanceStatus instanceStatus
+	version        int
 }
 
 func (s sagaInstance) ParentID() string {
 	return s.parentID
 }
 
+func (s sagaInstance) Version() int {
+	return s.version
+}
+
+func (s *sagaInstance) SetVersion(version int) {
+	s.version = version
+}
+
 func (s sagaInstance) UID() string {
 	return s.uid
 }
@@ -99,6 +137,51 @@ func (s *sagaInstance) Compensate(sagaCtx SagaContext) error {
 	return s.saga.Compensate(sagaCtx)
 }
 
+func (s *sagaInstance) CompensateChildren(childUIDs []string) {
+	results := make(map[string]ChildCompensationResult, len(childUIDs))
+	for _, childUID := range childUIDs {
+		results[childUID] = ChildCompensationPending
+	}
+
+	s.saga.SetChildCompensations(results)
+	s.instanceStatus.status = sagaStatusCompensatingChildren
+	s.update()
+}
+
+func (s *sagaInstance) ChildCompensated(sagaCtx SagaContext, childUID string, compensated bool) (bool, error) {
+	results := s.saga.ChildCompensations()
+
+	if !s.instanceStatus.CompensatingChildren() || results[childUID] != ChildCompensationPending {
+		return false, nil
+	}
+
+	results[childUID] = ChildCompensationFailed
+	if compensated {
+		results[childUID] = ChildCompensationDone
+	}
+
+	s.saga.SetChildCompensations(results)
+	s.update()
+
+	failed := false
+
+	for _, result := range results {
+		switch result {
+		case ChildCompensationPending:
+			return true, nil
+		case ChildCompensationFailed:
+			failed = true
+		}
+	}
+
+	if failed {
+		s.instanceStatus.status = sagaStatusChildCompensationFailed
+		return true, nil
+	}
+
+	return true, s.Compensate(sagaCtx)
+}
+
 func (s *sagaInstance) Recover(sagaCtx SagaContext) error {
 	s.instanceStatus.status = sagaStatusRecovering
 	s.update()
@@ -157,6 +240,30 @@ func (s *sagaInstance) AddHistoryEvent(ev message.Object, ahv *AddHistoryEvent)
 	s.historyEvents = append(s.historyEvents, historyEv)
 }
 
+func (s sagaInstance) EntityRefs() []EntityRef {
+	return s.entityRefs
+}
+
+func (s *sagaInstance) AddEntityRef(ref EntityRef) error {
+	if err := validateEntityRef(ref); err != nil {
+		return err
+	}
+
+	for _, existing := range s.entityRefs {
+		if existing == ref {
+			return nil
+		}
+	}
+
+	if len(s.entityRefs) >= MaxEntityRefs {
+		return WithEntityRefLimitErr(errors.Errorf("saga '%s' already has %d entity refs, can't add %s", s.uid, MaxEntityRefs, ref))
+	}
+
+	s.entityRefs = append(s.entityRefs, ref)
+
+	return nil
+}
+
 type HistoryEvent struct {
 	UID          string         `json:"uid"`
 	CreatedAt    time.Time      `json:"created_at"`
@@ -193,6 +300,14 @@ func (s status) Completed() bool {
 	return s == sagaStatusCompleted
 }
 
+func (s status) CompensatingChildren() bool {
+	return s == sagaStatusCompensatingChildren
+}
+
+func (s status) ChildCompensationFailed() bool {
+	return s == sagaStatusChildCompensationFailed
+}
+
 func (s status) String() string {
 	return string(s)
 }
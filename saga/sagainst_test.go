@@ -123,3 +123,61 @@ type DataContract struct {
 	message.ObjectMeta
 	Message string
 }
+
+func TestInstanceChildCompensation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sagaCtxMock := NewMockSagaContext(ctrl)
+
+	t.Run("saga is compensated after its children", func(t *testing.T) {
+		sagaEx := &sagaExample{}
+		instance := NewSagaInstance("123", "", sagaEx)
+		instance.Fail(nil)
+
+		instance.CompensateChildren([]string{"child-1", "child-2"})
+		assert.True(t, instance.Status().CompensatingChildren())
+		assert.False(t, instance.Status().Compensating())
+
+		handled, err := instance.ChildCompensated(sagaCtxMock, "child-1", true)
+		require.NoError(t, err)
+		assert.True(t, handled)
+		assert.True(t, instance.Status().CompensatingChildren(), "child-2 is still compensating")
+
+		handled, err = instance.ChildCompensated(sagaCtxMock, "child-1", true)
+		require.NoError(t, err)
+		assert.False(t, handled, "outcome of the child is already known")
+
+		handled, err = instance.ChildCompensated(sagaCtxMock, "unknown", true)
+		require.NoError(t, err)
+		assert.False(t, handled)
+
+		sagaCtxMock.EXPECT().Dispatch(&DataContract{Message: "compensate"})
+
+		handled, err = instance.ChildCompensated(sagaCtxMock, "child-2", true)
+		require.NoError(t, err)
+		assert.True(t, handled)
+		assert.True(t, instance.Status().Compensating())
+		assert.Equal(t, map[string]ChildCompensationResult{"child-1": ChildCompensationDone, "child-2": ChildCompensationDone}, sagaEx.ChildCompensations())
+	})
+
+	t.Run("compensation of a child failed", func(t *testing.T) {
+		instance := NewSagaInstance("123", "", &sagaExample{})
+		instance.CompensateChildren([]string{"child-1", "child-2"})
+
+		handled, err := instance.ChildCompensated(sagaCtxMock, "child-1", false)
+		require.NoError(t, err)
+		assert.True(t, handled)
+		assert.True(t, instance.Status().CompensatingChildren(), "the saga waits for all children")
+
+		handled, err = instance.ChildCompensated(sagaCtxMock, "child-2", true)
+		require.NoError(t, err)
+		assert.True(t, handled)
+		assert.True(t, instance.Status().ChildCompensationFailed(), "own compensation isn't run")
+		assert.Equal(t, "child_compensation_failed", instance.Status().String())
+
+		handled, err = instance.ChildCompensated(sagaCtxMock, "child-1", true)
+		require.NoError(t, err)
+		assert.False(t, handled, "the saga doesn't wait for children anymore")
+	})
+}
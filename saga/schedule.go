@@ -0,0 +1,271 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	scheduleTableName      = "saga_schedule"
+	scheduleDispatcherName = "saga-schedule-dispatcher"
+)
+
+// Scheduled is an event a saga scheduled with SagaContext.Schedule, it's delivered back to the saga at FireAt
+type Scheduled struct {
+	Payload message.Object
+	FireAt  time.Time
+}
+
+// ScheduledEvent is an event kept in the schedule until it fires
+type ScheduledEvent struct {
+	ID      int64
+	SagaUID string
+	Message *message.OutcomingMessage
+	FireAt  time.Time
+}
+
+//go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/schedule.go -package saga . Scheduler
+
+// Scheduler keeps events sagas scheduled for themselves, they are saved together with the saga and survive restarts
+type Scheduler interface {
+	// Schedule writes the event within the transaction of the saga update
+	Schedule(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, fireAt time.Time) error
+	// Cancel removes pending events of the saga within the transaction of the saga update
+	Cancel(ctx context.Context, tx *sql.Tx, sagaId string) error
+	// Due returns up to limit events which fire at now or earlier in the order they fire
+	Due(ctx context.Context, now time.Time, limit int) ([]ScheduledEvent, error)
+	// Fired removes the event once it's sent
+	Fired(ctx context.Context, id int64) error
+}
+
+// SQLScheduler is a Scheduler kept in saga_schedule table of the database of TransactionalStore
+type SQLScheduler struct {
+	db            *sagaSql.DB
+	driver        SQLDriver
+	msgMarshaller message.Marshaller
+}
+
+// NewSQLScheduler creates the schedule table if it doesn't exist, it supports mysql and postgres drivers
+func NewSQLScheduler(db *sagaSql.DB, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLScheduler, error) {
+	s := &SQLScheduler{db: db, driver: driver, msgMarshaller: msgMarshaller}
+
+	if err := s.initTable(); err != nil {
+		return nil, errors.Wrapf(err, "initializing table for SQLScheduler, driver %s", driver)
+	}
+
+	return s, nil
+}
+
+func (s *SQLScheduler) Schedule(ctx context.Context, tx *sql.Tx, sagaId string, msg *message.OutcomingMessage, fireAt time.Time) error {
+	payload, err := s.msgMarshaller.Marshal(msg.Payload())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling scheduled message %s of saga %s", msg.UID(), sagaId)
+	}
+
+	headers, err := json.Marshal(msg.Headers())
+	if err != nil {
+		return errors.Wrapf(err, "marshaling headers of scheduled message %s of saga %s", msg.UID(), sagaId)
+	}
+
+	if _, err := tx.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("INSERT INTO %s (saga_uid, msg_uid, payload, headers, fire_at, created_at) VALUES (?, ?, ?, ?, ?, ?);", scheduleTableName)),
+		sagaId, msg.UID(), payload, string(headers), fireAt, time.Now(),
+	); err != nil {
+		return errors.Wrapf(err, "inserting scheduled message %s of saga %s", msg.UID(), sagaId)
+	}
+
+	return nil
+}
+
+func (s *SQLScheduler) Cancel(ctx context.Context, tx *sql.Tx, sagaId string) error {
+	if _, err := tx.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("DELETE FROM %s WHERE saga_uid=?;", scheduleTableName)), sagaId); err != nil {
+		return errors.Wrapf(err, "cancelling scheduled messages of saga %s", sagaId)
+	}
+
+	return nil
+}
+
+func (s *SQLScheduler) Due(ctx context.Context, now time.Time, limit int) ([]ScheduledEvent, error) {
+	rows, err := s.db.QueryContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("SELECT id, saga_uid, msg_uid, payload, headers, fire_at FROM %s WHERE fire_at <= ? ORDER BY fire_at, id LIMIT ?;", scheduleTableName)), now, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying due scheduled messages")
+	}
+
+	defer rows.Close()
+
+	var events []ScheduledEvent
+
+	for rows.Next() {
+		var (
+			scheduled       ScheduledEvent
+			msgUID, headers string
+			payload         []byte
+		)
+
+		if err := rows.Scan(&scheduled.ID, &scheduled.SagaUID, &msgUID, &payload, &headers, &scheduled.FireAt); err != nil {
+			return nil, errors.Wrap(err, "scanning scheduled message")
+		}
+
+		obj, err := s.msgMarshaller.Unmarshal(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling scheduled message %d", scheduled.ID)
+		}
+
+		msgHeaders := make(message.Headers)
+		if err := json.Unmarshal([]byte(headers), &msgHeaders); err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling headers of scheduled message %d", scheduled.ID)
+		}
+
+		scheduled.Message = message.NewOutcomingMessage(obj, message.WithHeaders(msgHeaders), message.WithUID(msgUID))
+		events = append(events, scheduled)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating over scheduled messages")
+	}
+
+	return events, nil
+}
+
+func (s *SQLScheduler) Fired(ctx context.Context, id int64) error {
+	if _, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("DELETE FROM %s WHERE id=?;", scheduleTableName)), id); err != nil {
+		return errors.Wrapf(err, "removing fired scheduled message %d", id)
+	}
+
+	return nil
+}
+
+func (s *SQLScheduler) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	idColumn, payloadColumn, inlineIndexes := "bigint not null auto_increment primary key", "longblob", ",\n\t\tindex saga_schedule_fire_at_idx (fire_at, id),\n\t\tindex saga_schedule_saga_uid_idx (saga_uid)"
+
+	if s.driver == PGDriver {
+		idColumn, payloadColumn, inlineIndexes = "bigserial primary key", "bytea", ""
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id %s,
+		saga_uid varchar(255) not null,
+		msg_uid varchar(255) not null,
+		payload %s not null,
+		headers text not null,
+		fire_at timestamp not null,
+		created_at timestamp null%s
+	);`, scheduleTableName, idColumn, payloadColumn, inlineIndexes))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if s.driver == PGDriver {
+		for _, index := range []string{"saga_schedule_fire_at_idx on %s (fire_at, id)", "saga_schedule_saga_uid_idx on %s (saga_uid)"} {
+			if _, err := s.db.ExecContext(ctx, "create index if not exists "+fmt.Sprintf(index, scheduleTableName)+";"); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ScheduleDispatcher is a foreman.Worker which sends due events of the schedule every interval through endpoints the router
+// resolves for them. An event is removed only after all its endpoints accepted it, so it may be delivered more than once,
+// e.g. if the process dies before it's removed. Failed events are retried on the next tick. Dispatchers of several replicas
+// would send the same due events, so it must run under a worker mutex of MessageBus, see foreman.WithWorkerMutex.
+type ScheduleDispatcher struct {
+	scheduler Scheduler
+	router    endpoint.Router
+	interval  time.Duration
+	batchSize int
+	logger    log.Logger
+}
+
+func NewScheduleDispatcher(scheduler Scheduler, router endpoint.Router, interval time.Duration, batchSize int, logger log.Logger) *ScheduleDispatcher {
+	return &ScheduleDispatcher{scheduler: scheduler, router: router, interval: interval, batchSize: batchSize, logger: logger}
+}
+
+func (d *ScheduleDispatcher) Name() string {
+	return scheduleDispatcherName
+}
+
+// Run dispatches due events until ctx is done. Failures are logged and retried on the next tick.
+func (d *ScheduleDispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.dispatch(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Logf(log.ErrorLevel, "dispatching scheduled messages. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch sends batches of due events until none is left or an event fails
+func (d *ScheduleDispatcher) dispatch(ctx context.Context) error {
+	for ctx.Err() == nil {
+		events, err := d.scheduler.Due(ctx, time.Now(), d.batchSize)
+		if err != nil {
+			return err
+		}
+
+		failed := false
+
+		for _, scheduled := range events {
+			if err := d.send(ctx, scheduled); err != nil {
+				failed = true
+				d.logger.Logf(log.ErrorLevel, "sending scheduled message %d of saga '%s'. %s", scheduled.ID, scheduled.SagaUID, err)
+
+				continue
+			}
+
+			if err := d.scheduler.Fired(ctx, scheduled.ID); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < d.batchSize || failed {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (d *ScheduleDispatcher) send(ctx context.Context, scheduled ScheduledEvent) error {
+	endpoints, err := routeRelayed(d.router, scheduled.Message)
+	if err != nil {
+		return err
+	}
+
+	if len(endpoints) == 0 {
+		d.logger.Logf(log.WarnLevel, "no endpoints defined for scheduled message %d", scheduled.ID)
+		return nil
+	}
+
+	for _, endp := range endpoints {
+		if err := endp.Send(ctx, scheduled.Message); err != nil {
+			return errors.Wrapf(err, "sending message %s to endpoint %s", scheduled.Message.UID(), endp.Name())
+		}
+	}
+
+	return nil
+}
+
+var _ Scheduler = (*SQLScheduler)(nil)
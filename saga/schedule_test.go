@@ -0,0 +1,172 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/go-foreman/foreman/testing/log"
+	endpointMock "github.com/go-foreman/foreman/testing/mocks/pubsub/endpoint"
+	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLScheduler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	fireAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("pg schedule and cancel in transaction", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		scheduler, db, mock := createScheduler(t, PGDriver, marshallerMock)
+		msg := message.NewOutcomingMessage(&ExampleEv{Data: "data"}, message.WithHeaders(message.Headers{"sagaId": "123"}))
+
+		marshallerMock.EXPECT().Marshal(msg.Payload()).Return([]byte("payload"), nil)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO saga_schedule (saga_uid, msg_uid, payload, headers, fire_at, created_at) VALUES ($1, $2, $3, $4, $5, $6);").
+			WithArgs("123", msg.UID(), []byte("payload"), `{"sagaId":"123","uid":"`+msg.UID()+`"}`, fireAt, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("DELETE FROM saga_schedule WHERE saga_uid=$1;").WithArgs("123").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		tx, err := db.Begin()
+		require.NoError(t, err)
+		require.NoError(t, scheduler.Schedule(ctx, tx, "123", msg, fireAt))
+		require.NoError(t, scheduler.Cancel(ctx, tx, "123"))
+		require.NoError(t, tx.Commit())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql due events and fired", func(t *testing.T) {
+		marshallerMock := mockMessage.NewMockMarshaller(ctrl)
+		scheduler, _, mock := createScheduler(t, MYSQLDriver, marshallerMock)
+		now := fireAt.Add(time.Minute)
+
+		mock.ExpectQuery("SELECT id, saga_uid, msg_uid, payload, headers, fire_at FROM saga_schedule WHERE fire_at <= ? ORDER BY fire_at, id LIMIT ?;").
+			WithArgs(now, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "saga_uid", "msg_uid", "payload", "headers", "fire_at"}).
+				AddRow(1, "123", "msg-1", []byte("payload"), `{"sagaId":"123","uid":"msg-1"}`, fireAt),
+			)
+		marshallerMock.EXPECT().Unmarshal([]byte("payload")).Return(&ExampleEv{Data: "data"}, nil)
+
+		events, err := scheduler.Due(ctx, now, 10)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		assert.Equal(t, int64(1), events[0].ID)
+		assert.Equal(t, "123", events[0].SagaUID)
+		assert.Equal(t, fireAt, events[0].FireAt)
+		assert.Equal(t, "msg-1", events[0].Message.UID())
+		assert.Equal(t, "123", events[0].Message.Headers()["sagaId"])
+		assert.Equal(t, &ExampleEv{Data: "data"}, events[0].Message.Payload())
+
+		mock.ExpectExec("DELETE FROM saga_schedule WHERE id=?;").WithArgs(1).WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, scheduler.Fired(ctx, 1), "removing fired scheduled message 1: connection lost")
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestScheduleDispatcher(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	endpointInstance := endpointMock.NewMockEndpoint(ctrl)
+	endpointInstance.EXPECT().Name().Return("saga-endpoint").AnyTimes()
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(endpointInstance, &ExampleEv{})
+
+	newScheduled := func(id int64, sagaId string) ScheduledEvent {
+		return ScheduledEvent{ID: id, SagaUID: sagaId, Message: message.NewOutcomingMessage(&ExampleEv{Data: sagaId})}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second := newScheduled(1, "a"), newScheduled(2, "b")
+	scheduler := &fakeScheduler{due: []ScheduledEvent{first, second}, onDue: func(calls int) {
+		if calls == 2 {
+			cancel()
+		}
+	}}
+
+	dispatcher := NewScheduleDispatcher(scheduler, router, time.Millisecond*10, 10, log.NewNilLogger())
+	assert.Equal(t, "saga-schedule-dispatcher", dispatcher.Name())
+
+	gomock.InOrder(
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(errors.New("broker is down")),
+		endpointInstance.EXPECT().Send(gomock.Any(), second.Message).Return(nil),
+		// the failed event is sent again on the next tick
+		endpointInstance.EXPECT().Send(gomock.Any(), first.Message).Return(nil),
+	)
+
+	assert.NoError(t, dispatcher.Run(ctx))
+	assert.Equal(t, []int64{2, 1}, scheduler.fired)
+	assert.Empty(t, scheduler.due)
+}
+
+type fakeScheduler struct {
+	Scheduler
+	due      []ScheduledEvent
+	fired    []int64
+	dueCalls int
+	onDue    func(calls int)
+}
+
+func (s *fakeScheduler) Due(ctx context.Context, now time.Time, limit int) ([]ScheduledEvent, error) {
+	s.dueCalls++
+	s.onDue(s.dueCalls)
+
+	due := make([]ScheduledEvent, len(s.due))
+	copy(due, s.due)
+
+	if len(due) > limit {
+		return due[:limit], nil
+	}
+
+	return due, nil
+}
+
+func (s *fakeScheduler) Fired(ctx context.Context, id int64) error {
+	s.fired = append(s.fired, id)
+
+	for i, scheduled := range s.due {
+		if scheduled.ID == id {
+			s.due = append(s.due[:i], s.due[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func createScheduler(t *testing.T, driver SQLDriver, msgMarshaller message.Marshaller) (*SQLScheduler, *formanSql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	if driver == PGDriver {
+		mock.ExpectExec("create table if not exists saga_schedule ( id bigserial primary key, saga_uid varchar(255) not null, msg_uid varchar(255) not null, payload bytea not null, headers text not null, fire_at timestamp not null, created_at timestamp null );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists saga_schedule_fire_at_idx on saga_schedule (fire_at, id);").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists saga_schedule_saga_uid_idx on saga_schedule (saga_uid);").WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec("create table if not exists saga_schedule ( id bigint not null auto_increment primary key, saga_uid varchar(255) not null, msg_uid varchar(255) not null, payload longblob not null, headers text not null, fire_at timestamp not null, created_at timestamp null, index saga_schedule_fire_at_idx (fire_at, id), index saga_schedule_saga_uid_idx (saga_uid) );").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	wrapper := formanSql.NewDB(db)
+	scheduler, err := NewSQLScheduler(wrapper, driver, msgMarshaller)
+	require.NoError(t, err)
+
+	return scheduler, wrapper, mock
+}
@@ -0,0 +1,168 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	idempotencyKeyTableName = "idempotency_key"
+	seenKeysJanitorName     = "idempotency-keys-janitor"
+)
+
+// SQLSeenKeys is endpoint.SeenKeys shared by replicas of a service, keys are rows of a table with a unique index on idempotency_key.
+// Pass it into endpoint.WithSharedSeenKeys and run NewSeenKeysJanitor to delete expired keys.
+type SQLSeenKeys struct {
+	db     *sagaSql.DB
+	driver SQLDriver
+}
+
+// NewSQLSeenKeys creates the table of idempotency keys if it doesn't exist. It supports mysql and postgres drivers,
+// mysql connection must not be configured with clientFoundRows=true, otherwise a key which isn't expired is reported as not sent.
+func NewSQLSeenKeys(db *sagaSql.DB, driver SQLDriver) (*SQLSeenKeys, error) {
+	s := &SQLSeenKeys{db: db, driver: driver}
+
+	if err := s.initTable(); err != nil {
+		return nil, errors.Wrapf(err, "initializing table for SQLSeenKeys, driver %s", driver)
+	}
+
+	return s, nil
+}
+
+// MarkSent inserts the key, an expired key is taken over. Replicas racing for the same key don't fail on the unique index,
+// the upsert lets only one of them insert or take over the key and the rest get alreadySent.
+func (s *SQLSeenKeys) MarkSent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	res, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, s.upsertQuery()), key, now.Add(ttl), now)
+	if err != nil {
+		return false, errors.Wrapf(err, "inserting idempotency key %s", key)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "getting affected rows of idempotency key %s", key)
+	}
+
+	return affected == 0, nil
+}
+
+func (s *SQLSeenKeys) Forget(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("DELETE FROM %s WHERE idempotency_key=?;", idempotencyKeyTableName)), key); err != nil {
+		return errors.Wrapf(err, "deleting idempotency key %s", key)
+	}
+
+	return nil
+}
+
+// DeleteExpired deletes keys which expired before the passed time and returns the number of deleted keys
+func (s *SQLSeenKeys) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, prepDriverQuery(s.driver, fmt.Sprintf("DELETE FROM %s WHERE expires_at <= ?;", idempotencyKeyTableName)), before)
+	if err != nil {
+		return 0, errors.Wrap(err, "deleting expired idempotency keys")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting number of deleted idempotency keys")
+	}
+
+	return int(deleted), nil
+}
+
+// upsertQuery inserts a key or updates expiration of an expired one, params are key, new expiration and now.
+// Nothing is affected if the key exists and isn't expired.
+func (s *SQLSeenKeys) upsertQuery() string {
+	if s.driver == PGDriver {
+		return fmt.Sprintf("INSERT INTO %[1]s (idempotency_key, expires_at) VALUES (?, ?) ON CONFLICT (idempotency_key) DO UPDATE SET expires_at=EXCLUDED.expires_at WHERE %[1]s.expires_at <= ?;", idempotencyKeyTableName)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (idempotency_key, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at=IF(expires_at <= ?, VALUES(expires_at), expires_at);", idempotencyKeyTableName)
+}
+
+func (s *SQLSeenKeys) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	inlineIndex := ",\n\t\tindex idempotency_key_expires_at_idx (expires_at)"
+
+	if s.driver == PGDriver {
+		inlineIndex = ""
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		idempotency_key varchar(255) not null primary key,
+		expires_at timestamp null%s
+	);`, idempotencyKeyTableName, inlineIndex))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if s.driver == PGDriver {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("create index if not exists idempotency_key_expires_at_idx on %s (expires_at);", idempotencyKeyTableName)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// SeenKeysJanitor is a foreman.Worker which deletes expired keys of SQLSeenKeys every interval, register it with MessageBus.RegisterWorkers
+type SeenKeysJanitor struct {
+	keys     *SQLSeenKeys
+	interval time.Duration
+	logger   log.Logger
+}
+
+func NewSeenKeysJanitor(keys *SQLSeenKeys, interval time.Duration, logger log.Logger) *SeenKeysJanitor {
+	return &SeenKeysJanitor{keys: keys, interval: interval, logger: logger}
+}
+
+func (j *SeenKeysJanitor) Name() string {
+	return seenKeysJanitorName
+}
+
+// Run cleans up until ctx is done. Failures are logged and retried on the next tick.
+func (j *SeenKeysJanitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *SeenKeysJanitor) cleanup(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	deleted, err := j.keys.DeleteExpired(ctx, time.Now())
+
+	if err != nil {
+		if ctx.Err() == nil {
+			j.logger.Logf(log.ErrorLevel, "deleting expired idempotency keys. %s", err)
+		}
+		return
+	}
+
+	if deleted > 0 {
+		j.logger.Logf(log.DebugLevel, "deleted %d expired idempotency keys", deleted)
+	}
+}
+
+var _ endpoint.SeenKeys = (*SQLSeenKeys)(nil)
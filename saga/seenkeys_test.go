@@ -0,0 +1,96 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	formanSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLSeenKeys(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("pg", func(t *testing.T) {
+		seenKeys, mock := createSeenKeys(t, PGDriver)
+		upsert := "INSERT INTO idempotency_key (idempotency_key, expires_at) VALUES ($1, $2) ON CONFLICT (idempotency_key) DO UPDATE SET expires_at=EXCLUDED.expires_at WHERE idempotency_key.expires_at <= $3;"
+
+		mock.ExpectExec(upsert).WithArgs("order-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		alreadySent, err := seenKeys.MarkSent(ctx, "order-1", time.Hour)
+		require.NoError(t, err)
+		assert.False(t, alreadySent)
+
+		mock.ExpectExec(upsert).WithArgs("order-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+		alreadySent, err = seenKeys.MarkSent(ctx, "order-1", time.Hour)
+		require.NoError(t, err)
+		assert.True(t, alreadySent, "conflicting key which isn't expired is not updated")
+
+		mock.ExpectExec("DELETE FROM idempotency_key WHERE idempotency_key=$1;").WithArgs("order-1").WillReturnResult(sqlmock.NewResult(0, 1))
+		require.NoError(t, seenKeys.Forget(ctx, "order-1"))
+
+		mock.ExpectExec("DELETE FROM idempotency_key WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 3))
+		deleted, err := seenKeys.DeleteExpired(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 3, deleted)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		seenKeys, mock := createSeenKeys(t, MYSQLDriver)
+		upsert := "INSERT INTO idempotency_key (idempotency_key, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at=IF(expires_at <= ?, VALUES(expires_at), expires_at);"
+
+		// mysql reports 2 affected rows when an existing row is updated, here it's an expired key taken over
+		mock.ExpectExec(upsert).WithArgs("order-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+		alreadySent, err := seenKeys.MarkSent(ctx, "order-1", time.Hour)
+		require.NoError(t, err)
+		assert.False(t, alreadySent)
+
+		mock.ExpectExec(upsert).WithArgs("order-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(errors.New("connection lost"))
+		_, err = seenKeys.MarkSent(ctx, "order-1", time.Hour)
+		assert.EqualError(t, err, "inserting idempotency key order-1: connection lost")
+
+		mock.ExpectExec("DELETE FROM idempotency_key WHERE idempotency_key=?;").WithArgs("order-1").WillReturnError(errors.New("connection lost"))
+		assert.EqualError(t, seenKeys.Forget(ctx, "order-1"), "deleting idempotency key order-1: connection lost")
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestSeenKeysJanitor(t *testing.T) {
+	seenKeys, mock := createSeenKeys(t, PGDriver)
+
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnError(errors.New("connection lost"))
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE expires_at <= $1;").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	janitor := NewSeenKeysJanitor(seenKeys, time.Millisecond*20, log.NewNilLogger())
+	assert.Equal(t, "idempotency-keys-janitor", janitor.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	assert.NoError(t, janitor.Run(ctx), "failed cleanup doesn't stop the janitor")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func createSeenKeys(t *testing.T, driver SQLDriver) (*SQLSeenKeys, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+
+	if driver == PGDriver {
+		mock.ExpectExec("create table if not exists idempotency_key ( idempotency_key varchar(255) not null primary key, expires_at timestamp null );").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists idempotency_key_expires_at_idx on idempotency_key (expires_at);").WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec("create table if not exists idempotency_key ( idempotency_key varchar(255) not null primary key, expires_at timestamp null, index idempotency_key_expires_at_idx (expires_at) );").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	seenKeys, err := NewSQLSeenKeys(formanSql.NewDB(db), driver)
+	require.NoError(t, err)
+
+	return seenKeys, mock
+}
@@ -0,0 +1,366 @@
+package saga
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/saga/filter"
+	"github.com/pkg/errors"
+)
+
+const defaultShardsParallelism = 4
+
+// ShardResolver tells which shard keeps a saga
+type ShardResolver interface {
+	// Resolve returns a key of the shard the saga belongs to
+	Resolve(sagaId string) (shardKey string)
+}
+
+// NewHashShardResolver spreads sagas over shards by fnv hash of saga id. Shard keys are sorted, so the result doesn't depend on their order.
+// Changing a number of shards moves existing sagas to other shards, use own ShardResolver if shards are added over time.
+func NewHashShardResolver(shardKeys ...string) ShardResolver {
+	keys := make([]string, len(shardKeys))
+	copy(keys, shardKeys)
+	sort.Strings(keys)
+
+	return &hashShardResolver{shardKeys: keys}
+}
+
+type hashShardResolver struct {
+	shardKeys []string
+}
+
+func (r hashShardResolver) Resolve(sagaId string) string {
+	if len(r.shardKeys) == 0 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(sagaId))
+
+	return r.shardKeys[h.Sum32()%uint32(len(r.shardKeys))]
+}
+
+// ShardedStoreOpt configures sharded store
+type ShardedStoreOpt func(s *shardedStore)
+
+// WithShardResolver sets own ShardResolver, by default NewHashShardResolver over all shard keys is used
+func WithShardResolver(resolver ShardResolver) ShardedStoreOpt {
+	return func(s *shardedStore) {
+		s.resolver = resolver
+	}
+}
+
+// WithShardsParallelism limits a number of shards queried at the same time by GetByFilter, 4 by default
+func WithShardsParallelism(n int) ShardedStoreOpt {
+	return func(s *shardedStore) {
+		s.parallelism = n
+	}
+}
+
+// NewShardedStore creates a Store which routes each saga into one of the shards by ShardResolver.
+// GetByFilter of a filter matching more than one saga id queries all shards and merges results: each shard returns offset+limit sagas,
+// they are sorted together and the requested page is cut out of them.
+func NewShardedStore(shards map[string]Store, opts ...ShardedStoreOpt) (Store, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards specified")
+	}
+
+	s := &shardedStore{shards: shards, parallelism: defaultShardsParallelism}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.resolver == nil {
+		keys := make([]string, 0, len(shards))
+		for k := range shards {
+			keys = append(keys, k)
+		}
+
+		s.resolver = NewHashShardResolver(keys...)
+	}
+
+	if s.parallelism <= 0 {
+		s.parallelism = 1
+	}
+
+	return s, nil
+}
+
+type shardedStore struct {
+	shards      map[string]Store
+	resolver    ShardResolver
+	parallelism int
+}
+
+func (s shardedStore) Create(ctx context.Context, saga Instance) error {
+	shard, err := s.shard(saga.UID())
+	if err != nil {
+		return err
+	}
+
+	return shard.Create(ctx, saga)
+}
+
+func (s shardedStore) GetById(ctx context.Context, sagaId string) (Instance, error) {
+	shard, err := s.shard(sagaId)
+	if err != nil {
+		return nil, err
+	}
+
+	return shard.GetById(ctx, sagaId)
+}
+
+// GetByCorrelation queries all shards one by one, sagas matched in different shards are ambiguous too
+func (s shardedStore) GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (Instance, error) {
+	var matched []Instance
+
+	for key, shard := range s.shards {
+		sagaInstance, err := shard.GetByCorrelation(ctx, sagaType, field, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "correlating in shard '%s'", key)
+		}
+
+		if sagaInstance != nil {
+			matched = append(matched, sagaInstance)
+		}
+	}
+
+	return singleCorrelated(matched, sagaType, field, value)
+}
+
+func (s shardedStore) Update(ctx context.Context, saga Instance) error {
+	shard, err := s.shard(saga.UID())
+	if err != nil {
+		return err
+	}
+
+	return shard.Update(ctx, saga)
+}
+
+func (s shardedStore) UpdateIfVersion(ctx context.Context, saga Instance, expectedVersion int) error {
+	shard, err := s.shard(saga.UID())
+	if err != nil {
+		return err
+	}
+
+	return shard.UpdateIfVersion(ctx, saga, expectedVersion)
+}
+
+func (s shardedStore) Delete(ctx context.Context, sagaId string) error {
+	shard, err := s.shard(sagaId)
+	if err != nil {
+		return err
+	}
+
+	return shard.Delete(ctx, sagaId)
+}
+
+// DeleteByFilter deletes from the shard of the saga if the filter matches only one saga id, otherwise from all shards one by one
+func (s shardedStore) DeleteByFilter(ctx context.Context, filters ...FilterOption) (int, error) {
+	opts := newFilterOptions(filters)
+
+	if sagaId, ok := filter.SingleSagaID(opts.filter()); ok {
+		shard, err := s.shard(sagaId)
+		if err != nil {
+			return 0, err
+		}
+
+		return shard.DeleteByFilter(ctx, filters...)
+	}
+
+	deleted := 0
+
+	for key, shard := range s.shards {
+		n, err := shard.DeleteByFilter(ctx, filters...)
+		deleted += n
+
+		if err != nil {
+			return deleted, errors.Wrapf(err, "deleting from shard '%s'", key)
+		}
+	}
+
+	return deleted, nil
+}
+
+// DeleteOlderThan deletes from all shards one by one, the limit is shared by shards
+func (s shardedStore) DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...DeleteOption) (int, error) {
+	options := newDeleteOptions(opts)
+	deleted := 0
+
+	for key, shard := range s.shards {
+		shardOpts := opts
+
+		if options.limit > 0 {
+			if deleted >= options.limit {
+				break
+			}
+
+			shardOpts = append(append([]DeleteOption{}, opts...), WithDeleteLimit(options.limit-deleted))
+		}
+
+		n, err := shard.DeleteOlderThan(ctx, cutoff, shardOpts...)
+		deleted += n
+
+		if err != nil {
+			return deleted, errors.Wrapf(err, "deleting from shard '%s'", key)
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s shardedStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*InstancesBatch, error) {
+	if len(filters) == 0 {
+		return nil, errors.Errorf("no filters found, you have to specify at least one so result won't be whole store")
+	}
+
+	opts := newFilterOptions(filters)
+
+	if sagaId, ok := filter.SingleSagaID(opts.filter()); ok {
+		shard, err := s.shard(sagaId)
+		if err != nil {
+			return nil, err
+		}
+
+		return shard.GetByFilter(ctx, filters...)
+	}
+
+	field, order, err := opts.orderBy()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	if opts.offset != nil {
+		offset = *opts.offset
+	}
+
+	shardFilters := filters
+	if opts.limit != nil {
+		// a page of the merged result may consist of the first offset+limit sagas of any shard
+		shardFilters = append(filters[:len(filters):len(filters)], WithOffsetAndLimit(0, offset+*opts.limit))
+	}
+
+	batches, err := s.queryShards(ctx, shardFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &InstancesBatch{}
+
+	for _, batch := range batches {
+		res.Total += batch.Total
+		res.Items = append(res.Items, batch.Items...)
+	}
+
+	sortInstances(res.Items, field, order)
+
+	if offset > len(res.Items) {
+		offset = len(res.Items)
+	}
+
+	res.Items = res.Items[offset:]
+
+	if opts.limit != nil && *opts.limit < len(res.Items) {
+		res.Items = res.Items[:*opts.limit]
+	}
+
+	return res, nil
+}
+
+func (s shardedStore) queryShards(ctx context.Context, filters []FilterOption) ([]*InstancesBatch, error) {
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		batches  = make([]*InstancesBatch, 0, len(s.shards))
+		firstErr error
+		sem      = make(chan struct{}, s.parallelism)
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for key, shard := range s.shards {
+		wg.Add(1)
+
+		go func(key string, shard Store) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			batch, err := shard.GetByFilter(ctx, filters...)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "querying shard '%s'", key)
+					cancel()
+				}
+				return
+			}
+
+			if batch != nil {
+				batches = append(batches, batch)
+			}
+		}(key, shard)
+	}
+
+	wg.Wait()
+
+	return batches, firstErr
+}
+
+func (s shardedStore) shard(sagaId string) (Store, error) {
+	key := s.resolver.Resolve(sagaId)
+
+	shard, exists := s.shards[key]
+	if !exists {
+		return nil, errors.Errorf("saga '%s' is resolved into unknown shard '%s'", sagaId, key)
+	}
+
+	return shard, nil
+}
+
+// sortInstances orders sagas the same way sql store does, with uid as a tiebreaker
+func sortInstances(items []Instance, field SortField, order SortOrder) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := sortValue(items[i], field), sortValue(items[j], field)
+
+		if a.Equal(b) {
+			if order == SortAsc {
+				return items[i].UID() < items[j].UID()
+			}
+			return items[i].UID() > items[j].UID()
+		}
+
+		if order == SortAsc {
+			return a.Before(b)
+		}
+
+		return a.After(b)
+	})
+}
+
+func sortValue(instance Instance, field SortField) time.Time {
+	var t *time.Time
+
+	if field == SortByUpdatedAt {
+		t = instance.UpdatedAt()
+	} else {
+		t = instance.StartedAt()
+	}
+
+	if t == nil {
+		return time.Time{}
+	}
+
+	return *t
+}
@@ -0,0 +1,376 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore keeps sagas in memory and supports the same filters, sorting and paging as sql store
+type memStore struct {
+	mutex    sync.Mutex
+	sagas    map[string]Instance
+	err      error
+	queries  int
+	inFlight *inFlightCounter
+}
+
+type inFlightCounter struct {
+	mutex   sync.Mutex
+	current int
+	max     int
+}
+
+func (c *inFlightCounter) inc() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+}
+
+func (c *inFlightCounter) dec() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current--
+}
+
+func newMemStore() *memStore {
+	return &memStore{sagas: make(map[string]Instance)}
+}
+
+func (m *memStore) Create(ctx context.Context, saga Instance) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sagas[saga.UID()] = saga
+	return nil
+}
+
+func (m *memStore) GetById(ctx context.Context, sagaId string) (Instance, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.sagas[sagaId], nil
+}
+
+func (m *memStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*InstancesBatch, error) {
+	if m.inFlight != nil {
+		m.inFlight.inc()
+		defer m.inFlight.dec()
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.queries++
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	opts := newFilterOptions(filters)
+
+	field, order, err := opts.orderBy()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &InstancesBatch{}
+	for _, s := range m.sagas {
+		if !MatchFilter(opts.filter(), s) {
+			continue
+		}
+		res.Items = append(res.Items, s)
+	}
+
+	res.Total = len(res.Items)
+	sortInstances(res.Items, field, order)
+
+	if opts.offset != nil {
+		if *opts.offset > len(res.Items) {
+			res.Items = nil
+		} else {
+			res.Items = res.Items[*opts.offset:]
+		}
+	}
+
+	if opts.limit != nil && *opts.limit < len(res.Items) {
+		res.Items = res.Items[:*opts.limit]
+	}
+
+	return res, nil
+}
+
+func (m *memStore) Update(ctx context.Context, saga Instance) error {
+	return m.Create(ctx, saga)
+}
+
+func (m *memStore) UpdateIfVersion(ctx context.Context, saga Instance, expectedVersion int) error {
+	return m.Create(ctx, saga)
+}
+
+func (m *memStore) Delete(ctx context.Context, sagaId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sagas, sagaId)
+	return nil
+}
+
+func (m *memStore) DeleteByFilter(ctx context.Context, filters ...FilterOption) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	opts := newFilterOptions(filters)
+
+	deleted := 0
+	for id, s := range m.sagas {
+		if !MatchFilter(opts.filter(), s) {
+			continue
+		}
+		delete(m.sagas, id)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (m *memStore) DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...DeleteOption) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	options := newDeleteOptions(opts)
+
+	deleted := 0
+	for id, s := range m.sagas {
+		if options.limit > 0 && deleted == options.limit {
+			break
+		}
+		if !s.Status().Completed() || s.UpdatedAt() == nil || !s.UpdatedAt().Before(cutoff) {
+			continue
+		}
+		delete(m.sagas, id)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (m *memStore) GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (Instance, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var inProgress []Instance
+	for _, s := range m.sagas {
+		if !s.Status().Completed() {
+			inProgress = append(inProgress, s)
+		}
+	}
+
+	matched, err := correlatedInstances(inProgress, field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return singleCorrelated(matched, sagaType, field, value)
+}
+
+type fixedResolver map[string]string
+
+func (r fixedResolver) Resolve(sagaId string) string {
+	return r[sagaId]
+}
+
+func TestHashShardResolver(t *testing.T) {
+	resolver := NewHashShardResolver("b", "a", "c")
+	sameKeysResolver := NewHashShardResolver("c", "b", "a")
+
+	used := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		sagaId := fmt.Sprintf("saga-%d", i)
+		key := resolver.Resolve(sagaId)
+		assert.Equal(t, key, sameKeysResolver.Resolve(sagaId))
+		used[key]++
+	}
+
+	assert.Len(t, used, 3)
+	assert.Equal(t, "", NewHashShardResolver().Resolve("123"))
+}
+
+func TestShardedStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no shards", func(t *testing.T) {
+		_, err := NewShardedStore(nil)
+		assert.EqualError(t, err, "no shards specified")
+	})
+
+	t.Run("delete by filter from all shards", func(t *testing.T) {
+		first, second := newMemStore(), newMemStore()
+		store, err := NewShardedStore(map[string]Store{"first": first, "second": second}, WithShardResolver(fixedResolver{"1": "first", "2": "second", "3": "second"}))
+		require.NoError(t, err)
+
+		for _, id := range []string{"1", "2", "3"} {
+			instance := NewSagaInstance(id, "", &sagaExample{})
+			if id != "3" {
+				instance.Complete()
+			}
+			require.NoError(t, store.Create(ctx, instance))
+		}
+
+		deleted, err := store.DeleteByFilter(ctx, WithStatus("completed"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		assert.Len(t, first.sagas, 0)
+		assert.Len(t, second.sagas, 1)
+	})
+
+	t.Run("correlation over all shards", func(t *testing.T) {
+		first, second := newMemStore(), newMemStore()
+		store, err := NewShardedStore(map[string]Store{"first": first, "second": second}, WithShardResolver(fixedResolver{"1": "first", "2": "second", "3": "second"}))
+		require.NoError(t, err)
+
+		require.NoError(t, store.Create(ctx, NewSagaInstance("1", "", &SagaExample{Data: "order-1"})))
+		require.NoError(t, store.Create(ctx, NewSagaInstance("2", "", &SagaExample{Data: "order-2"})))
+
+		instance, err := store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-2")
+		require.NoError(t, err)
+		require.NotNil(t, instance)
+		assert.Equal(t, "2", instance.UID())
+
+		require.NoError(t, store.Create(ctx, NewSagaInstance("3", "", &SagaExample{Data: "order-1"})))
+
+		_, err = store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-1")
+		require.Error(t, err)
+		assert.IsType(t, AmbiguousCorrelationErr{}, err)
+		assert.Contains(t, err.Error(), "2 sagas example.SagaExample in progress have Data 'order-1'")
+	})
+
+	t.Run("delete older than shares the limit between shards", func(t *testing.T) {
+		first, second := newMemStore(), newMemStore()
+		store, err := NewShardedStore(map[string]Store{"first": first, "second": second}, WithShardResolver(fixedResolver{"1": "first", "2": "first", "3": "second", "4": "second"}))
+		require.NoError(t, err)
+
+		for _, id := range []string{"1", "2", "3", "4"} {
+			instance := NewSagaInstance(id, "", &sagaExample{})
+			if id != "4" {
+				instance.Complete()
+			}
+			require.NoError(t, store.Create(ctx, instance))
+		}
+
+		deleted, err := store.DeleteOlderThan(ctx, time.Now().Add(time.Minute), WithDeleteLimit(2))
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		assert.Equal(t, 2, len(first.sagas)+len(second.sagas))
+
+		deleted, err = store.DeleteOlderThan(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted, "saga in progress is kept")
+		assert.Len(t, first.sagas, 0)
+		assert.Len(t, second.sagas, 1)
+	})
+
+	t.Run("single saga operations go to exactly one shard", func(t *testing.T) {
+		first, second := newMemStore(), newMemStore()
+		store, err := NewShardedStore(map[string]Store{"first": first, "second": second}, WithShardResolver(fixedResolver{"1": "first", "2": "second"}))
+		require.NoError(t, err)
+
+		instance := NewSagaInstance("2", "", &sagaExample{})
+		require.NoError(t, store.Create(ctx, instance))
+		assert.Len(t, first.sagas, 0)
+		assert.Len(t, second.sagas, 1)
+
+		fetched, err := store.GetById(ctx, "2")
+		require.NoError(t, err)
+		assert.Same(t, instance, fetched)
+
+		batch, err := store.GetByFilter(ctx, WithSagaId("2"))
+		require.NoError(t, err)
+		assert.Equal(t, 0, first.queries)
+		assert.Equal(t, 1, second.queries)
+		assert.Equal(t, 1, batch.Total)
+
+		require.NoError(t, store.Update(ctx, instance))
+		require.NoError(t, store.Delete(ctx, "2"))
+		assert.Len(t, second.sagas, 0)
+
+		err = store.Create(ctx, NewSagaInstance("3", "", &sagaExample{}))
+		assert.EqualError(t, err, "saga '3' is resolved into unknown shard ''")
+	})
+
+	t.Run("filtered sagas are merged from all shards and paged", func(t *testing.T) {
+		shards := map[string]Store{"a": newMemStore(), "b": newMemStore(), "c": newMemStore()}
+		store, err := NewShardedStore(shards, WithShardsParallelism(2))
+		require.NoError(t, err)
+
+		started := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 10; i++ {
+			startedAt := started.Add(time.Duration(i) * time.Minute)
+			instance := &sagaInstance{uid: fmt.Sprintf("saga-%d", i), saga: &sagaExample{}, startedAt: &startedAt, instanceStatus: instanceStatus{status: sagaStatusInProgress}}
+			require.NoError(t, store.Create(ctx, instance))
+		}
+
+		uids := func(items []Instance) []string {
+			res := make([]string, len(items))
+			for i, item := range items {
+				res[i] = item.UID()
+			}
+			return res
+		}
+
+		batch, err := store.GetByFilter(ctx, WithStatus("in_progress"), WithOffsetAndLimit(3, 4))
+		require.NoError(t, err)
+		assert.Equal(t, 10, batch.Total)
+		assert.Equal(t, []string{"saga-6", "saga-5", "saga-4", "saga-3"}, uids(batch.Items))
+
+		batch, err = store.GetByFilter(ctx, WithStatus("in_progress"), WithSorting(SortByStartedAt, SortAsc), WithOffsetAndLimit(8, 4))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"saga-8", "saga-9"}, uids(batch.Items))
+
+		batch, err = store.GetByFilter(ctx, WithStatus("in_progress"), WithOffsetAndLimit(20, 4))
+		require.NoError(t, err)
+		assert.Equal(t, 10, batch.Total)
+		assert.Empty(t, batch.Items)
+
+		batch, err = store.GetByFilter(ctx, WithStatus("failed"))
+		require.NoError(t, err)
+		assert.Equal(t, 0, batch.Total)
+	})
+
+	t.Run("shards are queried with bounded parallelism", func(t *testing.T) {
+		counter := &inFlightCounter{}
+		shards := make(map[string]Store)
+		for i := 0; i < 6; i++ {
+			s := newMemStore()
+			s.inFlight = counter
+			shards[fmt.Sprintf("shard-%d", i)] = s
+		}
+
+		store, err := NewShardedStore(shards, WithShardsParallelism(2))
+		require.NoError(t, err)
+
+		_, err = store.GetByFilter(ctx, WithStatus("in_progress"))
+		require.NoError(t, err)
+		assert.LessOrEqual(t, counter.max, 2)
+	})
+
+	t.Run("shard returns an error", func(t *testing.T) {
+		failing := newMemStore()
+		failing.err = errors.New("connection refused")
+		store, err := NewShardedStore(map[string]Store{"a": newMemStore(), "b": failing})
+		require.NoError(t, err)
+
+		_, err = store.GetByFilter(ctx, WithStatus("in_progress"))
+		assert.EqualError(t, err, "querying shard 'b': connection refused")
+
+		_, err = store.GetByFilter(ctx, WithSorting("name", SortAsc), WithStatus("in_progress"))
+		assert.EqualError(t, err, "unknown sort field 'name'")
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	sagaSql "github.com/go-foreman/foreman/saga/sql"
 
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga/filter"
 	"github.com/pkg/errors"
 )
 
@@ -28,7 +30,9 @@ type sqlStore struct {
 }
 
 // NewSQLSagaStore creates sql saga store, it supports mysql and postgres drivers.
-// driver param is required because of https://github.com/golang/go/issues/3602. Better this than +1 dependency or copy pasting code
+// driver param is required because of https://github.com/golang/go/issues/3602. Better this than +1 dependency or copy pasting code.
+// With PGDriver payload columns are created as jsonb and history appends are idempotent (ON CONFLICT DO NOTHING).
+// Payload columns are binary (bytea or longblob) if the marshaller produces something else than json, e.g. message.NewProtobufMarshaller.
 func NewSQLSagaStore(db *sagaSql.DB, driver SQLDriver, msgMarshaller message.Marshaller) (Store, error) {
 	s := &sqlStore{db: db, driver: driver, msgMarshaller: msgMarshaller}
 	if err := s.initTables(); err != nil {
@@ -38,13 +42,26 @@ func NewSQLSagaStore(db *sagaSql.DB, driver SQLDriver, msgMarshaller message.Mar
 	return s, nil
 }
 
+// NewSQLStoreFactory returns a factory of sql saga store which can be passed into component.NewSagaComponent.
+// Tables and indexes are created when the component is initialized.
+func NewSQLStoreFactory(db *sagaSql.DB, driver SQLDriver) func(msgMarshaller message.Marshaller) (Store, error) {
+	return func(msgMarshaller message.Marshaller) (Store, error) {
+		return NewSQLSagaStore(db, driver, msgMarshaller)
+	}
+}
+
 // Create saves saga instance into mysql store. History events, last failed event are not persisted at this step,
 // there is no way for them to be at creation step.
 func (s sqlStore) Create(ctx context.Context, sagaInstance Instance) error {
 	payload, err := s.msgMarshaller.Marshal(sagaInstance.Saga())
 
 	if err != nil {
-		return errors.WithStack(err)
+		return errors.Wrapf(err, "marshaling saga instance %s on create", sagaInstance.UID())
+	}
+
+	correlations, err := sagaCorrelations(sagaInstance)
+	if err != nil {
+		return err
 	}
 
 	conn, err := s.db.Conn(ctx, sagaInstance.UID(), false)
@@ -76,6 +93,20 @@ func (s sqlStore) Create(ctx context.Context, sagaInstance Instance) error {
 		return errors.Wrapf(err, "inserting saga instance %s", sagaInstance.UID())
 	}
 
+	if err := s.insertEntityRefs(ctx, tx, sagaInstance.UID(), sagaInstance.EntityRefs()); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return err
+	}
+
+	if err := s.insertCorrelations(ctx, tx, sagaInstance.UID(), correlations, sortedFields(correlations)); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return errors.Wrapf(err, "committing saga instance %s into the store", sagaInstance.UID())
 	}
@@ -84,6 +115,22 @@ func (s sqlStore) Create(ctx context.Context, sagaInstance Instance) error {
 }
 
 func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
+	return s.updateTx(ctx, sagaInstance, sagaInstance.Version(), nil)
+}
+
+func (s *sqlStore) UpdateIfVersion(ctx context.Context, sagaInstance Instance, expectedVersion int) error {
+	return s.updateTx(ctx, sagaInstance, expectedVersion, nil)
+}
+
+func (s *sqlStore) DB() (*sagaSql.DB, SQLDriver) {
+	return s.db, s.driver
+}
+
+func (s *sqlStore) UpdateTx(ctx context.Context, sagaInstance Instance, inTx TxFunc) error {
+	return s.updateTx(ctx, sagaInstance, sagaInstance.Version(), inTx)
+}
+
+func (s *sqlStore) updateTx(ctx context.Context, sagaInstance Instance, expectedVersion int, inTx TxFunc) error {
 	payload, err := s.msgMarshaller.Marshal(sagaInstance.Saga())
 	sagaName := sagaInstance.Saga().GroupKind().String()
 
@@ -102,6 +149,11 @@ func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
 		}
 	}
 
+	correlations, err := sagaCorrelations(sagaInstance)
+	if err != nil {
+		return err
+	}
+
 	conn, err := s.db.Conn(ctx, sagaInstance.UID(), false)
 	if err != nil {
 		return errors.Wrap(err, "obtaining a connection")
@@ -115,7 +167,7 @@ func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
 		return errors.WithStack(err)
 	}
 
-	_, err = tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("UPDATE %v SET parent_uid=?, name=?, payload=?, status=?, started_at=?, updated_at=?, last_failed_ev=? WHERE uid=?;", sagaTableName)),
+	row := []interface{}{
 		sagaInstance.ParentID(),
 		sagaName,
 		payload,
@@ -123,14 +175,32 @@ func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
 		sagaInstance.StartedAt(),
 		sagaInstance.UpdatedAt(),
 		lastFailedEv,
-		sagaInstance.UID(),
-	)
+		expectedVersion + 1,
+	}
+
+	// the saga is handled under a fenced lock, the update of a holder whose lock expired meanwhile mustn't overwrite it
+	token, fenced := FencingTokenFromContext(ctx)
+
+	saved, err := s.saveSaga(ctx, tx, sagaInstance.UID(), row, expectedVersion, token, fenced)
 
 	if err != nil {
 		if rErr := tx.Rollback(); rErr != nil {
-			return errors.Wrapf(rErr, "error rollback when %s", err)
+			return errors.Wrapf(rErr, "rollback when %s", err)
 		}
-		return errors.WithStack(err)
+		return err
+	}
+
+	if !saved {
+		conflictErr := WithVersionConflictErr(errors.Errorf("saga %s isn't at version %d anymore, it was updated or deleted concurrently", sagaInstance.UID(), expectedVersion))
+
+		if fenced {
+			conflictErr = s.fencingConflict(ctx, tx, sagaInstance.UID(), token, conflictErr)
+		}
+
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback of conflicting update of saga %s", sagaInstance.UID())
+		}
+		return conflictErr
 	}
 
 	rows, err := tx.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT uid FROM %v WHERE saga_uid=?;", sagaHistoryTableName)), sagaInstance.UID())
@@ -171,10 +241,10 @@ func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
 					return errors.Wrapf(rErr, "rollback when %s", err)
 				}
 
-				return errors.WithStack(err)
+				return errors.Wrapf(err, "marshaling history event %s of saga instance %s on update", ev.UID, sagaInstance.UID())
 			}
 
-			_, err = tx.Exec(s.prepQuery(fmt.Sprintf("INSERT INTO %v (uid, saga_uid, name, status, payload, origin, created_at, trace_uid) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", sagaHistoryTableName)),
+			_, err = tx.Exec(s.prepQuery(fmt.Sprintf("INSERT INTO %v (uid, saga_uid, name, status, payload, origin, created_at, trace_uid) VALUES (?, ?, ?, ?, ?, ?, ?, ?)%s;", sagaHistoryTableName, s.onConflictDoNothing())),
 				ev.UID,
 				sagaInstance.UID(),
 				ev.Payload.GroupKind().String(),
@@ -194,13 +264,120 @@ func (s *sqlStore) Update(ctx context.Context, sagaInstance Instance) error {
 		}
 	}
 
+	if err := s.updateEntityRefs(ctx, tx, sagaInstance); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return err
+	}
+
+	if err := s.updateCorrelations(ctx, tx, sagaInstance.UID(), correlations); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return err
+	}
+
+	if inTx != nil {
+		if err := inTx(ctx, tx); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return errors.Wrapf(rErr, "rollback when %s", err)
+			}
+			return err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return errors.Wrapf(err, "committing update of events for saga %s", sagaInstance.UID())
 	}
 
+	sagaInstance.SetVersion(expectedVersion + 1)
+
 	return nil
 }
 
+// saveSaga overwrites the row of the saga if it's still at expectedVersion and wasn't saved under a greater fencing token.
+// Postgres upserts the row and returns the saved version, a row inserted instead of updated means the saga was deleted concurrently
+// and the transaction is rolled back by the caller. saveSaga reports false if the saga wasn't saved.
+func (s *sqlStore) saveSaga(ctx context.Context, tx *sql.Tx, sagaId string, row []interface{}, expectedVersion int, token int64, fenced bool) (bool, error) {
+	columns := []string{"parent_uid", "name", "payload", "status", "started_at", "updated_at", "last_failed_ev", "version"}
+	condition := "version=?"
+	conditionArgs := []interface{}{expectedVersion}
+
+	if fenced {
+		columns = append(columns, "fence")
+		row = append(row, token)
+		condition += " AND fence<=?"
+		conditionArgs = append(conditionArgs, token)
+	}
+
+	if s.driver == PGDriver {
+		assignments := make([]string, len(columns))
+		for i, column := range columns {
+			assignments[i] = fmt.Sprintf("%[1]s=EXCLUDED.%[1]s", column)
+		}
+
+		query := fmt.Sprintf(
+			"INSERT INTO %[1]v (uid, %[2]s) VALUES (?, %[3]s) ON CONFLICT (uid) DO UPDATE SET %[4]s WHERE %[1]v.%[5]s RETURNING version, xmax = 0;",
+			sagaTableName,
+			strings.Join(columns, ", "),
+			placeholders(len(columns)),
+			strings.Join(assignments, ", "),
+			strings.ReplaceAll(condition, " AND ", fmt.Sprintf(" AND %v.", sagaTableName)),
+		)
+
+		var (
+			version  int
+			inserted bool
+		)
+
+		args := append(append([]interface{}{sagaId}, row...), conditionArgs...)
+		if err := tx.QueryRowContext(ctx, s.prepQuery(query), args...).Scan(&version, &inserted); err != nil {
+			if err == sql.ErrNoRows {
+				return false, nil
+			}
+
+			return false, errors.WithStack(err)
+		}
+
+		return !inserted && version == expectedVersion+1, nil
+	}
+
+	query := fmt.Sprintf("UPDATE %v SET %s=? WHERE uid=? AND %s;", sagaTableName, strings.Join(columns, "=?, "), condition)
+	args := append(append(row, sagaId), conditionArgs...)
+
+	res, err := tx.ExecContext(ctx, s.prepQuery(query), args...)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "getting response of update query for saga %s", sagaId)
+	}
+
+	return updated > 0, nil
+}
+
+// fencingConflict returns StaleFencingTokenErr if the saga was saved under a greater fencing token than the one of the rejected update
+func (s sqlStore) fencingConflict(ctx context.Context, tx *sql.Tx, sagaId string, token int64, conflictErr error) error {
+	var fence int64
+
+	if err := tx.QueryRowContext(ctx, s.prepQuery(fmt.Sprintf("SELECT fence FROM %s WHERE uid=?;", sagaTableName)), sagaId).Scan(&fence); err != nil {
+		if err == sql.ErrNoRows {
+			return conflictErr
+		}
+
+		return errors.Wrapf(err, "querying fencing token of saga %s", sagaId)
+	}
+
+	if fence > token {
+		return WithStaleFencingTokenErr(errors.Errorf("saga %s was saved under fencing token %d, the lock with token %d has expired", sagaId, fence, token))
+	}
+
+	return conflictErr
+}
+
 func (s sqlStore) GetById(ctx context.Context, sagaId string) (Instance, error) {
 	conn, err := s.db.Conn(ctx, sagaId, false)
 	if err != nil {
@@ -210,7 +387,7 @@ func (s sqlStore) GetById(ctx context.Context, sagaId string) (Instance, error)
 	defer conn.Close(false)
 
 	sagaData := sagaSqlModel{}
-	err = conn.QueryRowContext(ctx, s.prepQuery(fmt.Sprintf("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM %v s WHERE uid=?;", sagaTableName)), sagaId).
+	err = conn.QueryRowContext(ctx, s.prepQuery(fmt.Sprintf("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM %v s WHERE uid=?;", sagaTableName)), sagaId).
 		Scan(
 			&sagaData.ID,
 			&sagaData.ParentID,
@@ -219,7 +396,8 @@ func (s sqlStore) GetById(ctx context.Context, sagaId string) (Instance, error)
 			&sagaData.Status,
 			&sagaData.LastFailedMsg,
 			&sagaData.StartedAt,
-			&sagaData.UpdatedAt)
+			&sagaData.UpdatedAt,
+			&sagaData.Version)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -242,6 +420,14 @@ func (s sqlStore) GetById(ctx context.Context, sagaId string) (Instance, error)
 
 	sagaInstance.historyEvents = messages
 
+	refs, err := s.queryEntityRefs(ctx, conn.Conn, []interface{}{sagaId})
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sagaInstance.entityRefs = refs[sagaId]
+
 	return sagaInstance, nil
 }
 
@@ -250,11 +436,7 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 		return nil, errors.Errorf("no filters found, you have to specify at least one so result won't be whole store")
 	}
 
-	opts := &filterOptions{}
-
-	for _, filter := range filters {
-		filter(opts)
-	}
+	opts := newFilterOptions(filters)
 
 	countQuery := fmt.Sprintf(`SELECT COUNT(s.uid) cnt FROM %s s`, sagaTableName)
 
@@ -268,29 +450,15 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 			s.status,
 			s.last_failed_ev,
 			s.started_at,
-			s.updated_at
+			s.updated_at,
+			s.version
 		FROM %s s`,
 		sagaTableName,
 	)
 
-	var (
-		args       []interface{}
-		conditions []string
-	)
-
-	if opts.sagaId != "" {
-		conditions = append(conditions, "s.uid = ?")
-		args = append(args, opts.sagaId)
-	}
-
-	if opts.status != "" {
-		conditions = append(conditions, "s.status = ?")
-		args = append(args, opts.status)
-	}
-
-	if opts.sagaName != "" {
-		conditions = append(conditions, "s.name = ?")
-		args = append(args, opts.sagaName)
+	conditions, args, err := s.filterConditions(opts.filter(), "s.")
+	if err != nil {
+		return nil, err
 	}
 
 	if len(conditions) > 0 {
@@ -300,7 +468,13 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 		return nil, errors.Errorf("all specified filters are empty, you have to specify at least one so result won't be whole store")
 	}
 
-	batchQuery += " ORDER BY started_at DESC"
+	sortField, sortOrder, err := opts.orderBy()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// uid makes the order stable when timestamps are equal, otherwise pages could overlap
+	batchQuery += fmt.Sprintf(" ORDER BY %[1]s %[2]s, uid %[2]s", sortField, strings.ToUpper(string(sortOrder)))
 
 	if opts.limit != nil {
 		batchQuery += fmt.Sprintf(" LIMIT %d", *opts.limit)
@@ -346,6 +520,7 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 			&sagaModel.LastFailedMsg,
 			&sagaModel.StartedAt,
 			&sagaModel.UpdatedAt,
+			&sagaModel.Version,
 		); err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -365,13 +540,7 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 		}, nil
 	}
 
-	var sagaIDPlaceholders string
-	for i := 0; i < len(sagaIDs); i++ {
-		sagaIDPlaceholders += "?"
-		if i < len(sagaIDs)-1 {
-			sagaIDPlaceholders += ", "
-		}
-	}
+	sagaIDPlaceholders := placeholders(len(sagaIDs))
 
 	eventsQuery := fmt.Sprintf(
 		`SELECT
@@ -420,17 +589,24 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 		}
 	}
 
-	sagas := make([]Instance, len(sagaModels))
+	refs, err := s.queryEntityRefs(ctx, s.db, sagaIDs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sagas := make([]Instance, len(sagaIDs))
+
+	// iterate over ids, not the map, to keep the order of the batch query
+	for idx, sagaID := range sagaIDs {
+		sagaModel := sagaModels[sagaID.(string)]
 
-	idx := 0
-	for _, sagaModel := range sagaModels {
 		sagaInstance, err := s.instanceFromModel(sagaModel)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 
 		sagas[idx] = sagaInstance
-		idx++
+		sagaInstance.entityRefs = refs[sagaModel.ID.String]
 
 		sagaEvents, ok := events[sagaModel.ID.String]
 		if !ok {
@@ -453,6 +629,49 @@ func (s sqlStore) GetByFilter(ctx context.Context, filters ...FilterOption) (*In
 	}, nil
 }
 
+// GetByCorrelation looks the saga up in saga_correlation table, which keeps values of fields of sagas in progress, and loads it by GetById.
+// Only strings, numbers and bools not longer than 255 characters are kept there, see CorrelationValue.
+func (s sqlStore) GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (Instance, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		s.prepQuery(fmt.Sprintf("SELECT c.saga_uid FROM %s c INNER JOIN %s s ON s.uid = c.saga_uid WHERE c.field = ? AND c.value = ? AND s.name = ? AND s.status <> ?;", sagaCorrelationTable, sagaTableName)),
+		field,
+		value,
+		sagaType,
+		sagaStatusCompleted.String(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying correlated sagas")
+	}
+
+	defer rows.Close()
+
+	var sagaIDs []string
+
+	for rows.Next() {
+		var sagaId string
+
+		if err := rows.Scan(&sagaId); err != nil {
+			return nil, errors.Wrap(err, "scanning correlated sagas")
+		}
+
+		sagaIDs = append(sagaIDs, sagaId)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating correlated sagas")
+	}
+
+	switch len(sagaIDs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return s.GetById(ctx, sagaIDs[0])
+	default:
+		return nil, ambiguousCorrelation(sagaIDs, sagaType, field, value)
+	}
+}
+
 func (s sqlStore) Delete(ctx context.Context, sagaId string) error {
 	conn, err := s.db.Conn(ctx, sagaId, false)
 	if err != nil {
@@ -479,135 +698,621 @@ func (s sqlStore) Delete(ctx context.Context, sagaId string) error {
 	return errors.Errorf("no saga instance %s found", sagaId)
 }
 
-func (s sqlStore) queryEvents(conn *sql.Conn, ctx context.Context, sagaId string) ([]HistoryEvent, error) {
-	rows, err := conn.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT uid, name, status, payload, origin, created_at, trace_uid FROM %v WHERE saga_uid=? ORDER BY created_at;", sagaHistoryTableName)), sagaId)
+// DeleteByFilter deletes matching sagas with one query, their history is deleted by the foreign key cascade
+func (s sqlStore) DeleteByFilter(ctx context.Context, filters ...FilterOption) (int, error) {
+	conditions, args, err := s.filterConditions(newFilterOptions(filters).filter(), "")
+	if err != nil {
+		return 0, err
+	}
+
+	if len(conditions) == 0 {
+		return 0, errors.Errorf("all specified filters are empty, you have to specify at least one so whole store won't be deleted")
+	}
 
+	res, err := s.db.ExecContext(ctx, s.prepQuery(fmt.Sprintf("DELETE FROM %s WHERE %s;", sagaTableName, strings.Join(conditions, " AND "))), args...)
 	if err != nil {
-		return nil, errors.Wrapf(err, "querying events for saga %s", sagaId)
+		return 0, errors.Wrap(err, "executing delete query")
 	}
 
-	defer rows.Close()
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting response of delete query")
+	}
 
-	messages := make([]HistoryEvent, 0)
+	return int(rows), nil
+}
 
-	for rows.Next() {
-		ev := historyEventSqlModel{}
+// DeleteOlderThan selects completed sagas in batches, oldest first, and deletes them one by one
+func (s sqlStore) DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...DeleteOption) (int, error) {
+	options := newDeleteOptions(opts)
+	deleted := 0
 
-		if err := rows.Scan(
-			&ev.ID,
-			&ev.Name,
-			&ev.SagaStatus,
-			&ev.Payload,
-			&ev.OriginSource,
-			&ev.CreatedAt,
-			&ev.TraceUID,
-		); err != nil {
-			return nil, errors.Wrapf(err, "scanning events for saga %s", sagaId)
-		}
+	for {
+		batchSize := options.batchSize(deleted)
 
-		hEv, err := s.eventFromModel(ev)
+		if batchSize <= 0 {
+			return deleted, nil
+		}
 
+		sagaIDs, err := s.completedBefore(ctx, cutoff, batchSize)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return deleted, err
 		}
 
-		messages = append(messages, *hEv)
+		for _, sagaId := range sagaIDs {
+			ok, err := s.deleteCompleted(ctx, sagaId, cutoff, options.archiver)
+			if err != nil {
+				return deleted, err
+			}
+
+			if ok {
+				deleted++
+			}
+		}
+
+		if len(sagaIDs) < batchSize {
+			return deleted, nil
+		}
 	}
+}
 
-	if rows.Err() != nil {
-		return nil, errors.WithStack(err)
+func (s sqlStore) completedBefore(ctx context.Context, cutoff time.Time, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT uid FROM %s WHERE status = ? AND updated_at < ? ORDER BY updated_at LIMIT %d;", sagaTableName, limit)), sagaStatusCompleted.String(), cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying completed sagas")
 	}
 
-	return messages, nil
-}
+	defer rows.Close()
 
-func (s sqlStore) eventFromModel(ev historyEventSqlModel) (*HistoryEvent, error) {
-	eventPayload, err := s.msgMarshaller.Unmarshal(ev.Payload)
+	var sagaIDs []string
 
-	if err != nil {
-		return nil, errors.Wrapf(err, "error deserializing payload into event %s", ev.ID.String)
+	for rows.Next() {
+		var sagaId string
+
+		if err := rows.Scan(&sagaId); err != nil {
+			return nil, errors.Wrap(err, "scanning completed sagas")
+		}
+
+		sagaIDs = append(sagaIDs, sagaId)
 	}
 
-	res := &HistoryEvent{
-		UID:          ev.ID.String,
-		SagaStatus:   ev.SagaStatus.String,
-		Payload:      eventPayload,
-		CreatedAt:    ev.CreatedAt.Time,
-		OriginSource: ev.OriginSource.String,
-		TraceUID:     ev.TraceUID.String,
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating completed sagas")
 	}
 
-	return res, nil
+	return sagaIDs, nil
 }
 
-func (s sqlStore) instanceFromModel(sagaData sagaSqlModel) (*sagaInstance, error) {
-	status, err := statusFromStr(sagaData.Status.String)
-	if err != nil {
-		return nil, errors.Wrapf(err, "parsing status of %s", sagaData.ID.String)
+// deleteCompleted archives the saga and deletes it with its history and entity refs in one transaction.
+// Nothing is deleted if the saga was updated or deleted since it was selected.
+func (s sqlStore) deleteCompleted(ctx context.Context, sagaId string, cutoff time.Time, archiver Archiver) (bool, error) {
+	if archiver != nil {
+		sagaInstance, err := s.GetById(ctx, sagaId)
+		if err != nil {
+			return false, errors.Wrapf(err, "loading saga %s for archiving", sagaId)
+		}
+
+		if sagaInstance == nil {
+			return false, nil
+		}
+
+		if err := archiver(ctx, sagaInstance); err != nil {
+			return false, errors.Wrapf(err, "archiving saga %s", sagaId)
+		}
 	}
 
-	sagaInstance := &sagaInstance{
-		uid: sagaData.ID.String,
-		instanceStatus: instanceStatus{
-			status: status,
-		},
-		parentID:      sagaData.ParentID.String,
-		historyEvents: make([]HistoryEvent, 0),
+	conn, err := s.db.Conn(ctx, sagaId, false)
+	if err != nil {
+		return false, errors.Wrap(err, "obtaining a connection")
 	}
 
-	if sagaData.StartedAt.Valid {
-		sagaInstance.startedAt = &sagaData.StartedAt.Time
+	defer conn.Close(false)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "beginning a transaction for saga %s", sagaId)
 	}
 
-	if sagaData.UpdatedAt.Valid {
-		sagaInstance.updatedAt = &sagaData.UpdatedAt.Time
+	rollback := func(err error) (bool, error) {
+		if rErr := tx.Rollback(); rErr != nil {
+			return false, errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return false, err
 	}
 
-	if len(sagaData.LastFailedMsg) > 0 {
-		sagaInstance.instanceStatus.lastFailedEv, err = s.msgMarshaller.Unmarshal(sagaData.LastFailedMsg)
-		if err != nil {
-			return nil, errors.Wrapf(err, "unmarshaling last failed ev %v for saga %s", sagaData.LastFailedMsg, sagaData.ID.String)
+	for _, table := range []string{sagaHistoryTableName, sagaEntityRefTableName} {
+		if _, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("DELETE FROM %s WHERE saga_uid=?;", table)), sagaId); err != nil {
+			return rollback(errors.Wrapf(err, "deleting %s of saga %s", table, sagaId))
 		}
 	}
 
-	saga, err := s.msgMarshaller.Unmarshal(sagaData.Payload)
+	res, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("DELETE FROM %s WHERE uid=? AND status = ? AND updated_at < ?;", sagaTableName)), sagaId, sagaStatusCompleted.String(), cutoff)
+	if err != nil {
+		return rollback(errors.Wrapf(err, "deleting saga %s", sagaId))
+	}
 
+	rows, err := res.RowsAffected()
 	if err != nil {
-		return nil, errors.Wrapf(err, "error deserializing payload %v into saga %s", sagaData.Payload, sagaData.Name.String)
+		return rollback(errors.Wrapf(err, "getting response of delete query for saga %s", sagaId))
 	}
 
-	sagaInterface, ok := saga.(Saga)
+	if rows == 0 {
+		if err := tx.Rollback(); err != nil {
+			return false, errors.Wrapf(err, "rollback of kept saga %s", sagaId)
+		}
+		return false, nil
+	}
 
-	if !ok {
-		return nil, errors.New("error converting payload into type Saga interface")
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrapf(err, "committing deletion of saga %s", sagaId)
 	}
 
-	sagaInstance.saga = sagaInterface
+	return true, nil
+}
 
-	return sagaInstance, nil
+// CheckHealth pings the database sagas are kept in, see health.Checker
+func (s sqlStore) CheckHealth(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
-func (s sqlStore) initTables() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
+// filterConditions compiles predicates of the filter which all must match into sql conditions, column names are prefixed with the table alias
+func (s sqlStore) filterConditions(e filter.Expr, alias string) ([]string, []interface{}, error) {
+	if err := s.checkFilter(e); err != nil {
+		return nil, nil, err
+	}
 
-	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	var (
+		args       []interface{}
+		conditions []string
+	)
 
-	if err != nil {
-		return errors.WithStack(err)
+	for _, conjunct := range filter.Conjuncts(e) {
+		condition, conditionArgs := s.sqlCondition(conjunct, alias)
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
 	}
 
-	_, err = tx.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
-	(
-		uid varchar(255) not null primary key,
-		parent_uid varchar(255) null,
+	return conditions, args, nil
+}
+
+// checkFilter rejects predicates the store can't compile. Binary payloads can't be searched, so DataContains requires a json marshaller.
+func (s sqlStore) checkFilter(e filter.Expr) error {
+	if message.ContentTypeOf(s.msgMarshaller) == message.JsonContentType {
+		return filter.Check(e, "sql store", filter.AllKinds...)
+	}
+
+	kinds := make([]filter.Kind, 0, len(filter.AllKinds))
+	for _, kind := range filter.AllKinds {
+		if kind != filter.DataContainsKind {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	return filter.Check(e, "sql store with binary payloads", kinds...)
+}
+
+// sqlCondition compiles a predicate into a condition. NULL columns never match, a negated condition
+// is coalesced to false first, so Not matches such sagas as saga.MatchFilter does.
+func (s sqlStore) sqlCondition(e filter.Expr, alias string) (string, []interface{}) {
+	switch node := e.(type) {
+	case filter.AndExpr:
+		return s.sqlJunction(node.Exprs, " AND ", "1 = 1", alias)
+	case filter.OrExpr:
+		return s.sqlJunction(node.Exprs, " OR ", "1 = 0", alias)
+	case filter.NotExpr:
+		// uid is never NULL
+		if byID, ok := node.Expr.(filter.SagaIDExpr); ok && len(byID.IDs) > 0 {
+			return fmt.Sprintf("%suid NOT IN (%s)", alias, placeholders(len(byID.IDs))), stringArgs(byID.IDs)
+		}
+
+		condition, args := s.sqlCondition(node.Expr, alias)
+
+		return fmt.Sprintf("NOT COALESCE(%s, FALSE)", condition), args
+	case filter.SagaIDExpr:
+		return sqlIn(alias+"uid", node.IDs)
+	case filter.StatusExpr:
+		return sqlIn(alias+"status", node.Statuses)
+	case filter.NameExpr:
+		return sqlIn(alias+"name", node.Names)
+	case filter.ParentIDExpr:
+		return alias + "parent_uid = ?", []interface{}{node.ID}
+	case filter.TimeExpr:
+		column, operator := "started_at", ">="
+
+		if node.Kind() == filter.UpdatedFromKind || node.Kind() == filter.UpdatedBeforeKind {
+			column = "updated_at"
+		}
+
+		if node.Kind() == filter.StartedBeforeKind || node.Kind() == filter.UpdatedBeforeKind {
+			operator = "<"
+		}
+
+		return fmt.Sprintf("%s%s %s ?", alias, column, operator), []interface{}{node.Time}
+	case filter.EntityRefExpr:
+		return fmt.Sprintf("%suid IN (SELECT r.saga_uid FROM %s r WHERE r.kind = ? AND r.entity_id = ?)", alias, sagaEntityRefTableName), []interface{}{node.EntityKind, node.ID}
+	case filter.DataContainsExpr:
+		payload := alias + "payload"
+
+		// a json document is looked up by containment, postgres uses gin index of payload for it
+		if _, ok := node.Document(); ok {
+			if s.driver == PGDriver {
+				return payload + " @> ?::jsonb", []interface{}{node.Text}
+			}
+
+			return fmt.Sprintf("JSON_CONTAINS(%s, ?)", payload), []interface{}{node.Text}
+		}
+
+		// jsonb is compared by its text representation
+		if s.driver == PGDriver {
+			payload += "::text"
+		}
+
+		return fmt.Sprintf("LOWER(%s) LIKE ?", payload), []interface{}{"%" + escapeLike(strings.ToLower(node.Text)) + "%"}
+	default:
+		// filter.Check rejects unknown predicates before they are compiled
+		return "1 = 0", nil
+	}
+}
+
+func (s sqlStore) sqlJunction(exprs []filter.Expr, operator, empty, alias string) (string, []interface{}) {
+	if len(exprs) == 0 {
+		return empty, nil
+	}
+
+	var (
+		args       []interface{}
+		conditions = make([]string, len(exprs))
+	)
+
+	for i, e := range exprs {
+		condition, conditionArgs := s.sqlCondition(e, alias)
+		conditions[i] = condition
+		args = append(args, conditionArgs...)
+	}
+
+	return "(" + strings.Join(conditions, operator) + ")", args
+}
+
+func sqlIn(column string, values []string) (string, []interface{}) {
+	switch len(values) {
+	case 0:
+		return "1 = 0", nil
+	case 1:
+		return column + " = ?", []interface{}{values[0]}
+	default:
+		return fmt.Sprintf("%s IN (%s)", column, placeholders(len(values))), stringArgs(values)
+	}
+}
+
+// likeEscaper escapes wildcards of LIKE patterns, backslash is the default escape character of mysql and postgres
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(text string) string {
+	return likeEscaper.Replace(text)
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+
+	return args
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryEntityRefs loads entity refs of sagas grouped by saga uid
+func (s sqlStore) queryEntityRefs(ctx context.Context, q queryer, sagaIDs []interface{}) (map[string][]EntityRef, error) {
+	rows, err := q.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT saga_uid, kind, entity_id FROM %s WHERE saga_uid IN (%s);", sagaEntityRefTableName, placeholders(len(sagaIDs)))), sagaIDs...)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "querying saga entity refs")
+	}
+
+	defer rows.Close()
+
+	refs := make(map[string][]EntityRef)
+
+	for rows.Next() {
+		var (
+			sagaUID string
+			ref     EntityRef
+		)
+
+		if err := rows.Scan(&sagaUID, &ref.Kind, &ref.ID); err != nil {
+			return nil, errors.Wrap(err, "scanning saga entity refs")
+		}
+
+		refs[sagaUID] = append(refs[sagaUID], ref)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating saga entity refs")
+	}
+
+	return refs, nil
+}
+
+// updateEntityRefs inserts refs added since the saga was loaded, refs are never removed
+func (s sqlStore) updateEntityRefs(ctx context.Context, tx *sql.Tx, sagaInstance Instance) error {
+	if len(sagaInstance.EntityRefs()) == 0 {
+		return nil
+	}
+
+	existing, err := s.queryEntityRefs(ctx, tx, []interface{}{sagaInstance.UID()})
+	if err != nil {
+		return err
+	}
+
+	existingRefs := make(map[EntityRef]struct{}, len(existing[sagaInstance.UID()]))
+	for _, ref := range existing[sagaInstance.UID()] {
+		existingRefs[ref] = struct{}{}
+	}
+
+	var newRefs []EntityRef
+
+	for _, ref := range sagaInstance.EntityRefs() {
+		if _, exists := existingRefs[ref]; !exists {
+			newRefs = append(newRefs, ref)
+		}
+	}
+
+	return s.insertEntityRefs(ctx, tx, sagaInstance.UID(), newRefs)
+}
+
+func (s sqlStore) insertEntityRefs(ctx context.Context, tx *sql.Tx, sagaId string, refs []EntityRef) error {
+	for _, ref := range refs {
+		_, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("INSERT INTO %s (saga_uid, kind, entity_id) VALUES (?, ?, ?);", sagaEntityRefTableName)), sagaId, ref.Kind, ref.ID)
+
+		if err != nil {
+			return errors.Wrapf(err, "inserting entity ref %s for saga %s", ref, sagaId)
+		}
+	}
+
+	return nil
+}
+
+// sagaCorrelations returns values of fields the saga can be correlated by, completed sagas aren't correlated
+func sagaCorrelations(sagaInstance Instance) (map[string]string, error) {
+	if sagaInstance.Status().Completed() {
+		return nil, nil
+	}
+
+	values, err := correlationValues(sagaInstance.Saga())
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading correlation fields of saga %s", sagaInstance.UID())
+	}
+
+	return values, nil
+}
+
+// updateCorrelations writes changed values of the saga fields, values of completed sagas are deleted
+func (s sqlStore) updateCorrelations(ctx context.Context, tx *sql.Tx, sagaId string, correlations map[string]string) error {
+	if len(correlations) == 0 {
+		if _, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("DELETE FROM %s WHERE saga_uid=?;", sagaCorrelationTable)), sagaId); err != nil {
+			return errors.Wrapf(err, "deleting correlations of saga %s", sagaId)
+		}
+
+		return nil
+	}
+
+	existing, err := s.queryCorrelations(ctx, tx, sagaId)
+	if err != nil {
+		return err
+	}
+
+	var newFields []string
+
+	for _, field := range sortedFields(existing) {
+		value, ok := correlations[field]
+
+		switch {
+		case !ok:
+			_, err = tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("DELETE FROM %s WHERE saga_uid=? AND field=?;", sagaCorrelationTable)), sagaId, field)
+		case value != existing[field]:
+			_, err = tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("UPDATE %s SET value=? WHERE saga_uid=? AND field=?;", sagaCorrelationTable)), value, sagaId, field)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "updating correlation %s of saga %s", field, sagaId)
+		}
+	}
+
+	for _, field := range sortedFields(correlations) {
+		if _, exists := existing[field]; !exists {
+			newFields = append(newFields, field)
+		}
+	}
+
+	return s.insertCorrelations(ctx, tx, sagaId, correlations, newFields)
+}
+
+func (s sqlStore) queryCorrelations(ctx context.Context, q queryer, sagaId string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT field, value FROM %s WHERE saga_uid=?;", sagaCorrelationTable)), sagaId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "querying correlations of saga %s", sagaId)
+	}
+
+	defer rows.Close()
+
+	correlations := make(map[string]string)
+
+	for rows.Next() {
+		var field, value string
+
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, errors.Wrapf(err, "scanning correlations of saga %s", sagaId)
+		}
+
+		correlations[field] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "iterating correlations of saga %s", sagaId)
+	}
+
+	return correlations, nil
+}
+
+func (s sqlStore) insertCorrelations(ctx context.Context, tx *sql.Tx, sagaId string, correlations map[string]string, fields []string) error {
+	for _, field := range fields {
+		_, err := tx.ExecContext(ctx, s.prepQuery(fmt.Sprintf("INSERT INTO %s (saga_uid, field, value) VALUES (?, ?, ?);", sagaCorrelationTable)), sagaId, field, correlations[field])
+
+		if err != nil {
+			return errors.Wrapf(err, "inserting correlation %s for saga %s", field, sagaId)
+		}
+	}
+
+	return nil
+}
+
+// sortedFields returns fields in the same order, so queries of an update are predictable
+func sortedFields(correlations map[string]string) []string {
+	fields := make([]string, 0, len(correlations))
+	for field := range correlations {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+func (s sqlStore) queryEvents(conn *sql.Conn, ctx context.Context, sagaId string) ([]HistoryEvent, error) {
+	rows, err := conn.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT uid, name, status, payload, origin, created_at, trace_uid FROM %v WHERE saga_uid=? ORDER BY created_at;", sagaHistoryTableName)), sagaId)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "querying events for saga %s", sagaId)
+	}
+
+	defer rows.Close()
+
+	messages := make([]HistoryEvent, 0)
+
+	for rows.Next() {
+		ev := historyEventSqlModel{}
+
+		if err := rows.Scan(
+			&ev.ID,
+			&ev.Name,
+			&ev.SagaStatus,
+			&ev.Payload,
+			&ev.OriginSource,
+			&ev.CreatedAt,
+			&ev.TraceUID,
+		); err != nil {
+			return nil, errors.Wrapf(err, "scanning events for saga %s", sagaId)
+		}
+
+		hEv, err := s.eventFromModel(ev)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		messages = append(messages, *hEv)
+	}
+
+	if rows.Err() != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return messages, nil
+}
+
+func (s sqlStore) eventFromModel(ev historyEventSqlModel) (*HistoryEvent, error) {
+	eventPayload, err := s.msgMarshaller.Unmarshal(ev.Payload)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error deserializing payload into event %s", ev.ID.String)
+	}
+
+	res := &HistoryEvent{
+		UID:          ev.ID.String,
+		SagaStatus:   ev.SagaStatus.String,
+		Payload:      eventPayload,
+		CreatedAt:    ev.CreatedAt.Time,
+		OriginSource: ev.OriginSource.String,
+		TraceUID:     ev.TraceUID.String,
+	}
+
+	return res, nil
+}
+
+func (s sqlStore) instanceFromModel(sagaData sagaSqlModel) (*sagaInstance, error) {
+	status, err := statusFromStr(sagaData.Status.String)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing status of %s", sagaData.ID.String)
+	}
+
+	sagaInstance := &sagaInstance{
+		uid: sagaData.ID.String,
+		instanceStatus: instanceStatus{
+			status: status,
+		},
+		parentID:      sagaData.ParentID.String,
+		historyEvents: make([]HistoryEvent, 0),
+		version:       int(sagaData.Version.Int64),
+	}
+
+	if sagaData.StartedAt.Valid {
+		sagaInstance.startedAt = &sagaData.StartedAt.Time
+	}
+
+	if sagaData.UpdatedAt.Valid {
+		sagaInstance.updatedAt = &sagaData.UpdatedAt.Time
+	}
+
+	if len(sagaData.LastFailedMsg) > 0 {
+		sagaInstance.instanceStatus.lastFailedEv, err = s.msgMarshaller.Unmarshal(sagaData.LastFailedMsg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling last failed ev %v for saga %s", sagaData.LastFailedMsg, sagaData.ID.String)
+		}
+	}
+
+	saga, err := s.msgMarshaller.Unmarshal(sagaData.Payload)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error deserializing payload %v into saga %s", sagaData.Payload, sagaData.Name.String)
+	}
+
+	sagaInterface, ok := saga.(Saga)
+
+	if !ok {
+		return nil, errors.Errorf("payload of saga %s is %T, it doesn't implement Saga interface", sagaData.ID.String, saga)
+	}
+
+	sagaInstance.saga = sagaInterface
+
+	return sagaInstance, nil
+}
+
+func (s sqlStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		uid varchar(255) not null primary key,
+		parent_uid varchar(255) null,
 		name varchar(255) null,
-		payload text null,
+		payload %[2]s null,
 		status varchar(255) null,
 		started_at timestamp null,
 		updated_at timestamp null,
-		last_failed_ev text null
-	);`, sagaTableName))
+		last_failed_ev %[2]s null,
+		version integer not null default 0,
+		fence bigint not null default 0%[3]s
+	);`, sagaTableName, s.payloadColumnType(), s.inlineIndexes()))
 
 	if err != nil {
 		if rErr := tx.Rollback(); rErr != nil {
@@ -622,14 +1327,58 @@ func (s sqlStore) initTables() error {
 		saga_uid varchar(255) not null,
 		name varchar(255) null,
 		status varchar(255) null,
-		payload text null,
+		payload %[3]s null,
 		origin varchar(255) null,
 		created_at timestamp null,
 		trace_uid varchar(255) null,
 		constraint saga_history_saga_model_id_fk
-			foreign key (saga_uid) references %v (uid)
+			foreign key (saga_uid) references %[2]v (uid)
+				on update cascade on delete cascade
+	);`, sagaHistoryTableName, sagaTableName, s.payloadColumnType()))
+
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "error rollback when %s", err)
+		}
+		return errors.WithStack(err)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		saga_uid varchar(255) not null,
+		kind varchar(255) not null,
+		entity_id varchar(255) not null,
+		primary key (saga_uid, kind, entity_id),%[3]s
+		constraint saga_entity_ref_saga_model_id_fk
+			foreign key (saga_uid) references %[2]v (uid)
+				on update cascade on delete cascade
+	);`, sagaEntityRefTableName, sagaTableName, s.inlineEntityRefIndex()))
+
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "error rollback when %s", err)
+		}
+		return errors.WithStack(err)
+	}
+
+	correlationTableExists, err := s.tableExists(ctx, tx, sagaCorrelationTable)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "error rollback when %s", err)
+		}
+		return errors.WithStack(err)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		saga_uid varchar(255) not null,
+		field varchar(255) not null,
+		value varchar(255) not null,
+		primary key (saga_uid, field),%[3]s
+		constraint saga_correlation_saga_model_id_fk
+			foreign key (saga_uid) references %[2]v (uid)
 				on update cascade on delete cascade
-	);`, sagaHistoryTableName, sagaTableName))
+	);`, sagaCorrelationTable, sagaTableName, s.inlineCorrelationIndex()))
 
 	if err != nil {
 		if rErr := tx.Rollback(); rErr != nil {
@@ -638,6 +1387,41 @@ func (s sqlStore) initTables() error {
 		return errors.WithStack(err)
 	}
 
+	upgradeQueries, err := s.upgradeQueries(ctx, tx)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return errors.Wrapf(rErr, "error rollback when %s", err)
+		}
+		return errors.WithStack(err)
+	}
+
+	for _, query := range upgradeQueries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return errors.Wrapf(rErr, "error rollback when %s", err)
+			}
+			return errors.Wrapf(err, "upgrading table: %s", query)
+		}
+	}
+
+	if !correlationTableExists {
+		if err := s.fillCorrelations(ctx, tx); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return errors.Wrapf(rErr, "error rollback when %s", err)
+			}
+			return err
+		}
+	}
+
+	for _, query := range s.indexQueries() {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return errors.Wrapf(rErr, "error rollback when %s", err)
+			}
+			return errors.Wrapf(err, "creating index: %s", query)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return errors.WithStack(err)
 	}
@@ -645,14 +1429,317 @@ func (s sqlStore) initTables() error {
 	return nil
 }
 
+// sagaEntityRefIndex backs WithEntityRef filter
+const sagaEntityRefIndex = "saga_entity_ref_entity_idx"
+
+// sagaCorrelationIndex backs GetByCorrelation
+const sagaCorrelationIndex = "saga_correlation_value_idx"
+
+// sagaPayloadIndex backs containment lookups of filter.DataContains on postgres
+const sagaPayloadIndex = "saga_payload_idx"
+
+// sagaIndexes back filters and sorting of GetByFilter, which is used by the status API
+var sagaIndexes = []struct {
+	name   string
+	column string
+}{
+	{"saga_name_idx", "name"},
+	{"saga_status_idx", "status"},
+	{"saga_updated_at_idx", "updated_at"},
+	{"saga_started_at_idx", "started_at"},
+	{"saga_parent_uid_idx", "parent_uid"},
+}
+
+// inlineIndexes returns index definitions for mysql create table statement, mysql doesn't support create index if not exists.
+// Tables created by previous versions don't get these indexes, add them manually.
+func (s sqlStore) inlineIndexes() string {
+	if s.driver == PGDriver {
+		return ""
+	}
+
+	var res strings.Builder
+
+	for _, idx := range sagaIndexes {
+		res.WriteString(fmt.Sprintf(",\n\t\tindex %s (%s)", idx.name, idx.column))
+	}
+
+	return res.String()
+}
+
+// tableColumn is a column added to a table after its first version
+type tableColumn struct {
+	name       string
+	definition string
+}
+
+// upgradeColumns are columns added to saga table after its first version
+var upgradeColumns = []tableColumn{
+	{"version", "integer not null default 0"},
+	{"fence", "bigint not null default 0"},
+}
+
+// upgradeQueries add columns missing in saga table created by previous versions and convert its payloads to jsonb on postgres
+func (s sqlStore) upgradeQueries(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	queries, err := addColumnsQueries(ctx, tx, s.driver, sagaTableName, upgradeColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.driver != PGDriver {
+		return queries, nil
+	}
+
+	jsonbQueries, err := s.jsonbUpgradeQueries(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(queries, jsonbQueries...), nil
+}
+
+// addColumnsQueries return queries adding columns missing in a table created by a previous version. Mysql doesn't support add column if not exists,
+// so columns are looked up in information_schema first.
+func addColumnsQueries(ctx context.Context, q queryer, driver SQLDriver, table string, columns []tableColumn) ([]string, error) {
+	var queries []string
+
+	if driver == PGDriver {
+		for _, column := range columns {
+			queries = append(queries, fmt.Sprintf("alter table %s add column if not exists %s %s;", table, column.name, column.definition))
+		}
+
+		return queries, nil
+	}
+
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = "'" + column.name + "'"
+	}
+
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in (%s);", strings.Join(names, ", ")), table)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up columns of %s table", table)
+	}
+
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, errors.Wrapf(err, "scanning columns of %s table", table)
+		}
+
+		existing[column] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "iterating columns of %s table", table)
+	}
+
+	for _, column := range columns {
+		if !existing[column.name] {
+			queries = append(queries, fmt.Sprintf("alter table %s add column %s %s;", table, column.name, column.definition))
+		}
+	}
+
+	return queries, nil
+}
+
+// jsonbUpgradeQueries convert payload columns of postgres tables created by previous versions to jsonb,
+// values stored as bytea are decoded as utf8 text first. Binary payloads of non json marshallers stay as they are.
+func (s sqlStore) jsonbUpgradeQueries(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	if s.payloadColumnType() != "jsonb" {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, s.prepQuery("select table_name, column_name, data_type from information_schema.columns where table_schema = current_schema() and ((table_name = ? and column_name in ('payload', 'last_failed_ev')) or (table_name = ? and column_name = 'payload')) and data_type <> 'jsonb' order by table_name, column_name;"), sagaTableName, sagaHistoryTableName)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up payload columns to convert to jsonb")
+	}
+
+	defer rows.Close()
+
+	var queries []string
+
+	for rows.Next() {
+		var table, column, dataType string
+		if err := rows.Scan(&table, &column, &dataType); err != nil {
+			return nil, errors.Wrap(err, "scanning payload columns to convert to jsonb")
+		}
+
+		value := column
+		if dataType == "bytea" {
+			value = fmt.Sprintf("convert_from(%s, 'UTF8')", column)
+		}
+
+		queries = append(queries, fmt.Sprintf("alter table %s alter column %s type jsonb using %s::jsonb;", table, column, value))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating payload columns to convert to jsonb")
+	}
+
+	return queries, nil
+}
+
+// tableExists looks the table up in information_schema of the current database
+func (s sqlStore) tableExists(ctx context.Context, tx *sql.Tx, table string) (bool, error) {
+	schema := "database()"
+	if s.driver == PGDriver {
+		schema = "current_schema()"
+	}
+
+	var tables int
+	if err := tx.QueryRowContext(ctx, s.prepQuery(fmt.Sprintf("select count(*) from information_schema.tables where table_schema = %s and table_name = ?;", schema)), table).Scan(&tables); err != nil {
+		return false, errors.Wrapf(err, "looking up %s table", table)
+	}
+
+	return tables > 0, nil
+}
+
+// fillCorrelations writes correlations of sagas in progress created before saga_correlation table existed.
+// Sagas are stored by the marshaller whose types may be not registered yet, so payloads are decoded as plain json,
+// binary payloads are skipped and such sagas are correlated after their next update.
+func (s sqlStore) fillCorrelations(ctx context.Context, tx *sql.Tx) error {
+	if message.ContentTypeOf(s.msgMarshaller) != message.JsonContentType {
+		return nil
+	}
+
+	rows, err := tx.QueryContext(ctx, s.prepQuery(fmt.Sprintf("SELECT uid, payload FROM %s WHERE status <> ?;", sagaTableName)), sagaStatusCompleted.String())
+	if err != nil {
+		return errors.Wrap(err, "querying sagas in progress for correlations")
+	}
+
+	correlations := make(map[string]map[string]string)
+
+	for rows.Next() {
+		var (
+			sagaId  string
+			payload []byte
+		)
+
+		if err := rows.Scan(&sagaId, &payload); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scanning sagas in progress for correlations")
+		}
+
+		fields, err := decodeJSONFields(payload)
+		if err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "decoding payload of saga %s", sagaId)
+		}
+
+		correlations[sagaId] = scalarValues(fields)
+	}
+
+	// the transaction has one connection, the rows must be read before inserts
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "iterating sagas in progress for correlations")
+	}
+
+	for sagaId, values := range correlations {
+		if err := s.insertCorrelations(ctx, tx, sagaId, values, sortedFields(values)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexQueries returns queries creating indexes on postgres. Unlike mysql, postgres doesn't index foreign keys, so saga_uid of history is indexed too.
+// jsonb payload gets gin index which backs containment lookups of filter.DataContains.
+func (s sqlStore) indexQueries() []string {
+	if s.driver != PGDriver {
+		return nil
+	}
+
+	queries := make([]string, 0, len(sagaIndexes)+4)
+
+	for _, idx := range sagaIndexes {
+		queries = append(queries, fmt.Sprintf("create index if not exists %s on %s (%s);", idx.name, sagaTableName, idx.column))
+	}
+
+	queries = append(queries,
+		fmt.Sprintf("create index if not exists saga_history_saga_uid_idx on %s (saga_uid);", sagaHistoryTableName),
+		fmt.Sprintf("create index if not exists %s on %s (kind, entity_id);", sagaEntityRefIndex, sagaEntityRefTableName),
+		fmt.Sprintf("create index if not exists %s on %s (field, value);", sagaCorrelationIndex, sagaCorrelationTable),
+	)
+
+	if s.payloadColumnType() == "jsonb" {
+		queries = append(queries, fmt.Sprintf("create index if not exists %s on %s using gin (payload jsonb_path_ops);", sagaPayloadIndex, sagaTableName))
+	}
+
+	return queries
+}
+
+// inlineEntityRefIndex returns an index of entity refs lookup for mysql create table statement
+func (s sqlStore) inlineEntityRefIndex() string {
+	if s.driver == PGDriver {
+		return ""
+	}
+
+	return fmt.Sprintf("\n\t\tindex %s (kind, entity_id),", sagaEntityRefIndex)
+}
+
+// inlineCorrelationIndex returns an index of correlation lookup for mysql create table statement
+func (s sqlStore) inlineCorrelationIndex() string {
+	if s.driver == PGDriver {
+		return ""
+	}
+
+	return fmt.Sprintf("\n\t\tindex %s (field, value),", sagaCorrelationIndex)
+}
+
+// payloadColumnType returns a column type for marshalled payloads. Postgres stores them as jsonb.
+// payloadColumnType is a binary type if the marshaller doesn't produce json, e.g. protobuf one
+func (s sqlStore) payloadColumnType() string {
+	binary := message.ContentTypeOf(s.msgMarshaller) != message.JsonContentType
+
+	if s.driver == PGDriver {
+		if binary {
+			return "bytea"
+		}
+
+		return "jsonb"
+	}
+
+	if binary {
+		return "longblob"
+	}
+
+	return "text"
+}
+
+// onConflictDoNothing returns a suffix for insert queries that makes repeated inserts of the same row a no-op on postgres.
+func (s sqlStore) onConflictDoNothing() string {
+	if s.driver == PGDriver {
+		return " ON CONFLICT (uid) DO NOTHING"
+	}
+
+	return ""
+}
+
+// placeholders returns n comma separated wildcard params
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
 // prepQuery replaces wildcard params to specific driver. Standard wildcard is '?'
 func (s *sqlStore) prepQuery(query string) string {
+	return prepDriverQuery(s.driver, query)
+}
+
+// prepDriverQuery replaces ? wildcards with numbered $n params for PGDriver
+func prepDriverQuery(driver SQLDriver, query string) string {
 	var res []byte
 
 	counter := 1
 
 	for i := 0; i < len(query); i++ {
-		if query[i] == '?' && s.driver == PGDriver {
+		if query[i] == '?' && driver == PGDriver {
 			res = append(append(res, '$'), []byte(strconv.Itoa(counter))...)
 			counter++
 
@@ -3,6 +3,8 @@ package saga
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"testing"
 	"time"
 
@@ -14,8 +16,10 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga/filter"
 	formanSql "github.com/go-foreman/foreman/saga/sql"
 	mockMessage "github.com/go-foreman/foreman/testing/mocks/pubsub/message"
+	"github.com/go-foreman/foreman/testing/protobuf/examplepb"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
 )
@@ -35,12 +39,19 @@ func TestSqlStore_InitTable(t *testing.T) {
 		wrapper := formanSql.NewDB(db)
 
 		mock.ExpectBegin()
-		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null );").
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
 			WithArgs().
 			WillReturnResult(sqlmock.NewResult(1, 1))
 		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
 			WithArgs().
 			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), index saga_entity_ref_entity_idx (kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectCorrelationTable(mock, MYSQLDriver, true)
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('version', 'fence');").
+			WithArgs("saga").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("version").AddRow("fence"))
 		mock.ExpectCommit().WillReturnError(errors.New("error commit"))
 
 		_, err = NewSQLSagaStore(wrapper, MYSQLDriver, msgMarshallerMock)
@@ -58,7 +69,7 @@ func TestSqlStore_InitTable(t *testing.T) {
 		wrapper := formanSql.NewDB(db)
 
 		mock.ExpectBegin()
-		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null );").
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
 			WithArgs().
 			WillReturnError(errors.New("error exec1"))
 		mock.ExpectRollback()
@@ -78,7 +89,7 @@ func TestSqlStore_InitTable(t *testing.T) {
 		wrapper := formanSql.NewDB(db)
 
 		mock.ExpectBegin()
-		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null );").
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
 			WithArgs().
 			WillReturnResult(sqlmock.NewResult(1, 1))
 		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
@@ -92,6 +103,204 @@ func TestSqlStore_InitTable(t *testing.T) {
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
+	t.Run("mysql saga table gets version and fence columns", func(t *testing.T) {
+		db, mock, err := sqlmock.New(
+			sqlmock.MonitorPingsOption(true),
+			sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
+		)
+		require.NoError(t, err)
+		wrapper := formanSql.NewDB(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), index saga_entity_ref_entity_idx (kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectCorrelationTable(mock, MYSQLDriver, true)
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('version', 'fence');").
+			WithArgs("saga").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}))
+		mock.ExpectExec("alter table saga add column version integer not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga add column fence bigint not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		_, err = NewSQLSagaStore(wrapper, MYSQLDriver, msgMarshallerMock)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("error looking up mysql columns", func(t *testing.T) {
+		db, mock, err := sqlmock.New(
+			sqlmock.MonitorPingsOption(true),
+			sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
+		)
+		require.NoError(t, err)
+		wrapper := formanSql.NewDB(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), index saga_entity_ref_entity_idx (kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectCorrelationTable(mock, MYSQLDriver, true)
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('version', 'fence');").
+			WithArgs("saga").
+			WillReturnError(errors.New("access denied"))
+		mock.ExpectRollback()
+
+		_, err = NewSQLSagaStore(wrapper, MYSQLDriver, msgMarshallerMock)
+		require.Error(t, err)
+		assert.EqualError(t, err, "initializing tables for SQLSagaStore, driver mysql: looking up columns of saga table: access denied")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("correlations of sagas in progress are filled in new table", func(t *testing.T) {
+		db, mock, err := sqlmock.New(
+			sqlmock.MonitorPingsOption(true),
+			sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
+		)
+		require.NoError(t, err)
+		wrapper := formanSql.NewDB(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null, version integer not null default 0, fence bigint not null default 0, index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid) );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), index saga_entity_ref_entity_idx (kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCorrelationTable(mock, MYSQLDriver, false)
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('version', 'fence');").
+			WithArgs("saga").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("version").AddRow("fence"))
+		mock.ExpectQuery("SELECT uid, payload FROM saga WHERE status <> ?;").
+			WithArgs("completed").
+			WillReturnRows(sqlmock.NewRows([]string{"uid", "payload"}).AddRow("1", []byte(`{"kind":"SagaExample","group":"example","Data":"order-1","timeouts":{"payment":"t-1"}}`)))
+		for _, correlation := range [][2]string{{"Data", "order-1"}, {"group", "example"}, {"kind", "SagaExample"}} {
+			mock.ExpectExec("INSERT INTO saga_correlation (saga_uid, field, value) VALUES (?, ?, ?);").
+				WithArgs("1", correlation[0], correlation[1]).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		_, err = NewSQLSagaStore(wrapper, MYSQLDriver, message.NewJsonMarshaller(scheme.NewKnownTypesRegistry()))
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("error creating pg index", func(t *testing.T) {
+		db, mock, err := sqlmock.New(
+			sqlmock.MonitorPingsOption(true),
+			sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
+		)
+		require.NoError(t, err)
+		wrapper := formanSql.NewDB(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload jsonb null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev jsonb null, version integer not null default 0, fence bigint not null default 0 );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload jsonb null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectCorrelationTable(mock, PGDriver, true)
+		expectPayloadColumnsLookup(mock, sqlmock.NewRows([]string{"table_name", "column_name", "data_type"}))
+		mock.ExpectExec("alter table saga add column if not exists version integer not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga add column if not exists fence bigint not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create index if not exists saga_name_idx on saga (name);").
+			WithArgs().
+			WillReturnError(errors.New("error index"))
+		mock.ExpectRollback()
+
+		_, err = NewSQLStoreFactory(wrapper, PGDriver)(msgMarshallerMock)
+		require.Error(t, err)
+		assert.EqualError(t, err, "initializing tables for SQLSagaStore, driver pg: creating index: create index if not exists saga_name_idx on saga (name);: error index")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("pg payload columns of previous versions are converted to jsonb", func(t *testing.T) {
+		db, mock, err := sqlmock.New(
+			sqlmock.MonitorPingsOption(true),
+			sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
+		)
+		require.NoError(t, err)
+		wrapper := formanSql.NewDB(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload jsonb null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev jsonb null, version integer not null default 0, fence bigint not null default 0 );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload jsonb null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id), constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectCorrelationTable(mock, PGDriver, true)
+		expectPayloadColumnsLookup(mock, sqlmock.NewRows([]string{"table_name", "column_name", "data_type"}).
+			AddRow("saga", "last_failed_ev", "bytea").
+			AddRow("saga", "payload", "text").
+			AddRow("saga_history", "payload", "text"),
+		)
+		mock.ExpectExec("alter table saga add column if not exists version integer not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga add column if not exists fence bigint not null default 0;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga alter column last_failed_ev type jsonb using convert_from(last_failed_ev, 'UTF8')::jsonb;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga alter column payload type jsonb using payload::jsonb;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table saga_history alter column payload type jsonb using payload::jsonb;").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		for _, q := range []string{
+			"create index if not exists saga_name_idx on saga (name);",
+			"create index if not exists saga_status_idx on saga (status);",
+			"create index if not exists saga_updated_at_idx on saga (updated_at);",
+			"create index if not exists saga_started_at_idx on saga (started_at);",
+			"create index if not exists saga_parent_uid_idx on saga (parent_uid);",
+			"create index if not exists saga_history_saga_uid_idx on saga_history (saga_uid);",
+			"create index if not exists saga_entity_ref_entity_idx on saga_entity_ref (kind, entity_id);",
+			"create index if not exists saga_correlation_value_idx on saga_correlation (field, value);",
+			"create index if not exists saga_payload_idx on saga using gin (payload jsonb_path_ops);",
+		} {
+			mock.ExpectExec(q).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectCommit()
+
+		_, err = NewSQLStoreFactory(wrapper, PGDriver)(msgMarshallerMock)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
 }
 
 func TestSqlStore_Create(t *testing.T) {
@@ -124,6 +333,9 @@ func TestSqlStore_Create(t *testing.T) {
 				sagaInstance.StartedAt(),
 				sagaInstance.UpdatedAt(),
 			).WillReturnResult(sqlmock.NewResult(1, 1))
+		dbMock.ExpectExec("INSERT INTO saga_correlation (saga_uid, field, value) VALUES (?, ?, ?);").
+			WithArgs(sagaInstance.UID(), "Data", "data").
+			WillReturnResult(sqlmock.NewResult(1, 1))
 		dbMock.ExpectCommit()
 
 		err := store.Create(ctx, sagaInstance)
@@ -153,6 +365,9 @@ func TestSqlStore_Create(t *testing.T) {
 				sagaInstance.StartedAt(),
 				sagaInstance.UpdatedAt(),
 			).WillReturnResult(sqlmock.NewResult(1, 1))
+		dbMock.ExpectExec("INSERT INTO saga_correlation (saga_uid, field, value) VALUES ($1, $2, $3);").
+			WithArgs(sagaInstance.UID(), "Data", "data").
+			WillReturnResult(sqlmock.NewResult(1, 1))
 		dbMock.ExpectCommit()
 
 		err := store.Create(ctx, sagaInstance)
@@ -171,7 +386,7 @@ func TestSqlStore_Create(t *testing.T) {
 
 		err := store.Create(ctx, sagaInstance)
 		assert.Error(t, err)
-		assert.EqualError(t, err, "error marshaling")
+		assert.EqualError(t, err, "marshaling saga instance 123 on create: error marshaling")
 	})
 
 	t.Run("error exec and rollback", func(t *testing.T) {
@@ -287,6 +502,8 @@ func TestSqlStore_Update(t *testing.T) {
 		})
 
 		sagaInstance.Fail(&ExampleEv{Data: "failed"})
+		require.NoError(t, sagaInstance.AddEntityRef(EntityRef{Kind: "order", ID: "1"}))
+		require.NoError(t, sagaInstance.AddEntityRef(EntityRef{Kind: "order", ID: "2"}))
 
 		payload := []byte("payload")
 
@@ -309,7 +526,7 @@ func TestSqlStore_Update(t *testing.T) {
 			Return(payload, nil)
 
 		dbMock.ExpectBegin()
-		dbMock.ExpectExec("UPDATE saga SET parent_uid=?, name=?, payload=?, status=?, started_at=?, updated_at=?, last_failed_ev=? WHERE uid=?;").
+		dbMock.ExpectExec("UPDATE saga SET parent_uid=?, name=?, payload=?, status=?, started_at=?, updated_at=?, last_failed_ev=?, version=? WHERE uid=? AND version=?;").
 			WithArgs(
 				sagaInstance.ParentID(),
 				"example.SagaExample",
@@ -318,7 +535,9 @@ func TestSqlStore_Update(t *testing.T) {
 				sagaInstance.StartedAt(),
 				sagaInstance.UpdatedAt(),
 				payload,
+				1,
 				sagaInstance.UID(),
+				0,
 			).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 		dbMock.ExpectQuery("SELECT uid FROM saga_history WHERE saga_uid=?;").
@@ -338,6 +557,23 @@ func TestSqlStore_Update(t *testing.T) {
 			).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs(sagaInstance.UID()).
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}).AddRow(sagaInstance.UID(), "order", "1"))
+		dbMock.ExpectExec("INSERT INTO saga_entity_ref (saga_uid, kind, entity_id) VALUES (?, ?, ?);").
+			WithArgs(sagaInstance.UID(), "order", "2").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		dbMock.ExpectQuery("SELECT field, value FROM saga_correlation WHERE saga_uid=?;").
+			WithArgs(sagaInstance.UID()).
+			WillReturnRows(sqlmock.NewRows([]string{"field", "value"}).AddRow("Data", "old data").AddRow("kind", "SagaExample"))
+		dbMock.ExpectExec("UPDATE saga_correlation SET value=? WHERE saga_uid=? AND field=?;").
+			WithArgs("data", sagaInstance.UID(), "Data").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectExec("INSERT INTO saga_correlation (saga_uid, field, value) VALUES (?, ?, ?);").
+			WithArgs(sagaInstance.UID(), "group", "example").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
 		dbMock.ExpectCommit()
 
 		assert.NoError(t, store.Update(ctx, sagaInstance))
@@ -393,8 +629,11 @@ func TestSqlStore_Update(t *testing.T) {
 			Return(payload, nil)
 
 		dbMock.ExpectBegin()
-		dbMock.ExpectExec("UPDATE saga SET parent_uid=$1, name=$2, payload=$3, status=$4, started_at=$5, updated_at=$6, last_failed_ev=$7 WHERE uid=$8;").
+		sagaInstance.SetVersion(4)
+
+		dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version WHERE saga.version=$10 RETURNING version, xmax = 0;").
 			WithArgs(
+				sagaInstance.UID(),
 				sagaInstance.ParentID(),
 				"example.SagaExample",
 				payload,
@@ -402,14 +641,15 @@ func TestSqlStore_Update(t *testing.T) {
 				sagaInstance.StartedAt(),
 				sagaInstance.UpdatedAt(),
 				payload,
-				sagaInstance.UID(),
+				5,
+				4,
 			).
-			WillReturnResult(sqlmock.NewResult(1, 1))
+			WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}).AddRow(5, false))
 		dbMock.ExpectQuery("SELECT uid FROM saga_history WHERE saga_uid=$1;").
 			WithArgs(sagaInstance.UID()).
 			WillReturnRows(sqlmock.NewRows([]string{"uid"}).AddRow(sagaInstance.HistoryEvents()[1].UID))
 
-		dbMock.ExpectExec("INSERT INTO saga_history (uid, saga_uid, name, status, payload, origin, created_at, trace_uid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);").
+		dbMock.ExpectExec("INSERT INTO saga_history (uid, saga_uid, name, status, payload, origin, created_at, trace_uid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (uid) DO NOTHING;").
 			WithArgs(
 				ev.UID,
 				sagaInstance.UID(),
@@ -422,12 +662,207 @@ func TestSqlStore_Update(t *testing.T) {
 			).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 
+		dbMock.ExpectQuery("SELECT field, value FROM saga_correlation WHERE saga_uid=$1;").
+			WithArgs(sagaInstance.UID()).
+			WillReturnRows(sqlmock.NewRows([]string{"field", "value"}).AddRow("Data", "data").AddRow("group", "example").AddRow("kind", "SagaExample").AddRow("order_id", "1"))
+		dbMock.ExpectExec("DELETE FROM saga_correlation WHERE saga_uid=$1 AND field=$2;").
+			WithArgs(sagaInstance.UID(), "order_id").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
 		dbMock.ExpectCommit()
 
 		assert.NoError(t, store.Update(ctx, sagaInstance))
+		assert.Equal(t, 5, sagaInstance.Version())
 
 		assert.NoError(t, dbMock.ExpectationsWereMet())
 	})
+
+	t.Run("version conflict", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, PGDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.SetVersion(2)
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil)
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version WHERE saga.version=$10 RETURNING version, xmax = 0;").
+			WithArgs(sagaID, sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3, 2).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}))
+		dbMock.ExpectRollback()
+
+		err := store.Update(ctx, sagaInstance)
+		assert.IsType(t, VersionConflictErr{}, err)
+		assert.EqualError(t, err, "saga 123 isn't at version 2 anymore, it was updated or deleted concurrently")
+		assert.Equal(t, 2, sagaInstance.Version())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("update if version", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, PGDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.SetVersion(2)
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil)
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version WHERE saga.version=$10 RETURNING version, xmax = 0;").
+			WithArgs(sagaID, sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 8, 7).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}))
+		dbMock.ExpectRollback()
+
+		err := store.UpdateIfVersion(ctx, sagaInstance, 7)
+		assert.IsType(t, VersionConflictErr{}, err)
+		assert.EqualError(t, err, "saga 123 isn't at version 7 anymore, it was updated or deleted concurrently")
+		assert.Equal(t, 2, sagaInstance.Version())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("pg saga deleted concurrently isn't inserted again", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, PGDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.SetVersion(2)
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil)
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version WHERE saga.version=$10 RETURNING version, xmax = 0;").
+			WithArgs(sagaID, sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3, 2).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}).AddRow(3, true))
+		dbMock.ExpectRollback()
+
+		err := store.Update(ctx, sagaInstance)
+		assert.IsType(t, VersionConflictErr{}, err)
+		assert.EqualError(t, err, "saga 123 isn't at version 2 anymore, it was updated or deleted concurrently")
+		assert.Equal(t, 2, sagaInstance.Version())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("fenced update", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, PGDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.SetVersion(2)
+		fencedCtx := WithFencingToken(ctx, 7)
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil)
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version, fence) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version, fence=EXCLUDED.fence WHERE saga.version=$11 AND saga.fence<=$12 RETURNING version, xmax = 0;").
+			WithArgs(sagaID, sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3, int64(7), 2, int64(7)).
+			WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}).AddRow(3, false))
+		dbMock.ExpectQuery("SELECT uid FROM saga_history WHERE saga_uid=$1;").
+			WithArgs(sagaID).
+			WillReturnRows(sqlmock.NewRows([]string{"uid"}))
+		dbMock.ExpectQuery("SELECT field, value FROM saga_correlation WHERE saga_uid=$1;").
+			WithArgs(sagaID).
+			WillReturnRows(sqlmock.NewRows([]string{"field", "value"}).AddRow("Data", "data"))
+		dbMock.ExpectCommit()
+
+		require.NoError(t, store.Update(fencedCtx, sagaInstance))
+		assert.Equal(t, 3, sagaInstance.Version())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("update with stale fencing token is rejected", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, MYSQLDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.SetVersion(2)
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil).Times(2)
+
+		expectRejected := func(fence int64) {
+			dbMock.ExpectBegin()
+			dbMock.ExpectExec("UPDATE saga SET parent_uid=?, name=?, payload=?, status=?, started_at=?, updated_at=?, last_failed_ev=?, version=?, fence=? WHERE uid=? AND version=? AND fence<=?;").
+				WithArgs(sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3, int64(7), sagaID, 2, int64(7)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			dbMock.ExpectQuery("SELECT fence FROM saga WHERE uid=?;").
+				WithArgs(sagaID).
+				WillReturnRows(sqlmock.NewRows([]string{"fence"}).AddRow(fence))
+			dbMock.ExpectRollback()
+		}
+
+		expectRejected(8)
+		err := store.Update(WithFencingToken(ctx, 7), sagaInstance)
+		assert.IsType(t, StaleFencingTokenErr{}, err)
+		assert.EqualError(t, err, "saga 123 was saved under fencing token 8, the lock with token 7 has expired")
+
+		expectRejected(7)
+		err = store.Update(WithFencingToken(ctx, 7), sagaInstance)
+		assert.IsType(t, VersionConflictErr{}, err, "the token is current, the version is not")
+		assert.Equal(t, 2, sagaInstance.Version())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("correlations of completed saga are deleted", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, MYSQLDriver)
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		sagaInstance.Complete()
+
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil)
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectExec("UPDATE saga SET parent_uid=?, name=?, payload=?, status=?, started_at=?, updated_at=?, last_failed_ev=?, version=? WHERE uid=? AND version=?;").
+			WithArgs(sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "completed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 1, sagaID, 0).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectQuery("SELECT uid FROM saga_history WHERE saga_uid=?;").
+			WithArgs(sagaID).
+			WillReturnRows(sqlmock.NewRows([]string{"uid"}))
+		dbMock.ExpectExec("DELETE FROM saga_correlation WHERE saga_uid=?;").
+			WithArgs(sagaID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+
+		require.NoError(t, store.Update(ctx, sagaInstance))
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("writes of transaction", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, PGDriver)
+		transactionalStore, ok := store.(TransactionalStore)
+		require.True(t, ok)
+
+		sagaInstance := NewSagaInstance(sagaID, parentSagaID, &SagaExample{Data: "data"})
+		marshallerMock.EXPECT().Marshal(sagaInstance.Saga()).Return([]byte("payload"), nil).Times(2)
+
+		expectUpdate := func() {
+			dbMock.ExpectBegin()
+			dbMock.ExpectQuery("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at, last_failed_ev, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (uid) DO UPDATE SET parent_uid=EXCLUDED.parent_uid, name=EXCLUDED.name, payload=EXCLUDED.payload, status=EXCLUDED.status, started_at=EXCLUDED.started_at, updated_at=EXCLUDED.updated_at, last_failed_ev=EXCLUDED.last_failed_ev, version=EXCLUDED.version WHERE saga.version=$10 RETURNING version, xmax = 0;").
+				WithArgs(sagaID, sagaInstance.ParentID(), sqlmock.AnyArg(), []byte("payload"), "created", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 1, 0).
+				WillReturnRows(sqlmock.NewRows([]string{"version", "inserted"}).AddRow(1, false))
+			dbMock.ExpectQuery("SELECT uid FROM saga_history WHERE saga_uid=$1;").
+				WithArgs(sagaID).
+				WillReturnRows(sqlmock.NewRows([]string{"uid"}))
+			dbMock.ExpectQuery("SELECT field, value FROM saga_correlation WHERE saga_uid=$1;").
+				WithArgs(sagaID).
+				WillReturnRows(sqlmock.NewRows([]string{"field", "value"}).AddRow("Data", "data"))
+			dbMock.ExpectExec("INSERT INTO saga_outbox (saga_uid) VALUES ($1);").
+				WithArgs(sagaID).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+
+		inTx := func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO saga_outbox (saga_uid) VALUES ($1);", sagaID)
+			return err
+		}
+
+		expectUpdate()
+		dbMock.ExpectCommit()
+		require.NoError(t, transactionalStore.UpdateTx(ctx, sagaInstance, inTx))
+		assert.Equal(t, 1, sagaInstance.Version())
+
+		sagaInstance.SetVersion(0)
+		expectUpdate()
+		dbMock.ExpectRollback()
+
+		err := transactionalStore.UpdateTx(ctx, sagaInstance, func(ctx context.Context, tx *sql.Tx) error {
+			if err := inTx(ctx, tx); err != nil {
+				return err
+			}
+			return errors.New("outbox is full")
+		})
+		assert.EqualError(t, err, "outbox is full")
+		assert.Equal(t, 0, sagaInstance.Version(), "saga isn't saved")
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
 }
 
 func TestSqlStore_Delete(t *testing.T) {
@@ -477,6 +912,144 @@ func TestSqlStore_Delete(t *testing.T) {
 	})
 }
 
+func TestSqlStore_DeleteByFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	updatedBefore := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("mysql delete completed sagas", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectExec("DELETE FROM saga WHERE status = ? AND name = ? AND updated_at < ?;").
+			WithArgs("completed", "example.SagaExample", updatedBefore).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+
+		deleted, err := store.DeleteByFilter(ctx, WithStatus("completed"), WithSagaName("example.SagaExample"), WithUpdatedBefore(updatedBefore), WithOffsetAndLimit(0, 10))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, deleted)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("pg delete completed sagas", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectExec("DELETE FROM saga WHERE status = $1 AND updated_at < $2;").
+			WithArgs("completed", updatedBefore).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		deleted, err := store.DeleteByFilter(ctx, WithStatus("completed"), WithUpdatedBefore(updatedBefore))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, deleted)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("no filters", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		_, err := store.DeleteByFilter(ctx, WithOffsetAndLimit(0, 10))
+		assert.EqualError(t, err, "all specified filters are empty, you have to specify at least one so whole store won't be deleted")
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("exec returns an error", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectExec("DELETE FROM saga WHERE status = $1;").
+			WithArgs("completed").
+			WillReturnError(errors.New("exec error"))
+
+		_, err := store.DeleteByFilter(ctx, WithStatus("completed"))
+		assert.EqualError(t, err, "executing delete query: exec error")
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
+
+func TestSqlStore_DeleteOlderThan(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	cutoff := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("pg delete each saga in a transaction", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectQuery("SELECT uid FROM saga WHERE status = $1 AND updated_at < $2 ORDER BY updated_at LIMIT 2;").
+			WithArgs("completed", cutoff).
+			WillReturnRows(sqlmock.NewRows([]string{"uid"}).AddRow("1").AddRow("2"))
+
+		dbMock.ExpectBegin()
+		dbMock.ExpectExec("DELETE FROM saga_history WHERE saga_uid=$1;").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 3))
+		dbMock.ExpectExec("DELETE FROM saga_entity_ref WHERE saga_uid=$1;").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 0))
+		dbMock.ExpectExec("DELETE FROM saga WHERE uid=$1 AND status = $2 AND updated_at < $3;").WithArgs("1", "completed", cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+
+		// the saga was updated since it was selected, its history is restored by rollback
+		dbMock.ExpectBegin()
+		dbMock.ExpectExec("DELETE FROM saga_history WHERE saga_uid=$1;").WithArgs("2").WillReturnResult(sqlmock.NewResult(0, 3))
+		dbMock.ExpectExec("DELETE FROM saga_entity_ref WHERE saga_uid=$1;").WithArgs("2").WillReturnResult(sqlmock.NewResult(0, 0))
+		dbMock.ExpectExec("DELETE FROM saga WHERE uid=$1 AND status = $2 AND updated_at < $3;").WithArgs("2", "completed", cutoff).WillReturnResult(sqlmock.NewResult(0, 0))
+		dbMock.ExpectRollback()
+
+		// the kept saga doesn't count, so the rest of the limit is selected again
+		dbMock.ExpectQuery("SELECT uid FROM saga WHERE status = $1 AND updated_at < $2 ORDER BY updated_at LIMIT 1;").
+			WithArgs("completed", cutoff).
+			WillReturnRows(sqlmock.NewRows([]string{"uid"}))
+
+		deleted, err := store.DeleteOlderThan(ctx, cutoff, WithDeleteLimit(2))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql saga is kept if archiving fails", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectQuery(fmt.Sprintf("SELECT uid FROM saga WHERE status = ? AND updated_at < ? ORDER BY updated_at LIMIT %d;", DefaultDeleteBatchSize)).
+			WithArgs("completed", cutoff).
+			WillReturnRows(sqlmock.NewRows([]string{"uid"}).AddRow("1"))
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s WHERE uid=?;").
+			WithArgs("1").
+			WillReturnRows(
+				sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at", "version"}).
+					AddRow("1", "", "example.SagaExample", []byte("payload"), "completed", nil, cutoff, cutoff, 2),
+			)
+		dbMock.ExpectQuery("SELECT uid, name, status, payload, origin, created_at, trace_uid FROM saga_history WHERE saga_uid=? ORDER BY created_at;").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"uid", "name", "status", "payload", "origin", "created_at", "trace_uid"}))
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+		marshallerMock.EXPECT().Unmarshal([]byte("payload")).Return(&SagaExample{Data: "data"}, nil)
+
+		var archived Instance
+
+		deleted, err := store.DeleteOlderThan(ctx, cutoff, WithArchiver(func(ctx context.Context, sagaInstance Instance) error {
+			archived = sagaInstance
+			return errors.New("bucket is unavailable")
+		}))
+		assert.EqualError(t, err, "archiving saga 1: bucket is unavailable")
+		assert.Equal(t, 0, deleted)
+		require.NotNil(t, archived)
+		assert.Equal(t, &SagaExample{Data: "data"}, archived.Saga())
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("query returns an error", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectQuery(fmt.Sprintf("SELECT uid FROM saga WHERE status = $1 AND updated_at < $2 ORDER BY updated_at LIMIT %d;", DefaultDeleteBatchSize)).
+			WithArgs("completed", cutoff).
+			WillReturnError(errors.New("query error"))
+
+		_, err := store.DeleteOlderThan(ctx, cutoff)
+		assert.EqualError(t, err, "querying completed sagas: query error")
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
+
 func TestSqlStore_GetById(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -519,10 +1092,10 @@ func TestSqlStore_GetById(t *testing.T) {
 			},
 		}
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s WHERE uid=?;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s WHERE uid=?;").
 			WithArgs(sagaID).
 			WillReturnRows(
-				sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at"}).
+				sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at", "version"}).
 					AddRow(
 						sagaData.ID.String,
 						sagaData.ParentID.String,
@@ -532,6 +1105,7 @@ func TestSqlStore_GetById(t *testing.T) {
 						sagaData.LastFailedMsg,
 						sagaData.StartedAt.Time,
 						sagaData.UpdatedAt.Time,
+						3,
 					),
 			)
 
@@ -570,6 +1144,13 @@ func TestSqlStore_GetById(t *testing.T) {
 					AddRow(evData.ID.String, evData.Name.String, evData.SagaStatus.String, evData.Payload, evData.OriginSource.String, evData.CreatedAt.Time, evData.TraceUID.String),
 			)
 
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs(sagaID).
+			WillReturnRows(
+				sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}).
+					AddRow(sagaID, "order", "12345"),
+			)
+
 		marshallerMock.
 			EXPECT().
 			Unmarshal(sagaData.LastFailedMsg).
@@ -600,6 +1181,8 @@ func TestSqlStore_GetById(t *testing.T) {
 		assert.Equal(t, evData.OriginSource.String, ev.OriginSource)
 		assert.Equal(t, evData.CreatedAt.Time, ev.CreatedAt)
 		assert.Equal(t, &DataContract{Message: "h1"}, ev.Payload)
+		assert.Equal(t, []EntityRef{{Kind: "order", ID: "12345"}}, sagaInstance.EntityRefs())
+		assert.Equal(t, 3, sagaInstance.Version())
 
 		assert.NoError(t, dbMock.ExpectationsWereMet())
 	})
@@ -607,10 +1190,10 @@ func TestSqlStore_GetById(t *testing.T) {
 	t.Run("PG: no saga found", func(t *testing.T) {
 		store, dbMock, _ := createStore(t, ctrl, PGDriver)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s WHERE uid=$1;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s WHERE uid=$1;").
 			WithArgs(sagaID).
 			WillReturnRows(
-				sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at"}),
+				sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at", "version"}),
 			)
 
 		sagaInstance, err := store.GetById(ctx, sagaID)
@@ -718,11 +1301,11 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					AddRow(1),
 			)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s  WHERE s.uid = ? AND s.status = ? AND s.name = ? ORDER BY started_at DESC;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE s.uid = ? AND s.status = ? AND s.name = ? ORDER BY started_at DESC, uid DESC;").
 			WithArgs("sagaId", "created", "sagaName").
 			WillReturnRows(
 				sqlmock.NewRows([]string{
-					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at",
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
 				}).AddRow(
 					sagaData.ID.String,
 					sagaData.ParentID.String,
@@ -732,6 +1315,7 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					sagaData.LastFailedMsg,
 					sagaData.StartedAt.Time,
 					sagaData.UpdatedAt.Time,
+					3,
 				),
 			)
 
@@ -761,6 +1345,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 				),
 			)
 
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs("sagaId").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+
 		marshallerMock.
 			EXPECT().
 			Unmarshal(sagaData.LastFailedMsg).
@@ -864,10 +1452,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					AddRow(1),
 			)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s ORDER BY started_at DESC LIMIT 2 OFFSET 1;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s ORDER BY started_at DESC, uid DESC LIMIT 2 OFFSET 1;").
 			WillReturnRows(
 				sqlmock.NewRows([]string{
-					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at",
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
 				}).AddRow(
 					sagaData.ID.String,
 					sagaData.ParentID.String,
@@ -877,6 +1465,7 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					sagaData.LastFailedMsg,
 					sagaData.StartedAt.Time,
 					sagaData.UpdatedAt.Time,
+					3,
 				),
 			)
 
@@ -906,6 +1495,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 				),
 			)
 
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs("sagaId").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+
 		marshallerMock.
 			EXPECT().
 			Unmarshal(sagaData.LastFailedMsg).
@@ -939,6 +1532,251 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 		assert.Len(t, sagas.Items[0].HistoryEvents(), 2)
 	})
 
+	t.Run("sorted page keeps the order of rows", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, MYSQLDriver)
+
+		timeNow := time.Now()
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s WHERE s.status = ?;").
+			WithArgs("failed").
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(10),
+			)
+
+		rows := sqlmock.NewRows([]string{
+			"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+		})
+
+		sagaIDs := []string{"c", "a", "d", "b"}
+		for _, id := range sagaIDs {
+			rows.AddRow(id, "", "example.SagaExample", []byte("payload-"+id), "failed", nil, timeNow, timeNow, 1)
+			marshallerMock.
+				EXPECT().
+				Unmarshal([]byte("payload-"+id)).
+				Return(&SagaExample{Data: id}, nil)
+		}
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE s.status = ? ORDER BY updated_at ASC, uid ASC LIMIT 4 OFFSET 4;").
+			WithArgs("failed").
+			WillReturnRows(rows)
+
+		dbMock.ExpectQuery(`SELECT sh.uid, sh.saga_uid, sh.name, sh.status, sh.payload, sh.origin, sh.created_at, sh.trace_uid FROM saga_history sh WHERE sh.saga_uid IN (?, ?, ?, ?);`).
+			WithArgs("c", "a", "d", "b").
+			WillReturnRows(
+				sqlmock.NewRows([]string{
+					"sh.uid", "sh.saga_uid,", "sh.name", "sh.status", "sh.payload", "sh.origin", "sh.created_at", "sh.trace_uid",
+				}),
+			)
+
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?, ?, ?, ?);").
+			WithArgs("c", "a", "d", "b").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+
+		sagas, err := store.GetByFilter(ctx, WithStatus("failed"), WithOffsetAndLimit(4, 4), WithSorting(SortByUpdatedAt, SortAsc))
+		require.NoError(t, err)
+		assert.Equal(t, 10, sagas.Total)
+		require.Len(t, sagas.Items, 4)
+
+		for i, id := range sagaIDs {
+			assert.Equal(t, id, sagas.Items[i].UID())
+		}
+	})
+
+	t.Run("filter by parent and started time range", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
+
+		from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := from.Add(time.Hour * 24)
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s WHERE s.parent_uid = ? AND s.started_at >= ? AND s.started_at < ?;").
+			WithArgs("parent", from, to).
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(0),
+			)
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE s.parent_uid = ? AND s.started_at >= ? AND s.started_at < ? ORDER BY started_at DESC, uid DESC LIMIT 10 OFFSET 0;").
+			WithArgs("parent", from, to).
+			WillReturnRows(sqlmock.NewRows([]string{
+				"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+			}))
+
+		sagas, err := store.GetByFilter(ctx, WithParentId("parent"), WithStartedBetween(from, to), WithOffsetAndLimit(0, 10))
+		require.NoError(t, err)
+		assert.Equal(t, 0, sagas.Total)
+		assert.Empty(t, sagas.Items)
+	})
+
+	t.Run("filter by entity ref", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s WHERE s.uid IN (SELECT r.saga_uid FROM saga_entity_ref r WHERE r.kind = $1 AND r.entity_id = $2);").
+			WithArgs("order", "12345").
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(0),
+			)
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE s.uid IN (SELECT r.saga_uid FROM saga_entity_ref r WHERE r.kind = $1 AND r.entity_id = $2) ORDER BY started_at DESC, uid DESC;").
+			WithArgs("order", "12345").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+			}))
+
+		sagas, err := store.GetByFilter(ctx, WithEntityRef(EntityRef{Kind: "order", ID: "12345"}))
+		require.NoError(t, err)
+		assert.Empty(t, sagas.Items)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("composed filter", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		where := "WHERE (s.status IN ($1, $2) OR s.updated_at < $3) AND NOT COALESCE(s.name = $4, FALSE) AND s.uid IN ($5, $6)"
+		args := []driver.Value{"failed", "compensating", from, "orders.RefundSaga", "1", "2"}
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s " + where + ";").
+			WithArgs(args...).
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(0),
+			)
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  " + where + " ORDER BY started_at DESC, uid DESC;").
+			WithArgs(args...).
+			WillReturnRows(sqlmock.NewRows([]string{
+				"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+			}))
+
+		sagas, err := store.GetByFilter(ctx, WithFilter(
+			filter.Or(filter.StatusIn("failed", "compensating"), filter.UpdatedBefore(from)),
+			filter.Not(filter.Name("orders.RefundSaga")),
+			filter.SagaID("1", "2"),
+		))
+		require.NoError(t, err)
+		assert.Empty(t, sagas.Items)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("filter by text in data", func(t *testing.T) {
+		for driver, where := range map[SQLDriver]string{
+			MYSQLDriver: "WHERE LOWER(s.payload) LIKE ?",
+			PGDriver:    "WHERE LOWER(s.payload::text) LIKE $1",
+		} {
+			store, dbMock, _ := createStore(t, ctrl, driver)
+
+			dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s " + where + ";").
+				WithArgs(`%john\_doe\%%`).
+				WillReturnRows(
+					sqlmock.NewRows([]string{"cnt"}).
+						AddRow(0),
+				)
+
+			dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  " + where + " ORDER BY started_at DESC, uid DESC;").
+				WithArgs(`%john\_doe\%%`).
+				WillReturnRows(sqlmock.NewRows([]string{
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+				}))
+
+			sagas, err := store.GetByFilter(ctx, WithFilter(filter.DataContains("John_Doe%")))
+			require.NoError(t, err)
+			assert.Empty(t, sagas.Items)
+			assert.NoError(t, dbMock.ExpectationsWereMet())
+		}
+	})
+
+	t.Run("filter by json document in data", func(t *testing.T) {
+		for driver, where := range map[SQLDriver]string{
+			MYSQLDriver: "WHERE JSON_CONTAINS(s.payload, ?)",
+			PGDriver:    "WHERE s.payload @> $1::jsonb",
+		} {
+			store, dbMock, _ := createStore(t, ctrl, driver)
+
+			dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s " + where + ";").
+				WithArgs(`{"email": "john@example.com"}`).
+				WillReturnRows(
+					sqlmock.NewRows([]string{"cnt"}).
+						AddRow(0),
+				)
+
+			dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  " + where + " ORDER BY started_at DESC, uid DESC;").
+				WithArgs(`{"email": "john@example.com"}`).
+				WillReturnRows(sqlmock.NewRows([]string{
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+				}))
+
+			sagas, err := store.GetByFilter(ctx, WithFilter(filter.DataContains(`{"email": "john@example.com"}`)))
+			require.NoError(t, err)
+			assert.Empty(t, sagas.Items)
+			assert.NoError(t, dbMock.ExpectationsWereMet())
+		}
+	})
+
+	t.Run("binary payloads can't be searched", func(t *testing.T) {
+		for _, driver := range []SQLDriver{MYSQLDriver, PGDriver} {
+			store, dbMock := createStoreWithMarshaller(t, driver, message.NewProtobufMarshaller(scheme.NewKnownTypesRegistry()))
+
+			_, err := store.GetByFilter(ctx, WithFilter(filter.StatusIn("failed"), filter.DataContains("john")))
+			assert.IsType(t, filter.UnsupportedPredicateErr{}, errors.Cause(err))
+			assert.Contains(t, err.Error(), "filter predicate 'dataContains' isn't supported by sql store with binary payloads")
+			assert.NoError(t, dbMock.ExpectationsWereMet())
+		}
+	})
+
+	t.Run("empty or matches nothing", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s WHERE 1 = 0;").
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(0),
+			)
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE 1 = 0 ORDER BY started_at DESC, uid DESC;").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+			}))
+
+		sagas, err := store.GetByFilter(ctx, WithFilter(filter.Or()))
+		require.NoError(t, err)
+		assert.Empty(t, sagas.Items)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("filter by status excluding ids", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectQuery("SELECT COUNT(s.uid) cnt FROM saga s WHERE s.status = ? AND s.uid NOT IN (?, ?);").
+			WithArgs("failed", "1", "2").
+			WillReturnRows(
+				sqlmock.NewRows([]string{"cnt"}).
+					AddRow(0),
+			)
+
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s  WHERE s.status = ? AND s.uid NOT IN (?, ?) ORDER BY started_at DESC, uid DESC;").
+			WithArgs("failed", "1", "2").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
+			}))
+
+		sagas, err := store.GetByFilter(ctx, WithStatus("failed"), WithExcludedIds("1", "2"))
+		require.NoError(t, err)
+		assert.Empty(t, sagas.Items)
+		assert.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown sorting", func(t *testing.T) {
+		store, _, _ := createStore(t, ctrl, MYSQLDriver)
+
+		_, err := store.GetByFilter(ctx, WithOffsetAndLimit(0, 2), WithSorting("payload; DROP TABLE saga", SortAsc))
+		assert.EqualError(t, err, "unknown sort field 'payload; DROP TABLE saga'")
+
+		_, err = store.GetByFilter(ctx, WithOffsetAndLimit(0, 2), WithSorting(SortByStartedAt, "sideways"))
+		assert.EqualError(t, err, "unknown sort order 'sideways'")
+	})
+
 	t.Run("count query fails", func(t *testing.T) {
 		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
 
@@ -958,7 +1796,7 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					AddRow(1),
 			)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s ORDER BY started_at DESC LIMIT 2 OFFSET 1;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s ORDER BY started_at DESC, uid DESC LIMIT 2 OFFSET 1;").
 			WillReturnError(errors.New("fail"))
 
 		_, err := store.GetByFilter(ctx, WithOffsetAndLimit(1, 2))
@@ -1005,10 +1843,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					AddRow(1),
 			)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s ORDER BY started_at DESC LIMIT 2 OFFSET 1;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s ORDER BY started_at DESC, uid DESC LIMIT 2 OFFSET 1;").
 			WillReturnRows(
 				sqlmock.NewRows([]string{
-					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at",
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
 				}).AddRow(
 					sagaData.ID.String,
 					sagaData.ParentID.String,
@@ -1018,6 +1856,7 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					sagaData.LastFailedMsg,
 					sagaData.StartedAt.Time,
 					sagaData.UpdatedAt.Time,
+					3,
 				),
 			)
 
@@ -1068,10 +1907,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					AddRow(1),
 			)
 
-		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at FROM saga s ORDER BY started_at DESC LIMIT 2 OFFSET 1;").
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s ORDER BY started_at DESC, uid DESC LIMIT 2 OFFSET 1;").
 			WillReturnRows(
 				sqlmock.NewRows([]string{
-					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at",
+					"s.uid", "s.parent_uid", "s.name", "s.payload", "s.status", "s.last_failed_ev", "s.started_at", "s.updated_at", "s.version",
 				}).AddRow(
 					sagaData.ID.String,
 					sagaData.ParentID.String,
@@ -1081,6 +1920,7 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 					sagaData.LastFailedMsg,
 					sagaData.StartedAt.Time,
 					sagaData.UpdatedAt.Time,
+					3,
 				),
 			)
 
@@ -1092,6 +1932,10 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 				}),
 			)
 
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs("sagaId").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+
 		marshallerMock.
 			EXPECT().
 			Unmarshal(sagaData.LastFailedMsg).
@@ -1116,27 +1960,188 @@ func TestSqlStore_GetByFilter(t *testing.T) {
 	})
 }
 
+func TestSqlStore_GetByCorrelation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	t.Run("pg several sagas match", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectQuery("SELECT c.saga_uid FROM saga_correlation c INNER JOIN saga s ON s.uid = c.saga_uid WHERE c.field = $1 AND c.value = $2 AND s.name = $3 AND s.status <> $4;").
+			WithArgs("Data", "order-1", "example.SagaExample", "completed").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid"}).AddRow("1").AddRow("3"))
+
+		instance, err := store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-1")
+		assert.Nil(t, instance)
+		assert.IsType(t, AmbiguousCorrelationErr{}, err)
+		assert.EqualError(t, err, "2 sagas example.SagaExample in progress have Data 'order-1': [1 3]")
+		require.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql matched saga is loaded", func(t *testing.T) {
+		store, dbMock, marshallerMock := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectQuery("SELECT c.saga_uid FROM saga_correlation c INNER JOIN saga s ON s.uid = c.saga_uid WHERE c.field = ? AND c.value = ? AND s.name = ? AND s.status <> ?;").
+			WithArgs("Data", "order-1", "example.SagaExample", "completed").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid"}).AddRow("1"))
+		dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s WHERE uid=?;").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at", "version"}).
+				AddRow("1", nil, "example.SagaExample", []byte("first"), "in_progress", nil, nil, nil, 2))
+		dbMock.ExpectQuery("SELECT uid, name, status, payload, origin, created_at, trace_uid FROM saga_history WHERE saga_uid=? ORDER BY created_at;").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"uid", "name", "status", "payload", "origin", "created_at", "trace_uid"}))
+		dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN (?);").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+		marshallerMock.EXPECT().Unmarshal([]byte("first")).Return(&SagaExample{Data: "order-1"}, nil)
+
+		instance, err := store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-1")
+		require.NoError(t, err)
+		require.NotNil(t, instance)
+		assert.Equal(t, "1", instance.UID())
+		assert.Equal(t, 2, instance.Version())
+		require.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("mysql no saga matches", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, MYSQLDriver)
+
+		dbMock.ExpectQuery("SELECT c.saga_uid FROM saga_correlation c INNER JOIN saga s ON s.uid = c.saga_uid WHERE c.field = ? AND c.value = ? AND s.name = ? AND s.status <> ?;").
+			WithArgs("Data", "order-2", "example.SagaExample", "completed").
+			WillReturnRows(sqlmock.NewRows([]string{"saga_uid"}))
+
+		instance, err := store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-2")
+		require.NoError(t, err)
+		assert.Nil(t, instance)
+		require.NoError(t, dbMock.ExpectationsWereMet())
+	})
+
+	t.Run("query fails", func(t *testing.T) {
+		store, dbMock, _ := createStore(t, ctrl, PGDriver)
+
+		dbMock.ExpectQuery("SELECT c.saga_uid FROM saga_correlation c INNER JOIN saga s ON s.uid = c.saga_uid WHERE c.field = $1 AND c.value = $2 AND s.name = $3 AND s.status <> $4;").
+			WithArgs("Data", "order-1", "example.SagaExample", "completed").
+			WillReturnError(errors.New("connection lost"))
+
+		_, err := store.GetByCorrelation(ctx, "example.SagaExample", "Data", "order-1")
+		assert.EqualError(t, err, "querying correlated sagas: connection lost")
+		require.NoError(t, dbMock.ExpectationsWereMet())
+	})
+}
+
 func createStore(t *testing.T, ctrl *gomock.Controller, provider SQLDriver) (Store, sqlmock.Sqlmock, *mockMessage.MockMarshaller) {
+	msgMarshallerMock := mockMessage.NewMockMarshaller(ctrl)
+	s, mock := createStoreWithMarshaller(t, provider, msgMarshallerMock)
+
+	return s, mock, msgMarshallerMock
+}
+
+func createStoreWithMarshaller(t *testing.T, provider SQLDriver, msgMarshaller message.Marshaller) (Store, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New(
 		sqlmock.MonitorPingsOption(true),
 		sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual),
 	)
 	require.NoError(t, err)
 	wrapper := formanSql.NewDB(db)
-	msgMarshallerMock := mockMessage.NewMockMarshaller(ctrl)
+	binary := message.ContentTypeOf(msgMarshaller) != message.JsonContentType
+
+	payloadType := "text"
+	inlineIndexes := ", index saga_name_idx (name), index saga_status_idx (status), index saga_updated_at_idx (updated_at), index saga_started_at_idx (started_at), index saga_parent_uid_idx (parent_uid)"
+	entityRefIndex := " index saga_entity_ref_entity_idx (kind, entity_id),"
+	if binary {
+		payloadType = "longblob"
+	}
+	if provider == PGDriver {
+		payloadType = "jsonb"
+		if binary {
+			payloadType = "bytea"
+		}
+		inlineIndexes = ""
+		entityRefIndex = ""
+	}
 
 	mock.ExpectBegin()
-	mock.ExpectExec("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload text null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev text null );").
+	mock.ExpectExec(fmt.Sprintf("create table if not exists saga ( uid varchar(255) not null primary key, parent_uid varchar(255) null, name varchar(255) null, payload %[1]s null, status varchar(255) null, started_at timestamp null, updated_at timestamp null, last_failed_ev %[1]s null, version integer not null default 0, fence bigint not null default 0%[2]s );", payloadType, inlineIndexes)).
 		WithArgs().
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload text null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+	mock.ExpectExec(fmt.Sprintf("create table if not exists saga_history ( uid varchar(255) not null primary key, saga_uid varchar(255) not null, name varchar(255) null, status varchar(255) null, payload %s null, origin varchar(255) null, created_at timestamp null, trace_uid varchar(255) null, constraint saga_history_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );", payloadType)).
 		WithArgs().
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(fmt.Sprintf("create table if not exists saga_entity_ref ( saga_uid varchar(255) not null, kind varchar(255) not null, entity_id varchar(255) not null, primary key (saga_uid, kind, entity_id),%s constraint saga_entity_ref_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );", entityRefIndex)).
+		WithArgs().
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectCorrelationTable(mock, provider, true)
+	if provider == PGDriver {
+		if !binary {
+			expectPayloadColumnsLookup(mock, sqlmock.NewRows([]string{"table_name", "column_name", "data_type"}))
+		}
+		expectPGIndexes(mock, !binary)
+	} else {
+		mock.ExpectQuery("select column_name from information_schema.columns where table_schema = database() and table_name = ? and column_name in ('version', 'fence');").
+			WithArgs("saga").
+			WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("version").AddRow("fence"))
+	}
 	mock.ExpectCommit()
-	s, err := NewSQLSagaStore(wrapper, provider, msgMarshallerMock)
+	s, err := NewSQLSagaStore(wrapper, provider, msgMarshaller)
 	require.NoError(t, err)
 
-	return s, mock, msgMarshallerMock
+	return s, mock
+}
+
+func expectCorrelationTable(mock sqlmock.Sqlmock, provider SQLDriver, exists bool) {
+	tables := 0
+	if exists {
+		tables = 1
+	}
+
+	if provider == PGDriver {
+		mock.ExpectQuery("select count(*) from information_schema.tables where table_schema = current_schema() and table_name = $1;").
+			WithArgs("saga_correlation").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tables))
+		mock.ExpectExec("create table if not exists saga_correlation ( saga_uid varchar(255) not null, field varchar(255) not null, value varchar(255) not null, primary key (saga_uid, field), constraint saga_correlation_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+			WithArgs().
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		return
+	}
+
+	mock.ExpectQuery("select count(*) from information_schema.tables where table_schema = database() and table_name = ?;").
+		WithArgs("saga_correlation").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tables))
+	mock.ExpectExec("create table if not exists saga_correlation ( saga_uid varchar(255) not null, field varchar(255) not null, value varchar(255) not null, primary key (saga_uid, field), index saga_correlation_value_idx (field, value), constraint saga_correlation_saga_model_id_fk foreign key (saga_uid) references saga (uid) on update cascade on delete cascade );").
+		WithArgs().
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectPayloadColumnsLookup(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery("select table_name, column_name, data_type from information_schema.columns where table_schema = current_schema() and ((table_name = $1 and column_name in ('payload', 'last_failed_ev')) or (table_name = $2 and column_name = 'payload')) and data_type <> 'jsonb' order by table_name, column_name;").
+		WithArgs("saga", "saga_history").
+		WillReturnRows(rows)
+}
+
+func expectPGIndexes(mock sqlmock.Sqlmock, jsonPayload bool) {
+	queries := []string{
+		"alter table saga add column if not exists version integer not null default 0;",
+		"alter table saga add column if not exists fence bigint not null default 0;",
+		"create index if not exists saga_name_idx on saga (name);",
+		"create index if not exists saga_status_idx on saga (status);",
+		"create index if not exists saga_updated_at_idx on saga (updated_at);",
+		"create index if not exists saga_started_at_idx on saga (started_at);",
+		"create index if not exists saga_parent_uid_idx on saga (parent_uid);",
+		"create index if not exists saga_history_saga_uid_idx on saga_history (saga_uid);",
+		"create index if not exists saga_entity_ref_entity_idx on saga_entity_ref (kind, entity_id);",
+		"create index if not exists saga_correlation_value_idx on saga_correlation (field, value);",
+	}
+
+	if jsonPayload {
+		queries = append(queries, "create index if not exists saga_payload_idx on saga using gin (payload jsonb_path_ops);")
+	}
+
+	for _, q := range queries {
+		mock.ExpectExec(q).WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
 }
 
 type SagaExample struct {
@@ -1168,3 +2173,111 @@ type ExampleEv struct {
 	message.ObjectMeta
 	Data string
 }
+
+type protoSagaExample struct {
+	BaseSaga
+	examplepb.OrderState
+}
+
+func (s *protoSagaExample) Init() {}
+
+func (s *protoSagaExample) Start(sagaCtx SagaContext) error {
+	return nil
+}
+
+func (s *protoSagaExample) Compensate(sagaCtx SagaContext) error {
+	return nil
+}
+
+func (s *protoSagaExample) Recover(sagaCtx SagaContext) error {
+	return nil
+}
+
+type protoOrderCreated struct {
+	message.ObjectMeta
+	examplepb.OrderCreated
+}
+
+// capturedArg matches any value and keeps it
+type capturedArg struct {
+	value *driver.Value
+}
+
+func (a capturedArg) Match(v driver.Value) bool {
+	*a.value = v
+	return true
+}
+
+func TestSqlStore_Marshallers(t *testing.T) {
+	ctx := context.Background()
+	sagaID := "123"
+
+	knownTypes := scheme.NewKnownTypesRegistry()
+	knownTypes.AddKnownTypes("example", &protoSagaExample{}, &protoOrderCreated{})
+
+	for _, msgMarshaller := range []message.Marshaller{message.NewJsonMarshaller(knownTypes), message.NewProtobufMarshaller(knownTypes)} {
+		t.Run(message.ContentTypeOf(msgMarshaller), func(t *testing.T) {
+			store, dbMock := createStoreWithMarshaller(t, PGDriver, msgMarshaller)
+
+			sagaObj := &protoSagaExample{OrderState: examplepb.OrderState{OrderId: "o-1", Status: "created", Items: []string{"a", "b"}}}
+			sagaObj.Timeouts = map[string]string{"payment": "t-1"}
+			sagaInstance := NewSagaInstance(sagaID, "", sagaObj)
+
+			var payload driver.Value
+
+			dbMock.ExpectBegin()
+			dbMock.ExpectExec("INSERT INTO saga (uid, parent_uid, name, payload, status, started_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7);").
+				WithArgs(sagaID, "", "example.protoSagaExample", capturedArg{value: &payload}, "created", sagaInstance.StartedAt(), sagaInstance.UpdatedAt()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			for _, correlation := range [][2]string{{"group", "example"}, {"kind", "protoSagaExample"}, {"order_id", "o-1"}, {"status", "created"}} {
+				dbMock.ExpectExec("INSERT INTO saga_correlation (saga_uid, field, value) VALUES ($1, $2, $3);").
+					WithArgs(sagaID, correlation[0], correlation[1]).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			dbMock.ExpectCommit()
+
+			require.NoError(t, store.Create(ctx, sagaInstance))
+
+			evPayload, err := msgMarshaller.Marshal(&protoOrderCreated{OrderCreated: examplepb.OrderCreated{OrderId: "o-1", Amount: 10}})
+			require.NoError(t, err)
+
+			now := time.Now()
+
+			dbMock.ExpectQuery("SELECT s.uid, s.parent_uid, s.name, s.payload, s.status, s.last_failed_ev, s.started_at, s.updated_at, s.version FROM saga s WHERE uid=$1;").
+				WithArgs(sagaID).
+				WillReturnRows(
+					sqlmock.NewRows([]string{"uid", "parent_uid", "name", "payload", "status", "last_failed_ev", "started_at", "updated_at", "version"}).
+						AddRow(sagaID, "", "example.protoSagaExample", payload, "in_progress", nil, now, now, 1),
+				)
+			dbMock.ExpectQuery("SELECT uid, name, status, payload, origin, created_at, trace_uid FROM saga_history WHERE saga_uid=$1 ORDER BY created_at;").
+				WithArgs(sagaID).
+				WillReturnRows(
+					sqlmock.NewRows([]string{"uid", "name", "status", "payload", "origin", "created_at", "trace_uid"}).
+						AddRow("ev-1", "example.protoOrderCreated", "in_progress", evPayload, "origin", now, "msg-1"),
+				)
+			dbMock.ExpectQuery("SELECT saga_uid, kind, entity_id FROM saga_entity_ref WHERE saga_uid IN ($1);").
+				WithArgs(sagaID).
+				WillReturnRows(sqlmock.NewRows([]string{"saga_uid", "kind", "entity_id"}))
+
+			loaded, err := store.GetById(ctx, sagaID)
+			require.NoError(t, err)
+			require.NotNil(t, loaded)
+
+			require.IsType(t, &protoSagaExample{}, loaded.Saga())
+			loadedSaga := loaded.Saga().(*protoSagaExample)
+			assert.Equal(t, "o-1", loadedSaga.GetOrderId())
+			assert.Equal(t, "created", loadedSaga.GetStatus())
+			assert.Equal(t, []string{"a", "b"}, loadedSaga.GetItems())
+			assert.Equal(t, map[string]string{"payment": "t-1"}, loadedSaga.Timeouts)
+			assert.Equal(t, scheme.GroupKind{Group: "example", Kind: "protoSagaExample"}, loadedSaga.GroupKind())
+
+			require.Len(t, loaded.HistoryEvents(), 1)
+			require.IsType(t, &protoOrderCreated{}, loaded.HistoryEvents()[0].Payload)
+			ev := loaded.HistoryEvents()[0].Payload.(*protoOrderCreated)
+			assert.Equal(t, "o-1", ev.GetOrderId())
+			assert.Equal(t, int64(10), ev.GetAmount())
+
+			assert.NoError(t, dbMock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package saga
+
+import (
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+// StepsDefinition declares a saga as a sequence of steps. A step runs its action, e.g. dispatches a command, and waits for one
+// of its events, once the event is handled the next step is started and the saga completes after the last one.
+// Each step can have a compensation, it's run in reverse order of steps when CompensateSagaCommand arrives.
+//
+//	saga.NewStepsDefinition().
+//		Step("reserve", s.reserve).OnEvent(&Reserved{}, nil).OnFailure(&ReservationFailed{}, nil).Compensate(s.cancelReservation).
+//		Step("charge", s.charge).OnEvent(&Charged{}, s.saveReceipt).Compensate(s.refund).OnCompensated(&Refunded{})
+//
+// Methods configuring a step are applied to the step added last.
+type StepsDefinition struct {
+	steps []*step
+}
+
+type step struct {
+	name          string
+	action        Executor
+	reactions     []reaction
+	compensation  Executor
+	compensatedOn message.Object
+}
+
+// reaction is what a step does when it receives an event
+type reaction struct {
+	ev      message.Object
+	handler Executor
+	fails   bool
+}
+
+// NewStepsDefinition creates an empty StepsDefinition, pass it into StepSaga.Define in Init of your saga
+func NewStepsDefinition() *StepsDefinition {
+	return &StepsDefinition{}
+}
+
+// Step adds a step which runs the action when it's started. A step without events is done right after its action.
+func (d *StepsDefinition) Step(name string, action Executor) *StepsDefinition {
+	if d.step(name) != nil {
+		panic(errors.Errorf("step %s is already defined", name))
+	}
+
+	d.steps = append(d.steps, &step{name: name, action: action})
+	return d
+}
+
+// OnEvent finishes the step when the event arrives, handler is called before the next step is started and can be nil.
+// The saga stays at the step if the handler fails it.
+func (d *StepsDefinition) OnEvent(ev message.Object, handler Executor) *StepsDefinition {
+	last := d.last("OnEvent")
+	last.reactions = append(last.reactions, reaction{ev: ev, handler: handler})
+	return d
+}
+
+// OnFailure fails the saga with the event when it arrives during the step, handler is called before and can be nil
+func (d *StepsDefinition) OnFailure(ev message.Object, handler Executor) *StepsDefinition {
+	last := d.last("OnFailure")
+	last.reactions = append(last.reactions, reaction{ev: ev, handler: handler, fails: true})
+	return d
+}
+
+// Compensate sets the compensation of the step. It's run for the step in progress too, so it must cope with an action which didn't happen.
+func (d *StepsDefinition) Compensate(compensation Executor) *StepsDefinition {
+	d.last("Compensate").compensation = compensation
+	return d
+}
+
+// OnCompensated makes the compensation wait for the event before previous steps are compensated
+func (d *StepsDefinition) OnCompensated(ev message.Object) *StepsDefinition {
+	d.last("OnCompensated").compensatedOn = ev
+	return d
+}
+
+func (d *StepsDefinition) last(method string) *step {
+	if len(d.steps) == 0 {
+		panic(errors.Errorf("%s is called before any step is defined", method))
+	}
+
+	return d.steps[len(d.steps)-1]
+}
+
+func (d *StepsDefinition) step(name string) *step {
+	for _, s := range d.steps {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// next returns the step following the one with the name, the first one for an empty name
+func (d *StepsDefinition) next(name string) *step {
+	if name == "" {
+		if len(d.steps) == 0 {
+			return nil
+		}
+
+		return d.steps[0]
+	}
+
+	for i, s := range d.steps {
+		if s.name == name && i+1 < len(d.steps) {
+			return d.steps[i+1]
+		}
+	}
+
+	return nil
+}
+
+// StepProgress is persisted together with a saga embedding StepSaga, steps are referred by their names
+type StepProgress struct {
+	// Current is the step waiting for its events
+	Current string `json:"current,omitempty"`
+	// Done lists finished steps in order they finished
+	Done []string `json:"done,omitempty"`
+	// Compensated lists steps whose compensations were run
+	Compensated []string `json:"compensated,omitempty"`
+	// Compensating is the step whose compensation waits for its event, see StepsDefinition.OnCompensated
+	Compensating string `json:"compensating,omitempty"`
+}
+
+// StepSaga is embedded into a saga instead of BaseSaga when the saga is declared by StepsDefinition. It implements Start, Compensate,
+// Recover and EventHandlers of the saga, Init must call Define:
+//
+//	func (s *OrderSaga) Init() {
+//		s.Define(saga.NewStepsDefinition().Step("reserve", s.reserve).OnEvent(&Reserved{}, nil).Compensate(s.cancelReservation))
+//	}
+//
+// Init is called without schema before Start, Compensate and Recover, so it mustn't call AddEventHandler.
+// Events of steps must be registered in the schema. An event not expected by the current step is ignored.
+// Recover runs the action of the current step again.
+type StepSaga struct {
+	BaseSaga
+	Progress   StepProgress `json:"step_progress"`
+	definition *StepsDefinition
+}
+
+// Define sets the definition of the saga
+func (s *StepSaga) Define(definition *StepsDefinition) {
+	s.definition = definition
+}
+
+// EventHandlers returns handlers of events of all steps together with handlers added by AddEventHandler
+func (s *StepSaga) EventHandlers() map[scheme.GroupKind]Executor {
+	handlers := make(map[scheme.GroupKind]Executor)
+
+	for gk, handler := range s.BaseSaga.EventHandlers() {
+		handlers[gk] = handler
+	}
+
+	if s.definition == nil {
+		return handlers
+	}
+
+	for _, st := range s.definition.steps {
+		events := make([]message.Object, 0, len(st.reactions)+1)
+		for _, r := range st.reactions {
+			events = append(events, r.ev)
+		}
+
+		if st.compensatedOn != nil {
+			events = append(events, st.compensatedOn)
+		}
+
+		for _, ev := range events {
+			handlers[s.kindOf(ev)] = s.handleEvent
+		}
+	}
+
+	return handlers
+}
+
+func (s *StepSaga) Start(sagaCtx SagaContext) error {
+	definition, err := s.defined(sagaCtx)
+	if err != nil {
+		return err
+	}
+
+	first := definition.next("")
+	if first == nil {
+		sagaCtx.SagaInstance().Complete()
+		return nil
+	}
+
+	return s.startStep(sagaCtx, first)
+}
+
+// Compensate runs compensations of started steps from the last one, it completes the saga once all of them are compensated
+func (s *StepSaga) Compensate(sagaCtx SagaContext) error {
+	if _, err := s.defined(sagaCtx); err != nil {
+		return err
+	}
+
+	return s.compensateNext(sagaCtx)
+}
+
+// Recover runs the action of the current step again
+func (s *StepSaga) Recover(sagaCtx SagaContext) error {
+	definition, err := s.defined(sagaCtx)
+	if err != nil {
+		return err
+	}
+
+	current := definition.step(s.Progress.Current)
+	if current == nil {
+		return errors.Errorf("saga %s has no step in progress to recover", sagaCtx.SagaInstance().UID())
+	}
+
+	return s.startStep(sagaCtx, current)
+}
+
+func (s *StepSaga) handleEvent(sagaCtx SagaContext) error {
+	ev := sagaCtx.Message().Payload()
+	gk := ev.GroupKind()
+	status := sagaCtx.SagaInstance().Status()
+
+	if status.Compensating() {
+		compensating := s.definition.step(s.Progress.Compensating)
+		if compensating == nil || compensating.compensatedOn == nil || s.kindOf(compensating.compensatedOn) != gk {
+			sagaCtx.Logger().Logf(log.WarnLevel, "event %s isn't expected while saga is compensating, ignoring it", gk)
+			return nil
+		}
+
+		s.Progress.Compensating = ""
+		return s.compensateNext(sagaCtx)
+	}
+
+	current := s.definition.step(s.Progress.Current)
+	if current == nil {
+		sagaCtx.Logger().Logf(log.WarnLevel, "event %s arrived while no step is in progress, ignoring it", gk)
+		return nil
+	}
+
+	for _, r := range current.reactions {
+		if s.kindOf(r.ev) != gk {
+			continue
+		}
+
+		if r.handler != nil {
+			if err := r.handler(sagaCtx); err != nil {
+				return err
+			}
+		}
+
+		if r.fails {
+			sagaCtx.SagaInstance().Fail(ev)
+			return nil
+		}
+
+		if sagaCtx.SagaInstance().Status().Failed() {
+			return nil
+		}
+
+		return s.finishStep(sagaCtx, current)
+	}
+
+	sagaCtx.Logger().Logf(log.WarnLevel, "event %s isn't expected by step %s, ignoring it", gk, current.name)
+
+	return nil
+}
+
+func (s *StepSaga) startStep(sagaCtx SagaContext, st *step) error {
+	s.Progress.Current = st.name
+
+	if st.action != nil {
+		if err := st.action(sagaCtx); err != nil {
+			return errors.Wrapf(err, "running step %s", st.name)
+		}
+	}
+
+	if len(st.reactions) == 0 {
+		return s.finishStep(sagaCtx, st)
+	}
+
+	return nil
+}
+
+// finishStep starts the next step or completes the saga after the last one
+func (s *StepSaga) finishStep(sagaCtx SagaContext, st *step) error {
+	s.Progress.Done = append(s.Progress.Done, st.name)
+	s.Progress.Current = ""
+
+	next := s.definition.next(st.name)
+	if next == nil {
+		sagaCtx.SagaInstance().Complete()
+		return nil
+	}
+
+	return s.startStep(sagaCtx, next)
+}
+
+// compensateNext runs compensations of started steps which aren't compensated yet, from the last one,
+// and stops at a compensation waiting for its event
+func (s *StepSaga) compensateNext(sagaCtx SagaContext) error {
+	started := s.Progress.Done
+	if s.Progress.Current != "" {
+		started = append(append([]string(nil), started...), s.Progress.Current)
+	}
+
+	for i := len(started) - 1; i >= 0; i-- {
+		st := s.definition.step(started[i])
+		if st == nil || contains(s.Progress.Compensated, st.name) {
+			continue
+		}
+
+		s.Progress.Compensated = append(s.Progress.Compensated, st.name)
+
+		if st.compensation != nil {
+			if err := st.compensation(sagaCtx); err != nil {
+				return errors.Wrapf(err, "compensating step %s", st.name)
+			}
+		}
+
+		if st.compensatedOn != nil {
+			s.Progress.Compensating = st.name
+			return nil
+		}
+	}
+
+	s.Progress.Current = ""
+	sagaCtx.SagaInstance().Complete()
+
+	return nil
+}
+
+// defined returns the definition, Init of the saga isn't called before Start, Compensate and Recover, so it's called here
+func (s *StepSaga) defined(sagaCtx SagaContext) (*StepsDefinition, error) {
+	if s.definition == nil {
+		sagaCtx.SagaInstance().Saga().Init()
+	}
+
+	if s.definition == nil {
+		return nil, errors.Errorf("saga %s embeds StepSaga, but its Init doesn't call Define", sagaCtx.SagaInstance().UID())
+	}
+
+	return s.definition, nil
+}
+
+func (s *StepSaga) stepsDefinition() *StepsDefinition {
+	return s.definition
+}
+
+func (s *StepSaga) stepProgress() StepProgress {
+	return s.Progress
+}
+
+func (s *StepSaga) kindOf(ev message.Object) scheme.GroupKind {
+	if s.scheme == nil {
+		panic(errors.New("schema wasn't set"))
+	}
+
+	gk, err := s.scheme.ObjectKind(ev)
+	if err != nil {
+		panic(errors.Errorf("ev %T is not registered in schema", ev))
+	}
+
+	return *gk
+}
@@ -0,0 +1,196 @@
+package saga
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/go-foreman/foreman/testing/mocks/pubsub/message/execution"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stepsExample struct {
+	StepSaga
+	Receipt string `json:"receipt"`
+}
+
+func (s *stepsExample) Init() {
+	s.Define(NewStepsDefinition().
+		Step("reserve", s.dispatch("reserve")).OnEvent(&stockReserved{}, nil).Compensate(s.dispatch("cancel reservation")).
+		Step("charge", s.dispatch("charge")).OnEvent(&paymentCharged{}, s.saveReceipt).OnFailure(&paymentFailed{}, nil).Compensate(s.dispatch("refund")).OnCompensated(&paymentRefunded{}).
+		Step("notify", s.dispatch("notify")))
+}
+
+func (s *stepsExample) dispatch(msg string) Executor {
+	return func(sagaCtx SagaContext) error {
+		sagaCtx.Dispatch(&DataContract{Message: msg})
+		return nil
+	}
+}
+
+func (s *stepsExample) saveReceipt(sagaCtx SagaContext) error {
+	s.Receipt = "receipt"
+	return nil
+}
+
+type stockReserved struct {
+	message.ObjectMeta
+}
+
+type paymentCharged struct {
+	message.ObjectMeta
+}
+
+type paymentFailed struct {
+	message.ObjectMeta
+}
+
+type paymentRefunded struct {
+	message.ObjectMeta
+}
+
+type undefinedStepsExample struct {
+	StepSaga
+}
+
+func (s *undefinedStepsExample) Init() {}
+
+func TestStepSaga(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schema := scheme.NewKnownTypesRegistry()
+	schema.AddKnownTypes("example", &stepsExample{}, &DataContract{}, &stockReserved{}, &paymentCharged{}, &paymentFailed{}, &paymentRefunded{})
+
+	sagaCtx := func(sagaInstance Instance, ev message.Object) SagaContext {
+		msgExecCtxMock := execution.NewMockMessageExecutionCtx(ctrl)
+		msgExecCtxMock.EXPECT().Logger().Return(log.NewNilLogger()).AnyTimes()
+
+		if ev != nil {
+			gk, err := schema.ObjectKind(ev)
+			require.NoError(t, err)
+			ev.SetGroupKind(gk)
+			msgExecCtxMock.EXPECT().Message().Return(message.NewReceivedMessage("uid", ev, message.Headers{}, time.Now(), "sagas")).AnyTimes()
+		}
+
+		return NewSagaCtx(msgExecCtxMock, sagaInstance)
+	}
+
+	dispatched := func(sagaCtx SagaContext) []string {
+		var messages []string
+		for _, delivery := range sagaCtx.Deliveries() {
+			messages = append(messages, delivery.Payload.(*DataContract).Message)
+		}
+
+		return messages
+	}
+
+	// handle does what the events handler does with a loaded saga
+	handle := func(t *testing.T, sagaInstance Instance, ev message.Object) SagaContext {
+		exp := sagaInstance.Saga()
+		exp.SetSchema(schema)
+		exp.Init()
+
+		ctx := sagaCtx(sagaInstance, ev)
+		handler, exists := exp.EventHandlers()[ev.GroupKind()]
+		require.True(t, exists)
+		require.NoError(t, handler(ctx))
+
+		return ctx
+	}
+
+	t.Run("event handlers of all steps", func(t *testing.T) {
+		exp := &stepsExample{}
+		exp.SetSchema(schema)
+		exp.Init()
+
+		assert.Len(t, exp.EventHandlers(), 4)
+		assert.Contains(t, exp.EventHandlers(), scheme.GroupKind{Group: "example", Kind: "paymentRefunded"})
+	})
+
+	t.Run("steps run in order", func(t *testing.T) {
+		exp := &stepsExample{}
+		sagaInstance := NewSagaInstance("123", "", exp)
+
+		ctx := sagaCtx(sagaInstance, nil)
+		require.NoError(t, sagaInstance.Start(ctx))
+		assert.Equal(t, []string{"reserve"}, dispatched(ctx))
+		assert.Equal(t, "reserve", exp.Progress.Current)
+
+		ctx = handle(t, sagaInstance, &paymentCharged{})
+		assert.Empty(t, dispatched(ctx), "event of another step is ignored")
+		assert.Empty(t, exp.Progress.Done)
+
+		ctx = handle(t, sagaInstance, &stockReserved{})
+		assert.Equal(t, []string{"charge"}, dispatched(ctx))
+		assert.Equal(t, StepProgress{Current: "charge", Done: []string{"reserve"}}, exp.Progress)
+
+		ctx = handle(t, sagaInstance, &paymentCharged{})
+		assert.Equal(t, []string{"notify"}, dispatched(ctx), "step without events is done right after its action")
+		assert.Equal(t, "receipt", exp.Receipt)
+		assert.Equal(t, StepProgress{Done: []string{"reserve", "charge", "notify"}}, exp.Progress)
+		assert.True(t, sagaInstance.Status().Completed())
+	})
+
+	t.Run("progress is persisted with the saga", func(t *testing.T) {
+		exp := &stepsExample{StepSaga: StepSaga{Progress: StepProgress{Current: "charge", Done: []string{"reserve"}}}}
+
+		data, err := json.Marshal(exp)
+		require.NoError(t, err)
+
+		decoded := &stepsExample{}
+		require.NoError(t, json.Unmarshal(data, decoded))
+		assert.Equal(t, exp.Progress, decoded.Progress)
+	})
+
+	t.Run("failed step is recovered and compensated in reverse order", func(t *testing.T) {
+		exp := &stepsExample{}
+		sagaInstance := NewSagaInstance("123", "", exp)
+		require.NoError(t, sagaInstance.Start(sagaCtx(sagaInstance, nil)))
+		handle(t, sagaInstance, &stockReserved{})
+
+		ctx := handle(t, sagaInstance, &paymentFailed{})
+		assert.Empty(t, dispatched(ctx))
+		assert.True(t, sagaInstance.Status().Failed())
+		assert.Equal(t, "charge", exp.Progress.Current)
+
+		ctx = sagaCtx(sagaInstance, nil)
+		require.NoError(t, sagaInstance.Recover(ctx))
+		assert.Equal(t, []string{"charge"}, dispatched(ctx))
+
+		handle(t, sagaInstance, &paymentFailed{})
+
+		ctx = sagaCtx(sagaInstance, nil)
+		require.NoError(t, sagaInstance.Compensate(ctx))
+		assert.Equal(t, []string{"refund"}, dispatched(ctx), "compensation waits for the refund")
+		assert.Equal(t, "charge", exp.Progress.Compensating)
+
+		ctx = handle(t, sagaInstance, &stockReserved{})
+		assert.Empty(t, dispatched(ctx), "events of steps are ignored while compensating")
+
+		ctx = handle(t, sagaInstance, &paymentRefunded{})
+		assert.Equal(t, []string{"cancel reservation"}, dispatched(ctx))
+		assert.Equal(t, []string{"charge", "reserve"}, exp.Progress.Compensated)
+		assert.True(t, sagaInstance.Status().Completed())
+	})
+
+	t.Run("saga without definition", func(t *testing.T) {
+		sagaInstance := NewSagaInstance("123", "", &undefinedStepsExample{})
+		assert.EqualError(t, sagaInstance.Start(sagaCtx(sagaInstance, nil)), "saga 123 embeds StepSaga, but its Init doesn't call Define")
+	})
+
+	t.Run("invalid definition", func(t *testing.T) {
+		assert.PanicsWithError(t, "OnEvent is called before any step is defined", func() {
+			NewStepsDefinition().OnEvent(&stockReserved{}, nil)
+		})
+
+		assert.PanicsWithError(t, "step reserve is already defined", func() {
+			NewStepsDefinition().Step("reserve", nil).Step("reserve", nil)
+		})
+	})
+}
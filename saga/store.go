@@ -3,17 +3,69 @@ package saga
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/go-foreman/foreman/saga/filter"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
 	"github.com/pkg/errors"
 )
 
 const (
-	sagaTableName        = "saga"
-	sagaHistoryTableName = "saga_history"
+	sagaTableName          = "saga"
+	sagaHistoryTableName   = "saga_history"
+	sagaEntityRefTableName = "saga_entity_ref"
+	sagaCorrelationTable   = "saga_correlation"
 )
 
+// VersionConflictErr is returned by Store.Update and Store.UpdateIfVersion if the saga was updated by someone else since the instance was loaded
+type VersionConflictErr struct {
+	error
+}
+
+func WithVersionConflictErr(err error) error {
+	return VersionConflictErr{err}
+}
+
+// StaleFencingTokenErr is returned by sql store Update if the saga was saved under a lock with a greater fencing token,
+// the lock the caller handles the saga under has expired and someone else holds it now
+type StaleFencingTokenErr struct {
+	error
+}
+
+func WithStaleFencingTokenErr(err error) error {
+	return StaleFencingTokenErr{err}
+}
+
+type fencingTokenKey struct{}
+
+// WithFencingToken returns ctx carrying the fencing token of the lock the saga is handled under, see mutex.FencedLock.
+// Sql store saves the token with the saga and rejects updates with an older one.
+func WithFencingToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, fencingTokenKey{}, token)
+}
+
+// FencingTokenFromContext returns the token set by WithFencingToken, false if there is none
+func FencingTokenFromContext(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(fencingTokenKey{}).(int64)
+	return token, ok
+}
+
 type FilterOption func(opts *filterOptions)
 
+// SortField is a column sagas can be ordered by in GetByFilter
+type SortField string
+
+// SortOrder is a direction of sorting
+type SortOrder string
+
+const (
+	SortByStartedAt SortField = "started_at"
+	SortByUpdatedAt SortField = "updated_at"
+
+	SortAsc  SortOrder = "asc"
+	SortDesc SortOrder = "desc"
+)
+
 //go:generate mockgen --build_flags=--mod=mod -destination ../testing/mocks/saga/store.go -package saga . Store
 
 type InstancesBatch struct {
@@ -25,25 +77,118 @@ type Store interface {
 	Create(ctx context.Context, saga Instance) error
 	GetById(ctx context.Context, sagaId string) (Instance, error)
 	GetByFilter(ctx context.Context, filters ...FilterOption) (*InstancesBatch, error)
+	// GetByCorrelation returns a not completed saga of the type whose field equals the value, see CorrelationRule.
+	// Nil is returned if there is no such saga, AmbiguousCorrelationErr if there are several of them.
+	GetByCorrelation(ctx context.Context, sagaType string, field string, value string) (Instance, error)
+	// Update saves the saga if it's still at the version it was loaded with, see Instance.Version, and increases the version.
+	// Otherwise VersionConflictErr is returned and nothing is saved. Sql store also rejects the update with StaleFencingTokenErr
+	// if ctx carries a fencing token older than the one the saga was saved with, see WithFencingToken.
 	Update(ctx context.Context, saga Instance) error
+	// UpdateIfVersion saves the saga if it's stored at expectedVersion and sets the version of the instance to the next one.
+	// Otherwise VersionConflictErr is returned and nothing is saved. Update is UpdateIfVersion with the version the instance was loaded with.
+	UpdateIfVersion(ctx context.Context, saga Instance, expectedVersion int) error
 	Delete(ctx context.Context, sagaId string) error
+	// DeleteByFilter deletes sagas matching filters together with their history and returns a number of deleted sagas.
+	// Sorting and paging filters are ignored, at least one other filter is required.
+	DeleteByFilter(ctx context.Context, filters ...FilterOption) (int, error)
+	// DeleteOlderThan deletes completed sagas last updated before cutoff and returns a number of deleted sagas.
+	// Completed is the only terminal status, sagas in progress or failed ones which can still be recovered are never touched.
+	// Each saga is deleted together with its history in a separate transaction.
+	DeleteOlderThan(ctx context.Context, cutoff time.Time, opts ...DeleteOption) (int, error)
+}
+
+// TxFunc writes into the transaction of a saga update, an error rolls the update back
+type TxFunc func(ctx context.Context, tx *sql.Tx) error
+
+// TransactionalStore is a Store kept in a sql database which lets other writes participate in the transaction of Update, see SQLOutbox
+type TransactionalStore interface {
+	Store
+	// UpdateTx updates the saga like Update and calls inTx before the transaction is committed, the saga is saved only if inTx succeeds
+	UpdateTx(ctx context.Context, saga Instance, inTx TxFunc) error
+	// DB returns the database sagas are kept in and its driver
+	DB() (*sagaSql.DB, SQLDriver)
 }
 
 func WithSagaId(sagaId string) FilterOption {
 	return func(opts *filterOptions) {
-		opts.sagaId = sagaId
+		if sagaId != "" {
+			opts.where = append(opts.where, filter.SagaID(sagaId))
+		}
 	}
 }
 
 func WithStatus(status string) FilterOption {
 	return func(opts *filterOptions) {
-		opts.status = status
+		if status != "" {
+			opts.where = append(opts.where, filter.StatusIn(status))
+		}
 	}
 }
 
 func WithSagaName(sagaName string) FilterOption {
 	return func(opts *filterOptions) {
-		opts.sagaName = sagaName
+		if sagaName != "" {
+			opts.where = append(opts.where, filter.Name(sagaName))
+		}
+	}
+}
+
+// WithParentId filters child sagas of the parent saga
+func WithParentId(parentId string) FilterOption {
+	return func(opts *filterOptions) {
+		if parentId != "" {
+			opts.where = append(opts.where, filter.ParentID(parentId))
+		}
+	}
+}
+
+// WithStartedBetween filters sagas started in [from, to). A zero time means the range isn't limited from that side.
+func WithStartedBetween(from, to time.Time) FilterOption {
+	return func(opts *filterOptions) {
+		if !from.IsZero() {
+			opts.where = append(opts.where, filter.StartedFrom(from))
+		}
+
+		if !to.IsZero() {
+			opts.where = append(opts.where, filter.StartedBefore(to))
+		}
+	}
+}
+
+// WithUpdatedBefore filters sagas last updated before t
+func WithUpdatedBefore(t time.Time) FilterOption {
+	return func(opts *filterOptions) {
+		if !t.IsZero() {
+			opts.where = append(opts.where, filter.UpdatedBefore(t))
+		}
+	}
+}
+
+// WithEntityRef filters sagas which added the ref by SagaContext.AddEntityRef, regardless of their type and status
+func WithEntityRef(ref EntityRef) FilterOption {
+	return func(opts *filterOptions) {
+		opts.where = append(opts.where, filter.EntityRef(ref.Kind, ref.ID))
+	}
+}
+
+// WithExcludedIds filters out sagas with the ids
+func WithExcludedIds(ids ...string) FilterOption {
+	return func(opts *filterOptions) {
+		if len(ids) > 0 {
+			opts.where = append(opts.where, filter.Not(filter.SagaID(ids...)))
+		}
+	}
+}
+
+// WithFilter selects sagas matching all of the filters, e.g. WithFilter(filter.Or(filter.StatusIn("failed"), filter.UpdatedBefore(t))).
+// Other filter options are predicates combined with them by And.
+func WithFilter(exprs ...filter.Expr) FilterOption {
+	return func(opts *filterOptions) {
+		for _, e := range exprs {
+			if e != nil {
+				opts.where = append(opts.where, e)
+			}
+		}
 	}
 }
 
@@ -54,16 +199,67 @@ func WithOffsetAndLimit(offset int, limit int) FilterOption {
 	}
 }
 
+// WithSorting orders result of GetByFilter. By default sagas are ordered by SortByStartedAt in SortDesc order.
+func WithSorting(field SortField, order SortOrder) FilterOption {
+	return func(opts *filterOptions) {
+		opts.sortField = field
+		opts.sortOrder = order
+	}
+}
+
 type filterOptions struct {
-	sagaId   string
-	status   string
-	sagaName string
-	limit    *int
-	offset   *int
+	// where are predicates which all must match
+	where     []filter.Expr
+	limit     *int
+	offset    *int
+	sortField SortField
+	sortOrder SortOrder
+}
+
+func newFilterOptions(filters []FilterOption) *filterOptions {
+	opts := &filterOptions{}
+
+	for _, f := range filters {
+		f(opts)
+	}
+
+	return opts
+}
+
+// filter returns predicates combined by And, nil if there are none
+func (o filterOptions) filter() filter.Expr {
+	if len(o.where) == 0 {
+		return nil
+	}
+
+	return filter.And(o.where...)
+}
+
+// orderBy returns validated sorting field and order, only known values are allowed so they are safe to put into a query
+func (o filterOptions) orderBy() (SortField, SortOrder, error) {
+	field, order := o.sortField, o.sortOrder
+
+	if field == "" {
+		field = SortByStartedAt
+	}
+
+	if order == "" {
+		order = SortDesc
+	}
+
+	if field != SortByStartedAt && field != SortByUpdatedAt {
+		return "", "", errors.Errorf("unknown sort field '%s'", field)
+	}
+
+	if order != SortAsc && order != SortDesc {
+		return "", "", errors.Errorf("unknown sort order '%s'", order)
+	}
+
+	return field, order, nil
 }
 
 func statusFromStr(str string) (status, error) {
-	statuses := []status{sagaStatusInProgress, sagaStatusFailed, sagaStatusInProgress, sagaStatusCompensating, sagaStatusCompleted, sagaStatusCreated, sagaStatusRecovering}
+	statuses := []status{sagaStatusInProgress, sagaStatusFailed, sagaStatusInProgress, sagaStatusCompensating, sagaStatusCompleted, sagaStatusCreated, sagaStatusRecovering, sagaStatusCompensatingChildren, sagaStatusChildCompensationFailed}
 	for _, s := range statuses {
 		if string(s) == str {
 			return s, nil
@@ -82,6 +278,7 @@ type sagaSqlModel struct {
 	LastFailedMsg []byte
 	StartedAt     sql.NullTime
 	UpdatedAt     sql.NullTime
+	Version       sql.NullInt64
 }
 
 type historyEventSqlModel struct {
@@ -3,19 +3,15 @@ package saga
 import (
 	"testing"
 
+	"github.com/go-foreman/foreman/saga/filter"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestOpts(t *testing.T) {
-	storeOpts := &filterOptions{}
-	opts := []FilterOption{WithStatus("xxx"), WithSagaId("yyy"), WithSagaName("zzz")}
-	for _, o := range opts {
-		o(storeOpts)
-	}
+	storeOpts := newFilterOptions([]FilterOption{WithStatus("xxx"), WithSagaId("yyy"), WithSagaName("zzz"), WithSagaId(""), WithExcludedIds()})
 
-	assert.Equal(t, storeOpts.status, "xxx")
-	assert.Equal(t, storeOpts.sagaId, "yyy")
-	assert.Equal(t, storeOpts.sagaName, "zzz")
+	assert.Equal(t, filter.And(filter.StatusIn("xxx"), filter.SagaID("yyy"), filter.Name("zzz")), storeOpts.filter())
+	assert.Nil(t, newFilterOptions([]FilterOption{WithOffsetAndLimit(0, 10)}).filter())
 }
 
 func TestStatusFromStr(t *testing.T) {
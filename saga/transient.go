@@ -0,0 +1,61 @@
+package saga
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// transientSQLStates are SQLSTATE codes of postgres errors after which the same statement succeeds if it's run again:
+// serialization_failure and deadlock_detected
+var transientSQLStates = map[string]struct{}{
+	"40001": {},
+	"40P01": {},
+}
+
+// transientMySQLErrors are prefixes of mysql errors after which the same statement succeeds if it's run again:
+// lock wait timeout and deadlock. The store doesn't depend on the driver, so its errors are recognized by the message.
+var transientMySQLErrors = []string{"Error 1205:", "Error 1213:"}
+
+// IsTransientErr tells whether a store operation failed with an error which goes away on its own, e.g. a deadlock,
+// a serialization failure, a broken or reset connection or an error the driver reports as temporary.
+// Version conflicts and cancelled contexts aren't transient.
+func IsTransientErr(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var sqlStateErr interface{ SQLState() string }
+	if errors.As(err, &sqlStateErr) {
+		_, transient := transientSQLStates[sqlStateErr.SQLState()]
+		return transient
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var temporaryErr interface{ Temporary() bool }
+	if errors.As(err, &temporaryErr) && temporaryErr.Temporary() {
+		return true
+	}
+
+	cause := errors.Cause(err).Error()
+	for _, prefix := range transientMySQLErrors {
+		if strings.HasPrefix(cause, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package saga
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type sqlStateErr struct {
+	code string
+}
+
+func (e sqlStateErr) Error() string {
+	return "pg error " + e.code
+}
+
+func (e sqlStateErr) SQLState() string {
+	return e.code
+}
+
+func TestIsTransientErr(t *testing.T) {
+	transient := []error{
+		driver.ErrBadConn,
+		errors.Wrap(driver.ErrBadConn, "updating saga"),
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET},
+		errors.Wrap(sqlStateErr{"40P01"}, "updating saga"),
+		sqlStateErr{"40001"},
+		errors.Wrap(errors.New("Error 1213: Deadlock found when trying to get lock; try restarting transaction"), "updating saga"),
+		errors.New("Error 1205: Lock wait timeout exceeded; try restarting transaction"),
+	}
+
+	for _, err := range transient {
+		assert.True(t, IsTransientErr(err), err.Error())
+	}
+
+	permanent := []error{
+		nil,
+		errors.New("saga not found"),
+		sqlStateErr{"23505"},
+		errors.New("Error 1062: Duplicate entry"),
+		errors.Wrap(context.Canceled, "updating saga"),
+		fmt.Errorf("updating saga: %w", context.DeadlineExceeded),
+		WithVersionConflictErr(errors.New("saga was updated concurrently")),
+	}
+
+	for _, err := range permanent {
+		assert.False(t, IsTransientErr(err), fmt.Sprint(err))
+	}
+}
@@ -0,0 +1,114 @@
+package saga
+
+import (
+	"context"
+
+	"github.com/go-foreman/foreman/saga/filter"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxTreeDepth limits how many levels of descendants GetTree loads below the saga
+	MaxTreeDepth = 32
+	// MaxTreeSize limits how many sagas GetTree loads
+	MaxTreeSize = 10000
+
+	// parentsPerQuery limits how many parents children are queried for at once
+	parentsPerQuery = 100
+)
+
+// Tree is a saga with its descendants, children are sorted by the time they were started
+type Tree struct {
+	Instance Instance
+	Children []*Tree
+}
+
+// CorruptTreeErr is returned by GetTree if parents of sagas form a cycle, a saga is its own parent or the tree exceeds MaxTreeDepth or MaxTreeSize
+type CorruptTreeErr struct {
+	error
+}
+
+func WithCorruptTreeErr(err error) error {
+	return CorruptTreeErr{err}
+}
+
+// GetTree loads the saga with its descendants, children are found by their parent id with a query per level of the tree.
+// Nil is returned if the saga doesn't exist. Traversal is bounded, corrupted parent references are reported by CorruptTreeErr.
+func GetTree(ctx context.Context, store Store, sagaId string) (*Tree, error) {
+	root, err := store.GetById(ctx, sagaId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading saga '%s'", sagaId)
+	}
+
+	if root == nil {
+		return nil, nil
+	}
+
+	tree := &Tree{Instance: root}
+	visited := map[string]struct{}{root.UID(): {}}
+	level := map[string]*Tree{root.UID(): tree}
+
+	for depth := 1; len(level) > 0; depth++ {
+		children, err := loadChildren(ctx, store, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(children) > 0 && depth > MaxTreeDepth {
+			return nil, WithCorruptTreeErr(errors.Errorf("saga '%s' has descendants deeper than %d levels", sagaId, MaxTreeDepth))
+		}
+
+		next := make(map[string]*Tree, len(children))
+
+		for _, child := range children {
+			if _, seen := visited[child.UID()]; seen {
+				return nil, WithCorruptTreeErr(errors.Errorf("saga '%s' is its own ancestor, parents of sagas in the tree of '%s' form a cycle", child.UID(), sagaId))
+			}
+
+			if len(visited) == MaxTreeSize {
+				return nil, WithCorruptTreeErr(errors.Errorf("tree of saga '%s' has more than %d sagas", sagaId, MaxTreeSize))
+			}
+
+			parent, ok := level[child.ParentID()]
+			if !ok {
+				continue
+			}
+
+			visited[child.UID()] = struct{}{}
+
+			node := &Tree{Instance: child}
+			parent.Children = append(parent.Children, node)
+			next[child.UID()] = node
+		}
+
+		level = next
+	}
+
+	return tree, nil
+}
+
+// loadChildren returns children of the sagas sorted by the time they were started
+func loadChildren(ctx context.Context, store Store, parents map[string]*Tree) ([]Instance, error) {
+	parentIDs := make([]filter.Expr, 0, len(parents))
+	for uid := range parents {
+		parentIDs = append(parentIDs, filter.ParentID(uid))
+	}
+
+	var children []Instance
+
+	for start := 0; start < len(parentIDs); start += parentsPerQuery {
+		end := start + parentsPerQuery
+		if end > len(parentIDs) {
+			end = len(parentIDs)
+		}
+
+		batch, err := store.GetByFilter(ctx, WithFilter(filter.Or(parentIDs[start:end]...)), WithSorting(SortByStartedAt, SortAsc))
+		if err != nil {
+			return nil, errors.Wrap(err, "loading children of sagas")
+		}
+
+		children = append(children, batch.Items...)
+	}
+
+	return children, nil
+}
@@ -0,0 +1,91 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func treeInstance(uid, parentID string, startedAt time.Time) Instance {
+	return &sagaInstance{uid: uid, parentID: parentID, saga: &sagaExample{}, startedAt: &startedAt, instanceStatus: instanceStatus{status: sagaStatusInProgress}}
+}
+
+func TestGetTree(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	t.Run("saga with descendants", func(t *testing.T) {
+		store := newMemStore()
+
+		for _, instance := range []Instance{
+			treeInstance("root", "", now),
+			treeInstance("second", "root", now.Add(time.Minute)),
+			treeInstance("first", "root", now),
+			treeInstance("grandchild", "first", now),
+			treeInstance("other", "", now),
+		} {
+			require.NoError(t, store.Create(ctx, instance))
+		}
+
+		tree, err := GetTree(ctx, store, "root")
+		require.NoError(t, err)
+
+		assert.Equal(t, "root", tree.Instance.UID())
+		require.Len(t, tree.Children, 2)
+		assert.Equal(t, "first", tree.Children[0].Instance.UID())
+		assert.Equal(t, "second", tree.Children[1].Instance.UID())
+		require.Len(t, tree.Children[0].Children, 1)
+		assert.Equal(t, "grandchild", tree.Children[0].Children[0].Instance.UID())
+		assert.Empty(t, tree.Children[1].Children)
+		assert.Equal(t, 3, store.queries, "a query per level")
+	})
+
+	t.Run("saga not found", func(t *testing.T) {
+		tree, err := GetTree(ctx, newMemStore(), "root")
+		assert.NoError(t, err)
+		assert.Nil(t, tree)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		store := newMemStore()
+		require.NoError(t, store.Create(ctx, treeInstance("a", "b", now)))
+		require.NoError(t, store.Create(ctx, treeInstance("b", "a", now)))
+
+		_, err := GetTree(ctx, store, "a")
+		assert.IsType(t, CorruptTreeErr{}, err)
+		assert.EqualError(t, err, "saga 'a' is its own ancestor, parents of sagas in the tree of 'a' form a cycle")
+	})
+
+	t.Run("saga is its own parent", func(t *testing.T) {
+		store := newMemStore()
+		require.NoError(t, store.Create(ctx, treeInstance("a", "a", now)))
+
+		_, err := GetTree(ctx, store, "a")
+		assert.IsType(t, CorruptTreeErr{}, err)
+	})
+
+	t.Run("too deep", func(t *testing.T) {
+		store := newMemStore()
+		require.NoError(t, store.Create(ctx, treeInstance("0", "", now)))
+
+		for i := 1; i <= MaxTreeDepth+1; i++ {
+			require.NoError(t, store.Create(ctx, treeInstance(fmt.Sprint(i), fmt.Sprint(i-1), now)))
+		}
+
+		_, err := GetTree(ctx, store, "0")
+		assert.EqualError(t, err, fmt.Sprintf("saga '0' has descendants deeper than %d levels", MaxTreeDepth))
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		store := newMemStore()
+		require.NoError(t, store.Create(ctx, treeInstance("root", "", now)))
+		store.err = fmt.Errorf("connection lost")
+
+		_, err := GetTree(ctx, store, "root")
+		assert.EqualError(t, err, "loading children of sagas: connection lost")
+	})
+}
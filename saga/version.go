@@ -0,0 +1,141 @@
+package saga
+
+import (
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+)
+
+// VersionSelector chooses a version of a saga for a new instance. Versions are numbered from 1 in the order they are registered.
+// It may consult a flag source to roll a new version out gradually, an instance keeps the chosen version till it ends.
+type VersionSelector func(startCmd *contracts.StartSagaCommand) int
+
+// VersionMismatchErr is returned for an instance whose saga version is no longer registered
+type VersionMismatchErr struct {
+	error
+}
+
+func WithVersionMismatchErr(err error) error {
+	return VersionMismatchErr{err}
+}
+
+// Definition describes a registered saga and all its versions
+type Definition struct {
+	Name     string              `json:"name"`
+	Versions []VersionDefinition `json:"versions"`
+}
+
+// VersionDefinition is one version of a saga, Type is GroupKind of the saga type implementing the version
+type VersionDefinition struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+}
+
+// VersionRegistry keeps registered sagas with their versions. A saga registered without versions has the only version 1.
+type VersionRegistry struct {
+	definitions []*versionedSaga
+	byKind      map[scheme.GroupKind]*versionedSaga
+}
+
+type versionedSaga struct {
+	kinds    []scheme.GroupKind
+	selector VersionSelector
+}
+
+func NewVersionRegistry() *VersionRegistry {
+	return &VersionRegistry{byKind: make(map[scheme.GroupKind]*versionedSaga)}
+}
+
+// Register adds versions of a saga, the saga is named after its first version. Selector may be nil for a saga with one version.
+func (r *VersionRegistry) Register(selector VersionSelector, versions ...scheme.GroupKind) error {
+	if len(versions) == 0 {
+		return errors.New("no saga versions specified")
+	}
+
+	if len(versions) > 1 && selector == nil {
+		return errors.Errorf("version selector of saga '%s' is nil", versions[0])
+	}
+
+	s := &versionedSaga{kinds: versions, selector: selector}
+
+	for _, gk := range versions {
+		if _, exists := r.byKind[gk]; exists {
+			return errors.Errorf("saga '%s' is already registered", gk)
+		}
+	}
+
+	for _, gk := range versions {
+		r.byKind[gk] = s
+	}
+
+	r.definitions = append(r.definitions, s)
+
+	return nil
+}
+
+// Select returns GroupKind of the saga version a new instance is created with. A start command of any version of a saga
+// is passed to its selector, a saga which isn't registered is started as is.
+func (r *VersionRegistry) Select(startCmd *contracts.StartSagaCommand) (scheme.GroupKind, error) {
+	gk := startCmd.Saga.GroupKind()
+
+	s, exists := r.byKind[gk]
+	if !exists || s.selector == nil {
+		return gk, nil
+	}
+
+	version := s.selector(startCmd)
+
+	if version < 1 || version > len(s.kinds) {
+		return gk, errors.Errorf("version selector of saga '%s' returned version %d, registered versions are 1-%d", s.name(), version, len(s.kinds))
+	}
+
+	return s.kinds[version-1], nil
+}
+
+// Check returns VersionMismatchErr if the saga type an instance was started with isn't registered anymore
+func (r *VersionRegistry) Check(sagaInstance Instance) error {
+	gk := sagaInstance.Saga().GroupKind()
+
+	if _, exists := r.byKind[gk]; !exists {
+		return WithVersionMismatchErr(errors.Errorf("saga '%s' was started with '%s' which is no longer registered, keep registering the version until all its instances end", sagaInstance.UID(), gk))
+	}
+
+	return nil
+}
+
+// Version returns the name of a saga and the version implemented by the type
+func (r *VersionRegistry) Version(gk scheme.GroupKind) (name string, version int, exists bool) {
+	s, exists := r.byKind[gk]
+	if !exists {
+		return "", 0, false
+	}
+
+	for i, kind := range s.kinds {
+		if kind == gk {
+			version = i + 1
+		}
+	}
+
+	return s.name(), version, true
+}
+
+// Definitions lists registered sagas in the order of registration
+func (r *VersionRegistry) Definitions() []Definition {
+	res := make([]Definition, 0, len(r.definitions))
+
+	for _, s := range r.definitions {
+		def := Definition{Name: s.name(), Versions: make([]VersionDefinition, 0, len(s.kinds))}
+
+		for i, gk := range s.kinds {
+			def.Versions = append(def.Versions, VersionDefinition{Version: i + 1, Type: gk.String()})
+		}
+
+		res = append(res, def)
+	}
+
+	return res
+}
+
+func (s versionedSaga) name() string {
+	return s.kinds[0].String()
+}
@@ -0,0 +1,88 @@
+package saga
+
+import (
+	"testing"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionRegistry(t *testing.T) {
+	v1 := scheme.GroupKind{Group: "example", Kind: "OrderSagaV1"}
+	v2 := scheme.GroupKind{Group: "example", Kind: "OrderSagaV2"}
+	plain := scheme.GroupKind{Group: "example", Kind: "sagaExample"}
+
+	version := 2
+	registry := NewVersionRegistry()
+	require.NoError(t, registry.Register(nil, plain))
+	require.NoError(t, registry.Register(func(startCmd *contracts.StartSagaCommand) int {
+		return version
+	}, v1, v2))
+
+	startCmd := func(gk scheme.GroupKind) *contracts.StartSagaCommand {
+		s := &sagaExample{}
+		s.SetGroupKind(&gk)
+		return &contracts.StartSagaCommand{SagaUID: "123", Saga: s}
+	}
+
+	t.Run("register errors", func(t *testing.T) {
+		assert.EqualError(t, registry.Register(nil), "no saga versions specified")
+		assert.EqualError(t, registry.Register(nil, scheme.GroupKind{Group: "example", Kind: "A"}, scheme.GroupKind{Group: "example", Kind: "B"}), "version selector of saga 'example.A' is nil")
+		assert.EqualError(t, registry.Register(nil, v2), "saga 'example.OrderSagaV2' is already registered")
+	})
+
+	t.Run("select", func(t *testing.T) {
+		gk, err := registry.Select(startCmd(v1))
+		require.NoError(t, err)
+		assert.Equal(t, v2, gk)
+
+		version = 1
+		gk, err = registry.Select(startCmd(v2))
+		require.NoError(t, err)
+		assert.Equal(t, v1, gk)
+
+		gk, err = registry.Select(startCmd(plain))
+		require.NoError(t, err)
+		assert.Equal(t, plain, gk)
+
+		unknown := scheme.GroupKind{Group: "example", Kind: "Unknown"}
+		gk, err = registry.Select(startCmd(unknown))
+		require.NoError(t, err)
+		assert.Equal(t, unknown, gk)
+
+		version = 3
+		_, err = registry.Select(startCmd(v1))
+		assert.EqualError(t, err, "version selector of saga 'example.OrderSagaV1' returned version 3, registered versions are 1-2")
+	})
+
+	t.Run("check", func(t *testing.T) {
+		s := &sagaExample{}
+		s.SetGroupKind(&v2)
+		assert.NoError(t, registry.Check(NewSagaInstance("123", "", s)))
+
+		s.SetGroupKind(&scheme.GroupKind{Group: "example", Kind: "OrderSagaV0"})
+		err := registry.Check(NewSagaInstance("123", "", s))
+		require.Error(t, err)
+		assert.IsType(t, VersionMismatchErr{}, err)
+		assert.EqualError(t, err, "saga '123' was started with 'example.OrderSagaV0' which is no longer registered, keep registering the version until all its instances end")
+	})
+
+	t.Run("version", func(t *testing.T) {
+		name, version, exists := registry.Version(v2)
+		assert.True(t, exists)
+		assert.Equal(t, "example.OrderSagaV1", name)
+		assert.Equal(t, 2, version)
+
+		_, _, exists = registry.Version(scheme.GroupKind{Group: "example", Kind: "Unknown"})
+		assert.False(t, exists)
+	})
+
+	t.Run("definitions", func(t *testing.T) {
+		assert.Equal(t, []Definition{
+			{Name: "example.sagaExample", Versions: []VersionDefinition{{Version: 1, Type: "example.sagaExample"}}},
+			{Name: "example.OrderSagaV1", Versions: []VersionDefinition{{Version: 1, Type: "example.OrderSagaV1"}, {Version: 2, Type: "example.OrderSagaV2"}}},
+		}, registry.Definitions())
+	})
+}
@@ -0,0 +1,200 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/component"
+	"github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/testing/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type orderSaga struct {
+	saga.BaseSaga
+	OrderID string `json:"order_id"`
+	Charged bool   `json:"charged"`
+}
+
+func (o *orderSaga) Init() {
+	o.AddEventHandler(&paymentCharged{}, o.HandlePaymentCharged)
+}
+
+func (o *orderSaga) Start(sagaCtx saga.SagaContext) error {
+	sagaCtx.Dispatch(&chargeCommand{OrderID: o.OrderID})
+	return nil
+}
+
+func (o *orderSaga) Compensate(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (o *orderSaga) Recover(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (o *orderSaga) HandlePaymentCharged(sagaCtx saga.SagaContext) error {
+	o.Charged = true
+	sagaCtx.SagaInstance().Complete()
+	return nil
+}
+
+// checkoutSaga charges an order by a child orderSaga
+type checkoutSaga struct {
+	saga.BaseSaga
+	OrderID  string `json:"order_id"`
+	ChildUID string `json:"child_uid"`
+}
+
+func (c *checkoutSaga) Init() {
+	c.AddEventHandler(&contracts.SagaChildCompletedEvent{}, c.HandleChildCompleted)
+}
+
+func (c *checkoutSaga) Start(sagaCtx saga.SagaContext) error {
+	c.ChildUID = sagaCtx.StartChildSaga(&orderSaga{OrderID: c.OrderID})
+	return nil
+}
+
+func (c *checkoutSaga) Compensate(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (c *checkoutSaga) Recover(sagaCtx saga.SagaContext) error {
+	return nil
+}
+
+func (c *checkoutSaga) HandleChildCompleted(sagaCtx saga.SagaContext) error {
+	if sagaCtx.Message().Payload().(*contracts.SagaChildCompletedEvent).SagaUID == c.ChildUID {
+		sagaCtx.SagaInstance().Complete()
+	}
+
+	return nil
+}
+
+type chargeCommand struct {
+	message.ObjectMeta
+	message.Command
+	OrderID string `json:"order_id"`
+}
+
+type paymentCharged struct {
+	message.ObjectMeta
+	OrderID string `json:"order_id"`
+}
+
+// newOrderingBus creates a message bus running orderSaga, charge commands are handled by the same bus
+func newOrderingBus(t *testing.T, tr *Transport) (*foreman.MessageBus, endpoint.Endpoint, *saga.Store) {
+	ctx := context.Background()
+
+	registry := scheme.NewKnownTypesRegistry()
+	registry.AddKnownTypes("orders", &orderSaga{}, &checkoutSaga{}, &chargeCommand{}, &paymentCharged{})
+	marshaller := message.NewJsonMarshaller(registry)
+
+	require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("sagas", true, false, false, false)))
+	sagaEndpoint := endpoint.NewAmqpEndpoint("sagas", tr, transport.DeliveryDestination{RoutingKey: "sagas"}, marshaller, endpoint.WithDelayedExchange())
+
+	var store saga.Store
+	sagaComponent := component.NewSagaComponent(func(msgMarshaller message.Marshaller) (saga.Store, error) {
+		var err error
+		store, err = NewStore(msgMarshaller)
+		return store, err
+	}, NewNoopMutex())
+	sagaComponent.RegisterSagas(&orderSaga{}, &checkoutSaga{})
+	sagaComponent.RegisterContracts(&chargeCommand{}, &paymentCharged{})
+	sagaComponent.RegisterSagaEndpoints(sagaEndpoint)
+
+	mBus, err := foreman.NewMessageBus(log.NewNilLogger(), marshaller, registry, foreman.DefaultSubscriber(tr), foreman.WithComponents(sagaComponent))
+	require.NoError(t, err)
+
+	mBus.Dispatcher().HandleCommand(&chargeCommand{}, func(execCtx execution.MessageExecutionCtx) error {
+		cmd := execCtx.Message().Payload().(*chargeCommand)
+		return execCtx.Send(message.NewOutcomingMessage(&paymentCharged{OrderID: cmd.OrderID}, message.WithHeaders(execCtx.Message().Headers())))
+	})
+
+	return mBus, sagaEndpoint, &store
+}
+
+func startOrderSaga(t *testing.T, sagaEndpoint endpoint.Endpoint, sagaUID string) {
+	startCmd := &contracts.StartSagaCommand{SagaUID: sagaUID, Saga: &orderSaga{OrderID: sagaUID}}
+	require.NoError(t, sagaEndpoint.Send(context.Background(), message.NewOutcomingMessage(startCmd)))
+}
+
+func assertCompleted(t *testing.T, store saga.Store, sagaUID string) {
+	sagaInstance, err := store.GetById(context.Background(), sagaUID)
+	require.NoError(t, err)
+	require.NotNil(t, sagaInstance)
+	assert.True(t, sagaInstance.Status().Completed())
+	assert.True(t, sagaInstance.Saga().(*orderSaga).Charged)
+	assert.Len(t, sagaInstance.HistoryEvents(), 3, "start command, charge command and payment charged event")
+}
+
+func TestSagaFlow(t *testing.T) {
+	t.Run("synchronously", func(t *testing.T) {
+		tr := NewTransport()
+		mBus, sagaEndpoint, store := newOrderingBus(t, tr)
+
+		startOrderSaga(t, sagaEndpoint, "order-1")
+		require.NoError(t, tr.Drain(context.Background(), mBus.Processor()))
+
+		assertCompleted(t, *store, "order-1")
+
+		lock, err := mBus.WorkerMutex().Lock(context.Background(), "relay")
+		require.NoError(t, err, "workers lease locks of the saga mutex")
+		require.NoError(t, lock.Release(context.Background()))
+	})
+
+	t.Run("by subscriber", func(t *testing.T) {
+		tr := NewTransport()
+		mBus, sagaEndpoint, store := newOrderingBus(t, tr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		subscribed := make(chan error, 1)
+		go func() {
+			subscribed <- mBus.Subscriber().Run(ctx, amqp.Queue("sagas", true, false, false, false))
+		}()
+
+		startOrderSaga(t, sagaEndpoint, "order-1")
+		startOrderSaga(t, sagaEndpoint, "order-2")
+		require.NoError(t, tr.WaitIdle(ctx))
+
+		assertCompleted(t, *store, "order-1")
+		assertCompleted(t, *store, "order-2")
+
+		cancel()
+		<-subscribed
+	})
+}
+
+func TestChildSaga(t *testing.T) {
+	tr := NewTransport()
+	mBus, sagaEndpoint, store := newOrderingBus(t, tr)
+	ctx := context.Background()
+
+	startCmd := &contracts.StartSagaCommand{SagaUID: "checkout-1", Saga: &checkoutSaga{OrderID: "order-1"}}
+	require.NoError(t, sagaEndpoint.Send(ctx, message.NewOutcomingMessage(startCmd)))
+	require.NoError(t, tr.Drain(ctx, mBus.Processor()))
+
+	parent, err := (*store).GetById(ctx, "checkout-1")
+	require.NoError(t, err)
+	require.NotNil(t, parent)
+	assert.True(t, parent.Status().Completed(), "parent completes once its child completes")
+
+	childUID := parent.Saga().(*checkoutSaga).ChildUID
+	assertCompleted(t, *store, childUID)
+
+	child, err := (*store).GetById(ctx, childUID)
+	require.NoError(t, err)
+	assert.Equal(t, "checkout-1", child.ParentID())
+}
@@ -0,0 +1,67 @@
+package inmemory
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/transport"
+)
+
+// inPkg is a package in a queue of Transport, it's delivered again if it's nacked or rejected with transport.WithRequeue
+type inPkg struct {
+	transport    *Transport
+	queue        string
+	seq          uint64
+	payload      []byte
+	headers      map[string]interface{}
+	publishedAt  time.Time
+	receivedAt   time.Time
+	acknowledged bool
+}
+
+func (p *inPkg) UID() string {
+	uid, _ := p.headers["uid"].(string)
+	return uid
+}
+
+func (p *inPkg) Origin() string {
+	return p.queue
+}
+
+func (p *inPkg) Payload() []byte {
+	return p.payload
+}
+
+func (p *inPkg) Headers() map[string]interface{} {
+	return p.headers
+}
+
+func (p *inPkg) Ack(options ...transport.AcknowledgmentOption) error {
+	return p.transport.acknowledge(p, false)
+}
+
+func (p *inPkg) Nack(options ...transport.AcknowledgmentOption) error {
+	return p.transport.acknowledge(p, requeue(options))
+}
+
+func (p *inPkg) Reject(options ...transport.AcknowledgmentOption) error {
+	return p.transport.acknowledge(p, requeue(options))
+}
+
+func (p *inPkg) ReceivedAt() time.Time {
+	return p.receivedAt
+}
+
+func (p *inPkg) PublishedAt() time.Time {
+	return p.publishedAt
+}
+
+func requeue(options []transport.AcknowledgmentOption) bool {
+	opts := make(map[string]interface{})
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	requeue, _ := opts["requeue"].(bool)
+
+	return requeue
+}
@@ -0,0 +1,39 @@
+package inmemory
+
+import (
+	"context"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/mutex"
+)
+
+// NewStore creates a saga store kept in memory, see saga.NewMemoryStore. It matches component.StoreFactory:
+//
+//	component.NewSagaComponent(inmemory.NewStore, inmemory.NewNoopMutex())
+func NewStore(msgMarshaller message.Marshaller) (saga.Store, error) {
+	return saga.NewMemoryStore(msgMarshaller), nil
+}
+
+// NewNoopMutex creates a mutex which never blocks. Events of a saga handled at the same time are still caught by versions
+// of the store, one of them fails with saga.VersionConflictErr and is redelivered.
+func NewNoopMutex() mutex.Mutex {
+	return noopMutex{}
+}
+
+type noopMutex struct{}
+
+func (noopMutex) Lock(ctx context.Context, sagaId string) (mutex.Lock, error) {
+	return noopLock{}, nil
+}
+
+type noopLock struct{}
+
+func (noopLock) Release(ctx context.Context) error {
+	return nil
+}
+
+// Renew never fails, so workers of a bus leasing the mutex (see foreman.WithWorkerMutex) run until they are stopped
+func (noopLock) Renew(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,423 @@
+// Package inmemory runs a message bus and sagas without a broker and a database, e.g. in integration tests of a service
+// or on a laptop. Transport loops sent packages back to queues bound to their destinations, NewStore keeps sagas in memory
+// and NewNoopMutex doesn't lock anything, so a whole flow from StartSagaCommand to a completed saga runs in one process.
+package inmemory
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/subscriber"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/pkg/errors"
+)
+
+// Transport is transport.Transport which keeps queues in memory. A package sent to a topic is put into every queue bound
+// to the topic with a matching binding key, AMQP topic wildcards * and # are supported. A package sent with an empty topic
+// goes into the queue named by its routing key. Packages delayed by endpoint.WithDelay or endpoint.WithDeliverAt are put
+// into queues once their publishedAt passes, create endpoints with endpoint.WithDelayedExchange, so they don't wait for the delay.
+//
+// Packages are received either asynchronously, by a subscriber consuming the queues (use WaitIdle to wait until they are
+// handled), or synchronously, by Drain processing them in the calling goroutine.
+type Transport struct {
+	mutex   sync.Mutex
+	topics  map[string]struct{}
+	queues  map[string]*queue
+	seq     uint64
+	active  int
+	changed chan struct{}
+	timers  map[*time.Timer]struct{}
+}
+
+type queue struct {
+	name    string
+	binds   []transport.QueueBind
+	pending []*inPkg
+	ready   chan struct{}
+}
+
+// NewTransport creates an empty Transport, queues and topics are created by CreateQueue and CreateTopic as usual
+func NewTransport() *Transport {
+	return &Transport{
+		topics:  make(map[string]struct{}),
+		queues:  make(map[string]*queue),
+		changed: make(chan struct{}),
+		timers:  make(map[*time.Timer]struct{}),
+	}
+}
+
+func (t *Transport) CreateTopic(ctx context.Context, topic transport.Topic) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.topics[topic.Name()] = struct{}{}
+
+	return nil
+}
+
+// CreateQueue creates the queue or adds bindings to an existing one
+func (t *Transport) CreateQueue(ctx context.Context, q transport.Queue, queueBinds ...transport.QueueBind) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, bind := range queueBinds {
+		if _, exists := t.topics[bind.DestinationTopic()]; !exists {
+			return errors.Errorf("binding queue %s to topic %s which doesn't exist", q.Name(), bind.DestinationTopic())
+		}
+	}
+
+	existing, exists := t.queues[q.Name()]
+	if !exists {
+		existing = &queue{name: q.Name(), ready: make(chan struct{}, 1)}
+		t.queues[q.Name()] = existing
+	}
+
+	existing.binds = append(existing.binds, queueBinds...)
+
+	return nil
+}
+
+// Consume sends packages of the queues into the returned channel until ctx is done
+func (t *Transport) Consume(ctx context.Context, queues []transport.Queue, options ...transport.ConsumeOpt) (<-chan transport.IncomingPkg, error) {
+	t.mutex.Lock()
+	consumed := make([]*queue, 0, len(queues))
+
+	for _, q := range queues {
+		existing, exists := t.queues[q.Name()]
+		if !exists {
+			t.mutex.Unlock()
+			return nil, errors.Errorf("queue %s doesn't exist", q.Name())
+		}
+
+		consumed = append(consumed, existing)
+	}
+	t.mutex.Unlock()
+
+	pkgs := make(chan transport.IncomingPkg)
+	wg := sync.WaitGroup{}
+
+	for _, q := range consumed {
+		wg.Add(1)
+
+		go func(q *queue) {
+			defer wg.Done()
+
+			for {
+				if pkg := t.pop(q); pkg != nil {
+					select {
+					case pkgs <- pkg:
+						continue
+					case <-ctx.Done():
+						t.requeue(pkg)
+						return
+					}
+				}
+
+				select {
+				case <-q.ready:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(q)
+	}
+
+	go func() {
+		wg.Wait()
+		close(pkgs)
+	}()
+
+	return pkgs, nil
+}
+
+func (t *Transport) Send(ctx context.Context, outboundPkg transport.OutboundPkg, options ...transport.SendOpt) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queues, err := t.route(outboundPkg.Destination())
+	if err != nil {
+		return err
+	}
+
+	// endpoints set publishedAt to the time a delayed message becomes available for consumers
+	var delay time.Duration
+	if publishedAt, ok := message.Headers(outboundPkg.Headers()).PublishedAt(); ok {
+		delay = time.Until(publishedAt)
+	}
+
+	for _, q := range queues {
+		pkg := &inPkg{transport: t, queue: q.name, payload: outboundPkg.Payload(), headers: copyHeaders(outboundPkg.Headers()), publishedAt: time.Now().Add(delay)}
+		t.active++
+
+		if delay <= 0 {
+			t.push(q, pkg)
+			continue
+		}
+
+		t.pushLater(q, pkg, delay)
+	}
+
+	return nil
+}
+
+// SendBatch sends packages one by one, it fails only for packages sent to topics or queues which don't exist
+func (t *Transport) SendBatch(ctx context.Context, outboundPkgs []transport.OutboundPkg, options ...transport.SendOpt) error {
+	failed := make(map[int]error)
+
+	for i, pkg := range outboundPkgs {
+		if err := t.Send(ctx, pkg, options...); err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return transport.WithBatchErr(errors.Errorf("%d of %d packages aren't sent", len(failed), len(outboundPkgs)), failed)
+	}
+
+	return nil
+}
+
+// Disconnect stops delivering delayed packages, queued packages are kept
+func (t *Transport) Disconnect(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for timer := range t.timers {
+		if timer.Stop() {
+			t.settle()
+		}
+	}
+
+	t.timers = make(map[*time.Timer]struct{})
+
+	return nil
+}
+
+// Drain processes packages which are ready in all queues in the calling goroutine, including packages sent while they are
+// processed, until none is left. Packages are processed in the order they were put into queues and acked once processed.
+// Drain stops on the first package the processor fails, the package is rejected and its error is returned.
+// Delayed packages which aren't ready yet are left for later calls.
+func (t *Transport) Drain(ctx context.Context, processor subscriber.Processor) error {
+	for ctx.Err() == nil {
+		pkg := t.popOldest()
+		if pkg == nil {
+			return nil
+		}
+
+		if err := processor.Process(ctx, pkg); err != nil {
+			_ = pkg.Reject()
+			return errors.Wrapf(err, "processing package %s from %s", pkg.UID(), pkg.Origin())
+		}
+
+		_ = pkg.Ack()
+	}
+
+	return ctx.Err()
+}
+
+// WaitIdle waits until every sent package is acked, rejected or nacked without requeue, delayed ones included.
+// A package which a subscriber failed to process is never acked, so WaitIdle returns ctx error in that case.
+func (t *Transport) WaitIdle(ctx context.Context) error {
+	for {
+		t.mutex.Lock()
+		active, changed := t.active, t.changed
+		t.mutex.Unlock()
+
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for %d packages", active)
+		}
+	}
+}
+
+// Pending returns the number of packages in the queue which aren't received yet
+func (t *Transport) Pending(queueName string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if q, exists := t.queues[queueName]; exists {
+		return len(q.pending)
+	}
+
+	return 0
+}
+
+// route returns queues the package sent to the destination goes into, must be called under the lock
+func (t *Transport) route(destination transport.DeliveryDestination) ([]*queue, error) {
+	if destination.DestinationTopic == "" {
+		q, exists := t.queues[destination.RoutingKey]
+		if !exists {
+			return nil, errors.Errorf("queue %s doesn't exist", destination.RoutingKey)
+		}
+
+		return []*queue{q}, nil
+	}
+
+	if _, exists := t.topics[destination.DestinationTopic]; !exists {
+		return nil, errors.Errorf("topic %s doesn't exist", destination.DestinationTopic)
+	}
+
+	var queues []*queue
+
+	for _, q := range t.queues {
+		for _, bind := range q.binds {
+			if bind.DestinationTopic() == destination.DestinationTopic && matchRoutingKey(bind.BindingKey(), destination.RoutingKey) {
+				queues = append(queues, q)
+				break
+			}
+		}
+	}
+
+	return queues, nil
+}
+
+func (t *Transport) push(q *queue, pkg *inPkg) {
+	t.seq++
+	pkg.seq = t.seq
+	q.pending = append(q.pending, pkg)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Transport) pushLater(q *queue, pkg *inPkg, delay time.Duration) {
+	var timer *time.Timer
+
+	timer = time.AfterFunc(delay, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if _, scheduled := t.timers[timer]; !scheduled {
+			return
+		}
+
+		delete(t.timers, timer)
+		t.push(q, pkg)
+	})
+
+	t.timers[timer] = struct{}{}
+}
+
+func (t *Transport) pop(q *queue) *inPkg {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+
+	pkg := q.pending[0]
+	q.pending = q.pending[1:]
+	pkg.receivedAt = time.Now()
+
+	return pkg
+}
+
+// popOldest takes the package which was put into any of queues first
+func (t *Transport) popOldest() *inPkg {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var oldest *queue
+
+	for _, q := range t.queues {
+		if len(q.pending) > 0 && (oldest == nil || q.pending[0].seq < oldest.pending[0].seq) {
+			oldest = q
+		}
+	}
+
+	if oldest == nil {
+		return nil
+	}
+
+	pkg := oldest.pending[0]
+	oldest.pending = oldest.pending[1:]
+	pkg.receivedAt = time.Now()
+
+	return pkg
+}
+
+// requeue puts the package back into its queue to be delivered again
+func (t *Transport) requeue(pkg *inPkg) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if q, exists := t.queues[pkg.queue]; exists {
+		t.push(q, pkg)
+	}
+}
+
+// settle marks a package as done and wakes up WaitIdle, must be called under the lock
+func (t *Transport) settle() {
+	t.active--
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *Transport) acknowledge(pkg *inPkg, requeue bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if pkg.acknowledged {
+		return errors.Errorf("package %s is already acknowledged", pkg.UID())
+	}
+
+	if requeue {
+		if q, exists := t.queues[pkg.queue]; exists {
+			t.push(q, pkg)
+			return nil
+		}
+	}
+
+	pkg.acknowledged = true
+	t.settle()
+
+	return nil
+}
+
+// matchRoutingKey matches a routing key against an AMQP topic binding key: * substitutes a word, # substitutes zero or more words
+func matchRoutingKey(bindingKey, routingKey string) bool {
+	return matchWords(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+var _ transport.Transport = (*Transport)(nil)
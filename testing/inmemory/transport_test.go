@@ -0,0 +1,169 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/transport"
+	"github.com/go-foreman/foreman/pubsub/transport/amqp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type processorFunc func(ctx context.Context, inPkg transport.IncomingPkg) error
+
+func (f processorFunc) Process(ctx context.Context, inPkg transport.IncomingPkg) error {
+	return f(ctx, inPkg)
+}
+
+func outboundPkg(uid string, destination transport.DeliveryDestination) transport.OutboundPkg {
+	headers := message.Headers{"uid": uid}
+	headers.SetPublishedAt(time.Now())
+
+	return transport.NewOutboundPkg([]byte(uid), "application/json", destination, headers)
+}
+
+func TestTransport(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("routing", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateTopic(ctx, amqp.Topic("events", true, false, false, false)))
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("orders", true, false, false, false), amqp.QueueBind("events", "orders.*", false)))
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("audit", true, false, false, false), amqp.QueueBind("events", "#", false)))
+
+		assert.EqualError(t, tr.CreateQueue(ctx, amqp.Queue("lost", true, false, false, false), amqp.QueueBind("unknown", "#", false)), "binding queue lost to topic unknown which doesn't exist")
+
+		require.NoError(t, tr.Send(ctx, outboundPkg("1", transport.DeliveryDestination{DestinationTopic: "events", RoutingKey: "orders.created"})))
+		require.NoError(t, tr.Send(ctx, outboundPkg("2", transport.DeliveryDestination{DestinationTopic: "events", RoutingKey: "payments.charged.eu"})))
+		require.NoError(t, tr.Send(ctx, outboundPkg("3", transport.DeliveryDestination{RoutingKey: "orders"})))
+
+		assert.Equal(t, 2, tr.Pending("orders"))
+		assert.Equal(t, 2, tr.Pending("audit"))
+
+		assert.EqualError(t, tr.Send(ctx, outboundPkg("4", transport.DeliveryDestination{DestinationTopic: "unknown"})), "topic unknown doesn't exist")
+		assert.EqualError(t, tr.Send(ctx, outboundPkg("5", transport.DeliveryDestination{RoutingKey: "unknown"})), "queue unknown doesn't exist")
+
+		err := tr.SendBatch(ctx, []transport.OutboundPkg{
+			outboundPkg("6", transport.DeliveryDestination{RoutingKey: "orders"}),
+			outboundPkg("7", transport.DeliveryDestination{RoutingKey: "unknown"}),
+		})
+		require.Error(t, err)
+		batchErr, ok := err.(transport.BatchErr)
+		require.True(t, ok)
+		assert.Equal(t, []int{1}, batchErr.FailedIndexes())
+	})
+
+	t.Run("drain processes packages in order they are sent", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("first", true, false, false, false)))
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("second", true, false, false, false)))
+
+		require.NoError(t, tr.Send(ctx, outboundPkg("1", transport.DeliveryDestination{RoutingKey: "second"})))
+		require.NoError(t, tr.Send(ctx, outboundPkg("2", transport.DeliveryDestination{RoutingKey: "first"})))
+
+		var processed []string
+		err := tr.Drain(ctx, processorFunc(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+			processed = append(processed, inPkg.UID())
+
+			if inPkg.UID() == "1" {
+				return tr.Send(ctx, outboundPkg("3", transport.DeliveryDestination{RoutingKey: "first"}))
+			}
+
+			return nil
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1", "2", "3"}, processed)
+		require.NoError(t, tr.WaitIdle(ctx))
+	})
+
+	t.Run("drain stops on failed package", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("orders", true, false, false, false)))
+		require.NoError(t, tr.Send(ctx, outboundPkg("1", transport.DeliveryDestination{RoutingKey: "orders"})))
+		require.NoError(t, tr.Send(ctx, outboundPkg("2", transport.DeliveryDestination{RoutingKey: "orders"})))
+
+		err := tr.Drain(ctx, processorFunc(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+			return errors.New("no executors")
+		}))
+		assert.EqualError(t, err, "processing package 1 from orders: no executors")
+		assert.Equal(t, 1, tr.Pending("orders"))
+	})
+
+	t.Run("requeued package is delivered again", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("orders", true, false, false, false)))
+		require.NoError(t, tr.Send(ctx, outboundPkg("1", transport.DeliveryDestination{RoutingKey: "orders"})))
+
+		consumeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		pkgs, err := tr.Consume(consumeCtx, []transport.Queue{amqp.Queue("orders", true, false, false, false)})
+		require.NoError(t, err)
+
+		first := <-pkgs
+		require.NoError(t, first.Nack(transport.WithRequeue()))
+
+		redelivered := <-pkgs
+		assert.Equal(t, "1", redelivered.UID())
+		assert.Equal(t, "orders", redelivered.Origin())
+		require.NoError(t, redelivered.Ack())
+		assert.EqualError(t, redelivered.Ack(), "package 1 is already acknowledged")
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+		defer waitCancel()
+		require.NoError(t, tr.WaitIdle(waitCtx))
+	})
+
+	t.Run("delayed package", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("orders", true, false, false, false)))
+
+		headers := message.Headers{"uid": "1"}
+		headers.SetPublishedAt(time.Now().Add(time.Millisecond * 50))
+		require.NoError(t, tr.Send(ctx, transport.NewOutboundPkg(nil, "application/json", transport.DeliveryDestination{RoutingKey: "orders"}, headers)))
+		assert.Equal(t, 0, tr.Pending("orders"))
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*10)
+		defer waitCancel()
+		assert.EqualError(t, tr.WaitIdle(waitCtx), "waiting for 1 packages: context deadline exceeded")
+
+		require.Eventually(t, func() bool {
+			return tr.Pending("orders") == 1
+		}, time.Second, time.Millisecond*10)
+
+		require.NoError(t, tr.Drain(ctx, processorFunc(func(ctx context.Context, inPkg transport.IncomingPkg) error {
+			return nil
+		})))
+		require.NoError(t, tr.WaitIdle(ctx))
+	})
+
+	t.Run("disconnect drops delayed packages", func(t *testing.T) {
+		tr := NewTransport()
+		require.NoError(t, tr.CreateQueue(ctx, amqp.Queue("orders", true, false, false, false)))
+
+		headers := message.Headers{"uid": "1"}
+		headers.SetPublishedAt(time.Now().Add(time.Hour))
+		require.NoError(t, tr.Send(ctx, transport.NewOutboundPkg(nil, "application/json", transport.DeliveryDestination{RoutingKey: "orders"}, headers)))
+
+		require.NoError(t, tr.Disconnect(ctx))
+		require.NoError(t, tr.WaitIdle(ctx))
+	})
+}
+
+func TestMatchRoutingKey(t *testing.T) {
+	for bindingKey, routingKeys := range map[string]map[string]bool{
+		"orders.created": {"orders.created": true, "orders.deleted": false, "orders": false},
+		"orders.*":       {"orders.created": true, "orders": false, "orders.created.eu": false},
+		"orders.#":       {"orders": true, "orders.created": true, "orders.created.eu": true, "payments.created": false},
+		"#.eu":           {"eu": true, "orders.created.eu": true, "orders.created": false},
+		"*.*.eu":         {"orders.created.eu": true, "orders.eu": false},
+	} {
+		for routingKey, matches := range routingKeys {
+			assert.Equal(t, matches, matchRoutingKey(bindingKey, routingKey), "%s matching %s", bindingKey, routingKey)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/go-foreman/foreman/saga/filter"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (p *pgStoreTest) TestPGStoreFilter() {
+	testSQLStoreFilter(p.T(), newFilterStore(p.T(), p.Connection(), saga.PGDriver))
+}
+
+func (m *mysqlStoreTest) TestMysqlStoreFilter() {
+	testSQLStoreFilter(m.T(), newFilterStore(m.T(), m.Connection(), saga.MYSQLDriver))
+}
+
+func newFilterStore(t *testing.T, connection *sql.DB, driver saga.SQLDriver) saga.Store {
+	schemeRegistry := scheme.NewKnownTypesRegistry()
+	schemeRegistry.AddKnownTypes(testGroup, &WorkflowSaga{})
+	schemeRegistry.AddKnownTypes(testGroup, &FilterSaga{})
+
+	store, err := saga.NewSQLSagaStore(sagaSql.NewDB(connection), driver, message.NewJsonMarshaller(schemeRegistry))
+	require.NoError(t, err)
+
+	return store
+}
+
+// testSQLStoreFilter checks that the store selects the same sagas as saga.MatchFilter for every predicate of the filter package
+func testSQLStoreFilter(t *testing.T, store saga.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	parentID := uuid.New().String()
+
+	created := saga.NewSagaInstance(uuid.New().String(), "", &WorkflowSaga{Field: "created"})
+
+	started := saga.NewSagaInstance(uuid.New().String(), parentID, &WorkflowSaga{Field: "started"})
+	require.NoError(t, started.Start(nil))
+	require.NoError(t, started.AddEntityRef(saga.EntityRef{Kind: "order", ID: parentID}))
+
+	completed := saga.NewSagaInstance(uuid.New().String(), parentID, &FilterSaga{})
+	require.NoError(t, completed.Start(nil))
+	completed.Complete()
+
+	fixtures := make([]saga.Instance, 0, 3)
+	uids := make([]string, 0, 3)
+
+	for _, instance := range []saga.Instance{created, started, completed} {
+		require.NoError(t, store.Create(ctx, instance))
+
+		// times are compared as the store keeps them
+		stored, err := store.GetById(ctx, instance.UID())
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+
+		fixtures = append(fixtures, stored)
+		uids = append(uids, instance.UID())
+	}
+
+	defer func() {
+		for _, uid := range uids {
+			assert.NoError(t, store.Delete(context.Background(), uid))
+		}
+	}()
+
+	startedAt := *fixtures[1].StartedAt()
+
+	predicates := map[string]filter.Expr{
+		"saga id":             filter.SagaID(created.UID(), completed.UID()),
+		"status":              filter.StatusIn("in_progress", "completed"),
+		"name":                filter.Name("testgroup.FilterSaga"),
+		"parent id":           filter.ParentID(parentID),
+		"started from":        filter.StartedFrom(startedAt),
+		"started before":      filter.StartedBefore(startedAt.Add(time.Second)),
+		"updated from":        filter.UpdatedFrom(startedAt),
+		"updated before":      filter.UpdatedBefore(startedAt.Add(time.Second)),
+		"entity ref":          filter.EntityRef("order", parentID),
+		"or":                  filter.Or(filter.StatusIn("created"), filter.Name("testgroup.FilterSaga")),
+		"not":                 filter.Not(filter.ParentID(parentID)),
+		"not started before":  filter.Not(filter.StartedBefore(startedAt.Add(time.Second))),
+		"not entity ref":      filter.Not(filter.EntityRef("order", parentID)),
+		"excluded ids":        filter.Not(filter.SagaID(started.UID())),
+		"empty or":            filter.Or(),
+		"and of alternatives": filter.And(filter.Or(filter.StatusIn("completed"), filter.EntityRef("order", parentID)), filter.Not(filter.Name("testgroup.FilterSaga"))),
+	}
+
+	for name, predicate := range predicates {
+		t.Run(name, func(t *testing.T) {
+			// fixtures are the only sagas a query may select, other tests share the table
+			where := filter.And(filter.SagaID(uids...), predicate)
+
+			batch, err := store.GetByFilter(ctx, saga.WithFilter(where))
+			require.NoError(t, err)
+
+			var expected, selected []string
+
+			for _, instance := range fixtures {
+				if saga.MatchFilter(where, instance) {
+					expected = append(expected, instance.UID())
+				}
+			}
+
+			for _, instance := range batch.Items {
+				selected = append(selected, instance.UID())
+			}
+
+			sort.Strings(expected)
+			sort.Strings(selected)
+
+			assert.Equal(t, expected, selected, where.String())
+			assert.Equal(t, len(expected), batch.Total)
+		})
+	}
+}
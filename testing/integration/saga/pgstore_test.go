@@ -35,4 +35,15 @@ func (p *pgStoreTest) TestPGStore() {
 	require.NotNil(t, pgStore)
 
 	testSQLStoreUseCases(t, pgStore, schemeRegistry, p.Connection())
+
+	t.Run("payload columns are jsonb", func(t *testing.T) {
+		var dataType string
+		err := p.Connection().QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'saga' AND column_name = 'payload';").Scan(&dataType)
+		require.NoError(t, err)
+		require.Equal(t, "jsonb", dataType)
+
+		err = p.Connection().QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'saga_history' AND column_name = 'payload';").Scan(&dataType)
+		require.NoError(t, err)
+		require.Equal(t, "jsonb", dataType)
+	})
 }
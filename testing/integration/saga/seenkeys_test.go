@@ -0,0 +1,133 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/saga"
+	sagaSql "github.com/go-foreman/foreman/saga/sql"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (p *pgStoreTest) TestPGSeenKeys() {
+	seenKeys, err := saga.NewSQLSeenKeys(sagaSql.NewDB(p.Connection()), saga.PGDriver)
+	require.NoError(p.T(), err)
+
+	testSQLSeenKeys(p.T(), seenKeys)
+}
+
+func (m *mysqlStoreTest) TestMysqlSeenKeys() {
+	seenKeys, err := saga.NewSQLSeenKeys(sagaSql.NewDB(m.Connection()), saga.MYSQLDriver)
+	require.NoError(m.T(), err)
+
+	testSQLSeenKeys(m.T(), seenKeys)
+}
+
+func testSQLSeenKeys(t *testing.T, seenKeys *saga.SQLSeenKeys) {
+	ctx := context.Background()
+
+	t.Run("replicas racing for the same key", func(t *testing.T) {
+		key := uuid.New().String()
+		replicas := 10
+
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+			sent int
+		)
+
+		for i := 0; i < replicas; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				alreadySent, err := seenKeys.MarkSent(ctx, key, time.Minute)
+				assert.NoError(t, err, "contention on the unique index is not an error")
+
+				if !alreadySent {
+					lock.Lock()
+					sent++
+					lock.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+		assert.Equal(t, 1, sent)
+	})
+
+	t.Run("expired key is taken over and deleted by janitor", func(t *testing.T) {
+		key := uuid.New().String()
+
+		alreadySent, err := seenKeys.MarkSent(ctx, key, -time.Minute)
+		require.NoError(t, err)
+		require.False(t, alreadySent)
+
+		alreadySent, err = seenKeys.MarkSent(ctx, key, -time.Minute)
+		require.NoError(t, err)
+		assert.False(t, alreadySent)
+
+		deleted, err := seenKeys.DeleteExpired(ctx, time.Now())
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, deleted, 1)
+	})
+
+	t.Run("forgotten key can be sent again", func(t *testing.T) {
+		key := uuid.New().String()
+
+		_, err := seenKeys.MarkSent(ctx, key, time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, seenKeys.Forget(ctx, key))
+
+		alreadySent, err := seenKeys.MarkSent(ctx, key, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, alreadySent)
+	})
+}
+
+// BenchmarkSQLSeenKeys quantifies latency WithIdempotencyKey with SharedScope adds to each send, it's a roundtrip to postgres.
+// Compare with BenchmarkAmqpEndpointIdempotency of pubsub/endpoint.
+func BenchmarkSQLSeenKeys(b *testing.B) {
+	connectionStr := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", "foreman", "foreman", "127.0.0.1:5432", "foreman")
+
+	if v := os.Getenv("PG_CONNECTION"); v != "" {
+		connectionStr = v
+	}
+
+	db, err := sql.Open("pgx", connectionStr)
+	require.NoError(b, err)
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		b.Skipf("postgres is not available: %s", err)
+	}
+
+	seenKeys, err := saga.NewSQLSeenKeys(sagaSql.NewDB(db), saga.PGDriver)
+	require.NoError(b, err)
+
+	ctx := context.Background()
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = uuid.New().String()
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := seenKeys.MarkSent(ctx, keys[i], time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	_, err = seenKeys.DeleteExpired(ctx, time.Now().Add(time.Hour))
+	require.NoError(b, err)
+}
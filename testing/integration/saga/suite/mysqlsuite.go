@@ -39,7 +39,7 @@ func (s *MysqlSuite) Connection() *sql.DB {
 
 // TearDownSuite teardown at the end of test
 func (s *MysqlSuite) TearDownSuite() {
-	res, err := s.dbConn.Exec("DROP TABLE IF EXISTS saga_history, saga;")
+	res, err := s.dbConn.Exec("DROP TABLE IF EXISTS saga_history, saga_entity_ref, saga_correlation, saga, idempotency_key;")
 	require.NoError(s.T(), err)
 	require.NotNil(s.T(), res)
 	require.NoError(s.T(), s.dbConn.Close())
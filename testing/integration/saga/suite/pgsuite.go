@@ -46,7 +46,7 @@ func (s *PgSuite) TearDownSuite() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	res, err := s.dbConn.ExecContext(ctx, "DROP TABLE IF EXISTS saga_history, saga;")
+	res, err := s.dbConn.ExecContext(ctx, "DROP TABLE IF EXISTS saga_history, saga_entity_ref, saga_correlation, saga, idempotency_key;")
 	require.NoError(s.T(), err)
 	require.NotNil(s.T(), res)
 	require.NoError(s.T(), s.dbConn.Close())
@@ -10,6 +10,7 @@ import (
 	dispatcher "github.com/go-foreman/foreman/pubsub/dispatcher"
 	message "github.com/go-foreman/foreman/pubsub/message"
 	execution "github.com/go-foreman/foreman/pubsub/message/execution"
+	scheme "github.com/go-foreman/foreman/runtime/scheme"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -36,6 +37,34 @@ func (m *MockDispatcher) EXPECT() *MockDispatcherMockRecorder {
 	return m.recorder
 }
 
+// HandleCommand mocks base method.
+func (m *MockDispatcher) HandleCommand(arg0 message.CommandContract, arg1 execution.Executor) dispatcher.Dispatcher {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleCommand", arg0, arg1)
+	ret0, _ := ret[0].(dispatcher.Dispatcher)
+	return ret0
+}
+
+// HandleCommand indicates an expected call of HandleCommand.
+func (mr *MockDispatcherMockRecorder) HandleCommand(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleCommand", reflect.TypeOf((*MockDispatcher)(nil).HandleCommand), arg0, arg1)
+}
+
+// ListenEvent mocks base method.
+func (m *MockDispatcher) ListenEvent(arg0 message.EventContract, arg1 execution.Executor) dispatcher.Dispatcher {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListenEvent", arg0, arg1)
+	ret0, _ := ret[0].(dispatcher.Dispatcher)
+	return ret0
+}
+
+// ListenEvent indicates an expected call of ListenEvent.
+func (mr *MockDispatcherMockRecorder) ListenEvent(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListenEvent", reflect.TypeOf((*MockDispatcher)(nil).ListenEvent), arg0, arg1)
+}
+
 // Match mocks base method.
 func (m *MockDispatcher) Match(arg0 message.Object) []execution.Executor {
 	m.ctrl.T.Helper()
@@ -91,3 +120,49 @@ func (mr *MockDispatcherMockRecorder) SubscribeForEvent(arg0, arg1 interface{})
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeForEvent", reflect.TypeOf((*MockDispatcher)(nil).SubscribeForEvent), arg0, arg1)
 }
+
+// SubscribeForGroup mocks base method.
+func (m *MockDispatcher) SubscribeForGroup(arg0 scheme.Group, arg1 execution.Executor) dispatcher.Dispatcher {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscribeForGroup", arg0, arg1)
+	ret0, _ := ret[0].(dispatcher.Dispatcher)
+	return ret0
+}
+
+// SubscribeForGroup indicates an expected call of SubscribeForGroup.
+func (mr *MockDispatcherMockRecorder) SubscribeForGroup(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeForGroup", reflect.TypeOf((*MockDispatcher)(nil).SubscribeForGroup), arg0, arg1)
+}
+
+// Unsubscribe mocks base method.
+func (m *MockDispatcher) Unsubscribe(arg0 execution.Executor) dispatcher.Dispatcher {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unsubscribe", arg0)
+	ret0, _ := ret[0].(dispatcher.Dispatcher)
+	return ret0
+}
+
+// Unsubscribe indicates an expected call of Unsubscribe.
+func (mr *MockDispatcherMockRecorder) Unsubscribe(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*MockDispatcher)(nil).Unsubscribe), arg0)
+}
+
+// Use mocks base method.
+func (m *MockDispatcher) Use(arg0 ...dispatcher.Middleware) dispatcher.Dispatcher {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range arg0 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Use", varargs...)
+	ret0, _ := ret[0].(dispatcher.Dispatcher)
+	return ret0
+}
+
+// Use indicates an expected call of Use.
+func (mr *MockDispatcherMockRecorder) Use(arg0 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Use", reflect.TypeOf((*MockDispatcher)(nil).Use), arg0...)
+}
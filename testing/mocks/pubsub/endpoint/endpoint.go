@@ -68,3 +68,22 @@ func (mr *MockEndpointMockRecorder) Send(arg0, arg1 interface{}, arg2 ...interfa
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Send", reflect.TypeOf((*MockEndpoint)(nil).Send), varargs...)
 }
+
+// SendBatch mocks base method.
+func (m *MockEndpoint) SendBatch(arg0 context.Context, arg1 []*message.OutcomingMessage, arg2 ...endpoint.DeliveryOption) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "SendBatch", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendBatch indicates an expected call of SendBatch.
+func (mr *MockEndpointMockRecorder) SendBatch(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendBatch", reflect.TypeOf((*MockEndpoint)(nil).SendBatch), varargs...)
+}
@@ -0,0 +1,65 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/go-foreman/foreman/pubsub/endpoint (interfaces: SeenKeys)
+
+// Package endpoint is a generated GoMock package.
+package endpoint
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockSeenKeys is a mock of SeenKeys interface.
+type MockSeenKeys struct {
+	ctrl     *gomock.Controller
+	recorder *MockSeenKeysMockRecorder
+}
+
+// MockSeenKeysMockRecorder is the mock recorder for MockSeenKeys.
+type MockSeenKeysMockRecorder struct {
+	mock *MockSeenKeys
+}
+
+// NewMockSeenKeys creates a new mock instance.
+func NewMockSeenKeys(ctrl *gomock.Controller) *MockSeenKeys {
+	mock := &MockSeenKeys{ctrl: ctrl}
+	mock.recorder = &MockSeenKeysMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSeenKeys) EXPECT() *MockSeenKeysMockRecorder {
+	return m.recorder
+}
+
+// Forget mocks base method.
+func (m *MockSeenKeys) Forget(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Forget", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Forget indicates an expected call of Forget.
+func (mr *MockSeenKeysMockRecorder) Forget(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Forget", reflect.TypeOf((*MockSeenKeys)(nil).Forget), arg0, arg1)
+}
+
+// MarkSent mocks base method.
+func (m *MockSeenKeys) MarkSent(arg0 context.Context, arg1 string, arg2 time.Duration) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkSent", arg0, arg1, arg2)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MarkSent indicates an expected call of MarkSent.
+func (mr *MockSeenKeysMockRecorder) MarkSent(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkSent", reflect.TypeOf((*MockSeenKeys)(nil).MarkSent), arg0, arg1, arg2)
+}
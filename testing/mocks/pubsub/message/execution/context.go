@@ -117,6 +117,25 @@ func (mr *MockMessageExecutionCtxMockRecorder) Send(arg0 interface{}, arg1 ...in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Send", reflect.TypeOf((*MockMessageExecutionCtx)(nil).Send), varargs...)
 }
 
+// SendBatch mocks base method.
+func (m *MockMessageExecutionCtx) SendBatch(arg0 []*message.OutcomingMessage, arg1 ...endpoint.DeliveryOption) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0}
+	for _, a := range arg1 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "SendBatch", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendBatch indicates an expected call of SendBatch.
+func (mr *MockMessageExecutionCtxMockRecorder) SendBatch(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0}, arg1...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendBatch", reflect.TypeOf((*MockMessageExecutionCtx)(nil).SendBatch), varargs...)
+}
+
 // Valid mocks base method.
 func (m *MockMessageExecutionCtx) Valid() bool {
 	m.ctrl.T.Helper()
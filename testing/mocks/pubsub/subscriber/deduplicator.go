@@ -0,0 +1,65 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/go-foreman/foreman/pubsub/subscriber (interfaces: Deduplicator)
+
+// Package subscriber is a generated GoMock package.
+package subscriber
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockDeduplicator is a mock of Deduplicator interface.
+type MockDeduplicator struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeduplicatorMockRecorder
+}
+
+// MockDeduplicatorMockRecorder is the mock recorder for MockDeduplicator.
+type MockDeduplicatorMockRecorder struct {
+	mock *MockDeduplicator
+}
+
+// NewMockDeduplicator creates a new mock instance.
+func NewMockDeduplicator(ctrl *gomock.Controller) *MockDeduplicator {
+	mock := &MockDeduplicator{ctrl: ctrl}
+	mock.recorder = &MockDeduplicatorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeduplicator) EXPECT() *MockDeduplicatorMockRecorder {
+	return m.recorder
+}
+
+// MarkProcessed mocks base method.
+func (m *MockDeduplicator) MarkProcessed(arg0 context.Context, arg1 string, arg2 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkProcessed", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkProcessed indicates an expected call of MarkProcessed.
+func (mr *MockDeduplicatorMockRecorder) MarkProcessed(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkProcessed", reflect.TypeOf((*MockDeduplicator)(nil).MarkProcessed), arg0, arg1, arg2)
+}
+
+// Processed mocks base method.
+func (m *MockDeduplicator) Processed(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Processed", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Processed indicates an expected call of Processed.
+func (mr *MockDeduplicatorMockRecorder) Processed(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Processed", reflect.TypeOf((*MockDeduplicator)(nil).Processed), arg0, arg1)
+}
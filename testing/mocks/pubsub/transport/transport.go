@@ -120,3 +120,22 @@ func (mr *MockTransportMockRecorder) Send(arg0, arg1 interface{}, arg2 ...interf
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Send", reflect.TypeOf((*MockTransport)(nil).Send), varargs...)
 }
+
+// SendBatch mocks base method.
+func (m *MockTransport) SendBatch(arg0 context.Context, arg1 []transport.OutboundPkg, arg2 ...transport.SendOpt) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "SendBatch", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendBatch indicates an expected call of SendBatch.
+func (mr *MockTransportMockRecorder) SendBatch(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendBatch", reflect.TypeOf((*MockTransport)(nil).SendBatch), varargs...)
+}
@@ -36,6 +36,20 @@ func (m *MockInstance) EXPECT() *MockInstanceMockRecorder {
 	return m.recorder
 }
 
+// AddEntityRef mocks base method.
+func (m *MockInstance) AddEntityRef(arg0 saga.EntityRef) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddEntityRef", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddEntityRef indicates an expected call of AddEntityRef.
+func (mr *MockInstanceMockRecorder) AddEntityRef(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddEntityRef", reflect.TypeOf((*MockInstance)(nil).AddEntityRef), arg0)
+}
+
 // AddHistoryEvent mocks base method.
 func (m *MockInstance) AddHistoryEvent(arg0 message.Object, arg1 *saga.AddHistoryEvent) {
 	m.ctrl.T.Helper()
@@ -48,6 +62,21 @@ func (mr *MockInstanceMockRecorder) AddHistoryEvent(arg0, arg1 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddHistoryEvent", reflect.TypeOf((*MockInstance)(nil).AddHistoryEvent), arg0, arg1)
 }
 
+// ChildCompensated mocks base method.
+func (m *MockInstance) ChildCompensated(arg0 saga.SagaContext, arg1 string, arg2 bool) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChildCompensated", arg0, arg1, arg2)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ChildCompensated indicates an expected call of ChildCompensated.
+func (mr *MockInstanceMockRecorder) ChildCompensated(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChildCompensated", reflect.TypeOf((*MockInstance)(nil).ChildCompensated), arg0, arg1, arg2)
+}
+
 // Compensate mocks base method.
 func (m *MockInstance) Compensate(arg0 saga.SagaContext) error {
 	m.ctrl.T.Helper()
@@ -62,6 +91,18 @@ func (mr *MockInstanceMockRecorder) Compensate(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compensate", reflect.TypeOf((*MockInstance)(nil).Compensate), arg0)
 }
 
+// CompensateChildren mocks base method.
+func (m *MockInstance) CompensateChildren(arg0 []string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "CompensateChildren", arg0)
+}
+
+// CompensateChildren indicates an expected call of CompensateChildren.
+func (mr *MockInstanceMockRecorder) CompensateChildren(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompensateChildren", reflect.TypeOf((*MockInstance)(nil).CompensateChildren), arg0)
+}
+
 // Complete mocks base method.
 func (m *MockInstance) Complete() {
 	m.ctrl.T.Helper()
@@ -74,6 +115,20 @@ func (mr *MockInstanceMockRecorder) Complete() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Complete", reflect.TypeOf((*MockInstance)(nil).Complete))
 }
 
+// EntityRefs mocks base method.
+func (m *MockInstance) EntityRefs() []saga.EntityRef {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EntityRefs")
+	ret0, _ := ret[0].([]saga.EntityRef)
+	return ret0
+}
+
+// EntityRefs indicates an expected call of EntityRefs.
+func (mr *MockInstanceMockRecorder) EntityRefs() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EntityRefs", reflect.TypeOf((*MockInstance)(nil).EntityRefs))
+}
+
 // Fail mocks base method.
 func (m *MockInstance) Fail(arg0 message.Object) {
 	m.ctrl.T.Helper()
@@ -142,6 +197,18 @@ func (mr *MockInstanceMockRecorder) Saga() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Saga", reflect.TypeOf((*MockInstance)(nil).Saga))
 }
 
+// SetVersion mocks base method.
+func (m *MockInstance) SetVersion(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetVersion", arg0)
+}
+
+// SetVersion indicates an expected call of SetVersion.
+func (mr *MockInstanceMockRecorder) SetVersion(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetVersion", reflect.TypeOf((*MockInstance)(nil).SetVersion), arg0)
+}
+
 // Start mocks base method.
 func (m *MockInstance) Start(arg0 saga.SagaContext) error {
 	m.ctrl.T.Helper()
@@ -211,3 +278,17 @@ func (mr *MockInstanceMockRecorder) UpdatedAt() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatedAt", reflect.TypeOf((*MockInstance)(nil).UpdatedAt))
 }
+
+// Version mocks base method.
+func (m *MockInstance) Version() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Version")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Version indicates an expected call of Version.
+func (mr *MockInstanceMockRecorder) Version() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Version", reflect.TypeOf((*MockInstance)(nil).Version))
+}
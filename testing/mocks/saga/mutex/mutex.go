@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/go-foreman/foreman/saga/mutex (interfaces: Mutex,Lock)
+// Source: github.com/go-foreman/foreman/saga/mutex (interfaces: Mutex,Lock,LeasedLock)
 
 // Package mutex is a generated GoMock package.
 package mutex
@@ -86,3 +86,54 @@ func (mr *MockLockMockRecorder) Release(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockLock)(nil).Release), arg0)
 }
+
+// MockLeasedLock is a mock of LeasedLock interface.
+type MockLeasedLock struct {
+	ctrl     *gomock.Controller
+	recorder *MockLeasedLockMockRecorder
+}
+
+// MockLeasedLockMockRecorder is the mock recorder for MockLeasedLock.
+type MockLeasedLockMockRecorder struct {
+	mock *MockLeasedLock
+}
+
+// NewMockLeasedLock creates a new mock instance.
+func NewMockLeasedLock(ctrl *gomock.Controller) *MockLeasedLock {
+	mock := &MockLeasedLock{ctrl: ctrl}
+	mock.recorder = &MockLeasedLockMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockLeasedLock) EXPECT() *MockLeasedLockMockRecorder {
+	return m.recorder
+}
+
+// Context mocks base method.
+func (m *MockLeasedLock) Context() context.Context {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Context")
+	ret0, _ := ret[0].(context.Context)
+	return ret0
+}
+
+// Context indicates an expected call of Context.
+func (mr *MockLeasedLockMockRecorder) Context() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Context", reflect.TypeOf((*MockLeasedLock)(nil).Context))
+}
+
+// Release mocks base method.
+func (m *MockLeasedLock) Release(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Release", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Release indicates an expected call of Release.
+func (mr *MockLeasedLockMockRecorder) Release(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockLeasedLock)(nil).Release), arg0)
+}
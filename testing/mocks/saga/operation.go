@@ -0,0 +1,109 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/go-foreman/foreman/saga (interfaces: OperationStore)
+
+// Package saga is a generated GoMock package.
+package saga
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	saga "github.com/go-foreman/foreman/saga"
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockOperationStore is a mock of OperationStore interface.
+type MockOperationStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockOperationStoreMockRecorder
+}
+
+// MockOperationStoreMockRecorder is the mock recorder for MockOperationStore.
+type MockOperationStoreMockRecorder struct {
+	mock *MockOperationStore
+}
+
+// NewMockOperationStore creates a new mock instance.
+func NewMockOperationStore(ctrl *gomock.Controller) *MockOperationStore {
+	mock := &MockOperationStore{ctrl: ctrl}
+	mock.recorder = &MockOperationStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOperationStore) EXPECT() *MockOperationStoreMockRecorder {
+	return m.recorder
+}
+
+// CreateOperation mocks base method.
+func (m *MockOperationStore) CreateOperation(arg0 context.Context, arg1 *saga.Operation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOperation", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateOperation indicates an expected call of CreateOperation.
+func (mr *MockOperationStoreMockRecorder) CreateOperation(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOperation", reflect.TypeOf((*MockOperationStore)(nil).CreateOperation), arg0, arg1)
+}
+
+// FinishOperation mocks base method.
+func (m *MockOperationStore) FinishOperation(arg0 context.Context, arg1 string, arg2 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishOperation", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishOperation indicates an expected call of FinishOperation.
+func (mr *MockOperationStoreMockRecorder) FinishOperation(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishOperation", reflect.TypeOf((*MockOperationStore)(nil).FinishOperation), arg0, arg1, arg2)
+}
+
+// GetOperation mocks base method.
+func (m *MockOperationStore) GetOperation(arg0 context.Context, arg1 string) (*saga.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOperation", arg0, arg1)
+	ret0, _ := ret[0].(*saga.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOperation indicates an expected call of GetOperation.
+func (mr *MockOperationStoreMockRecorder) GetOperation(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOperation", reflect.TypeOf((*MockOperationStore)(nil).GetOperation), arg0, arg1)
+}
+
+// GetUnfinishedOperations mocks base method.
+func (m *MockOperationStore) GetUnfinishedOperations(arg0 context.Context) ([]*saga.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUnfinishedOperations", arg0)
+	ret0, _ := ret[0].([]*saga.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUnfinishedOperations indicates an expected call of GetUnfinishedOperations.
+func (mr *MockOperationStoreMockRecorder) GetUnfinishedOperations(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnfinishedOperations", reflect.TypeOf((*MockOperationStore)(nil).GetUnfinishedOperations), arg0)
+}
+
+// SetItemResult mocks base method.
+func (m *MockOperationStore) SetItemResult(arg0 context.Context, arg1 string, arg2 saga.OperationItem) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetItemResult", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetItemResult indicates an expected call of SetItemResult.
+func (mr *MockOperationStoreMockRecorder) SetItemResult(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetItemResult", reflect.TypeOf((*MockOperationStore)(nil).SetItemResult), arg0, arg1, arg2)
+}
@@ -35,6 +35,32 @@ func (m *MockSaga) EXPECT() *MockSagaMockRecorder {
 	return m.recorder
 }
 
+// CancelTimeout mocks base method.
+func (m *MockSaga) CancelTimeout(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "CancelTimeout", arg0)
+}
+
+// CancelTimeout indicates an expected call of CancelTimeout.
+func (mr *MockSagaMockRecorder) CancelTimeout(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelTimeout", reflect.TypeOf((*MockSaga)(nil).CancelTimeout), arg0)
+}
+
+// ChildCompensations mocks base method.
+func (m *MockSaga) ChildCompensations() map[string]saga.ChildCompensationResult {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChildCompensations")
+	ret0, _ := ret[0].(map[string]saga.ChildCompensationResult)
+	return ret0
+}
+
+// ChildCompensations indicates an expected call of ChildCompensations.
+func (mr *MockSagaMockRecorder) ChildCompensations() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChildCompensations", reflect.TypeOf((*MockSaga)(nil).ChildCompensations))
+}
+
 // Compensate mocks base method.
 func (m *MockSaga) Compensate(arg0 saga.SagaContext) error {
 	m.ctrl.T.Helper()
@@ -63,6 +89,20 @@ func (mr *MockSagaMockRecorder) EventHandlers() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EventHandlers", reflect.TypeOf((*MockSaga)(nil).EventHandlers))
 }
 
+// Expectations mocks base method.
+func (m *MockSaga) Expectations() map[string]saga.Expectation {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Expectations")
+	ret0, _ := ret[0].(map[string]saga.Expectation)
+	return ret0
+}
+
+// Expectations indicates an expected call of Expectations.
+func (mr *MockSagaMockRecorder) Expectations() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Expectations", reflect.TypeOf((*MockSaga)(nil).Expectations))
+}
+
 // GroupKind mocks base method.
 func (m *MockSaga) GroupKind() scheme.GroupKind {
 	m.ctrl.T.Helper()
@@ -103,6 +143,30 @@ func (mr *MockSagaMockRecorder) Recover(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*MockSaga)(nil).Recover), arg0)
 }
 
+// SetChildCompensations mocks base method.
+func (m *MockSaga) SetChildCompensations(arg0 map[string]saga.ChildCompensationResult) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetChildCompensations", arg0)
+}
+
+// SetChildCompensations indicates an expected call of SetChildCompensations.
+func (mr *MockSagaMockRecorder) SetChildCompensations(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetChildCompensations", reflect.TypeOf((*MockSaga)(nil).SetChildCompensations), arg0)
+}
+
+// SetExpectations mocks base method.
+func (m *MockSaga) SetExpectations(arg0 map[string]saga.Expectation) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetExpectations", arg0)
+}
+
+// SetExpectations indicates an expected call of SetExpectations.
+func (mr *MockSagaMockRecorder) SetExpectations(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetExpectations", reflect.TypeOf((*MockSaga)(nil).SetExpectations), arg0)
+}
+
 // SetGroupKind mocks base method.
 func (m *MockSaga) SetGroupKind(arg0 *scheme.GroupKind) {
 	m.ctrl.T.Helper()
@@ -140,3 +204,31 @@ func (mr *MockSagaMockRecorder) Start(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockSaga)(nil).Start), arg0)
 }
+
+// TimeoutHandlers mocks base method.
+func (m *MockSaga) TimeoutHandlers() map[string]saga.Executor {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TimeoutHandlers")
+	ret0, _ := ret[0].(map[string]saga.Executor)
+	return ret0
+}
+
+// TimeoutHandlers indicates an expected call of TimeoutHandlers.
+func (mr *MockSagaMockRecorder) TimeoutHandlers() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TimeoutHandlers", reflect.TypeOf((*MockSaga)(nil).TimeoutHandlers))
+}
+
+// TimeoutPending mocks base method.
+func (m *MockSaga) TimeoutPending(arg0, arg1 string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TimeoutPending", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// TimeoutPending indicates an expected call of TimeoutPending.
+func (mr *MockSagaMockRecorder) TimeoutPending(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TimeoutPending", reflect.TypeOf((*MockSaga)(nil).TimeoutPending), arg0, arg1)
+}
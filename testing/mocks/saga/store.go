@@ -7,6 +7,7 @@ package saga
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	saga "github.com/go-foreman/foreman/saga"
 	gomock "github.com/golang/mock/gomock"
@@ -63,6 +64,61 @@ func (mr *MockStoreMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockStore)(nil).Delete), arg0, arg1)
 }
 
+// DeleteByFilter mocks base method.
+func (m *MockStore) DeleteByFilter(arg0 context.Context, arg1 ...saga.FilterOption) (int, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0}
+	for _, a := range arg1 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DeleteByFilter", varargs...)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteByFilter indicates an expected call of DeleteByFilter.
+func (mr *MockStoreMockRecorder) DeleteByFilter(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0}, arg1...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteByFilter", reflect.TypeOf((*MockStore)(nil).DeleteByFilter), varargs...)
+}
+
+// DeleteOlderThan mocks base method.
+func (m *MockStore) DeleteOlderThan(arg0 context.Context, arg1 time.Time, arg2 ...saga.DeleteOption) (int, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DeleteOlderThan", varargs...)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteOlderThan indicates an expected call of DeleteOlderThan.
+func (mr *MockStoreMockRecorder) DeleteOlderThan(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteOlderThan", reflect.TypeOf((*MockStore)(nil).DeleteOlderThan), varargs...)
+}
+
+// GetByCorrelation mocks base method.
+func (m *MockStore) GetByCorrelation(arg0 context.Context, arg1, arg2, arg3 string) (saga.Instance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByCorrelation", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(saga.Instance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByCorrelation indicates an expected call of GetByCorrelation.
+func (mr *MockStoreMockRecorder) GetByCorrelation(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByCorrelation", reflect.TypeOf((*MockStore)(nil).GetByCorrelation), arg0, arg1, arg2, arg3)
+}
+
 // GetByFilter mocks base method.
 func (m *MockStore) GetByFilter(arg0 context.Context, arg1 ...saga.FilterOption) (*saga.InstancesBatch, error) {
 	m.ctrl.T.Helper()
@@ -111,3 +167,17 @@ func (mr *MockStoreMockRecorder) Update(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockStore)(nil).Update), arg0, arg1)
 }
+
+// UpdateIfVersion mocks base method.
+func (m *MockStore) UpdateIfVersion(arg0 context.Context, arg1 saga.Instance, arg2 int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateIfVersion", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateIfVersion indicates an expected call of UpdateIfVersion.
+func (mr *MockStoreMockRecorder) UpdateIfVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateIfVersion", reflect.TypeOf((*MockStore)(nil).UpdateIfVersion), arg0, arg1, arg2)
+}